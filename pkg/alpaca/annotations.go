@@ -0,0 +1,167 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// annotation is a note, registered by an external tool, that applies to all requests made during
+// a time window (e.g. "this burst is the nightly backup").
+type annotation struct {
+	ID    int       `json:"id"`
+	Text  string    `json:"text"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type annotationRequest struct {
+	Text     string    `json:"text"`
+	Start    time.Time `json:"start"`              // Defaults to now
+	End      time.Time `json:"end"`                // Either end or duration is required
+	Duration string    `json:"duration,omitempty"` // e.g. "2h"
+}
+
+// annotations keeps track of annotations, and logs the ones that are active for each request.
+type annotations struct {
+	byID   map[int]annotation
+	nextID int
+	now    func() time.Time
+	mux    sync.Mutex
+}
+
+func newAnnotations() *annotations {
+	return &annotations{byID: make(map[int]annotation), nextID: 1, now: time.Now}
+}
+
+func (a *annotations) add(text string, start, end time.Time) annotation {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	an := annotation{ID: a.nextID, Text: text, Start: start, End: end}
+	a.byID[an.ID] = an
+	a.nextID++
+	return an
+}
+
+func (a *annotations) remove(id int) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	_, ok := a.byID[id]
+	delete(a.byID, id)
+	return ok
+}
+
+// list returns the annotations that haven't ended yet, in the order they were added. Annotations
+// that have ended are forgotten.
+func (a *annotations) list() []annotation {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	now := a.now()
+	list := []annotation{}
+	for id, an := range a.byID {
+		if !now.Before(an.End) {
+			delete(a.byID, id)
+			continue
+		}
+		list = append(list, an)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// active returns the text of the annotations that apply right now.
+func (a *annotations) active() []string {
+	now := a.now()
+	var texts []string
+	for _, an := range a.list() {
+		if !now.Before(an.Start) {
+			texts = append(texts, strconv.Quote(an.Text))
+		}
+	}
+	return texts
+}
+
+func (a *annotations) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if texts := a.active(); len(texts) > 0 {
+			log.Printf("[%d] Annotated: %s", req.Context().Value(contextKeyID),
+				strings.Join(texts, ", "))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (a *annotations) SetupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/alpaca/api/annotations", localhostOnly(a.handleAnnotations))
+}
+
+func (a *annotations) handleAnnotations(w http.ResponseWriter, req *http.Request) {
+	// This API is meant for scripts and other tools, not for web pages.
+	if req.Header.Get("Origin") != "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.list())
+	case http.MethodPost:
+		var body annotationRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		} else if body.Text == "" {
+			writeJSONError(w, http.StatusBadRequest, "request body must set text")
+			return
+		}
+		if body.Start.IsZero() {
+			body.Start = a.now()
+		}
+		if body.Duration != "" {
+			d, err := time.ParseDuration(body.Duration)
+			if err != nil || d <= 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid duration")
+				return
+			}
+			body.End = body.Start.Add(d)
+		}
+		if !body.End.After(body.Start) {
+			writeJSONError(w, http.StatusBadRequest, "request body must set an end (or "+
+				"duration) after the start")
+			return
+		}
+		an := a.add(body.Text, body.Start, body.End)
+		log.Printf("Added annotation %d (%q) from %v to %v", an.ID, an.Text, an.Start, an.End)
+		writeJSON(w, http.StatusCreated, an)
+	case http.MethodDelete:
+		id, err := strconv.Atoi(req.URL.Query().Get("id"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "id parameter must be a number")
+			return
+		} else if !a.remove(id) {
+			writeJSONError(w, http.StatusNotFound, "no such annotation")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
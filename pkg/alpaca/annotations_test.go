@@ -0,0 +1,119 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAnnotations() (*annotations, *http.ServeMux, *time.Time) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := newAnnotations()
+	a.now = func() time.Time { return now }
+	mux := http.NewServeMux()
+	a.SetupHandlers(mux)
+	return a, mux, &now
+}
+
+func TestAddAndListAnnotations(t *testing.T) {
+	a, mux, now := newTestAnnotations()
+	w := callExtensionAPI(mux, http.MethodPost, "/alpaca/api/annotations",
+		`{"text": "nightly backup", "duration": "1h"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var added annotation
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&added))
+	assert.Equal(t, "nightly backup", added.Text)
+	assert.Equal(t, now.Add(time.Hour), added.End)
+
+	w = callExtensionAPI(mux, http.MethodGet, "/alpaca/api/annotations", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list []annotation
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Equal(t, []annotation{added}, list)
+	assert.Equal(t, []string{`"nightly backup"`}, a.active())
+
+	// Once the annotation has ended, it's forgotten.
+	*now = now.Add(time.Hour)
+	assert.Empty(t, a.list())
+	assert.Empty(t, a.active())
+}
+
+func TestFutureAnnotationIsNotActive(t *testing.T) {
+	a, _, now := newTestAnnotations()
+	a.add("load test", now.Add(time.Hour), now.Add(2*time.Hour))
+	assert.Len(t, a.list(), 1)
+	assert.Empty(t, a.active())
+	*now = now.Add(90 * time.Minute)
+	assert.Equal(t, []string{`"load test"`}, a.active())
+}
+
+func TestDeleteAnnotation(t *testing.T) {
+	a, mux, now := newTestAnnotations()
+	an := a.add("nightly backup", *now, now.Add(time.Hour))
+	require.Equal(t, 1, an.ID)
+	w := callExtensionAPI(mux, http.MethodDelete, "/alpaca/api/annotations?id=1", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, a.list())
+	w = callExtensionAPI(mux, http.MethodDelete, "/alpaca/api/annotations?id=1", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestInvalidAnnotations(t *testing.T) {
+	_, mux, _ := newTestAnnotations()
+	for _, body := range []string{
+		`not json`,
+		`{"duration": "1h"}`,
+		`{"text": "no end"}`,
+		`{"text": "bad duration", "duration": "soon"}`,
+		`{"text": "ends before it starts", "start": "2024-01-01T12:00:00Z",
+		  "end": "2024-01-01T11:00:00Z"}`,
+	} {
+		w := callExtensionAPI(mux, http.MethodPost, "/alpaca/api/annotations", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
+
+func TestAnnotationsRejectBrowsers(t *testing.T) {
+	_, mux, _ := newTestAnnotations()
+	req := httptest.NewRequest(http.MethodPost, "/alpaca/api/annotations",
+		strings.NewReader(`{"text": "x", "duration": "1h"}`))
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.Header.Set("Origin", "https://evil.test")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestAnnotationsAreLogged(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	a, _, now := newTestAnnotations()
+	a.add("nightly backup", *now, now.Add(time.Hour))
+	handler := AddContextID(a.WrapHandler(http.NotFoundHandler()))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Contains(t, buf.String(), `[1] Annotated: "nightly backup"`)
+}
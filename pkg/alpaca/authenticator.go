@@ -0,0 +1,192 @@
+// Copyright 2019, 2021, 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/samuong/go-ntlmssp"
+)
+
+// proxyAuth authenticates requests to an upstream proxy. The request is sent using rt, which
+// must keep using the same connection for each round trip, since NTLM authenticates connections
+// rather than requests.
+type proxyAuth interface {
+	do(req *http.Request, rt http.RoundTripper) (*http.Response, error)
+}
+
+type authenticator struct {
+	domain   string
+	username string
+	hash     []byte
+	password string // If known; needed for Digest and Basic auth (see chooseScheme)
+}
+
+func (a authenticator) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	scheme := "NTLM"
+	switch authSchemesFor(req).choose(req, a) {
+	case "negotiate":
+		scheme = "Negotiate"
+	case "digest":
+		return a.digest(req, rt)
+	case "basic":
+		return a.basic(req, rt)
+	}
+	hostname, _ := os.Hostname() // in case of error, just use the zero value ("") as hostname
+	negotiate, err := ntlmssp.NewNegotiateMessage(a.domain, hostname)
+	if err != nil {
+		log.Printf("Error creating NTLM Type 1 (Negotiate) message: %v", err)
+		return nil, err
+	}
+	return ntlmHandshake(req, rt, scheme, negotiate, func(challenge []byte) ([]byte, error) {
+		return ntlmssp.ProcessChallengeWithHash(challenge, a.domain, a.username, a.hash)
+	})
+}
+
+// ntlmHandshake sends req with the given NTLM Type 1 (Negotiate) message, and then again with the
+// Type 3 (Authenticate) message that processChallenge returns for the proxy's challenge. The
+// messages are sent using the given scheme: either "NTLM", or "Negotiate" (which wraps them).
+//
+// NTLM authenticates a connection rather than a request, so a handshake that stops part-way
+// through leaves the proxy waiting for the rest of it, and the next (unrelated) request sent on
+// that connection is rejected with a 407. So once the proxy has sent its challenge, every
+// connection used for the handshake is closed, except the one that the handshake succeeded on.
+func ntlmHandshake(req *http.Request, rt http.RoundTripper, scheme string, negotiate []byte,
+	processChallenge func(challenge []byte) ([]byte, error)) (*http.Response, error) {
+	id := req.Context().Value(contextKeyID)
+	var conns handshakeConns
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), conns.trace()))
+	req.Header.Set("Proxy-Authorization", scheme+" "+base64.StdEncoding.EncodeToString(negotiate))
+	debugf("auth", "[%d] Sending NTLM Type 1 (Negotiate) message using %s", id, scheme)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		log.Printf("Error sending NTLM Type 1 (Negotiate) request: %v", err)
+		return nil, err
+	} else if resp.StatusCode != http.StatusProxyAuthRequired && scheme == "Negotiate" {
+		// With Kerberos (which SSPI may choose for Negotiate), one message is enough.
+		debugf("auth", "[%d] Negotiate handshake succeeded (got %s)", id, resp.Status)
+		return resp, nil
+	} else if resp.StatusCode != http.StatusProxyAuthRequired {
+		log.Printf("Expected response with status 407, got %s", resp.Status)
+		return resp, nil
+	}
+	resp.Body.Close()
+	challenge, err := base64.StdEncoding.DecodeString(authChallenge(resp.Header, scheme))
+	if err != nil {
+		log.Printf("Error decoding NTLM Type 2 (Challenge) message: %v", err)
+		conns.closeExcept(nil)
+		return nil, err
+	}
+	debugf("auth", "[%d] Got NTLM Type 2 (Challenge) message (%d bytes)", id, len(challenge))
+	authenticate, err := processChallenge(challenge)
+	if err != nil {
+		log.Printf("Error processing NTLM Type 2 (Challenge) message: %v", err)
+		conns.closeExcept(nil)
+		return nil, err
+	}
+	if req.GetBody != nil {
+		// The body might have been sent with the Type 1 message.
+		body, err := req.GetBody()
+		if err != nil {
+			log.Printf("Error resetting request body: %v", err)
+			conns.closeExcept(nil)
+			return nil, err
+		}
+		req.Body = body
+	}
+	req.Header.Set("Proxy-Authorization",
+		scheme+" "+base64.StdEncoding.EncodeToString(authenticate))
+	debugf("auth", "[%d] Sending NTLM Type 3 (Authenticate) message", id)
+	resp, err = rt.RoundTrip(req)
+	if err != nil {
+		conns.closeExcept(nil)
+		return nil, err
+	} else if resp.StatusCode == http.StatusProxyAuthRequired {
+		// The connection is closed once the caller is done with the response.
+		log.Printf("NTLM handshake rejected, closing connection")
+		resp.Body = &closeConnsBody{resp.Body, &conns}
+		return resp, nil
+	}
+	debugf("auth", "[%d] NTLM handshake succeeded (got %s)", id, resp.Status)
+	conns.closeExcept(conns.last())
+	return resp, nil
+}
+
+// handshakeConns records the connections that an http.Transport uses for an NTLM handshake. (A
+// CONNECT request's handshake is sent on a single connection, which connectViaProxy closes unless
+// the handshake succeeds.)
+type handshakeConns struct {
+	conns []net.Conn
+	mux   sync.Mutex
+}
+
+func (hc *handshakeConns) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		hc.mux.Lock()
+		defer hc.mux.Unlock()
+		if !slices.Contains(hc.conns, info.Conn) {
+			hc.conns = append(hc.conns, info.Conn)
+		}
+	}}
+}
+
+// last returns the connection used for the last request, or nil.
+func (hc *handshakeConns) last() net.Conn {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	if len(hc.conns) == 0 {
+		return nil
+	}
+	return hc.conns[len(hc.conns)-1]
+}
+
+// closeExcept closes all of the connections other than keep, so that the transport doesn't use
+// them for any more requests.
+func (hc *handshakeConns) closeExcept(keep net.Conn) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	for _, conn := range hc.conns {
+		if conn != keep {
+			conn.Close()
+		}
+	}
+}
+
+// closeConnsBody is the body of a response to a failed NTLM handshake. Closing it also closes the
+// connections that the handshake used.
+type closeConnsBody struct {
+	io.ReadCloser
+	conns *handshakeConns
+}
+
+func (b *closeConnsBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conns.closeExcept(nil)
+	return err
+}
+
+func (a authenticator) String() string {
+	return fmt.Sprintf("%s@%s:%s", a.username, a.domain, hex.EncodeToString(a.hash))
+}
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package alpaca
 
 import (
 	"bytes"
@@ -65,7 +65,7 @@ func sendProxyAuthRequired(w http.ResponseWriter) {
 }
 
 func sendChallengeResponse(w http.ResponseWriter) {
-	w.Header().Set("Proxy-Authenticate", "NTLM TlRMTVNTUAACAAAADAAMADgAAAAFgomi+Rp9UDbAycMAAAAAAAAAAKIAogBEAAAABgEAAAAAAA9HAEwATwBCAEEATAACAAwARwBMAE8AQgBBAEwAAQAeAFAAWABZAEEAVQAwADAAMgBNAEUATAAwADEAMAAzAAQAHABnAGwAbwBiAGEAbAAuAGEAbgB6AC4AYwBvAG0AAwA8AHAAeAB5AGEAdQAwADAAMgBtAGUAbAAwADEAMAAzAC4AZwBsAG8AYgBhAGwALgBhAG4AegAuAGMAbwBtAAcACABQ7ZOkOQbVAQAAAAA=")
+	w.Header().Set("Proxy-Authenticate", ntlmChallenge)
 	w.WriteHeader(http.StatusProxyAuthRequired)
 }
 
@@ -80,7 +80,7 @@ func TestNtlmAuth(t *testing.T) {
 	require.NoError(t, err)
 	require.NoError(t, resp.Body.Close())
 	require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
-	auth := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest")}
+	auth := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""}
 	resp, err = auth.do(req, tr)
 	require.NoError(t, err)
 	defer resp.Body.Close()
@@ -89,3 +89,73 @@ func TestNtlmAuth(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "Access granted", string(body))
 }
+
+// remoteAddrServer responds to NTLM handshakes like ntlmServer, but sends the given challenge and
+// status in response to the Type 1 and Type 3 messages. It records the remote address of each
+// request, so that tests can tell which requests were sent on the same connection.
+type remoteAddrServer struct {
+	t         *testing.T
+	challenge string
+	status    int // The status of the response to a Type 3 message
+	addrs     []string
+}
+
+func (s *remoteAddrServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.addrs = append(s.addrs, req.RemoteAddr)
+	hdr := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(hdr, "NTLM ") {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	msg, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hdr, "NTLM "))
+	require.NoError(s.t, err)
+	if binary.LittleEndian.Uint32(msg[8:12]) == 1 {
+		w.Header().Set("Proxy-Authenticate", s.challenge)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	w.WriteHeader(s.status)
+}
+
+func TestNtlmHandshakeConnectionReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge string
+		status    int
+		wantErr   bool
+		reuse     bool // Whether the next request should be sent on the same connection
+	}{
+		{"Success", ntlmChallenge, http.StatusOK, false, true},
+		{"Rejected", ntlmChallenge, http.StatusProxyAuthRequired, false, false},
+		{"BadChallenge", "NTLM !!!", 0, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &remoteAddrServer{t: t, challenge: test.challenge, status: test.status}
+			server := httptest.NewServer(s)
+			defer server.Close()
+			serverAddr := server.Listener.Addr().String()
+			tr := &http.Transport{Proxy: http.ProxyURL(&url.URL{Host: serverAddr})}
+			defer tr.CloseIdleConnections()
+			req, err := http.NewRequest(http.MethodGet, "http://"+serverAddr, nil)
+			require.NoError(t, err)
+			auth := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""}
+			resp, err := auth.do(req, tr)
+			if test.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+			}
+			req, err = http.NewRequest(http.MethodGet, "http://"+serverAddr, nil)
+			require.NoError(t, err)
+			resp, err = tr.RoundTrip(req)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			n := len(s.addrs)
+			require.GreaterOrEqual(t, n, 2)
+			assert.Equal(t, test.reuse, s.addrs[n-1] == s.addrs[n-2])
+		})
+	}
+}
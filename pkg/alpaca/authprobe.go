@@ -0,0 +1,142 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authProbeURL is the URL that the auth probe asks proxies for. Proxies that need credentials ask
+// for them before looking at the URL, so it's never fetched from those.
+const authProbeURL = "http://www.example.com/"
+
+// authProbeTimeout is how long the auth probe waits for a proxy to respond.
+const authProbeTimeout = 10 * time.Second
+
+// pacProxies matches the proxies in a PAC file's results, such as "PROXY proxy.example.com:8080".
+// Only proxies that appear literally in the PAC file are found this way.
+var pacProxies = regexp.MustCompile(`\b(PROXY|HTTPS?)\s+([A-Za-z0-9.\-\[\]:]+:[0-9]+)`)
+
+// authProber sends a request without credentials to each upstream proxy that's in the PAC file
+// (when it's loaded or changes), or that's chosen for a request, the first time it's seen. The
+// response shows whether the proxy needs credentials, and which auth schemes it offers, which
+// are remembered (see authSchemeCache) and logged. This way, a proxy that wants credentials
+// Alpaca doesn't have, or a scheme Alpaca doesn't support, shows up in the log straight away,
+// rather than as a mysterious failure of the first request.
+type authProber struct {
+	auth    proxyAuth        // To tell whether Alpaca has credentials to offer
+	schemes *authSchemeCache // Where the offered schemes are recorded
+	send    func(proxy *url.URL, req *http.Request) (*http.Response, error)
+	mux     sync.Mutex
+	probed  map[string]bool // By proxy address
+}
+
+// newAuthProber returns an authProber that connects to proxies using dial, and records the schemes
+// that they offer in schemes.
+func newAuthProber(auth proxyAuth, dial dialFunc, schemes *authSchemeCache) *authProber {
+	send := func(proxy *url.URL, req *http.Request) (*http.Response, error) {
+		return sendAuthProbe(dial, proxy, req)
+	}
+	return &authProber{auth: auth, schemes: schemes, send: send, probed: make(map[string]bool)}
+}
+
+// probe probes each of the proxies that hasn't been probed yet, in the background. Nil entries
+// (i.e. DIRECT) are skipped.
+func (ap *authProber) probe(proxies ...*url.URL) {
+	ap.mux.Lock()
+	defer ap.mux.Unlock()
+	for _, proxy := range proxies {
+		if proxy == nil || ap.probed[proxy.Host] {
+			continue
+		}
+		ap.probed[proxy.Host] = true
+		go ap.probeNow(proxy)
+	}
+}
+
+// probePAC probes the proxies that appear in a PAC file.
+func (ap *authProber) probePAC(pacjs []byte) {
+	var proxies []*url.URL
+	for _, m := range pacProxies.FindAllSubmatch(pacjs, -1) {
+		scheme := "http"
+		if string(m[1]) == "HTTPS" {
+			scheme = "https"
+		}
+		proxy := &url.URL{Scheme: scheme, Host: string(m[2])}
+		if _, _, err := net.SplitHostPort(proxy.Host); err == nil {
+			proxies = append(proxies, proxy)
+		}
+	}
+	ap.probe(proxies...)
+}
+
+func (ap *authProber) probeNow(proxy *url.URL) {
+	req, err := http.NewRequest(http.MethodHead, authProbeURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := ap.send(proxy, req)
+	if err != nil {
+		log.Printf("Couldn't probe proxy %s for its auth schemes: %v", proxy.Host, err)
+		// Try again the next time it's used.
+		ap.mux.Lock()
+		delete(ap.probed, proxy.Host)
+		ap.mux.Unlock()
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		log.Printf("Proxy %s doesn't ask for credentials (probe got %q)", proxy.Host, resp.Status)
+		return
+	}
+	ap.schemes.remember(proxy, resp.Header)
+	offered := parseAuthSchemes(resp.Header)
+	if !slices.ContainsFunc(offered, func(s string) bool {
+		return slices.Contains(authSchemePreference, s)
+	}) {
+		log.Printf("Proxy %s asks for credentials, but doesn't offer any auth scheme that "+
+			"Alpaca supports (offered: %s)", proxy.Host, strings.Join(offered, ", "))
+	} else if !authEnabled(ap.auth) {
+		log.Printf("Proxy %s asks for credentials (offered: %s), but Alpaca doesn't have any",
+			proxy.Host, strings.Join(offered, ", "))
+	} else {
+		log.Printf("Proxy %s asks for credentials (offered: %s)", proxy.Host,
+			strings.Join(offered, ", "))
+	}
+}
+
+// sendAuthProbe sends req to proxy, on a connection of its own. The response has no body (since
+// the request is a HEAD request), so the connection is closed straight away.
+func sendAuthProbe(dial dialFunc, proxy *url.URL, req *http.Request) (*http.Response, error) {
+	tr := transport{dialContext: dial}
+	if err := tr.dial(proxy); err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+	_ = tr.conn.SetDeadline(time.Now().Add(authProbeTimeout))
+	req.Header.Set("Connection", "close")
+	if err := req.WriteProxy(tr.conn); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(tr.reader, req)
+}
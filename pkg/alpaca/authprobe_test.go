@@ -0,0 +1,133 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthProbe(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(io.Discard)
+	var requests []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Method+" "+req.RequestURI)
+		w.Header().Add("Proxy-Authenticate", "Negotiate")
+		w.Header().Add("Proxy-Authenticate", `NTLM, Basic realm="corp"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+	open := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer open.Close()
+	proxyURL := &url.URL{Scheme: "http", Host: proxy.Listener.Addr().String()}
+	schemes := newAuthSchemeCache()
+
+	newAuthProber(nil, dialNAT64, schemes).probeNow(proxyURL)
+	assert.Equal(t, []string{"HEAD " + authProbeURL}, requests)
+	assert.Equal(t, []string{"negotiate", "ntlm", "basic"}, schemes.offered[proxyURL.Host])
+	assert.Contains(t, logs.String(), "Proxy "+proxyURL.Host+" asks for credentials "+
+		"(offered: negotiate, ntlm, basic), but Alpaca doesn't have any")
+
+	a := &authenticator{domain: "corp", username: "malory", hash: []byte("hash")}
+	newAuthProber(a, dialNAT64, newAuthSchemeCache()).probeNow(proxyURL)
+	assert.Contains(t, logs.String(), "Proxy "+proxyURL.Host+" asks for credentials "+
+		"(offered: negotiate, ntlm, basic)\n")
+
+	openURL := &url.URL{Scheme: "http", Host: open.Listener.Addr().String()}
+	newAuthProber(a, dialNAT64, newAuthSchemeCache()).probeNow(openURL)
+	assert.Contains(t, logs.String(), "Proxy "+openURL.Host+` doesn't ask for credentials `+
+		`(probe got "200 OK")`)
+}
+
+func TestAuthProbeUnsupportedScheme(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(io.Discard)
+	ap := newAuthProber(nil, dialNAT64, newAuthSchemeCache())
+	ap.send = func(*url.URL, *http.Request) (*http.Response, error) {
+		header := make(http.Header)
+		header.Set("Proxy-Authenticate", "Bearer")
+		return &http.Response{StatusCode: http.StatusProxyAuthRequired, Header: header,
+			Body: http.NoBody}, nil
+	}
+	proxy := &url.URL{Scheme: "http", Host: "proxy.test:8080"}
+	ap.probeNow(proxy)
+	assert.Contains(t, logs.String(), "Proxy proxy.test:8080 asks for credentials, but doesn't "+
+		"offer any auth scheme that Alpaca supports (offered: bearer)")
+}
+
+func TestAuthProbeOnce(t *testing.T) {
+	var mux sync.Mutex
+	var probed []string
+	fail := true
+	done := make(chan struct{}, 10)
+	ap := newAuthProber(nil, dialNAT64, newAuthSchemeCache())
+	ap.send = func(proxy *url.URL, _ *http.Request) (*http.Response, error) {
+		defer func() { done <- struct{}{} }()
+		mux.Lock()
+		defer mux.Unlock()
+		probed = append(probed, proxy.String())
+		if fail && proxy.Host == "down.test:80" {
+			fail = false
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}
+	wait := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for probes")
+			}
+		}
+	}
+	ap.probePAC([]byte(`function FindProxyForURL(url, host) {
+		if (host == "a") return "PROXY proxy.test:8080; HTTPS secure.test:443; DIRECT";
+		return "PROXY down.test:80";
+	}`))
+	wait(3)
+	require.Eventually(t, func() bool {
+		ap.mux.Lock()
+		defer ap.mux.Unlock()
+		return !ap.probed["down.test:80"]
+	}, 5*time.Second, time.Millisecond)
+	ap.probe(nil, &url.URL{Scheme: "http", Host: "proxy.test:8080"},
+		&url.URL{Scheme: "http", Host: "down.test:80"}, &url.URL{Scheme: "http", Host: "new.test:80"})
+	wait(2)
+	slices.Sort(probed)
+	assert.Equal(t, []string{
+		"http://down.test:80", // Probed again, since the first probe failed
+		"http://down.test:80",
+		"http://new.test:80",
+		"http://proxy.test:8080",
+		"https://secure.test:443",
+	}, probed)
+	require.Len(t, done, 0)
+}
@@ -0,0 +1,304 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The auth schemes that Alpaca supports, from strongest to weakest. Negotiate is done using NTLM
+// tokens (which proxies accept, when Kerberos isn't available). Digest and Basic need the
+// password, rather than just its NTLM hash, so they're only used if the password is known.
+var authSchemePreference = []string{"negotiate", "ntlm", "digest", "basic"}
+
+// authSchemeCache remembers which auth schemes each upstream proxy offered in its last "407 Proxy
+// Authentication Required" response, and the scheme that was chosen for it.
+type authSchemeCache struct {
+	offered map[string][]string // By proxy address
+	chosen  map[string]string
+	mux     sync.Mutex
+}
+
+// contextKeyAuthSchemes is the request context key for the authSchemeCache of the ProxyHandler
+// that's handling the request. Each server has its own, since the scheme that's chosen depends on
+// the server's credentials.
+const contextKeyAuthSchemes = contextKey("authSchemes")
+
+func newAuthSchemeCache() *authSchemeCache {
+	return &authSchemeCache{
+		offered: make(map[string][]string),
+		chosen:  make(map[string]string),
+	}
+}
+
+// authSchemesFor returns the authSchemeCache in req's context, or nil if there isn't one.
+func authSchemesFor(req *http.Request) *authSchemeCache {
+	c, _ := req.Context().Value(contextKeyAuthSchemes).(*authSchemeCache)
+	return c
+}
+
+// remember records the schemes in the Proxy-Authenticate headers of a 407 response from proxy.
+func (c *authSchemeCache) remember(proxy *url.URL, header http.Header) {
+	if c == nil || proxy == nil {
+		return
+	}
+	schemes := parseAuthSchemes(header)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.offered[proxy.Host] = schemes
+}
+
+// offers returns whether the proxy that req is being sent to offered the given scheme (in lower
+// case) the last time that it asked for auth.
+func (c *authSchemeCache) offers(req *http.Request, scheme string) bool {
+	proxy, _ := req.Context().Value(contextKeyProxy).(*url.URL)
+	if c == nil || proxy == nil {
+		return false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return slices.Contains(c.offered[proxy.Host], scheme)
+}
+
+// choose returns the scheme to use with the proxy that req is being sent to. If the proxy's
+// schemes aren't known, it returns "ntlm".
+func (c *authSchemeCache) choose(req *http.Request, a authenticator) string {
+	proxy, _ := req.Context().Value(contextKeyProxy).(*url.URL)
+	if c == nil || proxy == nil {
+		return "ntlm"
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	scheme := a.chooseScheme(c.offered[proxy.Host])
+	if c.chosen[proxy.Host] != scheme {
+		log.Printf("Using %s auth for proxy %s (offered: %s)", scheme, proxy.Host,
+			strings.Join(c.offered[proxy.Host], ", "))
+		c.chosen[proxy.Host] = scheme
+	}
+	debugf("auth", "[%d] Using %s auth for proxy %s", req.Context().Value(contextKeyID), scheme,
+		proxy.Host)
+	return scheme
+}
+
+// chooseScheme returns the strongest of the offered schemes that can be used with a's
+// credentials, or "ntlm" if there isn't one.
+func (a authenticator) chooseScheme(offered []string) string {
+	for _, scheme := range authSchemePreference {
+		if !slices.Contains(offered, scheme) {
+			continue
+		} else if (scheme == "digest" || scheme == "basic") && a.password == "" {
+			continue
+		}
+		return scheme
+	}
+	return "ntlm"
+}
+
+// parseAuthSchemes returns the (lower-case) names of the auth schemes in a response's
+// Proxy-Authenticate headers. A header can hold several challenges, separated by commas, which
+// are told apart from the parameters of a challenge (e.g. realm="example") by not having an "=".
+func parseAuthSchemes(header http.Header) []string {
+	var schemes []string
+	for _, value := range header.Values("Proxy-Authenticate") {
+		for _, part := range splitUnquoted(value, ',') {
+			name, _, _ := strings.Cut(strings.TrimSpace(part), " ")
+			if name == "" || strings.Contains(name, "=") {
+				continue
+			}
+			name = strings.ToLower(name)
+			if !slices.Contains(schemes, name) {
+				schemes = append(schemes, name)
+			}
+		}
+	}
+	return schemes
+}
+
+// splitUnquoted splits s at each sep that isn't inside a quoted string.
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// authChallenge returns the challenge for the given scheme from a response's Proxy-Authenticate
+// headers (without the scheme's name), or "" if there isn't one.
+func authChallenge(header http.Header, scheme string) string {
+	for _, value := range header.Values("Proxy-Authenticate") {
+		name, challenge, _ := strings.Cut(strings.TrimSpace(value), " ")
+		if strings.EqualFold(name, scheme) {
+			return strings.TrimSpace(challenge)
+		}
+	}
+	return ""
+}
+
+// authUser returns the username to send with Basic or Digest auth.
+func (a authenticator) authUser() string {
+	if a.domain == "" {
+		return a.username
+	}
+	return a.domain + `\` + a.username
+}
+
+func (a authenticator) basic(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	creds := base64.StdEncoding.EncodeToString([]byte(a.authUser() + ":" + a.password))
+	debugf("auth", "[%d] Sending Basic credentials for %s", req.Context().Value(contextKeyID),
+		a.authUser())
+	req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	return rt.RoundTrip(req)
+}
+
+// digest sends req without credentials to get a fresh challenge (since it includes a nonce, which
+// the proxy only accepts for a while), and then again with the response to it (see RFC 7616).
+func (a authenticator) digest(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	req.Header.Del("Proxy-Authorization")
+	resp, err := rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, err
+	}
+	resp.Body.Close()
+	challenge := authChallenge(resp.Header, "Digest")
+	if challenge == "" {
+		return nil, errors.New("proxy didn't send a Digest challenge")
+	}
+	params := parseAuthParams(challenge)
+	debugf("auth", "[%d] Got Digest challenge (realm %q, algorithm %q, qop %q)",
+		req.Context().Value(contextKeyID), params["realm"], params["algorithm"], params["qop"])
+	authorization, err := a.digestAuthorization(req, params)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	}
+	req.Header.Set("Proxy-Authorization", authorization)
+	return rt.RoundTrip(req)
+}
+
+func (a authenticator) digestAuthorization(req *http.Request, params map[string]string) (string,
+	error) {
+	var newHash func() hash.Hash
+	algorithm := params["algorithm"]
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported Digest algorithm %q", algorithm)
+	}
+	h := func(s string) string {
+		hash := newHash()
+		hash.Write([]byte(s))
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	cnonce := hex.EncodeToString(buf)
+	uri := req.URL.String()
+	if req.Method == http.MethodConnect {
+		uri = req.Host
+	}
+	ha1 := h(a.authUser() + ":" + params["realm"] + ":" + a.password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + params["nonce"] + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+	fields := []string{
+		fmt.Sprintf("username=%q", a.authUser()),
+		fmt.Sprintf("realm=%q", params["realm"]),
+		fmt.Sprintf("nonce=%q", params["nonce"]),
+		fmt.Sprintf("uri=%q", uri),
+	}
+	if algorithm != "" {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+	if slices.Contains(strings.Split(strings.ReplaceAll(params["qop"], " ", ""), ","), "auth") {
+		const nc = "00000001" // Each handshake uses a new nonce
+		response := h(ha1 + ":" + params["nonce"] + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		fields = append(fields, fmt.Sprintf("response=%q", response), "qop=auth", "nc="+nc,
+			fmt.Sprintf("cnonce=%q", cnonce))
+	} else {
+		fields = append(fields,
+			fmt.Sprintf("response=%q", h(ha1+":"+params["nonce"]+":"+ha2)))
+	}
+	if opaque, ok := params["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf("opaque=%q", opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+// parseAuthParams parses the parameters of a challenge, e.g. `realm="example", qop="auth"`.
+func parseAuthParams(challenge string) map[string]string {
+	params := make(map[string]string)
+	for challenge != "" {
+		key, rest, ok := strings.Cut(challenge, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimSpace(rest)
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// A quoted string, which may contain commas and escaped characters.
+			var sb strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				sb.WriteByte(rest[i])
+			}
+			value = sb.String()
+			rest = rest[min(i+1, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+			rest = "," + rest
+		}
+		params[key] = value
+		_, challenge, _ = strings.Cut(rest, ",")
+	}
+	return params
+}
@@ -0,0 +1,186 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/samuong/go-ntlmssp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schemeServer is a proxy that offers the given auth schemes, and responds to a request that
+// authenticates successfully with the name of the scheme that was used.
+type schemeServer struct {
+	t       *testing.T
+	offered []string
+}
+
+func (s schemeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	scheme, creds, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	switch scheme {
+	case "":
+		for _, offer := range s.offered {
+			switch offer {
+			case "Digest":
+				offer = `Digest realm="alpaca", nonce="abc123", qop="auth", opaque="xyz"`
+			case "Basic":
+				offer = `Basic realm="alpaca"`
+			}
+			w.Header().Add("Proxy-Authenticate", offer)
+		}
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	case "NTLM", "Negotiate":
+		msg, err := base64.StdEncoding.DecodeString(creds)
+		require.NoError(s.t, err)
+		if binary.LittleEndian.Uint32(msg[8:12]) == 1 {
+			challenge := strings.TrimPrefix(ntlmChallenge, "NTLM ")
+			w.Header().Set("Proxy-Authenticate", scheme+" "+challenge)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	case "Basic":
+		assert.Equal(s.t, base64.StdEncoding.EncodeToString([]byte(`isis\malory:guest`)), creds)
+	case "Digest":
+		params := parseAuthParams(creds)
+		h := func(s string) string {
+			sum := md5.Sum([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+		ha1 := h(`isis\malory:alpaca:guest`)
+		ha2 := h(req.Method + ":" + params["uri"])
+		want := h(ha1 + ":abc123:" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		assert.Equal(s.t, want, params["response"])
+		assert.Equal(s.t, "xyz", params["opaque"])
+		assert.Equal(s.t, req.URL.String(), params["uri"])
+	}
+	_, err := io.WriteString(w, strings.ToLower(scheme))
+	require.NoError(s.t, err)
+}
+
+func TestAuthSchemeDetection(t *testing.T) {
+	tests := []struct {
+		name     string
+		offered  []string
+		password string
+		expected string
+	}{
+		{"NegotiateOverNTLM", []string{"NTLM", "Negotiate", "Basic"}, "guest", "negotiate"},
+		{"NTLM", []string{"Basic", "NTLM"}, "guest", "ntlm"},
+		{"Digest", []string{"Basic", "Digest"}, "guest", "digest"},
+		{"Basic", []string{"Basic"}, "guest", "basic"},
+		{"NoPassword", []string{"Basic"}, "", "ntlm"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(schemeServer{t, test.offered})
+			defer server.Close()
+			proxy := &url.URL{Host: server.Listener.Addr().String()}
+			tr := &http.Transport{Proxy: http.ProxyURL(proxy)}
+			req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			require.NoError(t, err)
+			schemes := newAuthSchemeCache()
+			ctx := context.WithValue(req.Context(), contextKeyProxy, proxy)
+			req = req.WithContext(context.WithValue(ctx, contextKeyAuthSchemes, schemes))
+			resp, err := tr.RoundTrip(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+			schemes.remember(proxy, resp.Header)
+			auth := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"),
+				test.password}
+			resp, err = auth.do(req, tr)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, test.expected, string(body))
+		})
+	}
+}
+
+func TestAuthSchemesArePerHandler(t *testing.T) {
+	// Two handlers with different credentials can choose different schemes for the same proxy.
+	parent := httptest.NewServer(schemeServer{t, []string{"Basic"}})
+	defer parent.Close()
+	parentURL := &url.URL{Host: parent.Listener.Addr().String()}
+	get := func(auth *authenticator) (ProxyHandler, string) {
+		ph := NewProxyHandler(auth, getProxyFromContext, func(string) {})
+		child := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+			req *http.Request) {
+			ctx := context.WithValue(req.Context(), contextKeyProxy, parentURL)
+			ph.ServeHTTP(w, req.WithContext(ctx))
+		}))
+		defer child.Close()
+		client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, child)}}
+		_, body := getBody(t, client, "http://www.test/")
+		return ph, body
+	}
+	withPassword, body := get(&authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"),
+		"guest"})
+	assert.Equal(t, "basic", body)
+	withoutPassword, body := get(&authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"),
+		""})
+	assert.Equal(t, "ntlm", body)
+	assert.Equal(t, "basic", withPassword.schemes.chosen[parentURL.Host])
+	assert.Equal(t, "ntlm", withoutPassword.schemes.chosen[parentURL.Host])
+}
+
+func TestParseAuthSchemes(t *testing.T) {
+	header := make(http.Header)
+	header.Add("Proxy-Authenticate", "Negotiate")
+	header.Add("Proxy-Authenticate", `Basic realm="a, \"b, c\"", Digest realm="c", nonce="d"`)
+	header.Add("Proxy-Authenticate", "NTLM")
+	assert.Equal(t, []string{"negotiate", "basic", "digest", "ntlm"}, parseAuthSchemes(header))
+}
+
+func TestAuthSchemesOffered(t *testing.T) {
+	c := newAuthSchemeCache()
+	proxy := &url.URL{Host: "proxy.test:8080"}
+	header := make(http.Header)
+	header.Add("Proxy-Authenticate", "Negotiate")
+	header.Add("Proxy-Authenticate", "NTLM")
+	c.remember(proxy, header)
+	req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+	assert.False(t, c.offers(req, "negotiate"))
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyProxy, proxy))
+	assert.True(t, c.offers(req, "negotiate"))
+	assert.True(t, c.offers(req, "ntlm"))
+	assert.False(t, c.offers(req, "basic"))
+	var unknown *authSchemeCache
+	assert.False(t, unknown.offers(req, "negotiate"))
+}
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`realm="a, \"b\"", nonce=abc , qop="auth,auth-int"`)
+	assert.Equal(t, map[string]string{
+		"realm": `a, "b"`,
+		"nonce": "abc",
+		"qop":   "auth,auth-int",
+	}, params)
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// blobDigest matches the sha256 digest in the URL of a content-addressed blob, e.g.
+// /v2/library/alpine/blobs/sha256:<digest> for a docker or OCI image layer.
+var blobDigest = regexp.MustCompile(`sha256[:/-]([0-9a-f]{64})(?:$|[/.])`)
+
+// blobCache keeps content-addressed blobs on disk, so that they don't have to be downloaded
+// through the proxy again. Since a blob's URL includes the sha256 digest of its content, a cached
+// copy never goes stale, and can be checked against the digest; blobs that don't match are never
+// stored (or served). Only plain HTTP requests can be cached, since anything else goes through an
+// encrypted tunnel.
+type blobCache struct {
+	dir     string
+	maxSize int64 // The cache is trimmed to this size (in bytes) after each blob is stored
+	mux     sync.Mutex
+}
+
+func newBlobCache(dir string, maxSize int64) (*blobCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &blobCache{dir: dir, maxSize: maxSize}, nil
+}
+
+// blobDigestForRequest returns the digest of the blob that req is for, or "" if it isn't for a
+// content-addressed blob that can be cached.
+func blobDigestForRequest(req *http.Request) string {
+	if req.Method != http.MethodGet || req.URL.Scheme != "http" {
+		return ""
+	}
+	match := blobDigest.FindStringSubmatch(req.URL.Path)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+func (bc *blobCache) path(digest string) string {
+	return filepath.Join(bc.dir, "sha256-"+digest)
+}
+
+func (bc *blobCache) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		digest := blobDigestForRequest(req)
+		if digest == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		id := req.Context().Value(contextKeyID)
+		if bc.serve(w, req, digest) {
+			log.Printf("[%d] Served sha256:%s from the blob cache", id, digest)
+			return
+		}
+		bw, err := newBlobWriter(w, bc.dir)
+		if err != nil {
+			log.Printf("[%d] Error creating blob cache file: %v", id, err)
+			next.ServeHTTP(w, req)
+			return
+		}
+		// The client might have sent a Range request, or a conditional one; only a full
+		// response can be cached, but this is checked by comparing the digest anyway.
+		next.ServeHTTP(bw, req)
+		if err := bc.store(bw, digest); err != nil {
+			log.Printf("[%d] Not caching sha256:%s: %v", id, digest, err)
+		}
+	})
+}
+
+// serve serves a blob from the cache, if it's there (and hasn't been corrupted).
+func (bc *blobCache) serve(w http.ResponseWriter, req *http.Request, digest string) bool {
+	f, err := os.Open(bc.path(digest))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil || hex.EncodeToString(h.Sum(nil)) != digest {
+		log.Printf("Removing corrupt blob sha256:%s from the cache", digest)
+		os.Remove(bc.path(digest))
+		return false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	now := time.Now()
+	_ = os.Chtimes(bc.path(digest), now, now) // Used to evict the least recently used blobs
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", "sha256:"+digest)
+	w.Header().Set("ETag", `"sha256:`+digest+`"`)
+	http.ServeContent(w, req, "", time.Time{}, f)
+	return true
+}
+
+// store moves a downloaded blob into the cache, if it's complete and matches its digest.
+func (bc *blobCache) store(bw *blobWriter, digest string) error {
+	defer os.Remove(bw.file.Name())
+	if err := bw.file.Close(); err != nil {
+		return err
+	} else if bw.err != nil {
+		return bw.err
+	} else if bw.status != http.StatusOK {
+		return fmt.Errorf("got status %d", bw.status)
+	} else if got := hex.EncodeToString(bw.hash.Sum(nil)); got != digest {
+		return fmt.Errorf("content has digest sha256:%s", got)
+	}
+	if err := os.Rename(bw.file.Name(), bc.path(digest)); err != nil {
+		return err
+	}
+	bc.trim()
+	return nil
+}
+
+// trim removes the least recently used blobs until the cache is no bigger than its maximum size.
+func (bc *blobCache) trim() {
+	if bc.maxSize <= 0 {
+		return
+	}
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	entries, err := os.ReadDir(bc.dir)
+	if err != nil {
+		return
+	}
+	var blobs []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		if !blobDigest.MatchString(entry.Name()) {
+			continue
+		} else if info, err := entry.Info(); err == nil {
+			blobs = append(blobs, info)
+			total += info.Size()
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].ModTime().Before(blobs[j].ModTime()) })
+	for _, info := range blobs {
+		if total <= bc.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(bc.dir, info.Name())); err == nil {
+			total -= info.Size()
+		}
+	}
+}
+
+// blobWriter copies a response into a temporary file in the cache directory as it's sent to the
+// client, and computes its digest.
+type blobWriter struct {
+	http.ResponseWriter
+	file   *os.File
+	hash   hash.Hash
+	status int
+	err    error
+}
+
+func newBlobWriter(w http.ResponseWriter, dir string) (*blobWriter, error) {
+	f, err := os.CreateTemp(dir, "download-")
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{ResponseWriter: w, file: f, hash: sha256.New()}, nil
+}
+
+func (w *blobWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil {
+		w.err = err
+	} else if w.err == nil {
+		w.hash.Write(p)
+		_, w.err = w.file.Write(p)
+	}
+	return n, err
+}
+
+func (w *blobWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
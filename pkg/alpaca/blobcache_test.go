@@ -0,0 +1,145 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// newBlobCacheProxy returns a client that goes through a proxy with a blob cache, and a server
+// whose responses are given by the blobs map, along with a count of requests for each path.
+func newBlobCacheProxy(t *testing.T, bc *blobCache, blobs map[string]string) (*http.Client,
+	*httptest.Server, map[string]int) {
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests[req.URL.Path]++
+		if blob, ok := blobs[req.URL.Path]; ok {
+			_, _ = w.Write([]byte(blob))
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	proxy := httptest.NewServer(bc.WrapHandler(newDirectProxy()))
+	t.Cleanup(proxy.Close)
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	return client, server, requests
+}
+
+func getBody(t *testing.T, client *http.Client, url string) (int, string) {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestBlobCache(t *testing.T) {
+	layer := strings.Repeat("layer", 1000)
+	path := "/v2/library/alpine/blobs/sha256:" + sha256Hex(layer)
+	bc, err := newBlobCache(t.TempDir(), 0)
+	require.NoError(t, err)
+	client, server, requests := newBlobCacheProxy(t, bc, map[string]string{path: layer})
+	for i := 0; i < 3; i++ {
+		status, body := getBody(t, client, server.URL+path)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, layer, body)
+	}
+	assert.Equal(t, 1, requests[path])
+	// Ranges can be served from the cache too.
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=0-4")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "layer", string(body))
+	assert.Equal(t, 1, requests[path])
+}
+
+func TestBlobCacheDigestMismatch(t *testing.T) {
+	path := "/blobs/sha256:" + sha256Hex("expected")
+	bc, err := newBlobCache(t.TempDir(), 0)
+	require.NoError(t, err)
+	client, server, requests := newBlobCacheProxy(t, bc, map[string]string{path: "tampered"})
+	for i := 0; i < 2; i++ {
+		_, body := getBody(t, client, server.URL+path)
+		assert.Equal(t, "tampered", body)
+	}
+	assert.Equal(t, 2, requests[path])
+	entries, err := os.ReadDir(bc.dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestBlobCacheRemovesCorruptBlobs(t *testing.T) {
+	blob := "blob"
+	digest := sha256Hex(blob)
+	path := "/artifacts/sha256-" + digest + ".tar.gz"
+	bc, err := newBlobCache(t.TempDir(), 0)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(bc.path(digest), []byte("corrupt"), 0600))
+	client, server, requests := newBlobCacheProxy(t, bc, map[string]string{path: blob})
+	_, body := getBody(t, client, server.URL+path)
+	assert.Equal(t, blob, body)
+	assert.Equal(t, 1, requests[path])
+	cached, err := os.ReadFile(bc.path(digest))
+	require.NoError(t, err)
+	assert.Equal(t, blob, string(cached))
+}
+
+func TestBlobCacheIgnoresOtherRequests(t *testing.T) {
+	bc, err := newBlobCache(t.TempDir(), 0)
+	require.NoError(t, err)
+	client, server, requests := newBlobCacheProxy(t, bc, map[string]string{"/latest": "x"})
+	for i := 0; i < 2; i++ {
+		getBody(t, client, server.URL+"/latest")
+	}
+	assert.Equal(t, 2, requests["/latest"])
+}
+
+func TestBlobCacheTrim(t *testing.T) {
+	bc, err := newBlobCache(t.TempDir(), 10)
+	require.NoError(t, err)
+	for _, blob := range []string{"first!", "second", "third!"} {
+		path := "/blobs/sha256:" + sha256Hex(blob)
+		client, server, _ := newBlobCacheProxy(t, bc, map[string]string{path: blob})
+		getBody(t, client, server.URL+path)
+	}
+	entries, err := os.ReadDir(bc.dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, filepath.Base(bc.path(sha256Hex("third!"))), entries[0].Name())
+}
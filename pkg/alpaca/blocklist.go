@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package alpaca
 
 import (
 	"fmt"
@@ -61,6 +61,18 @@ func (b *blocklist) contains(entry string) bool {
 	return ok
 }
 
+// snapshot returns the entries in the blocklist, and when they expire.
+func (b *blocklist) snapshot() map[string]time.Time {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.sweep()
+	entries := make(map[string]time.Time, len(b.expiry))
+	for entry, expiry := range b.expiry {
+		entries[entry] = expiry
+	}
+	return entries
+}
+
 func (b *blocklist) sweep() {
 	// Delete any stale entries from both the slice and the map. This function is *not*
 	// reentrant; `mux` should be locked before calling this function!
@@ -0,0 +1,82 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// bypassList holds hosts (and their subdomains) that should temporarily be accessed directly,
+// regardless of what the PAC file says. These are set at runtime, e.g. by the browser extension.
+type bypassList struct {
+	all   bool
+	hosts map[string]struct{}
+	mux   sync.Mutex
+}
+
+func newBypassList() *bypassList {
+	return &bypassList{hosts: make(map[string]struct{})}
+}
+
+func (b *bypassList) setAll(all bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.all = all
+}
+
+func (b *bypassList) add(host string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.hosts[strings.ToLower(host)] = struct{}{}
+}
+
+func (b *bypassList) remove(host string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.hosts, strings.ToLower(host))
+}
+
+func (b *bypassList) contains(host string) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.all {
+		return true
+	}
+	host = strings.ToLower(host)
+	for {
+		if _, ok := b.hosts[host]; ok {
+			return true
+		}
+		dot := strings.IndexByte(host, '.')
+		if dot == -1 {
+			return false
+		}
+		host = host[dot+1:]
+	}
+}
+
+// list returns whether all hosts are bypassed, and the (sorted) individual hosts.
+func (b *bypassList) list() (bool, []string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	hosts := make([]string, 0, len(b.hosts))
+	for host := range b.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return b.all, hosts
+}
@@ -0,0 +1,176 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often to check for a captive portal, and how often to check whether it's gone once
+	// one has been detected (e.g. because the user has logged in).
+	captiveCheckInterval   = time.Minute
+	captiveRecheckInterval = 10 * time.Second
+	// How long to wait for each probe.
+	captiveCheckTimeout = 5 * time.Second
+	// A domain that has no wildcard DNS records, so a random subdomain of it shouldn't resolve.
+	captiveDNSProbeDomain = "example.com"
+)
+
+// captiveProbe is a URL that gives a known response when there's no captive portal.
+type captiveProbe struct {
+	url    string
+	status int
+	body   string // If set, a substring of the expected body
+}
+
+var defaultCaptiveProbes = []captiveProbe{
+	{url: "http://connectivitycheck.gstatic.com/generate_204", status: http.StatusNoContent},
+	{url: "http://captive.apple.com/hotspot-detect.html", status: http.StatusOK, body: "Success"},
+}
+
+// captivePortal detects captive portals (e.g. on hotel or airport networks), which hijack DNS or
+// redirect plain HTTP requests to a login page. While one is detected, ProxyFinder sends all
+// requests directly, so that the user can log in, rather than trying to reach proxies (or a PAC
+// server) that won't be reachable until they do.
+type captivePortal struct {
+	probes []captiveProbe
+	client *http.Client
+	lookup func(ctx context.Context, host string) ([]string, error)
+	now    func() time.Time
+	// onClear is called when a captive portal that was detected has gone.
+	onClear func()
+	reason  string // Why we think there's a captive portal, or "" if there isn't one
+	since   time.Time
+	mux     sync.Mutex
+}
+
+func newCaptivePortal(dial dialFunc) *captivePortal {
+	return &captivePortal{
+		probes: defaultCaptiveProbes,
+		client: &http.Client{
+			// The probes are always sent directly, never through a proxy.
+			Transport: &http.Transport{DialContext: dial},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Timeout: captiveCheckTimeout,
+		},
+		lookup: net.DefaultResolver.LookupHost,
+		now:    time.Now,
+	}
+}
+
+// start checks for a captive portal now, and then periodically, in the background.
+func (cp *captivePortal) start() {
+	go func() {
+		for {
+			cp.check()
+			if _, ok := cp.detected(); ok {
+				time.Sleep(captiveRecheckInterval)
+			} else {
+				time.Sleep(captiveCheckInterval)
+			}
+		}
+	}()
+}
+
+func (cp *captivePortal) check() {
+	reason := cp.probeDNS()
+	for _, probe := range cp.probes {
+		if reason != "" {
+			break
+		}
+		reason = cp.probeHTTP(probe)
+	}
+	cp.mux.Lock()
+	was := cp.reason
+	cp.reason = reason
+	if reason != "" && was == "" {
+		cp.since = cp.now()
+	}
+	since := cp.since
+	cp.mux.Unlock()
+	if reason != "" && was == "" {
+		log.Printf("Captive portal detected (%s); sending all requests directly until you "+
+			"log in to it", reason)
+	} else if reason == "" && was != "" {
+		log.Printf("Captive portal is gone (after %v); using the PAC file again",
+			cp.now().Sub(since).Round(time.Second))
+		if cp.onClear != nil {
+			cp.onClear()
+		}
+	}
+}
+
+// probeDNS looks up a host that doesn't exist, and returns a reason if it resolves anyway.
+func (cp *captivePortal) probeDNS() string {
+	label := make([]byte, 8)
+	if _, err := rand.Read(label); err != nil {
+		return ""
+	}
+	host := "alpaca-" + hex.EncodeToString(label) + "." + captiveDNSProbeDomain
+	ctx, cancel := context.WithTimeout(context.Background(), captiveCheckTimeout)
+	defer cancel()
+	addrs, err := cp.lookup(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("DNS is hijacked: %s resolved to %s", host, addrs[0])
+}
+
+// probeHTTP fetches a probe URL, and returns a reason if the response shows a captive portal.
+// Errors are inconclusive (we might just be offline, or on a network that blocks the probe), so
+// they don't count.
+func (cp *captivePortal) probeHTTP(probe captiveProbe) string {
+	resp, err := cp.client.Get(probe.url)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if loc := resp.Header.Get("Location"); resp.StatusCode/100 == 3 && loc != "" {
+		return fmt.Sprintf("%s redirected to %s", probe.url, loc)
+	} else if resp.StatusCode != probe.status {
+		if resp.StatusCode == http.StatusOK {
+			return fmt.Sprintf("%s returned a page instead of status %d", probe.url, probe.status)
+		}
+		return ""
+	} else if probe.body == "" {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil || strings.Contains(string(body), probe.body) {
+		return ""
+	}
+	return fmt.Sprintf("%s returned an unexpected page", probe.url)
+}
+
+// detected returns the reason that we think there's a captive portal, and false if there isn't
+// one.
+func (cp *captivePortal) detected() (string, bool) {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	return cp.reason, cp.reason != ""
+}
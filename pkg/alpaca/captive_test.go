@@ -0,0 +1,131 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func noSuchHost(context.Context, string) ([]string, error) {
+	return nil, errors.New("no such host")
+}
+
+func TestCaptivePortalProbes(t *testing.T) {
+	var portal bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if portal {
+			http.Redirect(w, req, "http://login.hotel.test/", http.StatusFound)
+			return
+		}
+		switch req.URL.Path {
+		case "/generate_204":
+			w.WriteHeader(http.StatusNoContent)
+		case "/hotspot-detect.html":
+			_, _ = w.Write([]byte("<HTML><BODY>Success</BODY></HTML>"))
+		}
+	}))
+	defer server.Close()
+	cp := newCaptivePortal(dialNAT64)
+	cp.lookup = noSuchHost
+	cp.probes = []captiveProbe{
+		{url: server.URL + "/generate_204", status: http.StatusNoContent},
+		{url: server.URL + "/hotspot-detect.html", status: http.StatusOK, body: "Success"},
+	}
+	cleared := 0
+	cp.onClear = func() { cleared++ }
+
+	cp.check()
+	_, ok := cp.detected()
+	assert.False(t, ok)
+
+	portal = true
+	cp.check()
+	reason, ok := cp.detected()
+	assert.True(t, ok)
+	assert.Contains(t, reason, "redirected to http://login.hotel.test/")
+	assert.Equal(t, 0, cleared)
+
+	portal = false
+	cp.check()
+	_, ok = cp.detected()
+	assert.False(t, ok)
+	assert.Equal(t, 1, cleared)
+}
+
+func TestCaptivePortalResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		captive bool
+	}{
+		{"Expected", http.StatusOK, "Success", false},
+		{"LoginPage", http.StatusOK, "<form>Room number</form>", true},
+		{"Blocked", http.StatusForbidden, "Access denied", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, _ *http.Request) {
+					w.WriteHeader(test.status)
+					_, _ = w.Write([]byte(test.body))
+				}))
+			defer server.Close()
+			cp := newCaptivePortal(dialNAT64)
+			probe := captiveProbe{url: server.URL, status: http.StatusOK, body: "Success"}
+			assert.Equal(t, test.captive, cp.probeHTTP(probe) != "")
+			probe = captiveProbe{url: server.URL, status: http.StatusNoContent}
+			assert.Equal(t, test.status == http.StatusOK, cp.probeHTTP(probe) != "")
+		})
+	}
+	cp := newCaptivePortal(dialNAT64)
+	assert.Empty(t, cp.probeHTTP(captiveProbe{url: "http://invalid.test:0/", status: 204}),
+		"errors should be inconclusive")
+}
+
+func TestCaptivePortalDNS(t *testing.T) {
+	cp := newCaptivePortal(dialNAT64)
+	cp.probes = nil
+	cp.lookup = func(context.Context, string) ([]string, error) {
+		return []string{"192.0.2.1"}, nil
+	}
+	cp.check()
+	reason, ok := cp.detected()
+	assert.True(t, ok)
+	assert.Contains(t, reason, "DNS is hijacked")
+}
+
+func TestCaptivePortalGoesDirect(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "PROXY proxy.test:80" }`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer server.Close()
+	pf := NewProxyFinder([]string{server.URL}, NewPACWrapper(PACData{Port: 1}), myIPAuto)
+	pf.captive = newCaptivePortal(dialNAT64)
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	proxy, err := pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.NotNil(t, proxy)
+	pf.captive.reason = "test"
+	proxy, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Nil(t, proxy)
+}
@@ -0,0 +1,360 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The maximum number of bytes of each request and response body to keep in a capture.
+const maxCaptureBodyBytes = 64 * 1024
+
+// Headers whose values are replaced in a capture, so that it can be shared (e.g. attached to a
+// ticket) without leaking credentials.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// The types below are a subset of the HAR 1.2 format (see
+// http://www.softwareishard.com/blog/har-12-spec/).
+
+type harLog struct {
+	Log harContent `json:"log"`
+}
+
+type harContent struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harBody        `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harBody struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// capture keeps a rolling buffer of the most recent proxied requests, which can be downloaded as
+// a HAR file. This helps users to provide evidence when reporting proxy problems to their IT
+// department.
+type capture struct {
+	entries []harEntry
+	size    int
+	now     func() time.Time
+	mux     sync.Mutex
+}
+
+func newCapture(size int) *capture {
+	return &capture{size: size, now: time.Now}
+}
+
+func (c *capture) add(entry harEntry) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.entries = append(c.entries, entry)
+	if len(c.entries) > c.size {
+		c.entries = c.entries[len(c.entries)-c.size:]
+	}
+}
+
+func (c *capture) har() harLog {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entries := append([]harEntry{}, c.entries...)
+	return harLog{harContent{
+		Version: "1.2",
+		Creator: harCreator{"Alpaca", BuildVersion},
+		Entries: entries,
+	}}
+}
+
+func (c *capture) clear() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.entries = nil
+}
+
+func (c *capture) SetupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/alpaca/api/capture.har", localhostOnly(c.handleCapture))
+}
+
+func (c *capture) handleCapture(w http.ResponseWriter, req *http.Request) {
+	// The capture contains (partially redacted) traffic; don't let web pages read it.
+	if req.Header.Get("Origin") != "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Disposition", `attachment; filename="alpaca.har"`)
+		writeJSON(w, http.StatusOK, c.har())
+	case http.MethodDelete:
+		c.clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// WrapHandler records the requests that are proxied by next. It should be placed inside the
+// ProxyFinder's handler, so that the proxy used for each request can be recorded too.
+func (c *capture) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect && req.URL.Scheme == "" {
+			// Not a proxy request (see ProxyHandler.WrapHandler).
+			next.ServeHTTP(w, req)
+			return
+		}
+		start := c.now()
+		reqBody := &limitedBuffer{limit: maxCaptureBodyBytes}
+		if req.Body != nil {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(req.Body, reqBody), req.Body}
+		}
+		entry := harEntry{StartedDateTime: start, Request: harRequest{
+			Method:      req.Method,
+			URL:         requestURL(req),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: harQueryString(req.URL),
+			HeadersSize: -1,
+		}}
+		if proxy, ok := req.Context().Value(contextKeyProxy).(*url.URL); ok && proxy != nil {
+			entry.Comment = "via " + proxyString(proxy)
+		} else {
+			entry.Comment = "via DIRECT"
+		}
+		cw := &captureWriter{ResponseWriter: w, now: c.now, body: limitedBuffer{
+			limit: maxCaptureBodyBytes,
+		}}
+		next.ServeHTTP(cw, req)
+		end := c.now()
+
+		entry.Request.BodySize = reqBody.n
+		if reqBody.n > 0 {
+			entry.Request.PostData = &harPostData{
+				MimeType: req.Header.Get("Content-Type"),
+				Text:     string(reqBody.buf),
+			}
+		}
+		if cw.hijacked {
+			// A CONNECT request, where the tunnel has been established.
+			cw.status = http.StatusOK
+		}
+		if cw.wroteHeader.IsZero() {
+			cw.wroteHeader = end
+		}
+		status := cw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		entry.Response = harResponse{
+			Status:      status,
+			StatusText:  http.StatusText(status),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(cw.header),
+			Content:     harContentBody(&cw.body, cw.header.Get("Content-Type")),
+			HeadersSize: -1,
+			BodySize:    cw.body.n,
+		}
+		wait := cw.wroteHeader.Sub(start)
+		entry.Timings = harTimings{Wait: millis(wait), Receive: millis(end.Sub(cw.wroteHeader))}
+		entry.Time = millis(end.Sub(start))
+		c.add(entry)
+	})
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func requestURL(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return "https://" + req.Host
+	}
+	return req.URL.String()
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			if redactedHeaders[name] {
+				value = "(redacted)"
+			}
+			headers = append(headers, harNameValue{name, value})
+		}
+	}
+	sort.SliceStable(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+func harQueryString(u *url.URL) []harNameValue {
+	query := []harNameValue{}
+	for name, values := range u.Query() {
+		for _, value := range values {
+			query = append(query, harNameValue{name, value})
+		}
+	}
+	sort.SliceStable(query, func(i, j int) bool { return query[i].Name < query[j].Name })
+	return query
+}
+
+func harContentBody(body *limitedBuffer, mimeType string) harBody {
+	content := harBody{Size: body.n, MimeType: mimeType}
+	if utf8.Valid(body.buf) {
+		content.Text = string(body.buf)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(body.buf)
+		content.Encoding = "base64"
+	}
+	if body.n > int64(len(body.buf)) {
+		content.Comment = "truncated"
+	}
+	return content
+}
+
+// limitedBuffer keeps the first limit bytes written to it, and counts the rest.
+type limitedBuffer struct {
+	buf   []byte
+	n     int64
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.n += int64(len(p))
+	if room := b.limit - len(b.buf); room > 0 {
+		if len(p) > room {
+			b.buf = append(b.buf, p[:room]...)
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// captureWriter records the response written to a http.ResponseWriter.
+type captureWriter struct {
+	http.ResponseWriter
+	now         func() time.Time
+	status      int
+	header      http.Header
+	wroteHeader time.Time
+	body        limitedBuffer
+	hijacked    bool
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.wroteHeader.IsZero() {
+		w.status = status
+		w.header = w.Header().Clone()
+		w.wroteHeader = w.now()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.wroteHeader.IsZero() {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		w.hijacked = true
+		w.wroteHeader = w.now()
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureHTTPRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("got " + string(body)))
+	}))
+	defer server.Close()
+	c := newCapture(10)
+	proxy := httptest.NewServer(c.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/path?q=1", strings.NewReader("hi"))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	entries := c.har().Log.Entries
+	require.Len(t, entries, 1)
+	entry := entries[0]
+	assert.Equal(t, "via DIRECT", entry.Comment)
+	assert.Equal(t, http.MethodPost, entry.Request.Method)
+	assert.Equal(t, server.URL+"/path?q=1", entry.Request.URL)
+	assert.Equal(t, []harNameValue{{"q", "1"}}, entry.Request.QueryString)
+	assert.Contains(t, entry.Request.Headers, harNameValue{"Authorization", "(redacted)"})
+	require.NotNil(t, entry.Request.PostData)
+	assert.Equal(t, "hi", entry.Request.PostData.Text)
+	assert.Equal(t, http.StatusTeapot, entry.Response.Status)
+	assert.Contains(t, entry.Response.Headers, harNameValue{"Set-Cookie", "(redacted)"})
+	assert.Equal(t, "got hi", entry.Response.Content.Text)
+	assert.Equal(t, "text/plain", entry.Response.Content.MimeType)
+}
+
+func TestCaptureConnectRequest(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer server.Close()
+	c := newCapture(10)
+	proxy := httptest.NewServer(c.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           proxyServer(t, proxy),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	client.CloseIdleConnections()
+
+	entries := c.har().Log.Entries
+	require.Len(t, entries, 1)
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodConnect, entries[0].Request.Method)
+	assert.Equal(t, "https://"+u.Host, entries[0].Request.URL)
+	assert.Equal(t, http.StatusOK, entries[0].Response.Status)
+	// The tunnel is encrypted, so its contents can't be captured.
+	assert.Empty(t, entries[0].Response.Content.Text)
+}
+
+func TestCaptureKeepsMostRecentEntries(t *testing.T) {
+	c := newCapture(2)
+	handler := c.WrapHandler(http.NotFoundHandler())
+	for _, path := range []string{"/1", "/2", "/3"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	entries := c.har().Log.Entries
+	require.Len(t, entries, 2)
+	assert.Equal(t, "http://example.com/2", entries[0].Request.URL)
+	assert.Equal(t, "http://example.com/3", entries[1].Request.URL)
+}
+
+func TestCaptureIgnoresLocalRequests(t *testing.T) {
+	c := newCapture(10)
+	handler := c.WrapHandler(http.NotFoundHandler())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/alpaca.pac", nil))
+	assert.Empty(t, c.har().Log.Entries)
+}
+
+func TestCaptureTruncatesLargeBodies(t *testing.T) {
+	c := newCapture(10)
+	body := strings.Repeat("x", maxCaptureBodyBytes+1)
+	handler := c.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(body))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://x/", nil))
+	content := c.har().Log.Entries[0].Response.Content
+	assert.Equal(t, int64(len(body)), content.Size)
+	assert.Len(t, content.Text, maxCaptureBodyBytes)
+	assert.Equal(t, "truncated", content.Comment)
+}
+
+func TestCaptureAPI(t *testing.T) {
+	c := newCapture(10)
+	mux := http.NewServeMux()
+	c.SetupHandlers(mux)
+	c.add(harEntry{Request: harRequest{Method: http.MethodGet, URL: "http://example.com/"}})
+
+	w := callExtensionAPI(mux, http.MethodGet, "/alpaca/api/capture.har", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "alpaca.har")
+	var har harLog
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&har))
+	assert.Equal(t, "1.2", har.Log.Version)
+	require.Len(t, har.Log.Entries, 1)
+	assert.Equal(t, "http://example.com/", har.Log.Entries[0].Request.URL)
+
+	w = callExtensionAPI(mux, http.MethodDelete, "/alpaca/api/capture.har", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, c.har().Log.Entries)
+
+	req := httptest.NewRequest(http.MethodGet, "/alpaca/api/capture.har", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.Header.Set("Origin", "https://evil.test")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// alpacaRequestIDHeader links the log messages for a request that goes through two chained
+// instances of Alpaca (see -upstream-alpaca), e.g. one on a laptop and one on a jump host. The
+// downstream instance sends its reference for the request (see requestRef) to the upstream one,
+// which logs it, and sends its own reference back in the response for the downstream instance
+// to log. The header isn't passed on any further in either direction.
+const alpacaRequestIDHeader = "X-Alpaca-Request-Id"
+
+// requestRef returns a reference to the request with the given ID, which is this machine's host
+// name and the request ID (e.g. "laptop#12").
+func requestRef(id interface{}) string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s#%v", hostname, id)
+}
+
+// logUpstreamRef logs the upstream instance's reference for a request, if the response has one,
+// and removes it from the response.
+func logUpstreamRef(id interface{}, header http.Header) {
+	if ref := header.Get(alpacaRequestIDHeader); ref != "" {
+		log.Printf("[%d] The upstream Alpaca logged this as request %s", id, ref)
+		header.Del(alpacaRequestIDHeader)
+	}
+}
+
+// parseUpstreamAlpaca parses the value of -upstream-alpaca, which is the address of the
+// upstream instance (host:port), or its URL.
+func parseUpstreamAlpaca(value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -upstream-alpaca: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid -upstream-alpaca %q (expected an http or https URL)",
+			value)
+	} else if u.Port() == "" {
+		return nil, fmt.Errorf("invalid -upstream-alpaca %q (expected host:port)", value)
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}, nil
+}
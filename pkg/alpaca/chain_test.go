@@ -0,0 +1,106 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUpstreamAlpaca(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"jump.example.com:3128", "http://jump.example.com:3128"},
+		{"http://jump.example.com:3128/", "http://jump.example.com:3128"},
+		{"https://jump.example.com:443", "https://jump.example.com:443"},
+		{"[::1]:3128", "http://[::1]:3128"},
+		{"jump.example.com", ""},
+		{"socks5://jump.example.com:1080", ""},
+	} {
+		u, err := parseUpstreamAlpaca(test.value)
+		if test.want == "" {
+			assert.Error(t, err, test.value)
+		} else if assert.NoError(t, err, test.value) {
+			assert.Equal(t, test.want, u.String())
+		}
+	}
+}
+
+func TestChainedAlpaca(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(io.Discard)
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	}))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer tlsServer.Close()
+	pacServer := httptest.NewServer(pacjsHandler(`function FindProxyForURL(url, host) {
+		return "DIRECT";
+	}`))
+	defer pacServer.Close()
+
+	upstream := httptest.NewServer(createServer("localhost", 3128, []string{pacServer.URL}, nil,
+		newTunnelTracker(), serverOptions{}).Handler)
+	defer upstream.Close()
+	upstreamURL, err := parseUpstreamAlpaca(upstream.Listener.Addr().String())
+	require.NoError(t, err)
+	downstream := httptest.NewServer(createServer("localhost", 3128, nil, nil, newTunnelTracker(),
+		serverOptions{upstreamAlpaca: upstreamURL}).Handler)
+	defer downstream.Close()
+
+	downstreamURL, err := url.Parse(downstream.URL)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(downstreamURL),
+		TLSClientConfig: tlsConfig(tlsServer),
+	}}
+	for _, u := range []string{server.URL, tlsServer.URL} {
+		resp, err := client.Get(u)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(alpacaRequestIDHeader), u)
+	}
+	require.NotNil(t, got)
+	assert.Empty(t, got.Get(alpacaRequestIDHeader))
+	assert.NotEmpty(t, got.Get("Via"))
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	// The downstream instance's requests are 1 and 2, and so are the upstream instance's.
+	for _, line := range []string{
+		"GET " + server.Listener.Addr().String() + " is for Alpaca request " + hostname + "#1",
+		"[1] The upstream Alpaca logged this as request " + hostname + "#1",
+		"CONNECT " + tlsServer.Listener.Addr().String() + " is for Alpaca request " +
+			hostname + "#2",
+		"[2] The upstream Alpaca logged this as request " + hostname + "#2",
+	} {
+		assert.Contains(t, logs.String(), line)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultCheckURLs are the URLs that "alpaca check" tries, if none are given.
+var defaultCheckURLs = []string{"https://www.google.com/", "http://example.com/"}
+
+// checkTimeout is how long "alpaca check" waits for each of its requests.
+const checkTimeout = 30 * time.Second
+
+// selfCheck checks that Alpaca is set up correctly (for "alpaca check"), by running a server with
+// the given flags and config, and making requests to it like a client would: it checks that the
+// PAC file can be downloaded, which proxy it chooses for each of a few URLs, and that the proxy
+// lets Alpaca connect to them (i.e. that the credentials are right).
+type selfCheck struct {
+	proxyAddr string // Where the server being checked is listening
+	client    *http.Client
+	out       io.Writer
+	checks    int
+	failures  int
+}
+
+// runCheck runs the checks against s, and prints the results (and a summary) to out. It returns
+// whether every check passed.
+func runCheck(s *http.Server, urls []string, out io.Writer) (bool, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return false, err
+	}
+	defer l.Close()
+	go func() { _ = s.Serve(l) }()
+	if len(urls) == 0 {
+		urls = defaultCheckURLs
+	}
+	c := newSelfCheck(l.Addr().String(), out)
+	c.checkPAC()
+	for _, u := range urls {
+		c.checkURL(u)
+	}
+	if c.failures == 0 {
+		fmt.Fprintf(out, "\nAll %d checks passed\n", c.checks)
+	} else {
+		fmt.Fprintf(out, "\n%d of %d checks failed\n", c.failures, c.checks)
+	}
+	return c.failures == 0, nil
+}
+
+func newSelfCheck(proxyAddr string, out io.Writer) *selfCheck {
+	return &selfCheck{
+		proxyAddr: proxyAddr,
+		// Talk to Alpaca directly, rather than through a proxy from the environment.
+		client: &http.Client{Transport: &http.Transport{}, Timeout: checkTimeout},
+		out:    out,
+	}
+}
+
+// pass and fail print the result of a check, with an explanation of what to do about a failure.
+func (c *selfCheck) pass(format string, args ...interface{}) {
+	c.checks++
+	fmt.Fprintf(c.out, "PASS  %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *selfCheck) fail(suggestion, format string, args ...interface{}) {
+	c.checks++
+	c.failures++
+	fmt.Fprintf(c.out, "FAIL  %s\n", fmt.Sprintf(format, args...))
+	if suggestion != "" {
+		fmt.Fprintf(c.out, "      %s\n", suggestion)
+	}
+}
+
+// getJSON makes a request to one of Alpaca's APIs, and decodes the response (or the error) into
+// v. It returns an error if either the request or the API failed.
+func (c *selfCheck) getJSON(path string, v interface{}) error {
+	resp, err := c.client.Get("http://" + c.proxyAddr + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var ae apiError
+		if err := json.NewDecoder(resp.Body).Decode(&ae); err != nil || ae.Error == "" {
+			return fmt.Errorf("unexpected response: %s", resp.Status)
+		}
+		return fmt.Errorf("%s", ae.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *selfCheck) checkPAC() {
+	var status extensionStatus
+	if err := c.getJSON("/alpaca/api/status", &status); err != nil {
+		c.fail("", "Couldn't get Alpaca's status: %v", err)
+	} else if status.PACURL == "" {
+		c.pass("No PAC file was given (using -C) or found, so requests will go directly")
+	} else if !status.Connected {
+		c.fail("Check that the URL is right, and that you're connected to the network (or VPN) "+
+			"that it's on.", "Couldn't download the PAC file from %s", status.PACURL)
+	} else {
+		c.pass("Downloaded the PAC file from %s", status.PACURL)
+	}
+}
+
+// checkURL checks which proxy the PAC file chooses for a URL, and then connects to it through
+// Alpaca: a CONNECT request for an https URL, or a GET request for an http one.
+func (c *selfCheck) checkURL(rawurl string) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.fail("", "Invalid URL %q (it should be an http or https URL)", rawurl)
+		return
+	}
+	var route extensionRoute
+	if err := c.getJSON("/alpaca/api/route?url="+url.QueryEscape(rawurl), &route); err != nil {
+		c.fail(messages.text(nil, "error.pac_error"), "Couldn't find a proxy for %s: %v",
+			rawurl, err)
+		return
+	}
+	resp, err := c.probe(u)
+	if err != nil {
+		c.fail("", "Couldn't connect to %s through Alpaca (%s): %v", rawurl, route.Proxy, err)
+		return
+	}
+	defer resp.Body.Close()
+	if code := resp.Header.Get(proxyErrorHeader); code != "" && code != "upstream_error" {
+		var pe proxyError
+		_ = json.NewDecoder(resp.Body).Decode(&pe)
+		c.fail(pe.Suggestion, "Couldn't connect to %s (%s): %s", rawurl, route.Proxy,
+			cmp.Or(pe.Message, code))
+	} else if resp.StatusCode == http.StatusProxyAuthRequired {
+		c.fail(messages.text(nil, "error.auth_rejected"),
+			"The proxy for %s (%s) asked for credentials", rawurl, route.Proxy)
+	} else if u.Scheme == "https" && resp.StatusCode != http.StatusOK {
+		c.fail("", "The proxy for %s (%s) refused to connect: %s", rawurl, route.Proxy,
+			resp.Status)
+	} else {
+		// Any response from the server means that the route works.
+		c.pass("Connected to %s (%s)", rawurl, route.Proxy)
+	}
+}
+
+// probe sends a request for u through Alpaca. It asks for errors as JSON, to get the details.
+func (c *selfCheck) probe(u *url.URL) (*http.Response, error) {
+	req, err := probeRequest(http.MethodGet, u)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	return sendThrough(c.proxyAddr, req)
+}
+
+// probeRequest returns a request for u to send to a proxy: a CONNECT request for an https URL,
+// or a request with the given method for an http one.
+func probeRequest(method string, u *url.URL) (*http.Request, error) {
+	if u.Scheme != "https" {
+		return http.NewRequest(method, u.String(), nil)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	return &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: make(http.Header),
+	}, nil
+}
+
+// sendThrough sends req to the proxy at proxyAddr, on a connection of its own that's closed along
+// with the response's body.
+func sendThrough(proxyAddr string, req *http.Request) (*http.Response, error) {
+	conn, err := net.DialTimeout("tcp", proxyAddr, checkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(checkTimeout))
+	req.Header.Set("Connection", "close")
+	if err := req.WriteProxy(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body = closeBoth{resp.Body, conn}
+	return resp, nil
+}
+
+// closeBoth is a response body that also closes the connection that it's read from.
+type closeBoth struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (cb closeBoth) Close() error {
+	cb.conn.Close()
+	return cb.ReadCloser.Close()
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer tlsServer.Close()
+	// An upstream proxy that wants credentials that Alpaca doesn't have.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+	pacServer := httptest.NewServer(pacjsHandler(fmt.Sprintf(`function FindProxyForURL(url, host) {
+		return host == "www.example.com" ? "PROXY %s" : "DIRECT";
+	}`, proxy.Listener.Addr())))
+	defer pacServer.Close()
+
+	s := createServer("localhost", 3128, []string{pacServer.URL}, nil, newTunnelTracker(),
+		serverOptions{})
+	var out strings.Builder
+	passed, err := runCheck(s, []string{server.URL, tlsServer.URL, "http://www.example.com/",
+		"ftp://www.example.com/"}, &out)
+	require.NoError(t, err)
+	assert.False(t, passed)
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(t, "PASS  Downloaded the PAC file from "+pacServer.URL, lines[0])
+	assert.Equal(t, "PASS  Connected to "+server.URL+" (DIRECT)", lines[1])
+	assert.Equal(t, "PASS  Connected to "+tlsServer.URL+" (DIRECT)", lines[2])
+	assert.Equal(t, "FAIL  The proxy for http://www.example.com/ (PROXY "+
+		proxy.Listener.Addr().String()+") asked for credentials", lines[3])
+	assert.Equal(t, "      "+defaultMessages["error.auth_rejected"], lines[4])
+	assert.Contains(t, out.String(), "FAIL  Invalid URL \"ftp://www.example.com/\"")
+	assert.Contains(t, out.String(), "\n2 of 5 checks failed\n")
+}
+
+func TestCheckWithoutPACFile(t *testing.T) {
+	pacServer := httptest.NewServer(http.NotFoundHandler())
+	defer pacServer.Close()
+	s := createServer("localhost", 3128, []string{pacServer.URL}, nil, newTunnelTracker(),
+		serverOptions{})
+	var out strings.Builder
+	passed, err := runCheck(s, []string{pacServer.URL}, &out)
+	require.NoError(t, err)
+	assert.False(t, passed)
+	assert.True(t, strings.HasPrefix(out.String(),
+		"FAIL  Couldn't download the PAC file from "+pacServer.URL+"\n"), out.String())
+}
@@ -0,0 +1,310 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// subcommand is a command that alpaca takes as its first argument(s), instead of running the
+// proxy.
+type subcommand struct {
+	name  string // e.g. "debug dump"
+	args  string // For the man page's synopsis
+	usage string
+}
+
+var subcommands = []subcommand{
+	{"check", "[flags] [url...]", "run a self-test with the given flags, then test the given URLs"},
+	{"resolve", "[flags] url...", "print which proxy the given flags choose for each URL, and why"},
+	{"test", "[flags] file...", "run the scenarios in the given files against a fake upstream"},
+	{"creds", "set|get|delete [-keyring name] [-u user]",
+		"save, check for, or delete the password that alpaca reads from the keyring"},
+	{"debug dump", "-debug port [-o file]", "save a debug dump from a running instance"},
+	{"completion", "bash|zsh|fish|powershell|man",
+		"print a completion script for bash, zsh, fish or powershell, or a man page"},
+}
+
+// completionFormats are the arguments that "alpaca completion" takes.
+var completionFormats = []string{"bash", "zsh", "fish", "powershell", "man"}
+
+// completionFlag is a flag, as described in a completion script or man page.
+type completionFlag struct {
+	Name    string
+	Value   string // The name of the flag's value, or empty for a boolean flag
+	Usage   string
+	Default string // The default value, if it's worth showing
+}
+
+// completionWord is a word that completes a subcommand, after the words in Parent.
+type completionWord struct {
+	Parent string
+	Word   string
+	Usage  string
+}
+
+type completionData struct {
+	Words    []completionWord
+	Flags    []completionFlag
+	Formats  []string
+	Synopsis [][2]string // The name and arguments of each subcommand
+}
+
+// Children returns the words that can follow the words in parent.
+func (d completionData) Children(parent string) []string {
+	var words []string
+	for _, w := range d.Words {
+		if w.Parent == parent {
+			words = append(words, w.Word)
+		}
+	}
+	return words
+}
+
+// completionCommand implements "alpaca completion", which prints a completion script for a
+// shell, or a man page, that's generated from the subcommands and from the flags in fs. Since
+// they're generated from the binary itself, they're always up to date with it, and packagers can
+// generate them when building a package.
+func completionCommand(args []string, fs *flag.FlagSet, w io.Writer) error {
+	if len(args) != 1 || !slices.Contains(completionFormats, args[0]) {
+		return fmt.Errorf("usage: alpaca completion %s", strings.Join(completionFormats, "|"))
+	}
+	return completionTmpl.ExecuteTemplate(w, args[0], newCompletionData(fs))
+}
+
+func newCompletionData(fs *flag.FlagSet) completionData {
+	data := completionData{Formats: completionFormats}
+	for _, sc := range subcommands {
+		words := strings.Fields(sc.name)
+		for i, word := range words {
+			cw := completionWord{strings.Join(words[:i], " "), word, sc.usage}
+			if i < len(words)-1 {
+				cw.Usage = "" // Only the last word is described.
+			}
+			if !slices.ContainsFunc(data.Words, func(w completionWord) bool {
+				return w.Parent == cw.Parent && w.Word == cw.Word
+			}) {
+				data.Words = append(data.Words, cw)
+			}
+		}
+		data.Synopsis = append(data.Synopsis, [2]string{sc.name, sc.args})
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		value, usage := flag.UnquoteUsage(f)
+		cf := completionFlag{Name: f.Name, Value: value, Usage: usage}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			cf.Value = ""
+		}
+		switch f.DefValue {
+		case "", "0", "0s", "false", "[]":
+		default:
+			cf.Default = f.DefValue
+		}
+		data.Flags = append(data.Flags, cf)
+	})
+	return data
+}
+
+func zshDescription(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// roff escapes text for a man page.
+func roff(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+var completionTmpl = template.Must(template.New("completion").Funcs(template.FuncMap{
+	// Quote a string for bash, zsh and fish, which all use single quotes in the same way
+	// (apart from fish allowing \' inside them, which isn't needed here).
+	"sq": func(s string) string { return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'" },
+	// Quote a string for PowerShell.
+	"psq": func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" },
+	// Escape the description of a zsh _arguments spec.
+	"zdesc": zshDescription,
+	// Make a zsh _arguments spec for a flag.
+	"zflag": func(f completionFlag) string {
+		spec := fmt.Sprintf("*-%s[%s]", f.Name, zshDescription(f.Usage))
+		if f.Value != "" {
+			spec += ":" + f.Value + ":_default"
+		}
+		return spec
+	},
+	"roff": roff,
+	"join": strings.Join,
+}).Parse(`
+{{- define "bash" -}}
+# bash completion for alpaca. Load it with: source <(alpaca completion bash)
+_alpaca() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    local parent="${COMP_WORDS[*]:1:COMP_CWORD-1}"
+    if [[ $cur == -* ]]; then
+        COMPREPLY=($(compgen -W '{{range .Flags}}-{{.Name}} {{end}}' -- "$cur"))
+        return
+    fi
+    case "$parent" in
+    "")
+        COMPREPLY=($(compgen -W '{{join (.Children "") " "}}' -- "$cur"))
+        ;;
+{{- range .Words}}{{if ne .Parent ""}}
+    {{sq .Parent}})
+        COMPREPLY=($(compgen -W {{sq .Word}} -- "$cur"))
+        ;;
+{{- end}}{{end}}
+    completion)
+        COMPREPLY=($(compgen -W '{{join .Formats " "}}' -- "$cur"))
+        ;;
+    *)
+        COMPREPLY=($(compgen -f -- "$cur"))
+        ;;
+    esac
+}
+complete -F _alpaca alpaca
+{{end}}
+
+{{- define "zsh" -}}
+#compdef alpaca
+# zsh completion for alpaca. Save it as _alpaca in a directory in $fpath.
+_alpaca() {
+    local -a commands
+    if (( CURRENT == 2 )) && [[ $words[CURRENT] != -* ]]; then
+        commands=(
+{{- range .Words}}{{if eq .Parent ""}}
+            {{sq (printf "%s:%s" .Word (zdesc .Usage))}}
+{{- end}}{{end}}
+        )
+        _describe command commands
+        return
+    fi
+    case "${words[2,CURRENT-1]}" in
+{{- range .Words}}{{if ne .Parent ""}}
+    {{sq .Parent}})
+        commands=({{sq (printf "%s:%s" .Word (zdesc .Usage))}})
+        _describe command commands
+        return
+        ;;
+{{- end}}{{end}}
+    completion)
+        _values format {{join .Formats " "}}
+        return
+        ;;
+    esac
+    _arguments \
+{{- range .Flags}}
+        {{sq (zflag .)}} \
+{{- end}}
+        '*:argument:_default'
+}
+_alpaca "$@"
+{{end}}
+
+{{- define "fish" -}}
+# fish completion for alpaca. Load it with: alpaca completion fish | source
+{{- range .Words}}
+{{- if eq .Parent ""}}
+complete -c alpaca -f -n __fish_use_subcommand -a {{.Word}} -d {{sq .Usage}}
+{{- else}}
+{{- $cond := printf "__fish_seen_subcommand_from %s" .Parent}}
+complete -c alpaca -f -n {{sq $cond}} -a {{.Word}} -d {{sq .Usage}}
+{{- end}}
+{{- end}}
+complete -c alpaca -f -n '__fish_seen_subcommand_from completion' -a '{{join .Formats " "}}'
+{{- range .Flags}}
+complete -c alpaca -o {{.Name}} -d {{sq .Usage}}{{if .Value}} -r{{end}}
+{{- end}}
+{{end}}
+
+{{- define "powershell" -}}
+# PowerShell completion for alpaca. Load it with:
+# alpaca completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName alpaca, alpaca.exe -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { "$_" })
+    if ($wordToComplete -ne '') {
+        $words = @($words | Select-Object -SkipLast 1)
+    }
+    $parent = $words -join ' '
+    $candidates = @()
+    if ($wordToComplete -notlike '-*') {
+        switch ($parent) {
+            '' {
+{{- range .Words}}{{if eq .Parent ""}}
+                $candidates += , @({{psq .Word}}, {{psq (or .Usage .Word)}})
+{{- end}}{{end}}
+            }
+{{- range .Words}}{{if ne .Parent ""}}
+            {{psq .Parent}} { $candidates += , @({{psq .Word}}, {{psq .Usage}}) }
+{{- end}}{{end}}
+            'completion' {
+{{- range .Formats}}
+                $candidates += , @({{psq .}}, {{psq .}})
+{{- end}}
+            }
+        }
+    }
+    if ($candidates.Count -eq 0) {
+{{- range .Flags}}
+        $candidates += , @({{psq (printf "-%s" .Name)}}, {{psq .Usage}})
+{{- end}}
+    }
+    $candidates | Where-Object { $_[0] -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new(
+            $_[0], $_[0], 'ParameterValue', $_[1])
+    }
+}
+{{end}}
+
+{{- define "man" -}}
+.TH ALPACA 1
+.SH NAME
+alpaca \- a local HTTP proxy for command-line tools
+.SH SYNOPSIS
+.B alpaca
+[\fIflags\fR]
+{{- range .Synopsis}}
+.br
+.B alpaca {{roff (index . 0)}}
+{{roff (index . 1)}}
+{{- end}}
+.SH DESCRIPTION
+Alpaca is a local HTTP proxy for command-line tools. It supports proxy
+auto-configuration (PAC) files and NTLM authentication.
+.SH COMMANDS
+{{- range .Words}}{{if .Usage}}
+.TP
+.B {{if .Parent}}{{roff .Parent}} {{end}}{{roff .Word}}
+{{roff .Usage}}
+{{- end}}{{end}}
+.SH FLAGS
+Flags can also be set with ALPACA_ environment variables (e.g. ALPACA_C for
+\-C), or in a config file (see \-config).
+{{- range .Flags}}
+.TP
+.B \-{{roff .Name}}{{if .Value}} \fI{{roff .Value}}\fR{{end}}
+{{roff .Usage}}{{if .Default}} (default: {{roff .Default}}){{end}}
+{{- end}}
+.SH SEE ALSO
+https://github.com/samuong/alpaca
+{{end}}
+`))
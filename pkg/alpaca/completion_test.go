@@ -0,0 +1,92 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"flag"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCompletionFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	fs.Int("p", 3128, "http port number to listen on")
+	fs.Bool("local-direct", false, "don't use the proxy for hosts on local subnets")
+	fs.String("d", "", "domain of the proxy account: e.g. `domain`")
+	return fs
+}
+
+func TestCompletionScripts(t *testing.T) {
+	fs := testCompletionFlags()
+	for _, tc := range []struct {
+		format   string
+		expected []string
+	}{
+		{"bash", []string{
+			"compgen -W '-d -local-direct -p '",
+			"compgen -W 'check resolve test creds debug completion' ",
+			"'debug')\n        COMPREPLY=($(compgen -W 'dump' ",
+		}},
+		{"zsh", []string{
+			"'check:run a self-test",
+			"'*-d[domain of the proxy account\\: e.g. domain]:domain:_default'",
+			"'*-local-direct[don'\\''t use the proxy for hosts on local subnets]' \\",
+		}},
+		{"fish", []string{
+			"-n '__fish_seen_subcommand_from debug' -a dump",
+			"complete -c alpaca -o p -d 'http port number to listen on' -r\n",
+			"complete -c alpaca -o local-direct -d 'don'\\''t use the proxy for hosts on local " +
+				"subnets'\n",
+		}},
+		{"powershell", []string{
+			"'debug' { $candidates += , @('dump', 'save a debug dump",
+			"@('-local-direct', 'don''t use the proxy for hosts on local subnets')",
+		}},
+		{"man", []string{
+			".B alpaca debug dump\n\\-debug port [\\-o file]\n",
+			".B \\-p \\fIint\\fR\nhttp port number to listen on (default: 3128)\n",
+			".B \\-local\\-direct\ndon't use",
+		}},
+	} {
+		var sb strings.Builder
+		require.NoError(t, completionCommand([]string{tc.format}, fs, &sb), tc.format)
+		for _, s := range tc.expected {
+			assert.Contains(t, sb.String(), s, tc.format)
+		}
+	}
+}
+
+func TestBashCompletionSyntax(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash isn't installed")
+	}
+	var sb strings.Builder
+	require.NoError(t, completionCommand([]string{"bash"}, testCompletionFlags(), &sb))
+	cmd := exec.Command("bash", "-n")
+	cmd.Stdin = strings.NewReader(sb.String())
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
+
+func TestCompletionUsage(t *testing.T) {
+	fs := testCompletionFlags()
+	assert.EqualError(t, completionCommand(nil, fs, &strings.Builder{}),
+		"usage: alpaca completion bash|zsh|fish|powershell|man")
+	assert.Error(t, completionCommand([]string{"tcsh"}, fs, &strings.Builder{}))
+}
@@ -0,0 +1,244 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// loadConfig applies settings from ALPACA_* environment variables and from a config file to the
+// flags in fs. The precedence is: flags set on the command line, then environment variables, then
+// the config file. The config file is given by the -config flag (which can itself be set using
+// the ALPACA_CONFIG environment variable); if it isn't, the default config files are used.
+func loadConfig(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := envVarName(f.Name)
+		value, ok := lookupEnv(name)
+		if !ok {
+			return
+		}
+		if err = fs.Set(f.Name, value); err != nil {
+			err = fmt.Errorf("invalid value for %s: %w", name, err)
+			return
+		}
+		set[f.Name] = true
+	})
+	if err != nil {
+		return err
+	}
+	paths, err := configFiles(fs)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := loadConfigFile(fs, path, set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configFiles returns the config files to read settings from, in order of precedence: the one
+// given by the -config flag, or if it isn't set, the user's config file and then the system-wide
+// one (see defaultConfigPaths), if they exist.
+func configFiles(fs *flag.FlagSet) ([]string, error) {
+	config := fs.Lookup("config")
+	if config == nil {
+		return nil, nil
+	} else if config.Value.String() != "" {
+		return []string{config.Value.String()}, nil
+	}
+	var paths []string
+	for _, path := range defaultConfigPaths() {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if path == systemConfigPath {
+			if err := checkSystemConfig(info); err != nil {
+				return nil, err
+			}
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// envVarName returns the name of the environment variable for a flag, e.g. ALPACA_MY_IP for the
+// -my-ip flag, or ALPACA_C for the -C flag.
+func envVarName(flagName string) string {
+	return "ALPACA_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfigFile reads a JSON config file containing an object whose keys are flag names, e.g.
+// {"p": 3128, "my-ip": "pac"}, and applies each setting to the corresponding flag. Flags that
+// are in the set map (because they were set some other way) are left alone.
+func loadConfigFile(fs *flag.FlagSet, path string, set map[string]bool) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Numbers are kept as they're written (see flagValue), rather than as float64s.
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var settings map[string]interface{}
+	if err := dec.Decode(&settings); err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	} else if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("error parsing config file %s: unexpected data after the settings",
+			path)
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "listeners" {
+			continue // Not a flag; see loadListenerConfigs
+		} else if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q in config file %s", name, path)
+		} else if set[name] {
+			continue
+		}
+		// Flags that can be given more than once (such as -l) can be set to an array.
+		values, ok := settings[name].([]interface{})
+		if !ok {
+			values = []interface{}{settings[name]}
+		}
+		for _, value := range values {
+			if err := fs.Set(name, flagValue(value)); err != nil {
+				return fmt.Errorf("invalid value for %q in config file %s: %w", name, path,
+					err)
+			}
+		}
+		set[name] = true
+	}
+	return nil
+}
+
+// flagValue returns the string to set a flag to, for a value from a JSON config file.
+func flagValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		// Integers are used exactly as they're written (even if they're too big for a float64),
+		// but other numbers are written out without an exponent, so that (for example) 3e3
+		// can be used for an int flag.
+		if !strings.ContainsAny(v.String(), ".eE") {
+			return v.String()
+		} else if f, err := v.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// listenerConfig describes an extra port for Alpaca to listen on, which authenticates to the
+// upstream proxy with its own credentials. This lets several users (or service accounts) share
+// one instance, e.g. on a build machine. Listeners are set in the config file, since they don't
+// fit in a flag:
+//
+//	{"listeners": [{"port": 3129, "domain": "CORP", "username": "svc-build"}]}
+//
+// The credentials come from ntlm-credentials (in the format printed by `alpaca -H`), or from an
+// encrypted credentials-file, or else the password is read from the terminal.
+type listenerConfig struct {
+	Port            int    `json:"port"`
+	Domain          string `json:"domain"`
+	Username        string `json:"username"`
+	NTLMCredentials string `json:"ntlm-credentials"`
+	CredentialsFile string `json:"credentials-file"`
+}
+
+// loadListenerConfigs reads the extra listeners from a config file. mainPort is the port given
+// by the -p flag, which a listener can't reuse.
+func loadListenerConfigs(path string, mainPort int) ([]listenerConfig, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Listeners []listenerConfig `json:"listeners"`
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	ports := map[int]bool{mainPort: true}
+	for _, lc := range config.Listeners {
+		if lc.Port <= 0 || lc.Port > 65535 {
+			return nil, fmt.Errorf("invalid listener port %d in config file %s", lc.Port, path)
+		} else if ports[lc.Port] {
+			return nil, fmt.Errorf("port %d is used more than once in config file %s",
+				lc.Port, path)
+		}
+		ports[lc.Port] = true
+	}
+	return config.Listeners, nil
+}
+
+// loadListeners reads the extra listeners from the config files that loadConfig reads settings
+// from (see configFiles). Like a flag, they're taken from the first file that has any, so the
+// user's config file can replace the system-wide one's listeners.
+func loadListeners(fs *flag.FlagSet, mainPort int) ([]listenerConfig, error) {
+	paths, err := configFiles(fs)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		listeners, err := loadListenerConfigs(path, mainPort)
+		if err != nil {
+			return nil, err
+		} else if len(listeners) > 0 {
+			return listeners, nil
+		}
+	}
+	return nil, nil
+}
+
+// authenticator returns the credentials for a listener, or nil if none were given (in which case
+// requests through the listener won't be authenticated).
+func (lc listenerConfig) authenticator() (*authenticator, error) {
+	if lc.NTLMCredentials != "" {
+		return fromEnvVar(lc.NTLMCredentials).parse()
+	} else if lc.CredentialsFile != "" {
+		return fromCredentialsFile(lc.CredentialsFile).getCredentials()
+	} else if lc.Domain != "" && lc.Username != "" {
+		return injectCredentialFault(fromTerminal().forUser(lc.Domain, lc.Username)).
+			getCredentials()
+	} else if lc.Domain != "" || lc.Username != "" {
+		return nil, errors.New("both a domain and username are needed")
+	}
+	return nil, nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func noEnv(string) (string, bool) { return "", false }
+
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	port := fs.Int("p", 3128, "")
+	pacurl := fs.String("C", "", "")
+	myIP := fs.String("my-ip", myIPAuto, "")
+	version := fs.Bool("version", false, "")
+	fs.String("config", "", "")
+	path := writeConfigFile(t, `{
+		"p": 3129,
+		"C": "http://config.test/proxy.pac",
+		"my-ip": "pac",
+		"version": true
+	}`)
+	args := []string{"-C", "http://cmdline.test/proxy.pac", "-config", path}
+	require.NoError(t, fs.Parse(args))
+	require.NoError(t, loadConfig(fs, noEnv))
+	assert.Equal(t, 3129, *port)
+	assert.Equal(t, "http://cmdline.test/proxy.pac", *pacurl)
+	assert.Equal(t, "pac", *myIP)
+	assert.True(t, *version)
+}
+
+func TestLoadConfigFileNumbers(t *testing.T) {
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	port := fs.Int("p", 3128, "")
+	big := fs.Uint64("big", 0, "")
+	size := fs.Int64("size", 0, "")
+	timeout := fs.Float64("timeout", 0, "")
+	path := writeConfigFile(t, `{
+		"p": 3e3,
+		"big": 18446744073709551615,
+		"size": 10000000000,
+		"timeout": 2.5
+	}`)
+	require.NoError(t, loadConfigFile(fs, path, make(map[string]bool)))
+	assert.Equal(t, 3000, *port)
+	assert.Equal(t, uint64(18446744073709551615), *big)
+	assert.Equal(t, int64(10000000000), *size)
+	assert.Equal(t, 2.5, *timeout)
+}
+
+func TestFlagValue(t *testing.T) {
+	for value, want := range map[interface{}]string{
+		"pac":                           "pac",
+		json.Number("8080"):             "8080",
+		json.Number("3e3"):              "3000",
+		json.Number("1.5E1"):            "15",
+		json.Number("0.25"):             "0.25",
+		json.Number("9007199254740993"): "9007199254740993",
+		true:                            "true",
+	} {
+		assert.Equal(t, want, flagValue(value), "flagValue(%#v)", value)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	port := fs.Int("p", 3128, "")
+	pacurl := fs.String("C", "", "")
+	myIP := fs.String("my-ip", myIPAuto, "")
+	localDirect := fs.Bool("local-direct", false, "")
+	fs.String("config", "", "")
+	path := writeConfigFile(t, `{
+		"p": 3129,
+		"C": "http://config.test/proxy.pac",
+		"my-ip": "pac"
+	}`)
+	require.NoError(t, fs.Parse([]string{"-C", "http://cmdline.test/proxy.pac"}))
+	env := fakeEnv(map[string]string{
+		"ALPACA_CONFIG":       path,
+		"ALPACA_C":            "http://env.test/proxy.pac",
+		"ALPACA_MY_IP":        "eth0",
+		"ALPACA_LOCAL_DIRECT": "true",
+	})
+	require.NoError(t, loadConfig(fs, env))
+	assert.Equal(t, "http://cmdline.test/proxy.pac", *pacurl) // flag > env > file
+	assert.Equal(t, "eth0", *myIP)                            // env > file
+	assert.Equal(t, 3129, *port)                              // file > default
+	assert.True(t, *localDirect)
+}
+
+func TestEnvVarName(t *testing.T) {
+	assert.Equal(t, "ALPACA_C", envVarName("C"))
+	assert.Equal(t, "ALPACA_PAC_REFRESH", envVarName("pac-refresh"))
+}
+
+func TestLoadConfigInvalidEnvVar(t *testing.T) {
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	fs.Int("p", 3128, "")
+	err := loadConfig(fs, fakeEnv(map[string]string{"ALPACA_P": "not a number"}))
+	assert.ErrorContains(t, err, "ALPACA_P")
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"InvalidJSON", `{"p": `},
+		{"TrailingData", `{"p": 3129} {"p": 3130}`},
+		{"NotAnInteger", `{"p": 3129.5}`},
+		{"UnknownSetting", `{"nonexistent": 1}`},
+		{"InvalidValue", `{"p": "not a number"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+			fs.Int("p", 3128, "")
+			set := make(map[string]bool)
+			assert.Error(t, loadConfigFile(fs, writeConfigFile(t, test.content), set))
+		})
+	}
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	path := filepath.Join(t.TempDir(), "nonexistent.json")
+	assert.Error(t, loadConfigFile(fs, path, make(map[string]bool)))
+}
+
+func TestLoadListenerConfigs(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"p": 3128,
+		"listeners": [
+			{"port": 3129, "ntlm-credentials": "alice@CORP:00112233445566778899aabbccddeeff"},
+			{"port": 3130}
+		]
+	}`)
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	port := fs.Int("p", 0, "")
+	require.NoError(t, loadConfigFile(fs, path, make(map[string]bool)))
+	assert.Equal(t, 3128, *port)
+	listeners, err := loadListenerConfigs(path, *port)
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	assert.Equal(t, 3129, listeners[0].Port)
+	a, err := listeners[0].authenticator()
+	require.NoError(t, err)
+	require.NotNil(t, a)
+	assert.Equal(t, "CORP", a.domain)
+	assert.Equal(t, "alice", a.username)
+	a, err = listeners[1].authenticator()
+	require.NoError(t, err)
+	assert.Nil(t, a)
+}
+
+func TestLoadListenerConfigsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"InvalidPort", `{"listeners": [{"port": 0}]}`},
+		{"MainPort", `{"listeners": [{"port": 3128}]}`},
+		{"DuplicatePort", `{"listeners": [{"port": 3129}, {"port": 3129}]}`},
+		{"InvalidJSON", `{"listeners": {"port": 3129}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadListenerConfigs(writeConfigFile(t, test.content), 3128)
+			assert.Error(t, err)
+		})
+	}
+	_, err := listenerConfig{Port: 3129, Domain: "CORP"}.authenticator()
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var errConnExpired = errors.New("connection has reached its maximum lifetime")
+
+// expiringConn is a net.Conn that stops being used for new requests once it's older than its
+// maximum lifetime. Some gateways silently invalidate a connection's authentication state after a
+// while (e.g. 30 minutes), so it's better to open a new one before that happens.
+//
+// An expired connection is closed when the next request is about to be written to it. Since
+// nothing has been written yet, http.Transport retries the request on a new connection.
+type expiringConn struct {
+	net.Conn
+	expires time.Time
+	now     func() time.Time
+	// Whether a request is being written, i.e. there has been a Write with no Read since.
+	writing atomic.Bool
+}
+
+func (c *expiringConn) Read(b []byte) (int, error) {
+	c.writing.Store(false)
+	return c.Conn.Read(b)
+}
+
+func (c *expiringConn) Write(b []byte) (int, error) {
+	if !c.writing.Swap(true) && !c.now().Before(c.expires) {
+		log.Printf("Recycling connection to %s after reaching its maximum lifetime",
+			c.RemoteAddr())
+		c.Conn.Close()
+		return 0, errConnExpired
+	}
+	return c.Conn.Write(b)
+}
+
+// expiringDialer returns a DialContext func for an http.Transport, for connections (made using
+// dial) with the given maximum lifetime.
+func expiringDialer(dial dialFunc, lifetime time.Duration) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &expiringConn{Conn: conn, expires: time.Now().Add(lifetime), now: time.Now}, nil
+	}
+}
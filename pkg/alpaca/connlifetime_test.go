@@ -0,0 +1,93 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiringConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	now := time.Now()
+	conn := &expiringConn{Conn: client, expires: now.Add(time.Minute)}
+	conn.now = func() time.Time { return now }
+	go func() {
+		// Read the request, and then send a response.
+		_, _ = io.ReadFull(server, make([]byte, 2))
+		_, _ = server.Write([]byte("ok"))
+	}()
+
+	// Writes are allowed before the connection expires, and in the middle of a request.
+	_, err := conn.Write([]byte("a"))
+	require.NoError(t, err)
+	now = now.Add(time.Minute)
+	_, err = conn.Write([]byte("b"))
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+
+	// But after that, the next request fails without writing anything.
+	n, err := conn.Write([]byte("c"))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, errConnExpired)
+}
+
+func TestRequestsRetriedAfterConnExpires(t *testing.T) {
+	var mux sync.Mutex
+	var addrs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		mux.Lock()
+		addrs = append(addrs, req.RemoteAddr)
+		mux.Unlock()
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+	ph := newDirectProxy()
+	ph.setMaxConnLifetime(50 * time.Millisecond)
+	proxy := httptest.NewServer(ph)
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	post := func(body string) {
+		resp, err := client.Post(server.URL, "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		echoed, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(echoed))
+	}
+	post("first")
+	post("second")
+	time.Sleep(100 * time.Millisecond)
+	post("third")
+	require.Len(t, addrs, 3)
+	assert.Equal(t, addrs[0], addrs[1], "connection should be reused before it expires")
+	assert.NotEqual(t, addrs[1], addrs[2], "connection should be recycled after it expires")
+}
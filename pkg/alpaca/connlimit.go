@@ -0,0 +1,214 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// contextKeyConnSlot holds the *connSlot for a request, if connections are being limited.
+const contextKeyConnSlot = contextKey("connSlot")
+
+// connLimiter limits the number of requests (including CONNECT tunnels) that can be open to each
+// destination host, and through each upstream proxy, at once. Upstream proxies often limit how
+// many connections each user can have (or throttle users who open too many), and parallel builds
+// can easily go over that limit, causing what look like random failures. Requests over the limit
+// wait for an earlier one to finish.
+type connLimiter struct {
+	maxPerHost  int           // Maximum number of connections to each host (0 for no limit)
+	maxPerProxy int           // Maximum number of connections through each proxy (0 for no limit)
+	wait        time.Duration // How long to wait for a free slot before giving up
+	slots       map[string]*hostSlots
+	waits       map[string]*connWaits // By kind ("host" or "proxy")
+	mux         sync.Mutex
+}
+
+type hostSlots struct {
+	sem   chan struct{}
+	users int // The number of requests holding, or waiting for, a slot
+}
+
+// connWaits counts the requests that had to wait for a slot, and how long they waited.
+type connWaits struct {
+	waited   int64 // Including the ones that gave up
+	timedOut int64
+	total    time.Duration
+	longest  time.Duration
+}
+
+func newConnLimiter(maxPerHost, maxPerProxy int, wait time.Duration) *connLimiter {
+	return &connLimiter{
+		maxPerHost:  maxPerHost,
+		maxPerProxy: maxPerProxy,
+		wait:        wait,
+		slots:       make(map[string]*hostSlots),
+		waits:       make(map[string]*connWaits),
+	}
+}
+
+// connSlot is a slot held by a request. Normally it's released once the request has been
+// handled, but a CONNECT request claims it, and releases it once the tunnel has closed.
+type connSlot struct {
+	release func()
+	claimed bool
+}
+
+// claimConnSlot takes over releasing the slot held by req (if any), and returns the function
+// that releases it, or nil.
+func claimConnSlot(req *http.Request) func() {
+	slot, ok := req.Context().Value(contextKeyConnSlot).(*connSlot)
+	if !ok {
+		return nil
+	}
+	slot.claimed = true
+	return slot.release
+}
+
+// WrapHandler limits the requests handled by next. It should be placed inside the ProxyFinder's
+// handler, so that the proxy used for each request is known.
+func (cl *connLimiter) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect && req.URL.Scheme == "" {
+			// Not a proxy request (see ProxyHandler.WrapHandler).
+			next.ServeHTTP(w, req)
+			return
+		}
+		proxy, _ := req.Context().Value(contextKeyProxy).(*url.URL)
+		release, err := cl.acquireAll(req.Context(), req.URL.Hostname(), proxy)
+		if err != nil {
+			log.Printf("[%d] %v", req.Context().Value(contextKeyID), err)
+			writeProxyError(w, req, http.StatusServiceUnavailable, stageConnect, proxy, err)
+			return
+		}
+		slot := &connSlot{release: release}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextKeyConnSlot,
+			slot)))
+		if !slot.claimed {
+			release()
+		}
+	})
+}
+
+// acquireAll waits for a slot for the host, and then one for the proxy (unless the request is
+// going direct), and returns a function that releases both of them. The request waits for up to
+// cl.wait in total.
+func (cl *connLimiter) acquireAll(ctx context.Context, host string, proxy *url.URL) (func(),
+	error) {
+	deadline := time.Now().Add(cl.wait)
+	releaseHost := func() {}
+	if cl.maxPerHost > 0 {
+		var err error
+		if releaseHost, err = cl.acquire(ctx, "host", host, cl.maxPerHost, deadline); err != nil {
+			return nil, err
+		}
+	}
+	if cl.maxPerProxy == 0 || proxy == nil {
+		return releaseHost, nil
+	}
+	releaseProxy, err := cl.acquire(ctx, "proxy", proxy.Host, cl.maxPerProxy, deadline)
+	if err != nil {
+		releaseHost()
+		return nil, err
+	}
+	return func() {
+		releaseProxy()
+		releaseHost()
+	}, nil
+}
+
+// acquire waits (until deadline) for one of the limit slots for the named host or proxy, and
+// returns a function that releases it.
+func (cl *connLimiter) acquire(ctx context.Context, kind, name string, limit int,
+	deadline time.Time) (func(), error) {
+	key := kind + " " + name
+	cl.mux.Lock()
+	hs, ok := cl.slots[key]
+	if !ok {
+		hs = &hostSlots{sem: make(chan struct{}, limit)}
+		cl.slots[key] = hs
+	}
+	hs.users++
+	cl.mux.Unlock()
+	var once sync.Once
+	release := func() { once.Do(func() { <-hs.sem; cl.done(key, hs) }) }
+	select {
+	case hs.sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+	start := time.Now()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case hs.sem <- struct{}{}:
+		cl.recordWait(kind, time.Since(start), false)
+		return release, nil
+	case <-timer.C:
+		cl.recordWait(kind, time.Since(start), true)
+		cl.done(key, hs)
+		return nil, fmt.Errorf("%w: waited %v for one of the %d connections to %s %s",
+			ErrTooManyConnections, cl.wait, limit, kind, name)
+	case <-ctx.Done():
+		cl.recordWait(kind, time.Since(start), false)
+		cl.done(key, hs)
+		return nil, ctx.Err()
+	}
+}
+
+// done forgets about a host (or proxy) once no requests are using it, so that the map doesn't
+// keep growing.
+func (cl *connLimiter) done(key string, hs *hostSlots) {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	hs.users--
+	if hs.users == 0 {
+		delete(cl.slots, key)
+	}
+}
+
+func (cl *connLimiter) recordWait(kind string, d time.Duration, timedOut bool) {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	cw, ok := cl.waits[kind]
+	if !ok {
+		cw = &connWaits{}
+		cl.waits[kind] = cw
+	}
+	cw.waited++
+	if timedOut {
+		cw.timedOut++
+	}
+	cw.total += d
+	if d > cw.longest {
+		cw.longest = d
+	}
+}
+
+// waitStats returns a copy of the wait counters, by kind.
+func (cl *connLimiter) waitStats() map[string]connWaits {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	stats := make(map[string]connWaits, len(cl.waits))
+	for kind, cw := range cl.waits {
+		stats[kind] = *cw
+	}
+	return stats
+}
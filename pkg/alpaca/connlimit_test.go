@@ -0,0 +1,139 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiterAcquire(t *testing.T) {
+	cl := newConnLimiter(1, 0, 50*time.Millisecond)
+	release, err := cl.acquireAll(context.Background(), "a.test", nil)
+	require.NoError(t, err)
+	// Other hosts have their own limit.
+	releaseB, err := cl.acquireAll(context.Background(), "b.test", nil)
+	require.NoError(t, err)
+	_, err = cl.acquireAll(context.Background(), "a.test", nil)
+	assert.ErrorIs(t, err, ErrTooManyConnections)
+	release()
+	release() // Releasing twice is harmless
+	release, err = cl.acquireAll(context.Background(), "a.test", nil)
+	require.NoError(t, err)
+	release()
+	releaseB()
+	assert.Empty(t, cl.slots)
+	stats := cl.waitStats()["host"]
+	assert.Equal(t, int64(1), stats.waited)
+	assert.Equal(t, int64(1), stats.timedOut)
+	assert.GreaterOrEqual(t, stats.longest, 50*time.Millisecond)
+}
+
+func TestConnLimiterWaitsForSlot(t *testing.T) {
+	cl := newConnLimiter(1, 0, time.Second)
+	release, err := cl.acquireAll(context.Background(), "a.test", nil)
+	require.NoError(t, err)
+	time.AfterFunc(50*time.Millisecond, release)
+	release, err = cl.acquireAll(context.Background(), "a.test", nil)
+	require.NoError(t, err)
+	release()
+	stats := cl.waitStats()["host"]
+	assert.Equal(t, int64(1), stats.waited)
+	assert.Zero(t, stats.timedOut)
+	assert.GreaterOrEqual(t, stats.total, 50*time.Millisecond)
+}
+
+func TestConnLimiterPerProxy(t *testing.T) {
+	cl := newConnLimiter(0, 2, 50*time.Millisecond)
+	proxy := &url.URL{Host: "proxy.test:8080"}
+	releaseA, err := cl.acquireAll(context.Background(), "a.test", proxy)
+	require.NoError(t, err)
+	releaseB, err := cl.acquireAll(context.Background(), "b.test", proxy)
+	require.NoError(t, err)
+	// The proxy's limit applies across hosts.
+	_, err = cl.acquireAll(context.Background(), "c.test", proxy)
+	assert.ErrorIs(t, err, ErrTooManyConnections)
+	assert.ErrorContains(t, err, "connections to proxy proxy.test:8080")
+	// Other proxies, and requests that go direct, aren't limited by it.
+	releaseOther, err := cl.acquireAll(context.Background(), "c.test",
+		&url.URL{Host: "other.test:8080"})
+	require.NoError(t, err)
+	releaseDirect, err := cl.acquireAll(context.Background(), "c.test", nil)
+	require.NoError(t, err)
+	releaseA()
+	releaseC, err := cl.acquireAll(context.Background(), "c.test", proxy)
+	require.NoError(t, err)
+	for _, release := range []func(){releaseB, releaseC, releaseOther, releaseDirect} {
+		release()
+	}
+	assert.Empty(t, cl.slots)
+	assert.Equal(t, int64(1), cl.waitStats()["proxy"].timedOut)
+}
+
+func TestConnLimiterReleasesHostIfProxyIsBusy(t *testing.T) {
+	cl := newConnLimiter(1, 1, 50*time.Millisecond)
+	proxy := &url.URL{Host: "proxy.test:8080"}
+	release, err := cl.acquireAll(context.Background(), "a.test", proxy)
+	require.NoError(t, err)
+	_, err = cl.acquireAll(context.Background(), "b.test", proxy)
+	assert.ErrorIs(t, err, ErrTooManyConnections)
+	// The slot for b.test was given back when the proxy's one couldn't be had.
+	release()
+	assert.Empty(t, cl.slots)
+}
+
+// connectVia sends a CONNECT request for target through the proxy, and returns the connection
+// along with the response status.
+func connectVia(t *testing.T, proxy, target string) (net.Conn, int) {
+	conn, err := net.Dial("tcp", proxy)
+	require.NoError(t, err)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	return conn, resp.StatusCode
+}
+
+func TestConnLimiterHoldsSlotForTunnel(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	target := server.Listener.Addr().String()
+	cl := newConnLimiter(1, 0, 50*time.Millisecond)
+	proxy := httptest.NewServer(cl.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	proxyAddr := proxy.Listener.Addr().String()
+
+	tunnel, status := connectVia(t, proxyAddr, target)
+	assert.Equal(t, http.StatusOK, status)
+	// The tunnel is still open, so there's no slot for another one.
+	conn, status := connectVia(t, proxyAddr, target)
+	conn.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	tunnel.Close()
+	require.Eventually(t, func() bool {
+		conn, status := connectVia(t, proxyAddr, target)
+		conn.Close()
+		return status == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/samuong/go-ntlmssp"
+)
+
+// rotatingAuth is a proxyAuth whose NTLM credentials can be replaced while Alpaca is running
+// (see credentialsAPI). A handshake that has already started carries on with the credentials
+// that it started with; connections that have already been authenticated stay authenticated.
+type rotatingAuth struct {
+	current atomic.Pointer[authenticator]
+	// While credentials are being loaded in the background (see loadInBackground), what Alpaca
+	// is waiting for.
+	status atomic.Pointer[string]
+}
+
+func (ra *rotatingAuth) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	a := ra.current.Load()
+	if a == nil {
+		// There are no credentials (yet); see authEnabled.
+		return rt.RoundTrip(req)
+	}
+	return a.do(req, rt)
+}
+
+// loadInBackground gets credentials from src (the source called name, e.g. the keyring) without
+// holding up startup, since some keyrings block until they're unlocked, in a dialog that may be
+// hidden or on another screen. Until they're found, there are no credentials, so a 407 response
+// is passed on to the client. If src hasn't returned after warnAfter, a warning is logged.
+func (ra *rotatingAuth) loadInBackground(src credentialSource, name string,
+	warnAfter time.Duration) {
+	ra.setStatus("waiting for the " + name)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(warnAfter):
+			log.Printf("Still waiting for credentials from the %s after %v; it may need to be "+
+				"unlocked (check for a password prompt). Until then, proxy auth is disabled",
+				name, warnAfter)
+			ra.setStatus(fmt.Sprintf("waiting for the %s, which may need to be unlocked", name))
+		}
+	}()
+	a, err := src.getCredentials()
+	ra.setStatus("")
+	if err != nil {
+		log.Printf("Credentials not found, disabling proxy auth: %v", err)
+	} else if !ra.current.CompareAndSwap(nil, a) {
+		log.Printf("Ignoring the credentials from the %s, since others were set using the API",
+			name)
+	} else {
+		log.Printf("Using the credentials for %s\\%s from the %s", a.domain, a.username, name)
+	}
+}
+
+func (ra *rotatingAuth) setStatus(status string) {
+	if status == "" {
+		ra.status.Store(nil)
+	} else {
+		ra.status.Store(&status)
+	}
+}
+
+// loadingStatus returns what Alpaca is waiting for while it loads credentials in the background,
+// or an empty string if it isn't.
+func (ra *rotatingAuth) loadingStatus() string {
+	if s := ra.status.Load(); s != nil {
+		return *s
+	}
+	return ""
+}
+
+// authEnabled returns whether auth has credentials to authenticate with. If it doesn't, a 407
+// response from the upstream proxy is passed on to the client.
+func authEnabled(auth proxyAuth) bool {
+	if ra, ok := auth.(*rotatingAuth); ok {
+		return ra.current.Load() != nil
+	} else if _, ok := auth.(*fallbackAuth); ok {
+		return true // The fallback credentials are always there
+	}
+	return auth != nil
+}
+
+// credentialsAPI lets the NTLM credentials be changed without restarting Alpaca (e.g. after a
+// password change), using POST /alpaca/api/credentials. Requests are only accepted from localhost,
+// and since other users of the same machine could make them too, they must also give the token
+// that Alpaca writes to a file that only the user running it can read.
+type credentialsAPI struct {
+	auth  *rotatingAuth
+	token string
+}
+
+type credentialsUpdate struct {
+	Domain   string `json:"domain"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Hash     string `json:"hash,omitempty"` // The NTLM hash, in hex
+	// In responses, what Alpaca is waiting for while it loads credentials (see loadingStatus).
+	Status string `json:"status,omitempty"`
+}
+
+func newCredentialsAPI(auth *rotatingAuth) *credentialsAPI {
+	buf := make([]byte, 32)
+	_, _ = rand.Read(buf)
+	return &credentialsAPI{auth: auth, token: hex.EncodeToString(buf)}
+}
+
+// credentialsTokenPath returns the path of the file holding the credentials API token for the
+// instance listening on the given port (in the same directory as the handoff socket).
+func credentialsTokenPath(port int) (string, error) {
+	dir, err := runtimeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("alpaca-%d.token", port)), nil
+}
+
+// writeToken saves the token to path, replacing the token of any previous instance.
+func (api *credentialsAPI) writeToken(path string) error {
+	// Remove the old file rather than overwriting it, in case it can be read by others.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(api.token + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (api *credentialsAPI) SetupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/alpaca/api/credentials", localhostOnly(api.handleCredentials))
+}
+
+func (api *credentialsAPI) handleCredentials(w http.ResponseWriter, req *http.Request) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		var current credentialsUpdate
+		if a := api.auth.current.Load(); a != nil {
+			current = credentialsUpdate{Domain: a.domain, Username: a.username}
+		} else {
+			current.Status = api.auth.loadingStatus()
+		}
+		writeJSON(w, http.StatusOK, current)
+	case http.MethodPost:
+		var update credentialsUpdate
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a, err := update.authenticator()
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		api.auth.current.Store(a)
+		log.Printf("Credentials changed to %s\\%s using the API", a.domain, a.username)
+		events.publish(eventCredentialsChanged, a.domain+`\`+a.username,
+			"Credentials changed to %s\\%s using the API", a.domain, a.username)
+		writeJSON(w, http.StatusOK, credentialsUpdate{Domain: a.domain, Username: a.username})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (u credentialsUpdate) authenticator() (*authenticator, error) {
+	if u.Domain == "" || u.Username == "" {
+		return nil, errors.New("both a domain and username are needed")
+	}
+	a := &authenticator{domain: u.Domain, username: u.Username}
+	if u.Hash != "" && u.Password != "" {
+		return nil, errors.New("give either a password or a hash, not both")
+	} else if u.Hash != "" {
+		hash, err := hex.DecodeString(u.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash: %w", err)
+		}
+		a.hash = hash
+	} else if u.Password != "" {
+		a.hash = ntlmssp.GetNtlmHash(u.Password)
+		a.password = u.Password
+	} else {
+		return nil, errors.New("a password or hash is needed")
+	}
+	return a, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuong/go-ntlmssp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func credentialsRequest(t *testing.T, server *httptest.Server, method, token,
+	body string) (*http.Response, credentialsUpdate) {
+	req, err := http.NewRequest(method, server.URL+"/alpaca/api/credentials",
+		strings.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var creds credentialsUpdate
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&creds))
+	}
+	return resp, creds
+}
+
+func TestCredentialsAPI(t *testing.T) {
+	ra := &rotatingAuth{}
+	ra.current.Store(&authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""})
+	api := newCredentialsAPI(ra)
+	mux := http.NewServeMux()
+	api.SetupHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, _ := credentialsRequest(t, server, http.MethodGet, "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = credentialsRequest(t, server, http.MethodGet, "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, creds := credentialsRequest(t, server, http.MethodGet, api.token, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, credentialsUpdate{Domain: "isis", Username: "malory"}, creds)
+
+	resp, creds = credentialsRequest(t, server, http.MethodPost, api.token,
+		`{"domain": "isis", "username": "archer", "password": "guest2"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, credentialsUpdate{Domain: "isis", Username: "archer"}, creds)
+	a := ra.current.Load()
+	assert.Equal(t, "archer", a.username)
+	assert.Equal(t, ntlmssp.GetNtlmHash("guest2"), a.hash)
+
+	for _, body := range []string{
+		`{"domain": "isis", "username": "archer"}`,
+		`{"username": "archer", "password": "guest"}`,
+		`{"domain": "isis", "username": "archer", "hash": "xyz"}`,
+		`{"domain": "isis", "username": "archer", "hash": "00", "password": "guest"}`,
+		`not json`,
+	} {
+		resp, _ := credentialsRequest(t, server, http.MethodPost, api.token, body)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	assert.Equal(t, a, ra.current.Load(), "credentials shouldn't change after a bad request")
+}
+
+func TestRotatingAuth(t *testing.T) {
+	parent := httptest.NewServer(ntlmServer{t})
+	defer parent.Close()
+	ra := &rotatingAuth{}
+	ph := NewProxyHandler(ra, http.ProxyURL(&url.URL{Host: parent.Listener.Addr().String()}),
+		func(string) {})
+	proxy := httptest.NewServer(ph)
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+
+	// Without credentials, the proxy's 407 response is passed on to the client.
+	assert.False(t, authEnabled(ra))
+	resp, err := client.Get("http://example.com/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	ra.current.Store(&authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""})
+	assert.True(t, authEnabled(ra))
+	resp, err = client.Get("http://example.com/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// blockingSource is a credential source that returns whatever is sent to it, like a keyring that
+// waits to be unlocked.
+type blockingSource chan *authenticator
+
+func (bs blockingSource) getCredentials() (*authenticator, error) {
+	if a := <-bs; a != nil {
+		return a, nil
+	}
+	return nil, errors.New("the keyring is locked")
+}
+
+func TestLoadCredentialsInBackground(t *testing.T) {
+	ra := &rotatingAuth{}
+	src := make(blockingSource)
+	done := make(chan struct{})
+	go func() {
+		ra.loadInBackground(src, "keyring", 10*time.Millisecond)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		return ra.loadingStatus() == "waiting for the keyring, which may need to be unlocked"
+	}, time.Second, time.Millisecond)
+	assert.False(t, authEnabled(ra))
+	src <- &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""}
+	<-done
+	assert.True(t, authEnabled(ra))
+	assert.Empty(t, ra.loadingStatus())
+}
+
+func TestLoadCredentialsInBackgroundFails(t *testing.T) {
+	ra := &rotatingAuth{}
+	src := make(blockingSource, 1)
+	src <- nil
+	ra.loadInBackground(src, "keyring", time.Minute)
+	assert.False(t, authEnabled(ra))
+	assert.Empty(t, ra.loadingStatus())
+}
+
+func TestCredentialsSetWhileLoading(t *testing.T) {
+	ra := &rotatingAuth{}
+	api := newCredentialsAPI(ra)
+	mux := http.NewServeMux()
+	api.SetupHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	src := make(blockingSource)
+	done := make(chan struct{})
+	go func() {
+		ra.loadInBackground(src, "keyring", time.Minute)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return ra.loadingStatus() != "" }, time.Second,
+		time.Millisecond)
+	resp, creds := credentialsRequest(t, server, http.MethodGet, api.token, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, credentialsUpdate{Status: "waiting for the keyring"}, creds)
+	// Credentials that are set using the API aren't replaced by the keyring's.
+	resp, _ = credentialsRequest(t, server, http.MethodPost, api.token,
+		`{"domain": "isis", "username": "archer", "password": "guest2"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	src <- &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""}
+	<-done
+	assert.Equal(t, "archer", ra.current.Load().username)
+}
+
+func TestCredentialsToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alpaca-3128.token")
+	require.NoError(t, os.WriteFile(path, []byte("old\n"), 0644))
+	api := newCredentialsAPI(&rotatingAuth{})
+	require.NoError(t, api.writeToken(path))
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, api.token+"\n", string(buf))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance from the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/samuong/go-ntlmssp"
+	ring "github.com/zalando/go-keyring"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/term"
+)
+
+type credentialSource interface {
+	getCredentials() (*authenticator, error)
+}
+
+// credentialSources tries each of its sources in turn, and returns the first credentials found.
+type credentialSources []credentialSource
+
+func (cs credentialSources) getCredentials() (*authenticator, error) {
+	if len(cs) == 0 {
+		return nil, errors.New("no credential sources available")
+	}
+	var errs []error
+	for _, src := range cs {
+		a, err := src.getCredentials()
+		if err == nil {
+			return a, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// keyringTimeout is how long to wait for the keyring, which can block indefinitely (e.g. while
+// it waits for the user to unlock it, in a dialog that nobody is looking at).
+var keyringTimeout = 10 * time.Second
+
+// timeoutSource gives up on a credential source that takes longer than timeout. The source is
+// left to finish in the background, since there's no way to cancel it.
+type timeoutSource struct {
+	src     credentialSource
+	name    string
+	timeout time.Duration
+}
+
+func withTimeout(src credentialSource, name string, timeout time.Duration) *timeoutSource {
+	return &timeoutSource{src: src, name: name, timeout: timeout}
+}
+
+func (ts *timeoutSource) getCredentials() (*authenticator, error) {
+	type result struct {
+		a   *authenticator
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		a, err := ts.src.getCredentials()
+		done <- result{a, err}
+	}()
+	select {
+	case r := <-done:
+		return r.a, r.err
+	case <-time.After(ts.timeout):
+		return nil, fmt.Errorf("timed out after %v waiting for the %s", ts.timeout, ts.name)
+	}
+}
+
+type terminal struct {
+	readPassword     func() ([]byte, error)
+	stdout           io.Writer
+	domain, username string
+}
+
+func fromTerminal() *terminal {
+	return &terminal{
+		readPassword: func() ([]byte, error) {
+			return term.ReadPassword(int(os.Stdin.Fd()))
+		},
+		stdout: os.Stdout,
+	}
+}
+
+func (t *terminal) forUser(domain, username string) *terminal {
+	t.domain = domain
+	t.username = username
+	return t
+}
+
+func (t *terminal) getCredentials() (*authenticator, error) {
+	fmt.Fprint(t.stdout, localText("prompt.password", t.domain+"\\"+t.username))
+	buf, err := t.readPassword()
+	fmt.Println()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("the password prompt was cancelled")
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading password from stdin: %w", err)
+	}
+	return &authenticator{
+		domain:   t.domain,
+		username: t.username,
+		hash:     ntlmssp.GetNtlmHash(string(buf)),
+		password: string(buf),
+	}, nil
+}
+
+type envVar struct {
+	value      string
+	keyringGet func(service, user string) (string, error)
+}
+
+func fromEnvVar(value string) *envVar {
+	return &envVar{value: value, keyringGet: keyringStore.get}
+}
+
+func (e *envVar) getCredentials() (*authenticator, error) {
+	a, err := e.parse()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Found credentials for %s\\%s in environment", a.domain, a.username)
+	return a, nil
+}
+
+// parse parses a credentials string, in the format printed by `alpaca -H`.
+func (e *envVar) parse() (*authenticator, error) {
+	if sealed, ok := strings.CutPrefix(e.value, envVarKeyringPrefix); ok {
+		plaintext, err := openEnvVar(sealed, e.keyringGet)
+		if err != nil {
+			return nil, err
+		}
+		return (&envVar{value: plaintext}).parse()
+	}
+	at := strings.IndexRune(e.value, '@')
+	colon := strings.IndexRune(e.value, ':')
+	if at == -1 || colon == -1 || at > colon {
+		return nil, errors.New("invalid credentials string, please run `alpaca -H`")
+	}
+	domain := e.value[at+1 : colon]
+	username := e.value[0:at]
+	hash, err := hex.DecodeString(e.value[colon+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash, please run `alpaca -H`: %w", err)
+	}
+	return &authenticator{domain: domain, username: username, hash: hash}, nil
+}
+
+// envVarKeyringPrefix marks an NTLM_CREDENTIALS value that has been encrypted using a key from the
+// OS keyring (see the -encrypt-hash flag). The value is then useless on any other machine (or to
+// any other user), since they won't have the key.
+const envVarKeyringPrefix = "keyring:"
+
+// The keyring entry used to store the key for encrypted NTLM_CREDENTIALS values.
+const envVarKeyringUser = "ntlm-credentials-key"
+
+// sealEnvVar encrypts the credentials string for a, using the key from the keyring (which is
+// created if it doesn't exist yet, but otherwise reused, so that earlier values still work).
+func sealEnvVar(a *authenticator, keyringGet func(service, user string) (string, error),
+	keyringSet func(service, user, password string) error) (string, error) {
+	value, err := keyringGet(credentialsKeyringService, envVarKeyringUser)
+	if errors.Is(err, ring.ErrNotFound) {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		value = hex.EncodeToString(buf)
+		err = keyringSet(credentialsKeyringService, envVarKeyringUser, value)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error storing key in keyring: %w", err)
+	}
+	key, err := decodeKeyringKey(value)
+	if err != nil {
+		return "", err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	box := secretbox.Seal(nonce[:], []byte(a.String()), &nonce, key)
+	return envVarKeyringPrefix + base64.RawURLEncoding.EncodeToString(box), nil
+}
+
+// openEnvVar decrypts a value produced by sealEnvVar (without its prefix).
+func openEnvVar(sealed string, keyringGet func(service, user string) (string, error)) (string,
+	error) {
+	buf, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(buf) < 24 {
+		return "", errors.New("invalid encrypted credentials, please run `alpaca -H` again")
+	}
+	value, err := keyringGet(credentialsKeyringService, envVarKeyringUser)
+	if err != nil {
+		return "", fmt.Errorf("error getting key from keyring (were these credentials "+
+			"encrypted on another machine?): %w", err)
+	}
+	key, err := decodeKeyringKey(value)
+	if err != nil {
+		return "", err
+	}
+	var nonce [24]byte
+	copy(nonce[:], buf)
+	plaintext, ok := secretbox.Open(nil, buf[24:], &nonce, key)
+	if !ok {
+		return "", errors.New("error decrypting credentials: were they encrypted on another " +
+			"machine?")
+	}
+	return string(plaintext), nil
+}
+
+func decodeKeyringKey(value string) (*[32]byte, error) {
+	var key [32]byte
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) != len(key) {
+		return nil, errors.New("invalid key in keyring")
+	}
+	copy(key[:], decoded)
+	return &key, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/samuong/go-ntlmssp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ring "github.com/zalando/go-keyring"
+)
+
+func TestTerminal(t *testing.T) {
+	fakeTerm := &terminal{
+		readPassword: func() ([]byte, error) { return []byte("guest"), nil },
+		stdout:       new(bytes.Buffer),
+	}
+	a, err := fakeTerm.forUser("isis", "malory").getCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, "malory@isis:823893adfad2cda6e1a414f3ebdf58f7", a.String())
+}
+
+func TestEnvVar(t *testing.T) {
+	a, err := fromEnvVar("malory@isis:823893adfad2cda6e1a414f3ebdf58f7").getCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, "isis", a.domain)
+	assert.Equal(t, "malory", a.username)
+	assert.Equal(t, ntlmssp.GetNtlmHash("guest"), a.hash)
+}
+
+func TestEnvVarInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		input string
+	}{
+		{name: "NoAtDomain", input: "malory:823893adfad2cda6e1a414f3ebdf58f7"},
+		{name: "NoColonHash", input: "malory@isis"},
+		{name: "WrongOrder", input: "823893adfad2cda6e1a414f3ebdf58f7:malory@isis"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := fromEnvVar(test.input).getCredentials()
+			assert.Error(t, err)
+		})
+	}
+}
+
+// fakeKeyring returns get and set functions for an in-memory keyring.
+func fakeKeyring() (func(service, user string) (string, error),
+	func(service, user, password string) error) {
+	keyring := make(map[string]string)
+	get := func(service, user string) (string, error) {
+		value, ok := keyring[service+"/"+user]
+		if !ok {
+			return "", ring.ErrNotFound
+		}
+		return value, nil
+	}
+	set := func(service, user, password string) error {
+		keyring[service+"/"+user] = password
+		return nil
+	}
+	return get, set
+}
+
+func TestEnvVarEncrypted(t *testing.T) {
+	a, err := fromEnvVar("malory@isis:823893adfad2cda6e1a414f3ebdf58f7").parse()
+	require.NoError(t, err)
+	get, set := fakeKeyring()
+	sealed, err := sealEnvVar(a, get, set)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, envVarKeyringPrefix))
+	assert.NotContains(t, sealed, "malory")
+	// Encrypting again reuses the same key, so both values keep working.
+	sealed2, err := sealEnvVar(a, get, set)
+	require.NoError(t, err)
+	for _, value := range []string{sealed, sealed2} {
+		parsed, err := (&envVar{value: value, keyringGet: get}).parse()
+		require.NoError(t, err)
+		assert.Equal(t, a.String(), parsed.String())
+	}
+	// On another machine, the key is missing (or different).
+	otherGet, otherSet := fakeKeyring()
+	_, err = (&envVar{value: sealed, keyringGet: otherGet}).parse()
+	assert.Error(t, err)
+	_, err = sealEnvVar(a, otherGet, otherSet)
+	require.NoError(t, err)
+	_, err = (&envVar{value: sealed, keyringGet: otherGet}).parse()
+	assert.Error(t, err)
+}
+
+func TestCredentialSources(t *testing.T) {
+	sources := credentialSources{
+		fromEnvVar("invalid"),
+		fromEnvVar("malory@isis:823893adfad2cda6e1a414f3ebdf58f7"),
+		fromEnvVar("lana@isis:823893adfad2cda6e1a414f3ebdf58f7"),
+	}
+	a, err := sources.getCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, "malory", a.username)
+}
+
+func TestCredentialSourcesNoneFound(t *testing.T) {
+	_, err := credentialSources{fromEnvVar("invalid")}.getCredentials()
+	assert.Error(t, err)
+	_, err = credentialSources{}.getCredentials()
+	assert.Error(t, err)
+}
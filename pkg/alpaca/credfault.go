@@ -0,0 +1,98 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// credentialFaults are the failures that -debug-credential-fault can simulate, so that what
+// Alpaca does when a credential source fails can be tried out without breaking a real one:
+//
+//   - keyring-timeout: the keyring never responds (e.g. it's waiting to be unlocked).
+//   - keyring-locked: the keyring is locked, and returns an error.
+//   - prompt-cancel: the password prompt is cancelled (as if Ctrl-D was pressed).
+//   - helper-error: the credential helper fails, both at first and when the proxy rejects the
+//     credentials that it gave.
+var credentialFaults = []string{"keyring-timeout", "keyring-locked", "prompt-cancel",
+	"helper-error"}
+
+// credentialFault is the failure to simulate, or an empty string for none.
+var credentialFault string
+
+func setCredentialFault(fault string) error {
+	if fault != "" && !slices.Contains(credentialFaults, fault) {
+		return fmt.Errorf("invalid -debug-credential-fault %q (expected one of: %s)", fault,
+			strings.Join(credentialFaults, ", "))
+	}
+	credentialFault = fault
+	if fault != "" {
+		log.Printf("WARNING: simulating a credential source failure (%s)", fault)
+	}
+	return nil
+}
+
+// injectCredentialFault makes src (or the source in it that credentialFault applies to) fail,
+// and returns it.
+func injectCredentialFault(src credentialSource) credentialSource {
+	switch s := src.(type) {
+	case credentialSources:
+		for i := range s {
+			s[i] = injectCredentialFault(s[i])
+		}
+	case *timeoutSource:
+		s.src = injectCredentialFault(s.src)
+	case *keyring:
+		switch credentialFault {
+		case "keyring-timeout":
+			return faultySource{hang: true}
+		case "keyring-locked":
+			return faultySource{err: errors.New("cannot get user secret from keyring: " +
+				"the keyring is locked")}
+		}
+	case *terminal:
+		if credentialFault == "prompt-cancel" {
+			s.readPassword = func() ([]byte, error) { return nil, io.EOF }
+		}
+	case *credentialHelper:
+		if credentialFault == "helper-error" {
+			// Run the same shell (see runHelper), but with a command that fails.
+			s.execCommand = func(name string, arg ...string) *exec.Cmd {
+				return exec.Command(name, arg[0], "exit 1")
+			}
+		}
+	}
+	return src
+}
+
+// faultySource is a credential source that fails, either straight away (with err) or by never
+// returning.
+type faultySource struct {
+	err  error
+	hang bool
+}
+
+func (fs faultySource) getCredentials() (*authenticator, error) {
+	if fs.hang {
+		select {}
+	}
+	return nil, fs.err
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTestCredentialFault sets credentialFault until the test ends.
+func setTestCredentialFault(t *testing.T, fault string) {
+	old := credentialFault
+	t.Cleanup(func() { credentialFault = old })
+	require.NoError(t, setCredentialFault(fault))
+}
+
+func TestInvalidCredentialFault(t *testing.T) {
+	assert.Error(t, setCredentialFault("keyring-on-fire"))
+}
+
+func TestKeyringTimeoutFault(t *testing.T) {
+	setTestCredentialFault(t, "keyring-timeout")
+	src := injectCredentialFault(credentialSources{
+		withTimeout(fromKeyring(), "keyring", 10*time.Millisecond),
+	})
+	_, err := src.getCredentials()
+	assert.EqualError(t, err, "timed out after 10ms waiting for the keyring")
+}
+
+func TestKeyringLockedFault(t *testing.T) {
+	setTestCredentialFault(t, "keyring-locked")
+	// The other sources are still tried.
+	src := injectCredentialFault(credentialSources{
+		withTimeout(fromKeyring(), "keyring", time.Second),
+		fromEnvVar("malory@isis:823893adfad2cda6e1a414f3ebdf58f7"),
+	})
+	a, err := src.getCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, "malory", a.username)
+	_, err = injectCredentialFault(fromKeyring()).getCredentials()
+	assert.ErrorContains(t, err, "the keyring is locked")
+}
+
+func TestPromptCancelFault(t *testing.T) {
+	setTestCredentialFault(t, "prompt-cancel")
+	term := &terminal{
+		readPassword: func() ([]byte, error) { return []byte("guest"), nil },
+		stdout:       new(bytes.Buffer),
+	}
+	_, err := injectCredentialFault(term.forUser("isis", "malory")).getCredentials()
+	assert.EqualError(t, err, "the password prompt was cancelled")
+}
+
+func TestHelperErrorFault(t *testing.T) {
+	setTestCredentialFault(t, "helper-error")
+	ch, _ := fakeCredentialHelper(t, "guest")
+	injectCredentialFault(ch)
+	_, err := ch.getCredentials()
+	assert.ErrorContains(t, err, "error running credential helper")
+	_, err = ch.refresh(&authenticator{domain: "isis", username: "malory"})
+	assert.Error(t, err)
+}
+
+func TestNoCredentialFault(t *testing.T) {
+	setTestCredentialFault(t, "")
+	src := credentialSources{fromEnvVar("malory@isis:823893adfad2cda6e1a414f3ebdf58f7")}
+	a, err := injectCredentialFault(src).getCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, "malory", a.username)
+}
@@ -0,0 +1,182 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	ring "github.com/zalando/go-keyring"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// The ways that the key for a credentials file can be obtained.
+const (
+	credentialsKeyPassphrase = "passphrase" // Derived from a passphrase using scrypt
+	credentialsKeyKeyring    = "keyring"    // A random key, stored in the OS keyring
+)
+
+// The keyring entry used to store the key for a credentials file.
+const (
+	credentialsKeyringService = "alpaca"
+	credentialsKeyringUser    = "credentials-file-key"
+)
+
+// encryptedCredentials is the on-disk format of a credentials file. The plaintext is the same
+// string that is used in the NTLM_CREDENTIALS environment variable.
+type encryptedCredentials struct {
+	Key   string `json:"key"` // One of credentialsKeyPassphrase or credentialsKeyKeyring
+	Salt  []byte `json:"salt,omitempty"`
+	Nonce []byte `json:"nonce"`
+	Box   []byte `json:"box"`
+}
+
+// credentialsFile reads (and writes) credentials from a file encrypted using NaCl secretbox. This
+// is useful on headless servers, where there's often no keyring daemon available.
+type credentialsFile struct {
+	path       string
+	passphrase func() ([]byte, error)
+	keyringGet func(service, user string) (string, error)
+	keyringSet func(service, user, password string) error
+}
+
+func fromCredentialsFile(path string) *credentialsFile {
+	return &credentialsFile{
+		path:       path,
+		passphrase: readPassphrase,
+		keyringGet: keyringStore.get,
+		keyringSet: keyringStore.set,
+	}
+}
+
+// readPassphrase reads the passphrase for a credentials file from the environment, or else from
+// the terminal.
+func readPassphrase() ([]byte, error) {
+	if value, ok := os.LookupEnv("ALPACA_CREDENTIALS_PASSPHRASE"); ok {
+		return []byte(value), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("no passphrase in ALPACA_CREDENTIALS_PASSPHRASE")
+	}
+	fmt.Print(localText("prompt.passphrase"))
+	buf, err := term.ReadPassword(fd)
+	fmt.Println()
+	return buf, err
+}
+
+func (f *credentialsFile) getCredentials() (*authenticator, error) {
+	buf, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading credentials file: %w", err)
+	}
+	var ec encryptedCredentials
+	if err := json.Unmarshal(buf, &ec); err != nil {
+		return nil, fmt.Errorf("error parsing credentials file %s: %w", f.path, err)
+	} else if len(ec.Nonce) != 24 {
+		return nil, fmt.Errorf("invalid nonce in credentials file %s", f.path)
+	}
+	key, err := f.key(ec.Key, ec.Salt)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], ec.Nonce)
+	plaintext, ok := secretbox.Open(nil, ec.Box, &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("error decrypting credentials file %s: wrong key?", f.path)
+	}
+	a, err := fromEnvVar(string(plaintext)).parse()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Found credentials for %s\\%s in %s", a.domain, a.username, f.path)
+	return a, nil
+}
+
+// save encrypts the given credentials and writes them to the file, replacing whatever was there
+// before. The keyType is one of credentialsKeyPassphrase or credentialsKeyKeyring.
+func (f *credentialsFile) save(a *authenticator, keyType string) error {
+	ec := encryptedCredentials{Key: keyType}
+	switch keyType {
+	case credentialsKeyPassphrase:
+		ec.Salt = make([]byte, 16)
+		if _, err := rand.Read(ec.Salt); err != nil {
+			return err
+		}
+	case credentialsKeyKeyring:
+		// All credentials files share the key in the keyring, so it's only created if it
+		// doesn't exist yet. Replacing it would make any other files unreadable.
+		_, err := f.keyringGet(credentialsKeyringService, credentialsKeyringUser)
+		if errors.Is(err, ring.ErrNotFound) {
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return err
+			}
+			err = f.keyringSet(credentialsKeyringService, credentialsKeyringUser,
+				hex.EncodeToString(key))
+		}
+		if err != nil {
+			return fmt.Errorf("error storing key in keyring: %w", err)
+		}
+	}
+	key, err := f.key(keyType, ec.Salt)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	ec.Nonce = nonce[:]
+	ec.Box = secretbox.Seal(nil, []byte(a.String()), &nonce, key)
+	buf, err := json.MarshalIndent(ec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.path, append(buf, '\n'), 0600)
+}
+
+func (f *credentialsFile) key(keyType string, salt []byte) (*[32]byte, error) {
+	var key [32]byte
+	switch keyType {
+	case credentialsKeyPassphrase:
+		passphrase, err := f.passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("error reading passphrase: %w", err)
+		}
+		derived, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, len(key))
+		if err != nil {
+			return nil, err
+		}
+		copy(key[:], derived)
+	case credentialsKeyKeyring:
+		value, err := f.keyringGet(credentialsKeyringService, credentialsKeyringUser)
+		if err != nil {
+			return nil, fmt.Errorf("error getting key from keyring: %w", err)
+		}
+		return decodeKeyringKey(value)
+	default:
+		return nil, fmt.Errorf("unknown key type %q in credentials file %s", keyType, f.path)
+	}
+	return &key, nil
+}
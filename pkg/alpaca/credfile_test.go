@@ -0,0 +1,102 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samuong/go-ntlmssp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ring "github.com/zalando/go-keyring"
+)
+
+func newTestCredentialsFile(t *testing.T, passphrase string) *credentialsFile {
+	keyring := make(map[string]string)
+	return &credentialsFile{
+		path:       filepath.Join(t.TempDir(), "credentials.json"),
+		passphrase: func() ([]byte, error) { return []byte(passphrase), nil },
+		keyringGet: func(service, user string) (string, error) {
+			value, ok := keyring[service+"/"+user]
+			if !ok {
+				return "", ring.ErrNotFound
+			}
+			return value, nil
+		},
+		keyringSet: func(service, user, password string) error {
+			keyring[service+"/"+user] = password
+			return nil
+		},
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	for _, keyType := range []string{credentialsKeyPassphrase, credentialsKeyKeyring} {
+		t.Run(keyType, func(t *testing.T) {
+			f := newTestCredentialsFile(t, "correct horse battery staple")
+			saved := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""}
+			require.NoError(t, f.save(saved, keyType))
+			info, err := os.Stat(f.path)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+			buf, err := os.ReadFile(f.path)
+			require.NoError(t, err)
+			assert.NotContains(t, string(buf), "malory")
+			a, err := f.getCredentials()
+			require.NoError(t, err)
+			assert.Equal(t, saved, a)
+		})
+	}
+}
+
+func TestCredentialsFilesShareKeyringKey(t *testing.T) {
+	first := newTestCredentialsFile(t, "")
+	second := newTestCredentialsFile(t, "")
+	second.keyringGet, second.keyringSet = first.keyringGet, first.keyringSet
+	a := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""}
+	require.NoError(t, first.save(a, credentialsKeyKeyring))
+	b := &authenticator{"isis", "cheryl", ntlmssp.GetNtlmHash("tunt"), ""}
+	require.NoError(t, second.save(b, credentialsKeyKeyring))
+	// Saving the second file mustn't stop the first one from being read.
+	got, err := first.getCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, a, got)
+	got, err = second.getCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, b, got)
+}
+
+func TestCredentialsFileWrongPassphrase(t *testing.T) {
+	f := newTestCredentialsFile(t, "correct horse battery staple")
+	a := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""}
+	require.NoError(t, f.save(a, credentialsKeyPassphrase))
+	f.passphrase = func() ([]byte, error) { return []byte("incorrect"), nil }
+	_, err := f.getCredentials()
+	assert.Error(t, err)
+}
+
+func TestCredentialsFileMissing(t *testing.T) {
+	f := newTestCredentialsFile(t, "")
+	_, err := f.getCredentials()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCredentialsFileUnknownKeyType(t *testing.T) {
+	f := newTestCredentialsFile(t, "")
+	a := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest"), ""}
+	assert.Error(t, f.save(a, "rot13"))
+}
@@ -0,0 +1,210 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/samuong/go-ntlmssp"
+)
+
+// credentialHelper gets credentials from an external program (given by -credential-helper), such
+// as a script that reads them from a password vault. Like a git credential helper, the program is
+// run by the shell with an action ("get" or "erase") as its last argument, and it reads and
+// writes key=value lines on stdin and stdout.
+//
+// For "get", it's given the domain and username (if known), and prints the domain, username, and
+// either the password or the NTLM hash (in hex). For "erase", it's given the credentials that the
+// proxy rejected, so that it can forget about them (e.g. if it caches them).
+//
+// Credentials are fetched when they're first needed, and fetched again if the proxy rejects them.
+type credentialHelper struct {
+	command          string
+	domain, username string
+	execCommand      func(name string, arg ...string) *exec.Cmd
+	current          *authenticator
+	mux              sync.Mutex
+}
+
+func newCredentialHelper(command, domain, username string) *credentialHelper {
+	return &credentialHelper{
+		command:     command,
+		domain:      domain,
+		username:    username,
+		execCommand: exec.Command,
+	}
+}
+
+// run runs the helper program for the given action, and returns the attributes that it printed.
+func (ch *credentialHelper) run(action string, attrs ...string) (map[string]string, error) {
+	return runHelper(ch.execCommand, "credential helper", ch.command, action, attrs...)
+}
+
+// runHelper runs a helper program (described by kind, for errors) using the shell, with the
+// action as its last argument. It writes the attributes to the program's stdin as key=value
+// lines, and returns the ones that it printed.
+func runHelper(execCommand func(name string, arg ...string) *exec.Cmd, kind, command,
+	action string, attrs ...string) (map[string]string, error) {
+	command += " " + action
+	cmd := shellCommand(execCommand, command)
+	var stdin bytes.Buffer
+	for _, attr := range attrs {
+		stdin.WriteString(attr + "\n")
+	}
+	stdin.WriteString("\n")
+	cmd.Stdin = &stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running %s %q: %w", kind, command, err)
+	}
+	return parseHelperOutput(out)
+}
+
+// shellCommand returns a command that runs command using the shell.
+func shellCommand(execCommand func(name string, arg ...string) *exec.Cmd,
+	command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return execCommand("cmd", "/C", command)
+	}
+	return execCommand("sh", "-c", command)
+}
+
+// parseHelperOutput returns the key=value lines that a helper program printed, up to the first
+// blank line.
+func parseHelperOutput(out []byte) (map[string]string, error) {
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		// Like git, ignore any attributes that we don't know about.
+		if key, value, ok := strings.Cut(line, "="); ok {
+			result[key] = value
+		}
+	}
+	return result, scanner.Err()
+}
+
+// get asks the helper program for credentials.
+func (ch *credentialHelper) get() (*authenticator, error) {
+	var attrs []string
+	if ch.domain != "" {
+		attrs = append(attrs, "domain="+ch.domain)
+	}
+	if ch.username != "" {
+		attrs = append(attrs, "username="+ch.username)
+	}
+	result, err := ch.run("get", attrs...)
+	if err != nil {
+		return nil, err
+	}
+	a := &authenticator{domain: result["domain"], username: result["username"]}
+	if a.domain == "" {
+		a.domain = ch.domain
+	}
+	if a.username == "" {
+		return nil, errors.New("credential helper didn't return a username")
+	}
+	if hash, ok := result["hash"]; ok {
+		if a.hash, err = hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("credential helper returned an invalid hash: %w", err)
+		}
+	} else if password, ok := result["password"]; ok {
+		a.hash = ntlmssp.GetNtlmHash(password)
+		a.password = password
+	} else {
+		return nil, errors.New("credential helper didn't return a password or hash")
+	}
+	log.Printf("Got credentials for %s\\%s from credential helper", a.domain, a.username)
+	return a, nil
+}
+
+func (ch *credentialHelper) getCredentials() (*authenticator, error) {
+	ch.mux.Lock()
+	defer ch.mux.Unlock()
+	if ch.current == nil {
+		a, err := ch.get()
+		if err != nil {
+			return nil, err
+		}
+		ch.current = a
+	}
+	return ch.current, nil
+}
+
+// refresh tells the helper program that the rejected credentials didn't work, and asks it for
+// new ones. If they've already been refreshed (by another request), the new ones are returned.
+func (ch *credentialHelper) refresh(rejected *authenticator) (*authenticator, error) {
+	ch.mux.Lock()
+	defer ch.mux.Unlock()
+	if ch.current != rejected && ch.current != nil {
+		return ch.current, nil
+	}
+	ch.current = nil
+	_, err := ch.run("erase", "domain="+rejected.domain, "username="+rejected.username)
+	if err != nil {
+		log.Printf("Error erasing rejected credentials: %v", err)
+	}
+	a, err := ch.get()
+	if err != nil {
+		return nil, err
+	}
+	ch.current = a
+	return a, nil
+}
+
+func (ch *credentialHelper) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	a, err := ch.getCredentials()
+	if err != nil {
+		log.Printf("Error getting credentials: %v", err)
+		return nil, err
+	}
+	resp, err := a.do(req, rt)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, err
+	}
+	log.Printf("Credentials for %s\\%s were rejected, asking the credential helper again",
+		a.domain, a.username)
+	fresh, err := ch.refresh(a)
+	if err != nil {
+		log.Printf("Error refreshing credentials: %v", err)
+		return resp, nil
+	} else if fresh.String() == a.String() {
+		return resp, nil
+	}
+	events.publish(eventCredentialsChanged, fresh.domain+`\`+fresh.username,
+		"Credentials changed to %s\\%s by the credential helper", fresh.domain, fresh.username)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req.Body = body
+	}
+	resp.Body.Close()
+	return fresh.do(req, rt)
+}
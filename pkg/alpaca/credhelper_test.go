@@ -0,0 +1,173 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samuong/go-ntlmssp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCredentialHelper returns a credentialHelper that runs TestMockCredentialHelper instead of
+// a real program, and a func that returns the actions (and input) that it was run with. The
+// helper gives out the passwords in turn, one for each "get".
+func fakeCredentialHelper(t *testing.T, passwords ...string) (*credentialHelper,
+	func() []string) {
+	logfile := filepath.Join(t.TempDir(), "helper.log")
+	ch := newCredentialHelper("vault-helper", "isis", "malory")
+	ch.execCommand = func(name string, arg ...string) *exec.Cmd {
+		arg = append([]string{"-test.run=TestMockCredentialHelper", "--", name}, arg...)
+		cmd := exec.Command(os.Args[0], arg...)
+		cmd.Env = []string{
+			"ALPACA_WANT_MOCK_CREDENTIAL_HELPER=1",
+			"HELPER_LOG=" + logfile,
+			"HELPER_PASSWORDS=" + strings.Join(passwords, ","),
+		}
+		return cmd
+	}
+	calls := func() []string {
+		buf, err := os.ReadFile(logfile)
+		require.NoError(t, err)
+		return strings.Split(strings.TrimSpace(string(buf)), "\n")
+	}
+	return ch, calls
+}
+
+func TestMockCredentialHelper(t *testing.T) {
+	if os.Getenv("ALPACA_WANT_MOCK_CREDENTIAL_HELPER") != "1" {
+		return
+	}
+	args := os.Args
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	// The command is run by the shell, e.g. ["sh", "-c", "vault-helper get"].
+	action := args[len(args)-1][strings.LastIndex(args[len(args)-1], " ")+1:]
+	var input []string
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() && scanner.Text() != "" {
+		input = append(input, scanner.Text())
+	}
+	buf, _ := os.ReadFile(os.Getenv("HELPER_LOG"))
+	gets := strings.Count(string(buf), "get ")
+	f, err := os.OpenFile(os.Getenv("HELPER_LOG"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		os.Exit(1)
+	}
+	fmt.Fprintln(f, action, strings.Join(input, " "))
+	f.Close()
+	passwords := strings.Split(os.Getenv("HELPER_PASSWORDS"), ",")
+	switch {
+	case action == "erase":
+	case action == "get" && gets < len(passwords) && passwords[gets] != "":
+		fmt.Printf("domain=isis\nusername=malory\npassword=%s\nexpiry=never\n", passwords[gets])
+	default:
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestCredentialHelperGet(t *testing.T) {
+	ch, calls := fakeCredentialHelper(t, "guest")
+	for i := 0; i < 2; i++ {
+		a, err := ch.getCredentials()
+		require.NoError(t, err)
+		assert.Equal(t, "malory@isis:823893adfad2cda6e1a414f3ebdf58f7", a.String())
+	}
+	assert.Equal(t, []string{"get domain=isis username=malory"}, calls())
+}
+
+func TestCredentialHelperFails(t *testing.T) {
+	ch, _ := fakeCredentialHelper(t, "")
+	_, err := ch.getCredentials()
+	assert.Error(t, err)
+}
+
+// rejectingProxy is a RoundTripper that acts like a proxy that rejects the first attempt to
+// authenticate (i.e. the first NTLM Type 3 message), but accepts any after that.
+type rejectingProxy struct {
+	attempts int
+}
+
+func (rp *rejectingProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{Header: make(http.Header), Body: io.NopCloser(strings.NewReader(""))}
+	hdr := req.Header.Get("Proxy-Authorization")
+	msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(hdr, "NTLM "))
+	if len(msg) < 12 || binary.LittleEndian.Uint32(msg[8:12]) != 3 {
+		resp.StatusCode = http.StatusProxyAuthRequired
+		resp.Header.Set("Proxy-Authenticate", "NTLM "+testChallenge)
+		return resp, nil
+	}
+	rp.attempts++
+	if rp.attempts == 1 {
+		resp.StatusCode = http.StatusProxyAuthRequired
+	} else {
+		resp.StatusCode = http.StatusOK
+	}
+	return resp, nil
+}
+
+// testChallenge is an NTLM Type 2 (Challenge) message, as sent by sendChallengeResponse.
+const testChallenge = "TlRMTVNTUAACAAAADAAMADgAAAAFgomi+Rp9UDbAycMAAAAAAAAAAKIAogBEAAAABgEAAAAA" +
+	"AA9HAEwATwBCAEEATAACAAwARwBMAE8AQgBBAEwAAQAeAFAAWABZAEEAVQAwADAAMgBNAEUATAAwADEAMAAz" +
+	"AAQAHABnAGwAbwBiAGEAbAAuAGEAbgB6AC4AYwBvAG0AAwA8AHAAeAB5AGEAdQAwADAAMgBtAGUAbAAwADEA" +
+	"MAAzAC4AZwBsAG8AYgBhAGwALgBhAG4AegAuAGMAbwBtAAcACABQ7ZOkOQbVAQAAAAA="
+
+func TestCredentialHelperRefreshesRejectedCredentials(t *testing.T) {
+	ch, calls := fakeCredentialHelper(t, "old", "new")
+	req, err := http.NewRequest(http.MethodGet, "http://www.test", nil)
+	require.NoError(t, err)
+	resp, err := ch.do(req, &rejectingProxy{})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	a, err := ch.getCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, ntlmssp.GetNtlmHash("new"), a.hash)
+	assert.Equal(t, []string{
+		"get domain=isis username=malory",
+		"erase domain=isis username=malory",
+		"get domain=isis username=malory",
+	}, calls())
+}
+
+func TestCredentialHelperUnchangedCredentials(t *testing.T) {
+	ch, calls := fakeCredentialHelper(t, "same", "same")
+	req, err := http.NewRequest(http.MethodGet, "http://www.test", nil)
+	require.NoError(t, err)
+	rp := &rejectingProxy{}
+	resp, err := ch.do(req, rp)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	// There's no point in trying the same credentials again.
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, 1, rp.attempts)
+	assert.Len(t, calls(), 3)
+}
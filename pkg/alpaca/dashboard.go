@@ -0,0 +1,475 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxDashboardRequests is the number of recent requests that the dashboard shows.
+const maxDashboardRequests = 100
+
+// dashboard serves a read-only page at /alpaca/ that shows what Alpaca is doing: the client
+// connections and tunnels that are open, recent requests and the proxy that each was sent to,
+// the state of the upstream proxies, and some counters. The page is self-contained (it doesn't
+// load anything from elsewhere), and gets its data from /alpaca/api/dashboard every few seconds.
+type dashboard struct {
+	finder   *ProxyFinder
+	tunnels  *tunnelTracker
+	conns    *connTracker  // If set, the client connections are listed
+	limiter  *connLimiter  // If set, the time spent waiting for connections is counted
+	auth     *rotatingAuth // If set, credentials that are still being loaded are shown
+	maxConns *connCap      // If set, the connections counted by -max-conns are shown
+	// The latencies of the upstream proxies (and servers) that the server's requests used.
+	latencies *latencyStats
+	started   time.Time
+	now       func() time.Time
+	recent    []dashboardRequest // Oldest first
+	requests  int64
+	statuses  map[string]int64 // By class, e.g. "2xx"
+	errors    map[string]int64 // By the code in the X-Alpaca-Error header
+	mux       sync.Mutex
+}
+
+type dashboardRequest struct {
+	ID       any    `json:"id"`
+	Time     string `json:"time"`
+	Method   string `json:"method"`
+	URL      string `json:"url"`
+	Via      string `json:"via"` // The PAC decision, e.g. "PROXY proxy.example.com:8080"
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type dashboardState struct {
+	Version     string             `json:"version"`
+	Uptime      string             `json:"uptime"`
+	PAC         dashboardPAC       `json:"pac"`
+	Counters    dashboardCounters  `json:"counters"`
+	Upstreams   []dashboardProxy   `json:"upstreams"`
+	Latency     []dashboardLatency `json:"latency"`
+	Connections []debugConn        `json:"connections"`
+	Tunnels     []debugTunnel      `json:"tunnels"`
+	Requests    []dashboardRequest `json:"requests"` // Newest first
+	// If set, credentials are being loaded in the background, and this is what's holding them
+	// up (see rotatingAuth.loadInBackground).
+	Credentials string `json:"credentials,omitempty"`
+}
+
+type dashboardPAC struct {
+	URL       string `json:"url"`
+	Connected bool   `json:"connected"`
+	Busy      bool   `json:"busy,omitempty"` // Whether the PAC file was being downloaded
+	// If set, there's a captive portal (so requests go direct), for this reason.
+	CaptivePortal string `json:"captive_portal,omitempty"`
+	// If set, the PAC script's engine has had to be restarted (see restartIfFailing).
+	Warning string `json:"warning,omitempty"`
+}
+
+type dashboardCounters struct {
+	Requests    int64            `json:"requests"`
+	Statuses    map[string]int64 `json:"statuses"`
+	Errors      map[string]int64 `json:"errors"`
+	Connections int              `json:"connections"`
+	Tunnels     int              `json:"tunnels"`
+	Goroutines  int              `json:"goroutines"`
+	// If -max-conns is set, the client connections (including tunnels) counted towards it.
+	MaxConns *dashboardMaxConns `json:"max_conns,omitempty"`
+	// Requests that waited for a connection (see -max-conns-per-host and -max-conns-per-proxy),
+	// by which limit they waited for ("host" or "proxy").
+	ConnWaits map[string]dashboardConnWaits `json:"conn_waits,omitempty"`
+}
+
+type dashboardConnWaits struct {
+	Waited   int64  `json:"waited"`
+	TimedOut int64  `json:"timed_out"`
+	Total    string `json:"total"`
+	Longest  string `json:"longest"`
+}
+
+type dashboardMaxConns struct {
+	Open  int   `json:"open"`
+	Limit int   `json:"limit"`
+	Waits int64 `json:"waits"` // The number of times a connection had to wait for a slot
+}
+
+// dashboardProxy is the state of an upstream proxy that isn't working normally.
+type dashboardProxy struct {
+	Proxy  string `json:"proxy"`
+	State  string `json:"state"` // "blocked" or "down"
+	Since  string `json:"since,omitempty"`
+	Until  string `json:"until,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func newDashboard(finder *ProxyFinder, tunnels *tunnelTracker, conns *connTracker) *dashboard {
+	return &dashboard{
+		finder:    finder,
+		tunnels:   tunnels,
+		conns:     conns,
+		latencies: newLatencyStats(),
+		started:   time.Now(),
+		now:       time.Now,
+		statuses:  make(map[string]int64),
+		errors:    make(map[string]int64),
+	}
+}
+
+func (d *dashboard) SetupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/alpaca/", localhostOnly(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/alpaca/" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy",
+			"default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; "+
+				"connect-src 'self'")
+		_, _ = w.Write([]byte(dashboardHTML))
+	}))
+	mux.HandleFunc("/alpaca/api/dashboard",
+		localhostOnly(func(w http.ResponseWriter, req *http.Request) {
+			writeJSON(w, http.StatusOK, d.state())
+		}))
+	mux.HandleFunc("/alpaca/metrics", localhostOnly(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.latencies.writeMetrics(w)
+		d.writeMetrics(w)
+	}))
+}
+
+// writeMetrics writes the numbers of open connections, tunnels and goroutines in the Prometheus
+// text format.
+func (d *dashboard) writeMetrics(w io.Writer) {
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	if d.conns != nil {
+		metric("alpaca_client_connections", "gauge",
+			"Open client connections (not including tunnels).", int64(d.conns.count()))
+	}
+	metric("alpaca_tunnels", "gauge", "Open tunnels.", int64(d.tunnels.count()))
+	metric("alpaca_tunnels_reaped_total", "counter", "Tunnels closed for being idle.",
+		d.tunnels.reaped.Load())
+	metric("alpaca_goroutines", "gauge", "Running goroutines.", int64(runtime.NumGoroutine()))
+	if d.maxConns != nil {
+		metric("alpaca_max_conns_open", "gauge", "Client connections counted by -max-conns.",
+			int64(d.maxConns.open()))
+		metric("alpaca_max_conns_waits_total", "counter",
+			"Times a connection waited for a slot under -max-conns.", d.maxConns.waits.Load())
+	}
+}
+
+// WrapHandler records the requests that are proxied by next. Like capture.WrapHandler, it should
+// be placed inside the ProxyFinder's handler, so that the proxy used for each request is known.
+func (d *dashboard) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect && req.URL.Scheme == "" {
+			// Not a proxy request (see ProxyHandler.WrapHandler).
+			next.ServeHTTP(w, req)
+			return
+		}
+		start := d.now()
+		entry := dashboardRequest{
+			ID:     req.Context().Value(contextKeyID),
+			Time:   start.Format(time.RFC3339),
+			Method: req.Method,
+			URL:    requestURL(req),
+		}
+		proxy, _ := req.Context().Value(contextKeyProxy).(*url.URL)
+		entry.Via = proxyString(proxy)
+		sw := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		entry.Status = sw.status
+		if entry.Status == 0 {
+			// A CONNECT request whose tunnel was established (or a request that wasn't
+			// answered at all).
+			entry.Status = http.StatusOK
+		}
+		entry.Error = w.Header().Get(proxyErrorHeader)
+		entry.Duration = d.now().Sub(start).Round(time.Millisecond).String()
+		d.add(entry)
+	})
+}
+
+func (d *dashboard) add(entry dashboardRequest) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.requests++
+	d.statuses[fmt.Sprintf("%dxx", entry.Status/100)]++
+	if entry.Error != "" {
+		d.errors[entry.Error]++
+	}
+	if len(d.recent) >= maxDashboardRequests {
+		d.recent = slices.Delete(d.recent, 0, len(d.recent)-maxDashboardRequests+1)
+	}
+	d.recent = append(d.recent, entry)
+}
+
+func (d *dashboard) state() dashboardState {
+	state := dashboardState{
+		Version:     BuildVersion,
+		Uptime:      d.now().Sub(d.started).Round(time.Second).String(),
+		Connections: []debugConn{},
+		Tunnels:     listTunnels(d.tunnels),
+		Upstreams:   []dashboardProxy{},
+		Latency:     d.latencies.dashboard(),
+	}
+	if d.conns != nil {
+		state.Connections = d.conns.list()
+	}
+	if d.auth != nil {
+		state.Credentials = d.auth.loadingStatus()
+	}
+	// Don't wait for the PAC file to be downloaded (see debugPAC).
+	if d.finder.TryLock() {
+		state.PAC.URL = d.finder.fetcher.url
+		state.PAC.Connected = d.finder.fetcher.isConnected()
+		blocked := d.finder.blocked
+		if runner, ok := d.finder.router.(*PACRunner); ok {
+			state.PAC.Warning = runner.engineWarning()
+		}
+		state.PAC.Warning = cmp.Or(state.PAC.Warning, d.finder.fetcher.savedWarning())
+		d.finder.Unlock()
+		for proxy, until := range blocked.snapshot() {
+			state.Upstreams = append(state.Upstreams, dashboardProxy{
+				Proxy:  proxy,
+				State:  "blocked",
+				Until:  until.Format(time.RFC3339),
+				Detail: "failed recently, so other proxies are tried first",
+			})
+		}
+	} else {
+		state.PAC.Busy = true
+	}
+	if d.finder.captive != nil {
+		state.PAC.CaptivePortal, _ = d.finder.captive.detected()
+	}
+	if d.finder.health != nil {
+		down, active := d.finder.health.status()
+		for proxy, since := range down {
+			entry := dashboardProxy{Proxy: proxy, State: "down", Since: since.Format(time.RFC3339)}
+			if active != "" {
+				entry.Detail = fmt.Sprintf("using health rule %q", active)
+			}
+			state.Upstreams = append(state.Upstreams, entry)
+		}
+	}
+	slices.SortFunc(state.Upstreams, func(a, b dashboardProxy) int {
+		return cmp.Compare(a.Proxy, b.Proxy)
+	})
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	state.Counters = dashboardCounters{
+		Requests:    d.requests,
+		Statuses:    make(map[string]int64, len(d.statuses)),
+		Errors:      make(map[string]int64, len(d.errors)),
+		Connections: len(state.Connections),
+		Tunnels:     len(state.Tunnels),
+		Goroutines:  runtime.NumGoroutine(),
+	}
+	if d.maxConns != nil {
+		state.Counters.MaxConns = &dashboardMaxConns{
+			Open:  d.maxConns.open(),
+			Limit: cap(d.maxConns.sem),
+			Waits: d.maxConns.waits.Load(),
+		}
+	}
+	for class, n := range d.statuses {
+		state.Counters.Statuses[class] = n
+	}
+	for code, n := range d.errors {
+		state.Counters.Errors[code] = n
+	}
+	if d.limiter != nil {
+		state.Counters.ConnWaits = make(map[string]dashboardConnWaits)
+		for kind, cw := range d.limiter.waitStats() {
+			state.Counters.ConnWaits[kind] = dashboardConnWaits{
+				Waited:   cw.waited,
+				TimedOut: cw.timedOut,
+				Total:    cw.total.Round(time.Millisecond).String(),
+				Longest:  cw.longest.Round(time.Millisecond).String(),
+			}
+		}
+	}
+	state.Requests = make([]dashboardRequest, 0, len(d.recent))
+	for i := len(d.recent) - 1; i >= 0; i-- {
+		state.Requests = append(state.Requests, d.recent[i])
+	}
+	return state
+}
+
+// The dashboard page. It builds the page using the DOM (rather than innerHTML), since the URLs
+// of requests come from clients.
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Alpaca</title>
+<style>
+body { font: 14px system-ui, sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 1.4em; margin-bottom: 0; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+#summary { color: #666; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 2px 8px; border-bottom: 1px solid #eee; }
+td { font-family: ui-monospace, monospace; font-size: 13px; }
+td.url { max-width: 40em; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+.counters span { display: inline-block; margin-right: 2em; }
+.s2 { color: #080; } .s3 { color: #06c; } .s4 { color: #b60; } .s5 { color: #c00; }
+.empty { color: #999; }
+button { margin-right: 0.5em; }
+/* The plain view relies on text alone (not colour or layout), and doesn't change under a screen
+   reader: it's only refreshed on request. */
+body.plain { font: 16px sans-serif; color: #000; background: #fff; }
+body.plain #summary, body.plain .empty, body.plain .s2, body.plain .s3, body.plain .s4,
+body.plain .s5 { color: inherit; }
+body.plain td { font: inherit; }
+body.plain td.url { max-width: none; white-space: normal; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Alpaca</h1>
+<p><button id="plain" aria-pressed="false">Plain view</button>
+<button id="refresh" hidden>Refresh</button></p>
+<div id="summary"></div>
+<h2 id="counters-heading">Counters</h2>
+<div id="counters" class="counters" aria-labelledby="counters-heading"></div>
+<h2 id="upstreams-heading">Upstream proxies</h2>
+<table id="upstreams" aria-labelledby="upstreams-heading"></table>
+<h2 id="latency-heading">Upstream latency</h2>
+<table id="latency" aria-labelledby="latency-heading"></table>
+<h2 id="requests-heading">Recent requests</h2>
+<table id="requests" aria-labelledby="requests-heading"></table>
+<h2 id="tunnels-heading">Tunnels</h2>
+<table id="tunnels" aria-labelledby="tunnels-heading"></table>
+<h2 id="connections-heading">Client connections</h2>
+<table id="connections" aria-labelledby="connections-heading"></table>
+<script>
+function cell(row, text, cls) {
+  const td = document.createElement(row.parentNode.tagName == "THEAD" ? "th" : "td");
+  td.textContent = text;
+  if (cls) td.className = cls;
+  row.appendChild(td);
+}
+// sparkline draws a series of numbers using block characters, scaled to the largest one.
+function sparkline(values) {
+  const blocks = "\u2581\u2582\u2583\u2584\u2585\u2586\u2587\u2588";
+  const top = Math.max(1, ...values);
+  return values.map(v => blocks[Math.min(7, Math.floor(v / top * 8))]).join("");
+}
+function table(id, headings, rows, empty) {
+  const t = document.getElementById(id);
+  t.replaceChildren();
+  const head = t.createTHead().insertRow();
+  headings.forEach(h => cell(head, h));
+  const body = t.createTBody();
+  if (rows.length == 0) {
+    const td = body.insertRow().insertCell();
+    td.colSpan = headings.length;
+    td.className = "empty";
+    td.textContent = empty;
+  }
+  rows.forEach(r => {
+    const row = body.insertRow();
+    r.forEach(c => Array.isArray(c) ? cell(row, c[0], c[1]) : cell(row, c));
+  });
+}
+async function refresh() {
+  let s;
+  try {
+    s = await (await fetch("api/dashboard")).json();
+  } catch (e) {
+    document.getElementById("summary").textContent = "Alpaca isn't responding: " + e;
+    return;
+  }
+  let pac = "PAC file: " + (s.pac.url || "none") +
+    (s.pac.url ? (s.pac.connected ? " (connected)" : " (not connected)") : "");
+  if (s.pac.busy) pac = "PAC file: updating";
+  if (s.pac.captive_portal) {
+    pac += ". Captive portal detected, so connecting directly (" + s.pac.captive_portal + ")";
+  }
+  if (s.pac.warning) pac += ". Warning: " + s.pac.warning;
+  if (s.credentials) pac += ". Proxy auth is disabled until credentials are loaded (" +
+    s.credentials + ")";
+  document.getElementById("summary").textContent = "Version " + s.version + ", up " +
+    s.uptime + ". " + pac;
+  const counters = document.getElementById("counters");
+  counters.replaceChildren();
+  const c = s.counters;
+  const items = [["Requests", c.requests], ["Open connections", c.connections],
+    ["Open tunnels", c.tunnels], ["Goroutines", c.goroutines]];
+  if (c.max_conns) {
+    items.push(["Connections (-max-conns)", c.max_conns.open + " of " + c.max_conns.limit +
+      " (" + c.max_conns.waits + " waits)"]);
+  }
+  Object.keys(c.statuses).sort().forEach(k => items.push([k, c.statuses[k]]));
+  Object.keys(c.errors).sort().forEach(k => items.push([k, c.errors[k]]));
+  Object.keys(c.conn_waits || {}).sort().forEach(k => {
+    const w = c.conn_waits[k];
+    items.push(["Waited for a " + k + " connection", w.waited + " (" + w.total +
+      " in total, longest " + w.longest + ", " + w.timed_out + " gave up)"]);
+  });
+  items.forEach(([k, v]) => {
+    const span = document.createElement("span");
+    span.textContent = k + ": " + v;
+    counters.appendChild(span);
+  });
+  table("upstreams", ["Proxy", "State", "Since", "Until", "Detail"],
+    s.upstreams.map(u => [u.proxy, u.state, u.since || "", u.until || "", u.detail || ""]),
+    "All upstream proxies are working normally.");
+  table("latency", ["Upstream", "Requests", "Connect", "Time to first byte", "Recent"],
+    s.latency.map(l => [l.upstream, l.requests, l.connect || "", l.ttfb || "",
+      l.recent_ttfb.length ? sparkline(l.recent_ttfb) + " (up to " +
+        Math.max(...l.recent_ttfb) + "ms)" : ""]),
+    "No requests yet.");
+  table("requests", ["ID", "Time", "Method", "URL", "Via", "Status", "Error", "Duration"],
+    s.requests.map(r => [r.id, r.time, r.method, [r.url, "url"], r.via,
+      [r.status, "s" + Math.floor(r.status / 100)], r.error || "", r.duration]),
+    "No requests yet.");
+  table("tunnels", ["Client", "Server", "Opened", "Last active"],
+    s.tunnels.map(t => [t.client, t.server, t.opened, t.lastActive]), "No open tunnels.");
+  table("connections", ["Client", "State", "Since"],
+    s.connections.map(c => [c.client, c.state, c.since]), "No open connections.");
+}
+let timer;
+function setPlain(plain) {
+  document.body.classList.toggle("plain", plain);
+  document.getElementById("plain").setAttribute("aria-pressed", plain);
+  document.getElementById("refresh").hidden = !plain;
+  clearInterval(timer);
+  if (!plain) timer = setInterval(refresh, 3000);
+  try { localStorage.setItem("alpaca-plain", plain ? "1" : ""); } catch (e) {}
+}
+document.getElementById("plain").onclick =
+  () => setPlain(!document.body.classList.contains("plain"));
+document.getElementById("refresh").onclick = refresh;
+let saved = "";
+try { saved = localStorage.getItem("alpaca-plain"); } catch (e) {}
+setPlain(saved == "1" || new URLSearchParams(location.search).has("plain"));
+refresh();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,113 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboard(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "DIRECT" }`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer server.Close()
+	pf := NewProxyFinder([]string{server.URL}, NewPACWrapper(PACData{Port: 1}), myIPAuto)
+	pf.blockProxy("bad.test:80")
+	d := newDashboard(pf, newTunnelTracker(), newConnTracker())
+	d.limiter = newConnLimiter(0, 4, time.Minute)
+	d.limiter.recordWait("proxy", 1500*time.Millisecond, false)
+	d.limiter.recordWait("proxy", 500*time.Millisecond, true)
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.Header().Set(proxyErrorHeader, "dns_failure")
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := AddContextID(pf.WrapHandler(d.WrapHandler(upstream)))
+	for _, u := range []string{"http://example.test/ok", "http://example.test/fail"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, u, nil))
+	}
+
+	mux := http.NewServeMux()
+	d.SetupHandlers(mux)
+	get := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/alpaca/api/dashboard", "127.0.0.1:12345")
+	require.Equal(t, http.StatusOK, w.Code)
+	var state dashboardState
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&state))
+	assert.Equal(t, server.URL, state.PAC.URL)
+	assert.True(t, state.PAC.Connected)
+	assert.Equal(t, int64(2), state.Counters.Requests)
+	assert.Equal(t, map[string]int64{"2xx": 1, "5xx": 1}, state.Counters.Statuses)
+	assert.Equal(t, map[string]int64{"dns_failure": 1}, state.Counters.Errors)
+	assert.Equal(t, map[string]dashboardConnWaits{
+		"proxy": {Waited: 2, TimedOut: 1, Total: "2s", Longest: "1.5s"},
+	}, state.Counters.ConnWaits)
+	require.Len(t, state.Requests, 2)
+	assert.Equal(t, "http://example.test/fail", state.Requests[0].URL)
+	assert.Equal(t, http.StatusBadGateway, state.Requests[0].Status)
+	assert.Equal(t, "dns_failure", state.Requests[0].Error)
+	assert.Equal(t, "DIRECT", state.Requests[1].Via)
+	assert.Equal(t, http.StatusNoContent, state.Requests[1].Status)
+	require.Len(t, state.Upstreams, 1)
+	assert.Equal(t, "bad.test:80", state.Upstreams[0].Proxy)
+	assert.Equal(t, "blocked", state.Upstreams[0].State)
+
+	w = get("/alpaca/", "[::1]:12345")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/html"))
+	assert.Contains(t, w.Body.String(), "<title>Alpaca</title>")
+	assert.Contains(t, w.Body.String(), `<button id="plain" aria-pressed="false">`)
+	assert.Equal(t, http.StatusForbidden, get("/alpaca/", "192.0.2.1:12345").Code)
+	assert.Equal(t, http.StatusNotFound, get("/alpaca/other", "127.0.0.1:12345").Code)
+}
+
+func TestDashboardKeepsRecentRequests(t *testing.T) {
+	d := newDashboard(nil, newTunnelTracker(), nil)
+	for i := 0; i < maxDashboardRequests+5; i++ {
+		d.add(dashboardRequest{ID: i, Status: http.StatusOK})
+	}
+	assert.Len(t, d.recent, maxDashboardRequests)
+	assert.Equal(t, 5, d.recent[0].ID)
+	assert.Equal(t, int64(maxDashboardRequests+5), d.requests)
+}
+
+func TestDashboardMetrics(t *testing.T) {
+	d := newDashboard(nil, newTunnelTracker(), newConnTracker())
+	d.maxConns = newConnCap(10)
+	d.maxConns.sem <- struct{}{}
+	var buf strings.Builder
+	d.writeMetrics(&buf)
+	assert.Contains(t, buf.String(), "# TYPE alpaca_tunnels gauge\nalpaca_tunnels 0\n")
+	assert.Contains(t, buf.String(), "\nalpaca_client_connections 0\n")
+	assert.Contains(t, buf.String(), "\nalpaca_max_conns_open 1\n")
+	assert.Regexp(t, `\nalpaca_goroutines [1-9][0-9]*\n`, buf.String())
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// connTracker records the state of each client connection to the proxy, so that they can be
+// listed on the debug server. Its track method is meant to be used as an http.Server's ConnState.
+type connTracker struct {
+	conns map[net.Conn]connInfo
+	mux   sync.Mutex
+}
+
+type connInfo struct {
+	state http.ConnState
+	since time.Time
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]connInfo)}
+}
+
+func (ct *connTracker) track(conn net.Conn, state http.ConnState) {
+	ct.mux.Lock()
+	defer ct.mux.Unlock()
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		// Hijacked connections are either closed, or show up as tunnels.
+		delete(ct.conns, conn)
+	default:
+		ct.conns[conn] = connInfo{state: state, since: time.Now()}
+	}
+}
+
+// count returns the number of client connections that are open (not including the ones that have
+// become tunnels).
+func (ct *connTracker) count() int {
+	ct.mux.Lock()
+	defer ct.mux.Unlock()
+	return len(ct.conns)
+}
+
+type debugConn struct {
+	Client string `json:"client"`
+	State  string `json:"state"`
+	Since  string `json:"since"`
+}
+
+type debugTunnel struct {
+	Client     string `json:"client"`
+	Server     string `json:"server"`
+	Opened     string `json:"opened"`
+	LastActive string `json:"lastActive"`
+}
+
+type debugConnections struct {
+	Goroutines  int           `json:"goroutines"`
+	Connections []debugConn   `json:"connections"`
+	Tunnels     []debugTunnel `json:"tunnels"`
+}
+
+func (ct *connTracker) list() []debugConn {
+	ct.mux.Lock()
+	defer ct.mux.Unlock()
+	conns := make([]debugConn, 0, len(ct.conns))
+	for conn, info := range ct.conns {
+		conns = append(conns, debugConn{
+			Client: conn.RemoteAddr().String(),
+			State:  info.state.String(),
+			Since:  info.since.Format(time.RFC3339),
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Client < conns[j].Client })
+	return conns
+}
+
+func listTunnels(tt *tunnelTracker) []debugTunnel {
+	open := tt.list()
+	sort.Slice(open, func(i, j int) bool { return open[i].opened.Before(open[j].opened) })
+	tunnels := make([]debugTunnel, 0, len(open))
+	for _, t := range open {
+		tunnels = append(tunnels, debugTunnel{
+			Client:     t.client.RemoteAddr().String(),
+			Server:     t.server.RemoteAddr().String(),
+			Opened:     t.opened.Format(time.RFC3339),
+			LastActive: time.Unix(0, t.lastActive.Load()).Format(time.RFC3339),
+		})
+	}
+	return tunnels
+}
+
+// newDebugHandler returns the handler for the debug server, which serves the usual
+// net/http/pprof endpoints under /debug/pprof/, along with a dump of Alpaca's open connections
+// and tunnels at /debug/connections, a dump of everything at /debug/dump (see debugState), and
+// sampled PAC evaluations at /debug/pac-traces (see pacTraceLog).
+func newDebugHandler(ds *debugState) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/connections", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, ds.connections())
+	})
+	mux.HandleFunc("/debug/dump", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, ds.dump())
+	})
+	mux.Handle("/debug/pac-traces", pacTraces)
+	return localhostOnly(mux.ServeHTTP)
+}
+
+// listenDebug starts the debug server on the given port. It only listens on the loopback
+// interface, since profiles and connection dumps can reveal what users are browsing.
+func listenDebug(port int, ds *debugState) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	s := &http.Server{Handler: newDebugHandler(ds), ReadHeaderTimeout: time.Minute}
+	go func() { _ = s.Serve(l) }()
+	return l, nil
+}
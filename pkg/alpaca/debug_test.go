@@ -0,0 +1,76 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugConnections(t *testing.T) {
+	conns := newConnTracker()
+	tunnels := newTunnelTracker()
+	server := httptest.NewServer(newDebugHandler(newDebugState(conns, tunnels, nil)))
+	defer server.Close()
+
+	client, clientSide := tcpPair(t)
+	serverSide, upstream := tcpPair(t)
+	defer client.Close()
+	defer upstream.Close()
+	tunnels.relay(clientSide, serverSide)
+	idle, _ := tcpPair(t)
+	defer idle.Close()
+	conns.track(idle, http.StateIdle)
+
+	resp, err := http.Get(server.URL + "/debug/connections")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var dump debugConnections
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&dump))
+	assert.Positive(t, dump.Goroutines)
+	require.Len(t, dump.Connections, 1)
+	assert.Equal(t, idle.RemoteAddr().String(), dump.Connections[0].Client)
+	assert.Equal(t, "idle", dump.Connections[0].State)
+	require.Len(t, dump.Tunnels, 1)
+	assert.Equal(t, clientSide.RemoteAddr().String(), dump.Tunnels[0].Client)
+	assert.Equal(t, serverSide.RemoteAddr().String(), dump.Tunnels[0].Server)
+
+	conns.track(idle, http.StateClosed)
+	assert.Empty(t, conns.list())
+}
+
+func TestDebugPprof(t *testing.T) {
+	ds := newDebugState(newConnTracker(), newTunnelTracker(), nil)
+	server := httptest.NewServer(newDebugHandler(ds))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/debug/pprof/goroutine?debug=1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestDebugListensOnLocalhost(t *testing.T) {
+	l, err := listenDebug(0, newDebugState(newConnTracker(), newTunnelTracker(), nil))
+	require.NoError(t, err)
+	defer l.Close()
+	assert.True(t, l.Addr().(*net.TCPAddr).IP.IsLoopback())
+}
@@ -0,0 +1,224 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugState collects everything that a maintainer might need to work out what Alpaca was doing
+// (e.g. when it seems to be stuck), so that it can be saved to one file for offline analysis. A
+// dump can be downloaded from the debug server's /debug/dump endpoint (which is what "alpaca
+// debug dump" does), or written to a file periodically (see the -debug-snapshot flag).
+type debugState struct {
+	conns   *connTracker
+	tunnels *tunnelTracker
+	flags   *flag.FlagSet // If set, the values of the flags are included
+	finders []*ProxyFinder
+	mux     sync.Mutex
+}
+
+type debugDump struct {
+	Time        string            `json:"time"`
+	Version     string            `json:"version"`
+	Platform    string            `json:"platform"`
+	Config      map[string]string `json:"config"`
+	Connections debugConnections  `json:"connections"`
+	PAC         []debugPAC        `json:"pac"`
+	Failures    map[string]string `json:"failures"` // See the -dns/-dial-failure-ttl flags
+	Stacks      string            `json:"stacks"`   // Every goroutine's stack trace
+}
+
+// debugPAC is the state of a server's ProxyFinder. There's one for the main server, plus one for
+// each extra listener in the config file.
+type debugPAC struct {
+	URL       string            `json:"url"`
+	Connected bool              `json:"connected"`
+	Busy      bool              `json:"busy,omitempty"` // Whether the PAC file was in use
+	Source    string            `json:"source"`
+	Results   map[string]string `json:"results"` // The last result for each host
+	Blocked   map[string]string `json:"blocked"` // The proxies that are blocked, until when
+}
+
+func newDebugState(conns *connTracker, tunnels *tunnelTracker, flags *flag.FlagSet) *debugState {
+	return &debugState{conns: conns, tunnels: tunnels, flags: flags}
+}
+
+// addFinder includes the state of a server's ProxyFinder in dumps.
+func (ds *debugState) addFinder(pf *ProxyFinder) {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	ds.finders = append(ds.finders, pf)
+}
+
+func (ds *debugState) connections() debugConnections {
+	return debugConnections{
+		Goroutines:  runtime.NumGoroutine(),
+		Connections: ds.conns.list(),
+		Tunnels:     listTunnels(ds.tunnels),
+	}
+}
+
+func (ds *debugState) dump() debugDump {
+	dump := debugDump{
+		Time:        time.Now().Format(time.RFC3339),
+		Version:     BuildVersion,
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		Config:      make(map[string]string),
+		Connections: ds.connections(),
+		Failures:    recentFailures.snapshot(),
+	}
+	if ds.flags != nil {
+		ds.flags.VisitAll(func(f *flag.Flag) {
+			dump.Config[f.Name] = redactURL(f.Value.String())
+			if f.Name == "event-webhook" && f.Value.String() != "" {
+				// Webhook URLs (e.g. Slack's) often have a secret in their path.
+				dump.Config[f.Name] = "xxxxx"
+			}
+		})
+	}
+	ds.mux.Lock()
+	for _, pf := range ds.finders {
+		dump.PAC = append(dump.PAC, pf.debugPAC())
+	}
+	ds.mux.Unlock()
+	var stacks bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&stacks, 2); err != nil {
+		log.Printf("Error dumping goroutines: %v", err)
+	}
+	dump.Stacks = stacks.String()
+	return dump
+}
+
+// debugPAC returns the state of the ProxyFinder. A dump is most useful when something's stuck,
+// so this doesn't wait for locks that are held while the PAC file is downloaded or run.
+func (pf *ProxyFinder) debugPAC() debugPAC {
+	state := debugPAC{Source: pf.wrapper.upstreamPAC(), Blocked: make(map[string]string)}
+	if pf.TryLock() {
+		state.URL = pf.fetcher.url
+		state.Connected = pf.fetcher.isConnected()
+		blocked, router := pf.blocked, pf.router
+		pf.Unlock()
+		for proxy, expiry := range blocked.snapshot() {
+			state.Blocked[proxy] = expiry.Format(time.RFC3339)
+		}
+		if pr, ok := router.(*PACRunner); ok {
+			if results, ok := pr.lastResults(); ok {
+				state.Results = results
+			} else {
+				state.Busy = true
+			}
+		}
+	} else {
+		state.Busy = true
+	}
+	return state
+}
+
+// redactURL hides the password in a flag value that's a URL (e.g. -log-endpoint), or a
+// comma-separated list of URLs (e.g. -C, if it's given more than once).
+func redactURL(value string) string {
+	items := strings.Split(value, ",")
+	for i, item := range items {
+		if u, err := url.Parse(item); err == nil && u.User != nil {
+			items[i] = u.Redacted()
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// writeSnapshot saves a dump to path. The file is replaced atomically, so that it's never left
+// half-written if Alpaca is killed.
+func (ds *debugState) writeSnapshot(path string) error {
+	buf, err := json.MarshalIndent(ds.dump(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runSnapshots saves a dump to path every interval, until stop is closed.
+func (ds *debugState) runSnapshots(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := ds.writeSnapshot(path); err != nil {
+			log.Printf("Error writing debug snapshot: %v", err)
+		}
+	}
+}
+
+// debugDumpCommand implements "alpaca debug dump", which downloads a dump from the debug server
+// of a running instance of Alpaca, and saves it to a file.
+func debugDumpCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("alpaca debug dump", flag.ContinueOnError)
+	port := fs.Int("debug", 0, "the -debug port of the running instance")
+	output := fs.String("o", "", "file to save the dump to (default alpaca-dump-TIME.json)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *port == 0 {
+		return errors.New("please specify the running instance's debug port (using -debug)")
+	}
+	if *output == "" {
+		*output = "alpaca-dump-" + time.Now().Format("20060102-150405") + ".json"
+	}
+	addr := net.JoinHostPort("localhost", strconv.Itoa(*port))
+	resp, err := http.Get("http://" + addr + "/debug/dump")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from debug server: %s", resp.Status)
+	}
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Saved a debug dump to %s\n", *output)
+	return nil
+}
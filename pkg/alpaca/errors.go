@@ -0,0 +1,70 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// These errors are returned (usually wrapped with more detail) when something goes wrong while
+// proxying a request, so that callers can use errors.Is to react to specific failures instead of
+// matching on error strings. A Server passes them to Config.OnError, and Server.PACError returns
+// ErrPACUnavailable.
+var (
+	// ErrAuthRejected means that an upstream proxy still responded with "407 Proxy
+	// Authentication Required" after we sent it our credentials.
+	ErrAuthRejected = errors.New("proxy authentication rejected")
+	// ErrPACUnavailable means that a PAC URL couldn't be found, or the PAC file couldn't be
+	// downloaded from it.
+	ErrPACUnavailable = errors.New("PAC file unavailable")
+	// ErrUpstreamBlocked means that an upstream proxy couldn't be reached, and has been
+	// temporarily blocked.
+	ErrUpstreamBlocked = errors.New("upstream proxy blocked")
+	// ErrTooManyConnections means that a request couldn't be sent, because there were already
+	// too many connections open to the same host or proxy (see -max-conns-per-host and
+	// -max-conns-per-proxy).
+	ErrTooManyConnections = errors.New("too many connections")
+	// ErrProxyLoop means that a request came back to the same instance of Alpaca that sent it,
+	// e.g. because the PAC file points at Alpaca itself.
+	ErrProxyLoop = errors.New("proxy loop detected")
+	// ErrUploadBlocked means that a request body was rejected by the upload scanner (see
+	// -scan-uploads).
+	ErrUploadBlocked = errors.New("upload blocked by scanner")
+	// ErrDownloadBlocked means that a response couldn't be scanned by the ICAP server given by
+	// -scan-downloads (e.g. because it was too big).
+	ErrDownloadBlocked = errors.New("download blocked by scanner")
+)
+
+// contextKeyOnError holds the function that's called with each error that's sent to a client
+// (see Config.OnError).
+const contextKeyOnError = contextKey("onError")
+
+// reportErrors returns a handler that makes reportError call onError for the requests that it
+// serves.
+func reportErrors(next http.Handler, onError func(*http.Request, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), contextKeyOnError, onError)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// reportError passes err to the program that's embedding Alpaca, if it asked for errors.
+func reportError(req *http.Request, err error) {
+	if onError, ok := req.Context().Value(contextKeyOnError).(func(*http.Request, error)); ok {
+		onError(req, err)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The types of event that Alpaca publishes to -event-webhook and -event-exec.
+const (
+	eventAuthFailed         = "auth_failed"         // An upstream proxy rejected the credentials
+	eventUpstreamDown       = "upstream_down"       // An upstream proxy couldn't be reached
+	eventPACChanged         = "pac_changed"         // A changed PAC file was downloaded (or restored)
+	eventCredentialsChanged = "credentials_changed" // The credentials were replaced
+)
+
+var eventTypes = []string{
+	eventAuthFailed, eventUpstreamDown, eventPACChanged, eventCredentialsChanged,
+}
+
+const (
+	eventQueueSize = 100              // The number of events a subscriber can fall behind by
+	eventCooldown  = time.Minute      // How long to wait before repeating an event
+	eventTimeout   = 30 * time.Second // The timeout for each webhook request or command
+)
+
+// event is something that happened in Alpaca that a user might want to know about. Webhooks
+// are sent it as JSON; since it has a "text" field, it can be sent straight to a Slack (or
+// Mattermost, or Rocket.Chat) incoming webhook.
+type event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`              // The machine that Alpaca is running on
+	Subject string    `json:"subject,omitempty"` // The proxy, PAC URL or user it's about
+	Text    string    `json:"text"`
+}
+
+// eventTarget is somewhere that events are delivered to.
+type eventTarget interface {
+	deliver(ev event) error
+	String() string
+}
+
+// eventBus passes events on to its subscribers. Each subscriber has its own queue, so a slow
+// webhook can't hold up the proxy or the other subscribers; if its queue fills up, events are
+// dropped. The same event (with the same type and subject) is only published once a minute, so
+// that a proxy that's rejecting every request doesn't send a flood of notifications.
+type eventBus struct {
+	types  []string // The types of event to publish, or nil for all of them
+	queues []chan event
+	host   string
+	now    func() time.Time
+	last   map[string]time.Time // When each type and subject was last published
+	mux    sync.Mutex
+}
+
+// events is the bus that the rest of Alpaca publishes to. Until something subscribes, publishing
+// an event does nothing.
+var events = newEventBus(nil)
+
+func newEventBus(types []string) *eventBus {
+	host, _ := os.Hostname()
+	return &eventBus{types: types, host: host, now: time.Now, last: map[string]time.Time{}}
+}
+
+// parseEventTypes parses the comma-separated list of types given by -events (all of them, if
+// it's empty).
+func parseEventTypes(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var types []string
+	for _, typ := range strings.Split(value, ",") {
+		typ = strings.TrimSpace(typ)
+		if !slices.Contains(eventTypes, typ) {
+			return nil, fmt.Errorf("unknown event type %q (should be one of %s)", typ,
+				strings.Join(eventTypes, ", "))
+		}
+		types = append(types, typ)
+	}
+	return types, nil
+}
+
+// subscribe starts delivering events to target, in the background.
+func (eb *eventBus) subscribe(target eventTarget) {
+	queue := make(chan event, eventQueueSize)
+	eb.mux.Lock()
+	eb.queues = append(eb.queues, queue)
+	eb.mux.Unlock()
+	go func() {
+		for ev := range queue {
+			if err := target.deliver(ev); err != nil {
+				log.Printf("Error sending %s event to %s: %v", ev.Type, target, err)
+			}
+		}
+	}()
+}
+
+// publish sends an event to each subscriber. The text is formatted like log.Printf.
+func (eb *eventBus) publish(typ, subject, format string, args ...interface{}) {
+	eb.mux.Lock()
+	defer eb.mux.Unlock()
+	if len(eb.queues) == 0 || (eb.types != nil && !slices.Contains(eb.types, typ)) {
+		return
+	}
+	now := eb.now()
+	key := typ + " " + subject
+	if last, ok := eb.last[key]; ok && now.Sub(last) < eventCooldown {
+		return
+	}
+	eb.last[key] = now
+	ev := event{
+		Type:    typ,
+		Time:    now,
+		Host:    eb.host,
+		Subject: subject,
+		Text:    fmt.Sprintf(format, args...),
+	}
+	for _, queue := range eb.queues {
+		select {
+		case queue <- ev:
+		default:
+			log.Printf("Dropping %s event, since a subscriber has fallen behind", typ)
+		}
+	}
+}
+
+// publishAuthFailed publishes an auth_failed event for an upstream proxy that rejected Alpaca's
+// credentials.
+func publishAuthFailed(proxy *url.URL) {
+	if proxy == nil {
+		return
+	}
+	events.publish(eventAuthFailed, proxy.Host,
+		"The proxy %s rejected Alpaca's credentials (e.g. the password may have changed)",
+		proxy.Host)
+}
+
+// webhookTarget POSTs each event as JSON to a URL (given by -event-webhook).
+type webhookTarget struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookTarget(url string) *webhookTarget {
+	return &webhookTarget{url: url, client: &http.Client{Timeout: eventTimeout}}
+}
+
+func (wt *webhookTarget) deliver(ev event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := wt.client.Post(wt.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// String returns only the webhook's host, since webhook URLs often have a secret in their path.
+func (wt *webhookTarget) String() string {
+	if u, err := url.Parse(wt.url); err == nil {
+		return "webhook at " + u.Host
+	}
+	return "webhook"
+}
+
+// execTarget runs a command (given by -event-exec) using the shell for each event, with the event
+// as JSON on its stdin, and its type and text in the ALPACA_EVENT and ALPACA_EVENT_TEXT
+// environment variables.
+type execTarget struct {
+	command     string
+	execCommand func(name string, arg ...string) *exec.Cmd
+}
+
+func newExecTarget(command string) *execTarget {
+	return &execTarget{command: command, execCommand: exec.Command}
+}
+
+func (et *execTarget) deliver(ev event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	cmd := shellCommand(et.execCommand, et.command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), "ALPACA_EVENT="+ev.Type, "ALPACA_EVENT_TEXT="+ev.Text)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Don't wait for any background processes that it leaves running.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = cmd.Process.Kill() })
+	defer stop()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output.Bytes()))
+	}
+	return nil
+}
+
+func (et *execTarget) String() string {
+	return fmt.Sprintf("%q", et.command)
+}
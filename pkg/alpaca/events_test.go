@@ -0,0 +1,159 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookServer returns the URL of a webhook that sends each event that it receives to a channel.
+func webhookServer(t *testing.T) (string, chan event) {
+	received := make(chan event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var ev event
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&ev))
+		received <- ev
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/services/secret", received
+}
+
+// useEventBus replaces the event bus for the duration of a test.
+func useEventBus(t *testing.T, eb *eventBus) {
+	saved := events
+	events = eb
+	t.Cleanup(func() { events = saved })
+}
+
+func nextEvent(t *testing.T, received chan event) event {
+	select {
+	case ev := <-received:
+		return ev
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timed out waiting for an event")
+		return event{}
+	}
+}
+
+func TestEventWebhook(t *testing.T) {
+	webhook, received := webhookServer(t)
+	eb := newEventBus(nil)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	eb.now = func() time.Time { return now }
+	eb.subscribe(newWebhookTarget(webhook))
+	eb.publish(eventUpstreamDown, "proxy.test:8080", "Couldn't connect to %s", "proxy.test:8080")
+	ev := nextEvent(t, received)
+	assert.Equal(t, eventUpstreamDown, ev.Type)
+	assert.Equal(t, "proxy.test:8080", ev.Subject)
+	assert.Equal(t, "Couldn't connect to proxy.test:8080", ev.Text)
+	assert.True(t, now.Equal(ev.Time))
+	assert.NotEmpty(t, ev.Host)
+
+	// The same event isn't repeated within a minute, but others are still sent.
+	eb.publish(eventUpstreamDown, "proxy.test:8080", "Couldn't connect again")
+	eb.publish(eventUpstreamDown, "other.test:8080", "Couldn't connect to other.test")
+	assert.Equal(t, "other.test:8080", nextEvent(t, received).Subject)
+	now = now.Add(eventCooldown)
+	eb.publish(eventUpstreamDown, "proxy.test:8080", "Couldn't connect again")
+	assert.Equal(t, "Couldn't connect again", nextEvent(t, received).Text)
+
+	// The webhook's path isn't logged, since it may be a secret.
+	assert.NotContains(t, newWebhookTarget(webhook).String(), "secret")
+}
+
+func TestEventTypes(t *testing.T) {
+	types, err := parseEventTypes("")
+	require.NoError(t, err)
+	assert.Nil(t, types)
+	types, err = parseEventTypes("auth_failed, pac_changed")
+	require.NoError(t, err)
+	assert.Equal(t, []string{eventAuthFailed, eventPACChanged}, types)
+	_, err = parseEventTypes("auth_failed,reboot")
+	assert.ErrorContains(t, err, `unknown event type "reboot"`)
+
+	webhook, received := webhookServer(t)
+	eb := newEventBus(types)
+	eb.subscribe(newWebhookTarget(webhook))
+	eb.publish(eventUpstreamDown, "proxy.test:8080", "Couldn't connect")
+	eb.publish(eventAuthFailed, "proxy.test:8080", "Credentials rejected")
+	assert.Equal(t, eventAuthFailed, nextEvent(t, received).Type)
+}
+
+func TestEventExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	dir := t.TempDir()
+	target := newExecTarget(`cat > "$OUT/event.json"; echo "$ALPACA_EVENT" > "$OUT/type"`)
+	t.Setenv("OUT", dir)
+	err := target.deliver(event{Type: eventPACChanged, Text: "Using a new PAC file"})
+	require.NoError(t, err)
+	out, err := os.ReadFile(filepath.Join(dir, "type"))
+	require.NoError(t, err)
+	assert.Equal(t, "pac_changed\n", string(out))
+	out, err = os.ReadFile(filepath.Join(dir, "event.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"text":"Using a new PAC file"`)
+
+	err = newExecTarget("echo oops >&2; exit 3").deliver(event{Type: eventPACChanged})
+	assert.ErrorContains(t, err, "oops")
+}
+
+func TestPACChangedEvent(t *testing.T) {
+	webhook, received := webhookServer(t)
+	eb := newEventBus(nil)
+	eb.subscribe(newWebhookTarget(webhook))
+	useEventBus(t, eb)
+	js := `function FindProxyForURL(url, host) { return "DIRECT" }`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(js))
+	}))
+	defer server.Close()
+	pf := NewProxyFinder([]string{server.URL}, NewPACWrapper(PACData{Port: 1}), myIPAuto)
+	js = `function FindProxyForURL(url, host) { return "PROXY proxy.test:8080" }`
+	pf.fetcher.refreshInterval = time.Hour
+	pf.fetcher.fetched = time.Time{}
+	pf.checkForUpdates()
+	ev := nextEvent(t, received)
+	assert.Equal(t, eventPACChanged, ev.Type)
+	assert.Equal(t, server.URL, ev.Subject)
+}
+
+func TestUpstreamDownEvent(t *testing.T) {
+	webhook, received := webhookServer(t)
+	eb := newEventBus(nil)
+	eb.subscribe(newWebhookTarget(webhook))
+	useEventBus(t, eb)
+	ph := NewProxyHandler(nil, getProxyFromContext, func(string) {})
+	req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+	err := ph.blockProxy(req, &url.URL{Host: "proxy.test:8080"}, errors.New("connection refused"))
+	require.ErrorIs(t, err, ErrUpstreamBlocked)
+	ev := nextEvent(t, received)
+	assert.Equal(t, eventUpstreamDown, ev.Type)
+	assert.Equal(t, "proxy.test:8080", ev.Subject)
+	assert.Contains(t, ev.Text, "connection refused")
+}
@@ -0,0 +1,170 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// extensionAPI serves a small JSON API for a companion browser extension, which can show how
+// Alpaca routes the current tab's URL, and temporarily bypass the proxy for some (or all)
+// hosts. Browsers only allow the extension to read the responses if its origin is configured
+// using the -extension-origin flag; requests from any other origin are rejected.
+type extensionAPI struct {
+	finder *ProxyFinder
+	origin string // e.g. "chrome-extension://abcdefghijklmnopabcdefghijklmnop"
+}
+
+type extensionStatus struct {
+	Version   string   `json:"version"`
+	PACURL    string   `json:"pacUrl"`
+	Connected bool     `json:"connected"`
+	BypassAll bool     `json:"bypassAll"`
+	Bypass    []string `json:"bypass"`
+}
+
+type extensionRoute struct {
+	URL     string   `json:"url"`
+	Proxy   string   `json:"proxy"`
+	Reasons []string `json:"reasons,omitempty"` // The steps that led to choosing Proxy
+}
+
+type extensionBypass struct {
+	Host string `json:"host,omitempty"`
+	All  *bool  `json:"all,omitempty"`
+}
+
+func (api *extensionAPI) SetupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/alpaca/api/status", api.wrap(api.handleStatus))
+	mux.HandleFunc("/alpaca/api/route", api.wrap(api.handleRoute))
+	mux.HandleFunc("/alpaca/api/bypass", api.wrap(api.handleBypass))
+}
+
+func (api *extensionAPI) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return localhostOnly(func(w http.ResponseWriter, req *http.Request) {
+		// Browsers send an Origin header with cross-origin requests. Only allow the extension
+		// (and non-browser clients, which don't send the header) to use the API.
+		if origin := req.Header.Get("Origin"); origin != "" {
+			if api.origin == "" || origin != api.origin {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Vary", "Origin")
+			if req.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next(w, req)
+	})
+}
+
+func (api *extensionAPI) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	pacurl, connected := api.finder.pacStatus()
+	all, hosts := api.finder.bypass.list()
+	writeJSON(w, http.StatusOK, extensionStatus{
+		Version:   BuildVersion,
+		PACURL:    pacurl,
+		Connected: connected,
+		BypassAll: all,
+		Bypass:    hosts,
+	})
+}
+
+func (api *extensionAPI) handleRoute(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	target := req.URL.Query().Get("url")
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		writeJSONError(w, http.StatusBadRequest, "url parameter must be an absolute URL")
+		return
+	}
+	var reasons []string
+	ctx := context.WithValue(req.Context(), contextKeyReasons, &reasons)
+	lookup, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	proxy, err := api.finder.findProxyForRequest(lookup)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, extensionRoute{
+		URL:     target,
+		Proxy:   proxyString(proxy),
+		Reasons: reasons,
+	})
+}
+
+// proxyString formats a proxy as it would appear in the result of FindProxyForURL.
+func proxyString(proxy *url.URL) string {
+	if proxy == nil {
+		return "DIRECT"
+	} else if proxy.Scheme == "https" {
+		return "HTTPS " + proxy.Host
+	}
+	return "PROXY " + proxy.Host
+}
+
+func (api *extensionAPI) handleBypass(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body extensionBypass
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		} else if body.Host == "" && body.All == nil {
+			writeJSONError(w, http.StatusBadRequest, "request body must set host or all")
+			return
+		}
+		if body.Host != "" {
+			api.finder.bypass.add(body.Host)
+		}
+		if body.All != nil {
+			api.finder.bypass.setAll(*body.All)
+		}
+	case http.MethodDelete:
+		host := req.URL.Query().Get("host")
+		if host == "" {
+			writeJSONError(w, http.StatusBadRequest, "host parameter is required")
+			return
+		}
+		api.finder.bypass.remove(host)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	all, hosts := api.finder.bypass.list()
+	writeJSON(w, http.StatusOK, struct {
+		All   bool     `json:"all"`
+		Hosts []string `json:"hosts"`
+	}{all, hosts})
+}
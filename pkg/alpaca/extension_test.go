@@ -0,0 +1,149 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testExtensionOrigin = "chrome-extension://alpaca"
+
+func newTestExtensionAPI(t *testing.T) (*http.ServeMux, *ProxyFinder) {
+	js := `function FindProxyForURL(url, host) {
+		return host == "internal.test" ? "DIRECT" : "PROXY proxy.test:8080";
+	}`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	t.Cleanup(server.Close)
+	pf := NewProxyFinder([]string{server.URL}, NewPACWrapper(PACData{Port: 1}), myIPAuto)
+	mux := http.NewServeMux()
+	api := &extensionAPI{finder: pf, origin: testExtensionOrigin}
+	api.SetupHandlers(mux)
+	return mux, pf
+}
+
+func callExtensionAPI(mux *http.ServeMux, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:12345"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestExtensionStatus(t *testing.T) {
+	mux, pf := newTestExtensionAPI(t)
+	w := callExtensionAPI(mux, http.MethodGet, "/alpaca/api/status", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var status extensionStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, pf.fetcher.url, status.PACURL)
+	assert.True(t, status.Connected)
+	assert.False(t, status.BypassAll)
+	assert.Empty(t, status.Bypass)
+}
+
+func TestExtensionRoute(t *testing.T) {
+	mux, _ := newTestExtensionAPI(t)
+	tests := []struct {
+		url, expected string
+	}{
+		{"https://internal.test/page", "DIRECT"},
+		{"https://external.test/page", "PROXY proxy.test:8080"},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			target := "/alpaca/api/route?url=" + url.QueryEscape(test.url)
+			w := callExtensionAPI(mux, http.MethodGet, target, "")
+			require.Equal(t, http.StatusOK, w.Code)
+			var route extensionRoute
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&route))
+			assert.Equal(t, test.url, route.URL)
+			assert.Equal(t, test.expected, route.Proxy)
+		})
+	}
+	w := callExtensionAPI(mux, http.MethodGet, "/alpaca/api/route?url=not-a-url", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExtensionBypass(t *testing.T) {
+	mux, pf := newTestExtensionAPI(t)
+	w := callExtensionAPI(mux, http.MethodPost, "/alpaca/api/bypass", `{"host": "external.test"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"all": false, "hosts": ["external.test"]}`, w.Body.String())
+	req := httptest.NewRequest(http.MethodGet, "https://www.external.test", nil)
+	proxy, err := pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Nil(t, proxy)
+
+	w = callExtensionAPI(mux, http.MethodDelete, "/alpaca/api/bypass?host=external.test", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	proxy, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.NotNil(t, proxy)
+
+	w = callExtensionAPI(mux, http.MethodPost, "/alpaca/api/bypass", `{"all": true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"all": true, "hosts": []}`, w.Body.String())
+	proxy, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Nil(t, proxy)
+
+	w = callExtensionAPI(mux, http.MethodPost, "/alpaca/api/bypass", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExtensionCORS(t *testing.T) {
+	mux, _ := newTestExtensionAPI(t)
+	tests := []struct {
+		name, method, origin string
+		expected             int
+	}{
+		{"NoOrigin", http.MethodGet, "", http.StatusOK},
+		{"ExtensionOrigin", http.MethodGet, testExtensionOrigin, http.StatusOK},
+		{"Preflight", http.MethodOptions, testExtensionOrigin, http.StatusNoContent},
+		{"OtherOrigin", http.MethodGet, "https://evil.test", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/alpaca/api/status", nil)
+			req.RemoteAddr = "127.0.0.1:12345"
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			assert.Equal(t, test.expected, w.Code)
+			if test.expected != http.StatusForbidden {
+				assert.Equal(t, test.origin, w.Header().Get("Access-Control-Allow-Origin"))
+			}
+		})
+	}
+}
+
+func TestExtensionAPIIsLocalhostOnly(t *testing.T) {
+	mux, _ := newTestExtensionAPI(t)
+	req := httptest.NewRequest(http.MethodGet, "/alpaca/api/status", nil)
+	req.RemoteAddr = "192.0.2.1:12345"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
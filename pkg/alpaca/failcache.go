@@ -0,0 +1,146 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The number of failures to remember before expired ones are cleared out.
+const maxCachedFailures = 1000
+
+// failureCache remembers DNS lookups and dials that failed recently, so that they can fail
+// straight away if they're tried again soon after. Some applications retry requests to a dead
+// host in a tight loop, and without this, each retry means another DNS lookup (possibly from the
+// PAC file too) and another connection attempt to the host or the upstream proxy.
+type failureCache struct {
+	dnsTTL     time.Duration // How long to remember failed DNS lookups (0 to disable)
+	dialTTL    time.Duration // How long to remember other failed dials (0 to disable)
+	lookupHost func(host string) ([]string, error)
+	now        func() time.Time
+	failures   map[string]cachedFailure
+	mux        sync.Mutex
+}
+
+type cachedFailure struct {
+	err     error
+	expires time.Time
+}
+
+func newFailureCache(dnsTTL, dialTTL time.Duration) *failureCache {
+	return &failureCache{
+		dnsTTL:     dnsTTL,
+		dialTTL:    dialTTL,
+		lookupHost: net.LookupHost,
+		now:        time.Now,
+		failures:   make(map[string]cachedFailure),
+	}
+}
+
+// recentFailures is used for all DNS lookups made by PAC files, and all outgoing connections. Its
+// TTLs are set by main, using the -dns-failure-ttl and -dial-failure-ttl flags.
+var recentFailures = newFailureCache(0, 0)
+
+// get returns the error for a recent failure, or nil if there isn't one.
+func (fc *failureCache) get(key string) error {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	failure, ok := fc.failures[key]
+	if !ok {
+		return nil
+	}
+	now := fc.now()
+	if !now.Before(failure.expires) {
+		delete(fc.failures, key)
+		return nil
+	}
+	remaining := failure.expires.Sub(now).Round(time.Millisecond)
+	return fmt.Errorf("%w (failed recently, not retrying for %v)", failure.err, remaining)
+}
+
+func (fc *failureCache) put(key string, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	now := fc.now()
+	if len(fc.failures) >= maxCachedFailures {
+		for k, failure := range fc.failures {
+			if !now.Before(failure.expires) {
+				delete(fc.failures, k)
+			}
+		}
+	}
+	fc.failures[key] = cachedFailure{err: err, expires: now.Add(ttl)}
+}
+
+// snapshot returns the failures that are currently cached, by key (e.g. "dns/example.com").
+func (fc *failureCache) snapshot() map[string]string {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	now := fc.now()
+	failures := make(map[string]string, len(fc.failures))
+	for key, failure := range fc.failures {
+		if now.Before(failure.expires) {
+			failures[key] = failure.err.Error()
+		}
+	}
+	return failures
+}
+
+// lookup is like net.LookupHost, but fails straight away if host failed to resolve recently.
+func (fc *failureCache) lookup(host string) ([]string, error) {
+	if err := fc.get("dns/" + host); err != nil {
+		return nil, err
+	}
+	addrs, err := fc.lookupHost(host)
+	if err != nil {
+		fc.put("dns/"+host, err, fc.dnsTTL)
+	}
+	return addrs, err
+}
+
+// dialContext dials address using dial, unless dialling it (or resolving its host) failed
+// recently, in which case it returns the same error straight away.
+func (fc *failureCache) dialContext(ctx context.Context, dial dialFunc, network, address string) (
+	net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return dial(ctx, network, address)
+	}
+	if err := fc.get("dns/" + host); err != nil {
+		return nil, err
+	} else if err := fc.get("dial/" + address); err != nil {
+		return nil, err
+	}
+	conn, err := dial(ctx, network, address)
+	if err == nil || ctx.Err() != nil {
+		// Don't remember failures caused by the client giving up.
+		return conn, err
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		fc.put("dns/"+host, err, fc.dnsTTL)
+	} else {
+		fc.put("dial/"+address, err, fc.dialTTL)
+	}
+	return conn, err
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFailureCache(now *time.Time) *failureCache {
+	fc := newFailureCache(10*time.Second, 2*time.Second)
+	fc.now = func() time.Time { return *now }
+	return fc
+}
+
+func TestFailureCacheLookup(t *testing.T) {
+	now := time.Now()
+	fc := newTestFailureCache(&now)
+	lookups := 0
+	fc.lookupHost = func(host string) ([]string, error) {
+		lookups++
+		if host == "dead.test" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []string{"192.0.2.1"}, nil
+	}
+	for i := 0; i < 3; i++ {
+		_, err := fc.lookup("dead.test")
+		var dnsErr *net.DNSError
+		assert.ErrorAs(t, err, &dnsErr)
+	}
+	assert.Equal(t, 1, lookups)
+	// Successful lookups aren't cached.
+	for i := 0; i < 2; i++ {
+		addrs, err := fc.lookup("alive.test")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"192.0.2.1"}, addrs)
+	}
+	assert.Equal(t, 3, lookups)
+	now = now.Add(10 * time.Second)
+	_, err := fc.lookup("dead.test")
+	assert.Error(t, err)
+	assert.Equal(t, 4, lookups)
+}
+
+func TestFailureCacheDial(t *testing.T) {
+	now := time.Now()
+	fc := newTestFailureCache(&now)
+	dials := make(map[string]int)
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials[address]++
+		host, _, _ := net.SplitHostPort(address)
+		if host == "dead.test" {
+			return nil, &net.OpError{Op: "dial", Net: network,
+				Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+		}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("refused")}
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := fc.dialContext(ctx, dial, "tcp", "dead.test:80")
+		assert.Error(t, err)
+		_, err = fc.dialContext(ctx, dial, "tcp", "192.0.2.1:8080")
+		assert.Error(t, err)
+	}
+	// A DNS failure applies to every port on the host.
+	_, err := fc.dialContext(ctx, dial, "tcp", "dead.test:443")
+	assert.Error(t, err)
+	assert.Equal(t, map[string]int{"dead.test:80": 1, "192.0.2.1:8080": 1}, dials)
+	// Dial failures are remembered for less time than DNS failures.
+	now = now.Add(2 * time.Second)
+	_, err = fc.dialContext(ctx, dial, "tcp", "192.0.2.1:8080")
+	assert.Error(t, err)
+	_, err = fc.dialContext(ctx, dial, "tcp", "dead.test:80")
+	assert.Error(t, err)
+	assert.Equal(t, map[string]int{"dead.test:80": 1, "192.0.2.1:8080": 2}, dials)
+}
+
+func TestFailureCacheIgnoresCancelledDials(t *testing.T) {
+	fc := newFailureCache(time.Minute, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dials := 0
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("refused")
+	}
+	_, err := fc.dialContext(ctx, dial, "tcp", "192.0.2.1:80")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = fc.dialContext(context.Background(), dial, "tcp", "192.0.2.1:80")
+	assert.Error(t, err)
+	assert.Equal(t, 2, dials)
+}
+
+func TestFailureCacheDisabled(t *testing.T) {
+	fc := newFailureCache(0, 0)
+	dials := 0
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		return nil, errors.New("refused")
+	}
+	for i := 0; i < 3; i++ {
+		_, err := fc.dialContext(context.Background(), dial, "tcp", "192.0.2.1:80")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 3, dials)
+	assert.Empty(t, fc.failures)
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fallbackRetryAfter is how long the fallback credentials are used for after the primary ones are
+// rejected, before the primary ones are tried again.
+const fallbackRetryAfter = 10 * time.Minute
+
+// fallbackAuth authenticates using the primary credentials, and if the proxy rejects them (e.g.
+// because the account has been locked), tries a second set of credentials, such as a service
+// account's. While the primary credentials are being rejected, the fallback ones are used
+// straight away, rather than making the account's lockout worse by failing again on every
+// connection. Since it's not otherwise obvious which account a connection was authenticated as,
+// it's logged for each handshake.
+type fallbackAuth struct {
+	primary  proxyAuth // May be nil (e.g. if the Windows credentials couldn't be used)
+	fallback proxyAuth
+	now      func() time.Time
+	rejected time.Time // When the primary credentials were last rejected
+	mux      sync.Mutex
+}
+
+func newFallbackAuth(primary, fallback proxyAuth) *fallbackAuth {
+	return &fallbackAuth{primary: primary, fallback: fallback, now: time.Now}
+}
+
+func (fa *fallbackAuth) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	id := req.Context().Value(contextKeyID)
+	primary := identity(fa.primary, "the primary account")
+	fallback := identity(fa.fallback, "the fallback account")
+	if !authEnabled(fa.primary) {
+		log.Printf("[%d] Authenticating as %s, since there are no primary credentials", id,
+			fallback)
+		return fa.fallback.do(req, rt)
+	}
+	fa.mux.Lock()
+	since := fa.now().Sub(fa.rejected)
+	fa.mux.Unlock()
+	if since < fallbackRetryAfter {
+		log.Printf("[%d] Authenticating as %s (the fallback), since %s was rejected %v ago",
+			id, fallback, primary, since.Round(time.Second))
+		return fa.fallback.do(req, rt)
+	}
+	resp, err := fa.primary.do(req, rt)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusProxyAuthRequired {
+		log.Printf("[%d] Authenticated as %s", id, primary)
+		return resp, nil
+	}
+	fa.mux.Lock()
+	fa.rejected = fa.now()
+	fa.mux.Unlock()
+	if req.GetBody == nil && req.Body != nil && req.Body != http.NoBody {
+		// The body has already been sent, and can't be sent again.
+		log.Printf("[%d] The proxy rejected the credentials for %s, and the request can't be "+
+			"sent again as %s (the fallback)", id, primary, fallback)
+		return resp, nil
+	}
+	log.Printf("[%d] The proxy rejected the credentials for %s, so using %s (the fallback) "+
+		"for the next %v", id, primary, fallback, fallbackRetryAfter)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req.Body = body
+	}
+	// The proxy might close the connection that the handshake failed on, and a failed NTLM
+	// handshake leaves it unusable anyway, so the fallback handshake needs a new one. (Closing
+	// the body closes the connections that an http.Transport used, so it makes new ones.)
+	resp.Body.Close()
+	if r, ok := rt.(redialer); ok {
+		if err := r.redial(); err != nil {
+			return nil, err
+		}
+	}
+	resp, err = fa.fallback.do(req, rt)
+	if err == nil && resp.StatusCode != http.StatusProxyAuthRequired {
+		log.Printf("[%d] Authenticated as %s (the fallback)", id, fallback)
+	}
+	return resp, err
+}
+
+// redialer is implemented by round trippers that send every request on the same connection (i.e.
+// transport, which is used for CONNECT requests), so that the connection can be replaced.
+type redialer interface {
+	redial() error
+}
+
+// identity describes the account that auth authenticates as, for logging, or returns unknown if
+// it can't tell.
+func identity(auth proxyAuth, unknown string) string {
+	switch a := auth.(type) {
+	case *authenticator:
+		return a.domain + `\` + a.username
+	case *rotatingAuth:
+		if current := a.current.Load(); current != nil {
+			return identity(current, unknown)
+		}
+	case *credentialHelper:
+		a.mux.Lock()
+		defer a.mux.Unlock()
+		if a.current != nil {
+			return identity(a.current, unknown)
+		}
+		return "the credential helper's account"
+	case *sspiAuthenticator:
+		return "the logged-in Windows user"
+	}
+	return unknown
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuong/go-ntlmssp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statusAuth is a proxyAuth that gets the same response every time, and counts its handshakes.
+type statusAuth struct {
+	status int
+	calls  int
+}
+
+func (sa *statusAuth) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	sa.calls++
+	return &http.Response{StatusCode: sa.status, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestFallbackAuth(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(io.Discard)
+	rejecting := &statusAuth{status: http.StatusProxyAuthRequired}
+	fallback := &statusAuth{status: http.StatusOK}
+	fa := newFallbackAuth(rejecting, fallback)
+	now := time.Now()
+	fa.now = func() time.Time { return now }
+	send := func() int {
+		ctx := context.WithValue(context.Background(), contextKeyID, 1)
+		req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil).WithContext(ctx)
+		resp, err := fa.do(req, nil)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	// The primary credentials are rejected, so the fallback ones are tried.
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, 1, rejecting.calls)
+	assert.Equal(t, 1, fallback.calls)
+	assert.Contains(t, buf.String(), "[1] The proxy rejected the credentials for the primary "+
+		"account, so using the fallback account (the fallback) for the next 10m0s\n")
+	assert.Contains(t, buf.String(), "[1] Authenticated as the fallback account (the fallback)\n")
+	// For a while, the fallback ones are used straight away.
+	now = now.Add(fallbackRetryAfter - time.Second)
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, 1, rejecting.calls)
+	assert.Equal(t, 2, fallback.calls)
+	// Then the primary ones are tried again.
+	now = now.Add(time.Second)
+	rejecting.status = http.StatusOK
+	buf.Reset()
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, 2, rejecting.calls)
+	assert.Equal(t, 2, fallback.calls)
+	assert.Contains(t, buf.String(), "[1] Authenticated as the primary account\n")
+}
+
+func TestFallbackAuthWithoutPrimaryCredentials(t *testing.T) {
+	fallback := &statusAuth{status: http.StatusOK}
+	fa := newFallbackAuth(&rotatingAuth{}, fallback)
+	assert.True(t, authEnabled(fa))
+	req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+	resp, err := fa.do(req, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, fallback.calls)
+}
+
+func TestIdentity(t *testing.T) {
+	a := &authenticator{domain: "CORP", username: "svc"}
+	assert.Equal(t, `CORP\svc`, identity(a, "?"))
+	ra := &rotatingAuth{}
+	assert.Equal(t, "?", identity(ra, "?"))
+	ra.current.Store(a)
+	assert.Equal(t, `CORP\svc`, identity(ra, "?"))
+	assert.Equal(t, "the logged-in Windows user", identity(&sspiAuthenticator{}, "?"))
+}
+
+func TestFallbackAuthDoesntResendUsedBody(t *testing.T) {
+	rejecting := &statusAuth{status: http.StatusProxyAuthRequired}
+	fallback := &statusAuth{status: http.StatusOK}
+	fa := newFallbackAuth(rejecting, fallback)
+	ctx := context.WithValue(context.Background(), contextKeyID, 1)
+	req := httptest.NewRequest(http.MethodPost, "http://www.test/", strings.NewReader("form"))
+	req.GetBody = nil
+	resp, err := fa.do(req.WithContext(ctx), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, 0, fallback.calls)
+}
+
+func TestFallbackAuthNTLMConnect(t *testing.T) {
+	pacServer := httptest.NewServer(pacjsHandler(`function FindProxyForURL(url, host) {
+		return "PROXY proxy.test:8080";
+	}`))
+	defer pacServer.Close()
+	primary := &authenticator{"ACME", "malory", ntlmssp.GetNtlmHash("guest"), "guest"}
+	fallback := &authenticator{"ACME", "svc-build", ntlmssp.GetNtlmHash("secret"), "secret"}
+	h, err := newHarness(func(port int, dial dialFunc) *http.Server {
+		return createServer("localhost", port, []string{pacServer.URL},
+			newFallbackAuth(primary, fallback), newTunnelTracker(), serverOptions{dial: dial})
+	})
+	require.NoError(t, err)
+	defer h.Close()
+	// The proxy rejects the primary account, and closes the connection when it does.
+	h.upstream.rejected = []string{"malory"}
+	scenario := Scenario{
+		URL:       "https://www.example.com/",
+		ProxyAuth: []string{"NTLM"},
+		Expect:    ScenarioExpect{Auth: "NTLM", Status: http.StatusOK},
+	}
+	result := h.Run(scenario)
+	assert.True(t, result.Passed(), result.Failures)
+	dials, accepted := h.upstream.results()
+	require.NotNil(t, accepted)
+	assert.Equal(t, "svc-build", accepted.user)
+	// One connection for the CONNECT without credentials, one for the primary account's
+	// handshake and one for the fallback's.
+	assert.Equal(t, []string{"proxy.test:8080", "proxy.test:8080", "proxy.test:8080"}, dials)
+	// For a while, the fallback account is used straight away.
+	result = h.Run(scenario)
+	assert.True(t, result.Passed(), result.Failures)
+	dials, accepted = h.upstream.results()
+	require.NotNil(t, accepted)
+	assert.Equal(t, "svc-build", accepted.user)
+	assert.Len(t, dials, 2)
+}
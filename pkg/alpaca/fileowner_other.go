@@ -12,35 +12,19 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build !darwin
+//go:build !windows
 
-package main
+package alpaca
 
 import (
-	"fmt"
 	"os"
-
-	"github.com/samuong/go-ntlmssp"
-	ring "github.com/zalando/go-keyring"
+	"syscall"
 )
 
-type keyring struct{}
-
-func fromKeyring() *keyring {
-	return &keyring{}
-}
-
-func (k *keyring) getCredentials() (*authenticator, error) {
-
-	var (
-		username = os.Getenv("NTLM_USERNAME")
-		domain   = os.Getenv("NTLM_DOMAIN")
-	)
-
-	pwd, err := ring.Get("alpaca", username)
-	if err != nil {
-		return nil, fmt.Errorf("cannot get user secret from keyring: %w", err)
+// fileOwner returns the uid of the user that owns a file, if it's known.
+func fileOwner(info os.FileInfo) (int, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), true
 	}
-	hash := ntlmssp.GetNtlmHash(pwd)
-	return &authenticator{domain, username, hash}, nil
+	return 0, false
 }
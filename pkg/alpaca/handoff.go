@@ -0,0 +1,311 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package alpaca
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// When a new instance of Alpaca is started with -takeover, it connects to a unix socket that
+// the running instance listens on, and receives the running instance's listening sockets and
+// open tunnels (as file descriptors, using SCM_RIGHTS). This means that upgrading Alpaca
+// doesn't refuse any connections, or break long-lived tunnels (e.g. SSH or WebSockets).
+//
+// The listeners are sent first, so that the new instance can start accepting connections while
+// the running instance finishes the requests that it's already handling (which can take up to
+// drainTimeout). The tunnels are sent after that, since more of them can be opened until then.
+//
+// Messages are sent one at a time, and each one is acknowledged before the next is sent, so
+// that the receiver never has to deal with more than one message in a single read.
+
+type handoffMessage struct {
+	Kind string `json:"kind"` // One of "listener", "listeners-done", "tunnel" or "done"
+	Name string `json:"name,omitempty"`
+}
+
+var handoffAck = []byte("ok")
+
+// handoffProbeWait is how long to wait to find out whether a connection to the handoff socket is
+// from a new instance that's taking over, or just checking that this one is running.
+const handoffProbeWait = 100 * time.Millisecond
+
+// handoffSocketPath returns the path of the unix socket used to take over from an instance
+// that's listening on the given port.
+func handoffSocketPath(port int) (string, error) {
+	dir, err := runtimeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("alpaca-%d.sock", port)), nil
+}
+
+// listenForTakeover creates the handoff socket. If there's a stale socket left behind by an
+// instance that is no longer running, it is removed.
+func listenForTakeover(path string) (*net.UnixListener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another instance is listening on %s", path)
+	}
+	_ = os.Remove(path)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// Only the user running Alpaca should be able to take over its sockets.
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// handOver waits for a new instance to connect to the handoff socket, and sends it the given
+// listeners, which it starts using straight away. It then calls stop (which should stop the
+// servers using those listeners and wait for in-flight requests to finish), and sends all of the
+// open tunnels that can be detached.
+func handOver(l *net.UnixListener, listeners map[string]net.Listener, tunnels *tunnelTracker,
+	stop func()) error {
+	conn, err := acceptTakeover(l)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("New instance is taking over, handing over listeners and tunnels")
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, err := listenerFile(listeners[name])
+		if err != nil {
+			return fmt.Errorf("error getting file for listener %s: %w", name, err)
+		}
+		err = sendHandoffMessage(conn, handoffMessage{Kind: "listener", Name: name}, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := sendHandoffMessage(conn, handoffMessage{Kind: "listeners-done"}); err != nil {
+		return err
+	}
+	stop()
+	for _, t := range tunnels.list() {
+		client, server, err := t.detach()
+		if err != nil {
+			log.Printf("Couldn't hand over tunnel, closing it: %v", err)
+			continue
+		}
+		err = sendHandoffMessage(conn, handoffMessage{Kind: "tunnel"}, client, server)
+		client.Close()
+		server.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// Close the handoff socket (which removes it from the filesystem) before telling the new
+	// instance that we're done, so that we don't remove the new instance's socket.
+	l.Close()
+	return sendHandoffMessage(conn, handoffMessage{Kind: "done"})
+}
+
+// acceptTakeover waits for a new instance to connect to the handoff socket. Other instances (e.g.
+// ones sharing the port using -reuse-port) also connect to it, to check whether this instance is
+// running (see listenForTakeover), but they close the connection straight away, whereas a new
+// instance waits for the first message without sending anything. Those connections are ignored.
+func acceptTakeover(l *net.UnixListener) (*net.UnixConn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(handoffProbeWait))
+		if _, err := conn.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+			_ = conn.SetReadDeadline(time.Time{})
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+func listenerFile(l net.Listener) (*os.File, error) {
+	filer, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("listener isn't backed by a file descriptor")
+	}
+	return filer.File()
+}
+
+func sendHandoffMessage(conn *net.UnixConn, msg handoffMessage, files ...*os.File) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	if _, _, err := conn.WriteMsgUnix(buf, syscall.UnixRights(fds...), nil); err != nil {
+		return err
+	}
+	ack := make([]byte, len(handoffAck))
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("error reading acknowledgement: %w", err)
+	}
+	return nil
+}
+
+// takeOver connects to the handoff socket of a running instance, and receives its listeners,
+// which are returned (keyed by name) as soon as they've all been sent. Its open tunnels are sent
+// once it has finished handling its in-flight requests, and are received in the background and
+// relayed by tunnels. The returned channel gets the result of that, once the running instance has
+// removed its handoff socket (so that this instance can create its own).
+func takeOver(path string, tunnels *tunnelTracker) (map[string]net.Listener, <-chan error,
+	error) {
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	conn, err := net.DialUnix("unix", nil, addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't connect to running instance: %w", err)
+	}
+	listeners := make(map[string]net.Listener)
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for {
+		msg, files, err := receiveHandoffMessage(conn)
+		if err != nil {
+			conn.Close()
+			closeAll()
+			return nil, nil, err
+		}
+		switch {
+		case msg.Kind == "listener" && len(files) == 1:
+			l, err := net.FileListener(files[0])
+			files[0].Close()
+			if err != nil {
+				conn.Close()
+				closeAll()
+				return nil, nil, fmt.Errorf("error receiving listener %s: %w", msg.Name, err)
+			}
+			listeners[msg.Name] = l
+		case msg.Kind == "listeners-done":
+			log.Printf("Took over %d listener(s)", len(listeners))
+			done := make(chan error, 1)
+			go func() {
+				defer conn.Close()
+				done <- receiveTunnels(conn, tunnels)
+			}()
+			return listeners, done, nil
+		default:
+			closeFiles(files)
+			conn.Close()
+			closeAll()
+			return nil, nil, fmt.Errorf("unexpected handoff message: %+v", msg)
+		}
+	}
+}
+
+// receiveTunnels receives the tunnels sent by handOver, up to the final "done" message.
+func receiveTunnels(conn *net.UnixConn, tunnels *tunnelTracker) error {
+	count := 0
+	for {
+		msg, files, err := receiveHandoffMessage(conn)
+		if err != nil {
+			return err
+		}
+		switch {
+		case msg.Kind == "tunnel" && len(files) == 2:
+			client, err1 := net.FileConn(files[0])
+			server, err2 := net.FileConn(files[1])
+			files[0].Close()
+			files[1].Close()
+			if err := errors.Join(err1, err2); err != nil {
+				log.Printf("Error receiving tunnel: %v", err)
+				continue
+			}
+			tunnels.relay(client, server)
+			count++
+		case msg.Kind == "done":
+			log.Printf("Took over %d tunnel(s)", count)
+			return nil
+		default:
+			closeFiles(files)
+			return fmt.Errorf("unexpected handoff message: %+v", msg)
+		}
+	}
+}
+
+// receiveHandoffMessage reads a message and acknowledges it.
+func receiveHandoffMessage(conn *net.UnixConn) (handoffMessage, []*os.File, error) {
+	msg, files, err := readHandoffMessage(conn)
+	if err == nil {
+		_, err = conn.Write(handoffAck)
+	}
+	if err != nil {
+		closeFiles(files)
+		return msg, nil, err
+	}
+	return msg, files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func readHandoffMessage(conn *net.UnixConn) (handoffMessage, []*os.File, error) {
+	var msg handoffMessage
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(2*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return msg, nil, err
+	}
+	cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return msg, nil, err
+	}
+	var files []*os.File
+	for _, cmsg := range cmsgs {
+		fds, err := syscall.ParseUnixRights(&cmsg)
+		if err != nil {
+			return msg, nil, err
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "handoff"))
+		}
+	}
+	if err := json.Unmarshal(buf[:n], &msg); err != nil {
+		closeFiles(files)
+		return msg, nil, err
+	}
+	return msg, files, nil
+}
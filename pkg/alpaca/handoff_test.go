@@ -0,0 +1,125 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package alpaca
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandOver(t *testing.T) {
+	dir, err := os.MkdirTemp("", "alpaca")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handoff.sock")
+
+	// The old instance has a listener, and a tunnel between a client and a server.
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	serverSide, server := tcpPair(t)
+	defer server.Close()
+	oldTunnels := newTunnelTracker()
+	oldTunnels.relay(clientSide, serverSide)
+
+	hl, err := listenForTakeover(path)
+	require.NoError(t, err)
+	stopping := make(chan struct{})
+	drained := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		listeners := map[string]net.Listener{"http/tcp": listener}
+		done <- handOver(hl, listeners, oldTunnels, func() {
+			listener.Close()
+			close(stopping)
+			<-drained
+		})
+	}()
+
+	// Another instance checking whether this one is running doesn't make it hand over.
+	_, err = listenForTakeover(path)
+	require.Error(t, err)
+	select {
+	case <-stopping:
+		t.Fatal("old instance stopped before a new one took over")
+	default:
+	}
+
+	newTunnels := newTunnelTracker()
+	inherited, tookOver, err := takeOver(path, newTunnels)
+	require.NoError(t, err)
+
+	// The inherited listener should accept connections on the same address, while the old
+	// instance is still draining.
+	<-stopping
+	require.Contains(t, inherited, "http/tcp")
+	l := inherited["http/tcp"]
+	defer l.Close()
+	assert.Equal(t, listener.Addr().String(), l.Addr().String())
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	// Once it has drained, the tunnels are handed over.
+	close(drained)
+	require.NoError(t, <-done)
+	require.NoError(t, <-tookOver)
+	assert.Equal(t, 1, newTunnels.count())
+	oldTunnels.wait(0)
+	assert.Equal(t, 0, oldTunnels.count())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "handoff socket should have been removed")
+
+	// The tunnel should still relay data in both directions, now via the new instance.
+	_, err = client.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(server).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+	_, err = server.Write([]byte("pong\n"))
+	require.NoError(t, err)
+	line, err = bufio.NewReader(client).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "pong\n", line)
+}
+
+func TestListenForTakeoverRemovesStaleSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "alpaca")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handoff.sock")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	l, err := listenForTakeover(path)
+	require.NoError(t, err)
+	defer l.Close()
+	// A second instance can't listen on the same socket.
+	_, err = listenForTakeover(path)
+	assert.Error(t, err)
+}
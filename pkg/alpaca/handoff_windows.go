@@ -0,0 +1,44 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"errors"
+	"net"
+)
+
+// Passing sockets between processes isn't supported on Windows.
+var errHandoffNotSupported = errors.New(
+	"taking over from a running instance isn't supported on Windows")
+
+func handoffSocketPath(port int) (string, error) {
+	return "", nil
+}
+
+func listenForTakeover(path string) (*net.UnixListener, error) {
+	// Return a nil listener (rather than an error), so that we don't log an error every time
+	// Alpaca starts up on Windows.
+	return nil, nil
+}
+
+func handOver(l *net.UnixListener, listeners map[string]net.Listener, tunnels *tunnelTracker,
+	stop func()) error {
+	return errHandoffNotSupported
+}
+
+func takeOver(path string, tunnels *tunnelTracker) (map[string]net.Listener, <-chan error,
+	error) {
+	return nil, nil, errHandoffNotSupported
+}
@@ -0,0 +1,436 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// Scenario is a request to send through Alpaca (for "alpaca test", or a Harness), along with what
+// should happen to it. Scenario files hold a list of them, as JSON:
+//
+//	{"scenarios": [{"name": "...", "url": "...", "expect": {"proxy": "DIRECT"}}]}
+type Scenario struct {
+	Name   string            `json:"name"`
+	Method string            `json:"method,omitempty"` // GET, if not given (https uses CONNECT)
+	URL    string            `json:"url"`
+	Header map[string]string `json:"header,omitempty"`
+	// ProxyAuth is the auth schemes (NTLM, Negotiate, Basic or Digest) that the fake proxies ask
+	// for. By default, they don't ask for credentials.
+	ProxyAuth []string       `json:"proxyAuth,omitempty"`
+	Expect    ScenarioExpect `json:"expect"`
+}
+
+// ScenarioExpect is what should happen to a scenario's request. Fields that aren't given aren't
+// checked.
+type ScenarioExpect struct {
+	// Proxy is the proxy that the request should go to, as FindProxyForURL would return it
+	// (e.g. "DIRECT" or "PROXY proxy.example.com:8080").
+	Proxy string `json:"proxy,omitempty"`
+	// Auth is the scheme that Alpaca should authenticate to the proxy with, or "none".
+	Auth string `json:"auth,omitempty"`
+	// Status is the status of the response that the client should get.
+	Status int `json:"status,omitempty"`
+	// Header is the headers that the upstream should get (an empty value means none).
+	Header map[string]string `json:"header,omitempty"`
+}
+
+// ScenarioResult is the outcome of running a Scenario.
+type ScenarioResult struct {
+	Name     string
+	Proxy    string   // The proxy that Alpaca chose
+	Reasons  []string // The steps that led to choosing Proxy
+	Failures []string // How the outcome differed from what was expected
+}
+
+// Passed returns whether everything happened as the scenario expected.
+func (r ScenarioResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// LoadScenarios reads a scenario file.
+func LoadScenarios(path string) ([]Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Scenarios []Scenario `json:"scenarios"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, sc := range file.Scenarios {
+		u, err := url.Parse(sc.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: scenario %d has an invalid URL %q", path, i+1, sc.URL)
+		} else if sc.Name == "" {
+			file.Scenarios[i].Name = sc.URL
+		}
+	}
+	return file.Scenarios, nil
+}
+
+// Harness runs Alpaca's whole middleware chain, the same as it would run for a client, but with
+// a fake upstream instead of the network: every connection that Alpaca makes, to a proxy or
+// directly to a server, goes to the fake, which accepts any request (once it's authenticated, if
+// the scenario says so). This can be used to check a site's configuration (its PAC file, routing
+// rules, header rules and so on) before rolling it out.
+type Harness struct {
+	server   *http.Server
+	check    *selfCheck
+	upstream *fakeUpstream
+}
+
+// NewHarness returns a Harness for a server with the given configuration. Its Host, Port and Dial
+// aren't used, since the harness listens on a free port of its own, and connects to its fake
+// upstream instead of the network.
+func NewHarness(config Config) (*Harness, error) {
+	es, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	return newHarness(func(port int, dial dialFunc) *http.Server {
+		return createServer(es.config.Host, port, config.PACURLs, es.auth, es.tunnels,
+			serverOptions{pacRefresh: config.PACRefresh, dial: dial})
+	})
+}
+
+// newHarness listens on a free port, and serves requests using the server that newServer returns
+// for that port, which should make all of its outgoing connections using dial.
+func newHarness(newServer func(port int, dial dialFunc) *http.Server) (*Harness, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	upstream := &fakeUpstream{}
+	s := newServer(l.Addr().(*net.TCPAddr).Port, upstream.dial)
+	go func() { _ = s.Serve(l) }()
+	h := &Harness{
+		server:   s,
+		check:    newSelfCheck(l.Addr().String(), io.Discard),
+		upstream: upstream,
+	}
+	return h, nil
+}
+
+// Close stops the server, closing its listener and connections.
+func (h *Harness) Close() error {
+	return h.server.Close()
+}
+
+// Run sends the scenario's request through Alpaca, and checks what happened to it.
+func (h *Harness) Run(sc Scenario) ScenarioResult {
+	result := ScenarioResult{Name: sc.Name}
+	failf := func(format string, args ...interface{}) {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+	}
+	u, err := url.Parse(sc.URL)
+	if err != nil {
+		failf("invalid URL: %v", err)
+		return result
+	}
+	var route extensionRoute
+	if err := h.check.getJSON("/alpaca/api/route?url="+url.QueryEscape(sc.URL), &route); err != nil {
+		failf("couldn't find a proxy: %v", err)
+		return result
+	}
+	result.Proxy, result.Reasons = route.Proxy, route.Reasons
+	if want := sc.Expect.Proxy; want != "" && !strings.EqualFold(want, route.Proxy) {
+		failf("expected proxy %q, got %q", want, route.Proxy)
+	}
+
+	h.upstream.reset(sc.ProxyAuth)
+	req, err := probeRequest(cmp.Or(sc.Method, http.MethodGet), u)
+	if err != nil {
+		failf("invalid request: %v", err)
+		return result
+	}
+	for name, value := range sc.Header {
+		req.Header.Set(name, value)
+	}
+	resp, err := sendThrough(h.check.proxyAddr, req)
+	if err != nil {
+		failf("couldn't send the request through Alpaca: %v", err)
+		return result
+	}
+	if req.Method != http.MethodConnect {
+		// Nothing is sent through a tunnel, so there's nothing to wait for.
+		_, _ = io.Copy(io.Discard, resp.Body)
+	}
+	resp.Body.Close()
+	if want := sc.Expect.Status; want != 0 && want != resp.StatusCode {
+		failf("expected status %d, got %s", want, resp.Status)
+	}
+
+	dials, accepted := h.upstream.results()
+	if want := sc.Expect.Proxy; want != "" && strings.EqualFold(want, route.Proxy) {
+		addr := upstreamAddr(route.Proxy, u)
+		if !slices.Contains(dials, addr) && (accepted == nil || accepted.addr != addr) {
+			failf("expected a connection to %s, but Alpaca didn't make one", addr)
+		}
+	}
+	if want := sc.Expect.Auth; want != "" {
+		got := "none"
+		if accepted != nil && accepted.auth != "" {
+			got = accepted.auth
+		}
+		if !strings.EqualFold(want, got) {
+			failf("expected auth %q, got %q", want, got)
+		}
+	}
+	for name, want := range sc.Expect.Header {
+		if accepted == nil {
+			failf("expected header %s, but the upstream didn't get a request", name)
+			continue
+		}
+		if got := accepted.header.Get(name); got != want {
+			failf("expected header %s: %q, got %q", name, want, got)
+		}
+	}
+	return result
+}
+
+// upstreamAddr returns the address that Alpaca should connect to for u, using proxy (as
+// FindProxyForURL would return it).
+func upstreamAddr(proxy string, u *url.URL) string {
+	if _, host, ok := strings.Cut(proxy, " "); ok {
+		return strings.TrimSpace(host)
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// runScenarios runs the scenarios in each file against a server from newServer (see newHarness),
+// for "alpaca test", and prints the results (and a summary) to out. It returns whether every
+// scenario passed.
+func runScenarios(newServer func(port int, dial dialFunc) *http.Server, paths []string,
+	out io.Writer) (bool, error) {
+	if len(paths) == 0 {
+		return false, errors.New("usage: alpaca test [flags] scenarios.json...")
+	}
+	var scenarios []Scenario
+	for _, path := range paths {
+		loaded, err := LoadScenarios(path)
+		if err != nil {
+			return false, err
+		}
+		scenarios = append(scenarios, loaded...)
+	}
+	h, err := newHarness(newServer)
+	if err != nil {
+		return false, err
+	}
+	defer h.Close()
+	failures := 0
+	for _, sc := range scenarios {
+		result := h.Run(sc)
+		if result.Passed() {
+			fmt.Fprintf(out, "PASS  %s (%s)\n", result.Name, result.Proxy)
+			continue
+		}
+		failures++
+		fmt.Fprintf(out, "FAIL  %s\n", result.Name)
+		for _, failure := range result.Failures {
+			fmt.Fprintf(out, "      %s\n", failure)
+		}
+		for _, reason := range result.Reasons {
+			fmt.Fprintf(out, "        - %s\n", reason)
+		}
+	}
+	if failures == 0 {
+		fmt.Fprintf(out, "\nAll %d scenarios passed\n", len(scenarios))
+	} else {
+		fmt.Fprintf(out, "\n%d of %d scenarios failed\n", failures, len(scenarios))
+	}
+	return failures == 0, nil
+}
+
+// An NTLM Type 2 (Challenge) message, as sent by a proxy.
+const ntlmChallenge = "NTLM TlRMTVNTUAACAAAADAAMADgAAAAFgomi+Rp9UDbAycMAAAAAAAAAAKIAogBEAAAABgE" +
+	"AAAAAAA9HAEwATwBCAEEATAACAAwARwBMAE8AQgBBAEwAAQAeAFAAWABZAEEAVQAwADAAMgBNAEUATAAwADEAMAA" +
+	"zAAQAHABnAGwAbwBiAGEAbAAuAGEAbgB6AC4AYwBvAG0AAwA8AHAAeAB5AGEAdQAwADAAMgBtAGUAbAAwADEAMAA" +
+	"zAC4AZwBsAG8AYgBhAGwALgBhAG4AegAuAGMAbwBtAAcACABQ7ZOkOQbVAQAAAAA="
+
+// fakeUpstream is a Harness's stand-in for every proxy and server. It records the addresses that
+// Alpaca connects to, and the last request that it accepted.
+type fakeUpstream struct {
+	mux      sync.Mutex
+	schemes  []string // The auth schemes that proxy requests need
+	rejected []string // Users whose NTLM credentials are rejected (e.g. locked accounts)
+	dials    []string
+	accepted *upstreamRequest
+}
+
+type upstreamRequest struct {
+	addr   string // The address that Alpaca connected to
+	auth   string // The scheme that the request was authenticated with, if any
+	user   string // The user that the request was authenticated as, for NTLM
+	header http.Header
+}
+
+func (f *fakeUpstream) reset(schemes []string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.schemes, f.dials, f.accepted = schemes, nil, nil
+}
+
+func (f *fakeUpstream) results() ([]string, *upstreamRequest) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return slices.Clone(f.dials), f.accepted
+}
+
+func (f *fakeUpstream) dial(_ context.Context, _, address string) (net.Conn, error) {
+	f.mux.Lock()
+	f.dials = append(f.dials, address)
+	f.mux.Unlock()
+	client, server := net.Pipe()
+	go f.serve(server, address)
+	return client, nil
+}
+
+// serve responds to the requests on a connection. It stops after a CONNECT request succeeds,
+// since the harness doesn't send anything through the tunnel, and after rejecting credentials,
+// like many proxies do.
+func (f *fakeUpstream) serve(conn net.Conn, addr string) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, req.Body)
+		resp := f.respond(req, addr)
+		err = resp.Write(conn)
+		if err != nil || resp.Close ||
+			(req.Method == http.MethodConnect && resp.StatusCode == http.StatusOK) {
+			return
+		}
+	}
+}
+
+func (f *fakeUpstream) respond(req *http.Request, addr string) *http.Response {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	proxied := req.Method == http.MethodConnect || req.URL.IsAbs()
+	scheme, token, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !proxied || len(f.schemes) == 0 {
+		scheme = ""
+	} else if !slices.ContainsFunc(f.schemes, func(s string) bool {
+		return strings.EqualFold(s, scheme)
+	}) {
+		resp.StatusCode = http.StatusProxyAuthRequired
+		for _, s := range f.schemes {
+			resp.Header.Add("Proxy-Authenticate", authOffer(s))
+		}
+		return resp
+	} else if isNTLMNegotiate(scheme, token) {
+		resp.StatusCode = http.StatusProxyAuthRequired
+		challenge := strings.TrimPrefix(ntlmChallenge, "NTLM ")
+		resp.Header.Set("Proxy-Authenticate", scheme+" "+challenge)
+		return resp
+	}
+	user := ntlmUser(scheme, token)
+	if user != "" && slices.Contains(f.rejected, user) {
+		resp.StatusCode = http.StatusProxyAuthRequired
+		resp.Close = true
+		for _, s := range f.schemes {
+			resp.Header.Add("Proxy-Authenticate", authOffer(s))
+		}
+		return resp
+	}
+	f.accepted = &upstreamRequest{addr: addr, auth: scheme, user: user, header: req.Header.Clone()}
+	return resp
+}
+
+// authOffer returns the Proxy-Authenticate header that a fake proxy sends for a scheme.
+func authOffer(scheme string) string {
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return `Basic realm="alpaca test"`
+	case "digest":
+		return `Digest realm="alpaca test", nonce="alpaca", qop="auth"`
+	}
+	return scheme
+}
+
+// isNTLMNegotiate returns whether a Proxy-Authorization header holds an NTLM Type 1 (Negotiate)
+// message, which the proxy responds to with a challenge.
+func isNTLMNegotiate(scheme, token string) bool {
+	if !strings.EqualFold(scheme, "NTLM") && !strings.EqualFold(scheme, "Negotiate") {
+		return false
+	}
+	msg, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	return err == nil && len(msg) >= 12 && string(msg[:8]) == "NTLMSSP\x00" && msg[8] == 1
+}
+
+// ntlmUser returns the user name in a Proxy-Authorization header that holds an NTLM Type 3
+// (Authenticate) message, or "" if it doesn't hold one.
+func ntlmUser(scheme, token string) string {
+	if !strings.EqualFold(scheme, "NTLM") && !strings.EqualFold(scheme, "Negotiate") {
+		return ""
+	}
+	msg, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil || len(msg) < 64 || string(msg[:8]) != "NTLMSSP\x00" || msg[8] != 3 {
+		return ""
+	}
+	// The user name's length and offset are at bytes 36 and 40, and it's UTF-16 if the
+	// NTLMSSP_NEGOTIATE_UNICODE flag is set.
+	length := int(binary.LittleEndian.Uint16(msg[36:]))
+	offset := int(binary.LittleEndian.Uint32(msg[40:]))
+	if offset > len(msg) || length > len(msg)-offset {
+		return ""
+	}
+	name := msg[offset : offset+length]
+	if binary.LittleEndian.Uint32(msg[60:])&1 == 0 {
+		return string(name)
+	}
+	units := make([]uint16, len(name)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(name[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
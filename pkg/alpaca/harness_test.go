@@ -0,0 +1,201 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHarness(t *testing.T, username string) *Harness {
+	pacServer := httptest.NewServer(pacjsHandler(`function FindProxyForURL(url, host) {
+		return dnsDomainIs(host, ".corp.test") ? "DIRECT" : "PROXY proxy.test:8080";
+	}`))
+	t.Cleanup(pacServer.Close)
+	h, err := NewHarness(Config{
+		PACURLs:  []string{pacServer.URL},
+		Domain:   "ACME",
+		Username: username,
+		Password: "guest",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestHarness(t *testing.T) {
+	h := newTestHarness(t, "malory")
+	tests := []struct {
+		name     string
+		scenario Scenario
+		failures []string
+	}{
+		{"Direct", Scenario{
+			URL:    "http://wiki.corp.test/",
+			Header: map[string]string{"X-Test": "yes"},
+			Expect: ScenarioExpect{Proxy: "DIRECT", Auth: "none", Status: http.StatusOK,
+				Header: map[string]string{"X-Test": "yes"}},
+		}, nil},
+		{"NTLM", Scenario{
+			URL:       "http://www.example.com/",
+			ProxyAuth: []string{"NTLM"},
+			Expect:    ScenarioExpect{Proxy: "PROXY proxy.test:8080", Auth: "NTLM", Status: 200},
+		}, nil},
+		{"NTLMConnect", Scenario{
+			URL:       "https://www.example.com/",
+			ProxyAuth: []string{"NTLM"},
+			Expect:    ScenarioExpect{Proxy: "PROXY proxy.test:8080", Auth: "NTLM", Status: 200},
+		}, nil},
+		{"BasicConnect", Scenario{
+			URL:       "https://www.example.com/",
+			ProxyAuth: []string{"Basic"},
+			Expect:    ScenarioExpect{Proxy: "PROXY proxy.test:8080", Auth: "Basic", Status: 200},
+		}, nil},
+		{"DirectConnect", Scenario{
+			URL:    "https://wiki.corp.test/",
+			Expect: ScenarioExpect{Proxy: "DIRECT", Status: http.StatusOK},
+		}, nil},
+		{"WrongProxy", Scenario{
+			URL:    "http://www.example.com/",
+			Expect: ScenarioExpect{Proxy: "DIRECT", Auth: "NTLM"},
+		}, []string{
+			`expected proxy "DIRECT", got "PROXY proxy.test:8080"`,
+			`expected auth "NTLM", got "none"`,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := h.Run(test.scenario)
+			assert.Equal(t, test.failures, result.Failures)
+			assert.NotEmpty(t, result.Reasons)
+		})
+	}
+}
+
+func TestHarnessWithoutCredentials(t *testing.T) {
+	h := newTestHarness(t, "")
+	result := h.Run(Scenario{
+		URL:       "http://www.example.com/",
+		ProxyAuth: []string{"NTLM"},
+		Expect:    ScenarioExpect{Auth: "NTLM"},
+	})
+	assert.Equal(t, []string{`expected auth "NTLM", got "none"`}, result.Failures)
+	result = h.Run(Scenario{
+		URL:       "http://www.example.com/",
+		ProxyAuth: []string{"NTLM"},
+		Expect:    ScenarioExpect{Status: http.StatusProxyAuthRequired},
+	})
+	assert.True(t, result.Passed(), result.Failures)
+}
+
+func TestHarnessesAreIndependent(t *testing.T) {
+	// Each harness only sends its own server's connections to its fake upstream, so more than
+	// one can be open at once, alongside servers that use the network.
+	first := newTestHarness(t, "malory")
+	second := newTestHarness(t, "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("real"))
+	}))
+	defer server.Close()
+	pacServer := httptest.NewServer(pacjsHandler(`function FindProxyForURL(url, host) {
+		return "DIRECT";
+	}`))
+	defer pacServer.Close()
+	s, err := New(Config{Host: "127.0.0.1", PACURLs: []string{pacServer.URL}})
+	require.NoError(t, err)
+	require.NoError(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	scenario := Scenario{URL: "http://www.example.com/", ProxyAuth: []string{"NTLM"}}
+	scenario.Expect = ScenarioExpect{Auth: "NTLM", Status: http.StatusOK}
+	assert.True(t, first.Run(scenario).Passed())
+	scenario.Expect = ScenarioExpect{Auth: "none", Status: http.StatusProxyAuthRequired}
+	assert.True(t, second.Run(scenario).Passed())
+	proxyURL, err := url.Parse("http://" + s.Addr().String())
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	status, body := getBody(t, client, server.URL)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "real", body)
+}
+
+func TestHarnessServesPACForItsOwnPort(t *testing.T) {
+	h := newTestHarness(t, "")
+	resp, err := http.Get("http://" + h.check.proxyAddr + "/alpaca.pac")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	pac, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(h.check.proxyAddr)
+	require.NoError(t, err)
+	assert.Contains(t, string(pac), `"PROXY localhost:`+port+`"`)
+}
+
+func TestHarnessClose(t *testing.T) {
+	h := newTestHarness(t, "")
+	require.NoError(t, h.Close())
+	result := h.Run(Scenario{URL: "http://www.example.com/"})
+	assert.False(t, result.Passed())
+}
+
+func TestRunScenarios(t *testing.T) {
+	pacServer := httptest.NewServer(pacjsHandler(`function FindProxyForURL(url, host) {
+		return "PROXY proxy.test:8080";
+	}`))
+	defer pacServer.Close()
+	path := filepath.Join(t.TempDir(), "scenarios.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"scenarios": [
+		{"name": "proxied", "url": "http://www.example.com/",
+			"expect": {"proxy": "PROXY proxy.test:8080"}},
+		{"url": "http://wiki.corp.test/", "expect": {"proxy": "DIRECT"}}
+	]}`), 0600))
+	newServer := func(port int, dial dialFunc) *http.Server {
+		return createServer("localhost", port, []string{pacServer.URL}, nil, newTunnelTracker(),
+			serverOptions{dial: dial})
+	}
+	var out strings.Builder
+	passed, err := runScenarios(newServer, []string{path}, &out)
+	require.NoError(t, err)
+	assert.False(t, passed)
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(t, "PASS  proxied (PROXY proxy.test:8080)", lines[0])
+	assert.Equal(t, "FAIL  http://wiki.corp.test/", lines[1])
+	assert.Equal(t, `      expected proxy "DIRECT", got "PROXY proxy.test:8080"`, lines[2])
+	assert.Contains(t, out.String(), "\n1 of 2 scenarios failed\n")
+}
+
+func TestLoadScenarios(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"unknown.json": `{"scenarios": [{"url": "http://a.test/", "expct": {}}]}`,
+		"badurl.json":  `{"scenarios": [{"url": "ftp://a.test/"}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		_, err := LoadScenarios(path)
+		assert.Error(t, err, name)
+	}
+}
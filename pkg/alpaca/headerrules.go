@@ -0,0 +1,210 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+// How often the -header-rules file is checked for changes.
+const headerRulesCheckInterval = 5 * time.Second
+
+// headerRule adds, replaces or removes a request or response header, for hosts that match a
+// pattern.
+type headerRule struct {
+	pattern  string
+	glob     glob.Glob
+	response bool   // Whether the rule applies to responses rather than requests
+	action   string // "add", "set" or "remove"
+	name     string
+	value    string
+}
+
+// headerRules are the rules in the -header-rules file, one per line, each of which is a host
+// pattern (as for shExpMatch), an action, a header name, and (except for removals) a value, e.g.
+// "*.corp.example.com request-remove X-Client-Tracking" or "api.example.com request-set
+// Authorization Bearer 0123". The actions are request-add, request-set, request-remove,
+// response-add, response-set and response-remove. Every matching rule is applied, in order.
+//
+// Alpaca only sees the headers of plain HTTP requests (including WebSocket upgrades), so the
+// rules don't apply to HTTPS requests, which are tunnelled. The file is reloaded when it changes.
+type headerRules struct {
+	path    string
+	modTime time.Time
+	checked time.Time
+	rules   []headerRule
+	now     func() time.Time
+	mux     sync.Mutex
+}
+
+// headerRewrites are the rules given by -header-rules, or nil if there aren't any.
+var headerRewrites *headerRules
+
+func newHeaderRules(path string) (*headerRules, error) {
+	hr := &headerRules{path: path, now: time.Now}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := hr.load(info.ModTime()); err != nil {
+		return nil, fmt.Errorf("error loading -header-rules file %s: %w", path, err)
+	}
+	return hr, nil
+}
+
+// load reads the file, which was last modified at modTime.
+func (hr *headerRules) load(modTime time.Time) error {
+	buf, err := os.ReadFile(hr.path)
+	if err != nil {
+		return err
+	}
+	rules, err := parseHeaderRules(buf)
+	if err != nil {
+		return err
+	}
+	hr.modTime, hr.rules = modTime, rules
+	return nil
+}
+
+func parseHeaderRules(buf []byte) ([]headerRule, error) {
+	var rules []headerRule
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; scanner.Scan(); n++ {
+		// Only whole lines can be comments, since values (e.g. URLs) can contain a '#'.
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected a host pattern, an action and a header", n)
+		}
+		g, err := glob.Compile(asciiPattern(strings.ToLower(fields[0])))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid host pattern %q: %w", n, fields[0], err)
+		}
+		rule := headerRule{pattern: fields[0], glob: g, name: http.CanonicalHeaderKey(fields[2])}
+		direction, action, _ := strings.Cut(fields[1], "-")
+		switch direction {
+		case "request":
+		case "response":
+			rule.response = true
+		default:
+			return nil, fmt.Errorf("line %d: invalid action %q", n, fields[1])
+		}
+		switch action {
+		case "add", "set":
+			// The value is the rest of the line, which may contain spaces.
+			value := line
+			for _, field := range fields[:3] {
+				value = strings.TrimSpace(strings.TrimPrefix(value, field))
+			}
+			if value == "" {
+				return nil, fmt.Errorf("line %d: %s needs a value", n, fields[1])
+			}
+			rule.value = value
+		case "remove":
+			if len(fields) > 3 {
+				return nil, fmt.Errorf("line %d: %s doesn't take a value", n, fields[1])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: invalid action %q", n, fields[1])
+		}
+		if isHopByHopHeader(rule.name) {
+			return nil, fmt.Errorf("line %d: %s is a hop-by-hop header", n, rule.name)
+		}
+		rule.action = action
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// isHopByHopHeader returns whether a header is only meant for the next hop, so that rewriting
+// it would interfere with Alpaca's own connections (and any rewrite would be undone anyway).
+func isHopByHopHeader(name string) bool {
+	switch name {
+	case "Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+		"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade":
+		return true
+	}
+	return false
+}
+
+// reloadIfChanged reloads the file if it has changed since it was last loaded. If it can't be
+// loaded, the previous version is kept.
+func (hr *headerRules) reloadIfChanged() {
+	now := hr.now()
+	if now.Sub(hr.checked) < headerRulesCheckInterval {
+		return
+	}
+	hr.checked = now
+	info, err := os.Stat(hr.path)
+	if err != nil {
+		log.Printf("Error checking -header-rules file: %v", err)
+		return
+	} else if info.ModTime().Equal(hr.modTime) {
+		return
+	}
+	if err := hr.load(info.ModTime()); err != nil {
+		log.Printf("Not using changed -header-rules file %s: %v", hr.path, err)
+		return
+	}
+	log.Printf("Reloaded -header-rules file %s", hr.path)
+}
+
+// rewriteRequest applies the request rules for the request's host to its headers.
+func (hr *headerRules) rewriteRequest(req *http.Request) {
+	if hr != nil {
+		hr.apply(req.URL.Hostname(), false, req.Header)
+	}
+}
+
+// rewriteResponse applies the response rules for the request's host to the response headers
+// that are being sent to the client.
+func (hr *headerRules) rewriteResponse(req *http.Request, header http.Header) {
+	if hr != nil && req != nil {
+		hr.apply(req.URL.Hostname(), true, header)
+	}
+}
+
+func (hr *headerRules) apply(hostname string, response bool, header http.Header) {
+	hr.mux.Lock()
+	defer hr.mux.Unlock()
+	hr.reloadIfChanged()
+	host := canonicalHost(hostname)
+	for _, rule := range hr.rules {
+		if rule.response != response || !rule.glob.Match(host) {
+			continue
+		}
+		switch rule.action {
+		case "add":
+			header.Add(rule.name, rule.value)
+		case "set":
+			header.Set(rule.name, rule.value)
+		case "remove":
+			header.Del(rule.name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeHeaderRules(t *testing.T, rules string) string {
+	path := filepath.Join(t.TempDir(), "headers.txt")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0644))
+	return path
+}
+
+func TestParseHeaderRules(t *testing.T) {
+	rules, err := parseHeaderRules([]byte(`# Strip tracking headers
+*.corp.test request-remove x-client-tracking
+api.test    request-set    Authorization   Bearer abc#123
+*           response-add   X-Via-Alpaca yes
+`))
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+	assert.Equal(t, "X-Client-Tracking", rules[0].name)
+	assert.Equal(t, "remove", rules[0].action)
+	assert.Equal(t, "Bearer abc#123", rules[1].value)
+	assert.True(t, rules[2].response)
+
+	for _, bad := range []string{
+		"api.test request-set Authorization",
+		"api.test request-remove X-Foo bar",
+		"api.test request-rename X-Foo",
+		"api.test both-set X-Foo bar",
+		"api.test request-remove",
+		"api.test request-set Proxy-Authorization Basic abc",
+	} {
+		_, err := parseHeaderRules([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestHeaderRewriting(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Tracking", "1")
+		w.Header().Set("X-Keep", "1")
+		_, _ = io.WriteString(w, req.Header.Get("Authorization")+"/"+req.Header.Get("X-Client"))
+	}))
+	defer server.Close()
+	proxy := httptest.NewServer(newDirectProxy())
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	path := writeHeaderRules(t, `127.0.0.1 request-set Authorization Bearer abc
+127.0.0.1 request-remove X-Client
+127.0.0.1 response-remove X-Tracking
+*.test response-remove X-Keep
+`)
+	hr, err := newHeaderRules(path)
+	require.NoError(t, err)
+	saved := headerRewrites
+	headerRewrites = hr
+	t.Cleanup(func() { headerRewrites = saved })
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Client", "secret")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer abc/", string(body))
+	assert.Empty(t, resp.Header.Get("X-Tracking"))
+	assert.Equal(t, "1", resp.Header.Get("X-Keep"))
+}
+
+func TestHeaderRulesReload(t *testing.T) {
+	path := writeHeaderRules(t, "*.test request-set X-Token one")
+	hr, err := newHeaderRules(path)
+	require.NoError(t, err)
+	now := time.Now()
+	hr.now = func() time.Time { return now }
+	token := func() string {
+		req := httptest.NewRequest(http.MethodGet, "http://api.test/", nil)
+		hr.rewriteRequest(req)
+		return req.Header.Get("X-Token")
+	}
+	assert.Equal(t, "one", token())
+
+	require.NoError(t, os.WriteFile(path, []byte("*.test request-set X-Token two"), 0644))
+	require.NoError(t, os.Chtimes(path, now, now.Add(time.Minute)))
+	assert.Equal(t, "one", token(), "shouldn't reload before the check interval")
+	now = now.Add(headerRulesCheckInterval)
+	assert.Equal(t, "two", token())
+
+	// A broken file is ignored, and the last good version is kept.
+	require.NoError(t, os.WriteFile(path, []byte("*.test request-set X-Token"), 0644))
+	require.NoError(t, os.Chtimes(path, now, now.Add(2*time.Minute)))
+	now = now.Add(headerRulesCheckInterval)
+	assert.Equal(t, "two", token())
+}
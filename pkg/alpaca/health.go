@@ -0,0 +1,178 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the proxies in health rules are checked.
+	healthCheckInterval = 30 * time.Second
+	// How long to wait for a connection to a proxy, before deciding that it's down.
+	healthCheckTimeout = 5 * time.Second
+)
+
+// healthRule replaces the PAC file (and any routing rules) with a fixed result once a proxy has
+// been unreachable for a while, e.g. "proxy.example.com:8080 down 5m DIRECT". It stops applying
+// once the proxy is reachable again.
+type healthRule struct {
+	proxy  string        // The proxy to check, as host:port
+	after  time.Duration // How long the proxy needs to be down for
+	result string        // A PAC-style result, e.g. "PROXY backup.example.com:8080" or "DIRECT"
+}
+
+func (r healthRule) String() string {
+	return fmt.Sprintf("%s down %v %s", r.proxy, r.after, r.result)
+}
+
+// parseHealthRules parses the -health-rule flag, which is a comma-separated list of rules.
+func parseHealthRules(value string) ([]healthRule, error) {
+	var rules []healthRule
+	for _, elem := range strings.Split(value, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		fields := strings.Fields(elem)
+		if len(fields) < 4 || fields[1] != "down" {
+			return nil, fmt.Errorf("invalid health rule %q (expected <host:port> down "+
+				"<duration> <proxy>)", elem)
+		}
+		if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+			return nil, fmt.Errorf("invalid proxy in health rule %q: %w", elem, err)
+		}
+		after, err := parseDuration(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration in health rule %q: %w", elem, err)
+		}
+		result := strings.Join(fields[3:], " ")
+		if err := validatePACResult(result); err != nil {
+			return nil, fmt.Errorf("invalid proxy in health rule %q: %w", elem, err)
+		}
+		rules = append(rules, healthRule{fields[0], after, result})
+	}
+	return rules, nil
+}
+
+// healthChecker periodically checks whether the proxies in the health rules can be connected to,
+// and keeps track of which rule (if any) currently applies. This automates switching to a backup
+// proxy (or going direct) during a proxy outage.
+type healthChecker struct {
+	rules     []healthRule
+	dial      dialFunc
+	now       func() time.Time
+	downSince map[string]time.Time
+	active    *healthRule
+	mux       sync.Mutex
+}
+
+func newHealthChecker(rules []healthRule) *healthChecker {
+	return &healthChecker{
+		rules:     rules,
+		dial:      dialNAT64,
+		now:       time.Now,
+		downSince: make(map[string]time.Time),
+	}
+}
+
+// start checks the proxies now, and then every healthCheckInterval, in the background.
+func (hc *healthChecker) start() {
+	go func() {
+		hc.check()
+		for range time.Tick(healthCheckInterval) {
+			hc.check()
+		}
+	}()
+}
+
+func (hc *healthChecker) check() {
+	up := make(map[string]bool)
+	for _, rule := range hc.rules {
+		if _, ok := up[rule.proxy]; !ok {
+			up[rule.proxy] = hc.probe(rule.proxy)
+		}
+	}
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	now := hc.now()
+	for proxy, ok := range up {
+		since, wasDown := hc.downSince[proxy]
+		if ok && wasDown {
+			log.Printf("Proxy %s is reachable again (after %v)", proxy, now.Sub(since))
+			delete(hc.downSince, proxy)
+		} else if !ok && !wasDown {
+			log.Printf("Proxy %s is unreachable", proxy)
+			hc.downSince[proxy] = now
+		}
+	}
+	var active *healthRule
+	for i, rule := range hc.rules {
+		if since, ok := hc.downSince[rule.proxy]; ok && now.Sub(since) >= rule.after {
+			active = &hc.rules[i]
+			break
+		}
+	}
+	if active != hc.active {
+		if active != nil {
+			log.Printf("Applying health rule %q", active)
+		} else {
+			log.Printf("Health rule %q no longer applies", hc.active)
+		}
+		hc.active = active
+	}
+}
+
+func (hc *healthChecker) probe(proxy string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	conn, err := hc.dial(ctx, "tcp", proxy)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// status returns the proxies that are down (and since when), and the rule that currently
+// applies (or "" if none does).
+func (hc *healthChecker) status() (map[string]time.Time, string) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	down := make(map[string]time.Time, len(hc.downSince))
+	for proxy, since := range hc.downSince {
+		down[proxy] = since
+	}
+	if hc.active == nil {
+		return down, ""
+	}
+	return down, hc.active.String()
+}
+
+// activeRule returns the rule that currently applies, if any.
+func (hc *healthChecker) activeRule() (healthRule, bool) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	if hc.active == nil {
+		return healthRule{}, false
+	}
+	return *hc.active, true
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHealthRules(t *testing.T) {
+	rules, err := parseHealthRules(
+		"proxy.test:8080 down 5m DIRECT, proxy.test:8080 down 1m PROXY backup.test:80; DIRECT")
+	require.NoError(t, err)
+	assert.Equal(t, []healthRule{
+		{"proxy.test:8080", 5 * time.Minute, "DIRECT"},
+		{"proxy.test:8080", time.Minute, "PROXY backup.test:80; DIRECT"},
+	}, rules)
+	for _, value := range []string{
+		"proxy.test:8080 down 5m",
+		"proxy.test:8080 up 5m DIRECT",
+		"proxy.test down 5m DIRECT",
+		"proxy.test:8080 down forever DIRECT",
+		"proxy.test:8080 down 5m SOCKS socks.test:1080",
+		"proxy.test:8080 down 5m PROXY",
+		"proxy.test:8080 down 5m PROXY backup.test:80; HTTPS",
+		"proxy.test:8080 down 5m DIRECT backup.test:80",
+	} {
+		_, err := parseHealthRules(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func newTestHealthChecker(t *testing.T, value string) (*healthChecker, map[string]bool,
+	*time.Time) {
+	rules, err := parseHealthRules(value)
+	require.NoError(t, err)
+	hc := newHealthChecker(rules)
+	up := make(map[string]bool)
+	hc.dial = func(_ context.Context, _, address string) (net.Conn, error) {
+		if !up[address] {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	hc.now = func() time.Time { return now }
+	return hc, up, &now
+}
+
+func TestHealthRuleApplies(t *testing.T) {
+	hc, up, now := newTestHealthChecker(t, "a.test:80 down 5m PROXY b.test:80, "+
+		"b.test:80 down 1m DIRECT")
+	up["a.test:80"], up["b.test:80"] = true, true
+	hc.check()
+	_, ok := hc.activeRule()
+	assert.False(t, ok)
+
+	// A proxy that has only just gone down doesn't trigger a rule.
+	up["a.test:80"] = false
+	hc.check()
+	_, ok = hc.activeRule()
+	assert.False(t, ok)
+	*now = now.Add(5 * time.Minute)
+	hc.check()
+	rule, ok := hc.activeRule()
+	require.True(t, ok)
+	assert.Equal(t, "PROXY b.test:80", rule.result)
+
+	// Once the proxy is back up, the rule no longer applies.
+	up["a.test:80"] = true
+	hc.check()
+	_, ok = hc.activeRule()
+	assert.False(t, ok)
+}
+
+func TestHealthRuleOverridesPAC(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "PROXY proxy.test:80" }`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer server.Close()
+	pw := NewPACWrapper(PACData{Port: 1})
+	pf := NewProxyFinder([]string{server.URL}, pw, myIPAuto)
+	hc, _, now := newTestHealthChecker(t, "proxy.test:80 down 1m DIRECT")
+	pf.health = hc
+	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
+	hc.check()
+	proxy, err := pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	require.NotNil(t, proxy)
+	assert.Equal(t, "proxy.test:80", proxy.Host)
+	*now = now.Add(time.Minute)
+	hc.check()
+	proxy, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Nil(t, proxy)
+}
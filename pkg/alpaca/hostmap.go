@@ -0,0 +1,75 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hostMap maps host names to other addresses (e.g. a production host name to a staging server),
+// for testing. Requests to a mapped host always go directly, and connect to the other address,
+// but are otherwise unchanged: the Host header and (for HTTPS) the TLS server name are still the
+// original host's. A rule can map all of a host's ports ("api.example.com=staging.test"), or
+// just one ("api.example.com:443=staging.test:8443"). If the other address doesn't have a port,
+// the request's port is used.
+type hostMap struct {
+	rules map[string]string
+}
+
+// hostMappings is used for all outgoing connections. It's set by main, using the -map-host flag.
+var hostMappings *hostMap
+
+func parseHostMap(value string) (*hostMap, error) {
+	hm := &hostMap{rules: make(map[string]string)}
+	for _, elem := range strings.Split(value, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(elem, "=")
+		from, to = strings.ToLower(strings.TrimSpace(from)), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid host mapping %q (expected host=address)", elem)
+		} else if _, ok := hm.rules[from]; ok {
+			return nil, fmt.Errorf("host %q is mapped more than once", from)
+		}
+		hm.rules[from] = to
+	}
+	return hm, nil
+}
+
+// lookup returns the address to connect to instead of address (a host and port), if it's mapped.
+func (hm *hostMap) lookup(address string) (string, bool) {
+	if hm == nil || len(hm.rules) == 0 {
+		return "", false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	to, ok := hm.rules[net.JoinHostPort(host, port)]
+	if !ok {
+		if to, ok = hm.rules[host]; !ok {
+			return "", false
+		}
+	}
+	if _, _, err := net.SplitHostPort(to); err != nil {
+		to = net.JoinHostPort(strings.Trim(to, "[]"), port)
+	}
+	return to, true
+}
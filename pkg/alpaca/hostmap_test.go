@@ -0,0 +1,84 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostMapLookup(t *testing.T) {
+	hm, err := parseHostMap("API.example.com=staging.test, www.example.com:443=127.0.0.1:8443," +
+		"v6.example.com=[::1]")
+	require.NoError(t, err)
+	tests := []struct {
+		address string
+		mapped  string
+	}{
+		{"api.example.com:443", "staging.test:443"},
+		{"api.example.com.:80", "staging.test:80"},
+		{"Api.Example.com:8080", "staging.test:8080"},
+		{"www.example.com:443", "127.0.0.1:8443"},
+		{"www.example.com:80", ""},
+		{"v6.example.com:443", "[::1]:443"},
+		{"example.com:443", ""},
+	}
+	for _, test := range tests {
+		mapped, ok := hm.lookup(test.address)
+		assert.Equal(t, test.mapped != "", ok, test.address)
+		assert.Equal(t, test.mapped, mapped, test.address)
+	}
+	var none *hostMap
+	_, ok := none.lookup("api.example.com:443")
+	assert.False(t, ok)
+}
+
+func TestParseHostMapInvalid(t *testing.T) {
+	for _, value := range []string{"api.example.com", "=staging.test", "api.example.com=",
+		"a.test=b.test,A.test=c.test"} {
+		_, err := parseHostMap(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestMappedHostGoesDirect(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host = req.Host
+		_, _ = w.Write([]byte("staging"))
+	}))
+	defer server.Close()
+	defer func(hm *hostMap) { hostMappings = hm }(hostMappings)
+	var err error
+	hostMappings, err = parseHostMap("www.example.com=" + server.Listener.Addr().String())
+	require.NoError(t, err)
+
+	js := `function FindProxyForURL(url, host) { return "PROXY proxy.test:80" }`
+	pacServer := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer pacServer.Close()
+	pf := NewProxyFinder([]string{pacServer.URL}, NewPACWrapper(PACData{Port: 1}), myIPAuto)
+	ph := NewProxyHandler(nil, getProxyFromContext, func(string) {})
+	proxy := httptest.NewServer(pf.WrapHandler(ph))
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	status, body := postBody(t, client, "http://www.example.com/", http.NoBody)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "staging", body)
+	assert.Equal(t, "www.example.com", host)
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// canonicalHost returns host in the form that PAC files expect to see it: in lower case, without
+// a trailing dot, and with internationalized domain names in their ASCII (punycode) form, which
+// is what browsers pass to FindProxyForURL. Names that aren't valid IDNs (e.g. ones containing
+// underscores) are only lower-cased.
+func canonicalHost(host string) string {
+	host = strings.TrimRight(host, ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return strings.ToLower(host)
+}
+
+// canonicalDomain is like canonicalHost, but keeps a leading dot (e.g. ".example.com", as given
+// to dnsDomainIs).
+func canonicalDomain(domain string) string {
+	if rest, ok := strings.CutPrefix(domain, "."); ok {
+		return "." + canonicalHost(rest)
+	}
+	return canonicalHost(domain)
+}
+
+// parseDomainList parses a comma-separated list of domains (e.g. from a flag) for inDomains. A
+// leading "*." or "." is ignored, since subdomains are always included.
+func parseDomainList(value string) []string {
+	domains := splitList(value)
+	for i, domain := range domains {
+		domain = strings.TrimPrefix(domain, "*")
+		domains[i] = canonicalHost(strings.TrimPrefix(domain, "."))
+	}
+	return domains
+}
+
+// inDomains returns whether host is one of domains (see parseDomainList), or a subdomain of one.
+func inDomains(host string, domains []string) bool {
+	host = canonicalHost(host)
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalURL replaces the host in u with its canonical form (see canonicalHost).
+func canonicalURL(u *url.URL) {
+	host := canonicalHost(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+}
+
+// asciiPattern converts any internationalized labels in a shell expression (as given to
+// shExpMatch) to their ASCII form, so that it can match canonical host names. Labels containing
+// wildcards are left alone, since they can't be converted.
+func asciiPattern(pattern string) string {
+	labels := strings.FieldsFunc(pattern, func(r rune) bool { return r == '.' || r == '/' })
+	for _, label := range labels {
+		if isASCII(label) || strings.ContainsAny(label, "*?[]") {
+			continue
+		}
+		if ascii, err := idna.Lookup.ToASCII(label); err == nil {
+			pattern = strings.Replace(pattern, label, ascii, 1)
+		}
+	}
+	return pattern
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalHost(t *testing.T) {
+	for input, expected := range map[string]string{
+		"www.example.com":       "www.example.com",
+		"WWW.Example.COM.":      "www.example.com",
+		"bücher.example":        "xn--bcher-kva.example",
+		"BÜCHER.example":        "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"例え.テスト":                "xn--r8jz45g.xn--zckzah",
+		"My_Host.example":       "my_host.example",
+		"192.0.2.1":             "192.0.2.1",
+		"::1":                   "::1",
+		"":                      "",
+	} {
+		assert.Equal(t, expected, canonicalHost(input), input)
+	}
+}
+
+func TestCanonicalDomain(t *testing.T) {
+	assert.Equal(t, ".xn--bcher-kva.example", canonicalDomain(".Bücher.example."))
+	assert.Equal(t, "example.com", canonicalDomain("example.com"))
+}
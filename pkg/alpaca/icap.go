@@ -0,0 +1,341 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// icapClient sends requests and responses to an ICAP server (RFC 3507), such as a corporate
+// virus scanner or DLP service, before they're passed on. The server responds with "204 No
+// Content" to let them through unchanged, or with an HTTP response (usually an error page) to
+// send to the client instead. Modified requests and responses aren't supported, so they're let
+// through unchanged.
+type icapClient struct {
+	url *url.URL
+	// dial connects to the ICAP server. It connects directly unless -icap-via-proxy is given,
+	// in which case it goes through Alpaca itself (and so the upstream proxy), for ICAP servers
+	// that can only be reached from the proxy's network.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func newICAPClient(value string) (*icapClient, error) {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme != "icap" || u.Host == "" {
+		return nil, fmt.Errorf("invalid ICAP URL %q", value)
+	}
+	return &icapClient{url: u, dial: (&net.Dialer{}).DialContext}, nil
+}
+
+// icapResult is a response that the ICAP server wants to be sent instead of the original, and
+// why (if it said).
+type icapResult struct {
+	resp   *http.Response
+	reason string
+}
+
+// scan sends an upload to the server in a REQMOD request (see bodyScanner).
+func (c *icapClient) scan(ctx context.Context, req *http.Request, body []byte) error {
+	result, err := c.roundTrip(ctx, "REQMOD", icapRequestHeader(req), nil, body)
+	if err != nil || result == nil {
+		return err
+	}
+	result.resp.Body.Close()
+	return fmt.Errorf("%w: %s", ErrUploadBlocked, result.reason)
+}
+
+// respmod sends a response (to req) to the server in a RESPMOD request, and returns the response
+// to send instead, if there is one.
+func (c *icapClient) respmod(ctx context.Context, req *http.Request, status int,
+	header http.Header, body []byte) (*icapResult, error) {
+	var resHdr bytes.Buffer
+	fmt.Fprintf(&resHdr, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	_ = header.Write(&resHdr)
+	resHdr.WriteString("\r\n")
+	return c.roundTrip(ctx, "RESPMOD", icapRequestHeader(req), resHdr.Bytes(), body)
+}
+
+// roundTrip sends an ICAP request, which encapsulates the given HTTP request header, HTTP
+// response header (for RESPMOD) and body. It returns nil if the server let them through.
+func (c *icapClient) roundTrip(ctx context.Context, method string, reqHdr, resHdr,
+	body []byte) (*icapResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+	addr := c.url.Host
+	if c.url.Port() == "" {
+		addr = net.JoinHostPort(c.url.Hostname(), "1344")
+	}
+	conn, err := c.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.Write(c.request(method, reqHdr, resHdr, body)); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	_, status, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(status, " ")
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case "204":
+		return nil, nil
+	case "200":
+	default:
+		return nil, fmt.Errorf("ICAP server responded with %q", line)
+	}
+	offsets, err := parseEncapsulated(header.Get("Encapsulated"))
+	if err != nil {
+		return nil, err
+	}
+	resOffset, ok := offsets["res-hdr"]
+	if !ok {
+		return nil, nil
+	}
+	// Skip the request header, if the server sent one back.
+	if _, err := io.CopyN(io.Discard, br, int64(resOffset)); err != nil {
+		return nil, err
+	}
+	resp, err := readICAPResponse(tp)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := offsets["res-body"]; ok {
+		// Encapsulated bodies are always chunked, whatever the HTTP header says.
+		buf, err := io.ReadAll(httputil.NewChunkedReader(br))
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(buf))
+		resp.ContentLength = int64(len(buf))
+	}
+	reason := cmp.Or(header.Get("X-Violations-Found"), header.Get("X-Infection-Found"),
+		"the ICAP server responded with "+resp.Status)
+	return &icapResult{resp: resp, reason: reason}, nil
+}
+
+// request returns an ICAP request. The body is sent as a single chunk.
+func (c *icapClient) request(method string, reqHdr, resHdr, body []byte) []byte {
+	encapsulated := "req-hdr=0"
+	offset := len(reqHdr)
+	if resHdr != nil {
+		encapsulated += fmt.Sprintf(", res-hdr=%d", offset)
+		offset += len(resHdr)
+	}
+	bodyName := "req-body"
+	if resHdr != nil {
+		bodyName = "res-body"
+	}
+	if len(body) == 0 {
+		bodyName = "null-body"
+	}
+	encapsulated += fmt.Sprintf(", %s=%d", bodyName, offset)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s ICAP/1.0\r\n", method, c.url)
+	fmt.Fprintf(&buf, "Host: %s\r\n", c.url.Host)
+	buf.WriteString("Allow: 204\r\n")
+	fmt.Fprintf(&buf, "Encapsulated: %s\r\n", encapsulated)
+	buf.WriteString("Connection: close\r\n\r\n")
+	buf.Write(reqHdr)
+	buf.Write(resHdr)
+	if len(body) > 0 {
+		buf.WriteString(strconv.FormatInt(int64(len(body)), 16) + "\r\n")
+		buf.Write(body)
+		buf.WriteString("\r\n0\r\n\r\n")
+	}
+	return buf.Bytes()
+}
+
+// icapRequestHeader returns the header of req, as it's encapsulated in an ICAP request.
+func icapRequestHeader(req *http.Request) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL, req.Host)
+	header := req.Header.Clone()
+	header.Del("Proxy-Authorization")
+	_ = header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// parseEncapsulated parses an Encapsulated header, e.g. "res-hdr=0, res-body=120", into the
+// offset of each section.
+func parseEncapsulated(value string) (map[string]int, error) {
+	offsets := make(map[string]int)
+	for _, elem := range strings.Split(value, ",") {
+		name, offset, ok := strings.Cut(strings.TrimSpace(elem), "=")
+		n, err := strconv.Atoi(offset)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid Encapsulated header %q", value)
+		}
+		offsets[name] = n
+	}
+	return offsets, nil
+}
+
+// readICAPResponse reads the header of an HTTP response that's encapsulated in an ICAP response.
+// (http.ReadResponse can't be used, since it would read the body according to the header.)
+func readICAPResponse(tp *textproto.Reader) (*http.Response, error) {
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, status, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(status, " ")
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || !strings.HasPrefix(proto, "HTTP/") {
+		return nil, fmt.Errorf("invalid encapsulated response %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	// The body is chunked in the ICAP response, and may be sent to the client differently.
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	return &http.Response{
+		Status:     status,
+		StatusCode: statusCode,
+		Proto:      proto,
+		Header:     http.Header(header),
+		Body:       http.NoBody,
+	}, nil
+}
+
+// downloadScanner sends responses to an ICAP server (given by -scan-downloads) before passing them
+// on to the client. Like uploadScanner, it reads bodies into memory to scan them (so it blocks
+// ones that are bigger than maxBody), and only works for plain HTTP requests.
+type downloadScanner struct {
+	icap    *icapClient
+	domains []string // If set, only downloads from these domains (see parseDomainList)
+	maxBody int64
+}
+
+func (ds *downloadScanner) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodConnect || req.URL.Scheme == "" ||
+			req.Method == http.MethodHead || req.Header.Get("Upgrade") != "" ||
+			(len(ds.domains) > 0 && !inDomains(req.URL.Hostname(), ds.domains)) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		id := req.Context().Value(contextKeyID)
+		bw := &bufferedResponseWriter{header: make(http.Header), limit: ds.maxBody}
+		next.ServeHTTP(bw, req)
+		if bw.tooLarge {
+			err := fmt.Errorf("%w: the body is bigger than -scan-max-body (%d bytes), so it "+
+				"can't be scanned", ErrDownloadBlocked, ds.maxBody)
+			log.Printf("[%d] %s %s: %v", id, req.Method, logURL(req.URL), err)
+			writeProxyError(w, req, http.StatusForbidden, stageRequest, nil, err)
+			return
+		} else if bw.body.Len() == 0 {
+			bw.writeTo(w)
+			return
+		}
+		result, err := ds.icap.respmod(req.Context(), req, bw.status, bw.header, bw.body.Bytes())
+		if err != nil {
+			// Rather than letting the download through unchecked.
+			err = fmt.Errorf("error scanning download: %w", err)
+			log.Printf("[%d] %s %s: %v", id, req.Method, logURL(req.URL), err)
+			writeProxyError(w, req, http.StatusBadGateway, stageRequest, nil, err)
+			return
+		} else if result == nil {
+			bw.writeTo(w)
+			return
+		}
+		defer result.resp.Body.Close()
+		log.Printf("[%d] %s %s: response replaced by the ICAP server: %s", id, req.Method,
+			logURL(req.URL), result.reason)
+		copyResponseHeaders(w, result.resp)
+		if result.resp.StatusCode >= 400 {
+			w.Header().Set(proxyErrorHeader, "download_blocked")
+		}
+		w.WriteHeader(result.resp.StatusCode)
+		_, _ = io.Copy(w, result.resp.Body)
+	})
+}
+
+// errResponseTooLarge is returned by bufferedResponseWriter, to stop the handler from sending the
+// rest of a response that's too large to scan.
+var errResponseTooLarge = errors.New("response too large to scan")
+
+// bufferedResponseWriter keeps a response in memory (up to limit bytes of its body), so that it
+// can be scanned before it's sent.
+type bufferedResponseWriter struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	limit    int64
+	tooLarge bool
+}
+
+func (bw *bufferedResponseWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *bufferedResponseWriter) WriteHeader(status int) {
+	if bw.status == 0 {
+		bw.status = status
+	}
+}
+
+func (bw *bufferedResponseWriter) Write(p []byte) (int, error) {
+	bw.WriteHeader(http.StatusOK)
+	if int64(bw.body.Len()+len(p)) > bw.limit {
+		bw.tooLarge = true
+		return 0, errResponseTooLarge
+	}
+	return bw.body.Write(p)
+}
+
+// writeTo sends the response to w.
+func (bw *bufferedResponseWriter) writeTo(w http.ResponseWriter) {
+	for k, vs := range bw.header {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			w.Header()[k] = vs
+		}
+	}
+	w.WriteHeader(cmp.Or(bw.status, http.StatusOK))
+	_, _ = w.Write(bw.body.Bytes())
+	// Trailers are only known once the body has been sent (see ProxyHandler.proxyRequest).
+	for k, vs := range bw.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			w.Header()[k] = vs
+		}
+	}
+}
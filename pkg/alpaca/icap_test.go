@@ -0,0 +1,166 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// respmodServer is a fake ICAP server, which replaces responses that contain "virus" with an
+// error page.
+func respmodServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			serveRespmod(t, conn)
+		}
+	}()
+	return l
+}
+
+func serveRespmod(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "RESPMOD icap://"), line)
+	header, err := tp.ReadMIMEHeader()
+	require.NoError(t, err)
+	offsets, err := parseEncapsulated(header.Get("Encapsulated"))
+	require.NoError(t, err)
+	require.Contains(t, offsets, "res-body")
+	req, err := http.ReadRequest(br)
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodGet, req.Method)
+	status, err := tp.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	_, err = tp.ReadMIMEHeader()
+	require.NoError(t, err)
+	body, err := io.ReadAll(httputil.NewChunkedReader(br))
+	require.NoError(t, err)
+	if !bytes.Contains(body, []byte("virus")) {
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\n\r\n"))
+		return
+	}
+	resHdr := "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\nContent-Length: 99\r\n\r\n"
+	page := "blocked by policy"
+	_, _ = fmt.Fprintf(conn, "ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Threat=EICAR;\r\n"+
+		"Encapsulated: res-hdr=0, res-body=%d\r\n\r\n%s%x\r\n%s\r\n0\r\n\r\n",
+		len(resHdr), resHdr, len(page), page)
+}
+
+func TestDownloadScanning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, strings.TrimPrefix(req.URL.Path, "/"))
+	}))
+	defer server.Close()
+	l := respmodServer(t)
+	defer l.Close()
+	c, err := newICAPClient("icap://" + l.Addr().String() + "/respmod")
+	require.NoError(t, err)
+	ds := &downloadScanner{icap: c, domains: parseDomainList("127.0.0.1"), maxBody: 16}
+	proxy := httptest.NewServer(ds.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	get := func(url string) (*http.Response, string) {
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+	resp, body := get(server.URL + "/hello")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	// The ICAP server's error page is sent instead.
+	resp, body = get(server.URL + "/a-virus")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "download_blocked", resp.Header.Get(proxyErrorHeader))
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "blocked by policy", body)
+	// Bodies that are too big to scan are blocked.
+	resp, _ = get(server.URL + "/" + strings.Repeat("x", 17))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "download_blocked", resp.Header.Get(proxyErrorHeader))
+	// Downloads from other hosts aren't scanned.
+	resp, body = get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1) + "/another-virus")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "another-virus", body)
+}
+
+func TestDownloadScanningError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer server.Close()
+	// Nothing is listening on the ICAP server's port, so downloads can't be checked.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	c, err := newICAPClient("icap://" + l.Addr().String())
+	require.NoError(t, err)
+	ds := &downloadScanner{icap: c, maxBody: 16}
+	proxy := httptest.NewServer(ds.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestICAPViaProxy(t *testing.T) {
+	l := icapServer(t)
+	defer l.Close()
+	proxy := httptest.NewServer(newDirectProxy())
+	defer proxy.Close()
+	scanner, err := newICAPClient("icap://" + l.Addr().String() + "/reqmod")
+	require.NoError(t, err)
+	scanner.dial = httpConnectDialer(proxy.Listener.Addr().String())
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.com/upload", nil)
+	assert.NoError(t, scanner.scan(req.Context(), req, []byte("hello")))
+	assert.ErrorIs(t, scanner.scan(req.Context(), req, []byte("a secret")), ErrUploadBlocked)
+}
+
+func TestParseEncapsulated(t *testing.T) {
+	offsets, err := parseEncapsulated("req-hdr=0, res-hdr=45,res-body=120")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"req-hdr": 0, "res-hdr": 45, "res-body": 120}, offsets)
+	for _, value := range []string{"", "res-hdr", "res-hdr=x", "res-hdr=-1"} {
+		_, err := parseEncapsulated(value)
+		assert.Error(t, err, value)
+	}
+}
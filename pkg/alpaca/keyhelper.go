@@ -0,0 +1,87 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// keyHelper is the private key for a client certificate (-proxy-cert), held by an external
+// program (given by -proxy-key-helper) rather than in a file, e.g. a script that uses a smart card
+// through PKCS#11, or a key in the OS keystore that can't be exported. Like a credential helper,
+// the program is run by the shell with an action ("sign") as its last argument, and it reads and
+// writes key=value lines on stdin and stdout. It's given the algorithm (e.g. "rsa-pss-sha256" or
+// "ecdsa-sha256") and the digest to sign (in hex), and prints the signature (in hex).
+type keyHelper struct {
+	command     string
+	public      crypto.PublicKey
+	execCommand func(name string, arg ...string) *exec.Cmd
+}
+
+func newKeyHelper(command string, public crypto.PublicKey) *keyHelper {
+	return &keyHelper{command: command, public: public, execCommand: exec.Command}
+}
+
+func (kh *keyHelper) Public() crypto.PublicKey {
+	return kh.public
+}
+
+func (kh *keyHelper) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := signatureAlgorithm(kh.public, opts)
+	if err != nil {
+		return nil, err
+	}
+	result, err := runHelper(kh.execCommand, "key helper", kh.command, "sign",
+		"algorithm="+algorithm, "digest="+hex.EncodeToString(digest))
+	if err != nil {
+		return nil, err
+	}
+	signature, err := hex.DecodeString(result["signature"])
+	if err != nil {
+		return nil, fmt.Errorf("key helper returned an invalid signature: %w", err)
+	} else if len(signature) == 0 {
+		return nil, errors.New("key helper didn't return a signature")
+	}
+	return signature, nil
+}
+
+// signatureAlgorithm returns the name of the algorithm that's given to the key helper, e.g.
+// "rsa-pkcs1-sha256", "rsa-pss-sha384", "ecdsa-sha256" or "ed25519". For Ed25519, the "digest" is
+// actually the whole message.
+func signatureAlgorithm(public crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	// e.g. "SHA-256" becomes "sha256", and "MD5+SHA1" (used by TLS 1.0) becomes "md5+sha1".
+	hash := strings.ToLower(strings.ReplaceAll(opts.HashFunc().String(), "-", ""))
+	switch public.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return "rsa-pss-" + hash, nil
+		}
+		return "rsa-pkcs1-" + hash, nil
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + hash, nil
+	case ed25519.PublicKey:
+		return "ed25519", nil
+	}
+	return "", fmt.Errorf("unsupported public key type %T", public)
+}
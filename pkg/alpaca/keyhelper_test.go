@@ -0,0 +1,120 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMockKeyHelper is run as a key helper by TestKeyHelper. It signs with the key in the file
+// given by $HELPER_KEY.
+func TestMockKeyHelper(t *testing.T) {
+	if os.Getenv("ALPACA_WANT_MOCK_KEY_HELPER") != "1" {
+		return
+	}
+	input := make(map[string]string)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() && scanner.Text() != "" {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		input[key] = value
+	}
+	buf, _ := os.ReadFile(os.Getenv("HELPER_KEY"))
+	block, _ := pem.Decode(buf)
+	key, _ := x509.ParsePKCS8PrivateKey(block.Bytes)
+	digest, _ := hex.DecodeString(input["digest"])
+	if input["algorithm"] != "ecdsa-sha256" {
+		os.Exit(1)
+	}
+	signature, _ := ecdsa.SignASN1(rand.Reader, key.(*ecdsa.PrivateKey), digest)
+	fmt.Printf("signature=%x\n\n", signature)
+	os.Exit(0)
+}
+
+func TestKeyHelper(t *testing.T) {
+	clientCert, certFile, keyFile := writeClientCert(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	server.TLS.ClientCAs.AddCert(clientCert)
+	server.StartTLS()
+	defer server.Close()
+
+	config, err := loadTLSClientConfig("", certFile, "", "sign-with-hsm")
+	require.NoError(t, err)
+	require.Len(t, config.Certificates, 1)
+	kh, ok := config.Certificates[0].PrivateKey.(*keyHelper)
+	require.True(t, ok)
+	kh.execCommand = func(name string, arg ...string) *exec.Cmd {
+		arg = append([]string{"-test.run=TestMockKeyHelper", "--", name}, arg...)
+		cmd := exec.Command(os.Args[0], arg...)
+		cmd.Env = []string{"ALPACA_WANT_MOCK_KEY_HELPER=1", "HELPER_KEY=" + keyFile}
+		return cmd
+	}
+	config.RootCAs = x509.NewCertPool()
+	config.RootCAs.AddCert(server.Certificate())
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	_, err = loadTLSClientConfig("", "", "", "sign-with-hsm")
+	assert.Error(t, err)
+	_, err = loadTLSClientConfig("", certFile, keyFile, "sign-with-hsm")
+	assert.Error(t, err)
+}
+
+func TestSignatureAlgorithm(t *testing.T) {
+	rsaKey := &rsa.PublicKey{}
+	ecKey := &ecdsa.PublicKey{}
+	edKey := ed25519.PublicKey{}
+	tests := []struct {
+		public   crypto.PublicKey
+		opts     crypto.SignerOpts
+		expected string
+	}{
+		{rsaKey, crypto.SHA256, "rsa-pkcs1-sha256"},
+		{rsaKey, &rsa.PSSOptions{Hash: crypto.SHA384}, "rsa-pss-sha384"},
+		{rsaKey, crypto.MD5SHA1, "rsa-pkcs1-md5+sha1"},
+		{ecKey, crypto.SHA512, "ecdsa-sha512"},
+		{edKey, crypto.Hash(0), "ed25519"},
+	}
+	for _, test := range tests {
+		algorithm, err := signatureAlgorithm(test.public, test.opts)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, algorithm)
+	}
+	_, err := signatureAlgorithm("not a key", crypto.SHA256)
+	assert.Error(t, err)
+}
@@ -1,4 +1,4 @@
-// Copyright 2019, 2021, 2022 The Alpaca Authors
+// Copyright 2024 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -12,20 +12,18 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+//go:build !darwin
 
-type pacFinder struct{
-	pacURL string
-}
+package alpaca
 
-func newPacFinder(pacURL string) *pacFinder {
-	return &pacFinder{pacURL: pacURL}
+type keyring struct {
+	backend keyringBackend
 }
 
-func (finder *pacFinder) findPACURL() (string, error) {
-	return finder.pacURL, nil
+func fromKeyring() *keyring {
+	return &keyring{backend: keyringStore}
 }
 
-func (finder *pacFinder) pacChanged() bool {
-	return false
+func (k *keyring) getCredentials() (*authenticator, error) {
+	return credentialsFromKeyring(k.backend)
 }
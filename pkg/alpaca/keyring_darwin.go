@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package alpaca
 
 import (
 	"errors"
@@ -26,11 +26,12 @@ import (
 )
 
 type keyring struct {
+	backend     keyringBackend
 	execCommand func(name string, arg ...string) *exec.Cmd
 }
 
 func fromKeyring() *keyring {
-	return &keyring{execCommand: exec.Command}
+	return &keyring{backend: keyringStore, execCommand: exec.Command}
 }
 
 func (k *keyring) readDefaultForNoMAD(key string) (string, error) {
@@ -64,6 +65,10 @@ func (k *keyring) readPasswordFromKeychain(userPrincipal string) string {
 }
 
 func (k *keyring) getCredentials() (*authenticator, error) {
+	if _, ok := k.backend.(osKeyring); !ok && k.backend != nil {
+		// Another keyring was chosen using -keyring, so don't look for NoMAD's credentials.
+		return credentialsFromKeyring(k.backend)
+	}
 	useKeychain, err := k.readDefaultForNoMAD("UseKeychain")
 	if err != nil {
 		return nil, err
@@ -79,7 +84,8 @@ func (k *keyring) getCredentials() (*authenticator, error) {
 		return nil, errors.New("Couldn't retrieve AD domain and username from NoMAD.")
 	}
 	user, domain := substrs[0], substrs[1]
-	hash := ntlmssp.GetNtlmHash(k.readPasswordFromKeychain(userPrincipal))
+	password := k.readPasswordFromKeychain(userPrincipal)
+	hash := ntlmssp.GetNtlmHash(password)
 	log.Printf("Found NoMAD credentials for %s\\%s in system keychain", domain, user)
-	return &authenticator{domain, user, hash}, nil
+	return &authenticator{domain: domain, username: user, hash: hash, password: password}, nil
 }
@@ -0,0 +1,75 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/danieljoos/wincred"
+	ring "github.com/zalando/go-keyring"
+)
+
+// winCredKeyring is Windows Credential Manager. Entries are named like go-keyring's
+// ("service:user"), except for the password, which can be given a different target name (e.g.
+// one that another program already uses).
+type winCredKeyring struct {
+	target string
+}
+
+func newWinCredKeyring(target string) (keyringBackend, error) {
+	return &winCredKeyring{target: target}, nil
+}
+
+func (wk *winCredKeyring) targetName(service, user string) string {
+	if wk.target != "" && user != credentialsKeyringUser && user != envVarKeyringUser {
+		return wk.target
+	}
+	return service + ":" + user
+}
+
+func (wk *winCredKeyring) get(service, user string) (string, error) {
+	cred, err := wincred.GetGenericCredential(wk.targetName(service, user))
+	if errors.Is(err, syscall.ERROR_NOT_FOUND) {
+		return "", ring.ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return string(cred.CredentialBlob), nil
+}
+
+func (wk *winCredKeyring) set(service, user, secret string) error {
+	cred := wincred.NewGenericCredential(wk.targetName(service, user))
+	cred.UserName = user
+	cred.CredentialBlob = []byte(secret)
+	return cred.Write()
+}
+
+func (wk *winCredKeyring) delete(service, user string) error {
+	cred, err := wincred.GetGenericCredential(wk.targetName(service, user))
+	if errors.Is(err, syscall.ERROR_NOT_FOUND) {
+		return ring.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return cred.Delete()
+}
+
+func (wk *winCredKeyring) String() string {
+	if wk.target != "" {
+		return "Windows Credential Manager (" + wk.target + ")"
+	}
+	return "Windows Credential Manager"
+}
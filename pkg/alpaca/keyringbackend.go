@@ -0,0 +1,280 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/samuong/go-ntlmssp"
+	ring "github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+// The values accepted by the -keyring flag.
+const (
+	keyringAuto          = "auto"           // The OS's own keyring (see osKeyring)
+	keyringSecretService = "secret-service" // e.g. GNOME Keyring (Linux and BSD only)
+	keyringKWallet       = "kwallet"        // KDE Wallet, using kwallet-query
+	keyringPass          = "pass"           // The standard Unix password manager
+	keyringWinCred       = "wincred"        // Windows Credential Manager (Windows only)
+)
+
+var keyringBackends = []string{
+	keyringAuto, keyringSecretService, keyringKWallet, keyringPass, keyringWinCred,
+}
+
+// keyringBackend stores the secrets that Alpaca keeps in a keyring: the NTLM password, and the
+// keys for -credentials-key keyring and -encrypt-hash. Each one is identified by a service (which
+// is always "alpaca") and a user.
+type keyringBackend interface {
+	get(service, user string) (string, error) // Returns ring.ErrNotFound if there's no secret
+	set(service, user, secret string) error
+	delete(service, user string) error
+	String() string
+}
+
+// keyringStore is the keyring chosen by the -keyring flag.
+var keyringStore keyringBackend = osKeyring{}
+
+// newKeyringBackend returns the keyring with the given name (one of keyringBackends). The target
+// is the name of the Windows Credential Manager entry that holds the password, if it isn't the
+// default.
+func newKeyringBackend(name, target string) (keyringBackend, error) {
+	if target != "" && name != keyringWinCred && (name != keyringAuto || runtime.GOOS != "windows") {
+		return nil, errors.New("-keyring-target can only be used with Windows Credential Manager")
+	}
+	switch name {
+	case keyringAuto:
+		if target != "" {
+			return newWinCredKeyring(target)
+		}
+		return osKeyring{}, nil
+	case keyringSecretService:
+		if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+			return nil, fmt.Errorf("the Secret Service keyring isn't available on %s", runtime.GOOS)
+		}
+		return osKeyring{}, nil
+	case keyringKWallet:
+		return &commandKeyring{kind: keyringKWallet, execCommand: exec.Command}, nil
+	case keyringPass:
+		return &commandKeyring{kind: keyringPass, execCommand: exec.Command}, nil
+	case keyringWinCred:
+		return newWinCredKeyring(target)
+	}
+	return nil, fmt.Errorf("unknown keyring %q (should be one of %s)", name,
+		strings.Join(keyringBackends, ", "))
+}
+
+// osKeyring is the OS's own keyring, as used by go-keyring: the Secret Service (e.g. GNOME
+// Keyring or KeePassXC) on Linux and BSD, Windows Credential Manager (with target names like
+// "alpaca:user") on Windows, and the login keychain on macOS.
+type osKeyring struct{}
+
+func (osKeyring) get(service, user string) (string, error) {
+	return ring.Get(service, user)
+}
+
+func (osKeyring) set(service, user, secret string) error {
+	return ring.Set(service, user, secret)
+}
+
+func (osKeyring) delete(service, user string) error {
+	return ring.Delete(service, user)
+}
+
+func (osKeyring) String() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "Windows Credential Manager"
+	case "darwin":
+		return "the login keychain"
+	}
+	return "the Secret Service keyring"
+}
+
+// commandKeyring is a keyring that's used by running its command-line tool: kwallet-query for
+// KDE Wallet (with each service as a folder in the default wallet), or pass (with each secret in
+// a file named service/user).
+type commandKeyring struct {
+	kind        string // keyringKWallet or keyringPass
+	execCommand func(name string, arg ...string) *exec.Cmd
+}
+
+func (ck *commandKeyring) get(service, user string) (string, error) {
+	if ck.kind == keyringKWallet {
+		out, err := ck.run("", "kwallet-query", "-f", service, "-r", user, "kdewallet")
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(out, "\n"), nil
+	}
+	out, err := ck.run("", "pass", "show", service+"/"+user)
+	if err != nil {
+		return "", err
+	}
+	// Like other clients of pass, only use the first line (the rest can hold other details).
+	secret, _, _ := strings.Cut(out, "\n")
+	return secret, nil
+}
+
+func (ck *commandKeyring) set(service, user, secret string) error {
+	var err error
+	if ck.kind == keyringKWallet {
+		_, err = ck.run(secret, "kwallet-query", "-f", service, "-w", user, "kdewallet")
+	} else {
+		_, err = ck.run(secret+"\n", "pass", "insert", "--multiline", "--force",
+			service+"/"+user)
+	}
+	return err
+}
+
+func (ck *commandKeyring) delete(service, user string) error {
+	if ck.kind == keyringKWallet {
+		return errors.New("kwallet-query can't delete entries; use KWalletManager instead")
+	}
+	_, err := ck.run("", "pass", "rm", "--force", service+"/"+user)
+	return err
+}
+
+func (ck *commandKeyring) String() string {
+	if ck.kind == keyringKWallet {
+		return "KDE Wallet"
+	}
+	return "pass"
+}
+
+// run runs a keyring's command with the given stdin, and returns its stdout. If the command says
+// that there's no such entry, the error wraps ring.ErrNotFound.
+func (ck *commandKeyring) run(stdin, name string, arg ...string) (string, error) {
+	cmd := ck.execCommand(name, arg...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String() + stdout.String())
+		if strings.Contains(msg, "is not in the password store") ||
+			strings.Contains(msg, "does not exist") ||
+			strings.Contains(msg, "Failed to read entry") {
+			return "", fmt.Errorf("%w: %s", ring.ErrNotFound, msg)
+		}
+		return "", fmt.Errorf("error running %s: %w: %s", name, err, msg)
+	}
+	return stdout.String(), nil
+}
+
+// keyringUser returns the user whose password Alpaca looks for in the keyring: $NTLM_USERNAME,
+// or the logged-in user if that isn't set.
+func keyringUser() string {
+	if username := os.Getenv("NTLM_USERNAME"); username != "" {
+		return username
+	}
+	return whoAmI()
+}
+
+// credentialsFromKeyring gets the password for keyringUser from a keyring. The domain is given
+// by $NTLM_DOMAIN.
+func credentialsFromKeyring(backend keyringBackend) (*authenticator, error) {
+	username, domain := keyringUser(), os.Getenv("NTLM_DOMAIN")
+	pwd, err := backend.get(credentialsKeyringService, username)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get user secret from %s: %w", backend, err)
+	}
+	hash := ntlmssp.GetNtlmHash(pwd)
+	return &authenticator{domain: domain, username: username, hash: hash, password: pwd}, nil
+}
+
+// credsCommand runs "alpaca creds set|get|delete", which manages the password that Alpaca reads
+// from the keyring. "set" reads the password from the terminal (or, if stdin isn't a terminal,
+// from the first line of stdin), and "get" only says whether there is one.
+func credsCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("alpaca creds", flag.ContinueOnError)
+	name := fs.String("keyring", keyringAuto, "the keyring to use (see alpaca -help)")
+	target := fs.String("keyring-target", "", "the Windows Credential Manager target name")
+	username := fs.String("u", keyringUser(), "the user whose password to manage")
+	usage := "usage: alpaca creds set|get|delete [-keyring name] [-keyring-target name] [-u user]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	} else if err := loadConfig(fs, os.LookupEnv); err != nil {
+		return err
+	} else if fs.NArg() > 0 {
+		return errors.New(usage)
+	}
+	backend, err := newKeyringBackend(*name, *target)
+	if err != nil {
+		return err
+	}
+	if _, ok := backend.(osKeyring); ok && runtime.GOOS == "darwin" {
+		return errors.New("on macOS, Alpaca reads NoMAD's keychain item, unless another " +
+			"-keyring is chosen")
+	}
+	switch action {
+	case "set":
+		password, err := readCredsPassword(stdin, stdout, *username)
+		if err != nil {
+			return err
+		} else if err := backend.set(credentialsKeyringService, *username, password); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Saved the password for %s in %s\n", *username, backend)
+	case "get":
+		if _, err := backend.get(credentialsKeyringService, *username); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "There's a password for %s in %s\n", *username, backend)
+	case "delete":
+		if err := backend.delete(credentialsKeyringService, *username); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Deleted the password for %s from %s\n", *username, backend)
+	default:
+		return errors.New(usage)
+	}
+	return nil
+}
+
+func readCredsPassword(stdin io.Reader, stdout io.Writer, username string) (string, error) {
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprintf(stdout, "Password for %s: ", username)
+		buf, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(stdout)
+		if err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("no password given")
+	}
+	return password, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ring "github.com/zalando/go-keyring"
+)
+
+// fakePass is a shell script that behaves like pass, keeping its entries in $STORE.
+const fakePass = `cmd=$1; shift
+case $cmd in
+show)
+	[ -f "$STORE/$1" ] || { echo "Error: $1 is not in the password store." >&2; exit 1; }
+	cat "$STORE/$1" ;;
+insert)
+	mkdir -p "$(dirname "$STORE/$3")" && cat > "$STORE/$3" ;;
+rm)
+	[ -f "$STORE/$2" ] || { echo "Error: $2 is not in the password store." >&2; exit 1; }
+	rm "$STORE/$2" ;;
+esac`
+
+func fakePassKeyring(t *testing.T) *commandKeyring {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	t.Setenv("STORE", t.TempDir())
+	return &commandKeyring{
+		kind: keyringPass,
+		execCommand: func(name string, arg ...string) *exec.Cmd {
+			require.Equal(t, "pass", name)
+			return exec.Command("sh", append([]string{"-c", fakePass, name}, arg...)...)
+		},
+	}
+}
+
+func TestPassKeyring(t *testing.T) {
+	k := fakePassKeyring(t)
+	_, err := k.get("alpaca", "malory")
+	require.ErrorIs(t, err, ring.ErrNotFound)
+	require.NoError(t, k.set("alpaca", "malory", "guest"))
+	secret, err := k.get("alpaca", "malory")
+	require.NoError(t, err)
+	assert.Equal(t, "guest", secret)
+	require.NoError(t, k.delete("alpaca", "malory"))
+	assert.ErrorIs(t, k.delete("alpaca", "malory"), ring.ErrNotFound)
+}
+
+func TestCredentialsFromKeyring(t *testing.T) {
+	k := fakePassKeyring(t)
+	t.Setenv("NTLM_USERNAME", "malory")
+	t.Setenv("NTLM_DOMAIN", "ISIS")
+	require.NoError(t, k.set(credentialsKeyringService, "malory", "guest"))
+	a, err := (&keyring{backend: k}).getCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, "ISIS", a.domain)
+	assert.Equal(t, "malory", a.username)
+	assert.Equal(t, "guest", a.password)
+	// Keys for -encrypt-hash are kept in the same keyring.
+	value, err := sealEnvVar(a, k.get, k.set)
+	require.NoError(t, err)
+	a, err = (&envVar{value: value, keyringGet: k.get}).parse()
+	require.NoError(t, err)
+	assert.Equal(t, "malory", a.username)
+}
+
+func TestNewKeyringBackend(t *testing.T) {
+	k, err := newKeyringBackend(keyringPass, "")
+	require.NoError(t, err)
+	assert.Equal(t, "pass", k.String())
+	_, err = newKeyringBackend("vault", "")
+	assert.ErrorContains(t, err, `unknown keyring "vault"`)
+	_, err = newKeyringBackend(keyringKWallet, "corp-proxy")
+	assert.ErrorContains(t, err, "-keyring-target")
+	if runtime.GOOS != "windows" {
+		_, err = newKeyringBackend(keyringWinCred, "")
+		assert.Error(t, err)
+	}
+}
+
+func TestCredsCommandUsage(t *testing.T) {
+	var out strings.Builder
+	assert.ErrorContains(t, credsCommand(nil, strings.NewReader(""), &out), "usage")
+	err := credsCommand([]string{"list"}, strings.NewReader(""), &out)
+	assert.ErrorContains(t, err, "usage")
+	err = credsCommand([]string{"get", "-keyring", "vault"}, strings.NewReader(""), &out)
+	assert.ErrorContains(t, err, "unknown keyring")
+}
+
+func TestReadCredsPassword(t *testing.T) {
+	var out strings.Builder
+	password, err := readCredsPassword(strings.NewReader("guest\r\n"), &out, "malory")
+	require.NoError(t, err)
+	assert.Equal(t, "guest", password)
+	_, err = readCredsPassword(strings.NewReader(""), &out, "malory")
+	assert.Error(t, err)
+}
@@ -0,0 +1,207 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms' buckets (apart from the last
+// bucket, which counts anything slower).
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// latencySamples is the number of recent samples of each latency that are kept for each upstream,
+// for the dashboard's sparklines.
+const latencySamples = 30
+
+// latencyStats records how long it takes to connect to each upstream proxy (or, for DIRECT, to
+// servers), and how long until the first byte of each response (the time to first byte, or TTFB,
+// which includes getting a connection). It's exported as Prometheus metrics at /alpaca/metrics,
+// and shown on the dashboard, so that slow proxies are visible from the client side.
+type latencyStats struct {
+	upstreams map[string]*upstreamLatency // By proxyString, e.g. "PROXY proxy.example.com:8080"
+	mux       sync.Mutex
+}
+
+type upstreamLatency struct {
+	connect latencyHistogram
+	ttfb    latencyHistogram
+}
+
+type latencyHistogram struct {
+	counts []int64 // One for each of latencyBuckets, and one for anything slower
+	sum    time.Duration
+	count  int64
+	recent []time.Duration // Oldest first
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{upstreams: make(map[string]*upstreamLatency)}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(latencyBuckets)+1)
+	}
+	i, _ := slices.BinarySearch(latencyBuckets, d)
+	h.counts[i]++
+	h.sum += d
+	h.count++
+	if len(h.recent) >= latencySamples {
+		h.recent = slices.Delete(h.recent, 0, len(h.recent)-latencySamples+1)
+	}
+	h.recent = append(h.recent, d)
+}
+
+// median returns the median of the recent samples, of which there must be at least one.
+func (h *latencyHistogram) median() time.Duration {
+	sorted := slices.Clone(h.recent)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
+
+func (ls *latencyStats) upstream(proxy *url.URL) *upstreamLatency {
+	name := proxyString(proxy)
+	ul, ok := ls.upstreams[name]
+	if !ok {
+		ul = &upstreamLatency{}
+		ls.upstreams[name] = ul
+	}
+	return ul
+}
+
+func (ls *latencyStats) recordConnect(proxy *url.URL, d time.Duration) {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	ls.upstream(proxy).connect.observe(d)
+}
+
+func (ls *latencyStats) recordTTFB(proxy *url.URL, d time.Duration) {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	ls.upstream(proxy).ttfb.observe(d)
+}
+
+// trace returns a copy of req whose context records the latencies of sending it via proxy (nil
+// for DIRECT). The connect time is only recorded if a new connection is made.
+func (ls *latencyStats) trace(req *http.Request, proxy *url.URL) *http.Request {
+	start := time.Now()
+	var connectStart time.Time
+	var mux sync.Mutex
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			mux.Lock()
+			defer mux.Unlock()
+			connectStart = time.Now()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			mux.Lock()
+			defer mux.Unlock()
+			if err == nil && !connectStart.IsZero() {
+				ls.recordConnect(proxy, time.Since(connectStart))
+			}
+		},
+		GotFirstResponseByte: func() { ls.recordTTFB(proxy, time.Since(start)) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// writeMetrics writes the histograms in the Prometheus text format.
+func (ls *latencyStats) writeMetrics(w io.Writer) {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	names := make([]string, 0, len(ls.upstreams))
+	for name := range ls.upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := []struct {
+		name, help string
+		histogram  func(*upstreamLatency) *latencyHistogram
+	}{
+		{"alpaca_upstream_connect_seconds", "Time taken to connect to each upstream proxy.",
+			func(ul *upstreamLatency) *latencyHistogram { return &ul.connect }},
+		{"alpaca_upstream_ttfb_seconds", "Time until the first byte of each response, by " +
+			"upstream proxy.", func(ul *upstreamLatency) *latencyHistogram { return &ul.ttfb }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+		for _, name := range names {
+			h := m.histogram(ls.upstreams[name])
+			label := fmt.Sprintf("upstream=%s", strconv.Quote(name))
+			var cumulative int64
+			for i, bound := range latencyBuckets {
+				if h.counts != nil {
+					cumulative += h.counts[i]
+				}
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", m.name, label, bound.Seconds(),
+					cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", m.name, label, h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %g\n", m.name, label, h.sum.Seconds())
+			fmt.Fprintf(w, "%s_count{%s} %d\n", m.name, label, h.count)
+		}
+	}
+}
+
+// dashboardLatency is the latency of an upstream, as shown on the dashboard.
+type dashboardLatency struct {
+	Upstream string `json:"upstream"`
+	Requests int64  `json:"requests"`
+	Connect  string `json:"connect"` // The median of the recent connect times
+	TTFB     string `json:"ttfb"`    // The median of the recent TTFBs
+	// The recent TTFBs in milliseconds, oldest first, for a sparkline.
+	RecentTTFB []int64 `json:"recent_ttfb"`
+}
+
+func (ls *latencyStats) dashboard() []dashboardLatency {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	latencies := make([]dashboardLatency, 0, len(ls.upstreams))
+	for name, ul := range ls.upstreams {
+		dl := dashboardLatency{
+			Upstream:   name,
+			Requests:   ul.ttfb.count,
+			RecentTTFB: make([]int64, 0, len(ul.ttfb.recent)),
+		}
+		if len(ul.connect.recent) > 0 {
+			dl.Connect = ul.connect.median().Round(time.Millisecond).String()
+		}
+		if len(ul.ttfb.recent) > 0 {
+			dl.TTFB = ul.ttfb.median().Round(time.Millisecond).String()
+		}
+		for _, d := range ul.ttfb.recent {
+			dl.RecentTTFB = append(dl.RecentTTFB, d.Milliseconds())
+		}
+		latencies = append(latencies, dl)
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i].Upstream < latencies[j].Upstream
+	})
+	return latencies
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyMetrics(t *testing.T) {
+	ls := newLatencyStats()
+	proxy := &url.URL{Scheme: "http", Host: "proxy.test:8080"}
+	ls.recordConnect(proxy, 3*time.Millisecond)
+	ls.recordTTFB(proxy, 20*time.Millisecond)
+	ls.recordTTFB(proxy, 200*time.Millisecond)
+	ls.recordTTFB(nil, 20*time.Second)
+	var b strings.Builder
+	ls.writeMetrics(&b)
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE alpaca_upstream_connect_seconds histogram",
+		`alpaca_upstream_connect_seconds_bucket{upstream="PROXY proxy.test:8080",le="0.005"} 1`,
+		`alpaca_upstream_connect_seconds_count{upstream="DIRECT"} 0`,
+		`alpaca_upstream_ttfb_seconds_bucket{upstream="PROXY proxy.test:8080",le="0.01"} 0`,
+		`alpaca_upstream_ttfb_seconds_bucket{upstream="PROXY proxy.test:8080",le="0.025"} 1`,
+		`alpaca_upstream_ttfb_seconds_bucket{upstream="PROXY proxy.test:8080",le="0.25"} 2`,
+		`alpaca_upstream_ttfb_seconds_bucket{upstream="PROXY proxy.test:8080",le="+Inf"} 2`,
+		`alpaca_upstream_ttfb_seconds_sum{upstream="PROXY proxy.test:8080"} 0.22`,
+		`alpaca_upstream_ttfb_seconds_bucket{upstream="DIRECT",le="10"} 0`,
+		`alpaca_upstream_ttfb_seconds_bucket{upstream="DIRECT",le="+Inf"} 1`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+	assert.Equal(t, []dashboardLatency{
+		{Upstream: "DIRECT", Requests: 1, TTFB: "20s", RecentTTFB: []int64{20000}},
+		{Upstream: "PROXY proxy.test:8080", Requests: 2, Connect: "3ms", TTFB: "200ms",
+			RecentTTFB: []int64{20, 200}},
+	}, ls.dashboard())
+}
+
+func TestLatencyRecentSamples(t *testing.T) {
+	var h latencyHistogram
+	for i := 1; i <= latencySamples+5; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	assert.Len(t, h.recent, latencySamples)
+	assert.Equal(t, 6*time.Millisecond, h.recent[0])
+	assert.Equal(t, int64(latencySamples+5), h.count)
+}
+
+func TestLatencyTrace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer server.Close()
+	ls := newLatencyStats()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultTransport.RoundTrip(ls.trace(req, nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	ul := ls.upstreams["DIRECT"]
+	require.NotNil(t, ul)
+	assert.Equal(t, int64(1), ul.connect.count)
+	assert.Equal(t, int64(1), ul.ttfb.count)
+	assert.GreaterOrEqual(t, ul.ttfb.sum, 10*time.Millisecond)
+}
@@ -0,0 +1,149 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	leakCheckInterval = time.Minute
+	// leakThreshold is how many more goroutines than there were at the first check (that aren't
+	// accounted for by connections and tunnels) there can be before Alpaca warns about a leak.
+	leakThreshold = 1000
+	// Roughly how many goroutines each tunnel and client connection uses.
+	goroutinesPerTunnel = 3
+	goroutinesPerConn   = 2
+)
+
+// leakDetector watches for goroutine leaks. Most of Alpaca's goroutines belong to a client
+// connection or tunnel, so it counts the goroutines that aren't accounted for by those, and if
+// that number keeps growing, it logs where the most common goroutines were started, to help
+// find what's leaking them.
+type leakDetector struct {
+	tunnels    *tunnelTracker
+	conns      *connTracker
+	goroutines func() int
+	baseline   int // The unaccounted-for goroutines at the first check (-1 before that)
+	warned     int // The excess over the baseline when Alpaca last warned about it
+}
+
+func newLeakDetector(tunnels *tunnelTracker, conns *connTracker) *leakDetector {
+	return &leakDetector{
+		tunnels:    tunnels,
+		conns:      conns,
+		goroutines: runtime.NumGoroutine,
+		baseline:   -1,
+	}
+}
+
+// run checks for leaks every leakCheckInterval, until stop is closed (if ever).
+func (ld *leakDetector) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(leakCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ld.check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// check logs a warning if the unaccounted-for goroutines have grown by more than leakThreshold,
+// and then again each time the excess doubles.
+func (ld *leakDetector) check() {
+	total := ld.goroutines()
+	unaccounted := total - goroutinesPerTunnel*ld.tunnels.count() -
+		goroutinesPerConn*ld.conns.count()
+	if ld.baseline < 0 {
+		ld.baseline = unaccounted
+		return
+	}
+	excess := unaccounted - ld.baseline
+	if excess <= leakThreshold || excess < 2*ld.warned {
+		return
+	}
+	ld.warned = excess
+	var common []string
+	for _, g := range topGoroutines(5) {
+		common = append(common, fmt.Sprintf("%s (%d)", g.function, g.count))
+	}
+	log.Printf("There are %d goroutines, %d more than at startup that aren't accounted for by "+
+		"connections or tunnels, so some may have leaked. Started most often by: %s", total,
+		excess, strings.Join(common, ", "))
+}
+
+type goroutineGroup struct {
+	function string // The function that started the goroutines
+	count    int
+}
+
+// topGoroutines returns the n functions that started the most goroutines that are still running,
+// from the goroutine profile.
+func topGoroutines(n int) []goroutineGroup {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil
+	}
+	// With debug=1, goroutines with the same stack are grouped together, e.g.
+	//   3 @ 0x43e0ce 0x44f2a5 ...
+	//   #	0x6b3ac4	net/http.(*conn).serve+0x5c4	/go/src/net/http/server.go:2039
+	// where the last frame is the function that the goroutines were started with.
+	counts := make(map[string]int)
+	var count int
+	var function string
+	flush := func() {
+		if function != "" {
+			counts[function] += count
+		}
+		count, function = 0, ""
+	}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if before, _, ok := strings.Cut(line, " @ "); ok {
+			flush()
+			count, _ = strconv.Atoi(before)
+		} else if fields := strings.Split(line, "\t"); len(fields) >= 3 && fields[0] == "#" {
+			function, _, _ = strings.Cut(fields[2], "+0x")
+		}
+	}
+	flush()
+	groups := make([]goroutineGroup, 0, len(counts))
+	for function, count := range counts {
+		groups = append(groups, goroutineGroup{function, count})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].count != groups[j].count {
+			return groups[i].count > groups[j].count
+		}
+		return groups[i].function < groups[j].function
+	})
+	if len(groups) > n {
+		groups = groups[:n]
+	}
+	return groups
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeakDetector(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(io.Discard)
+	goroutines := 100
+	ld := newLeakDetector(newTunnelTracker(), newConnTracker())
+	ld.goroutines = func() int { return goroutines }
+	ld.check() // Sets the baseline
+	goroutines += leakThreshold
+	ld.check()
+	assert.Empty(t, buf.String())
+	goroutines++
+	ld.check()
+	assert.Contains(t, buf.String(), "There are 1101 goroutines, 1001 more than at startup")
+	// It only warns again once the excess has doubled.
+	buf.Reset()
+	goroutines += 500
+	ld.check()
+	assert.Empty(t, buf.String())
+	goroutines += 501
+	ld.check()
+	assert.Contains(t, buf.String(), "2002 more than at startup")
+}
+
+func TestTopGoroutines(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	for i := 0; i < 50; i++ {
+		go func() { <-stop }()
+	}
+	// Other tests may have left more goroutines running than this, so look for this test's
+	// group among all of them, rather than expecting it to come first.
+	groups := topGoroutines(math.MaxInt)
+	var ours *goroutineGroup
+	for i, group := range groups {
+		if i > 0 {
+			assert.GreaterOrEqual(t, groups[i-1].count, group.count)
+		}
+		if strings.HasSuffix(group.function, "TestTopGoroutines.func1") {
+			ours = &groups[i]
+		}
+	}
+	require.NotNil(t, ours)
+	assert.GreaterOrEqual(t, ours.count, 50)
+	assert.Len(t, topGoroutines(1), 1)
+}
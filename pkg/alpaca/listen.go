@@ -0,0 +1,124 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listenFlag holds the values of the -l flag, which can be given more than once. Each value can
+// also be a comma-separated list (which is handy in environment variables).
+type listenFlag struct {
+	values []string
+	set    bool // Whether the default has been replaced
+}
+
+func newListenFlag(defaults ...string) *listenFlag {
+	return &listenFlag{values: defaults}
+}
+
+func (lf *listenFlag) String() string {
+	if lf == nil {
+		return ""
+	}
+	return strings.Join(lf.values, ",")
+}
+
+func (lf *listenFlag) Set(value string) error {
+	if !lf.set {
+		lf.values = nil
+		lf.set = true
+	}
+	for _, item := range splitList(value) {
+		if _, err := parseListenAddr(item, 0); err != nil {
+			return err
+		}
+		lf.values = append(lf.values, item)
+	}
+	return nil
+}
+
+// addrs parses the listen addresses, using defaultPort for any that don't include a port.
+func (lf *listenFlag) addrs(defaultPort int) ([]listenAddr, error) {
+	addrs := make([]listenAddr, 0, len(lf.values))
+	for _, value := range lf.values {
+		la, err := parseListenAddr(value, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, la)
+	}
+	return addrs, nil
+}
+
+// listenAddr is an address to listen on, as given by the -l flag.
+type listenAddr struct {
+	host string // A host name or IP address, or empty for all interfaces
+	port int
+}
+
+// parseListenAddr parses a host name or IP address (e.g. "localhost" or "::1"), or a host and
+// port (e.g. "localhost:3128" or "[::1]:3128").
+func parseListenAddr(value string, defaultPort int) (listenAddr, error) {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		// There's no port, so the whole value is the host (possibly a bare IPv6 address).
+		host = value
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+		if strings.ContainsAny(host, "[]") || (strings.Contains(host, ":") &&
+			net.ParseIP(host) == nil) {
+			return listenAddr{}, fmt.Errorf("invalid listen address %q", value)
+		}
+		return listenAddr{host: host, port: defaultPort}, nil
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return listenAddr{}, fmt.Errorf("invalid port in listen address %q", value)
+	}
+	return listenAddr{host: host, port: p}, nil
+}
+
+func (la listenAddr) String() string {
+	return net.JoinHostPort(la.host, strconv.Itoa(la.port))
+}
+
+// bindAddrs returns the addresses to bind to for la. A host name is resolved, and each of its IP
+// addresses are bound to separately (e.g. both 127.0.0.1 and ::1 for localhost), rather than
+// just the first one.
+func (la listenAddr) bindAddrs() ([]string, error) {
+	port := strconv.Itoa(la.port)
+	if la.host == "" || net.ParseIP(la.host) != nil {
+		return []string{net.JoinHostPort(la.host, port)}, nil
+	}
+	ips, err := net.LookupIP(la.host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  listenAddr
+	}{
+		{"localhost", listenAddr{"localhost", 3128}},
+		{"localhost:3129", listenAddr{"localhost", 3129}},
+		{"127.0.0.1", listenAddr{"127.0.0.1", 3128}},
+		{"::1", listenAddr{"::1", 3128}},
+		{"[::1]", listenAddr{"::1", 3128}},
+		{"[::1]:3129", listenAddr{"::1", 3129}},
+		{":3129", listenAddr{"", 3129}},
+		{"", listenAddr{"", 3128}},
+	} {
+		got, err := parseListenAddr(test.value, 3128)
+		require.NoError(t, err, test.value)
+		assert.Equal(t, test.want, got, test.value)
+	}
+	for _, value := range []string{"localhost:http", "localhost:0", "[::1", "a:b:c"} {
+		_, err := parseListenAddr(value, 3128)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestListenFlag(t *testing.T) {
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	lf := newListenFlag("localhost")
+	fs.Var(lf, "l", "")
+	addrs, err := lf.addrs(3128)
+	require.NoError(t, err)
+	assert.Equal(t, []listenAddr{{"localhost", 3128}}, addrs)
+	// Setting the flag replaces the default, rather than adding to it.
+	require.NoError(t, fs.Parse([]string{"-l", "127.0.0.1:3128,[::1]:3128", "-l", "10.0.0.1"}))
+	addrs, err = lf.addrs(3129)
+	require.NoError(t, err)
+	assert.Equal(t, []listenAddr{{"127.0.0.1", 3128}, {"::1", 3128}, {"10.0.0.1", 3129}},
+		addrs)
+	assert.Error(t, fs.Parse([]string{"-l", "localhost:port"}))
+}
+
+func TestListenFlagInConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	lf := newListenFlag("localhost")
+	fs.Var(lf, "l", "")
+	path := writeConfigFile(t, `{"l": ["127.0.0.1:3128", "[::1]:3128"]}`)
+	require.NoError(t, loadConfigFile(fs, path, make(map[string]bool)))
+	assert.Equal(t, "127.0.0.1:3128,[::1]:3128", lf.String())
+}
+
+func TestBindAddrs(t *testing.T) {
+	addrs, err := listenAddr{"::1", 3128}.bindAddrs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"[::1]:3128"}, addrs)
+	addrs, err = listenAddr{"", 3128}.bindAddrs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{":3128"}, addrs)
+	addrs, err = listenAddr{"localhost", 3128}.bindAddrs()
+	require.NoError(t, err)
+	assert.Contains(t, addrs, "127.0.0.1:3128")
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// localNameTTL is how long a local name's address (or the lack of one) is cached for, at most.
+const localNameTTL = time.Minute
+
+// localNameResolver resolves .local host names using mDNS, and single-label host names (e.g.
+// "printer") using LLMNR, for -local-names. Corporate PAC files often send these to the proxy,
+// which can't reach them, and Go's own resolver can't resolve them either (without cgo). Requests
+// for local names go directly, and connections to them use the address from mDNS or LLMNR if
+// there is one, or else the system's resolver. A single-label name that's in the system's DNS
+// (using a search domain) is left to the system's resolver.
+type localNameResolver struct {
+	mdnsAddr  string // The multicast address to send mDNS queries to
+	llmnrAddr string // The multicast address to send LLMNR queries to
+	timeout   time.Duration
+	lookupIP  func(ctx context.Context, network, host string) ([]net.IP, error)
+	now       func() time.Time
+	mux       sync.Mutex
+	cache     map[string]localName
+}
+
+type localName struct {
+	ip      net.IP // nil if the system's resolver should be used
+	expires time.Time
+}
+
+// localNames is used for all outgoing connections. It's set by main if -local-names is given.
+var localNames *localNameResolver
+
+func newLocalNameResolver() *localNameResolver {
+	return &localNameResolver{
+		mdnsAddr:  "224.0.0.251:5353",
+		llmnrAddr: "224.0.0.252:5355",
+		timeout:   time.Second,
+		lookupIP:  net.DefaultResolver.LookupIP,
+		now:       time.Now,
+		cache:     make(map[string]localName),
+	}
+}
+
+// isLocalName returns whether host is a .local or single-label host name (other than localhost).
+func isLocalName(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || host == "localhost" || net.ParseIP(host) != nil {
+		return false
+	}
+	return strings.HasSuffix(host, ".local") || !strings.Contains(host, ".")
+}
+
+// contains returns whether requests for host should go directly.
+func (r *localNameResolver) contains(host string) bool {
+	return r != nil && isLocalName(host)
+}
+
+// lookup returns the address to connect to instead of address (a host and port), if its host is
+// a local name that mDNS or LLMNR has an address for.
+func (r *localNameResolver) lookup(ctx context.Context, address string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || !isLocalName(host) {
+		return "", false
+	}
+	ip := r.resolve(ctx, strings.ToLower(strings.TrimSuffix(host, ".")))
+	if ip == nil {
+		return "", false
+	}
+	return net.JoinHostPort(ip.String(), port), true
+}
+
+func (r *localNameResolver) resolve(ctx context.Context, host string) net.IP {
+	r.mux.Lock()
+	cached, ok := r.cache[host]
+	r.mux.Unlock()
+	if ok && r.now().Before(cached.expires) {
+		return cached.ip
+	}
+	var ip net.IP
+	ttl := localNameTTL
+	if strings.HasSuffix(host, ".local") {
+		ip, ttl = r.query(ctx, r.mdnsAddr, host)
+	} else if ips, err := r.lookupIP(ctx, "ip", host); err != nil || len(ips) == 0 {
+		ip, ttl = r.query(ctx, r.llmnrAddr, host)
+	}
+	if ip == nil {
+		debugf("dns", "No mDNS or LLMNR answer for %s, using the system's resolver", host)
+		ttl = localNameTTL
+	} else {
+		debugf("dns", "Resolved %s to %s using mDNS or LLMNR", host, ip)
+	}
+	r.mux.Lock()
+	r.cache[host] = localName{ip: ip, expires: r.now().Add(min(ttl, localNameTTL))}
+	r.mux.Unlock()
+	return ip
+}
+
+// query sends queries for host's IPv4 and IPv6 addresses to server (an mDNS or LLMNR multicast
+// address), and returns the first address that's answered, and its TTL. It returns nil if there
+// isn't an answer before the timeout. Since the queries aren't sent from port 5353, mDNS
+// responders answer them directly (as "legacy unicast" queries), like LLMNR responders do.
+func (r *localNameResolver) query(ctx context.Context, server, host string) (net.IP,
+	time.Duration) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0
+	}
+	dst, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, 0
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, 0
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	id := uint16(rand.Uint32())
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg := dnsmessage.Message{
+			Header: dnsmessage.Header{ID: id},
+			Questions: []dnsmessage.Question{
+				{Name: name, Type: qtype, Class: dnsmessage.ClassINET},
+			},
+		}
+		buf, err := msg.Pack()
+		if err != nil {
+			return nil, 0
+		}
+		if _, err := conn.WriteToUDP(buf, dst); err != nil {
+			debugf("dns", "Error sending query for %s to %s: %v", host, server, err)
+			return nil, 0
+		}
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, 0
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response || msg.ID != id {
+			continue
+		}
+		for _, answer := range msg.Answers {
+			if !strings.EqualFold(answer.Header.Name.String(), name.String()) {
+				continue
+			}
+			ttl := time.Duration(answer.Header.TTL) * time.Second
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				return net.IP(body.A[:]), ttl
+			case *dnsmessage.AAAAResource:
+				// A link-local address can't be used without knowing its interface.
+				if ip := net.IP(body.AAAA[:]); !ip.IsLinkLocalUnicast() {
+					return ip, ttl
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestIsLocalName(t *testing.T) {
+	tests := []struct {
+		host  string
+		local bool
+	}{
+		{"printer.local", true},
+		{"Printer.Local.", true},
+		{"nas", true},
+		{"localhost", false},
+		{"www.example.com", false},
+		{"local", true},
+		{"192.0.2.1", false},
+		{"::1", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.local, isLocalName(test.host), test.host)
+	}
+}
+
+// localNameResponder answers A queries for any name with 192.0.2.7, like an mDNS or LLMNR
+// responder would. It counts the A queries that it gets.
+func localNameResponder(t *testing.T, queries *atomic.Int32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			q := msg.Questions[0]
+			if q.Type != dnsmessage.TypeA {
+				continue
+			}
+			queries.Add(1)
+			// An answer to some other query, which should be ignored.
+			other := dnsmessage.Message{Header: dnsmessage.Header{ID: msg.ID + 1, Response: true}}
+			if resp, err := other.Pack(); err == nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+			msg.Response = true
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 120,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 7}},
+			}}
+			if resp, err := msg.Pack(); err == nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestLocalNameLookup(t *testing.T) {
+	var queries atomic.Int32
+	r := newLocalNameResolver()
+	r.mdnsAddr = localNameResponder(t, &queries)
+	r.llmnrAddr = r.mdnsAddr
+	r.lookupIP = func(_ context.Context, _, host string) ([]net.IP, error) {
+		if host == "intranet" {
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	ctx := context.Background()
+
+	addr, ok := r.lookup(ctx, "printer.local:631")
+	require.True(t, ok)
+	assert.Equal(t, "192.0.2.7:631", addr)
+	assert.Equal(t, int32(1), queries.Load())
+	addr, ok = r.lookup(ctx, "PRINTER.local.:80")
+	require.True(t, ok)
+	assert.Equal(t, "192.0.2.7:80", addr)
+	assert.Equal(t, int32(1), queries.Load(), "the answer should be cached")
+
+	addr, ok = r.lookup(ctx, "nas:443")
+	require.True(t, ok)
+	assert.Equal(t, "192.0.2.7:443", addr)
+	// Single-label names that are in DNS use the system's resolver, without asking LLMNR.
+	_, ok = r.lookup(ctx, "intranet:80")
+	assert.False(t, ok)
+	assert.Equal(t, int32(2), queries.Load())
+	_, ok = r.lookup(ctx, "www.example.com:80")
+	assert.False(t, ok)
+
+	// Answers expire after a minute, rather than their TTL.
+	now := time.Now().Add(localNameTTL)
+	r.now = func() time.Time { return now }
+	_, ok = r.lookup(ctx, "printer.local:631")
+	assert.True(t, ok)
+	assert.Equal(t, int32(3), queries.Load())
+}
+
+func TestLocalNameTimeout(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	r := newLocalNameResolver()
+	r.mdnsAddr = silent.LocalAddr().String()
+	r.timeout = 50 * time.Millisecond
+	_, ok := r.lookup(context.Background(), "printer.local:80")
+	assert.False(t, ok)
+}
+
+func TestFindProxyForLocalNames(t *testing.T) {
+	defer func(r *localNameResolver) { localNames = r }(localNames)
+	localNames = newLocalNameResolver()
+	server := httptest.NewServer(pacjsHandler(`function FindProxyForURL(url, host) {
+		return "PROXY proxy.test:8080";
+	}`))
+	defer server.Close()
+	pf := NewProxyFinder([]string{server.URL}, NewPACWrapper(PACData{Port: 1}), myIPAuto)
+	for host, want := range map[string]string{
+		"printer.local":   "DIRECT",
+		"nas":             "DIRECT",
+		"www.example.com": "PROXY proxy.test:8080",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		proxy, err := pf.findProxyForRequest(req)
+		require.NoError(t, err)
+		assert.Equal(t, want, proxyString(proxy), host)
+	}
+}
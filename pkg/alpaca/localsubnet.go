@@ -0,0 +1,81 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+)
+
+// Subnets larger than these are ignored, so that (for example) a VPN interface with a /8 address
+// doesn't cause the entire corporate network to be accessed directly.
+const (
+	minLocalPrefixIPv4 = 16
+	minLocalPrefixIPv6 = 64
+)
+
+// localSubnets checks whether a host is on the same subnet as one of this machine's network
+// interfaces. Many corporate PAC files send such requests to a remote proxy, which breaks access
+// to printers, NAS devices and the like.
+type localSubnets struct {
+	getAddrs func() ([]net.Addr, error)
+	lookupIP func(host string) ([]net.IP, error)
+}
+
+func newLocalSubnets() *localSubnets {
+	return &localSubnets{getAddrs: net.InterfaceAddrs, lookupIP: net.LookupIP}
+}
+
+func (ls *localSubnets) subnets() []*net.IPNet {
+	addrs, err := ls.getAddrs()
+	if err != nil {
+		return nil
+	}
+	var subnets []*net.IPNet
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		ones, bits := ipnet.Mask.Size()
+		if (bits == 8*net.IPv4len && ones < minLocalPrefixIPv4) ||
+			(bits == 8*net.IPv6len && ones < minLocalPrefixIPv6) {
+			continue
+		}
+		subnets = append(subnets, ipnet)
+	}
+	return subnets
+}
+
+// contains returns true if any of the addresses that the host resolves to is on a local subnet.
+func (ls *localSubnets) contains(host string) bool {
+	subnets := ls.subnets()
+	if len(subnets) == 0 {
+		return false
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if resolved, err := ls.lookupIP(host); err == nil {
+		ips = resolved
+	}
+	for _, ip := range ips {
+		for _, subnet := range subnets {
+			if subnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeLocalSubnets(t *testing.T, cidrs ...string) *localSubnets {
+	var addrs []net.Addr
+	for _, cidr := range cidrs {
+		ip, ipnet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ipnet.IP = ip
+		addrs = append(addrs, ipnet)
+	}
+	hosts := map[string][]net.IP{
+		"printer.test": {net.ParseIP("192.168.1.20")},
+		"remote.test":  {net.ParseIP("203.0.113.1")},
+	}
+	return &localSubnets{
+		getAddrs: func() ([]net.Addr, error) { return addrs, nil },
+		lookupIP: func(host string) ([]net.IP, error) {
+			if ips, ok := hosts[host]; ok {
+				return ips, nil
+			}
+			return nil, errors.New("no such host")
+		},
+	}
+}
+
+func TestLocalSubnets(t *testing.T) {
+	ls := fakeLocalSubnets(t, "127.0.0.1/8", "192.168.1.10/24", "10.1.2.3/8", "fd00::1/64")
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{"192.168.1.1", true},
+		{"192.168.2.1", false},
+		{"printer.test", true},
+		{"remote.test", false},
+		{"nonexistent.test", false},
+		{"fd00::2", true},
+		{"fd01::2", false},
+		// Loopback addresses and subnets that are too big are ignored.
+		{"127.0.0.2", false},
+		{"10.9.9.9", false},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			assert.Equal(t, test.expected, ls.contains(test.host))
+		})
+	}
+}
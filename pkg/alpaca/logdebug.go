@@ -0,0 +1,64 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// The subsystems that debug logging can be enabled for (using the -log-debug flag).
+var debugSubsystems = []string{"auth", "dns", "pac", "socks", "transparent"}
+
+// The subsystems that debug logging is enabled for. It's only changed before Alpaca starts
+// serving requests.
+var debugEnabled = make(map[string]bool)
+
+// setLogDebug enables debug logging for a comma-separated list of subsystems, or for all of them
+// if the list is "all".
+func setLogDebug(list string) error {
+	enabled := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		} else if name == "all" {
+			for _, subsystem := range debugSubsystems {
+				enabled[subsystem] = true
+			}
+		} else if slices.Contains(debugSubsystems, name) {
+			enabled[name] = true
+		} else {
+			return fmt.Errorf("unknown subsystem %q in -log-debug (expected \"all\" or one of %s)",
+				name, strings.Join(debugSubsystems, ", "))
+		}
+	}
+	debugEnabled = enabled
+	return nil
+}
+
+// debugf logs a message if debug logging is enabled for the subsystem. The subsystem's name is
+// added after the request ID (if the message starts with one), so that the line is still
+// recognised as belonging to that request.
+func debugf(subsystem, format string, args ...any) {
+	if !debugEnabled[subsystem] {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	id := requestID.FindString(msg)
+	_ = log.Output(2, id+subsystem+": "+msg[len(id):])
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetLogDebug(t *testing.T) {
+	defer func() { require.NoError(t, setLogDebug("")) }()
+	require.NoError(t, setLogDebug("pac, SOCKS"))
+	assert.Equal(t, map[string]bool{"pac": true, "socks": true}, debugEnabled)
+	require.NoError(t, setLogDebug("all"))
+	assert.Equal(t, map[string]bool{
+		"auth": true, "dns": true, "pac": true, "socks": true, "transparent": true,
+	}, debugEnabled)
+	assert.ErrorContains(t, setLogDebug("pac,tls"), `unknown subsystem "tls"`)
+	assert.Len(t, debugEnabled, 5, "a bad list shouldn't change which subsystems are enabled")
+	require.NoError(t, setLogDebug(""))
+	assert.Empty(t, debugEnabled)
+}
+
+func TestDebugf(t *testing.T) {
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(io.Discard)
+		log.SetFlags(flags)
+		require.NoError(t, setLogDebug(""))
+	}()
+	require.NoError(t, setLogDebug("auth"))
+	debugf("auth", "[%d] Sending NTLM Type 1 (Negotiate) message using %s", 7, "NTLM")
+	debugf("pac", "FindProxyForURL(%q) returned %q", "http://example.com/", "DIRECT")
+	debugf("auth", "Using %s auth", "ntlm")
+	assert.Equal(t, "[7] auth: Sending NTLM Type 1 (Negotiate) message using NTLM\n"+
+		"auth: Using ntlm auth\n", buf.String())
+}
@@ -0,0 +1,214 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// The values accepted by the -log-format flag.
+const (
+	logFormatAuto   = "auto"   // pretty if stderr is a terminal, plain otherwise
+	logFormatPlain  = "plain"  // the standard log package format, suitable for files
+	logFormatPretty = "pretty" // a concise, colourful format for humans
+	logFormatText   = "text"   // like pretty, but without colours or cursor movement
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+	// Moves the cursor to the start of the previous line, and clears it.
+	ansiRewriteLine = "\x1b[1A\x1b[2K\r"
+)
+
+// setLogFormat configures the log package to write to stderr in the given format.
+func setLogFormat(format string) error {
+	switch format {
+	case logFormatAuto:
+		if !term.IsTerminal(int(os.Stderr.Fd())) {
+			return setLogFormat(logFormatPlain)
+		} else if _, noColor := os.LookupEnv("NO_COLOR"); noColor || os.Getenv("TERM") == "dumb" {
+			return setLogFormat(logFormatText)
+		}
+		return setLogFormat(logFormatPretty)
+	case logFormatPlain:
+		log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
+		log.SetOutput(os.Stderr)
+	case logFormatPretty:
+		log.SetFlags(0)
+		log.SetOutput(newPrettyWriter(os.Stderr, ansiTheme))
+	case logFormatText:
+		log.SetFlags(0)
+		log.SetOutput(newPrettyWriter(os.Stderr, textTheme))
+	default:
+		return fmt.Errorf("unknown log format %q (expected %q, %q, %q or %q)", format,
+			logFormatAuto, logFormatPlain, logFormatPretty, logFormatText)
+	}
+	return nil
+}
+
+// logRole is what a part of a pretty log line means, which a logTheme can show in its own way
+// (e.g. using colour).
+type logRole int
+
+const (
+	roleText     logRole = iota
+	roleMuted            // Timestamps and request IDs
+	roleSuccess          // 2xx statuses
+	roleRedirect         // 3xx statuses
+	roleWarning          // 4xx statuses
+	roleError            // 5xx statuses, and errors
+)
+
+// logSpan is a part of a pretty log line.
+type logSpan struct {
+	role  logRole
+	text  string
+	width int // If the theme aligns columns, the text is padded to this width (left-aligned if < 0)
+}
+
+// logTheme determines how prettyWriter shows log lines.
+type logTheme struct {
+	colors map[logRole]string // ANSI escape codes for each role
+	align  bool               // Whether to pad spans into columns
+	// If set, a repeated line replaces the previous one, with a counter. Otherwise, repeats are
+	// left out, and the number of them is given once a different line is logged.
+	rewrite bool
+}
+
+// ansiTheme is for terminals, and uses colour and cursor movement.
+var ansiTheme = logTheme{
+	colors: map[logRole]string{
+		roleMuted:    ansiDim,
+		roleSuccess:  ansiGreen,
+		roleRedirect: ansiCyan,
+		roleWarning:  ansiYellow,
+		roleError:    ansiRed,
+	},
+	align:   true,
+	rewrite: true,
+}
+
+// textTheme writes plain text, with nothing that's only conveyed by colour, layout or rewriting
+// lines, so that it's readable with a screen reader (or with $NO_COLOR set).
+var textTheme = logTheme{}
+
+// render joins the spans into a line.
+func (t logTheme) render(spans []logSpan) string {
+	parts := make([]string, len(spans))
+	for i, span := range spans {
+		text := span.text
+		if t.align && span.width != 0 {
+			text = fmt.Sprintf("%*s", span.width, text)
+		}
+		if color := t.colors[span.role]; color != "" {
+			text = color + text + ansiReset
+		}
+		parts[i] = text
+	}
+	return strings.Join(parts, " ")
+}
+
+// Matches the lines written by RequestLogger, e.g. "[12] 200 GET /alpaca.pac".
+var requestLogLine = regexp.MustCompile(`^\[(\d+)\] (\d{3}) (\S+) (.*)$`)
+
+// Matches the request ID at the start of a line.
+var requestID = regexp.MustCompile(`^\[\d+\] `)
+
+// prettyWriter reformats log lines for a terminal: timestamps are shortened, request log lines are
+// aligned into columns and colour-coded by status, and runs of repeated lines (e.g. a browser
+// polling for the PAC file) are collapsed into one line with a counter (depending on the theme).
+type prettyWriter struct {
+	w       io.Writer
+	theme   logTheme
+	now     func() time.Time
+	last    string // The previous line, without its request ID
+	repeats int
+}
+
+func newPrettyWriter(w io.Writer, theme logTheme) *prettyWriter {
+	return &prettyWriter{w: w, theme: theme, now: time.Now}
+}
+
+// Write is called by the log package once per line (and never concurrently).
+func (pw *prettyWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	key := requestID.ReplaceAllString(line, "")
+	timestamp := logSpan{role: roleMuted, text: pw.now().Format("15:04:05")}
+	out := ""
+	if key == pw.last {
+		pw.repeats++
+		if !pw.theme.rewrite {
+			return len(p), nil
+		}
+		out = ansiRewriteLine
+	} else {
+		if pw.repeats > 1 && !pw.theme.rewrite {
+			out = pw.theme.render([]logSpan{timestamp, {role: roleMuted,
+				text: fmt.Sprintf("(the previous line was repeated %d times)", pw.repeats-1)}})
+			out += "\n"
+		}
+		pw.last = key
+		pw.repeats = 1
+	}
+	spans := append([]logSpan{timestamp}, prettySpans(line)...)
+	if pw.repeats > 1 {
+		spans = append(spans, logSpan{role: roleMuted, text: fmt.Sprintf("(x%d)", pw.repeats)})
+	}
+	if _, err := io.WriteString(pw.w, out+pw.theme.render(spans)+"\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// prettySpans splits a log line into spans.
+func prettySpans(line string) []logSpan {
+	if m := requestLogLine.FindStringSubmatch(line); m != nil {
+		return []logSpan{
+			{role: roleMuted, text: "[" + m[1] + "]", width: 6},
+			{role: statusRole(m[2]), text: m[2]},
+			{role: roleText, text: m[3], width: -7},
+			{role: roleText, text: m[4]},
+		}
+	} else if strings.Contains(line, "Error") {
+		return []logSpan{{role: roleError, text: line}}
+	}
+	return []logSpan{{role: roleText, text: line}}
+}
+
+func statusRole(status string) logRole {
+	switch status[0] {
+	case '2':
+		return roleSuccess
+	case '3':
+		return roleRedirect
+	case '4':
+		return roleWarning
+	default:
+		return roleError
+	}
+}
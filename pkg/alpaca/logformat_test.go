@@ -0,0 +1,94 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPrettyWriter() (*prettyWriter, *bytes.Buffer) {
+	return newTestPrettyWriterWithTheme(ansiTheme)
+}
+
+func newTestPrettyWriterWithTheme(theme logTheme) (*prettyWriter, *bytes.Buffer) {
+	var buf bytes.Buffer
+	pw := newPrettyWriter(&buf, theme)
+	pw.now = func() time.Time { return time.Date(2024, 1, 1, 12, 34, 56, 0, time.UTC) }
+	return pw, &buf
+}
+
+func TestPrettyRequestLine(t *testing.T) {
+	pw, buf := newTestPrettyWriter()
+	_, err := pw.Write([]byte("[12] 404 GET /nonexistent\n"))
+	require.NoError(t, err)
+	expected := ansiDim + "12:34:56" + ansiReset + " " + ansiDim + "  [12]" + ansiReset + " " +
+		ansiYellow + "404" + ansiReset + " GET     /nonexistent\n"
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestPrettyErrorLine(t *testing.T) {
+	pw, buf := newTestPrettyWriter()
+	_, err := pw.Write([]byte("[3] Error dialling host example.com: refused\n"))
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), ansiRed+"[3] Error dialling host")
+}
+
+func TestPrettyCollapsesRepeatedLines(t *testing.T) {
+	pw, buf := newTestPrettyWriter()
+	for _, line := range []string{
+		"[1] 200 GET /alpaca.pac\n",
+		"[2] 200 GET /alpaca.pac\n",
+		"[3] 200 GET /alpaca.pac\n",
+		"[4] 200 GET /alpaca/api/status\n",
+	} {
+		_, err := pw.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.NotContains(t, lines[0], "(x")
+	assert.True(t, strings.HasPrefix(lines[1], ansiRewriteLine))
+	assert.Contains(t, lines[1], "(x2)")
+	assert.True(t, strings.HasPrefix(lines[2], ansiRewriteLine))
+	assert.Contains(t, lines[2], "(x3)")
+	assert.False(t, strings.HasPrefix(lines[3], ansiRewriteLine))
+	assert.Contains(t, lines[3], "/alpaca/api/status")
+}
+
+func TestTextTheme(t *testing.T) {
+	pw, buf := newTestPrettyWriterWithTheme(textTheme)
+	for _, line := range []string{
+		"[1] 200 GET /alpaca.pac\n",
+		"[2] 200 GET /alpaca.pac\n",
+		"[3] 200 GET /alpaca.pac\n",
+		"[4] Error dialling host example.com: refused\n",
+	} {
+		_, err := pw.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "12:34:56 [1] 200 GET /alpaca.pac\n"+
+		"12:34:56 (the previous line was repeated 2 times)\n"+
+		"12:34:56 [4] Error dialling host example.com: refused\n", buf.String())
+}
+
+func TestSetLogFormatInvalid(t *testing.T) {
+	assert.Error(t, setLogFormat("xml"))
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// The values accepted by the -log-privacy flag.
+const (
+	logPrivacyOff      = "off"      // log URLs in full
+	logPrivacyQuery    = "query"    // leave out query strings (and fragments)
+	logPrivacyTruncate = "truncate" // only log the scheme, host and port
+	logPrivacyHash     = "hash"     // like truncate, but with the host name hashed
+)
+
+// The -log-privacy mode, which is only changed before Alpaca starts serving requests.
+var logPrivacy = logPrivacyOff
+
+// logHashKey is a random key for hashing host names, so that the same host has the same hash
+// for as long as Alpaca is running (and so requests to it can be followed in the log), but the
+// hashes can't be reversed by hashing a list of likely host names.
+var logHashKey []byte
+
+func setLogPrivacy(mode string) error {
+	switch mode {
+	case logPrivacyOff, logPrivacyQuery, logPrivacyTruncate:
+	case logPrivacyHash:
+		logHashKey = make([]byte, 32)
+		if _, err := rand.Read(logHashKey); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown log privacy mode %q (expected %q, %q, %q or %q)", mode,
+			logPrivacyOff, logPrivacyQuery, logPrivacyTruncate, logPrivacyHash)
+	}
+	logPrivacy = mode
+	return nil
+}
+
+// logURL returns a URL as it should be logged, according to the -log-privacy mode.
+func logURL(u *url.URL) string {
+	if logPrivacy == logPrivacyOff {
+		return u.Redacted()
+	}
+	logged := &url.URL{Scheme: u.Scheme, Host: u.Host}
+	switch logPrivacy {
+	case logPrivacyQuery:
+		logged.Path, logged.RawPath = u.Path, u.RawPath
+		logged.Opaque = u.Opaque
+	case logPrivacyHash:
+		logged.Host = logHost(u.Host)
+	}
+	return logged.String()
+}
+
+// logHost returns a host (and optional port) as it should be logged. Only the hash mode of
+// -log-privacy changes it.
+func logHost(host string) string {
+	if logPrivacy != logPrivacyHash {
+		return host
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return hashHost(host)
+	}
+	return net.JoinHostPort(hashHost(name), port)
+}
+
+// hashHost returns an (unreversible) name for a host, e.g. "h-3f2a0c9be41d".
+func hashHost(host string) string {
+	mac := hmac.New(sha256.New, logHashKey)
+	mac.Write([]byte(strings.ToLower(host)))
+	return "h-" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
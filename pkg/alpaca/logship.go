@@ -0,0 +1,312 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The values accepted by the -log-endpoint-format flag.
+const (
+	logShipJSON = "json" // A JSON array of logRecords
+	logShipOTLP = "otlp" // OpenTelemetry logs, using the OTLP/HTTP JSON encoding
+)
+
+const (
+	logShipBatchSize  = 500              // The maximum number of records sent at once
+	logShipMaxBackoff = 5 * time.Minute  // The maximum delay between failed attempts
+	logShipTimeout    = 30 * time.Second // The timeout for each request to the endpoint
+)
+
+// Matches the date, time and file name that the log package adds with the plain log format.
+var logLinePrefix = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? (\S+:\d+: )?`)
+
+// logRecord is a structured log line. Lines written by RequestLogger are split into fields, so
+// that (for example) error rates can be worked out without parsing the message.
+type logRecord struct {
+	Time      time.Time `json:"time"`
+	Severity  string    `json:"severity"`
+	Message   string    `json:"message"`
+	Host      string    `json:"host"`
+	Version   string    `json:"version,omitempty"`
+	RequestID int       `json:"request_id,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	URL       string    `json:"url,omitempty"`
+}
+
+// logShipper sends log lines to a central endpoint (given by -log-endpoint), so that IT can keep
+// an eye on every Alpaca instance without having to collect logs from each machine. Lines are
+// buffered and sent in batches; if the endpoint can't be reached, they're kept (up to a limit,
+// after which the oldest ones are dropped) and sent again later, backing off exponentially.
+type logShipper struct {
+	endpoint string
+	format   string
+	interval time.Duration // How often to send buffered lines
+	limit    int           // The maximum number of lines to buffer
+	client   *http.Client
+	host     string
+	now      func() time.Time
+	records  []logRecord
+	dropped  int // The number of lines dropped since the last successful send
+	mux      sync.Mutex
+}
+
+func newLogShipper(endpoint, format string, interval time.Duration, limit int) (*logShipper,
+	error) {
+	if format != logShipJSON && format != logShipOTLP {
+		return nil, fmt.Errorf("unknown log endpoint format %q (expected %q or %q)", format,
+			logShipJSON, logShipOTLP)
+	}
+	host, _ := os.Hostname()
+	return &logShipper{
+		endpoint: endpoint,
+		format:   format,
+		interval: interval,
+		limit:    limit,
+		// The endpoint is expected to be on the internal network, so don't use a proxy.
+		client: &http.Client{Transport: &http.Transport{}, Timeout: logShipTimeout},
+		host:   host,
+		now:    time.Now,
+	}, nil
+}
+
+// Write is called by the log package once per line. It mustn't log anything itself, since the
+// log package holds a lock while calling it.
+func (ls *logShipper) Write(p []byte) (int, error) {
+	line := logLinePrefix.ReplaceAllString(strings.TrimSuffix(string(p), "\n"), "")
+	record := logRecord{
+		Time:     ls.now(),
+		Severity: "INFO",
+		Message:  line,
+		Host:     ls.host,
+		Version:  BuildVersion,
+	}
+	if m := requestLogLine.FindStringSubmatch(line); m != nil {
+		record.RequestID, _ = strconv.Atoi(m[1])
+		record.Status, _ = strconv.Atoi(m[2])
+		record.Method = m[3]
+		record.URL = m[4]
+	}
+	if strings.Contains(line, "Error") || record.Status >= 500 {
+		record.Severity = "ERROR"
+	}
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	ls.records = append(ls.records, record)
+	ls.trim()
+	return len(p), nil
+}
+
+// trim drops the oldest records, if there are more than the limit.
+func (ls *logShipper) trim() {
+	if excess := len(ls.records) - ls.limit; excess > 0 {
+		ls.records = ls.records[excess:]
+		ls.dropped += excess
+	}
+}
+
+// run sends buffered lines to the endpoint until stop is closed.
+func (ls *logShipper) run(stop <-chan struct{}) {
+	delay := ls.interval
+	failing := false
+	for {
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		}
+		err := ls.flush()
+		if err == nil {
+			if failing {
+				log.Printf("Sending logs to %s again", ls.endpoint)
+			}
+			failing = false
+			delay = ls.interval
+			continue
+		}
+		// Only log the first failure, since the message itself would need to be sent too.
+		if !failing {
+			log.Printf("Error sending logs to %s, will keep retrying: %v", ls.endpoint, err)
+		}
+		failing = true
+		delay = min(delay*2, logShipMaxBackoff)
+	}
+}
+
+// flush sends all of the buffered lines to the endpoint, in batches.
+func (ls *logShipper) flush() error {
+	for {
+		ls.mux.Lock()
+		n := min(len(ls.records), logShipBatchSize)
+		batch := ls.records[:n:n]
+		ls.records = ls.records[n:]
+		dropped := ls.dropped
+		ls.mux.Unlock()
+		if n == 0 {
+			return nil
+		}
+		if dropped > 0 {
+			batch = append(batch, logRecord{
+				Time:     ls.now(),
+				Severity: "WARN",
+				Message:  fmt.Sprintf("Dropped %d log lines while the endpoint was down", dropped),
+				Host:     ls.host,
+				Version:  BuildVersion,
+			})
+		}
+		if err := ls.send(batch); err != nil {
+			// Put the batch back, in front of anything that's been logged since.
+			ls.mux.Lock()
+			ls.records = append(batch[:n:n], ls.records...)
+			ls.trim()
+			ls.mux.Unlock()
+			return err
+		}
+		ls.mux.Lock()
+		ls.dropped -= dropped
+		ls.mux.Unlock()
+	}
+}
+
+func (ls *logShipper) send(records []logRecord) error {
+	var body any = records
+	if ls.format == logShipOTLP {
+		body = otlpLogs(records, ls.host)
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := ls.client.Post(ls.endpoint, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// The types below are the parts of the OTLP/HTTP JSON encoding of logs that Alpaca uses (see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding).
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string          `json:"timeUnixNano"`
+	SeverityNumber int             `json:"severityNumber"`
+	SeverityText   string          `json:"severityText"`
+	Body           otlpValue       `json:"body"`
+	Attributes     []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // 64-bit ints are encoded as strings
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{key, otlpValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int) otlpAttribute {
+	s := strconv.Itoa(value)
+	return otlpAttribute{key, otlpValue{IntValue: &s}}
+}
+
+func otlpBool(key string, value bool) otlpAttribute {
+	return otlpAttribute{key, otlpValue{BoolValue: &value}}
+}
+
+// The OpenTelemetry severity numbers for each of the severities that Alpaca uses.
+var otlpSeverity = map[string]int{"INFO": 9, "WARN": 13, "ERROR": 17}
+
+func otlpLogs(records []logRecord, host string) otlpLogsRequest {
+	logRecords := make([]otlpLogRecord, 0, len(records))
+	for _, r := range records {
+		message := r.Message
+		lr := otlpLogRecord{
+			TimeUnixNano:   strconv.FormatInt(r.Time.UnixNano(), 10),
+			SeverityNumber: otlpSeverity[r.Severity],
+			SeverityText:   r.Severity,
+			Body:           otlpValue{StringValue: &message},
+		}
+		if r.Status != 0 {
+			lr.Attributes = []otlpAttribute{
+				otlpInt("alpaca.request_id", r.RequestID),
+				otlpInt("http.response.status_code", r.Status),
+				otlpString("http.request.method", r.Method),
+				otlpString("url.full", r.URL),
+			}
+		}
+		logRecords = append(logRecords, lr)
+	}
+	resource := otlpResource{Attributes: []otlpAttribute{
+		otlpString("service.name", "alpaca"),
+		otlpString("host.name", host),
+	}}
+	if BuildVersion != "" {
+		resource.Attributes = append(resource.Attributes,
+			otlpString("service.version", BuildVersion))
+	}
+	return otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: resource,
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: "alpaca", Version: BuildVersion},
+			LogRecords: logRecords,
+		}},
+	}}}
+}
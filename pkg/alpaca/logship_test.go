@@ -0,0 +1,138 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLogEndpoint returns a server that records the bodies of the requests sent to it, and
+// fails them while *down is true.
+func newTestLogEndpoint(t *testing.T, down *bool) (*httptest.Server, *[]json.RawMessage) {
+	var bodies []json.RawMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if *down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var body json.RawMessage
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		bodies = append(bodies, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &bodies
+}
+
+func TestLogShipperRecords(t *testing.T) {
+	down := false
+	server, bodies := newTestLogEndpoint(t, &down)
+	ls, err := newLogShipper(server.URL, logShipJSON, time.Minute, 100)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ls.now = func() time.Time { return now }
+	ls.host = "laptop"
+	fmt.Fprintln(ls, "2024/01/02 03:04:05.123456 main.go:42: Listening on 127.0.0.1:3128")
+	fmt.Fprintln(ls, "[7] 502 GET http://www.test/")
+	fmt.Fprintln(ls, "Error downloading PAC file")
+	require.NoError(t, ls.flush())
+	require.Len(t, *bodies, 1)
+	var records []logRecord
+	require.NoError(t, json.Unmarshal((*bodies)[0], &records))
+	assert.Equal(t, []logRecord{
+		{Time: now, Severity: "INFO", Message: "Listening on 127.0.0.1:3128", Host: "laptop"},
+		{Time: now, Severity: "ERROR", Message: "[7] 502 GET http://www.test/", Host: "laptop",
+			RequestID: 7, Status: 502, Method: "GET", URL: "http://www.test/"},
+		{Time: now, Severity: "ERROR", Message: "Error downloading PAC file", Host: "laptop"},
+	}, records)
+	// There's nothing left to send.
+	require.NoError(t, ls.flush())
+	assert.Len(t, *bodies, 1)
+}
+
+func TestLogShipperBuffersWhileDown(t *testing.T) {
+	down := true
+	server, bodies := newTestLogEndpoint(t, &down)
+	ls, err := newLogShipper(server.URL, logShipJSON, time.Minute, 3)
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		fmt.Fprintf(ls, "line %d\n", i)
+	}
+	assert.Error(t, ls.flush())
+	for i := 3; i <= 5; i++ {
+		fmt.Fprintf(ls, "line %d\n", i)
+	}
+	down = false
+	require.NoError(t, ls.flush())
+	require.Len(t, *bodies, 1)
+	var records []logRecord
+	require.NoError(t, json.Unmarshal((*bodies)[0], &records))
+	var messages []string
+	for _, r := range records {
+		messages = append(messages, r.Message)
+	}
+	assert.Equal(t, []string{
+		"line 3",
+		"line 4",
+		"line 5",
+		"Dropped 2 log lines while the endpoint was down",
+	}, messages)
+	assert.Zero(t, ls.dropped)
+}
+
+func TestLogShipperOTLP(t *testing.T) {
+	down := false
+	server, bodies := newTestLogEndpoint(t, &down)
+	ls, err := newLogShipper(server.URL, logShipOTLP, time.Minute, 100)
+	require.NoError(t, err)
+	ls.now = func() time.Time { return time.Unix(1700000000, 0) }
+	ls.host = "laptop"
+	fmt.Fprintln(ls, "[7] 200 GET http://www.test/")
+	require.NoError(t, ls.flush())
+	require.Len(t, *bodies, 1)
+	assert.JSONEq(t, `{"resourceLogs": [{
+		"resource": {"attributes": [
+			{"key": "service.name", "value": {"stringValue": "alpaca"}},
+			{"key": "host.name", "value": {"stringValue": "laptop"}}
+		]},
+		"scopeLogs": [{
+			"scope": {"name": "alpaca"},
+			"logRecords": [{
+				"timeUnixNano": "1700000000000000000",
+				"severityNumber": 9,
+				"severityText": "INFO",
+				"body": {"stringValue": "[7] 200 GET http://www.test/"},
+				"attributes": [
+					{"key": "alpaca.request_id", "value": {"intValue": "7"}},
+					{"key": "http.response.status_code", "value": {"intValue": "200"}},
+					{"key": "http.request.method", "value": {"stringValue": "GET"}},
+					{"key": "url.full", "value": {"stringValue": "http://www.test/"}}
+				]
+			}]
+		}]
+	}]}`, string((*bodies)[0]))
+}
+
+func TestLogShipperInvalidFormat(t *testing.T) {
+	_, err := newLogShipper("http://logs.test", "xml", time.Minute, 100)
+	assert.Error(t, err)
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// If Alpaca is misconfigured so that it sends requests to itself (e.g. because -C points at its
+// own alpaca.pac, or the upstream proxy forwards requests back to Alpaca), each request would
+// loop until the process runs out of file descriptors. To detect this, a Via header is added to
+// requests sent to an upstream proxy, identifying this instance of Alpaca, and requests that
+// already have one are rejected.
+
+// newViaPseudonym returns a name to identify an instance of Alpaca in Via headers. It's random,
+// so that chaining one instance of Alpaca to another (e.g. on another machine) isn't mistaken
+// for a loop.
+func newViaPseudonym() string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return "alpaca-" + hex.EncodeToString(buf)
+}
+
+// addVia adds pseudonym to the Via header of a request (see RFC 9110, section 7.6.3).
+func addVia(req *http.Request, pseudonym string) {
+	req.Header.Add("Via", req.Proto[strings.Index(req.Proto, "/")+1:]+" "+pseudonym)
+}
+
+// isLoop returns whether req has already been through the instance of Alpaca with pseudonym.
+func isLoop(req *http.Request, pseudonym string) bool {
+	for _, value := range req.Header.Values("Via") {
+		for _, hop := range strings.Split(value, ",") {
+			// Each hop is the protocol, the pseudonym, and an optional comment.
+			if fields := strings.Fields(hop); len(fields) >= 2 && fields[1] == pseudonym {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLoopingProxy returns a proxy server that uses itself as its upstream proxy.
+func newLoopingProxy() *httptest.Server {
+	var handler http.Handler
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+	}))
+	handler = newChildProxy(proxy)
+	return proxy
+}
+
+func TestIsLoop(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	assert.False(t, isLoop(req, "alpaca-1234"))
+	addVia(req, "alpaca-5678")
+	assert.False(t, isLoop(req, "alpaca-1234"))
+	req.Header.Set("Via", "1.0 fred, 1.1 alpaca-1234 (Alpaca)")
+	assert.True(t, isLoop(req, "alpaca-1234"))
+}
+
+func TestProxyLoop(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	proxy := newLoopingProxy()
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusLoopDetected, resp.StatusCode)
+	var pe proxyError
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&pe))
+	assert.Equal(t, "proxy_loop", pe.Code)
+}
+
+func TestProxyLoopConnect(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	proxy := newLoopingProxy()
+	defer proxy.Close()
+	conn, status := connectVia(t, proxy.Listener.Addr().String(), server.Listener.Addr().String())
+	defer conn.Close()
+	require.Equal(t, http.StatusLoopDetected, status)
+}
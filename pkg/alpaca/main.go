@@ -0,0 +1,1315 @@
+// Copyright 2019, 2021, 2022 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// BuildVersion is the version of Alpaca, which the alpaca command sets from its own BuildVersion
+// (which is set when building a release).
+var BuildVersion string
+
+// The maximum time to wait for in-flight requests and tunnels to finish, after handing over to a
+// new instance.
+const drainTimeout = 5 * time.Minute
+
+func whoAmI() string {
+	me, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return me.Username
+}
+
+// Main runs the alpaca command, using the command-line flags in os.Args.
+func Main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
+	if len(os.Args) > 2 && os.Args[1] == "debug" && os.Args[2] == "dump" {
+		if err := debugDumpCommand(os.Args[3:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "creds" {
+		if err := credsCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	// "alpaca check" takes the same flags as alpaca, and runs a self-test with them rather than
+	// starting the proxy. Any other arguments are URLs to test.
+	check := len(os.Args) > 1 && os.Args[1] == "check"
+	if check {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+	// Likewise, "alpaca resolve" prints which proxy the flags would choose for each URL, and why.
+	resolve := len(os.Args) > 1 && os.Args[1] == "resolve"
+	if resolve {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+	// And "alpaca test" runs the scenarios in the given files against a fake upstream.
+	scenarios := len(os.Args) > 1 && os.Args[1] == "test"
+	if scenarios {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+	// "alpaca completion" needs the flags to be defined, so it's run just before they're parsed.
+	completion := len(os.Args) > 1 && os.Args[1] == "completion"
+	listenAddrs := newListenFlag("localhost")
+	flag.Var(listenAddrs, "l",
+		"address to listen on, as host or host:port (can be given more than once)")
+	port := flag.Int("p", 3128, "http port number to listen on")
+	portRange := flag.String("port-range", "",
+		"range of ports (e.g. \"3128-3227\") to choose -p from by uid, so that each user of a "+
+			"shared machine gets their own")
+	socksPort := flag.Int("s", 8010, "socks port number to listen on")
+	reusePort := flag.Int("reuse-port", 0,
+		"number of sockets (with their own accept loops) to open for each http and socks address "+
+			"using SO_REUSEPORT, which other alpaca processes can share (linux only, 0 to disable)")
+	workers := flag.Int("workers", 1,
+		"number of alpaca processes sharing the ports with -reuse-port (including this one)")
+	pinClientIPs := flag.Bool("pin-clients", false,
+		"send all of a client's connections to the same -reuse-port socket and worker (linux only)")
+	transparentPort := flag.Int("transparent-port", 0,
+		"port number to listen on for connections redirected by iptables (linux only, 0 to disable)")
+	pacurls := &pacURLFlag{}
+	flag.Var(pacurls, "C",
+		"url of proxy auto-config (pac) file (can be given more than once, to fall back to the next)")
+	probeAuth := flag.Bool("probe-auth", true,
+		"check whether each upstream proxy asks for credentials when it's first seen, and log "+
+			"which auth schemes it offers")
+	upstreamAlpaca := flag.String("upstream-alpaca", "",
+		"address (host:port) of another alpaca, e.g. on a jump host, to send every request to "+
+			"instead of using a pac file; it authenticates to the proxies, so this one doesn't")
+	useSystemProxy := flag.Bool("use-system-proxy", true,
+		"without -C, use the proxy from the system proxy settings if they don't have a pac url")
+	pacCacheFile := flag.String("pac-cache", "",
+		"file to save the last good pac file in, to use if it can't be downloaded at startup")
+	pacHistoryDir := flag.String("pac-history", "",
+		"directory to keep the last few pac files in, so that the api can roll back to them")
+	pacHistorySize := flag.Int("pac-history-size", 10,
+		"number of pac files to keep in the -pac-history directory")
+	pacRefresh := durationFlag("pac-refresh", time.Hour,
+		"how often to check the pac file for changes (0 to disable)")
+	pacBypass := flag.String("pac-bypass", "",
+		"comma-separated host patterns (e.g. *.example.com) that the served pac file sends direct")
+	pacFailover := flag.String("pac-failover", "",
+		"comma-separated host:port addresses of other alpaca instances for the served pac file")
+	pacKeyFile := flag.String("pac-public-key", "",
+		"only use pac files signed with the ed25519 private key for this public key file")
+	pacTimeoutFlag := durationFlag("pac-timeout", 5*time.Second,
+		"interrupt the pac script if it takes longer than this for a request (0 for no limit)")
+	pacRequireHTTPS := flag.Bool("pac-require-https", false,
+		"only use pac files served over https (or signed, see -pac-public-key)")
+	pacHosts := flag.String("pac-hosts", "",
+		"comma-separated hosts (or patterns like *.example.com) that pac files may come from")
+	pacHTTPSPort := flag.Int("pac-https-port", 0,
+		"also serve the wrapped pac file over https on this port (0 to disable)")
+	pacTLSCert := flag.String("pac-tls-cert", "",
+		"pem certificate for -pac-https-port (generated and saved here if it doesn't exist)")
+	pacTLSKey := flag.String("pac-tls-key", "",
+		"pem private key for -pac-tls-cert (if it isn't in the same file)")
+	myIP := flag.String("my-ip", myIPAuto, "address returned by myIpAddress() in the pac file: "+
+		"\"auto\", \"pac\" (the interface that routes to the pac server), \"route\" (the vpn "+
+		"or default route interface, ignoring docker and vm interfaces), an ip address or an "+
+		"interface name")
+	routes := flag.String("route", "",
+		"comma-separated rules that override the pac file, e.g. "+
+			"\"process=git PROXY proxy.example.com:8080,port=22 DIRECT\"")
+	mapHosts := flag.String("map-host", "",
+		"comma-separated host=address rules, which connect directly to another address for a "+
+			"host, e.g. \"api.example.com=staging.example.net:8443\"")
+	pinRedirects := durationFlag("pin-redirects", 0,
+		"send requests that follow a redirect via the same proxy as the redirect, for this long "+
+			"(0 to disable)")
+	pacOverrideFile := flag.String("pac-override", "",
+		"local pac file, or file of \"host-pattern proxy\" rules, that overrides the pac file")
+	headerRulesFile := flag.String("header-rules", "",
+		"file of \"host-pattern action header [value]\" rules that add, replace or remove "+
+			"request and response headers")
+	healthRules := flag.String("health-rule", "",
+		"comma-separated rules to use while a proxy is down, e.g. "+
+			"\"proxy.example.com:8080 down 5m DIRECT\"")
+	captivePortal := flag.Bool("captive-portal", false,
+		"detect captive portals, and connect directly to everything while behind one")
+	localDirect := flag.Bool("local-direct", false,
+		"always connect directly to hosts on the same subnet as this machine, ignoring the pac file")
+	localNamesFlag := flag.Bool("local-names", false,
+		"always connect directly to .local and single-label hosts, ignoring the pac file, and "+
+			"resolve them using mdns or llmnr")
+	extensionOrigin := flag.String("extension-origin", "",
+		"origin of the browser extension allowed to use the api (e.g. chrome-extension://<id>)")
+	readHeaderTimeout := durationFlag("read-header-timeout", 30*time.Second,
+		"how long to wait for a client to send request headers (0 for no limit)")
+	idleTimeout := durationFlag("idle-timeout", 5*time.Minute,
+		"how long to keep idle client connections open (0 for no limit)")
+	maxHeaderBytes := sizeFlag("max-header-bytes", http.DefaultMaxHeaderBytes,
+		"maximum size of request headers")
+	maxBodyBytes := sizeFlag("max-body-bytes", 0,
+		"maximum size of request bodies (other than CONNECT tunnels), e.g. 100MB (0 for no limit)")
+	maxBufferedBody := sizeFlag("max-buffered-body", defaultMaxBufferedBody,
+		"how much of each request body to keep, so it can be sent again with auth")
+	directTimeout := durationFlag("direct-timeout", 0,
+		"how long to try connecting directly before falling back to the next proxy returned by "+
+			"the pac file (0 to wait as long as the os does)")
+	maxConnLifetime := durationFlag("max-conn-lifetime", 0,
+		"stop reusing connections to upstream proxies after this long (0 for no limit)")
+	upstreamIdleConns := flag.Int("upstream-idle-conns", 16,
+		"number of idle connections to keep open to each upstream proxy, split between -workers")
+	tunnelIdleTimeout := durationFlag("tunnel-idle-timeout", 0,
+		"close CONNECT tunnels after no data has been sent for this long (0 for no limit)")
+	tunnelNoIdleTimeout := flag.String("tunnel-no-idle-timeout", "",
+		"comma-separated list of domains whose tunnels -tunnel-idle-timeout doesn't apply to")
+	tunnelKeepAlive := durationFlag("tunnel-keepalive", 0,
+		"how often to send TCP keep-alives on both sides of tunnels (0 for the default of 15s)")
+	memoryLimit := sizeFlag("memory-limit", 0,
+		"soft limit on memory use, e.g. 500MB; over it, alpaca frees what it can (0 for no limit)")
+	parallelConns := flag.Int("parallel-downloads", 0,
+		"split large plain http downloads into up to this many parallel range requests "+
+			"(0 to disable)")
+	parallelChunkSize := sizeFlag("parallel-chunk-size", 8<<20,
+		"size of each range request for -parallel-downloads")
+	blobCacheDir := flag.String("blob-cache", "",
+		"directory to cache content-addressed blobs (e.g. docker image layers) in")
+	blobCacheSize := sizeFlag("blob-cache-size", 10<<30,
+		"maximum size of the -blob-cache directory")
+	responseCacheSize := sizeFlag("response-cache", 0,
+		"memory to use for caching plain-http responses from upstream proxies, e.g. 64MB (0 to "+
+			"disable)")
+	responseCacheDir := flag.String("response-cache-dir", "",
+		"directory to also keep -response-cache responses in, so that they survive restarts")
+	responseCacheDirSize := sizeFlag("response-cache-dir-size", 1<<30,
+		"maximum size of the -response-cache-dir directory")
+	maxConns := flag.Int("max-conns", 0,
+		"maximum number of client connections (and tunnels) open at once, to avoid running out "+
+			"of file descriptors (0 for no limit)")
+	maxConnsPerHost := flag.Int("max-conns-per-host", 0,
+		"maximum number of requests (and tunnels) open to each host at once (0 for no limit)")
+	maxConnsPerProxy := flag.Int("max-conns-per-proxy", 0,
+		"maximum number of requests (and tunnels) open through each upstream proxy at once "+
+			"(0 for no limit)")
+	connWait := durationFlag("conn-wait", time.Minute,
+		"how long a request over -max-conns-per-host or -max-conns-per-proxy waits for a "+
+			"connection to free up")
+	scanUploads := flag.String("scan-uploads", "",
+		"scan request bodies before sending them, using an ICAP server (icap://host:port/path) "+
+			"or a command")
+	scanDownloads := flag.String("scan-downloads", "",
+		"scan response bodies before passing them on, using an ICAP server (icap://host:port/path)")
+	scanHosts := flag.String("scan-hosts", "",
+		"comma-separated list of domains whose uploads and downloads are scanned (default: all)")
+	scanMaxBody := sizeFlag("scan-max-body", 16<<20,
+		"largest body that -scan-uploads or -scan-downloads can scan; bigger ones are blocked")
+	icapViaProxy := flag.Bool("icap-via-proxy", false,
+		"connect to ICAP servers through the upstream proxy (as given by the PAC file)")
+	bandwidthLimit := sizeFlag("bandwidth-limit", 0,
+		"maximum rate at which to send data to all clients, per second, e.g. 1MB (0 for no limit)")
+	clientBandwidthLimit := sizeFlag("client-bandwidth-limit", 0,
+		"maximum rate at which to send data to each client ip, per second (0 for no limit)")
+	dnsFailureTTL := durationFlag("dns-failure-ttl", 0,
+		"how long to remember failed dns lookups, and fail straight away if retried (0 to disable)")
+	dialFailureTTL := durationFlag("dial-failure-ttl", 0,
+		"how long to remember failed connections to hosts and proxies (0 to disable)")
+	captureSize := flag.Int("capture", 0,
+		"keep the last N proxied requests, for download as a HAR file (0 to disable)")
+	debugPort := flag.Int("debug", 0,
+		"serve pprof and connection dumps on this localhost port (0 to disable)")
+	debugPACTrace := flag.Float64("debug-pac-trace", 0,
+		"fraction of pac evaluations to trace, for the -debug server's /debug/pac-traces (0 to 1)")
+	debugSnapshot := flag.String("debug-snapshot", "",
+		"file to save a snapshot of alpaca's state to periodically, for bug reports")
+	debugSnapshotInterval := durationFlag("debug-snapshot-interval", 10*time.Minute,
+		"how often to save the -debug-snapshot file")
+	debugCredentialFault := flag.String("debug-credential-fault", "",
+		"simulate a failing credential source, for testing: \"keyring-timeout\", "+
+			"\"keyring-locked\", \"prompt-cancel\" or \"helper-error\"")
+	proxyCAFile := flag.String("proxy-ca-file", "",
+		"pem file of extra certificate authorities to trust for https upstream proxies")
+	proxyCert := flag.String("proxy-cert", "",
+		"pem file of a client certificate to present to https upstream proxies")
+	proxyKey := flag.String("proxy-key", "",
+		"pem file of the private key for -proxy-cert (if it isn't in the same file)")
+	proxyKeyHelper := flag.String("proxy-key-helper", "",
+		"command that signs with the private key for -proxy-cert, e.g. using pkcs#11 or the os "+
+			"keystore (see README)")
+	flag.String("config", "", "path to a json config file")
+	logFormat := flag.String("log-format", logFormatAuto,
+		"log format: \"auto\", \"plain\", \"pretty\" or \"text\" (pretty without colours, "+
+			"for screen readers)")
+	logPrivacyMode := flag.String("log-privacy", logPrivacyOff,
+		"how much of each url to log: \"off\" (all of it), \"query\" (not the query string), "+
+			"\"truncate\" (only the host) or \"hash\" (a hash of the host)")
+	logDebug := flag.String("log-debug", "",
+		"comma-separated subsystems to log debug messages for: \"auth\", \"pac\", \"socks\", "+
+			"\"transparent\" or \"all\"")
+	messagesDir := flag.String("messages", "",
+		"directory of json message catalogs (e.g. de.json) that translate error pages and prompts")
+	logEndpoint := flag.String("log-endpoint", "",
+		"url to send logs to, e.g. for central monitoring (see also -log-endpoint-format)")
+	logEndpointFormat := flag.String("log-endpoint-format", logShipJSON,
+		"format of the logs sent to -log-endpoint: \"json\" or \"otlp\" (OTLP/HTTP JSON)")
+	logEndpointInterval := durationFlag("log-endpoint-interval", 10*time.Second,
+		"how often to send logs to -log-endpoint")
+	logEndpointBuffer := flag.Int("log-endpoint-buffer", 10000,
+		"maximum number of log lines to keep while -log-endpoint can't be reached")
+	eventWebhook := flag.String("event-webhook", "",
+		"url to post events (e.g. proxy auth failures) to as json, e.g. a slack incoming webhook")
+	eventExec := flag.String("event-exec", "",
+		"command to run for each event, with the event as json on its stdin")
+	eventFilter := flag.String("events", "",
+		"comma-separated types of event to send: \"auth_failed\", \"upstream_down\", "+
+			"\"pac_changed\" or \"credentials_changed\" (default all)")
+	domain := flag.String("d", "", "domain of the proxy account (for NTLM auth)")
+	username := flag.String("u", whoAmI(), "username of the proxy account (for NTLM auth)")
+	printHash := flag.Bool("H", false, "print hashed NTLM credentials for non-interactive use")
+	encryptHash := flag.Bool("encrypt-hash", false,
+		"encrypt the -H output with a key from the OS keyring, so it only works on this machine")
+	sspi := flag.Bool("sspi", runtime.GOOS == "windows",
+		"use the logged-in windows user's credentials for proxy auth (windows only)")
+	credentialsFile := flag.String("credentials-file", "",
+		"path to an encrypted file containing NTLM credentials")
+	fallbackCredentialsFile := flag.String("fallback-credentials-file", "",
+		"path to an encrypted file containing NTLM credentials to use if the proxy rejects the "+
+			"usual ones (see also NTLM_FALLBACK_CREDENTIALS)")
+	credentialHelperCmd := flag.String("credential-helper", "",
+		"command that prints NTLM credentials on demand (see README for the protocol)")
+	saveCredentials := flag.Bool("save-credentials", false,
+		"save the credentials for the -d and -u account to the -credentials-file, and exit")
+	credentialsKey := flag.String("credentials-key", credentialsKeyPassphrase,
+		"how to protect a saved -credentials-file: \"passphrase\" or \"keyring\"")
+	keyringName := flag.String("keyring", keyringAuto,
+		"keyring to keep the password and keys in: \"auto\", \"secret-service\", \"kwallet\", "+
+			"\"pass\" or \"wincred\"")
+	keyringTarget := flag.String("keyring-target", "",
+		"target name of the windows credential manager entry holding the password "+
+			"(default \"alpaca:USER\")")
+	usageStatsURL := flag.String("usage-stats", "",
+		"opt in to sending anonymous usage statistics to this url (see -usage-stats-preview)")
+	usageStatsPreview := flag.Bool("usage-stats-preview", false,
+		"print the usage statistics that -usage-stats would send, and exit")
+	version := flag.Bool("version", false, "print version number")
+	setSystemProxy := flag.Bool("set-system-proxy", false,
+		"point the system proxy settings at alpaca while it's running (macOS only)")
+	takeover := flag.Bool("takeover", false,
+		"take over the listening sockets and open tunnels of a running instance")
+	standby := flag.Bool("standby", false,
+		"wait for the instance running on the same port to fail, then take over its ports")
+	standbyInterval := durationFlag("standby-interval", 2*time.Second,
+		"how often a -standby instance checks the running instance")
+	standbyFailures := flag.Int("standby-failures", 3,
+		"number of failed checks in a row before a -standby instance takes over")
+	if completion {
+		if err := completionCommand(os.Args[2:], flag.CommandLine, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	flag.Parse()
+
+	if err := loadConfig(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	if *portRange != "" && !isFlagSet(flag.CommandLine, "p") {
+		var err error
+		if *port, err = portForUser(*portRange, os.Getuid()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := setLogFormat(*logFormat); err != nil {
+		log.Fatal(err)
+	}
+	if err := setLogPrivacy(*logPrivacyMode); err != nil {
+		log.Fatal(err)
+	}
+	if err := setLogDebug(*logDebug); err != nil {
+		log.Fatal(err)
+	}
+	if *messagesDir != "" {
+		var err error
+		if messages, err = loadMessageCatalogs(*messagesDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *logEndpoint != "" {
+		shipper, err := newLogShipper(*logEndpoint, *logEndpointFormat, *logEndpointInterval,
+			*logEndpointBuffer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(io.MultiWriter(log.Writer(), shipper))
+		go shipper.run(nil)
+	}
+	if *eventWebhook != "" || *eventExec != "" {
+		types, err := parseEventTypes(*eventFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		events = newEventBus(types)
+		if *eventWebhook != "" {
+			events.subscribe(newWebhookTarget(*eventWebhook))
+		}
+		if *eventExec != "" {
+			events.subscribe(newExecTarget(*eventExec))
+		}
+	}
+
+	if *version {
+		fmt.Println("Alpaca", BuildVersion)
+		os.Exit(0)
+	}
+
+	var usage *usageStats
+	if *usageStatsURL != "" || *usageStatsPreview {
+		usage = newUsageStats(*usageStatsURL, flag.CommandLine)
+	}
+	if *usageStatsPreview {
+		if err := usage.preview(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	} else if usage != nil {
+		log.Printf("Sending anonymous usage statistics to %s", *usageStatsURL)
+		go usage.run(nil)
+	}
+
+	if config, err := loadTLSClientConfig(*proxyCAFile, *proxyCert, *proxyKey,
+		*proxyKeyHelper); err != nil {
+		log.Fatal(err)
+	} else if config != nil {
+		tlsClientConfig = config
+	}
+
+	// On Windows, use the logged-in user's credentials, unless some were given explicitly.
+	useSSPI := *sspi && *domain == "" && os.Getenv("NTLM_CREDENTIALS") == "" &&
+		*credentialsFile == "" && *credentialHelperCmd == "" && *upstreamAlpaca == ""
+
+	if err := setCredentialFault(*debugCredentialFault); err != nil {
+		log.Fatal(err)
+	}
+	var err error
+	if keyringStore, err = newKeyringBackend(*keyringName, *keyringTarget); err != nil {
+		log.Fatal(err)
+	}
+	// A credential helper is only run when credentials are first needed, rather than now.
+	var helper *credentialHelper
+	var src credentialSource
+	var background credentialSource // If set, the keyring, which is read once Alpaca has started
+	if *upstreamAlpaca != "" {
+		log.Printf("Not authenticating to proxies, since the upstream Alpaca does")
+	} else if *credentialHelperCmd != "" {
+		helper = newCredentialHelper(*credentialHelperCmd, *domain, *username)
+		injectCredentialFault(helper)
+	} else if *domain != "" {
+		src = fromTerminal().forUser(*domain, *username)
+	} else if !useSSPI {
+		var sources credentialSources
+		if value := os.Getenv("NTLM_CREDENTIALS"); value != "" {
+			sources = append(sources, fromEnvVar(value))
+		}
+		if *credentialsFile != "" {
+			sources = append(sources, fromCredentialsFile(*credentialsFile))
+		}
+		if *saveCredentials || *printHash || check || scenarios {
+			src = append(sources, withTimeout(fromKeyring(), "keyring", keyringTimeout))
+		} else {
+			// The keyring can block until it's unlocked, so don't wait for it before
+			// listening.
+			if len(sources) > 0 {
+				src = sources
+			}
+			background = injectCredentialFault(fromKeyring())
+		}
+	}
+
+	var a *authenticator
+	if src != nil {
+		var err error
+		a, err = injectCredentialFault(src).getCredentials()
+		if err != nil && background != nil {
+			log.Printf("Credentials not found, trying the keyring: %v", err)
+		} else if err != nil {
+			log.Printf("Credentials not found, disabling proxy auth: %v", err)
+		}
+	}
+
+	// A second account (e.g. a service account) to use if the proxy rejects the first.
+	var fallback *authenticator
+	if *upstreamAlpaca == "" && !*saveCredentials && !*printHash {
+		var sources credentialSources
+		if value := os.Getenv("NTLM_FALLBACK_CREDENTIALS"); value != "" {
+			sources = append(sources, fromEnvVar(value))
+		}
+		if *fallbackCredentialsFile != "" {
+			sources = append(sources, fromCredentialsFile(*fallbackCredentialsFile))
+		}
+		if len(sources) > 0 {
+			if fallback, err = sources.getCredentials(); err != nil {
+				log.Fatalf("Error reading the fallback credentials: %v", err)
+			}
+			log.Printf("Using %s\\%s as the fallback credentials", fallback.domain,
+				fallback.username)
+		}
+	}
+
+	if *saveCredentials {
+		if a == nil || *domain == "" || *credentialsFile == "" {
+			fmt.Println(localText("cli.need_credentials_file"))
+			os.Exit(1)
+		}
+		err := fromCredentialsFile(*credentialsFile).save(a, *credentialsKey)
+		if err != nil {
+			log.Fatalf("Error saving credentials: %v", err)
+		}
+		fmt.Println(localText("cli.saved_credentials", a.domain+"\\"+a.username,
+			*credentialsFile))
+		os.Exit(0)
+	}
+
+	if *printHash {
+		if a == nil {
+			fmt.Println(localText("cli.need_account"))
+			os.Exit(1)
+		}
+		value := a.String()
+		if *encryptHash {
+			var err error
+			if value, err = sealEnvVar(a, keyringStore.get, keyringStore.set); err != nil {
+				log.Fatalf("Error encrypting credentials: %v", err)
+			}
+		}
+		fmt.Println("# " + localText("cli.add_to_profile"))
+		fmt.Printf("NTLM_CREDENTIALS=%q; export NTLM_CREDENTIALS\n", value)
+		os.Exit(0)
+	}
+
+	var auth proxyAuth
+	var rotating *rotatingAuth
+	if helper != nil {
+		auth = helper
+	} else if useSSPI {
+		if sa, err := newSSPIAuthenticator(); err != nil {
+			log.Printf("Can't use Windows credentials, disabling proxy auth: %v", err)
+		} else {
+			log.Printf("Using the logged-in Windows user's credentials for proxy auth")
+			auth = sa
+		}
+	} else {
+		// The credentials can be changed (or set, if there aren't any) using the API.
+		rotating = &rotatingAuth{}
+		rotating.current.Store(a)
+		auth = rotating
+		if a == nil && background != nil {
+			go rotating.loadInBackground(background, "keyring", keyringTimeout)
+		}
+	}
+	if fallback != nil {
+		auth = newFallbackAuth(auth, fallback)
+	}
+
+	var capped *connCap
+	if *maxConns < 0 {
+		log.Fatalf("Invalid -max-conns: %d", *maxConns)
+	} else if *maxConns > 0 {
+		capped = newConnCap(*maxConns)
+	}
+	errch := make(chan error)
+	serve := func(serve func(net.Listener) error, l net.Listener) {
+		if capped != nil {
+			l = capped.wrap(l)
+		}
+		// Listeners are closed when handing over to a new instance; that's not an error.
+		err := serve(l)
+		if !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			errch <- err
+		}
+	}
+
+	// If we're taking over from a running instance, reuse its listeners and tunnels.
+	tunnels := newTunnelTracker()
+	tunnels.idleTimeout = *tunnelIdleTimeout
+	tunnels.noIdleTimeout = parseDomainList(*tunnelNoIdleTimeout)
+	tunnels.keepAlive = *tunnelKeepAlive
+	inherited := make(map[string]net.Listener)
+	var tookOver <-chan error
+	if *takeover {
+		path, err := handoffSocketPath(*port)
+		if err == nil {
+			inherited, tookOver, err = takeOver(path, tunnels)
+		}
+		if err != nil {
+			log.Fatalf("Error taking over from running instance: %v", err)
+		}
+	}
+	listeners := make(map[string]net.Listener)
+	listenWith := func(name string, newListener func() (net.Listener, error)) (net.Listener, error) {
+		l, ok := inherited[name]
+		if !ok {
+			var err error
+			if l, err = newListener(); err != nil {
+				return nil, err
+			}
+		}
+		listeners[name] = l
+		return l, nil
+	}
+	listen := func(name, network, address string) (net.Listener, error) {
+		return listenWith(name, func() (net.Listener, error) { return net.Listen(network, address) })
+	}
+	// listenTCP listens on a TCP address. With -reuse-port, it opens that many sockets, and
+	// accepts connections from all of them.
+	if *reusePort < 0 {
+		log.Fatalf("Invalid -reuse-port: %d", *reusePort)
+	} else if *workers < 1 {
+		log.Fatalf("Invalid -workers: %d", *workers)
+	} else if *reusePort == 0 && (*workers > 1 || *pinClientIPs) {
+		log.Fatal("-workers and -pin-clients can only be used with -reuse-port")
+	}
+	listenTCP := func(name, address string) (net.Listener, error) {
+		if *reusePort == 0 {
+			return listen(name, "tcp", address)
+		}
+		var ls []net.Listener
+		closeAll := func() {
+			for j, l := range ls {
+				l.Close()
+				delete(listeners, reusePortName(name, j))
+			}
+		}
+		for i := 0; i < *reusePort; i++ {
+			l, err := listenWith(reusePortName(name, i), func() (net.Listener, error) {
+				return listenReusePort(address)
+			})
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			// If the port was chosen by the OS, the other sockets need to use the same one.
+			address = l.Addr().String()
+			ls = append(ls, l)
+		}
+		// The kernel chooses between all of the workers' sockets, so they all need to agree on
+		// how many there are.
+		if *pinClientIPs {
+			if err := pinClients(ls[0], *reusePort**workers); err != nil {
+				closeAll()
+				return nil, fmt.Errorf("error pinning clients to sockets: %w", err)
+			}
+		}
+		return newReusePortListener(ls), nil
+	}
+
+	// http server
+	failover := splitList(*pacFailover)
+	for _, addr := range failover {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			log.Fatalf("Invalid -pac-failover address %q: %v", addr, err)
+		}
+	}
+	if *pacKeyFile != "" {
+		key, err := loadPACPublicKey(*pacKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pacPublicKey = key
+	}
+	pacTimeout = *pacTimeoutFlag
+	if *pacCacheFile != "" {
+		pacCache = &pacDiskCache{path: *pacCacheFile}
+	}
+	if *useSystemProxy && len(*pacurls) == 0 {
+		systemProxyPAC = systemProxyScript(*port)
+	}
+	if *debugPACTrace < 0 || *debugPACTrace > 1 {
+		log.Fatalf("Invalid -debug-pac-trace: %v (expected a fraction from 0 to 1)",
+			*debugPACTrace)
+	} else if *debugPACTrace > 0 {
+		if *debugPort == 0 {
+			log.Fatal("-debug-pac-trace needs the debug server (-debug PORT) to be enabled")
+		}
+		pacTraces = newPACTraceLog(*debugPACTrace)
+	}
+	recentFailures.dnsTTL = *dnsFailureTTL
+	recentFailures.dialTTL = *dialFailureTTL
+	defaultPACPolicy = pacPolicy{requireHTTPS: *pacRequireHTTPS, hosts: splitList(*pacHosts)}
+	routingRules, err := parseRoutingRules(*routes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if hostMappings, err = parseHostMap(*mapHosts); err != nil {
+		log.Fatal(err)
+	}
+	if *localNamesFlag {
+		localNames = newLocalNameResolver()
+	}
+	var chainTo *url.URL
+	if *upstreamAlpaca != "" {
+		if len(*pacurls) > 0 {
+			log.Fatal("-upstream-alpaca can't be used with -C")
+		} else if chainTo, err = parseUpstreamAlpaca(*upstreamAlpaca); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *headerRulesFile != "" {
+		if headerRewrites, err = newHeaderRules(*headerRulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	health, err := parseHealthRules(*healthRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var override *pacOverride
+	if *pacOverrideFile != "" {
+		if override, err = newPACOverride(*pacOverrideFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	addrs, err := listenAddrs.addrs(*port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	extraListeners, err := loadListeners(flag.CommandLine, *port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := serverOptions{
+		pacBypass:       splitList(*pacBypass),
+		pacFailover:     failover,
+		myIP:            *myIP,
+		pacRefresh:      *pacRefresh,
+		localDirect:     *localDirect,
+		routes:          routingRules,
+		healthRules:     health,
+		captivePortal:   *captivePortal,
+		upstreamAlpaca:  chainTo,
+		probeAuth:       *probeAuth && !resolve && !scenarios, // Not for resolve or test
+		pacOverride:     override,
+		pinRedirects:    *pinRedirects,
+		extensionOrigin: *extensionOrigin,
+		maxConnLifetime: *maxConnLifetime,
+		idleConns:       perWorker(*upstreamIdleConns, *workers),
+		maxBufferedBody: *maxBufferedBody,
+		directTimeout:   *directTimeout,
+		captureSize:     *captureSize,
+		usage:           usage,
+		maxConns:        capped,
+	}
+	if rotating != nil {
+		opts.credentials = newCredentialsAPI(rotating)
+	}
+	if *pacHistoryDir != "" {
+		if opts.pacHistory, err = newPACHistory(*pacHistoryDir, *pacHistorySize); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if opts.tracer, err = newTracer(os.LookupEnv); err != nil {
+		log.Fatal(err)
+	} else if opts.tracer != nil {
+		log.Printf("Sending traces to %s", opts.tracer.endpoint)
+		go opts.tracer.run(nil)
+	}
+	if *maxConnsPerHost > 0 || *maxConnsPerProxy > 0 {
+		opts.connLimiter = newConnLimiter(*maxConnsPerHost, *maxConnsPerProxy, *connWait)
+	}
+	// The ICAP clients, which connect through Alpaca itself with -icap-via-proxy (once it's
+	// listening).
+	var icapClients []*icapClient
+	if *scanUploads != "" {
+		scanner, err := newBodyScanner(*scanUploads)
+		if err != nil {
+			log.Fatal(err)
+		} else if c, ok := scanner.(*icapClient); ok {
+			icapClients = append(icapClients, c)
+		}
+		opts.uploads = newUploadScanner(scanner, parseDomainList(*scanHosts), *scanMaxBody)
+	}
+	if *scanDownloads != "" {
+		c, err := newICAPClient(*scanDownloads)
+		if err != nil {
+			log.Fatal(err)
+		}
+		icapClients = append(icapClients, c)
+		opts.downloads = &downloadScanner{icap: c, domains: parseDomainList(*scanHosts),
+			maxBody: *scanMaxBody}
+	}
+	if *bandwidthLimit > 0 || *clientBandwidthLimit > 0 {
+		opts.bandwidth = newBandwidthLimiter(*bandwidthLimit, *clientBandwidthLimit)
+	}
+	if *blobCacheDir != "" {
+		if opts.blobCache, err = newBlobCache(*blobCacheDir, *blobCacheSize); err != nil {
+			log.Fatalf("Error creating blob cache: %v", err)
+		}
+	}
+	if *responseCacheSize > 0 && fallback != nil {
+		// Which account a request is sent as isn't known until it's been sent.
+		log.Printf("Not using the response cache, since requests might be sent as either the " +
+			"primary or the fallback account")
+	} else if *responseCacheSize > 0 {
+		opts.responseCache, err = newResponseCache(*responseCacheSize, *responseCacheDir,
+			*responseCacheDirSize)
+		if err != nil {
+			log.Fatalf("Error creating response cache: %v", err)
+		}
+		opts.responseCache.identity = func() string { return identity(auth, "") }
+	} else if *responseCacheDir != "" {
+		log.Fatal("-response-cache-dir needs -response-cache")
+	}
+	if *parallelConns > 0 {
+		if *parallelChunkSize <= 0 {
+			log.Fatalf("Invalid -parallel-chunk-size: %s", formatSize(*parallelChunkSize))
+		}
+		opts.parallel = &parallelDownloads{conns: *parallelConns, chunkSize: *parallelChunkSize}
+	}
+	conns := newConnTracker()
+	opts.conns = conns
+	if *memoryLimit > 0 {
+		opts.memory = newMemoryMonitor(*memoryLimit, conns, tunnels)
+		go opts.memory.run(nil)
+	}
+	if *debugPort != 0 || *debugSnapshot != "" {
+		opts.debug = newDebugState(conns, tunnels, flag.CommandLine)
+	}
+	if *debugPort != 0 {
+		if l, err := listenDebug(*debugPort, opts.debug); err != nil {
+			log.Printf("Failed to start debug server: %v", err)
+		} else {
+			log.Printf("Debug server listening on http://%s/debug/pprof/", l.Addr())
+		}
+	}
+	if *debugSnapshot != "" {
+		if *debugSnapshotInterval <= 0 {
+			log.Fatalf("Invalid -debug-snapshot-interval: %v", *debugSnapshotInterval)
+		}
+		go opts.debug.runSnapshots(*debugSnapshot, *debugSnapshotInterval, nil)
+	}
+	newServer := func(port int, auth proxyAuth, opts serverOptions) *http.Server {
+		s := createServer(addrs[0].host, port, *pacurls, auth, tunnels, opts)
+		// Don't let misbehaving clients hold on to connections (and goroutines) forever.
+		s.ReadHeaderTimeout = *readHeaderTimeout
+		s.IdleTimeout = *idleTimeout
+		s.MaxHeaderBytes = int(*maxHeaderBytes)
+		if *maxBodyBytes > 0 {
+			s.Handler = http.MaxBytesHandler(s.Handler, *maxBodyBytes)
+		}
+		s.ConnState = conns.track
+		if opts.memory != nil {
+			// Turning keep-alives off closes the idle client connections.
+			opts.memory.onPressure(func() {
+				s.SetKeepAlivesEnabled(false)
+				s.SetKeepAlivesEnabled(true)
+			})
+		}
+		if opts.maxConns != nil {
+			// At the limit, make room by closing the idle client connections.
+			opts.maxConns.onFull(func() {
+				s.SetKeepAlivesEnabled(false)
+				s.SetKeepAlivesEnabled(true)
+			})
+		}
+		return s
+	}
+	if check {
+		passed, err := runCheck(newServer(*port, auth, opts), flag.Args(), os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		} else if !passed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if resolve {
+		if err := runResolve(newServer(*port, auth, opts), flag.Args(), os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if scenarios {
+		// The captive portal probes would go to the fake upstream too, and find a portal.
+		opts.captivePortal = false
+		newTestServer := func(port int, dial dialFunc) *http.Server {
+			opts := opts
+			opts.dial = dial
+			return newServer(port, auth, opts)
+		}
+		passed, err := runScenarios(newTestServer, flag.Args(), os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		} else if !passed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	s := newServer(*port, auth, opts)
+	servers := []*http.Server{s}
+	go newLeakDetector(tunnels, conns).run(nil)
+	// bind listens on each address that la resolves to, skipping any that can't be bound (e.g.
+	// ::1 when IPv6 is disabled) as long as at least one can be.
+	bind := func(la listenAddr) []net.Listener {
+		bindAddrs, err := la.bindAddrs()
+		if err != nil {
+			log.Fatalf("Error resolving listen address %s: %v", la, err)
+		}
+		var ls []net.Listener
+		for _, addr := range bindAddrs {
+			l, err := listenTCP("http/"+addr, addr)
+			if err != nil {
+				log.Printf("Error listening on %s: %v", addr, err)
+				continue
+			}
+			ls = append(ls, l)
+		}
+		if len(ls) == 0 {
+			log.Fatalf("Couldn't listen on %s", la)
+		}
+		return ls
+	}
+	if *standby {
+		if *takeover {
+			log.Fatal("-standby can't be used with -takeover")
+		} else if *standbyInterval <= 0 || *standbyFailures <= 0 {
+			log.Fatal("-standby-interval and -standby-failures must be positive")
+		}
+		waitForPrimary(addrs[0], *standbyInterval, *standbyFailures)
+	}
+	// The SOCKS and transparent proxy listeners, which (unlike the HTTP ones) aren't closed by
+	// shutting down an http.Server.
+	var socksListeners []net.Listener
+	// With -icap-via-proxy, ICAP servers are reached by sending a CONNECT request to the first
+	// listener.
+	dialICAPViaProxy := *icapViaProxy
+	for _, la := range addrs {
+		for _, l := range bind(la) {
+			// HTTP/HTTPS Server
+			log.Printf("Listening on %s", l.Addr())
+			if dialICAPViaProxy {
+				for _, c := range icapClients {
+					c.dial = httpConnectDialer(l.Addr().String())
+				}
+				dialICAPViaProxy = false
+			}
+			go serve(s.Serve, l)
+
+			// SOCKS server
+			httpaddr := l.Addr().String()
+			host, _, _ := net.SplitHostPort(httpaddr)
+			socksaddr := net.JoinHostPort(host, strconv.Itoa(*socksPort))
+			srv, err := startSocksServer(httpaddr, a)
+			if err != nil {
+				log.Printf("Failed to start SOCKS server: %v", err)
+				continue
+			}
+			sl, err := listenTCP("socks/"+socksaddr, socksaddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			socksListeners = append(socksListeners, sl)
+			log.Printf("SOCKS (via HTTP proxy %s) listening on %s", httpaddr, socksaddr)
+			go serve(srv.Serve, sl)
+
+			// Transparent proxy
+			if *transparentPort == 0 {
+				continue
+			}
+			taddr := net.JoinHostPort(host, strconv.Itoa(*transparentPort))
+			tl, err := listenWith("transparent/"+taddr, func() (net.Listener, error) {
+				return listenTransparent(taddr)
+			})
+			if err != nil {
+				log.Fatalf("Error starting transparent proxy: %v", err)
+			}
+			socksListeners = append(socksListeners, tl)
+			log.Printf("Transparent proxy (via HTTP proxy %s) listening on %s", httpaddr, taddr)
+			go serve(newTransparentProxy(httpaddr).Serve, tl)
+		}
+	}
+
+	if opts.credentials != nil {
+		path, err := credentialsTokenPath(*port)
+		if err == nil {
+			err = opts.credentials.writeToken(path)
+		}
+		if err != nil {
+			log.Printf("The credentials API won't be usable: %v", err)
+		}
+	}
+
+	// The wrapped PAC file can also be served over HTTPS, since some systems won't use a PAC
+	// file from a plain HTTP URL. This listens on the same hosts as the main server.
+	if *pacHTTPSPort != 0 {
+		hosts := make([]string, 0, len(addrs))
+		for _, la := range addrs {
+			hosts = append(hosts, la.host)
+		}
+		cert, err := loadPACCert(*pacTLSCert, *pacTLSKey, hosts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ps := &http.Server{
+			Handler:           pacOnly(s.Handler),
+			TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}},
+			ReadHeaderTimeout: *readHeaderTimeout,
+			IdleTimeout:       *idleTimeout,
+		}
+		servers = append(servers, ps)
+		serveTLS := func(l net.Listener) error { return ps.ServeTLS(l, "", "") }
+		bound := make(map[string]bool)
+		for _, la := range addrs {
+			if bound[la.host] {
+				continue
+			}
+			bound[la.host] = true
+			for _, l := range bind(listenAddr{host: la.host, port: *pacHTTPSPort}) {
+				log.Printf("Serving the PAC file at https://%s/alpaca.pac", l.Addr())
+				go serve(serveTLS, l)
+			}
+		}
+	}
+
+	// Each extra listener from the config file gets a server of its own, which authenticates
+	// to the upstream proxy with that listener's credentials. It listens on the same hosts as
+	// the main server.
+	for _, lc := range extraListeners {
+		a, err := lc.authenticator()
+		if err != nil {
+			log.Fatalf("Error getting credentials for port %d: %v", lc.Port, err)
+		}
+		var auth proxyAuth
+		user := "no proxy auth"
+		if a != nil {
+			auth = a
+			user = a.domain + `\` + a.username
+		}
+		// The credentials API only changes the main server's credentials.
+		extraOpts := opts
+		extraOpts.credentials = nil
+		// The proxy might not give every account the same responses.
+		extraOpts.responseCache = nil
+		ls := newServer(lc.Port, auth, extraOpts)
+		servers = append(servers, ls)
+		hosts := make(map[string]bool)
+		for _, la := range addrs {
+			if hosts[la.host] {
+				continue
+			}
+			hosts[la.host] = true
+			for _, l := range bind(listenAddr{host: la.host, port: lc.Port}) {
+				log.Printf("Listening on %s (%s)", l.Addr(), user)
+				go serve(ls.Serve, l)
+			}
+		}
+	}
+
+	// Close any listeners inherited from the old instance that this one doesn't use (e.g. if
+	// -reuse-port has changed), so that connections aren't queued on sockets that nobody accepts.
+	for name, l := range inherited {
+		if listeners[name] != l {
+			log.Printf("Closing unused listener %s from the old instance", name)
+			l.Close()
+		}
+	}
+
+	// Listen for a new instance taking over from this one. If this instance is taking over from
+	// another one, that has to wait until the old instance has handed over its tunnels and removed
+	// its handoff socket, which happens once it has finished handling its in-flight requests.
+	go func() {
+		if tookOver != nil {
+			if err := <-tookOver; err != nil {
+				log.Printf("Error taking over tunnels from the old instance: %v", err)
+			}
+		}
+		if path, err := handoffSocketPath(*port); err != nil {
+			log.Printf("Taking over from this instance won't be possible: %v", err)
+		} else if hl, err := listenForTakeover(path); err != nil {
+			log.Printf("Taking over from this instance won't be possible: %v", err)
+		} else if hl != nil {
+			stop := func() {
+				ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+				defer cancel()
+				for _, s := range servers {
+					_ = s.Shutdown(ctx)
+				}
+				for _, l := range socksListeners {
+					l.Close()
+				}
+			}
+			if err := handOver(hl, listeners, tunnels, stop); err != nil {
+				log.Fatalf("Error handing over to new instance: %v", err)
+			}
+			log.Printf("Handed over to new instance, waiting for %d tunnel(s) to close",
+				tunnels.count())
+			tunnels.wait(drainTimeout)
+			os.Exit(0)
+		}
+	}()
+
+	var sp *systemProxy
+	if *setSystemProxy {
+		var err error
+		if sp, err = newSystemProxy(); err == nil {
+			err = sp.set(addrs[0].host, addrs[0].port, *socksPort)
+		}
+		if err != nil {
+			log.Fatalf("Error setting system proxy: %v", err)
+		}
+		go func() {
+			sigch := make(chan os.Signal, 1)
+			signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+			<-sigch
+			sp.restore()
+			os.Exit(0)
+		}()
+	}
+
+	err = <-errch
+	if sp != nil {
+		sp.restore()
+	}
+	log.Fatal(err)
+}
+
+// serverOptions holds the optional settings for createServer. The zero value of each field gives
+// the default behaviour.
+type serverOptions struct {
+	pacBypass       []string      // Host patterns that the served PAC file sends DIRECT
+	pacFailover     []string      // Other Alpaca instances for the served PAC file to fall back to
+	myIP            string        // See the -my-ip flag
+	pacRefresh      time.Duration // How often to check the PAC file for changes (0 to disable)
+	localDirect     bool          // Whether to connect directly to hosts on local subnets
+	routes          *routingRules // Rules that override the PAC file
+	healthRules     []healthRule  // Rules that override the PAC file while a proxy is down
+	pacOverride     *pacOverride  // A local PAC file or rules that override the PAC file
+	captivePortal   bool          // Whether to go direct while behind a captive portal
+	pinRedirects    time.Duration // How long to send redirect targets via the same proxy
+	extensionOrigin string        // The origin of the browser extension allowed to use the API
+	maxConnLifetime time.Duration // Maximum lifetime of pooled upstream connections (0 for none)
+	idleConns       int           // Number of idle connections to keep to each upstream proxy
+	maxBufferedBody int64         // How much of each request body to keep for sending again
+	directTimeout   time.Duration // How long to wait for a direct connection before falling back
+	captureSize     int           // Number of requests to keep in the HAR capture (0 to disable)
+	// If set, large downloads are split into parallel range requests.
+	parallel *parallelDownloads
+	// If set, limits the number of connections to each destination host.
+	connLimiter *connLimiter
+	// If set, content-addressed blobs are cached on disk.
+	blobCache *blobCache
+	// If set, cacheable responses to plain HTTP requests are cached.
+	responseCache *responseCache
+	// If set, request bodies are scanned before they're sent.
+	uploads *uploadScanner
+	// If set, response bodies are scanned before they're passed on.
+	downloads *downloadScanner
+	// If set, limits the rate at which data is sent to clients.
+	bandwidth *bandwidthLimiter
+	// If set, requests are counted for the usage statistics.
+	usage *usageStats
+	// If set, the state of the PAC file is included in debug dumps.
+	debug *debugState
+	// If set, the dashboard lists the client connections.
+	conns *connTracker
+	// If set, proxied requests are traced (see the OTEL_* environment variables).
+	tracer *tracer
+	// If set, the credentials can be changed using the API.
+	credentials *credentialsAPI
+	// If set, limits the number of client connections open at once.
+	maxConns *connCap
+	// If set, old PAC files are kept, and can be rolled back to using the API.
+	pacHistory *pacHistory
+	// If set, idle upstream connections are closed when memory use is over the limit.
+	memory *memoryMonitor
+	// If set, another instance of Alpaca to send every request to, instead of using the PAC
+	// file.
+	upstreamAlpaca *url.URL
+	// Whether to probe upstream proxies for the auth schemes that they offer.
+	probeAuth bool
+	// If set, used instead of dialNAT64 for all outgoing connections, to proxies and servers
+	// (e.g. by a Harness, to send them to its fake upstream).
+	dial dialFunc
+	// If set, called with each error that's sent to a client (see Config.OnError).
+	onError func(*http.Request, error)
+	// If set, the ProxyFinder is stored here, so that a Server can report on the PAC file.
+	finder **ProxyFinder
+}
+
+func createServer(host string, port int, pacurls []string, auth proxyAuth, tunnels *tunnelTracker,
+	opts serverOptions) *http.Server {
+	dial := opts.dial
+	if dial == nil {
+		dial = dialNAT64
+	}
+	pacWrapper := NewPACWrapper(PACData{
+		Port:     port,
+		Bypass:   opts.pacBypass,
+		Failover: opts.pacFailover,
+	})
+	proxyFinder := NewProxyFinder(pacurls, pacWrapper, opts.myIP)
+	if opts.localDirect {
+		proxyFinder.local = newLocalSubnets()
+	}
+	if opts.routes != nil && len(opts.routes.rules) > 0 {
+		proxyFinder.routes = opts.routes
+	}
+	proxyFinder.patch = opts.pacOverride
+	if len(opts.healthRules) > 0 {
+		proxyFinder.health = newHealthChecker(opts.healthRules)
+		proxyFinder.health.dial = dial
+		proxyFinder.health.start()
+	}
+	if opts.captivePortal {
+		proxyFinder.captive = newCaptivePortal(dial)
+		proxyFinder.captive.onClear = func() {
+			// The PAC server was probably unreachable, so try it again now.
+			proxyFinder.Lock()
+			proxyFinder.fetcher.forceDownload = true
+			proxyFinder.Unlock()
+		}
+		proxyFinder.captive.start()
+	}
+	if opts.pinRedirects > 0 {
+		proxyFinder.pins = newRedirectPins(opts.pinRedirects)
+	}
+	proxyFinder.upstream = opts.upstreamAlpaca
+	schemes := newAuthSchemeCache()
+	if opts.probeAuth {
+		proxyFinder.setAuthProber(newAuthProber(auth, dial, schemes))
+	}
+	if opts.pacHistory != nil {
+		proxyFinder.setHistory(opts.pacHistory)
+	}
+	proxyFinder.refreshEvery(opts.pacRefresh)
+	if opts.debug != nil {
+		opts.debug.addFinder(proxyFinder)
+	}
+	if opts.finder != nil {
+		*opts.finder = proxyFinder
+	}
+	proxyHandler := NewProxyHandler(auth, getProxyFromContext, proxyFinder.blockProxy)
+	proxyHandler.tunnels = tunnels
+	proxyHandler.setDialer(dial)
+	proxyHandler.schemes = schemes
+	proxyHandler.setMaxConnLifetime(opts.maxConnLifetime)
+	proxyHandler.setIdleConns(opts.idleConns)
+	if opts.maxBufferedBody > 0 {
+		proxyHandler.maxBufferedBody = opts.maxBufferedBody
+	}
+	proxyHandler.directTimeout = opts.directTimeout
+	proxyHandler.parallel = opts.parallel
+	proxyHandler.upstreamAlpaca = opts.upstreamAlpaca
+	if opts.memory != nil {
+		opts.memory.onPressure(proxyHandler.transport.CloseIdleConnections)
+	}
+	mux := http.NewServeMux()
+	pacWrapper.SetupHandlers(mux)
+	extension := &extensionAPI{finder: proxyFinder, origin: opts.extensionOrigin}
+	extension.SetupHandlers(mux)
+	if opts.credentials != nil {
+		opts.credentials.SetupHandlers(mux)
+	}
+	if opts.pacHistory != nil {
+		history := &pacHistoryAPI{history: opts.pacHistory, finder: proxyFinder}
+		history.SetupHandlers(mux)
+	}
+	annotations := newAnnotations()
+	annotations.SetupHandlers(mux)
+	dashboard := newDashboard(proxyFinder, tunnels, opts.conns)
+	dashboard.limiter = opts.connLimiter
+	dashboard.auth, _ = auth.(*rotatingAuth)
+	if fa, ok := auth.(*fallbackAuth); ok {
+		dashboard.auth, _ = fa.primary.(*rotatingAuth)
+	}
+	dashboard.maxConns = opts.maxConns
+	dashboard.latencies = proxyHandler.latencies
+	dashboard.SetupHandlers(mux)
+	var capture *capture
+	if opts.captureSize > 0 {
+		capture = newCapture(opts.captureSize)
+		capture.SetupHandlers(mux)
+	}
+
+	// build the handler by wrapping middleware upon middleware
+	var handler http.Handler = mux
+	handler = RequestLogger(handler)
+	handler = proxyHandler.WrapHandler(handler)
+	if opts.usage != nil {
+		handler = opts.usage.WrapHandler(handler)
+	}
+	if opts.connLimiter != nil {
+		handler = opts.connLimiter.WrapHandler(handler)
+	}
+	if opts.downloads != nil {
+		handler = opts.downloads.WrapHandler(handler)
+	}
+	if opts.uploads != nil {
+		handler = opts.uploads.WrapHandler(handler)
+	}
+	if opts.bandwidth != nil {
+		handler = opts.bandwidth.WrapHandler(handler)
+	}
+	if opts.responseCache != nil {
+		handler = opts.responseCache.WrapHandler(handler)
+	}
+	if opts.blobCache != nil {
+		handler = opts.blobCache.WrapHandler(handler)
+	}
+	if capture != nil {
+		handler = capture.WrapHandler(handler)
+	}
+	handler = dashboard.WrapHandler(handler)
+	handler = proxyFinder.WrapHandler(handler)
+	handler = annotations.WrapHandler(handler)
+	if opts.tracer != nil {
+		handler = opts.tracer.WrapHandler(handler)
+	}
+	if opts.onError != nil {
+		handler = reportErrors(handler, opts.onError)
+	}
+	handler = AddContextID(handler)
+
+	return &http.Server{
+		// Set the addr to host(defaults to localhost) : port(defaults to 3128)
+		Addr:    net.JoinHostPort(host, strconv.Itoa(port)),
+		Handler: handler,
+		// TODO: Implement HTTP/2 support. In the meantime, set TLSNextProto to a non-nil
+		// value to disable HTTP/2.
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+}
+
+// splitList splits a comma-separated flag value, ignoring any empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
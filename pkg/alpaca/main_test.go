@@ -19,7 +19,7 @@
 
 // +build squid
 
-package main
+package alpaca
 
 import (
 	"bytes"
@@ -190,7 +190,8 @@ func TestWithSquid(t *testing.T) {
 	// Run (most of) Alpaca in a goroutine.
 	port, err := strconv.Atoi(findAvailablePort(t))
 	require.NoError(t, err)
-	alpaca := createServer("localhost", port, pacServer.URL, nil)
+	alpaca := createServer("localhost", port, []string{pacServer.URL}, nil, newTunnelTracker(),
+		serverOptions{})
 	go alpaca.ListenAndServe()
 	defer alpaca.Close()
 	waitForServer(alpaca.Addr)
@@ -0,0 +1,143 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connCapLogInterval is how often Alpaca logs that it's at the -max-conns limit.
+const connCapLogInterval = time.Minute
+
+// connCap limits the number of client connections (including ones that have become tunnels) that
+// are open at once, across all listeners, so that a misbehaving client can't use up all of the
+// file descriptors. At the limit, listeners stop accepting connections (so new ones wait in the
+// listen backlog) until one is closed, and idle keep-alive connections are closed to make room.
+type connCap struct {
+	sem     chan struct{}
+	full    []func() // Called when the limit is reached, to close idle connections
+	waits   atomic.Int64
+	lastLog time.Time
+	now     func() time.Time
+	mux     sync.Mutex // Protects full and lastLog
+}
+
+func newConnCap(max int) *connCap {
+	return &connCap{sem: make(chan struct{}, max), now: time.Now}
+}
+
+// onFull registers a function that closes idle connections, to be called when the limit is
+// reached.
+func (cc *connCap) onFull(f func()) {
+	cc.mux.Lock()
+	defer cc.mux.Unlock()
+	cc.full = append(cc.full, f)
+}
+
+// acquire waits for a free slot, returning false if done is closed first.
+func (cc *connCap) acquire(done <-chan struct{}) bool {
+	select {
+	case cc.sem <- struct{}{}:
+		return true
+	default:
+	}
+	cc.waits.Add(1)
+	cc.mux.Lock()
+	full := slices.Clone(cc.full)
+	if now := cc.now(); now.Sub(cc.lastLog) >= connCapLogInterval {
+		cc.lastLog = now
+		log.Printf("There are %d client connections open, the most allowed by -max-conns; new "+
+			"connections will wait until one is closed", cap(cc.sem))
+	}
+	cc.mux.Unlock()
+	for _, f := range full {
+		f()
+	}
+	select {
+	case cc.sem <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (cc *connCap) release() {
+	<-cc.sem
+}
+
+// open returns the number of connections holding a slot.
+func (cc *connCap) open() int {
+	return len(cc.sem)
+}
+
+// wrap returns a listener whose connections count towards the limit.
+func (cc *connCap) wrap(l net.Listener) net.Listener {
+	return &cappedListener{Listener: l, cap: cc, done: make(chan struct{})}
+}
+
+type cappedListener struct {
+	net.Listener
+	cap   *connCap
+	done  chan struct{} // Closed when the listener is closed, to stop waiting for a slot
+	close sync.Once
+}
+
+func (l *cappedListener) Accept() (net.Conn, error) {
+	if !l.cap.acquire(l.done) {
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.cap.release()
+		return nil, err
+	}
+	return &cappedConn{Conn: conn, release: sync.OnceFunc(l.cap.release)}, nil
+}
+
+func (l *cappedListener) Close() error {
+	l.close.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// cappedConn is a client connection that frees its slot when it's closed.
+type cappedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *cappedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+// NetConn returns the underlying connection (like tls.Conn's), e.g. for setKeepAlive.
+func (c *cappedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// baseConn returns the connection that a cappedConn wraps, e.g. so that tunnels between TCP
+// connections can still use splice(2). Other wrappers are left alone.
+func baseConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*cappedConn); ok {
+		return c.Conn
+	}
+	return conn
+}
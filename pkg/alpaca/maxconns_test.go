@@ -0,0 +1,98 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnCapWaitsForAConnectionToClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cc := newConnCap(1)
+	var full atomic.Int32
+	cc.onFull(func() { full.Add(1) })
+	cl := cc.wrap(l)
+	defer cl.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := cl.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+	first := <-accepted
+	assert.Equal(t, 1, cc.open())
+	// The second connection has to wait for the first to be closed.
+	select {
+	case <-accepted:
+		t.Fatal("accepted a connection over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, int32(1), full.Load())
+	assert.Equal(t, int64(1), cc.waits.Load())
+	require.NoError(t, first.Close())
+	second := <-accepted
+	assert.Equal(t, 1, cc.open())
+	second.Close()
+	second.Close() // Only frees its slot once
+	// Accept holds a slot while it waits for the next connection, until the listener is closed.
+	require.NoError(t, cl.Close())
+	_, ok := <-accepted
+	assert.False(t, ok)
+	assert.Equal(t, 0, cc.open())
+}
+
+func TestClosingCappedListenerStopsWaiting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cc := newConnCap(1)
+	cc.sem <- struct{}{} // Already at the limit
+	cl := cc.wrap(l)
+	errs := make(chan error)
+	go func() {
+		_, err := cl.Accept()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, cl.Close())
+	assert.ErrorIs(t, <-errs, net.ErrClosed)
+}
+
+func TestBaseConn(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	capped := &cappedConn{Conn: server, release: func() {}}
+	assert.Same(t, server, baseConn(capped))
+	assert.Same(t, client, baseConn(client))
+	_, err := connFile(capped)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryPressure is set while Alpaca is using more memory than -memory-limit allows. While it's
+// set, new downloads aren't split into parallel range requests (which are held in memory).
+var memoryPressure atomic.Bool
+
+// How often the memory monitor checks how much memory Alpaca is using, and how often (at most) it
+// logs that it's over the limit.
+const (
+	memoryCheckInterval = 10 * time.Second
+	memoryLogInterval   = time.Minute
+)
+
+// memoryMonitor enforces a soft limit on Alpaca's memory use (its resident set size). When the
+// limit is exceeded, it frees what it can: idle connections (and anything else registered with
+// onPressure) are closed, downloads stop being split into parallel ranges, and memory that the Go
+// runtime isn't using is returned to the OS. It also logs what's using the most memory. It never
+// refuses requests, so Alpaca can still go over the limit.
+type memoryMonitor struct {
+	limit   int64
+	rss     func() (int64, error)
+	conns   *connTracker   // If set, the number of open connections is logged
+	tunnels *tunnelTracker // If set, the number of open tunnels is logged
+	shrink  []func()       // Called to free memory when the limit is exceeded
+	lastLog time.Time
+	now     func() time.Time
+	mux     sync.Mutex
+}
+
+func newMemoryMonitor(limit int64, conns *connTracker, tunnels *tunnelTracker) *memoryMonitor {
+	// The Go runtime's own soft limit makes the garbage collector work harder as the heap
+	// approaches the limit, so the monitor should rarely have to do anything.
+	debug.SetMemoryLimit(limit)
+	return &memoryMonitor{
+		limit:   limit,
+		rss:     readRSS,
+		conns:   conns,
+		tunnels: tunnels,
+		now:     time.Now,
+	}
+}
+
+// onPressure registers a function that frees some memory, to be called when the limit is
+// exceeded.
+func (mm *memoryMonitor) onPressure(shrink func()) {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	mm.shrink = append(mm.shrink, shrink)
+}
+
+// run checks the memory use every memoryCheckInterval, until stop is closed (if ever).
+func (mm *memoryMonitor) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mm.check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (mm *memoryMonitor) check() {
+	rss, err := mm.rss()
+	if err != nil {
+		log.Printf("Error checking memory use: %v", err)
+		return
+	}
+	if rss <= mm.limit {
+		// Wait until there's some room to spare before splitting downloads again, so that
+		// it doesn't flip back and forth.
+		if memoryPressure.Load() && rss < mm.limit/10*9 {
+			log.Printf("Memory use (%s) is back under -memory-limit (%s)", formatSize(rss),
+				formatSize(mm.limit))
+			memoryPressure.Store(false)
+		}
+		return
+	}
+	memoryPressure.Store(true)
+	mm.mux.Lock()
+	shrink := slices.Clone(mm.shrink)
+	mm.mux.Unlock()
+	for _, f := range shrink {
+		f()
+	}
+	debug.FreeOSMemory()
+	if now := mm.now(); now.Sub(mm.lastLog) >= memoryLogInterval {
+		mm.lastLog = now
+		log.Printf("Memory use (%s) is over -memory-limit (%s), freeing what can be freed. %s",
+			formatSize(rss), formatSize(mm.limit), mm.consumers())
+	}
+}
+
+// consumers describes what's using the most memory: the number of open connections, tunnels
+// and goroutines, and the functions that allocated the most memory that's still in use.
+func (mm *memoryMonitor) consumers() string {
+	var parts []string
+	if mm.conns != nil {
+		parts = append(parts, fmt.Sprintf("%d connections", len(mm.conns.list())))
+	}
+	if mm.tunnels != nil {
+		parts = append(parts, fmt.Sprintf("%d tunnels", mm.tunnels.count()))
+	}
+	parts = append(parts, fmt.Sprintf("%d goroutines", runtime.NumGoroutine()))
+	var allocs []string
+	for _, a := range topAllocations(5) {
+		allocs = append(allocs, fmt.Sprintf("%s (%s)", a.function, formatSize(a.bytes)))
+	}
+	summary := "Open: " + strings.Join(parts, ", ")
+	if len(allocs) > 0 {
+		summary += ". Biggest allocations: " + strings.Join(allocs, ", ")
+	}
+	return summary
+}
+
+type allocation struct {
+	function string
+	bytes    int64
+}
+
+// topAllocations returns the n functions (outside the Go runtime) that allocated the most memory
+// that's still in use, from the heap profile. The profile only samples allocations, so the sizes
+// are estimates.
+func topAllocations(n int) []allocation {
+	var records []runtime.MemProfileRecord
+	for {
+		count, ok := runtime.MemProfile(records, false)
+		if ok {
+			records = records[:count]
+			break
+		}
+		records = make([]runtime.MemProfileRecord, count+50)
+	}
+	totals := make(map[string]int64)
+	for _, r := range records {
+		if r.InUseBytes() <= 0 {
+			continue
+		}
+		frames := runtime.CallersFrames(r.Stack())
+		for {
+			frame, more := frames.Next()
+			if !strings.HasPrefix(frame.Function, "runtime.") || !more {
+				totals[frame.Function] += r.InUseBytes()
+				break
+			}
+		}
+	}
+	allocs := make([]allocation, 0, len(totals))
+	for function, size := range totals {
+		allocs = append(allocs, allocation{function, size})
+	}
+	slices.SortFunc(allocs, func(a, b allocation) int { return cmp.Compare(b.bytes, a.bytes) })
+	return allocs[:min(n, len(allocs))]
+}
+
+// readRSS returns the resident set size of this process. On Linux, that's read from
+// /proc/self/statm; elsewhere, it's estimated from the memory that the Go runtime has got from
+// the OS (and not given back).
+func readRSS() (int64, error) {
+	if buf, err := os.ReadFile("/proc/self/statm"); err == nil {
+		fields := bytes.Fields(buf)
+		if len(fields) < 2 {
+			return 0, fmt.Errorf("unexpected contents of /proc/self/statm: %q", buf)
+		}
+		pages, err := strconv.ParseInt(string(fields[1]), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return pages * int64(os.Getpagesize()), nil
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.Sys - ms.HeapReleased), nil
+}
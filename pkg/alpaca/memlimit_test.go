@@ -0,0 +1,93 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryMonitor(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(io.Discard)
+	defer memoryPressure.Store(false)
+	var rss int64
+	now := time.Now()
+	mm := &memoryMonitor{
+		limit:   1000,
+		rss:     func() (int64, error) { return rss, nil },
+		tunnels: newTunnelTracker(),
+		now:     func() time.Time { return now },
+	}
+	shrunk := 0
+	mm.onPressure(func() { shrunk++ })
+
+	rss = 500
+	mm.check()
+	assert.Equal(t, 0, shrunk)
+	assert.False(t, memoryPressure.Load())
+	assert.Empty(t, logs.String())
+
+	rss = 2000
+	mm.check()
+	assert.Equal(t, 1, shrunk)
+	assert.True(t, memoryPressure.Load())
+	assert.Contains(t, logs.String(), "Memory use (2000B) is over -memory-limit (1000B)")
+	assert.Contains(t, logs.String(), "Open: 0 tunnels")
+
+	// It keeps freeing memory while it's over the limit, but doesn't log it every time.
+	logs.Reset()
+	mm.check()
+	assert.Equal(t, 2, shrunk)
+	assert.Empty(t, logs.String())
+
+	// Downloads aren't split again until there's some room to spare.
+	rss = 950
+	mm.check()
+	assert.True(t, memoryPressure.Load())
+	rss = 800
+	mm.check()
+	assert.False(t, memoryPressure.Load())
+	assert.Contains(t, logs.String(), "back under -memory-limit")
+	assert.Equal(t, 2, shrunk)
+}
+
+func TestReadRSS(t *testing.T) {
+	rss, err := readRSS()
+	require.NoError(t, err)
+	assert.Greater(t, rss, int64(1<<20))
+}
+
+func TestTopAllocations(t *testing.T) {
+	buf := make([]byte, 64<<20)
+	runtime.GC()
+	allocs := topAllocations(3)
+	require.NotEmpty(t, allocs)
+	found := false
+	for _, a := range allocs {
+		found = found || strings.HasSuffix(a.function, ".TestTopAllocations")
+	}
+	assert.True(t, found, allocs)
+	runtime.KeepAlive(buf)
+}
@@ -0,0 +1,204 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultMessages are the user-facing messages (i.e. ones that are shown to people who use
+// Alpaca, rather than logged for the people who run it), in English. Each one has an ID that
+// translations refer to (see messageCatalogs), and some are format strings.
+var defaultMessages = map[string]string{
+	"error.title":   "Alpaca couldn't complete this request",
+	"error.details": "Details",
+	"error.auth_rejected": "Check the credentials that Alpaca is using (e.g. your password " +
+		"may have changed); run alpaca with -d and -u to enter them again.",
+	"error.upstream_unreachable": "The proxy couldn't be reached. If you've changed networks, " +
+		"try again; Alpaca will use the next proxy in the PAC file, or go direct.",
+	"error.too_many_connections": "Too many requests to this host are already in progress; " +
+		"try again later, or raise -max-conns-per-host.",
+	"error.proxy_loop": "Alpaca is sending requests to itself. Check that the PAC file (-C) " +
+		"doesn't point at Alpaca (e.g. at its own alpaca.pac), and that the upstream proxy " +
+		"doesn't send requests back to Alpaca.",
+	"error.request_too_large": "The request body is larger than -max-body-bytes allows.",
+	"error.upload_blocked": "The upload was blocked by the upload scanner (-scan-uploads). " +
+		"Contact whoever runs the scanner if you think that's a mistake.",
+	"error.download_blocked": "The download was blocked by the download scanner " +
+		"(-scan-downloads). Contact whoever runs the scanner if you think that's a mistake.",
+	"error.dns_error": "Check that the host name is correct. If it's an internal host, you may " +
+		"need to be connected to the VPN.",
+	"error.timeout": "The connection timed out. The host may be down, or blocked by a firewall; " +
+		"try again, or check whether it needs to go via a proxy.",
+	"error.connection_refused": "The host refused the connection. The service may be down or " +
+		"restarting; try again later.",
+	"error.connection_reset": "The connection was closed before a response was received; try " +
+		"again.",
+	"error.pac_error": "The PAC file failed to run; check the PAC file given by -C (or your " +
+		"system settings).",
+	"prompt.password":   "Password (for %s): ",
+	"prompt.passphrase": "Passphrase (for credentials file): ",
+	"cli.need_account":  "Please specify a domain (using -d) and username (using -u)",
+	"cli.need_credentials_file": "Please specify a domain (using -d), username (using -u) and " +
+		"credentials file (using -credentials-file)",
+	"cli.saved_credentials": "Saved credentials for %s to %s",
+	"cli.add_to_profile":    "Add this to your ~/.profile (or equivalent) and restart your shell",
+}
+
+// messageCatalogs holds translations of the default messages, by language (e.g. "de" or
+// "pt-br"). They're loaded from a directory (given by the -messages flag) of JSON files named
+// after the language, e.g. de.json, each of which maps message IDs to translations. Messages that
+// aren't translated are shown in English.
+type messageCatalogs struct {
+	catalogs map[string]map[string]string
+}
+
+// messages is the catalogs that are used for user-facing messages. It's empty (i.e. messages are
+// shown in English) unless -messages is given.
+var messages = &messageCatalogs{}
+
+func loadMessageCatalogs(dir string) (*messageCatalogs, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	} else if len(paths) == 0 {
+		return nil, fmt.Errorf("no message catalogs (e.g. de.json) found in %s", dir)
+	}
+	mc := &messageCatalogs{catalogs: make(map[string]map[string]string)}
+	for _, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(buf, &catalog); err != nil {
+			return nil, fmt.Errorf("error parsing message catalog %s: %w", path, err)
+		}
+		for id, text := range catalog {
+			english, ok := defaultMessages[id]
+			if !ok {
+				return nil, fmt.Errorf("unknown message %q in %s", id, path)
+			} else if formatVerbs(text) != formatVerbs(english) {
+				return nil, fmt.Errorf("message %q in %s should have the same %%s and %%v "+
+					"placeholders as the English version (%q)", id, path, english)
+			}
+		}
+		lang := normalizeLanguage(strings.TrimSuffix(filepath.Base(path), ".json"))
+		mc.catalogs[lang] = catalog
+	}
+	return mc, nil
+}
+
+// formatVerbs returns the verbs (e.g. "%s") in a format string, so that translations can be
+// checked against the English version.
+func formatVerbs(format string) string {
+	var verbs []string
+	for i := 0; i < len(format)-1; i++ {
+		if format[i] == '%' {
+			verbs = append(verbs, format[i:i+2])
+			i++
+		}
+	}
+	return strings.Join(verbs, "")
+}
+
+// normalizeLanguage converts a language tag (e.g. "pt-BR") or locale (e.g. "pt_BR.UTF-8") to the
+// form used for catalogs (e.g. "pt-br").
+func normalizeLanguage(lang string) string {
+	lang, _, _ = strings.Cut(lang, ".")
+	lang, _, _ = strings.Cut(lang, "@")
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(lang), "_", "-"))
+}
+
+// text returns the message with the given ID, in the first of the languages (in order of
+// preference) that it's been translated into, or in English. If there are any args, the message
+// is used as a format string.
+func (mc *messageCatalogs) text(langs []string, id string, args ...interface{}) string {
+	format := defaultMessages[id]
+	for _, lang := range langs {
+		base, _, _ := strings.Cut(lang, "-")
+		if t, ok := mc.catalogs[lang][id]; ok {
+			format = t
+			break
+		} else if t, ok := mc.catalogs[base][id]; ok {
+			format = t
+			break
+		} else if base == "en" {
+			break
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// requestLanguages returns the languages that the client prefers, from its Accept-Language
+// header, e.g. ["de-ch", "de", "en"] for "de-CH, de;q=0.9, en;q=0.5".
+func requestLanguages(req *http.Request) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var prefs []weighted
+	for _, value := range req.Header.Values("Accept-Language") {
+		for _, elem := range strings.Split(value, ",") {
+			lang, params, _ := strings.Cut(elem, ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				var err error
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			if lang = normalizeLanguage(lang); lang != "" && lang != "*" && q > 0 {
+				prefs = append(prefs, weighted{lang, q})
+			}
+		}
+	}
+	slices.SortStableFunc(prefs, func(a, b weighted) int { return cmp.Compare(b.q, a.q) })
+	langs := make([]string, len(prefs))
+	for i, pref := range prefs {
+		langs[i] = pref.lang
+	}
+	return langs
+}
+
+// localLanguages returns the language of the user who's running Alpaca, from the locale
+// environment variables, e.g. ["de-de"] for LANG=de_DE.UTF-8.
+func localLanguages(getenv func(string) string) []string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := getenv(name); value != "" {
+			if lang := normalizeLanguage(value); lang != "c" && lang != "posix" {
+				return []string{lang}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// localText returns a message for the user who's running Alpaca (see localLanguages).
+func localText(id string, args ...interface{}) string {
+	return messages.text(localLanguages(os.Getenv), id, args...)
+}
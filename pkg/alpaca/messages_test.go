@@ -0,0 +1,95 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeMessageCatalogs(t *testing.T, catalogs map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range catalogs {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	return dir
+}
+
+func TestMessageCatalogs(t *testing.T) {
+	mc, err := loadMessageCatalogs(writeMessageCatalogs(t, map[string]string{
+		"de.json":    `{"error.title": "Alpaca konnte die Anfrage nicht ausführen"}`,
+		"pt_BR.json": `{"prompt.password": "Senha (para %s): "}`,
+	}))
+	require.NoError(t, err)
+	tests := []struct {
+		langs    []string
+		id       string
+		expected string
+	}{
+		{[]string{"de-ch", "en"}, "error.title", "Alpaca konnte die Anfrage nicht ausführen"},
+		{[]string{"en", "de"}, "error.title", "Alpaca couldn't complete this request"},
+		{[]string{"fr", "de"}, "error.title", "Alpaca konnte die Anfrage nicht ausführen"},
+		{[]string{"de"}, "error.details", "Details"},
+		{[]string{"pt-br"}, "prompt.password", "Senha (para CORP\\me): "},
+		{[]string{"pt"}, "prompt.password", "Password (for CORP\\me): "},
+		{nil, "prompt.password", "Password (for CORP\\me): "},
+	}
+	for _, test := range tests {
+		var args []interface{}
+		if test.id == "prompt.password" {
+			args = append(args, "CORP\\me")
+		}
+		assert.Equal(t, test.expected, mc.text(test.langs, test.id, args...), test.langs)
+	}
+}
+
+func TestMessageCatalogErrors(t *testing.T) {
+	for _, catalogs := range []map[string]string{
+		{},
+		{"de.json": `{"error.nonexistent": "Fehler"}`},
+		{"de.json": `{"prompt.password": "Passwort: "}`},
+		{"de.json": `["not", "an", "object"]`},
+	} {
+		_, err := loadMessageCatalogs(writeMessageCatalogs(t, catalogs))
+		assert.Error(t, err, catalogs)
+	}
+}
+
+func TestRequestLanguages(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+	assert.Empty(t, requestLanguages(req))
+	req.Header.Set("Accept-Language", "en;q=0.5, de-CH, *;q=0.1, de;q=0.9, fr;q=0")
+	assert.Equal(t, []string{"de-ch", "de", "en"}, requestLanguages(req))
+}
+
+func TestLocalLanguages(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+	assert.Equal(t, []string{"de-de"}, localLanguages(env(map[string]string{
+		"LANG": "de_DE.UTF-8",
+	})))
+	assert.Equal(t, []string{"fr"}, localLanguages(env(map[string]string{
+		"LC_ALL": "fr", "LANG": "de_DE.UTF-8",
+	})))
+	assert.Empty(t, localLanguages(env(map[string]string{"LC_ALL": "C", "LANG": "de_DE"})))
+	assert.Empty(t, localLanguages(env(nil)))
+}
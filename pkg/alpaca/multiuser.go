@@ -0,0 +1,108 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// systemConfigPath is the config file for a system-wide installation, whose settings apply to
+// every user of the machine (unless they override them). Since it can set flags such as
+// -credential-helper, which runs a command, it's only used if it's owned by root and nobody else
+// can change it.
+var systemConfigPath = "/etc/alpaca/config.json"
+
+// defaultConfigPaths returns the config files that are used if -config isn't given, in order of
+// precedence: the user's own config file, then the system-wide one. Either may not exist.
+func defaultConfigPaths() []string {
+	var paths []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "alpaca", "config.json"))
+	}
+	if runtime.GOOS != "windows" {
+		paths = append(paths, systemConfigPath)
+	}
+	return paths
+}
+
+// checkSystemConfig returns an error if the system-wide config file could have been changed by
+// someone other than root.
+func checkSystemConfig(info os.FileInfo) error {
+	if uid, ok := fileOwner(info); ok && uid != 0 {
+		return fmt.Errorf("%s must be owned by root", systemConfigPath)
+	} else if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s mustn't be writable by group or others", systemConfigPath)
+	}
+	return nil
+}
+
+// runtimeDir returns the directory for files that only last while Alpaca is running, such as the
+// handoff socket and the credentials API token: $XDG_RUNTIME_DIR if it's set, or else a directory
+// in the temp dir that only the current user can use, so that on a shared machine, other users
+// can't read the files, or put their own in their place.
+func runtimeDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir, nil
+	} else if runtime.GOOS == "windows" {
+		// The temp dir is already per-user on Windows.
+		return os.TempDir(), nil
+	}
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("alpaca-%d", os.Getuid()))
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	// If the directory already existed, make sure that it's really ours (and not a symlink).
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("%s isn't a directory", dir)
+	} else if uid, ok := fileOwner(info); ok && uid != os.Getuid() {
+		return "", fmt.Errorf("%s is owned by another user", dir)
+	} else if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s can be used by other users", dir)
+	}
+	return dir, nil
+}
+
+// isFlagSet returns whether a flag was set, whether on the command line, by an environment
+// variable or in a config file.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
+// portForUser returns the port for the given user from a range such as "3128-3227" (given by
+// -port-range), so that each user of a shared machine can run their own instance. Users are
+// spread across the range by their uid, so that each one always gets the same port.
+func portForUser(portRange string, uid int) (int, error) {
+	first, last, ok := strings.Cut(portRange, "-")
+	low, err1 := strconv.ParseUint(first, 10, 16)
+	high, err2 := strconv.ParseUint(last, 10, 16)
+	if !ok || err1 != nil || err2 != nil || low == 0 || high < low {
+		return 0, fmt.Errorf("invalid port range %q (expected e.g. \"3128-3227\")", portRange)
+	} else if uid < 0 {
+		return 0, errors.New("-port-range needs a uid, which isn't available on this platform")
+	}
+	return int(low) + uid%int(high-low+1), nil
+}
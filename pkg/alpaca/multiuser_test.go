@@ -0,0 +1,159 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortForUser(t *testing.T) {
+	port, err := portForUser("3128-3227", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, 3128, port)
+	port, err = portForUser("3128-3227", 1042)
+	require.NoError(t, err)
+	assert.Equal(t, 3170, port)
+	port, err = portForUser("8080-8080", 1042)
+	require.NoError(t, err)
+	assert.Equal(t, 8080, port)
+	for _, bad := range []string{"3128", "3227-3128", "0-10", "3128-99999", "a-b"} {
+		_, err := portForUser(bad, 1000)
+		assert.Error(t, err, bad)
+	}
+	_, err = portForUser("3128-3227", -1)
+	assert.Error(t, err)
+}
+
+func TestRuntimeDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the temp dir is already per-user on Windows")
+	}
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	dir, err := runtimeDir()
+	require.NoError(t, err)
+	assert.Equal(t, "/run/user/1000", dir)
+
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("TMPDIR", t.TempDir())
+	dir, err = runtimeDir()
+	require.NoError(t, err)
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	path, err := handoffSocketPath(3128)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "alpaca-3128.sock"), path)
+
+	// A directory that other users could have put files in isn't used.
+	require.NoError(t, os.Chmod(dir, 0777))
+	_, err = runtimeDir()
+	assert.ErrorContains(t, err, "other users")
+	require.NoError(t, os.Remove(dir))
+	require.NoError(t, os.Symlink(t.TempDir(), dir))
+	_, err = runtimeDir()
+	assert.ErrorContains(t, err, "isn't a directory")
+}
+
+func TestCheckSystemConfig(t *testing.T) {
+	path := writeConfigFile(t, `{"p": 3129}`)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	if os.Getuid() == 0 {
+		assert.NoError(t, checkSystemConfig(info))
+	} else if runtime.GOOS != "windows" {
+		assert.ErrorContains(t, checkSystemConfig(info), "owned by root")
+	}
+	if runtime.GOOS != "windows" {
+		require.NoError(t, os.Chmod(path, 0666))
+		info, err = os.Stat(path)
+		require.NoError(t, err)
+		assert.Error(t, checkSystemConfig(info))
+	}
+}
+
+func TestDefaultConfigFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sets $XDG_CONFIG_HOME, which is only used on Linux")
+	}
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	require.NoError(t, os.Mkdir(filepath.Join(configHome, "alpaca"), 0700))
+	userConfig := filepath.Join(configHome, "alpaca", "config.json")
+	require.NoError(t, os.WriteFile(userConfig, []byte(`{"p": 3129}`), 0600))
+	saved := systemConfigPath
+	systemConfigPath = writeConfigFile(t, `{"p": 3130, "C": "http://wpad.test/proxy.pac"}`)
+	t.Cleanup(func() { systemConfigPath = saved })
+	require.NoError(t, os.Chmod(systemConfigPath, 0644))
+
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	port := fs.Int("p", 3128, "")
+	pacurl := fs.String("C", "", "")
+	fs.String("config", "", "")
+	require.NoError(t, fs.Parse(nil))
+	err := loadConfig(fs, noEnv)
+	if os.Getuid() != 0 {
+		// The system config file isn't owned by root, so it can't be trusted.
+		assert.ErrorContains(t, err, "owned by root")
+		return
+	}
+	require.NoError(t, err)
+	// The user's config file takes precedence over the system one.
+	assert.Equal(t, 3129, *port)
+	assert.Equal(t, "http://wpad.test/proxy.pac", *pacurl)
+	assert.True(t, isFlagSet(fs, "p"))
+}
+
+func TestDefaultConfigFileListeners(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sets $XDG_CONFIG_HOME, which is only used on Linux")
+	}
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	saved := systemConfigPath
+	systemConfigPath = filepath.Join(t.TempDir(), "nonexistent.json")
+	t.Cleanup(func() { systemConfigPath = saved })
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	fs.String("config", "", "")
+	require.NoError(t, fs.Parse(nil))
+	listeners, err := loadListeners(fs, 3128)
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	// Listeners in the user's config file are used, even though -config wasn't given.
+	require.NoError(t, os.Mkdir(filepath.Join(configHome, "alpaca"), 0700))
+	userConfig := filepath.Join(configHome, "alpaca", "config.json")
+	require.NoError(t, os.WriteFile(userConfig,
+		[]byte(`{"listeners": [{"port": 3129}, {"port": 3130}]}`), 0600))
+	listeners, err = loadListeners(fs, 3128)
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	assert.Equal(t, 3129, listeners[0].Port)
+	// They're checked in the same way as ones in a file given by -config.
+	require.NoError(t, os.WriteFile(userConfig, []byte(`{"listeners": [{"port": 3128}]}`), 0600))
+	_, err = loadListeners(fs, 3128)
+	assert.Error(t, err)
+	// A file given by -config is used instead of the default ones.
+	require.NoError(t, fs.Set("config", writeConfigFile(t, `{"listeners": [{"port": 3131}]}`)))
+	listeners, err = loadListeners(fs, 3128)
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	assert.Equal(t, 3131, listeners[0].Port)
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/robertkrimen/otto"
+)
+
+const (
+	// myIPAuto makes myIpAddress() behave like Chrome's implementation.
+	myIPAuto = "auto"
+	// myIPPAC makes myIpAddress() return the address of the interface that routes to the PAC
+	// server. This is usually the right answer on multi-homed machines (e.g. when connected to
+	// a VPN), since the PAC server is on the corporate network.
+	myIPPAC = "pac"
+	// myIPRoute makes myIpAddress() return the address of a VPN interface if there is one, or
+	// otherwise the interface of the default route. Interfaces that belong to containers or
+	// virtual machines (e.g. docker0) are never used.
+	myIPRoute = "route"
+)
+
+// Name prefixes of network interfaces that are created by VPN clients.
+var vpnInterfacePrefixes = []string{"tun", "utun", "ppp", "wg", "ipsec", "gpd", "cscotun"}
+
+// Name prefixes of network interfaces that are created by container runtimes and hypervisors.
+// Their addresses are private to this machine, so PAC files never expect them.
+var virtualInterfacePrefixes = []string{
+	"docker", "br-", "veth", "virbr", "vboxnet", "vmnet", "vEthernet", "lxcbr", "lxdbr", "cni",
+	"flannel", "podman", "bridge",
+}
+
+// myIPFinder implements the PAC myIpAddress() function according to the -my-ip setting, which
+// is one of "auto", "pac", "route", a literal IP address, or the name of a network interface.
+type myIPFinder struct {
+	setting string
+	pacHost string
+	mux     sync.Mutex
+}
+
+func newMyIPFinder(setting string) *myIPFinder {
+	if setting == "" {
+		setting = myIPAuto
+	}
+	return &myIPFinder{setting: setting}
+}
+
+// setPACURL records the URL of the PAC file, for use in "pac" mode.
+func (f *myIPFinder) setPACURL(pacurl string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	u, err := url.Parse(pacurl)
+	if err != nil {
+		f.pacHost = ""
+		return
+	}
+	f.pacHost = u.Hostname()
+}
+
+func (f *myIPFinder) myIpAddress(call otto.FunctionCall) otto.Value {
+	if ip := f.find(); ip != "" {
+		return toValue(ip)
+	}
+	// Fall back to the default behaviour if we couldn't find an address using the configured
+	// setting (e.g. if the interface is down, or the PAC file is a local file).
+	return myIpAddress(call)
+}
+
+func (f *myIPFinder) find() string {
+	switch f.setting {
+	case myIPAuto:
+		return ""
+	case myIPPAC:
+		f.mux.Lock()
+		host := f.pacHost
+		f.mux.Unlock()
+		if host == "" {
+			return ""
+		}
+		if ip := resolve(host); ip != nil {
+			return probeRoute("udp4", ip.String())
+		}
+		// The PAC server might only have an IPv6 address (e.g. on an IPv6-only network).
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return ""
+		}
+		return probeRoute("udp6", ips[0].String())
+	}
+	if f.setting == myIPRoute {
+		return chooseRouteAddr(interfaceAddrs(), probeRoute("udp4", "8.8.8.8"))
+	}
+	if ip := net.ParseIP(f.setting); ip != nil {
+		return ip.String()
+	}
+	return interfaceAddr(f.setting)
+}
+
+// interfaceAddr returns the first IPv4 address of the named network interface, or the empty
+// string if there is no such interface or it has no usable address.
+func interfaceAddr(name string) string {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return ""
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipv4 := ipnet.IP.To4(); ipv4 != nil {
+			return ipv4.String()
+		}
+	}
+	return ""
+}
+
+// ifaceAddr is an IPv4 address of a network interface.
+type ifaceAddr struct {
+	name string
+	ip   string
+}
+
+// interfaceAddrs returns the IPv4 addresses of all network interfaces that are up (other than
+// loopback interfaces).
+func interfaceAddrs() []ifaceAddr {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var addrs []ifaceAddr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if ip := interfaceAddr(iface.Name); ip != "" {
+			addrs = append(addrs, ifaceAddr{iface.Name, ip})
+		}
+	}
+	return addrs
+}
+
+// chooseRouteAddr implements the "route" setting. It returns the address of the first VPN
+// interface, or else defaultRoute (the local address used for the default route) unless that
+// belongs to a virtual interface, or else the address of the first non-virtual interface.
+func chooseRouteAddr(addrs []ifaceAddr, defaultRoute string) string {
+	for _, addr := range addrs {
+		if hasAnyPrefix(addr.name, vpnInterfacePrefixes) {
+			return addr.ip
+		}
+	}
+	var fallback string
+	for _, addr := range addrs {
+		if hasAnyPrefix(addr.name, virtualInterfacePrefixes) {
+			if addr.ip == defaultRoute {
+				defaultRoute = ""
+			}
+		} else if fallback == "" {
+			fallback = addr.ip
+		}
+	}
+	if defaultRoute != "" {
+		return defaultRoute
+	}
+	return fallback
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+	"testing"
+
+	"github.com/robertkrimen/otto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func callMyIpAddress(t *testing.T, f *myIPFinder) string {
+	vm := otto.New()
+	require.NoError(t, vm.Set("myIpAddress", f.myIpAddress))
+	value, err := vm.Call("myIpAddress", nil)
+	require.NoError(t, err)
+	output, err := value.ToString()
+	require.NoError(t, err)
+	return output
+}
+
+func TestMyIPFinderWithAddress(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", callMyIpAddress(t, newMyIPFinder("192.0.2.1")))
+}
+
+func TestMyIPFinderWithInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		ip := interfaceAddr(iface.Name)
+		if ip == "" {
+			continue
+		}
+		assert.Equal(t, ip, callMyIpAddress(t, newMyIPFinder(iface.Name)))
+		return
+	}
+	t.Skip("no network interfaces with an IPv4 address")
+}
+
+func TestMyIPFinderFallsBackToAuto(t *testing.T) {
+	auto := callMyIpAddress(t, newMyIPFinder(myIPAuto))
+	assert.Equal(t, auto, callMyIpAddress(t, newMyIPFinder("nonexistent0")))
+	// In "pac" mode, we can't find a route to a local PAC file.
+	f := newMyIPFinder(myIPPAC)
+	f.setPACURL("file:///etc/proxy.pac")
+	assert.Equal(t, auto, callMyIpAddress(t, f))
+}
+
+func TestMyIPFinderWithPACServer(t *testing.T) {
+	f := newMyIPFinder(myIPPAC)
+	f.setPACURL("http://127.0.0.1:8080/proxy.pac")
+	// A route to the loopback address is never used, so we fall back to the default.
+	assert.Equal(t, "", f.find())
+	f.setPACURL("http://192.0.2.1/proxy.pac")
+	ip := f.find()
+	if ip == "" {
+		t.Skip("no route to 192.0.2.1")
+	}
+	assert.Equal(t, probeRoute("udp4", "192.0.2.1"), ip)
+}
+
+func TestChooseRouteAddr(t *testing.T) {
+	wifi := ifaceAddr{"en0", "192.168.1.10"}
+	docker := ifaceAddr{"docker0", "172.17.0.1"}
+	vpn := ifaceAddr{"utun3", "10.20.30.40"}
+	tests := []struct {
+		name         string
+		addrs        []ifaceAddr
+		defaultRoute string
+		expected     string
+	}{
+		{"DefaultRoute", []ifaceAddr{docker, wifi}, "192.168.1.10", "192.168.1.10"},
+		{"PreferVPN", []ifaceAddr{wifi, docker, vpn}, "192.168.1.10", "10.20.30.40"},
+		{"IgnoreVirtualDefaultRoute", []ifaceAddr{docker, wifi}, "172.17.0.1", "192.168.1.10"},
+		{"NoDefaultRoute", []ifaceAddr{docker, wifi}, "", "192.168.1.10"},
+		{"OnlyVirtual", []ifaceAddr{docker}, "172.17.0.1", ""},
+		{"NoInterfaces", nil, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, chooseRouteAddr(test.addrs, test.defaultRoute))
+		})
+	}
+}
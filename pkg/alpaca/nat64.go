@@ -0,0 +1,160 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// On IPv6-only networks, IPv4 hosts are reached using NAT64, with DNS64 synthesizing IPv6
+// addresses for hosts that only have IPv4 addresses. That works for host names, but not for IPv4
+// literals (e.g. "PROXY 10.1.2.3:8080" in a PAC file, or a CONNECT to 192.0.2.1:443), so for
+// those we synthesize the IPv6 address ourselves, as described in RFC 6052 and RFC 7050.
+
+// The byte offsets of the embedded IPv4 address, for each of the NAT64 prefix lengths allowed by
+// RFC 6052 (byte 8 is always skipped).
+var nat64Offsets = map[int][4]int{
+	32: {4, 5, 6, 7},
+	40: {5, 6, 7, 9},
+	48: {6, 7, 9, 10},
+	56: {7, 9, 10, 11},
+	64: {9, 10, 11, 12},
+	96: {12, 13, 14, 15},
+}
+
+// The well-known IPv4 addresses of ipv4only.arpa, which is used to discover the NAT64 prefix.
+var ipv4OnlyAddrs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+// How long to remember the NAT64 prefix (or that there isn't one) before checking again.
+const nat64CacheDuration = 5 * time.Minute
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+type nat64Prefix struct {
+	ip     net.IP
+	length int
+}
+
+type nat64 struct {
+	lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+	now      func() time.Time
+	prefix   *nat64Prefix
+	checked  time.Time
+	mux      sync.Mutex
+}
+
+func newNAT64() *nat64 {
+	return &nat64{lookupIP: net.DefaultResolver.LookupIP, now: time.Now}
+}
+
+var defaultNAT64 = newNAT64()
+
+// discover returns the NAT64 prefix for the current network, or nil if there isn't one.
+func (n *nat64) discover(ctx context.Context) *nat64Prefix {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if !n.checked.IsZero() && n.now().Sub(n.checked) < nat64CacheDuration {
+		return n.prefix
+	}
+	n.checked = n.now()
+	n.prefix = nil
+	ips, err := n.lookupIP(ctx, "ip6", "ipv4only.arpa")
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if prefix := extractNAT64Prefix(ip); prefix != nil {
+			n.prefix = prefix
+			break
+		}
+	}
+	return n.prefix
+}
+
+// extractNAT64Prefix returns the prefix of an address that DNS64 synthesized for ipv4only.arpa.
+func extractNAT64Prefix(ip net.IP) *nat64Prefix {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+	for _, length := range []int{96, 64, 56, 48, 40, 32} {
+		embedded := make(net.IP, net.IPv4len)
+		for i, offset := range nat64Offsets[length] {
+			embedded[i] = ip[offset]
+		}
+		for _, known := range ipv4OnlyAddrs {
+			if embedded.Equal(known) {
+				prefix := make(net.IP, net.IPv6len)
+				copy(prefix, ip.Mask(net.CIDRMask(length, 128)))
+				return &nat64Prefix{prefix, length}
+			}
+		}
+	}
+	return nil
+}
+
+// synthesize embeds an IPv4 address in the prefix.
+func (p *nat64Prefix) synthesize(ipv4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.ip)
+	for i, offset := range nat64Offsets[p.length] {
+		ip[offset] = ipv4.To4()[i]
+	}
+	return ip
+}
+
+// dialContext dials address using dial. If that fails and the address is an IPv4 literal, it
+// retries using an IPv6 address synthesized from the network's NAT64 prefix (if it has one).
+func (n *nat64) dialContext(ctx context.Context, dial dialFunc, network, address string) (
+	net.Conn, error) {
+	conn, err := dial(ctx, network, address)
+	if err == nil || (network != "tcp" && network != "tcp6") {
+		return conn, err
+	}
+	host, port, splitErr := net.SplitHostPort(address)
+	ip := net.ParseIP(host)
+	if splitErr != nil || ip == nil || ip.To4() == nil {
+		return conn, err
+	}
+	prefix := n.discover(ctx)
+	if prefix == nil {
+		return conn, err
+	}
+	synthesized := net.JoinHostPort(prefix.synthesize(ip).String(), port)
+	if conn, err6 := dial(ctx, network, synthesized); err6 == nil {
+		return conn, nil
+	}
+	return conn, err
+}
+
+// dialNAT64 is a DialContext func that uses NAT64 (if available) to reach IPv4 literals. It also
+// fails straight away for addresses that failed recently (see failureCache), and connects to
+// another address for mapped hosts (see hostMap), and resolves local names using mDNS or LLMNR
+// (see localNameResolver). It's what servers use for their outgoing connections, unless they're
+// given a dialer of their own (see serverOptions.dial).
+func dialNAT64(ctx context.Context, network, address string) (net.Conn, error) {
+	if mapped, ok := hostMappings.lookup(address); ok {
+		address = mapped
+	} else if resolved, ok := localNames.lookup(ctx, address); ok {
+		address = resolved
+	}
+	var dialer net.Dialer
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return defaultNAT64.dialContext(ctx, dialer.DialContext, network, address)
+	}
+	return recentFailures.dialContext(ctx, dial, network, address)
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNAT64Prefixes(t *testing.T) {
+	// Examples from RFC 6052, section 2.4, using 192.0.2.33 as the IPv4 address.
+	for _, test := range []struct {
+		length      int
+		synthesized string
+	}{
+		{32, "2001:db8:c000:221::"},
+		{40, "2001:db8:1c0:2:21::"},
+		{48, "2001:db8:122:c000:2:2100::"},
+		{56, "2001:db8:122:3c0:0:221::"},
+		{64, "2001:db8:122:344:c0:2:2100:0"},
+		{96, "2001:db8:122:344::192.0.2.33"},
+	} {
+		synthesized := net.ParseIP(test.synthesized)
+		prefix := &nat64Prefix{synthesized.Mask(net.CIDRMask(test.length, 128)), test.length}
+		assert.Equal(t, synthesized, prefix.synthesize(net.ParseIP("192.0.2.33")), test.length)
+	}
+}
+
+func TestExtractNAT64Prefix(t *testing.T) {
+	prefix := extractNAT64Prefix(net.ParseIP("64:ff9b::192.0.0.170"))
+	require.NotNil(t, prefix)
+	assert.Equal(t, 96, prefix.length)
+	assert.Equal(t, net.ParseIP("64:ff9b::"), prefix.ip)
+	assert.Equal(t, net.ParseIP("64:ff9b::1.2.3.4"), prefix.synthesize(net.ParseIP("1.2.3.4")))
+
+	prefix = extractNAT64Prefix(net.ParseIP("2001:db8:122:344:c0:0:aa00:0"))
+	require.NotNil(t, prefix)
+	assert.Equal(t, 64, prefix.length)
+
+	assert.Nil(t, extractNAT64Prefix(net.ParseIP("2001:db8::1")))
+	assert.Nil(t, extractNAT64Prefix(net.ParseIP("192.0.0.170")))
+}
+
+func TestNAT64DiscoveryIsCached(t *testing.T) {
+	lookups := 0
+	now := time.Now()
+	n := &nat64{
+		lookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			lookups++
+			assert.Equal(t, "ipv4only.arpa", host)
+			return []net.IP{net.ParseIP("64:ff9b::192.0.0.171")}, nil
+		},
+		now: func() time.Time { return now },
+	}
+	require.NotNil(t, n.discover(context.Background()))
+	require.NotNil(t, n.discover(context.Background()))
+	assert.Equal(t, 1, lookups)
+	now = now.Add(nat64CacheDuration)
+	require.NotNil(t, n.discover(context.Background()))
+	assert.Equal(t, 2, lookups)
+}
+
+func TestNAT64Dial(t *testing.T) {
+	n := &nat64{
+		lookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("64:ff9b::192.0.0.170")}, nil
+		},
+		now: time.Now,
+	}
+	var dialled []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialled = append(dialled, address)
+		if address == "[64:ff9b::c000:201]:443" {
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+		return nil, errors.New("network is unreachable")
+	}
+	conn, err := n.dialContext(context.Background(), dial, "tcp", "192.0.2.1:443")
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, []string{"192.0.2.1:443", "[64:ff9b::c000:201]:443"}, dialled)
+
+	// Host names are left to DNS64, so there's nothing to retry.
+	dialled = nil
+	_, err = n.dialContext(context.Background(), dial, "tcp", "www.example.test:443")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"www.example.test:443"}, dialled)
+}
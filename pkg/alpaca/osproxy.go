@@ -0,0 +1,372 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// systemProxyPAC is a PAC script generated from the static proxy in the OS proxy settings (see
+// osProxySettings), which is used if no PAC URL is given or found. It's nil if there's no static
+// proxy, or if -use-system-proxy is false.
+var systemProxyPAC []byte
+
+// osProxySettings are the proxy settings from the operating system: a PAC URL, or a static proxy
+// (with a list of hosts that bypass it). Desktop users usually have these set already (e.g. by
+// their organisation), so Alpaca can use them without any flags.
+type osProxySettings struct {
+	source     string   // Where the settings came from, e.g. "GNOME"
+	pacURL     string   // If set, the PAC URL to use
+	httpProxy  string   // If set, the proxy (as host:port) for http URLs
+	httpsProxy string   // If set, the proxy for https URLs (and CONNECT requests)
+	bypass     []string // Hosts, patterns (e.g. *.example.com), CIDRs or "<local>" to go DIRECT
+}
+
+// runCommand runs a command and returns its output. It's a variable so that tests can fake the
+// commands that read the OS proxy settings.
+var runCommand = func(name string, arg ...string) ([]byte, error) {
+	out, err := exec.Command(name, arg...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running %s %s: %w", name, strings.Join(arg, " "), err)
+	}
+	return out, nil
+}
+
+// readOSProxySettings reads this user's proxy settings: the Internet Settings in the registry (or
+// failing that, the WinHTTP settings) on Windows, scutil on macOS, and gsettings (i.e. GNOME)
+// elsewhere.
+func readOSProxySettings() (osProxySettings, error) {
+	switch runtime.GOOS {
+	case "windows":
+		return readWindowsProxySettings()
+	case "darwin":
+		return readMacProxySettings()
+	default:
+		return readGNOMEProxySettings()
+	}
+}
+
+// systemProxyScript reads the OS proxy settings, and returns a PAC script for the static proxy in
+// them, or nil if there isn't one. port is the one that Alpaca is listening on.
+func systemProxyScript(port int) []byte {
+	s, err := readOSProxySettings()
+	if err != nil {
+		debugf("pac", "Couldn't read the system proxy settings: %v", err)
+		return nil
+	} else if !s.hasProxy() {
+		return nil
+	} else if s.pointsAt(port) {
+		log.Printf("Not using the proxy in the %s proxy settings, since it's Alpaca itself",
+			s.source)
+		return nil
+	}
+	httpProxy, httpsProxy := s.proxies()
+	if httpProxy == httpsProxy {
+		log.Printf("Using proxy %s from the %s proxy settings, if there's no PAC file",
+			httpProxy, s.source)
+	} else {
+		log.Printf("Using proxies %s (for http) and %s (for https) from the %s proxy "+
+			"settings, if there's no PAC file", httpProxy, httpsProxy, s.source)
+	}
+	return s.pacScript()
+}
+
+// hasProxy reports whether the settings have a static proxy.
+func (s osProxySettings) hasProxy() bool {
+	return s.httpProxy != "" || s.httpsProxy != ""
+}
+
+// proxies returns the static proxies for http and https URLs. If only one of them is set, it's
+// used for both.
+func (s osProxySettings) proxies() (string, string) {
+	httpProxy, httpsProxy := s.httpProxy, s.httpsProxy
+	if httpProxy == "" {
+		httpProxy = httpsProxy
+	} else if httpsProxy == "" {
+		httpsProxy = httpProxy
+	}
+	return httpProxy, httpsProxy
+}
+
+// pointsAt reports whether the static proxy is Alpaca itself (i.e. port on this host), which is
+// what the settings look like when the system proxy was set to Alpaca (e.g. by -set-system-proxy,
+// in a previous run that didn't exit cleanly). Using it would send requests round in a loop.
+func (s osProxySettings) pointsAt(port int) bool {
+	for _, proxy := range []string{s.httpProxy, s.httpsProxy} {
+		host, p, err := net.SplitHostPort(proxy)
+		if err != nil || p != strconv.Itoa(port) {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && isLocalIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// osProxyTmpl is the PAC script for a static proxy from the OS proxy settings.
+var osProxyTmpl = template.Must(template.New("osproxy").Funcs(template.FuncMap{
+	"json": func(s string) (string, error) {
+		b, err := json.Marshal(s)
+		return string(b), err
+	},
+	"mask": func(m net.IPMask) string { return net.IP(m).String() },
+}).Parse(`// Generated by alpaca from the {{ .Source }} proxy settings
+function FindProxyForURL(url, host) {
+{{- if .Local }}
+  if (isPlainHostName(host)) return "DIRECT";
+{{- end }}
+{{- range .Patterns }}
+  if (shExpMatch(host, {{ json . }})) return "DIRECT";
+{{- end }}
+{{- range .Nets }}
+  if (isInNet(host, {{ json .IP.String }}, {{ json (mask .Mask) }})) return "DIRECT";
+{{- end }}
+{{- if ne .HTTP .HTTPS }}
+  if (url.substring(0, 6) == "https:") return {{ json (print "PROXY " .HTTPS) }};
+{{- end }}
+  return {{ json (print "PROXY " .HTTP) }};
+}
+`))
+
+// pacScript returns a PAC script that sends requests to the static proxy, except for the hosts
+// that bypass it.
+func (s osProxySettings) pacScript() []byte {
+	data := struct {
+		Source      string
+		Local       bool
+		Patterns    []string
+		Nets        []*net.IPNet
+		HTTP, HTTPS string
+	}{Source: s.source}
+	data.HTTP, data.HTTPS = s.proxies()
+	for _, entry := range s.bypass {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		} else if entry == "<local>" {
+			data.Local = true
+		} else if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			data.Nets = append(data.Nets, ipnet)
+		} else if strings.HasPrefix(entry, ".") {
+			data.Patterns = append(data.Patterns, "*"+entry)
+		} else {
+			data.Patterns = append(data.Patterns, entry)
+		}
+	}
+	var b bytes.Buffer
+	if err := osProxyTmpl.Execute(&b, data); err != nil {
+		// This can only happen if the template is broken.
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+// readGNOMEProxySettings reads the proxy settings from gsettings, e.g.
+//
+//	$ gsettings get org.gnome.system.proxy mode
+//	'manual'
+//	$ gsettings get org.gnome.system.proxy.http host
+//	'proxy.example.com'
+func readGNOMEProxySettings() (osProxySettings, error) {
+	s := osProxySettings{source: "GNOME"}
+	get := func(schema, key string) (string, error) {
+		out, err := runCommand("gsettings", "get", schema, key)
+		return strings.Trim(strings.TrimSpace(string(out)), "'"), err
+	}
+	mode, err := get("org.gnome.system.proxy", "mode")
+	if err != nil {
+		return s, err
+	}
+	switch mode {
+	case "auto":
+		s.pacURL, err = get("org.gnome.system.proxy", "autoconfig-url")
+		return s, err
+	case "manual":
+	default:
+		return s, nil
+	}
+	for _, scheme := range []string{"http", "https"} {
+		host, err := get("org.gnome.system.proxy."+scheme, "host")
+		if err != nil {
+			return s, err
+		}
+		port, err := get("org.gnome.system.proxy."+scheme, "port")
+		if err != nil {
+			return s, err
+		} else if host == "" || port == "" || port == "0" {
+			continue
+		}
+		if scheme == "http" {
+			s.httpProxy = net.JoinHostPort(host, port)
+		} else {
+			s.httpsProxy = net.JoinHostPort(host, port)
+		}
+	}
+	hosts, err := get("org.gnome.system.proxy", "ignore-hosts")
+	if err != nil {
+		return s, err
+	}
+	// The hosts are a GVariant array of strings, e.g. ['localhost', '127.0.0.0/8', '::1'].
+	for _, host := range strings.Split(strings.Trim(hosts, "@as[]"), ",") {
+		if host = strings.Trim(strings.TrimSpace(host), "'"); host != "" {
+			s.bypass = append(s.bypass, host)
+		}
+	}
+	return s, nil
+}
+
+// readMacProxySettings reads the proxy settings from `scutil --proxy`, whose output looks like:
+//
+//	<dictionary> {
+//	  ExceptionsList : <array> {
+//	    0 : *.local
+//	  }
+//	  HTTPEnable : 1
+//	  HTTPPort : 8080
+//	  HTTPProxy : proxy.example.com
+//	  ProxyAutoConfigEnable : 0
+//	}
+func readMacProxySettings() (osProxySettings, error) {
+	s := osProxySettings{source: "macOS"}
+	out, err := runCommand("scutil", "--proxy")
+	if err != nil {
+		return s, err
+	}
+	values := make(map[string]string)
+	inExceptions := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "}" {
+			inExceptions = false
+			continue
+		}
+		key, value, ok := strings.Cut(line, " : ")
+		if !ok {
+			continue
+		} else if inExceptions {
+			s.bypass = append(s.bypass, value)
+		} else if key == "ExceptionsList" {
+			inExceptions = true
+		} else {
+			values[key] = value
+		}
+	}
+	if values["ProxyAutoConfigEnable"] == "1" {
+		s.pacURL = values["ProxyAutoConfigURLString"]
+		return s, nil
+	}
+	if values["ExcludeSimpleHostnames"] == "1" {
+		s.bypass = append(s.bypass, "<local>")
+	}
+	if values["HTTPEnable"] == "1" && values["HTTPProxy"] != "" {
+		s.httpProxy = net.JoinHostPort(values["HTTPProxy"], values["HTTPPort"])
+	}
+	if values["HTTPSEnable"] == "1" && values["HTTPSProxy"] != "" {
+		s.httpsProxy = net.JoinHostPort(values["HTTPSProxy"], values["HTTPSPort"])
+	}
+	return s, nil
+}
+
+const internetSettingsKey = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// readWindowsProxySettings reads the proxy settings that are shown in the Internet Options dialog
+// (which most applications use) from the registry, using `reg query`. If there aren't any, it
+// reads WinHTTP's settings (which services use) using `netsh winhttp show proxy`.
+func readWindowsProxySettings() (osProxySettings, error) {
+	s := osProxySettings{source: "Windows"}
+	out, err := runCommand("reg", "query", internetSettingsKey)
+	if err != nil {
+		return s, err
+	}
+	// Each value is on a line like "    ProxyServer    REG_SZ    proxy.example.com:8080".
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && strings.HasPrefix(fields[1], "REG_") {
+			values[fields[0]] = strings.Join(fields[2:], " ")
+		}
+	}
+	if s.pacURL = values["AutoConfigURL"]; s.pacURL != "" {
+		return s, nil
+	}
+	if enabled, _ := strconv.ParseUint(values["ProxyEnable"], 0, 32); enabled != 0 {
+		s.setWindowsProxy(values["ProxyServer"], values["ProxyOverride"])
+		if s.hasProxy() {
+			return s, nil
+		}
+	}
+	out, err = runCommand("netsh", "winhttp", "show", "proxy")
+	if err != nil {
+		return s, err
+	}
+	// The settings are on lines like "    Proxy Server(s) :  proxy.example.com:8080".
+	var server, bypass string
+	scanner = bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " : ")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Proxy Server(s)":
+			server = strings.TrimSpace(value)
+		case "Bypass List":
+			bypass = strings.TrimSpace(value)
+		}
+	}
+	if server != "" {
+		s.source = "WinHTTP"
+		s.setWindowsProxy(server, bypass)
+	}
+	return s, nil
+}
+
+// setWindowsProxy sets the static proxy from Windows' settings. The server is either a single
+// proxy (host:port), or a proxy for each scheme (e.g. "http=proxy:80;https=proxy:443"), and the
+// bypass list is separated by semicolons.
+func (s *osProxySettings) setWindowsProxy(server, bypass string) {
+	for _, elem := range strings.Split(server, ";") {
+		elem = strings.TrimSpace(elem)
+		scheme, proxy, ok := strings.Cut(elem, "=")
+		if !ok {
+			s.httpProxy, s.httpsProxy = elem, elem
+			continue
+		}
+		switch scheme {
+		case "http":
+			s.httpProxy = proxy
+		case "https":
+			s.httpsProxy = proxy
+		}
+	}
+	for _, host := range strings.Split(bypass, ";") {
+		if host = strings.TrimSpace(host); host != "" {
+			s.bypass = append(s.bypass, host)
+		}
+	}
+}
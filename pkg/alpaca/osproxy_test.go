@@ -0,0 +1,186 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCommands replaces runCommand with one that returns the output for each command line (or an
+// error, if it's not in outputs), until the test ends.
+func fakeCommands(t *testing.T, outputs map[string]string) {
+	old := runCommand
+	t.Cleanup(func() { runCommand = old })
+	runCommand = func(name string, arg ...string) ([]byte, error) {
+		cmd := strings.Join(append([]string{name}, arg...), " ")
+		out, ok := outputs[cmd]
+		if !ok {
+			return nil, fmt.Errorf("unexpected command: %s", cmd)
+		}
+		return []byte(out), nil
+	}
+}
+
+func TestGNOMEProxySettings(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"gsettings get org.gnome.system.proxy mode":         "'manual'\n",
+		"gsettings get org.gnome.system.proxy.http host":    "'proxy.test'\n",
+		"gsettings get org.gnome.system.proxy.http port":    "8080\n",
+		"gsettings get org.gnome.system.proxy.https host":   "''\n",
+		"gsettings get org.gnome.system.proxy.https port":   "0\n",
+		"gsettings get org.gnome.system.proxy ignore-hosts": "['localhost', '10.0.0.0/8']\n",
+	})
+	s, err := readGNOMEProxySettings()
+	require.NoError(t, err)
+	assert.Equal(t, osProxySettings{
+		source:    "GNOME",
+		httpProxy: "proxy.test:8080",
+		bypass:    []string{"localhost", "10.0.0.0/8"},
+	}, s)
+}
+
+func TestGNOMEProxySettingsWithPACURL(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"gsettings get org.gnome.system.proxy mode":           "'auto'\n",
+		"gsettings get org.gnome.system.proxy autoconfig-url": "'http://wpad.test/wpad.dat'\n",
+	})
+	s, err := readGNOMEProxySettings()
+	require.NoError(t, err)
+	assert.Equal(t, "http://wpad.test/wpad.dat", s.pacURL)
+	assert.False(t, s.hasProxy())
+}
+
+func TestMacProxySettings(t *testing.T) {
+	fakeCommands(t, map[string]string{"scutil --proxy": `<dictionary> {
+  ExceptionsList : <array> {
+    0 : *.local
+    1 : 169.254.0.0/16
+  }
+  ExcludeSimpleHostnames : 1
+  FTPPassive : 1
+  HTTPEnable : 1
+  HTTPPort : 8080
+  HTTPProxy : proxy.test
+  HTTPSEnable : 1
+  HTTPSPort : 8443
+  HTTPSProxy : proxy.test
+  ProxyAutoConfigEnable : 0
+}
+`})
+	s, err := readMacProxySettings()
+	require.NoError(t, err)
+	assert.Equal(t, osProxySettings{
+		source:     "macOS",
+		httpProxy:  "proxy.test:8080",
+		httpsProxy: "proxy.test:8443",
+		bypass:     []string{"*.local", "169.254.0.0/16", "<local>"},
+	}, s)
+}
+
+func TestWindowsProxySettings(t *testing.T) {
+	fakeCommands(t, map[string]string{"reg query " + internetSettingsKey: `
+HKEY_CURRENT_USER\Software\Microsoft\Windows\CurrentVersion\Internet Settings
+    ProxyEnable    REG_DWORD    0x1
+    ProxyServer    REG_SZ    http=proxy.test:80;https=secure.test:443;socks=socks.test:1080
+    ProxyOverride    REG_SZ    *.intranet.test;<local>
+`})
+	s, err := readWindowsProxySettings()
+	require.NoError(t, err)
+	assert.Equal(t, osProxySettings{
+		source:     "Windows",
+		httpProxy:  "proxy.test:80",
+		httpsProxy: "secure.test:443",
+		bypass:     []string{"*.intranet.test", "<local>"},
+	}, s)
+}
+
+func TestWindowsProxySettingsFromWinHTTP(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"reg query " + internetSettingsKey: `
+HKEY_CURRENT_USER\Software\Microsoft\Windows\CurrentVersion\Internet Settings
+    ProxyEnable    REG_DWORD    0x0
+`,
+		"netsh winhttp show proxy": `
+Current WinHTTP proxy settings:
+
+    Proxy Server(s) :  proxy.test:8080
+    Bypass List     :  *.intranet.test
+`,
+	})
+	s, err := readWindowsProxySettings()
+	require.NoError(t, err)
+	assert.Equal(t, osProxySettings{
+		source:     "WinHTTP",
+		httpProxy:  "proxy.test:8080",
+		httpsProxy: "proxy.test:8080",
+		bypass:     []string{"*.intranet.test"},
+	}, s)
+}
+
+func TestOSProxyPACScript(t *testing.T) {
+	s := osProxySettings{
+		source:     "Windows",
+		httpProxy:  "proxy.test:80",
+		httpsProxy: "secure.test:443",
+		bypass:     []string{"*.intranet.test", ".corp.test", "10.0.0.0/8", "<local>"},
+	}
+	pr := &PACRunner{}
+	require.NoError(t, pr.Update(s.pacScript()))
+	for rawurl, expected := range map[string]string{
+		"http://www.example.test/":     "PROXY proxy.test:80",
+		"https://www.example.test/":    "PROXY secure.test:443",
+		"http://wiki.intranet.test/":   "DIRECT",
+		"http://build.corp.test/":      "DIRECT",
+		"http://10.1.2.3/":             "DIRECT",
+		"http://printer/":              "DIRECT",
+		"http://www.intranet.test.cc/": "PROXY proxy.test:80",
+	} {
+		u, err := url.Parse(rawurl)
+		require.NoError(t, err)
+		result, err := pr.FindProxyForURL(*u)
+		require.NoError(t, err)
+		assert.Equal(t, expected, result, rawurl)
+	}
+}
+
+func TestOSProxyPointsAtAlpaca(t *testing.T) {
+	assert.True(t, osProxySettings{httpProxy: "localhost:3128"}.pointsAt(3128))
+	assert.True(t, osProxySettings{httpsProxy: "127.0.0.1:3128"}.pointsAt(3128))
+	assert.False(t, osProxySettings{httpProxy: "localhost:8080"}.pointsAt(3128))
+	assert.False(t, osProxySettings{httpProxy: "proxy.test:3128"}.pointsAt(3128))
+}
+
+func TestFetcherUsesSystemProxyWithoutPACURL(t *testing.T) {
+	old := systemProxyPAC
+	defer func() { systemProxyPAC = old }()
+	systemProxyPAC = osProxySettings{source: "GNOME", httpProxy: "proxy.test:8080"}.pacScript()
+	pf := newPACFetcher()
+	pf.pacFinder = &pacFinder{} // Don't look for a PAC URL in the system settings
+	assert.Equal(t, systemProxyPAC, pf.download())
+	assert.True(t, pf.isConnected())
+	// A PAC URL takes precedence.
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script")))
+	defer server.Close()
+	pf = newPACFetcher(server.URL)
+	assert.Equal(t, []byte("test script"), pf.download())
+}
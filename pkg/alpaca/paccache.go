@@ -0,0 +1,146 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+// pacCacheStaleAfter is how old a saved PAC file can get before Alpaca warns that it's stale.
+const pacCacheStaleAfter = 7 * 24 * time.Hour
+
+// pacCache is where the last good PAC file is saved (given by -pac-cache). It's nil if the PAC
+// file isn't saved.
+var pacCache *pacDiskCache
+
+// pacDiskCache saves the last PAC file that was downloaded successfully, so that it can be used
+// if Alpaca starts while the PAC server is unreachable (e.g. before the VPN has connected), rather
+// than connecting directly to everything. It's only used until a PAC file can be downloaded.
+type pacDiskCache struct {
+	path string
+}
+
+// savedPAC is the contents of the file.
+type savedPAC struct {
+	URL    string    `json:"url"`
+	Saved  time.Time `json:"saved"`  // When the PAC file was last downloaded (or refreshed)
+	Signed bool      `json:"signed"` // Whether the signature was checked (see pacsig.go)
+	PAC    string    `json:"pac"`
+}
+
+// save replaces the saved PAC file. The file is replaced atomically, so that it's never left
+// half-written if Alpaca is killed.
+func (pc *pacDiskCache) save(saved savedPAC) {
+	buf, err := json.Marshal(saved)
+	if err == nil {
+		tmp := pc.path + ".tmp"
+		if err = os.WriteFile(tmp, buf, 0600); err == nil {
+			err = os.Rename(tmp, pc.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving the PAC file to %s: %v", pc.path, err)
+	}
+}
+
+// load returns the saved PAC file, if there is one.
+func (pc *pacDiskCache) load() (savedPAC, error) {
+	var saved savedPAC
+	buf, err := os.ReadFile(pc.path)
+	if err != nil {
+		return saved, err
+	} else if err := json.Unmarshal(buf, &saved); err != nil {
+		return saved, fmt.Errorf("error parsing %s: %w", pc.path, err)
+	}
+	return saved, nil
+}
+
+// saveToDisk saves a PAC file that was just downloaded (or refreshed) from pacurl.
+func (pf *pacFetcher) saveToDisk(pacurl string, pacjs []byte) {
+	if pf.diskCache == nil {
+		return
+	}
+	pf.diskCache.save(savedPAC{
+		URL:    pacurl,
+		Saved:  pf.now(),
+		Signed: pf.publicKey != nil,
+		PAC:    string(pacjs),
+	})
+}
+
+// loadFromDisk returns the saved PAC file, if it was downloaded from one of the PAC URLs, and
+// marks it as the one in use.
+func (pf *pacFetcher) loadFromDisk(pacurls []string) []byte {
+	saved, err := pf.diskCache.load()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		log.Printf("Not using the saved PAC file: %v", err)
+		return nil
+	} else if !slices.Contains(pacurls, saved.URL) {
+		log.Printf("Not using the saved PAC file, which is from a different URL (%s)",
+			saved.URL)
+		return nil
+	} else if pf.publicKey != nil && !saved.Signed {
+		log.Print("Not using the saved PAC file, since it was saved before -pac-public-key was " +
+			"given")
+		return nil
+	} else if err := pf.policy.check(saved.URL, saved.Signed); err != nil {
+		log.Printf("Not using the saved PAC file: %v", err)
+		return nil
+	}
+	pacjs := []byte(saved.PAC)
+	// If the saved PAC file was already in use (and the download was retried), it doesn't
+	// need to be run again.
+	reloaded := bytes.Equal(pacjs, pf.cache)
+	pf.url = saved.URL
+	pf.fallback = saved.URL != pacurls[0]
+	pf.connected = true
+	pf.cache = pacjs
+	pf.modified, pf.etag = "", ""
+	pf.savedAt = saved.Saved
+	if pf.now().Sub(pf.savedAt) >= pacCacheStaleAfter {
+		log.Printf("WARNING: %s", pf.savedWarning())
+	} else {
+		log.Print(pf.savedWarning())
+	}
+	if reloaded {
+		return nil
+	}
+	return pacjs
+}
+
+// savedWarning returns a warning that the PAC file in use is the saved one (and how old it is),
+// or an empty string if it isn't.
+func (pf *pacFetcher) savedWarning() string {
+	if pf.savedAt.IsZero() {
+		return ""
+	}
+	warning := fmt.Sprintf("Using the PAC file from %s that was saved at %s, since it can't "+
+		"be downloaded", pf.url, pf.savedAt.Format(time.RFC3339))
+	if age := pf.now().Sub(pf.savedAt); age >= pacCacheStaleAfter {
+		warning += fmt.Sprintf(" (it's %d days old, so it may be out of date)",
+			int(age/(24*time.Hour)))
+	}
+	return warning
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSavedPACIsUsedUntilDownloadWorks(t *testing.T) {
+	cache := &pacDiskCache{path: filepath.Join(t.TempDir(), "pac.json")}
+	down := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("test script"))
+	}))
+	defer server.Close()
+	// The first instance downloads the PAC file, and saves it.
+	pf := newPACFetcher(server.URL)
+	pf.diskCache = cache
+	assert.Equal(t, []byte("test script"), pf.download())
+	saved, err := cache.load()
+	require.NoError(t, err)
+	assert.Equal(t, server.URL, saved.URL)
+	assert.Equal(t, "test script", saved.PAC)
+	// The next one can't download it, so it uses the saved one.
+	down = true
+	nm := &fakeNetMonitor{true}
+	pf = newPACFetcher(server.URL)
+	pf.diskCache = cache
+	pf.monitor = nm
+	assert.Equal(t, []byte("test script"), pf.download())
+	assert.True(t, pf.isConnected())
+	assert.Contains(t, pf.savedWarning(), "Using the PAC file from "+server.URL)
+	// If it still can't be downloaded, there's nothing new to run.
+	nm.changed = true
+	assert.Nil(t, pf.download())
+	assert.True(t, pf.isConnected())
+	// Once it can, the downloaded one replaces the saved one.
+	down = false
+	nm.changed = true
+	assert.Equal(t, []byte("test script"), pf.download())
+	assert.True(t, pf.isConnected())
+	assert.Empty(t, pf.savedWarning())
+	// After that, a failed download means going direct, as usual.
+	down = true
+	nm.changed = true
+	assert.Nil(t, pf.download())
+	assert.False(t, pf.isConnected())
+}
+
+func TestSavedPACFromAnotherURLIsIgnored(t *testing.T) {
+	cache := &pacDiskCache{path: filepath.Join(t.TempDir(), "pac.json")}
+	cache.save(savedPAC{URL: "http://other.test/proxy.pac", Saved: time.Now(), PAC: "script"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	pf := newPACFetcher(server.URL)
+	pf.diskCache = cache
+	assert.Nil(t, pf.download())
+	assert.False(t, pf.isConnected())
+}
+
+func TestSavedPACStaleWarning(t *testing.T) {
+	now := time.Now()
+	pf := &pacFetcher{url: "http://wpad.test/proxy.pac", now: func() time.Time { return now }}
+	assert.Empty(t, pf.savedWarning())
+	pf.savedAt = now.Add(-time.Hour)
+	assert.NotContains(t, pf.savedWarning(), "out of date")
+	pf.savedAt = now.Add(-10 * 24 * time.Hour)
+	assert.Contains(t, pf.savedWarning(), "it's 10 days old, so it may be out of date")
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around each change in a diff.
+	diffContext = 3
+	// maxDiffLines is the most lines of a diff that are logged when the PAC file changes.
+	maxDiffLines = 100
+	// maxDiffCells limits how much work is done to diff two PAC files (the product of the
+	// numbers of lines that differ, after removing the lines they start and end with).
+	maxDiffCells = 4 << 20
+)
+
+// diffOp is a line of a diff: ' ' if it's in both files, '-' if it's only in the old one, or '+'
+// if it's only in the new one. ai and bi are the positions in the old and new files (the
+// 0-based index of the line, or of the next line if it's not in that file).
+type diffOp struct {
+	kind   byte
+	text   string
+	ai, bi int
+}
+
+// unifiedDiff returns a unified diff between the old and new files (a and b), with the lines after
+// the first maxLines replaced by a count. It returns false if the files are too different to
+// diff (see maxDiffCells).
+func unifiedDiff(a, b string, maxLines int) (string, bool) {
+	ops, ok := diffLines(splitLines(a), splitLines(b))
+	if !ok {
+		return "", false
+	}
+	var lines []string
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk until the next change is too far away to share context with it.
+		start, end := i-diffContext, i
+		if start < 0 {
+			start = 0
+		}
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			} else if j-end > 2*diffContext {
+				break
+			}
+		}
+		end = min(end+diffContext+1, len(ops))
+		lines = append(lines, hunkHeader(ops[start:end]))
+		for _, op := range ops[start:end] {
+			lines = append(lines, string(op.kind)+op.text)
+		}
+		i = end
+	}
+	if len(lines) > maxLines {
+		lines = append(lines[:maxLines], fmt.Sprintf("... %d more lines", len(lines)-maxLines))
+	}
+	return strings.Join(lines, "\n"), true
+}
+
+func hunkHeader(ops []diffOp) string {
+	var acount, bcount int
+	for _, op := range ops {
+		if op.kind != '+' {
+			acount++
+		}
+		if op.kind != '-' {
+			bcount++
+		}
+	}
+	// An empty range starts at the line before it, as in diff -u.
+	astart, bstart := ops[0].ai, ops[0].bi
+	if acount > 0 {
+		astart++
+	}
+	if bcount > 0 {
+		bstart++
+	}
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", astart, acount, bstart, bcount)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines finds the shortest edit from a to b, using the longest common subsequence of their
+// lines. Since a new PAC file usually only changes a few lines, the lines that both files start
+// and end with are skipped before doing the (quadratic) search.
+func diffLines(a, b []string) ([]diffOp, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	am, bm := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(am)*len(bm) > maxDiffCells {
+		return nil, false
+	}
+	// lcs[i][j] is the length of the longest common subsequence of am[i:] and bm[j:].
+	lcs := make([][]int32, len(am)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(bm)+1)
+	}
+	for i := len(am) - 1; i >= 0; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{' ', a[i], i, i})
+	}
+	i, j := 0, 0
+	for i < len(am) || j < len(bm) {
+		ai, bi := prefix+i, prefix+j
+		switch {
+		case i < len(am) && j < len(bm) && am[i] == bm[j]:
+			ops = append(ops, diffOp{' ', am[i], ai, bi})
+			i, j = i+1, j+1
+		case j == len(bm) || (i < len(am) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', am[i], ai, bi})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', bm[j], ai, bi})
+			j++
+		}
+	}
+	for k := 0; k < suffix; k++ {
+		ai, bi := len(a)-suffix+k, len(b)-suffix+k
+		ops = append(ops, diffOp{' ', a[ai], ai, bi})
+	}
+	return ops, true
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func numberedLines(n int, change map[int]string) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		if s, ok := change[i]; ok {
+			sb.WriteString(s)
+		} else {
+			fmt.Fprintf(&sb, "line %d\n", i)
+		}
+	}
+	return sb.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	old := numberedLines(20, nil)
+	new := numberedLines(20, map[int]string{2: "", 8: "changed 8\n", 19: "line 19\nadded\n"})
+	diff, ok := unifiedDiff(old, new, maxDiffLines)
+	assert.True(t, ok)
+	// The first two changes are close enough to share their context, but the last one isn't.
+	expected := []string{
+		"@@ -1,11 +1,10 @@",
+		" line 1",
+		"-line 2",
+		" line 3",
+		" line 4",
+		" line 5",
+		" line 6",
+		" line 7",
+		"-line 8",
+		"+changed 8",
+		" line 9",
+		" line 10",
+		" line 11",
+		"@@ -17,4 +16,5 @@",
+		" line 17",
+		" line 18",
+		" line 19",
+		"+added",
+		" line 20",
+	}
+	assert.Equal(t, strings.Join(expected, "\n"), diff)
+}
+
+func TestUnifiedDiffEmptyFile(t *testing.T) {
+	diff, ok := unifiedDiff("", "a\nb\n", maxDiffLines)
+	assert.True(t, ok)
+	assert.Equal(t, "@@ -0,0 +1,2 @@\n+a\n+b", diff)
+	diff, ok = unifiedDiff("a\n", "", maxDiffLines)
+	assert.True(t, ok)
+	assert.Equal(t, "@@ -1,1 +0,0 @@\n-a", diff)
+}
+
+func TestUnifiedDiffIsTruncated(t *testing.T) {
+	diff, ok := unifiedDiff(numberedLines(50, nil), "", 10)
+	assert.True(t, ok)
+	lines := strings.Split(diff, "\n")
+	assert.Len(t, lines, 11)
+	assert.Equal(t, "... 41 more lines", lines[10])
+}
+
+func TestUnifiedDiffTooLarge(t *testing.T) {
+	old := numberedLines(3000, nil)
+	new := strings.ReplaceAll(old, "line", "LINE")
+	_, ok := unifiedDiff(old, new, maxDiffLines)
+	assert.False(t, ok)
+	// Only the lines that differ count towards the limit.
+	_, ok = unifiedDiff(old, numberedLines(3000, map[int]string{1500: "x\n"}), maxDiffLines)
+	assert.True(t, ok)
+}
@@ -0,0 +1,325 @@
+// Copyright 2019, 2021, 2022 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The maximum size (in bytes) allowed for a PAC script. At 1 MB, this matches the limit in Chrome.
+const maxResponseBytes = 1 * 1024 * 1024
+
+// The time to wait before retrying a failed PAC download. This is similar to Chrome's delay:
+// https://cs.chromium.org/chromium/src/net/proxy_resolution/proxy_resolution_service.cc?l=96&rcl=3db5f65968c3ecab3932c1ff7367ad28834f9502
+var delayAfterFailedDownload = 2 * time.Second
+
+type pacFetcher struct {
+	pacFinder *pacFinder
+	// Other PAC URLs (given by repeating -C) to try, in order, if the first one can't be
+	// downloaded, e.g. for a PAC server that's only reachable in the office, and another
+	// that's only reachable over the VPN.
+	fallbacks []string
+	monitor   netMonitor
+	client    *http.Client
+	connected bool
+	url       string // The PAC URL that's in use (or the first one tried, if none worked)
+	fallback  bool   // Whether url is one of the fallbacks
+	static    []byte // If set, the PAC script to use if there's no PAC URL (see systemProxyPAC)
+	err       error  // The reason for the last failed download; wraps ErrPACUnavailable
+	// If set, the last good PAC file is saved here, and used until a PAC file can be
+	// downloaded (see paccache.go).
+	diskCache  *pacDiskCache
+	downloaded bool      // Whether a PAC file has been downloaded since Alpaca started
+	savedAt    time.Time // If set, the PAC file in use is the saved one, which was saved then
+	// If non-zero, the PAC file is re-fetched after this much time has passed, even if the
+	// network hasn't changed. The cache validators below are used to make this cheap when the
+	// PAC file hasn't changed on the server.
+	refreshInterval time.Duration
+	cache           []byte
+	modified        string // The Last-Modified header from the last successful download
+	etag            string // The ETag header from the last successful download
+	fetched         time.Time
+	now             func() time.Time
+	publicKey       ed25519.PublicKey // If set, PAC files must be signed (see pacsig.go)
+	policy          pacPolicy
+	// If set, the next download starts from scratch, as if the network had changed.
+	forceDownload bool
+}
+
+// newPACFetcher returns a pacFetcher for the given PAC URLs, in order of preference. If there
+// aren't any, the PAC URL is found from the system's proxy settings.
+func newPACFetcher(pacurls ...string) *pacFetcher {
+	pacurls = slices.DeleteFunc(slices.Clone(pacurls), func(u string) bool { return u == "" })
+	tr := &http.Transport{
+		// The DefaultClient in net/http uses the proxy specified in the http(s)_proxy
+		// environment variable, which could be pointing at this instance of alpaca. When
+		// fetching the PAC file, we always use a client that goes directly to the server,
+		// rather than via a proxy.
+		Proxy: nil,
+	}
+	if slices.ContainsFunc(pacurls, func(u string) bool { return strings.HasPrefix(u, "file:") }) {
+		log.Print("Warning: When using a local PAC file, the online/offline status can't ",
+			"be determined by the fact that the PAC file is downloaded. Make sure you ",
+			"check for proxy connectivity in your PAC file!")
+		if runtime.GOOS == "windows" {
+			tr.RegisterProtocol("file", http.NewFileTransport(http.Dir("C:")))
+		} else {
+			tr.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+		}
+	}
+	pf := &pacFetcher{
+		pacFinder: newPacFinder(""),
+		monitor:   newNetMonitor(),
+		client:    &http.Client{Transport: tr, Timeout: 30 * time.Second},
+		now:       time.Now,
+		publicKey: pacPublicKey,
+		policy:    defaultPACPolicy,
+		diskCache: pacCache,
+	}
+	if len(pacurls) > 0 {
+		pf.pacFinder = newPacFinder(pacurls[0])
+		pf.fallbacks = pacurls[1:]
+	} else {
+		pf.static = systemProxyPAC
+	}
+	return pf
+}
+
+// pacURLFlag holds the values of the -C flag, which can be given more than once (or as a
+// comma-separated list) to give PAC URLs to fall back to, in order.
+type pacURLFlag []string
+
+func (f *pacURLFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *pacURLFlag) Set(value string) error {
+	*f = append(*f, splitList(value)...)
+	return nil
+}
+
+func requireOK(resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return resp, err
+	} else if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("expected status 200 OK, got %s", resp.Status)
+	} else {
+		return resp, nil
+	}
+}
+
+func (pf *pacFetcher) download() []byte {
+	if !pf.monitor.addrsChanged() && !pf.pacFinder.pacChanged() && !pf.forceDownload {
+		if !pf.refreshDue() {
+			return nil
+		} else if pf.connected && !pf.fallback && pf.savedAt.IsZero() {
+			return pf.refresh()
+		}
+		// The refresh interval has passed, but either we couldn't download the PAC file last
+		// time (and may be using the saved one), or we're using a fallback and the preferred
+		// PAC URL might work now. Rather than waiting for a network change, try again from
+		// scratch.
+	}
+	usingSaved := !pf.savedAt.IsZero()
+	pf.connected = false
+	pf.fallback = false
+	pf.savedAt = time.Time{}
+	pf.err = nil
+	pf.fetched = pf.now()
+	pf.forceDownload = false
+
+	pacurl, err := pf.pacFinder.findPACURL()
+	pf.url = pacurl
+	if err != nil {
+		log.Printf("Error while trying to detect PAC URL: %v", err)
+		pf.err = fmt.Errorf("%w: error detecting PAC URL: %w", ErrPACUnavailable, err)
+		return nil
+	} else if pacurl == "" && pf.static != nil {
+		log.Println("No PAC URL specified or detected; using the proxy from the system settings")
+		pf.connected = true
+		pf.cache = pf.static
+		return pf.static
+	} else if pacurl == "" {
+		log.Println("No PAC URL specified or detected; all requests will be made directly")
+		pf.err = fmt.Errorf("%w: no PAC URL specified or detected", ErrPACUnavailable)
+		return nil
+	}
+	for i, candidate := range append([]string{pacurl}, pf.fallbacks...) {
+		if i > 0 {
+			log.Printf("Trying the next PAC URL (%d of %d)", i+1, len(pf.fallbacks)+1)
+		}
+		resp, pacjs, err := pf.fetch(candidate)
+		if err != nil {
+			pf.err = fmt.Errorf("%w: %w", ErrPACUnavailable, err)
+			continue
+		}
+		if usingSaved {
+			log.Printf("Downloaded the PAC file from %s, so the saved one isn't used any more",
+				candidate)
+		}
+		pf.url = candidate
+		pf.fallback = i > 0
+		pf.err = nil
+		pf.connected = true
+		pf.downloaded = true
+		pf.savedAt = time.Time{}
+		pf.cache = pacjs
+		pf.modified = resp.Header.Get("Last-Modified")
+		pf.etag = resp.Header.Get("ETag")
+		pf.saveToDisk(candidate, pacjs)
+		return pacjs
+	}
+	if !pf.downloaded && pf.diskCache != nil {
+		return pf.loadFromDisk(append([]string{pacurl}, pf.fallbacks...))
+	}
+	return nil
+}
+
+// fetch downloads and verifies the PAC file from pacurl. It returns the response (whose body has
+// been read and closed), and the PAC file.
+func (pf *pacFetcher) fetch(pacurl string) (*http.Response, []byte, error) {
+	signed := pf.publicKey != nil
+	if err := pf.policy.check(pacurl, signed); err != nil {
+		log.Printf("Not using PAC file: %v", err)
+		return nil, nil, err
+	}
+	warnIfUnprotected(pacurl, signed)
+
+	log.Printf("Attempting to download PAC from %s", pacurl)
+	resp, err := requireOK(pf.client.Get(pacurl))
+	if err != nil {
+		// Sometimes, if we try to download too soon after a network change, the PAC
+		// download can fail. See https://github.com/samuong/alpaca/issues/8 for details.
+		log.Printf("Error downloading PAC file, will retry after %v: %q",
+			delayAfterFailedDownload, err)
+		time.Sleep(delayAfterFailedDownload)
+		if resp, err = requireOK(pf.client.Get(pacurl)); err != nil {
+			log.Printf("Error downloading PAC file, giving up: %q", err)
+			return nil, nil, fmt.Errorf("error downloading %s: %w", pacurl, err)
+		}
+	}
+	defer resp.Body.Close()
+	pacjs, err := readPAC(resp)
+	if err != nil {
+		log.Printf("Error reading PAC JS from response body: %q", err)
+		return nil, nil, fmt.Errorf("error reading %s: %w", pacurl, err)
+	}
+	if err := pf.verify(pacurl, pacjs); err != nil {
+		log.Printf("Not using PAC file from %s: %v", pacurl, err)
+		return nil, nil, fmt.Errorf("error verifying %s: %w", pacurl, err)
+	}
+	if pf.cache != nil && !bytes.Equal(pacjs, pf.cache) && isUnprotected(pacurl, signed) {
+		log.Printf("WARNING: The PAC file has changed, and was downloaded from %s without "+
+			"HTTPS or a signature. If you're on an untrusted network, it may have been "+
+			"tampered with.", pacurl)
+	}
+	return resp, pacjs, nil
+}
+
+func readPAC(resp *http.Response) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, resp.Body, maxResponseBytes)
+	if err == io.EOF {
+		return buf.Bytes(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("PAC JS is too big (limit is %d bytes)", maxResponseBytes)
+}
+
+func (pf *pacFetcher) refreshDue() bool {
+	return pf.refreshInterval > 0 && pf.url != "" &&
+		pf.now().Sub(pf.fetched) >= pf.refreshInterval
+}
+
+// refresh re-fetches the PAC file from the current URL using a conditional request, and returns
+// the new PAC script if it has changed. If the refresh fails, we keep using the current script.
+func (pf *pacFetcher) refresh() []byte {
+	pf.fetched = pf.now()
+	req, err := http.NewRequest(http.MethodGet, pf.url, nil)
+	if err != nil {
+		log.Printf("Error creating PAC refresh request: %v", err)
+		return nil
+	}
+	if pf.etag != "" {
+		req.Header.Set("If-None-Match", pf.etag)
+	}
+	if pf.modified != "" {
+		req.Header.Set("If-Modified-Since", pf.modified)
+	}
+	resp, err := pf.client.Do(req)
+	if err != nil {
+		log.Printf("Error refreshing PAC file, will try again in %v: %v",
+			pf.refreshInterval, err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		debugf("pac", "PAC file at %s hasn't changed", pf.url)
+		pf.saveToDisk(pf.url, pf.cache)
+		return nil
+	} else if resp.StatusCode != http.StatusOK {
+		log.Printf("Error refreshing PAC file, will try again in %v: got %s",
+			pf.refreshInterval, resp.Status)
+		return nil
+	}
+	pacjs, err := readPAC(resp)
+	if err != nil {
+		log.Printf("Error refreshing PAC file, will try again in %v: %v",
+			pf.refreshInterval, err)
+		return nil
+	}
+	if !bytes.Equal(pacjs, pf.cache) {
+		// Don't update the cache validators if the new PAC file isn't valid, so that it gets
+		// checked again next time (e.g. in case its detached signature wasn't updated yet).
+		if err := pf.verify(pf.url, pacjs); err != nil {
+			log.Printf("Not using changed PAC file at %s: %v", pf.url, err)
+			return nil
+		}
+	}
+	pf.modified = resp.Header.Get("Last-Modified")
+	pf.etag = resp.Header.Get("ETag")
+	pf.saveToDisk(pf.url, pacjs)
+	if bytes.Equal(pacjs, pf.cache) {
+		debugf("pac", "PAC file at %s hasn't changed", pf.url)
+		return nil
+	}
+	if isUnprotected(pf.url, pf.publicKey != nil) {
+		log.Printf("WARNING: The PAC file at %s has changed, and was downloaded without "+
+			"HTTPS or a signature. If you're on an untrusted network, it may have been "+
+			"tampered with.", pf.url)
+	} else {
+		log.Printf("PAC file at %s has changed", pf.url)
+	}
+	pf.cache = pacjs
+	return pacjs
+}
+
+func (pf *pacFetcher) isConnected() bool {
+	return pf.connected
+}
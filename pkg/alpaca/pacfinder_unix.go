@@ -15,7 +15,7 @@
 //go:build aix || dragonfly || freebsd || linux || netbsd || openbsd || solaris
 // +build aix dragonfly freebsd linux netbsd openbsd solaris
 
-package main
+package alpaca
 
 import (
 	"os/exec"
@@ -15,7 +15,7 @@
 //go:build aix || dragonfly || freebsd || linux || netbsd || openbsd || solaris
 // +build aix dragonfly freebsd linux netbsd openbsd solaris
 
-package main
+package alpaca
 
 import (
 	"os"
@@ -31,7 +31,7 @@ func TestFindPACURL(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 	oldpath := os.Getenv("PATH")
-	defer require.NoError(t, os.Setenv("PATH", oldpath))
+	defer func() { require.NoError(t, os.Setenv("PATH", oldpath)) }()
 
 	require.NoError(t, os.Setenv("PATH", dir))
 	tmpfn := filepath.Join(dir, "gsettings")
@@ -49,7 +49,7 @@ func TestFindPACURLWhenGsettingsIsntAvailable(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 	oldpath := os.Getenv("PATH")
-	defer require.NoError(t, os.Setenv("PATH", oldpath))
+	defer func() { require.NoError(t, os.Setenv("PATH", oldpath)) }()
 	require.NoError(t, os.Setenv("PATH", dir))
 	pf := newPacFinder("")
 	_, err = pf.findPACURL()
@@ -0,0 +1,54 @@
+// Copyright 2019, 2021, 2022 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import "time"
+
+// How often the PAC URL is read from the registry again, to see whether it has changed. Unlike
+// gsettings and SystemConfiguration, running reg is too slow to do for every request.
+const pacFinderCheckInterval = 5 * time.Second
+
+type pacFinder struct {
+	pacURL  string
+	auto    bool
+	checked time.Time
+}
+
+func newPacFinder(pacURL string) *pacFinder {
+	return &pacFinder{pacURL: pacURL, auto: pacURL == ""}
+}
+
+func (finder *pacFinder) findPACURL() (string, error) {
+	if !finder.auto {
+		return finder.pacURL, nil
+	}
+	settings, err := readWindowsProxySettings()
+	if err != nil {
+		return "", err
+	}
+	return settings.pacURL, nil
+}
+
+func (finder *pacFinder) pacChanged() bool {
+	if !finder.auto || time.Since(finder.checked) < pacFinderCheckInterval {
+		return false
+	}
+	finder.checked = time.Now()
+	if url, _ := finder.findPACURL(); finder.pacURL != url {
+		finder.pacURL = url
+		return true
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logPACDiff logs how the PAC file from pacurl changed, as a unified diff (see maxDiffLines).
+func logPACDiff(pacurl string, old, new []byte) {
+	diff, ok := unifiedDiff(string(old), string(new), maxDiffLines)
+	if !ok {
+		log.Printf("The PAC file from %s changed (too much to show as a diff)", redactURL(pacurl))
+		return
+	}
+	log.Printf("The PAC file from %s changed:\n%s", redactURL(pacurl), diff)
+}
+
+// pacHistory keeps the last few versions of the PAC file in a directory (given by -pac-history),
+// so that if a new PAC file breaks something, Alpaca can be told to go back to an older one using
+// the API (see pacHistoryAPI). Each version is saved in its own file, named after its number.
+type pacHistory struct {
+	dir  string
+	size int // The number of versions to keep
+}
+
+// pacVersion describes a saved version of the PAC file.
+type pacVersion struct {
+	Version int       `json:"version"`
+	Saved   time.Time `json:"saved"`
+	Size    int       `json:"size"`
+	SHA256  string    `json:"sha256"`
+	// In responses, whether this is the version that Alpaca is using.
+	Current bool `json:"current,omitempty"`
+}
+
+var errNoSuchVersion = errors.New("no such version of the PAC file")
+
+func newPACHistory(dir string, size int) (*pacHistory, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid PAC history size %d (must be at least 1)", size)
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &pacHistory{dir: dir, size: size}, nil
+}
+
+func (h *pacHistory) path(version int) string {
+	return filepath.Join(h.dir, fmt.Sprintf("pac-%06d.js", version))
+}
+
+// numbers returns the numbers of the saved versions, oldest first.
+func (h *pacHistory) numbers() ([]int, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []int
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), "pac-")
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		} else if name, ok = strings.CutSuffix(name, ".js"); !ok {
+			continue
+		} else if n, err := strconv.Atoi(name); err == nil && n > 0 {
+			numbers = append(numbers, n)
+		}
+	}
+	slices.Sort(numbers)
+	return numbers, nil
+}
+
+// load returns the contents of a saved version.
+func (h *pacHistory) load(version int) ([]byte, error) {
+	pacjs, err := os.ReadFile(h.path(version))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNoSuchVersion
+	}
+	return pacjs, err
+}
+
+// versions describes the saved versions, newest first.
+func (h *pacHistory) versions() ([]pacVersion, error) {
+	numbers, err := h.numbers()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]pacVersion, 0, len(numbers))
+	for i := len(numbers) - 1; i >= 0; i-- {
+		n := numbers[i]
+		info, err := os.Stat(h.path(n))
+		if err != nil {
+			continue // Removed by another instance
+		}
+		pacjs, err := h.load(n)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(pacjs)
+		versions = append(versions, pacVersion{
+			Version: n,
+			Saved:   info.ModTime().UTC(),
+			Size:    len(pacjs),
+			SHA256:  hex.EncodeToString(sum[:]),
+		})
+	}
+	return versions, nil
+}
+
+// record saves pacjs as a new version (unless it's the same as the newest version), and removes
+// the oldest versions beyond the number to keep. Errors are logged rather than returned, since
+// they shouldn't stop the PAC file from being used.
+func (h *pacHistory) record(pacjs []byte) {
+	numbers, err := h.numbers()
+	if err != nil {
+		log.Printf("Error reading the PAC history in %s: %v", h.dir, err)
+		return
+	}
+	next := 1
+	if len(numbers) > 0 {
+		last := numbers[len(numbers)-1]
+		if saved, err := h.load(last); err == nil && bytes.Equal(saved, pacjs) {
+			return
+		}
+		next = last + 1
+	}
+	// Write to a temporary file first, so that a version is never left half-written.
+	path := h.path(next)
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, pacjs, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.Printf("Error saving the PAC file to %s: %v", path, err)
+		return
+	}
+	debugf("pac", "Saved version %d of the PAC file to %s", next, path)
+	numbers = append(numbers, next)
+	for len(numbers) > h.size {
+		n := numbers[0]
+		numbers = numbers[1:]
+		if err := os.Remove(h.path(n)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error removing an old version of the PAC file: %v", err)
+		}
+	}
+}
+
+// pacHistoryAPI lists the saved versions of the PAC file (GET /alpaca/api/pac/history), returns
+// one of them (GET /alpaca/api/pac/history?version=N), and rolls back to one of them (POST
+// /alpaca/api/pac/rollback). A rollback lasts until the PAC server has a new PAC file.
+type pacHistoryAPI struct {
+	history *pacHistory
+	finder  *ProxyFinder
+}
+
+type rollbackRequest struct {
+	Version int `json:"version"`
+}
+
+func (api *pacHistoryAPI) SetupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/alpaca/api/pac/history", localhostOnly(api.handleHistory))
+	mux.HandleFunc("/alpaca/api/pac/rollback", localhostOnly(api.handleRollback))
+}
+
+func (api *pacHistoryAPI) handleHistory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if v := req.URL.Query().Get("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "version parameter must be a number")
+			return
+		}
+		pacjs, err := api.history.load(n)
+		if errors.Is(err, errNoSuchVersion) {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = w.Write(pacjs)
+		return
+	}
+	versions, err := api.history.versions()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	current := sha256.Sum256(api.finder.currentPAC())
+	for i := range versions {
+		versions[i].Current = versions[i].SHA256 == hex.EncodeToString(current[:])
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+func (api *pacHistoryAPI) handleRollback(w http.ResponseWriter, req *http.Request) {
+	// Like the annotations API, this is meant for scripts and other tools, not for web pages.
+	if req.Header.Get("Origin") != "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body rollbackRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	pacjs, err := api.history.load(body.Version)
+	if errors.Is(err, errNoSuchVersion) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := api.finder.rollback(pacjs); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	log.Printf("Rolled back to version %d of the PAC file using the API", body.Version)
+	events.publish(eventPACChanged, api.history.path(body.Version),
+		"Rolled back to version %d of the PAC file", body.Version)
+	writeJSON(w, http.StatusOK, body)
+}
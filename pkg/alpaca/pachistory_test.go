@@ -0,0 +1,142 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPACHistoryKeepsLastVersions(t *testing.T) {
+	h, err := newPACHistory(t.TempDir(), 2)
+	require.NoError(t, err)
+	h.record([]byte("one"))
+	h.record([]byte("one")) // Not a new version
+	h.record([]byte("two"))
+	h.record([]byte("three"))
+	versions, err := h.versions()
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, 3, versions[0].Version)
+	assert.Equal(t, 5, versions[0].Size)
+	assert.Equal(t, 2, versions[1].Version)
+	pacjs, err := h.load(2)
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(pacjs))
+	_, err = h.load(1)
+	assert.ErrorIs(t, err, errNoSuchVersion)
+	// The numbering carries on from the saved versions after a restart.
+	h, err = newPACHistory(h.dir, 2)
+	require.NoError(t, err)
+	h.record([]byte("one"))
+	pacjs, err = h.load(4)
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(pacjs))
+	_, err = newPACHistory(h.dir, 0)
+	assert.Error(t, err)
+}
+
+func TestPACChangeIsLoggedAsDiff(t *testing.T) {
+	js := "function FindProxyForURL(url, host) {\n  return \"DIRECT\";\n}\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(js))
+	}))
+	defer server.Close()
+	pf := NewProxyFinder([]string{server.URL}, NewPACWrapper(PACData{Port: 1}), myIPAuto)
+	js = "function FindProxyForURL(url, host) {\n  return \"PROXY proxy.test:8080\";\n}\n"
+	pf.fetcher.refreshInterval = time.Hour
+	pf.fetcher.fetched = time.Time{}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(io.Discard)
+	pf.checkForUpdates()
+	assert.Contains(t, buf.String(), "The PAC file from "+server.URL+" changed:\n"+
+		"@@ -1,3 +1,3 @@\n function FindProxyForURL(url, host) {\n-  return \"DIRECT\";\n"+
+		"+  return \"PROXY proxy.test:8080\";\n }\n")
+}
+
+func TestPACRollback(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "PROXY good.test:8080" }`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(js))
+	}))
+	defer server.Close()
+	pf := NewProxyFinder([]string{server.URL}, NewPACWrapper(PACData{Port: 1}), myIPAuto)
+	history, err := newPACHistory(t.TempDir(), 10)
+	require.NoError(t, err)
+	pf.setHistory(history)
+	mux := http.NewServeMux()
+	(&pacHistoryAPI{history: history, finder: pf}).SetupHandlers(mux)
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:3128"+path, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:12345"
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	route := func() string {
+		req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+		proxy, err := pf.findProxyForRequest(req)
+		require.NoError(t, err)
+		return proxy.Host
+	}
+	refresh := func() {
+		pf.fetcher.refreshInterval = time.Hour
+		pf.fetcher.fetched = time.Time{}
+		pf.fetcher.forceDownload = true
+		pf.checkForUpdates()
+	}
+	js = `function FindProxyForURL(url, host) { return "PROXY bad.test:8080" }`
+	refresh()
+	assert.Equal(t, "bad.test:8080", route())
+
+	w := call(http.MethodGet, "/alpaca/api/pac/history", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var versions []pacVersion
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&versions))
+	require.Len(t, versions, 2)
+	assert.Equal(t, 2, versions[0].Version)
+	assert.True(t, versions[0].Current)
+	assert.False(t, versions[1].Current)
+	w = call(http.MethodGet, "/alpaca/api/pac/history?version=1", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "good.test")
+
+	w = call(http.MethodPost, "/alpaca/api/pac/rollback", `{"version":1}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "good.test:8080", route())
+	// Downloading the bad PAC file again (e.g. after a network change) doesn't undo the rollback.
+	refresh()
+	assert.Equal(t, "good.test:8080", route())
+	// But a new one does.
+	js = `function FindProxyForURL(url, host) { return "PROXY fixed.test:8080" }`
+	refresh()
+	assert.Equal(t, "fixed.test:8080", route())
+
+	assert.Equal(t, http.StatusNotFound,
+		call(http.MethodPost, "/alpaca/api/pac/rollback", `{"version":9}`).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed,
+		call(http.MethodGet, "/alpaca/api/pac/rollback", "").Code)
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+// How often a pacOverride checks whether its file has changed.
+const pacOverrideCheckInterval = 5 * time.Second
+
+// pacOverride is a local file (given by the -pac-override flag) whose decisions take precedence
+// over the PAC file, so that users can work around a broken entry in their organisation's PAC file
+// without waiting for it to be fixed. The file is either a PAC script, whose FindProxyForURL
+// returns null (or "") for the URLs that it doesn't want to override, or a list of rules, one per
+// line, each of which is a host pattern (as for shExpMatch) followed by a PAC-style result, e.g.
+// "*.saas.example.com DIRECT". The file is reloaded when it changes.
+type pacOverride struct {
+	path    string
+	modTime time.Time
+	checked time.Time
+	runner  *PACRunner     // If the file is a PAC script
+	rules   []overrideRule // Otherwise
+	now     func() time.Time
+	mux     sync.Mutex
+}
+
+type overrideRule struct {
+	pattern string
+	glob    glob.Glob
+	result  string
+}
+
+func newPACOverride(path string) (*pacOverride, error) {
+	po := &pacOverride{path: path, now: time.Now}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := po.load(info.ModTime()); err != nil {
+		return nil, fmt.Errorf("error loading -pac-override file %s: %w", path, err)
+	}
+	return po, nil
+}
+
+// load reads the file, which was last modified at modTime.
+func (po *pacOverride) load(modTime time.Time) error {
+	buf, err := os.ReadFile(po.path)
+	if err != nil {
+		return err
+	}
+	po.modTime = modTime
+	if bytes.Contains(buf, []byte("FindProxyForURL")) {
+		runner := &PACRunner{timeout: pacTimeout}
+		if err := runner.Update(buf); err != nil {
+			return err
+		}
+		po.runner, po.rules = runner, nil
+		return nil
+	}
+	rules, err := parseOverrideRules(buf)
+	if err != nil {
+		return err
+	}
+	po.runner, po.rules = nil, rules
+	return nil
+}
+
+func parseOverrideRules(buf []byte) ([]overrideRule, error) {
+	var rules []overrideRule
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a host pattern and a proxy", n)
+		}
+		g, err := glob.Compile(asciiPattern(strings.ToLower(fields[0])))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid host pattern %q: %w", n, fields[0], err)
+		}
+		result := strings.Join(fields[1:], " ")
+		if err := validatePACResult(result); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules = append(rules, overrideRule{pattern: fields[0], glob: g, result: result})
+	}
+	return rules, scanner.Err()
+}
+
+// reloadIfChanged reloads the file if it has changed since it was last loaded. If it can't be
+// loaded, the previous version is kept.
+func (po *pacOverride) reloadIfChanged() {
+	now := po.now()
+	if now.Sub(po.checked) < pacOverrideCheckInterval {
+		return
+	}
+	po.checked = now
+	info, err := os.Stat(po.path)
+	if err != nil {
+		log.Printf("Error checking -pac-override file: %v", err)
+		return
+	} else if info.ModTime().Equal(po.modTime) {
+		return
+	}
+	if err := po.load(info.ModTime()); err != nil {
+		log.Printf("Not using changed -pac-override file %s: %v", po.path, err)
+		return
+	}
+	log.Printf("Reloaded -pac-override file %s", po.path)
+}
+
+// find returns the result that overrides the PAC file for u, and a description of where it came
+// from (for logging). It returns false if the PAC file shouldn't be overridden.
+func (po *pacOverride) find(u url.URL) (string, string, bool) {
+	po.mux.Lock()
+	defer po.mux.Unlock()
+	po.reloadIfChanged()
+	if po.runner != nil {
+		result, err := po.runner.FindProxyForURL(u)
+		if errors.Is(err, errPACNotString) || (err == nil && result == "") {
+			return "", "", false
+		} else if err != nil {
+			log.Printf("Error running -pac-override file: %v", err)
+			return "", "", false
+		}
+		return result, "override PAC", true
+	}
+	host := canonicalHost(u.Hostname())
+	for _, rule := range po.rules {
+		if rule.glob.Match(host) {
+			return rule.result, "override rule " + rule.pattern, true
+		}
+	}
+	return "", "", false
+}
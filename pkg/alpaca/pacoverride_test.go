@@ -0,0 +1,133 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeOverride(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "override")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestPACOverrideRules(t *testing.T) {
+	po, err := newPACOverride(writeOverride(t, `
+		# Broken in the corporate PAC file
+		*.saas.test   DIRECT
+		build.test    PROXY build-proxy.test:8080; DIRECT  # comment
+	`))
+	require.NoError(t, err)
+	tests := []struct {
+		host, result string
+		ok           bool
+	}{
+		{"app.saas.test", "DIRECT", true},
+		{"APP.SAAS.TEST", "DIRECT", true},
+		{"build.test", "PROXY build-proxy.test:8080; DIRECT", true},
+		{"other.test", "", false},
+	}
+	for _, test := range tests {
+		result, _, ok := po.find(url.URL{Scheme: "https", Host: test.host})
+		assert.Equal(t, test.ok, ok, test.host)
+		assert.Equal(t, test.result, result, test.host)
+	}
+}
+
+func TestPACOverrideInvalidRules(t *testing.T) {
+	for _, content := range []string{
+		"example.test",
+		"example.test SOCKS s.test:1080",
+		"[ DIRECT",
+		"*.corp PROXY",
+		"*.corp PROXY a.test:80 b.test:80",
+		"*.corp HTTPS a.test:443; DIRECT a.test:80",
+	} {
+		_, err := newPACOverride(writeOverride(t, content))
+		assert.Error(t, err, content)
+	}
+	_, err := newPACOverride(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestPACOverrideScript(t *testing.T) {
+	po, err := newPACOverride(writeOverride(t, `function FindProxyForURL(url, host) {
+		if (dnsDomainIs(host, ".saas.test")) { return "DIRECT"; }
+		if (host == "empty.test") { return ""; }
+		return null;
+	}`))
+	require.NoError(t, err)
+	result, source, ok := po.find(url.URL{Scheme: "https", Host: "app.saas.test"})
+	assert.True(t, ok)
+	assert.Equal(t, "DIRECT", result)
+	assert.Equal(t, "override PAC", source)
+	_, _, ok = po.find(url.URL{Scheme: "https", Host: "empty.test"})
+	assert.False(t, ok)
+	_, _, ok = po.find(url.URL{Scheme: "https", Host: "other.test"})
+	assert.False(t, ok)
+}
+
+func TestPACOverrideReload(t *testing.T) {
+	path := writeOverride(t, "*.saas.test DIRECT")
+	po, err := newPACOverride(path)
+	require.NoError(t, err)
+	now := time.Now()
+	po.now = func() time.Time { return now }
+	u := url.URL{Scheme: "https", Host: "app.saas.test"}
+
+	require.NoError(t, os.WriteFile(path, []byte("*.saas.test PROXY p.test:80"), 0644))
+	require.NoError(t, os.Chtimes(path, now, now.Add(time.Minute)))
+	result, _, _ := po.find(u)
+	assert.Equal(t, "PROXY p.test:80", result)
+
+	// A broken file is ignored, and the last good version is kept.
+	require.NoError(t, os.WriteFile(path, []byte("*.saas.test"), 0644))
+	require.NoError(t, os.Chtimes(path, now, now.Add(2*time.Minute)))
+	result, _, _ = po.find(u)
+	assert.Equal(t, "PROXY p.test:80", result, "shouldn't reload before the check interval")
+	now = now.Add(pacOverrideCheckInterval)
+	result, _, _ = po.find(u)
+	assert.Equal(t, "PROXY p.test:80", result)
+}
+
+func TestPACOverrideTakesPrecedence(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "PROXY proxy.test:80" }`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer server.Close()
+	pw := NewPACWrapper(PACData{Port: 1})
+	pf := NewProxyFinder([]string{server.URL}, pw, myIPAuto)
+	patch, err := newPACOverride(writeOverride(t, "*.saas.test DIRECT"))
+	require.NoError(t, err)
+	pf.patch = patch
+	req := httptest.NewRequest(http.MethodGet, "https://app.saas.test/", nil)
+	proxy, err := pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Nil(t, proxy)
+	req = httptest.NewRequest(http.MethodGet, "https://other.test/", nil)
+	proxy, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	require.NotNil(t, proxy)
+	assert.Equal(t, "proxy.test:80", proxy.Host)
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// pacPolicy protects against PAC files served by an attacker, e.g. by answering WPAD queries on a
+// public Wi-Fi network. It's set using the -pac-require-https and -pac-hosts flags.
+type pacPolicy struct {
+	requireHTTPS bool     // Only use PAC files served over HTTPS (or signed, see pacsig.go)
+	hosts        []string // If non-empty, the only hosts (or patterns) that PAC files may come from
+}
+
+var defaultPACPolicy pacPolicy
+
+// check returns an error if the PAC file at pacurl shouldn't be used. signed is true if the PAC
+// file will have its signature verified.
+func (p pacPolicy) check(pacurl string, signed bool) error {
+	u, err := url.Parse(pacurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "file" {
+		// Local files can't be spoofed over the network.
+		return nil
+	}
+	if p.requireHTTPS && u.Scheme != "https" && !signed {
+		return fmt.Errorf("PAC URL %s doesn't use HTTPS (and isn't signed)", pacurl)
+	}
+	if len(p.hosts) > 0 && !p.allowsHost(u.Hostname()) {
+		return fmt.Errorf("PAC URL %s isn't on one of the allowed hosts (%s)",
+			pacurl, strings.Join(p.hosts, ", "))
+	}
+	return nil
+}
+
+func (p pacPolicy) allowsHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range p.hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnprotected returns true if a PAC file could have been tampered with by someone on the local
+// network, because it's downloaded over plain HTTP without a signature.
+func isUnprotected(pacurl string, signed bool) bool {
+	return !signed && strings.HasPrefix(pacurl, "http:")
+}
+
+// isWPADURL returns true if a PAC URL looks like it was found using WPAD (Web Proxy
+// Auto-Discovery), e.g. http://wpad.example.com/wpad.dat. WPAD is easy to spoof, since the wpad
+// host is found using DNS search domains (or DHCP), which are controlled by whoever runs the
+// network.
+func isWPADURL(pacurl string) bool {
+	u, err := url.Parse(pacurl)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == "wpad" || strings.HasPrefix(host, "wpad.") ||
+		strings.HasSuffix(strings.ToLower(u.Path), "/wpad.dat")
+}
+
+// warnIfUnprotected logs a warning if a PAC file that was found using WPAD isn't protected.
+func warnIfUnprotected(pacurl string, signed bool) {
+	if isUnprotected(pacurl, signed) && isWPADURL(pacurl) {
+		log.Printf("WARNING: The PAC file at %s looks like it was found using WPAD, and is "+
+			"downloaded without HTTPS or a signature. Anyone on this network could use it "+
+			"to intercept your traffic. Consider using -pac-require-https, -pac-hosts or "+
+			"-pac-public-key.", pacurl)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPACPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  pacPolicy
+		pacurl  string
+		signed  bool
+		allowed bool
+	}{
+		{"Default", pacPolicy{}, "http://wpad/wpad.dat", false, true},
+		{"RequireHTTPS", pacPolicy{requireHTTPS: true}, "http://pac.test/proxy.pac", false,
+			false},
+		{"HTTPS", pacPolicy{requireHTTPS: true}, "https://pac.test/proxy.pac", false, true},
+		{"Signed", pacPolicy{requireHTTPS: true}, "http://pac.test/proxy.pac", true, true},
+		{"LocalFile", pacPolicy{requireHTTPS: true}, "file:///etc/proxy.pac", false, true},
+		{"PinnedHost", pacPolicy{hosts: []string{"pac.test"}}, "http://PAC.test/proxy.pac",
+			false, true},
+		{"PinnedPattern", pacPolicy{hosts: []string{"*.corp.test"}},
+			"http://pac.corp.test/proxy.pac", false, true},
+		{"WrongHost", pacPolicy{hosts: []string{"*.corp.test"}}, "http://wpad.evil.test/wpad.dat",
+			false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.check(test.pacurl, test.signed)
+			if test.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestIsWPADURL(t *testing.T) {
+	assert.True(t, isWPADURL("http://wpad/wpad.dat"))
+	assert.True(t, isWPADURL("http://wpad.example.com/wpad.dat"))
+	assert.True(t, isWPADURL("http://10.0.0.1/wpad.dat"))
+	assert.False(t, isWPADURL("http://pac.example.com/proxy.pac"))
+}
+
+func TestPACPolicyBlocksDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script")))
+	defer server.Close()
+	pf := newPACFetcher(server.URL)
+	pf.policy = pacPolicy{requireHTTPS: true}
+	assert.Nil(t, pf.download())
+	assert.False(t, pf.isConnected())
+	assert.ErrorIs(t, pf.err, ErrPACUnavailable)
+}
+
+func TestWarningWhenUnprotectedPACChanges(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	s := &pacServerWithETag{pacjs: "test script 1", etag: `"1"`}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	nm := &fakeNetMonitor{true}
+	pf := newPACFetcher(server.URL)
+	pf.monitor = nm
+	assert.Equal(t, []byte("test script 1"), pf.download())
+	assert.NotContains(t, buf.String(), "WARNING")
+	s.pacjs = "test script 2"
+	nm.changed = true
+	assert.Equal(t, []byte("test script 2"), pf.download())
+	assert.Contains(t, buf.String(), "WARNING: The PAC file has changed")
+}
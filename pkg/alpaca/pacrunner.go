@@ -0,0 +1,721 @@
+// Copyright 2019, 2021, 2023, 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/robertkrimen/otto"
+)
+
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_(PAC)_file
+
+type PACRunner struct {
+	vm   *otto.Otto
+	myIP *myIPFinder // If set, overrides the default implementation of myIpAddress()
+	// If non-zero, a PAC script that runs for longer than this is interrupted, e.g. so that
+	// an infinite loop doesn't hold up every request.
+	timeout time.Duration
+	// The last result for each host, to fall back to if the PAC script times out.
+	lastGood map[string]string
+	traces   *pacTraceLog  // If set, a sample of evaluations is recorded here
+	hook     *pacTraceHook // Records the PAC function calls made by the current vm
+	// The PAC script that vm was created from, so that it can be created again if the script
+	// keeps failing (see restartIfFailing).
+	source    []byte
+	failures  int          // The number of evaluations in a row that have failed
+	restarted time.Time    // When vm was last recreated (or zero if it hasn't been)
+	restarts  int          // How many times vm has been recreated since the last Update
+	warning   atomic.Value // A string describing the restarts, for the dashboard
+	sync.Mutex
+}
+
+// pacTimeout is the timeout for PACRunners created by a ProxyFinder (see the -pac-timeout flag).
+var pacTimeout time.Duration
+
+// maxLastGood is the maximum number of hosts that PACRunner remembers results for.
+const maxLastGood = 1000
+
+var errPACTimeout = errors.New("PAC script timed out")
+
+var errPACNotString = errors.New("FindProxyForURL didn't return a string")
+
+// If this many evaluations of the PAC script fail in a row, the JavaScript engine is recreated
+// from the PAC script, in case its state has been corrupted (e.g. by a script that ran out of
+// memory, or that has a global variable that one bad call left in a broken state). This happens
+// at most once per pacRestartInterval.
+const (
+	pacRestartFailures = 5
+	pacRestartInterval = time.Minute
+)
+
+func (pr *PACRunner) Update(pacjs []byte) error {
+	vm, hook, err := pr.newVM(pacjs)
+	if err != nil {
+		return err
+	}
+	// Swap in the new VM while holding the lock, so that concurrent calls to FindProxyForURL
+	// use either the old PAC script or the new one.
+	pr.Lock()
+	defer pr.Unlock()
+	pr.vm = vm
+	pr.hook = hook
+	pr.lastGood = nil
+	pr.source = pacjs
+	pr.failures = 0
+	pr.restarts = 0
+	pr.warning.Store("")
+	return nil
+}
+
+// newVM creates a JavaScript engine with the PAC functions defined, and runs pacjs in it.
+func (pr *PACRunner) newVM(pacjs []byte) (*otto.Otto, *pacTraceHook, error) {
+	vm := otto.New()
+	hook := &pacTraceHook{}
+	var err error
+	set := func(name string, handler func(otto.FunctionCall) otto.Value) {
+		if err != nil {
+			return
+		} else if pr.traces != nil {
+			handler = hook.wrap(name, handler)
+		}
+		err = vm.Set(name, handler)
+	}
+	set("isPlainHostName", isPlainHostName)
+	set("dnsDomainIs", dnsDomainIs)
+	set("localHostOrDomainIs", localHostOrDomainIs)
+	set("isResolvable", isResolvable)
+	set("isInNet", isInNet)
+	set("dnsResolve", dnsResolve)
+	set("convert_addr", convertAddr)
+	if pr.myIP != nil {
+		set("myIpAddress", pr.myIP.myIpAddress)
+	} else {
+		set("myIpAddress", myIpAddress)
+	}
+	set("dnsDomainLevels", dnsDomainLevels)
+	set("shExpMatch", shExpMatch)
+	set("weekdayRange", func(fc otto.FunctionCall) otto.Value {
+		return weekdayRange(fc, time.Now())
+	})
+	set("dateRange", func(fc otto.FunctionCall) otto.Value {
+		return dateRange(fc, time.Now())
+	})
+	set("timeRange", func(fc otto.FunctionCall) otto.Value {
+		return timeRange(fc, time.Now())
+	})
+	// Microsoft's IPv6 extensions to the PAC API. See
+	// https://learn.microsoft.com/en-us/windows/win32/winhttp/ipv6-extensions-to-navigator-auto-config-file-format
+	set("isResolvableEx", isResolvableEx)
+	set("isInNetEx", isInNetEx)
+	set("dnsResolveEx", dnsResolveEx)
+	set("myIpAddressEx", myIpAddressEx)
+	set("sortIpAddressList", sortIpAddressList)
+	set("getClientVersion", getClientVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = runWithTimeout(vm, pr.timeout, func() (otto.Value, error) { return vm.Run(pacjs) })
+	if err != nil {
+		return nil, nil, err
+	}
+	return vm, hook, nil
+}
+
+func (pr *PACRunner) FindProxyForURL(u url.URL) (result string, err error) {
+	pr.Lock()
+	defer pr.Unlock()
+	if u.Scheme == "" {
+		// When a net/http Server parses a CONNECT request, the URL will
+		// have no Scheme. In that case, assume the scheme is "https".
+		u.Scheme = "https"
+	}
+	// Like browsers, pass the host to the PAC file in its canonical (ASCII) form.
+	canonicalURL(&u)
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		// Strip the path and query components of https:// URLs.
+		// https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_(PAC)_file#Parameters
+		// Like Chrome, also strip the path and query for wss:// URLs (secure WebSockets).
+		// https://cs.chromium.org/chromium/src/net/proxy_resolution/proxy_resolution_service.cc?rcl=fba6691ffca770dd0c916418601b9c9c019a2929&l=383
+		// It also seems like a good idea to strip the fragment, so do that too.
+		u.Path = "/"
+		u.RawPath = "/"
+		u.RawQuery = ""
+		u.Fragment = ""
+	}
+	if trace := pr.traces.sample(u.String(), u.Hostname()); trace != nil {
+		pr.hook.trace = trace
+		start := time.Now()
+		defer func() {
+			pr.hook.trace = nil
+			pr.traces.add(trace, result, err, time.Since(start))
+		}()
+	}
+	call := func() (otto.Value, error) {
+		return runWithTimeout(pr.vm, pr.timeout, func() (otto.Value, error) {
+			return pr.vm.Call("FindProxyForURL", nil, u.String(), u.Hostname())
+		})
+	}
+	val, err := call()
+	if err == nil && !val.IsString() {
+		err = errPACNotString
+	}
+	if err != nil && pr.restartIfFailing(err) {
+		// Give this request another go with the new engine.
+		val, err = call()
+		if err == nil && !val.IsString() {
+			err = errPACNotString
+		} else if err != nil {
+			pr.failures++
+		}
+	}
+	if err == nil && pr.failures > 0 {
+		if pr.failures >= pacRestartFailures {
+			// It was failing too often to restart, but it's recovered.
+			pr.warning.Store(pr.restartSummary())
+		}
+		pr.failures = 0
+	}
+	if errors.Is(err, errPACTimeout) {
+		result, ok := pr.lastGood[u.Hostname()]
+		if !ok {
+			result = "DIRECT"
+		}
+		log.Printf("FindProxyForURL(%q) took longer than %v, using %q", u.String(), pr.timeout,
+			result)
+		return result, nil
+	} else if err != nil {
+		return "", err
+	}
+	if pr.lastGood == nil || len(pr.lastGood) >= maxLastGood {
+		pr.lastGood = make(map[string]string)
+	}
+	pr.lastGood[u.Hostname()] = val.String()
+	debugf("pac", "FindProxyForURL(%q) returned %q", u.String(), val.String())
+	return val.String(), nil
+}
+
+// restartIfFailing counts an evaluation that failed with err, and recreates the JavaScript engine
+// if there have been pacRestartFailures in a row (unless it's been recreated too recently). It
+// returns whether it did. pr must be locked.
+func (pr *PACRunner) restartIfFailing(err error) bool {
+	pr.failures++
+	if pr.failures < pacRestartFailures || pr.source == nil {
+		return false
+	} else if since := time.Since(pr.restarted); since < pacRestartInterval {
+		pr.warning.Store(fmt.Sprintf("The PAC script keeps failing (%v), even after the "+
+			"engine was restarted %v ago", err, since.Round(time.Second)))
+		return false
+	}
+	log.Printf("The PAC script has failed %d times in a row (most recently: %v), restarting "+
+		"the engine", pr.failures, err)
+	pr.restarted = time.Now()
+	vm, hook, err := pr.newVM(pr.source)
+	if err != nil {
+		log.Printf("Error restarting the PAC engine: %v", err)
+		pr.warning.Store(fmt.Sprintf("The PAC script keeps failing, and the engine couldn't be "+
+			"restarted: %v", err))
+		return false
+	}
+	if pr.hook != nil {
+		hook.trace = pr.hook.trace
+	}
+	pr.vm = vm
+	pr.hook = hook
+	pr.failures = 0
+	pr.restarts++
+	pr.warning.Store(pr.restartSummary())
+	return true
+}
+
+func (pr *PACRunner) restartSummary() string {
+	if pr.restarts == 0 {
+		return ""
+	}
+	return fmt.Sprintf("The PAC engine was restarted %d time(s) after repeated errors, most "+
+		"recently at %s", pr.restarts, pr.restarted.Format(time.TimeOnly))
+}
+
+// engineWarning returns a description of any problems with the JavaScript engine (see
+// restartIfFailing), or an empty string if there haven't been any.
+func (pr *PACRunner) engineWarning() string {
+	warning, _ := pr.warning.Load().(string)
+	return warning
+}
+
+// lastResults returns the last result of the PAC script for each host. It returns false if the
+// PAC script is running (and might be stuck), rather than waiting for it.
+func (pr *PACRunner) lastResults() (map[string]string, bool) {
+	if !pr.TryLock() {
+		return nil, false
+	}
+	defer pr.Unlock()
+	results := make(map[string]string, len(pr.lastGood))
+	for host, result := range pr.lastGood {
+		results[host] = result
+	}
+	return results, true
+}
+
+// runWithTimeout calls f, which runs some JavaScript in vm, and interrupts it if it hasn't
+// finished after timeout (unless timeout is zero).
+func runWithTimeout(vm *otto.Otto, timeout time.Duration,
+	f func() (otto.Value, error)) (val otto.Value, err error) {
+	if timeout <= 0 {
+		return f()
+	}
+	// Use a new channel each time, so that a timer that fires just as f finishes can't
+	// interrupt a later call.
+	interrupt := make(chan func(), 1)
+	vm.Interrupt = interrupt
+	timer := time.AfterFunc(timeout, func() {
+		interrupt <- func() { panic(errPACTimeout) }
+	})
+	defer func() {
+		timer.Stop()
+		if caught := recover(); caught == errPACTimeout {
+			err = errPACTimeout
+		} else if caught != nil {
+			panic(caught)
+		}
+	}()
+	return f()
+}
+
+func toValue(unwrapped interface{}) otto.Value {
+	wrapped, err := otto.ToValue(unwrapped)
+	if err != nil {
+		return otto.UndefinedValue()
+	} else {
+		return wrapped
+	}
+}
+
+func isPlainHostName(call otto.FunctionCall) otto.Value {
+	host := canonicalHost(call.Argument(0).String())
+	return toValue(!strings.ContainsRune(host, '.'))
+}
+
+func dnsDomainIs(call otto.FunctionCall) otto.Value {
+	host := canonicalHost(call.Argument(0).String())
+	domain := canonicalDomain(call.Argument(1).String())
+	return toValue(strings.HasSuffix(host, domain))
+}
+
+func localHostOrDomainIs(call otto.FunctionCall) otto.Value {
+	host := canonicalHost(call.Argument(0).String())
+	hostdom := canonicalHost(call.Argument(1).String())
+	return toValue(host == hostdom || strings.HasPrefix(hostdom, host+"."))
+}
+
+func isResolvable(call otto.FunctionCall) otto.Value {
+	host := call.Argument(0).String()
+	_, err := recentFailures.lookup(host)
+	return toValue(err == nil)
+}
+
+func isInNet(call otto.FunctionCall) otto.Value {
+	host := call.Argument(0).String()
+	pattern := call.Argument(1).String()
+	mask := call.Argument(2).String()
+	buf := net.ParseIP(mask).To4()
+	if len(buf) != 4 {
+		return toValue(false)
+	}
+
+	m := net.IPv4Mask(buf[0], buf[1], buf[2], buf[3])
+	maskedIP := resolve(host).Mask(m)
+	maskedPattern := net.ParseIP(pattern).To4().Mask(m)
+	return toValue(maskedIP.Equal(maskedPattern))
+}
+
+func dnsResolve(call otto.FunctionCall) otto.Value {
+	host := call.Argument(0).String()
+	return toValue(resolve(host).String())
+}
+
+func resolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		// The given host is already an IP(v4) address; just return it.
+		return ip.To4()
+	}
+	addrs, err := recentFailures.lookup(host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		// There might be multiple IP addresses for this host. Return the first IPv4 address
+		// that we can find.
+		if ipv4 := net.ParseIP(addr).To4(); ipv4 != nil {
+			return ipv4
+		}
+	}
+	return nil
+}
+
+func convertAddr(call otto.FunctionCall) otto.Value {
+	ipaddr := call.Argument(0).String()
+	ipv4 := net.ParseIP(ipaddr).To4()
+	if ipv4 == nil {
+		return toValue(0)
+	}
+	return toValue(binary.BigEndian.Uint32(ipv4))
+}
+
+func myIpAddress(call otto.FunctionCall) otto.Value {
+	// This function works like Chrome's myIpAddress() function, except
+	// that we avoid returning an IPv6 address unless there's no IPv4 one.
+	// https://github.com/samuong/alpaca/issues/10
+	// https://chromium.googlesource.com/chromium/src/+/ee43fa5328856129f46566b2ea1be5811739681c/net/docs/proxy.md#Resolving-client_s-IP-address-within-a-PAC-script-using-myIpAddress
+	if localAddr := probeRoute("udp4", "8.8.8.8"); localAddr != "" {
+		return toValue(localAddr)
+	}
+	if ip := resolveHostname(); ip != "" {
+		return toValue(ip)
+	}
+	private := []string{"10.0.0.0", "172.16.0.0", "192.168.0.0"}
+	for _, remoteAddr := range private {
+		if localAddr := probeRoute("udp4", remoteAddr); localAddr != "" {
+			return toValue(localAddr)
+		}
+	}
+	// On an IPv6-only network, there's no IPv4 address to return. Like Chrome, fall back to an
+	// IPv6 address rather than the loopback address.
+	if localAddr := probeRoute("udp6", "2001:4860:4860::8888"); localAddr != "" {
+		return toValue(localAddr)
+	}
+	return toValue("127.0.0.1")
+}
+
+// probeRoute creates a UDP "connection" to the remote address, and returns the
+// local interface address. This does involve a system call, but does not
+// generate any network traffic since UDP is a connectionless protocol.
+func probeRoute(network, remote string) string {
+	conn, err := net.Dial(network, net.JoinHostPort(remote, "80"))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		// XXX: This is very unexpected, is it better to panic here?
+		return ""
+	}
+	if local.IP.IsLoopback() ||
+		local.IP.IsLinkLocalUnicast() ||
+		local.IP.IsLinkLocalMulticast() {
+		return ""
+	}
+	return local.IP.String()
+}
+
+// resolveHostname does a DNS resolve of the machine's hostname, and returns
+// the first IPv4 result if there is one, or the empty string.
+func resolveHostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return ""
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+			continue
+		}
+		if ipv4 := ip.To4(); len(ipv4) == net.IPv4len {
+			return ipv4.String()
+		}
+	}
+	return ""
+}
+
+func dnsDomainLevels(call otto.FunctionCall) otto.Value {
+	host := canonicalHost(call.Argument(0).String())
+	return toValue(strings.Count(host, "."))
+}
+
+func shExpMatch(call otto.FunctionCall) otto.Value {
+	str := call.Argument(0).String()
+	shexp := asciiPattern(call.Argument(1).String())
+	g, err := glob.Compile(shexp)
+	if err != nil {
+		return otto.UndefinedValue()
+	}
+	return toValue(g.Match(str))
+}
+
+func weekdayRange(call otto.FunctionCall, now time.Time) otto.Value {
+	if call.Argument(len(call.ArgumentList)-1).String() == "GMT" {
+		now = now.In(time.UTC)
+	}
+	weekdays := map[string]time.Weekday{
+		"SUN": time.Sunday, "MON": time.Monday, "TUE": time.Tuesday, "WED": time.Wednesday,
+		"THU": time.Thursday, "FRI": time.Friday, "SAT": time.Saturday,
+	}
+	wd1, ok := weekdays[call.Argument(0).String()]
+	if !ok {
+		return otto.UndefinedValue()
+	}
+	wd2, ok := weekdays[call.Argument(1).String()]
+	if !ok {
+		return toValue(now.Weekday() == wd1)
+	} else if wd1 <= wd2 {
+		return toValue(wd1 <= now.Weekday() && now.Weekday() <= wd2)
+	} else {
+		return toValue(wd1 == now.Weekday() || wd2 == now.Weekday())
+	}
+}
+
+func dateRange(call otto.FunctionCall, now time.Time) otto.Value {
+	argc := len(call.ArgumentList)
+	if call.Argument(argc-1).String() == "GMT" {
+		now = now.In(time.UTC)
+		argc--
+	}
+
+	var days []int
+	var months []time.Month
+	var years []int
+
+	monthmap := map[string]time.Month{
+		"JAN": time.January, "FEB": time.February, "MAR": time.March,
+		"APR": time.April, "MAY": time.May, "JUN": time.June,
+		"JUL": time.July, "AUG": time.August, "SEP": time.September,
+		"OCT": time.October, "NOV": time.November, "DEC": time.December,
+	}
+
+	for i := 0; i < argc; i++ {
+		if call.Argument(i).IsNumber() {
+			n, err := call.Argument(i).ToInteger()
+			if err != nil {
+				return otto.UndefinedValue()
+			} else if 1 <= n && n <= 31 {
+				days = append(days, int(n))
+			} else {
+				years = append(years, int(n))
+			}
+		} else if month, ok := monthmap[call.Argument(i).String()]; ok {
+			months = append(months, month)
+		} else {
+			return otto.UndefinedValue()
+		}
+	}
+
+	switch max(len(days), len(months), len(years)) {
+	case 1:
+		// One (possibly partial) date provided; match it against the current date.
+		if len(days) == 1 && days[0] != now.Day() {
+			return otto.FalseValue()
+		} else if len(months) == 1 && months[0] != now.Month() {
+			return otto.FalseValue()
+		} else if len(years) == 1 && years[0] != now.Year() {
+			return otto.FalseValue()
+		} else {
+			return otto.TrueValue()
+		}
+	case 2:
+		// Two dates provided; check that the current date is inside the range.
+		y1, m1, d1 := now.Date()
+		y2, m2, d2 := now.Date()
+		if len(days) == 2 {
+			d1, d2 = days[0], days[1]
+		}
+		if len(months) == 2 {
+			m1, m2 = months[0], months[1]
+		}
+		if len(years) == 2 {
+			y1, y2 = years[0], years[1]
+		}
+		h, m, s := now.Clock()
+		ns, loc := now.Nanosecond(), now.Location()
+		start := time.Date(y1, m1, d1, h, m, s, ns, loc)
+		end := time.Date(y2, m2, d2, h, m, s, ns, loc)
+		return toValue(!start.After(now) && !end.Before(now))
+	default:
+		// Zero, three or more dates provided. Something's wrong.
+		return otto.UndefinedValue()
+	}
+}
+
+func max(a, b, c int) int {
+	if a >= b && a >= c {
+		return a
+	} else if b >= c {
+		return b
+	} else {
+		return c
+	}
+}
+
+func timeRange(call otto.FunctionCall, now time.Time) otto.Value {
+	argc := len(call.ArgumentList)
+	if call.Argument(argc-1).String() == "GMT" {
+		now = now.In(time.UTC)
+		argc--
+	}
+	h1, m1, s1, h2, m2, s2 := 0, 0, 0, 0, 0, 0
+	var err error
+	toInt := func(idx int) int {
+		val, err2 := call.Argument(idx).ToInteger()
+		if err2 != nil {
+			err = err2
+		}
+		return int(val)
+	}
+	switch argc {
+	case 1:
+		h1 = toInt(0)
+		h2 = h1 + 1
+	case 2:
+		h1 = toInt(0)
+		h2 = toInt(1)
+	case 4:
+		h1, m1 = toInt(0), toInt(1)
+		h2, m2 = toInt(2), toInt(3)
+	case 6:
+		h1, m1, s1 = toInt(0), toInt(1), toInt(2)
+		h2, m2, s2 = toInt(3), toInt(4), toInt(5)
+	default:
+		return otto.UndefinedValue()
+	}
+	if err != nil {
+		return otto.UndefinedValue()
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), h1, m1, s1, 0, now.Location())
+	end := time.Date(now.Year(), now.Month(), now.Day(), h2, m2, s2, 0, now.Location())
+	return toValue(!start.After(now) && end.After(now))
+}
+
+func isResolvableEx(call otto.FunctionCall) otto.Value {
+	host := call.Argument(0).String()
+	addrs, err := recentFailures.lookup(host)
+	return toValue(err == nil && len(addrs) > 0)
+}
+
+func isInNetEx(call otto.FunctionCall) otto.Value {
+	// Unlike isInNet, the first argument must be an IP address (not a hostname) and the
+	// second argument is a prefix in CIDR notation, e.g. "198.95.0.0/16" or "3ffe:8311::/32".
+	ip := net.ParseIP(call.Argument(0).String())
+	_, prefix, err := net.ParseCIDR(call.Argument(1).String())
+	if ip == nil || err != nil {
+		return toValue(false)
+	}
+	return toValue(prefix.Contains(ip))
+}
+
+func dnsResolveEx(call otto.FunctionCall) otto.Value {
+	host := call.Argument(0).String()
+	if ip := net.ParseIP(host); ip != nil {
+		return toValue(ip.String())
+	}
+	addrs, err := recentFailures.lookup(host)
+	if err != nil {
+		return toValue("")
+	}
+	return toValue(strings.Join(addrs, ";"))
+}
+
+func myIpAddressEx(call otto.FunctionCall) otto.Value {
+	// Like myIpAddress, this follows the algorithm that Chrome uses, but returns all of the
+	// addresses found at the first step that finds any (including IPv6 addresses), separated
+	// by semicolons. If nothing is found, the result is an empty string.
+	var ips []string
+	probe := func(remotes ...string) {
+		for _, remote := range remotes {
+			if local := probeRoute("udp", remote); local != "" {
+				ips = append(ips, local)
+			}
+		}
+	}
+	if probe("8.8.8.8", "2001:4860:4860::8888"); len(ips) > 0 {
+		return toValue(strings.Join(ips, ";"))
+	}
+	if ips = resolveHostnameEx(); len(ips) > 0 {
+		return toValue(strings.Join(ips, ";"))
+	}
+	probe("10.0.0.0", "172.16.0.0", "192.168.0.0", "FC00::")
+	return toValue(strings.Join(ips, ";"))
+}
+
+// resolveHostnameEx does a DNS resolve of the machine's hostname, and returns all of the IPv4
+// and IPv6 results, excluding loopback and link-local addresses.
+func resolveHostnameEx() []string {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+			continue
+		}
+		result = append(result, ip.String())
+	}
+	return result
+}
+
+func sortIpAddressList(call otto.FunctionCall) otto.Value {
+	// Sort a semicolon-separated list of IP addresses, with IPv6 addresses before IPv4
+	// addresses (matching Chrome). If any element of the list isn't a valid IP address, or the
+	// list is empty, return false.
+	list := call.Argument(0).String()
+	if strings.TrimSpace(list) == "" {
+		return toValue(false)
+	}
+	var ips []net.IP
+	for _, elem := range strings.Split(list, ";") {
+		ip := net.ParseIP(strings.TrimSpace(elem))
+		if ip == nil {
+			return toValue(false)
+		}
+		ips = append(ips, ip)
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		iv4, jv4 := ips[i].To4() != nil, ips[j].To4() != nil
+		if iv4 != jv4 {
+			return !iv4
+		}
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+	sorted := make([]string, len(ips))
+	for i, ip := range ips {
+		sorted[i] = ip.String()
+	}
+	return toValue(strings.Join(sorted, ";"))
+}
+
+func getClientVersion(call otto.FunctionCall) otto.Value {
+	// This is the version of the PAC API that we support, not the version of Alpaca.
+	return toValue("1.0")
+}
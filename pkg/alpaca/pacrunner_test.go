@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package alpaca
 
 import (
 	"net"
@@ -35,6 +35,77 @@ func TestDirect(t *testing.T) {
 	assert.Equal(t, "DIRECT", proxy)
 }
 
+func TestFindProxyForURLTimeout(t *testing.T) {
+	pr := PACRunner{timeout: 50 * time.Millisecond}
+	pacjs := []byte(`function FindProxyForURL(url, host) {
+		if (host == "loop.test" && shExpMatch(url, "*/loop")) { while (true) {} }
+		return "PROXY proxy.test:8080";
+	}`)
+	require.NoError(t, pr.Update(pacjs))
+	proxy, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "other.test", Path: "/loop"})
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY proxy.test:8080", proxy)
+	// With no previous result for the host, fall back to DIRECT.
+	proxy, err = pr.FindProxyForURL(url.URL{Scheme: "http", Host: "loop.test", Path: "/loop"})
+	require.NoError(t, err)
+	assert.Equal(t, "DIRECT", proxy)
+	// Otherwise, use the last result for the host.
+	proxy, err = pr.FindProxyForURL(url.URL{Scheme: "http", Host: "loop.test", Path: "/ok"})
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY proxy.test:8080", proxy)
+	proxy, err = pr.FindProxyForURL(url.URL{Scheme: "http", Host: "loop.test", Path: "/loop"})
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY proxy.test:8080", proxy)
+}
+
+func TestUpdateTimeout(t *testing.T) {
+	pr := PACRunner{timeout: 50 * time.Millisecond}
+	pacjs := []byte(`while (true) {}`)
+	assert.ErrorIs(t, pr.Update(pacjs), errPACTimeout)
+}
+
+func TestRestartAfterRepeatedErrors(t *testing.T) {
+	var pr PACRunner
+	// Once this script has been asked about broken.test, it fails for every host (like an engine
+	// whose state has been corrupted) until it's run again.
+	pacjs := []byte(`var broken = false;
+		function FindProxyForURL(url, host) {
+			if (host == "broken.test") broken = true;
+			if (broken) throw "corrupted";
+			return "DIRECT";
+		}`)
+	require.NoError(t, pr.Update(pacjs))
+	find := func(host string) (string, error) {
+		return pr.FindProxyForURL(url.URL{Scheme: "https", Host: host})
+	}
+	_, err := find("broken.test")
+	require.Error(t, err)
+	for i := 2; i < pacRestartFailures; i++ {
+		_, err := find("www.test")
+		require.Error(t, err)
+	}
+	assert.Empty(t, pr.engineWarning())
+	proxy, err := find("www.test")
+	require.NoError(t, err)
+	assert.Equal(t, "DIRECT", proxy)
+	assert.Contains(t, pr.engineWarning(), "restarted 1 time(s)")
+
+	// It won't be restarted again straight away.
+	for i := 0; i < pacRestartFailures; i++ {
+		_, err = find("broken.test")
+		require.Error(t, err)
+	}
+	assert.Contains(t, pr.engineWarning(), "keeps failing")
+	pr.restarted = pr.restarted.Add(-pacRestartInterval)
+	proxy, err = find("www.test")
+	require.NoError(t, err)
+	assert.Equal(t, "DIRECT", proxy)
+	assert.Contains(t, pr.engineWarning(), "restarted 2 time(s)")
+
+	require.NoError(t, pr.Update(pacjs))
+	assert.Empty(t, pr.engineWarning())
+}
+
 func TestFindProxyForURL(t *testing.T) {
 	tests := []struct {
 		name, input, expected string
@@ -43,6 +114,9 @@ func TestFindProxyForURL(t *testing.T) {
 		{"HTTP", "http://alpaca.test/a?b=c#d", "http://alpaca.test/a?b=c#d"},
 		{"HTTPS", "https://alpaca.test/a?b=c#d", "https://alpaca.test/"},
 		{"WSS", "wss://alpaca.test/a?b=c#d", "wss://alpaca.test/"},
+		{"IDN", "http://Bücher.test./a", "http://xn--bcher-kva.test/a"},
+		{"IDNPort", "https://bücher.test:8443/", "https://xn--bcher-kva.test:8443/"},
+		{"IPv6", "http://[::1]:8080/a", "http://[::1]:8080/a"},
 	}
 	for _, test := range tests {
 		var pr PACRunner
@@ -88,6 +162,10 @@ func TestDnsDomainIs(t *testing.T) {
 		{"www", ".anz.com", false},
 		{"notanz.com", ".anz.com", false},
 		{"notanz.com", "anz.com", true}, // https://crbug.com/299649
+		{"www.anz.com.", ".anz.com", true},
+		{"WWW.ANZ.COM", ".anz.com", true},
+		{"www.xn--bcher-kva.test", ".bücher.test", true},
+		{"www.bücher.test", ".xn--bcher-kva.test", true},
 	}
 	for _, test := range tests {
 		t.Run(test.host+" "+test.domain, func(t *testing.T) {
@@ -113,6 +191,8 @@ func TestLocalHostOrDomainIs(t *testing.T) {
 		{"hostname match", "www", "www.mozilla.org", true},
 		{"domain name mismatch", "www.google.com", "www.mozilla.org", false},
 		{"hostname mismatch", "home.mozilla.org", "www.mozilla.org", false},
+		{"trailing dot", "www.mozilla.org.", "www.mozilla.org", true},
+		{"idn hostname match", "xn--bcher-kva", "bücher.test", true},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -268,6 +348,9 @@ func TestShExpMatch(t *testing.T) {
 	}{
 		{"http://anz.com/a/b/c.html", "*/b/*", true},
 		{"http://anz.com/d/e/f.html", "*/b/*", false},
+		{"www.xn--bcher-kva.test", "*.bücher.test", true},
+		{"http://xn--bcher-kva.test/a", "http://bücher.test/*", true},
+		{"www.xn--bcher-kva.test", "*.bucher.test", false},
 	}
 	for _, test := range tests {
 		t.Run(test.str+" "+test.shexp, func(t *testing.T) {
@@ -557,3 +640,134 @@ func TestTimeRange(t *testing.T) {
 		}
 	}
 }
+
+func TestIsResolvableEx(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{"localhost", true},
+		{"nonexistent.test", false},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			vm := otto.New()
+			require.NoError(t, vm.Set("isResolvableEx", isResolvableEx))
+			value, err := vm.Call("isResolvableEx", nil, test.host)
+			require.NoError(t, err)
+			actual, err := value.ToBoolean()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestIsInNetEx(t *testing.T) {
+	tests := []struct {
+		ipaddr   string
+		prefix   string
+		expected bool
+	}{
+		{"198.95.249.79", "198.95.249.79/32", true},
+		{"198.95.6.8", "198.95.0.0/16", true},
+		{"198.96.6.8", "198.95.0.0/16", false},
+		{"3ffe:8311:ffff:abcd:1234:dead:beef:101", "3ffe:8311:ffff::/48", true},
+		{"3ffe:8312::1", "3ffe:8311:ffff::/48", false},
+		{"www.anz.com", "198.95.0.0/16", false},
+		{"198.95.6.8", "198.95.0.0", false},
+	}
+	for _, test := range tests {
+		t.Run(test.ipaddr+" "+test.prefix, func(t *testing.T) {
+			vm := otto.New()
+			require.NoError(t, vm.Set("isInNetEx", isInNetEx))
+			value, err := vm.Call("isInNetEx", nil, test.ipaddr, test.prefix)
+			require.NoError(t, err)
+			actual, err := value.ToBoolean()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestDnsResolveEx(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected []string
+	}{
+		{"192.0.2.1", []string{"192.0.2.1"}},
+		{"2001:db8::1", []string{"2001:db8::1"}},
+		{"nonexistent.test", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			vm := otto.New()
+			require.NoError(t, vm.Set("dnsResolveEx", dnsResolveEx))
+			value, err := vm.Call("dnsResolveEx", nil, test.host)
+			require.NoError(t, err)
+			actual, err := value.ToString()
+			require.NoError(t, err)
+			assert.Equal(t, strings.Join(test.expected, ";"), actual)
+		})
+	}
+}
+
+func TestMyIpAddressEx(t *testing.T) {
+	vm := otto.New()
+	require.NoError(t, vm.Set("myIpAddressEx", myIpAddressEx))
+	value, err := vm.Call("myIpAddressEx", nil)
+	require.NoError(t, err)
+	output, err := value.ToString()
+	require.NoError(t, err)
+	if output == "" {
+		// This can legitimately happen on a machine with no network interfaces (other than
+		// loopback), so there's nothing else to check.
+		return
+	}
+	addrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+	for _, ip := range strings.Split(output, ";") {
+		assert.NotNil(t, net.ParseIP(ip), "invalid IP address %q", ip)
+		found := false
+		for _, addr := range addrs {
+			if strings.HasPrefix(addr.String(), ip) {
+				found = true
+			}
+		}
+		assert.True(t, found, "%q isn't one of our addresses", ip)
+	}
+}
+
+func TestSortIpAddressList(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected interface{}
+	}{
+		{"IPv4", "10.2.3.9;10.2.3.1;10.1.3.9", "10.1.3.9;10.2.3.1;10.2.3.9"},
+		{"IPv6", "2001:db8::2;2001:db8::1", "2001:db8::1;2001:db8::2"},
+		{"Mixed", "10.2.3.9;2001:db8::1;10.1.3.9", "2001:db8::1;10.1.3.9;10.2.3.9"},
+		{"Spaces", " 10.2.3.9 ; 10.1.3.9", "10.1.3.9;10.2.3.9"},
+		{"Empty", "", false},
+		{"Invalid", "10.2.3.9;www.anz.com", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := otto.New()
+			require.NoError(t, vm.Set("sortIpAddressList", sortIpAddressList))
+			value, err := vm.Call("sortIpAddressList", nil, test.input)
+			require.NoError(t, err)
+			actual, err := value.Export()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestGetClientVersion(t *testing.T) {
+	var pr PACRunner
+	pacjs := []byte(`function FindProxyForURL(url, host) { return getClientVersion() }`)
+	require.NoError(t, pr.Update(pacjs))
+	proxy, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "anz.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", proxy)
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// If set (using the -pac-public-key flag), PAC files are only used if they've been signed with
+// the corresponding Ed25519 private key. This protects against a tampered PAC file, e.g. one
+// served by an attacker on an untrusted network using WPAD.
+var pacPublicKey ed25519.PublicKey
+
+// The prefix of the comment line that holds an embedded signature. It must be the last line of
+// the PAC file, and the signature covers everything before it.
+const pacSignaturePrefix = "// alpaca-signature:"
+
+// The suffix added to the PAC URL to find a detached signature, if the PAC file doesn't have an
+// embedded signature.
+const pacSignatureSuffix = ".sig"
+
+var errBadPACSignature = errors.New("PAC file signature is invalid")
+
+// loadPACPublicKey reads an Ed25519 public key from a file, either in PEM format (as written by
+// "openssl pkey -pubout"), or as the base64-encoded 32-byte key.
+func loadPACPublicKey(path string) (ed25519.PublicKey, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(buf); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing public key in %s: %w", path, err)
+		}
+		edkey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key in %s is not an Ed25519 key", path)
+		}
+		return edkey, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s doesn't contain an Ed25519 public key", path)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// splitPACSignature separates an embedded signature from the rest of the PAC file. If there isn't
+// one, it returns a nil signature.
+func splitPACSignature(pacjs []byte) (body []byte, sig []byte, err error) {
+	trimmed := bytes.TrimRight(pacjs, "\r\n")
+	start := bytes.LastIndexByte(trimmed, '\n') + 1
+	line := string(trimmed[start:])
+	if !strings.HasPrefix(line, pacSignaturePrefix) {
+		return pacjs, nil, nil
+	}
+	sig, err = decodeSignature([]byte(strings.TrimPrefix(line, pacSignaturePrefix)))
+	return pacjs[:start], sig, err
+}
+
+func decodeSignature(buf []byte) ([]byte, error) {
+	if len(buf) == ed25519.SignatureSize {
+		return buf, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: signature is malformed", errBadPACSignature)
+	}
+	return sig, nil
+}
+
+// verify checks the signature of a PAC file that was downloaded from pacurl. The signature is
+// either embedded in the PAC file, or downloaded from the URL with ".sig" appended.
+func (pf *pacFetcher) verify(pacurl string, pacjs []byte) error {
+	if pf.publicKey == nil {
+		return nil
+	}
+	body, sig, err := splitPACSignature(pacjs)
+	if err != nil {
+		return err
+	} else if sig == nil {
+		if sig, err = pf.downloadSignature(pacurl); err != nil {
+			return err
+		}
+	}
+	if !ed25519.Verify(pf.publicKey, body, sig) {
+		return errBadPACSignature
+	}
+	return nil
+}
+
+func (pf *pacFetcher) downloadSignature(pacurl string) ([]byte, error) {
+	sigurl := pacurl + pacSignatureSuffix
+	resp, err := requireOK(pf.client.Get(sigurl))
+	if err != nil {
+		return nil, fmt.Errorf("PAC file isn't signed, and no signature at %s: %w", sigurl, err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	return decodeSignature(buf)
+}
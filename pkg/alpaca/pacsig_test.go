@@ -0,0 +1,153 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPAC = "function FindProxyForURL(url, host) { return \"DIRECT\"; }\n"
+
+func newPACKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return pub, priv
+}
+
+func signPAC(priv ed25519.PrivateKey, pacjs string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(pacjs)))
+}
+
+// newSignedPACServer serves a PAC file at /proxy.pac, and (if sig isn't empty) a detached
+// signature at /proxy.pac.sig.
+func newSignedPACServer(pacjs, sig string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", pacjsHandler(pacjs))
+	if sig != "" {
+		mux.HandleFunc("/proxy.pac.sig", pacjsHandler(sig))
+	}
+	return httptest.NewServer(mux)
+}
+
+func TestPACWithEmbeddedSignature(t *testing.T) {
+	pub, priv := newPACKey(t)
+	signed := testPAC + pacSignaturePrefix + " " + signPAC(priv, testPAC) + "\n"
+	server := newSignedPACServer(signed, "")
+	defer server.Close()
+	pf := newPACFetcher(server.URL + "/proxy.pac")
+	pf.publicKey = pub
+	assert.Equal(t, []byte(signed), pf.download())
+	assert.True(t, pf.isConnected())
+}
+
+func TestPACWithDetachedSignature(t *testing.T) {
+	pub, priv := newPACKey(t)
+	server := newSignedPACServer(testPAC, signPAC(priv, testPAC))
+	defer server.Close()
+	pf := newPACFetcher(server.URL + "/proxy.pac")
+	pf.publicKey = pub
+	assert.Equal(t, []byte(testPAC), pf.download())
+	assert.True(t, pf.isConnected())
+}
+
+func TestPACWithInvalidSignature(t *testing.T) {
+	pub, _ := newPACKey(t)
+	_, otherPriv := newPACKey(t)
+	tampered := testPAC + "// evil\n"
+	tests := []struct {
+		name  string
+		pacjs string
+		sig   string
+	}{
+		{"Unsigned", testPAC, ""},
+		{"WrongKey", testPAC, signPAC(otherPriv, testPAC)},
+		{"Tampered", tampered + pacSignaturePrefix + " " + signPAC(otherPriv, testPAC), ""},
+		{"Malformed", testPAC + pacSignaturePrefix + " not base64!", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newSignedPACServer(test.pacjs, test.sig)
+			defer server.Close()
+			pf := newPACFetcher(server.URL + "/proxy.pac")
+			pf.publicKey = pub
+			assert.Nil(t, pf.download())
+			assert.False(t, pf.isConnected())
+			assert.ErrorIs(t, pf.err, ErrPACUnavailable)
+		})
+	}
+}
+
+func TestUnsignedPACWithoutPublicKey(t *testing.T) {
+	server := newSignedPACServer(testPAC, "")
+	defer server.Close()
+	pf := newPACFetcher(server.URL + "/proxy.pac")
+	assert.Equal(t, []byte(testPAC), pf.download())
+}
+
+func TestLoadPACPublicKey(t *testing.T) {
+	pub, _ := newPACKey(t)
+	dir := t.TempDir()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	pemFile := filepath.Join(dir, "key.pem")
+	writePEM(t, pemFile, "PUBLIC KEY", der)
+	key, err := loadPACPublicKey(pemFile)
+	require.NoError(t, err)
+	assert.Equal(t, pub, key)
+
+	b64File := filepath.Join(dir, "key.b64")
+	encoded := base64.StdEncoding.EncodeToString(pub) + "\n"
+	require.NoError(t, os.WriteFile(b64File, []byte(encoded), 0600))
+	key, err = loadPACPublicKey(b64File)
+	require.NoError(t, err)
+	assert.Equal(t, pub, key)
+
+	badFile := filepath.Join(dir, "bad")
+	require.NoError(t, os.WriteFile(badFile, []byte("not a key"), 0600))
+	_, err = loadPACPublicKey(badFile)
+	assert.Error(t, err)
+}
+
+func TestRefreshWithInvalidSignatureKeepsCurrentScript(t *testing.T) {
+	pub, priv := newPACKey(t)
+	signed := testPAC + pacSignaturePrefix + " " + signPAC(priv, testPAC) + "\n"
+	s := &pacServerWithETag{pacjs: signed, etag: `"1"`}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	now := time.Now()
+	pf := newPACFetcher(server.URL)
+	pf.publicKey = pub
+	pf.monitor = &fakeNetMonitor{true}
+	pf.refreshInterval = time.Hour
+	pf.now = func() time.Time { return now }
+	assert.Equal(t, []byte(signed), pf.download())
+	s.pacjs, s.etag = "function FindProxyForURL() { return \"PROXY evil.test:80\"; }", `"2"`
+	now = now.Add(time.Hour)
+	assert.Nil(t, pf.download())
+	assert.True(t, pf.isConnected())
+	assert.Equal(t, []byte(signed), pf.cache)
+}
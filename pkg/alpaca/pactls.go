@@ -0,0 +1,147 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// How long a generated certificate is valid for. This is the most that macOS and iOS accept for
+// a TLS server certificate.
+const pacCertLifetime = 825 * 24 * time.Hour
+
+// loadPACCert returns the certificate for serving the wrapped PAC file over HTTPS (see the
+// -pac-https-port flag). If certFile exists, it's loaded along with keyFile (which can be omitted
+// if certFile contains both). Otherwise, a self-signed certificate for hosts is generated, and
+// saved to certFile (if given) so that it only has to be trusted once, rather than every time
+// Alpaca starts.
+func loadPACCert(certFile, keyFile string, hosts []string) (tls.Certificate, error) {
+	if certFile == "" && keyFile != "" {
+		return tls.Certificate{}, errors.New("a pac key was given without a pac certificate")
+	} else if keyFile == "" {
+		keyFile = certFile
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil {
+			return cert, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return tls.Certificate{}, fmt.Errorf("error loading pac certificate: %w", err)
+		}
+	}
+	certPEM, keyPEM, err := generatePACCert(hosts, time.Now())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if certFile != "" {
+		if err := savePACCert(certFile, keyFile, certPEM, keyPEM); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("Generated a self-signed certificate for the PAC file (SHA-256 fingerprint %x)",
+		sha256.Sum256(cert.Certificate[0]))
+	return cert, nil
+}
+
+// generatePACCert returns a self-signed certificate (and its private key) for hosts, which can be
+// host names or IP addresses, as well as for localhost.
+func generatePACCert(hosts []string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Alpaca"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(pacCertLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	for _, host := range hosts {
+		if host == "" || host == "localhost" {
+			continue
+		} else if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func savePACCert(certFile, keyFile string, certPEM, keyPEM []byte) error {
+	if certFile == keyFile {
+		return os.WriteFile(certFile, append(certPEM, keyPEM...), 0600)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, keyPEM, 0600)
+}
+
+// pacOnly only passes requests for the wrapped PAC file on to next, so that the HTTPS listener
+// can't be used as a proxy. The port is removed from the Host header, so that clients on other
+// machines are pointed at the proxy's port, rather than the HTTPS one (see PACWrapper.pacFor).
+func pacOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodConnect || req.URL.Scheme != "" ||
+			req.URL.Path != "/alpaca.pac" {
+			http.NotFound(w, req)
+			return
+		}
+		if host, _, err := net.SplitHostPort(req.Host); err == nil {
+			req.Host = host
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratePACCert(t *testing.T) {
+	now := time.Now()
+	certPEM, keyPEM, err := generatePACCert([]string{"", "alpaca.example.com", "10.0.0.5"}, now)
+	require.NoError(t, err)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "alpaca.example.com",
+		"10.0.0.5"} {
+		assert.NoError(t, leaf.VerifyHostname(host), host)
+	}
+	assert.Error(t, leaf.VerifyHostname("other.example.com"))
+	assert.True(t, leaf.NotAfter.After(now.Add(365*24*time.Hour)))
+}
+
+func TestLoadPACCertSavesGeneratedCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "pac.crt")
+	keyFile := filepath.Join(dir, "pac.key")
+	first, err := loadPACCert(certFile, keyFile, nil)
+	require.NoError(t, err)
+	assert.FileExists(t, keyFile)
+	// The saved certificate is used from then on, so that it only needs to be trusted once.
+	second, err := loadPACCert(certFile, keyFile, nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.Certificate, second.Certificate)
+}
+
+func TestLoadPACCertInOneFile(t *testing.T) {
+	certFile := filepath.Join(t.TempDir(), "pac.pem")
+	first, err := loadPACCert(certFile, "", nil)
+	require.NoError(t, err)
+	second, err := loadPACCert(certFile, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.Certificate, second.Certificate)
+}
+
+func TestLoadPACCertKeyWithoutCert(t *testing.T) {
+	_, err := loadPACCert("", "pac.key", nil)
+	assert.Error(t, err)
+}
+
+func TestPACOverHTTPS(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 3128})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY proxy:8080"; }`))
+	mux := http.NewServeMux()
+	pw.SetupHandlers(mux)
+	server := httptest.NewUnstartedServer(pacOnly(mux))
+	cert, err := loadPACCert("", "", nil)
+	require.NoError(t, err)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	status, body := getBody(t, client, server.URL+"/alpaca.pac")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "PROXY localhost:3128")
+	// Nothing else is served over HTTPS.
+	status, _ = getBody(t, client, server.URL+"/alpaca/capture.har")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestPACOnlyUsesProxyPort(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 3128})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY proxy:8080"; }`))
+	mux := http.NewServeMux()
+	pw.SetupHandlers(mux)
+	req := httptest.NewRequest(http.MethodGet, "/alpaca.pac", nil)
+	// Clients on other machines are pointed at the proxy's port, not the HTTPS one.
+	req.Host = "alpaca.example.com:3443"
+	w := httptest.NewRecorder()
+	pacOnly(mux).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "PROXY alpaca.example.com:3128")
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// pacTraces is the log of sampled PAC evaluations for PACRunners created by a ProxyFinder (see the
+// -debug-pac-trace flag), or nil if they aren't being traced.
+var pacTraces *pacTraceLog
+
+// maxPACTraces is the number of PAC evaluations that a pacTraceLog keeps.
+const maxPACTraces = 500
+
+// pacTraceLog keeps the most recent of a random sample of PAC evaluations, so that when some site
+// is slow to load, the debug server's /debug/pac-traces endpoint can show which parts of the PAC
+// script are slow for it. A JavaScript interpreter can't easily say which branches of the script
+// were taken, so each trace lists the calls that the script made to the PAC functions (such as
+// dnsResolve() or isInNet()), which are what decide the branches, and are usually what's slow.
+type pacTraceLog struct {
+	rate   float64 // The fraction of evaluations to trace
+	random func() float64
+	traces []pacTrace // Oldest first
+	mux    sync.Mutex
+}
+
+type pacTrace struct {
+	Time     string    `json:"time"`
+	URL      string    `json:"url"`
+	Host     string    `json:"host"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	Duration string    `json:"duration"`
+	Calls    []pacCall `json:"calls"`
+	duration time.Duration
+}
+
+// pacCall is a call from the PAC script to one of the PAC functions.
+type pacCall struct {
+	Function string   `json:"function"`
+	Args     []string `json:"args"`
+	Result   string   `json:"result"`
+	Duration string   `json:"duration"`
+}
+
+func newPACTraceLog(rate float64) *pacTraceLog {
+	return &pacTraceLog{rate: rate, random: rand.Float64}
+}
+
+// sample returns a new trace for an evaluation of FindProxyForURL, or nil if this evaluation
+// shouldn't be traced.
+func (tl *pacTraceLog) sample(u, host string) *pacTrace {
+	if tl == nil || tl.random() >= tl.rate {
+		return nil
+	}
+	return &pacTrace{
+		Time:  time.Now().Format(time.RFC3339Nano),
+		URL:   u,
+		Host:  host,
+		Calls: []pacCall{},
+	}
+}
+
+// add records a finished evaluation.
+func (tl *pacTraceLog) add(trace *pacTrace, result string, err error, d time.Duration) {
+	trace.Result = result
+	if err != nil {
+		trace.Error = err.Error()
+	}
+	trace.duration = d
+	trace.Duration = d.String()
+	tl.mux.Lock()
+	defer tl.mux.Unlock()
+	if len(tl.traces) >= maxPACTraces {
+		tl.traces = slices.Delete(tl.traces, 0, len(tl.traces)-maxPACTraces+1)
+	}
+	tl.traces = append(tl.traces, *trace)
+}
+
+// query returns the traces (newest first) for the given host and its subdomains (or for every
+// host, if it's empty) that took at least minDuration, up to limit of them (or all of them, if
+// limit is zero).
+func (tl *pacTraceLog) query(host string, minDuration time.Duration, limit int) []pacTrace {
+	host = canonicalHost(host)
+	tl.mux.Lock()
+	defer tl.mux.Unlock()
+	traces := []pacTrace{}
+	for i := len(tl.traces) - 1; i >= 0 && (limit <= 0 || len(traces) < limit); i-- {
+		trace := tl.traces[i]
+		if host != "" && trace.Host != host && !strings.HasSuffix(trace.Host, "."+host) {
+			continue
+		} else if trace.duration < minDuration {
+			continue
+		}
+		traces = append(traces, trace)
+	}
+	return traces
+}
+
+// ServeHTTP serves /debug/pac-traces, which takes optional "host", "min" (a duration, e.g.
+// "100ms") and "limit" parameters.
+func (tl *pacTraceLog) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if tl == nil {
+		writeJSONError(w, http.StatusNotFound,
+			"PAC evaluations aren't being traced (see the -debug-pac-trace flag)")
+		return
+	}
+	query := req.URL.Query()
+	var minDuration time.Duration
+	if s := query.Get("min"); s != "" {
+		var err error
+		if minDuration, err = time.ParseDuration(s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid min: "+err.Error())
+			return
+		}
+	}
+	var limit int
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit: "+err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, tl.query(query.Get("host"), minDuration, limit))
+}
+
+// pacTraceHook lets the PAC functions of a PACRunner's VM record calls to them in the trace of the
+// current evaluation. It's only used while holding the PACRunner's lock.
+type pacTraceHook struct {
+	trace *pacTrace
+}
+
+// wrap returns a PAC function that records calls to handler in the current trace, if there is
+// one.
+func (hook *pacTraceHook) wrap(name string,
+	handler func(otto.FunctionCall) otto.Value) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		if hook.trace == nil {
+			return handler(call)
+		}
+		start := time.Now()
+		result := handler(call)
+		args := make([]string, len(call.ArgumentList))
+		for i, arg := range call.ArgumentList {
+			args[i] = arg.String()
+		}
+		hook.trace.Calls = append(hook.trace.Calls, pacCall{
+			Function: name,
+			Args:     args,
+			Result:   result.String(),
+			Duration: time.Since(start).String(),
+		})
+		return result
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPACTrace(t *testing.T) {
+	pr := PACRunner{traces: newPACTraceLog(1)}
+	pacjs := []byte(`function FindProxyForURL(url, host) {
+		if (isPlainHostName(host) || dnsDomainIs(host, ".internal.test")) { return "DIRECT" }
+		if (isInNet(host, "10.0.0.0", "255.0.0.0")) { return "DIRECT" }
+		return "PROXY proxy.test:8080";
+	}`)
+	require.NoError(t, pr.Update(pacjs))
+	proxy, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "app.internal.test"})
+	require.NoError(t, err)
+	assert.Equal(t, "DIRECT", proxy)
+	proxy, err = pr.FindProxyForURL(url.URL{Scheme: "http", Host: "10.1.2.3", Path: "/x"})
+	require.NoError(t, err)
+	assert.Equal(t, "DIRECT", proxy)
+
+	traces := pr.traces.query("", 0, 0)
+	require.Len(t, traces, 2)
+	assert.Equal(t, "http://10.1.2.3/x", traces[0].URL)
+	assert.Equal(t, "DIRECT", traces[0].Result)
+	var calls []string
+	for _, call := range traces[0].Calls {
+		calls = append(calls, fmt.Sprintf("%s%q=%s", call.Function, call.Args, call.Result))
+	}
+	assert.Equal(t, []string{
+		`isPlainHostName["10.1.2.3"]=false`,
+		`dnsDomainIs["10.1.2.3" ".internal.test"]=false`,
+		`isInNet["10.1.2.3" "10.0.0.0" "255.0.0.0"]=true`,
+	}, calls)
+	assert.Equal(t, "app.internal.test", traces[1].Host)
+	assert.Len(t, traces[1].Calls, 2)
+}
+
+func TestPACTraceSampling(t *testing.T) {
+	tl := newPACTraceLog(0.25)
+	samples := []float64{0.1, 0.5, 0.3, 0.2}
+	tl.random = func() float64 {
+		r := samples[0]
+		samples = samples[1:]
+		return r
+	}
+	var sampled []bool
+	for range 4 {
+		sampled = append(sampled, tl.sample("http://example.com/", "example.com") != nil)
+	}
+	assert.Equal(t, []bool{true, false, false, true}, sampled)
+	assert.Nil(t, (*pacTraceLog)(nil).sample("http://example.com/", "example.com"))
+}
+
+func TestPACTraceQuery(t *testing.T) {
+	tl := newPACTraceLog(1)
+	for i := 0; i < maxPACTraces+10; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		trace := tl.sample("https://"+host+"/", host)
+		tl.add(trace, "DIRECT", nil, time.Duration(i)*time.Millisecond)
+	}
+	assert.Len(t, tl.query("", 0, 0), maxPACTraces)
+	assert.Empty(t, tl.query("host5.example.com", 0, 0), "the oldest traces should be dropped")
+	traces := tl.query("example.com", 500*time.Millisecond, 3)
+	require.Len(t, traces, 3)
+	assert.Equal(t, "host509.example.com", traces[0].Host)
+	assert.Equal(t, "509ms", traces[0].Duration)
+	assert.Equal(t, "host507.example.com", traces[2].Host)
+	assert.Empty(t, tl.query("ample.com", 0, 0))
+}
+
+func TestPACTraceEndpoint(t *testing.T) {
+	tl := newPACTraceLog(1)
+	trace := tl.sample("https://slow.test/", "slow.test")
+	tl.add(trace, "PROXY proxy.test:8080", nil, time.Second)
+	server := httptest.NewServer(tl)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/debug/pac-traces?host=slow.test&min=100ms")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var traces []pacTrace
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&traces))
+	require.Len(t, traces, 1)
+	assert.Equal(t, "PROXY proxy.test:8080", traces[0].Result)
+	assert.Equal(t, "1s", traces[0].Duration)
+
+	resp, err = http.Get(server.URL + "/debug/pac-traces?min=soon")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	disabled := httptest.NewServer((*pacTraceLog)(nil))
+	defer disabled.Close()
+	resp, err = http.Get(disabled.URL + "/debug/pac-traces")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// PACData contains program configuration to be made available to the pacWrapTmpl.
+type PACData struct {
+	Port     int
+	Bypass   []string // Host patterns (as used by shExpMatch) that should always go DIRECT
+	Failover []string // Other Alpaca instances (host:port) to use if this one is unavailable
+}
+
+type pacData struct {
+	PACData
+	UpstreamPAC string
+	Host        string // The address of this instance, as seen by the client
+}
+
+type PACWrapper struct {
+	data      pacData
+	tmpl      *template.Template
+	alpacaPAC string
+	mux       sync.Mutex
+}
+
+// PACWrapper template for serving a PAC file to point at alpaca or DIRECT. If we have a valid
+// PAC file, we wrap that PAC file with a wrapper function that only returns "DIRECT" or
+// "localhost:port" (followed by any failover instances). If we do not have a PAC file, the PAC
+// function we serve only returns "DIRECT", which should prevent all requests reaching us.
+var pacWrapTmpl = `// Wrapped for and by alpaca
+function FindProxyForURL(url, host) {
+{{- range .Bypass }}
+  if (shExpMatch(host, {{ json . }})) return "DIRECT";
+{{- end }}
+{{ if .UpstreamPAC }}
+  return FindProxyForURL(url, host) === "DIRECT" ? "DIRECT" : "PROXY {{.Host}}
+{{- range .Failover }}; PROXY {{.}}{{ end }}";
+{{.UpstreamPAC}}
+{{ else }}
+  return "DIRECT";
+{{ end }}
+}
+`
+
+func NewPACWrapper(data PACData) *PACWrapper {
+	funcs := template.FuncMap{"json": func(s string) (string, error) {
+		b, err := json.Marshal(s)
+		return string(b), err
+	}}
+	t := template.Must(template.New("alpaca").Funcs(funcs).Parse(pacWrapTmpl))
+	host := net.JoinHostPort("localhost", strconv.Itoa(data.Port))
+	return &PACWrapper{data: pacData{data, "", host}, tmpl: t}
+}
+
+func (pw *PACWrapper) Wrap(pacjs []byte) {
+	pw.mux.Lock()
+	defer pw.mux.Unlock()
+	pac := string(pacjs)
+	if pac == pw.data.UpstreamPAC && pw.alpacaPAC != "" {
+		return
+	}
+	pw.data.UpstreamPAC = pac
+	alpacaPAC, err := pw.execute(pw.data)
+	if err != nil {
+		return
+	}
+	pw.alpacaPAC = alpacaPAC
+}
+
+func (pw *PACWrapper) execute(data pacData) (string, error) {
+	b := &bytes.Buffer{}
+	if err := pw.tmpl.Execute(b, data); err != nil {
+		log.Printf("error executing PAC wrap template: %v", err)
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// pacFor returns the wrapped PAC for a client that fetched it from the given host (i.e. the Host
+// header of the request), so that clients on other machines are pointed at an address that they
+// can reach, rather than localhost.
+func (pw *PACWrapper) pacFor(host string) string {
+	pw.mux.Lock()
+	defer pw.mux.Unlock()
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = strings.Trim(host, "[]")
+		host = net.JoinHostPort(hostname, strconv.Itoa(pw.data.Port))
+	}
+	if ip := net.ParseIP(hostname); hostname == "" || hostname == "localhost" ||
+		(ip != nil && ip.IsLoopback()) {
+		return pw.alpacaPAC
+	}
+	data := pw.data
+	data.Host = host
+	alpacaPAC, err := pw.execute(data)
+	if err != nil {
+		return pw.alpacaPAC
+	}
+	return alpacaPAC
+}
+
+// upstreamPAC returns the PAC script that's being wrapped.
+func (pw *PACWrapper) upstreamPAC() string {
+	pw.mux.Lock()
+	defer pw.mux.Unlock()
+	return pw.data.UpstreamPAC
+}
+
+func (pw *PACWrapper) SetupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/alpaca.pac", pw.handlePAC)
+}
+
+func (pw *PACWrapper) handlePAC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	if _, err := w.Write([]byte(pw.pacFor(req.Host))); err != nil {
+		log.Printf("Error writing PAC to response: %v", err)
+	}
+}
@@ -12,12 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package alpaca
 
 import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -59,3 +60,43 @@ func TestPACServe(t *testing.T) {
 	assert.Contains(t, body, `"DIRECT" : "PROXY localhost:1234"`)
 	resp.Body.Close()
 }
+
+func TestWrapPACWithBypassAndFailover(t *testing.T) {
+	pw := NewPACWrapper(PACData{
+		Port:     1234,
+		Bypass:   []string{"*.internal.test", "printer"},
+		Failover: []string{"alpaca2.test:3128"},
+	})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY proxy.test:8080" }`))
+	var pr PACRunner
+	require.NoError(t, pr.Update([]byte(pw.alpacaPAC)))
+	for _, test := range []struct {
+		host, expected string
+	}{
+		{"www.internal.test", "DIRECT"},
+		{"printer", "DIRECT"},
+		{"www.example.test", "PROXY localhost:1234; PROXY alpaca2.test:3128"},
+	} {
+		proxy, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: test.host})
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, proxy, test.host)
+	}
+}
+
+func TestWrapPACPerClient(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1234})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY proxy.test:8080" }`))
+	for _, test := range []struct {
+		host, expected string
+	}{
+		{"", `"PROXY localhost:1234"`},
+		{"localhost:1234", `"PROXY localhost:1234"`},
+		{"127.0.0.1:1234", `"PROXY localhost:1234"`},
+		{"[::1]:1234", `"PROXY localhost:1234"`},
+		{"192.0.2.1:1234", `"PROXY 192.0.2.1:1234"`},
+		{"alpaca.test", `"PROXY alpaca.test:1234"`},
+		{"[2001:db8::1]", `"PROXY [2001:db8::1]:1234"`},
+	} {
+		assert.Contains(t, pw.pacFor(test.host), test.expected, test.host)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parallelDownloads splits large plain HTTP downloads into range requests, which are sent in
+// parallel over separate upstream connections and reassembled in order. Some corporate proxies
+// throttle each connection, so this can make large downloads a lot faster.
+//
+// The first range is requested in place of the original request, so downloads that fit in one
+// range (or servers that don't support ranges) only cost a single request. Later ranges are sent
+// with an If-Range header, so that they fail rather than mixing two versions of the file.
+type parallelDownloads struct {
+	conns     int   // Maximum number of range requests in flight for each download
+	chunkSize int64 // Size of each range request
+}
+
+// fetchFunc sends a request upstream (see ProxyHandler.fetch).
+type fetchFunc func(*http.Request) (*http.Response, error)
+
+// canSplit reports whether a request is a download that could be split into range requests.
+// Downloads aren't split while memory is short (see memoryPressure), since the ranges are held in
+// memory.
+func (pd *parallelDownloads) canSplit(req *http.Request, bodyLen int) bool {
+	return !memoryPressure.Load() && req.Method == http.MethodGet && req.URL.Scheme == "http" &&
+		bodyLen == 0 && req.Header.Get("Range") == "" && req.Header.Get("If-Range") == ""
+}
+
+func (pd *parallelDownloads) rangeHeader(start, end int64) string {
+	return fmt.Sprintf("bytes=%d-%d", start, end)
+}
+
+// serve handles the response to the first range of a download. If it serves the whole download
+// itself, it returns a nil response. Otherwise, it returns the response that the caller should
+// forward: either resp (if the server didn't send a range), or the response to a new request
+// for the whole download.
+func (pd *parallelDownloads) serve(w http.ResponseWriter, req *http.Request,
+	resp *http.Response, fetch fetchFunc) (*http.Response, error) {
+	id := req.Context().Value(contextKeyID)
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// This happens for empty files.
+		resp.Body.Close()
+		return pd.fetchWhole(req, fetch)
+	} else if resp.StatusCode != http.StatusPartialContent {
+		return resp, nil
+	}
+	start, end, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	validator := rangeValidator(resp.Header)
+	if !ok || start != 0 || (end+1 < total && validator == "") {
+		// Without a validator, there's no way to make sure that the other ranges come from
+		// the same version of the file.
+		resp.Body.Close()
+		return pd.fetchWhole(req, fetch)
+	}
+	defer resp.Body.Close()
+	copyResponseHeaders(w, resp)
+	w.Header().Del("Content-Range")
+	w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+	w.WriteHeader(http.StatusOK)
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	var ranges []chan rangeResult
+	if end+1 < total {
+		log.Printf("[%d] Splitting %d byte download into ranges of %d bytes",
+			id, total, pd.chunkSize)
+		ranges = pd.fetchRanges(ctx, req, end+1, total, validator, fetch)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("[%d] Error copying response body: %v", id, err)
+		return nil, nil
+	}
+	for _, ch := range ranges {
+		var result rangeResult
+		select {
+		case result = <-ch:
+		case <-ctx.Done():
+			return nil, nil
+		}
+		if result.err != nil {
+			// The status has already been sent, so all we can do is cut the response short.
+			log.Printf("[%d] Error fetching range: %v", id, result.err)
+			return nil, nil
+		} else if _, err := w.Write(result.data); err != nil {
+			log.Printf("[%d] Error copying response body: %v", id, err)
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+// fetchWhole requests the whole download, after all.
+func (pd *parallelDownloads) fetchWhole(req *http.Request, fetch fetchFunc) (*http.Response,
+	error) {
+	req = req.Clone(req.Context())
+	req.Header.Del("Range")
+	req.Body = http.NoBody
+	return fetch(req)
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+// fetchRanges requests the bytes from start up to total, in chunks of pd.chunkSize. It returns a
+// channel for each chunk, in order, which the chunk is sent on when it's been downloaded. At most
+// pd.conns chunks are downloaded (and held in memory) at once; the next one isn't requested until
+// the caller has received an earlier one.
+func (pd *parallelDownloads) fetchRanges(ctx context.Context, req *http.Request, start, total int64,
+	validator string, fetch fetchFunc) []chan rangeResult {
+	var chunks [][2]int64
+	for ; start < total; start += pd.chunkSize {
+		chunks = append(chunks, [2]int64{start, min(start+pd.chunkSize, total) - 1})
+	}
+	results := make([]chan rangeResult, len(chunks))
+	for i := range results {
+		results[i] = make(chan rangeResult)
+	}
+	sem := make(chan struct{}, pd.conns)
+	go func() {
+		for i, chunk := range chunks {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(ch chan rangeResult, start, end int64) {
+				// Hold on to the slot until the caller has received the chunk.
+				defer func() { <-sem }()
+				data, err := pd.fetchRange(ctx, req, start, end, validator, fetch)
+				select {
+				case ch <- rangeResult{data, err}:
+				case <-ctx.Done():
+				}
+			}(results[i], chunk[0], chunk[1])
+		}
+	}()
+	return results
+}
+
+func (pd *parallelDownloads) fetchRange(ctx context.Context, req *http.Request, start, end int64,
+	validator string, fetch fetchFunc) ([]byte, error) {
+	req = req.Clone(ctx)
+	req.Body = http.NoBody
+	req.Header.Set("Range", pd.rangeHeader(start, end))
+	req.Header.Set("If-Range", validator)
+	resp, err := fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("got %q response for range %d-%d", resp.Status, start, end)
+	}
+	s, e, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || s != start || e != end {
+		return nil, fmt.Errorf("got range %q, expected %d-%d",
+			resp.Header.Get("Content-Range"), start, end)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, end-start+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) != end-start+1 {
+		return nil, fmt.Errorf("got %d bytes for range %d-%d", len(data), start, end)
+	}
+	return data, nil
+}
+
+// parseContentRange parses a Content-Range header such as "bytes 0-499/1234". The total length
+// must be known.
+func parseContentRange(value string) (start, end, total int64, ok bool) {
+	value, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rng, size, found := strings.Cut(value, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	first, last, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err1, err2, err3 error
+	start, err1 = strconv.ParseInt(first, 10, 64)
+	end, err2 = strconv.ParseInt(last, 10, 64)
+	total, err3 = strconv.ParseInt(size, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || start > end || end >= total {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
+
+// rangeValidator returns the value to use in an If-Range header for ranges of the same
+// response: its ETag if that's a strong one, or else its Last-Modified date.
+func rangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// fetch sends a request (without a body) upstream, authenticating if the proxy asks for it.
+func (ph ProxyHandler) fetch(req *http.Request) (*http.Response, error) {
+	resp, err := ph.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || !authEnabled(ph.auth) {
+		return resp, err
+	}
+	resp.Body.Close()
+	proxy, _ := ph.transport.Proxy(req)
+	ph.schemes.remember(proxy, resp.Header)
+	return ph.auth.do(req, ph.transport)
+}
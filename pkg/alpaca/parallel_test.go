@@ -0,0 +1,140 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rangeServer serves content (supporting range requests), and records the Range header of each
+// request that it gets.
+type rangeServer struct {
+	content []byte
+	etag    string
+	ranges  []string
+	mux     sync.Mutex
+}
+
+func (rs *rangeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rs.mux.Lock()
+	rs.ranges = append(rs.ranges, req.Header.Get("Range"))
+	etag := rs.etag
+	rs.mux.Unlock()
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(rs.content))
+}
+
+func newParallelProxy(t *testing.T, conns int, chunkSize int64) *http.Client {
+	ph := newDirectProxy()
+	ph.parallel = &parallelDownloads{conns: conns, chunkSize: chunkSize}
+	proxy := httptest.NewServer(ph)
+	t.Cleanup(proxy.Close)
+	return &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+}
+
+func TestParallelDownload(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	rs := &rangeServer{content: content, etag: `"v1"`}
+	server := httptest.NewServer(rs)
+	defer server.Close()
+	client := newParallelProxy(t, 3, 1024)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(content)), resp.ContentLength)
+	assert.Empty(t, resp.Header.Get("Content-Range"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content, body)
+	assert.Len(t, rs.ranges, 10)
+	assert.Contains(t, rs.ranges, "bytes=0-1023")
+	assert.Contains(t, rs.ranges, "bytes=9216-9999")
+}
+
+func TestParallelDownloadSmallFile(t *testing.T) {
+	for _, content := range []string{"", "small"} {
+		rs := &rangeServer{content: []byte(content), etag: `"v1"`}
+		server := httptest.NewServer(rs)
+		defer server.Close()
+		client := newParallelProxy(t, 3, 1024)
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	}
+}
+
+func TestParallelDownloadWithoutValidator(t *testing.T) {
+	// Without an ETag or Last-Modified date, the ranges might come from different versions of
+	// the file, so it's downloaded in one go instead.
+	content := []byte(strings.Repeat("x", 4096))
+	rs := &rangeServer{content: content}
+	server := httptest.NewServer(rs)
+	defer server.Close()
+	client := newParallelProxy(t, 3, 1024)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content, body)
+	assert.Equal(t, []string{"bytes=0-1023", ""}, rs.ranges)
+}
+
+func TestParallelDownloadClientRange(t *testing.T) {
+	// Requests for a range are passed through unchanged.
+	rs := &rangeServer{content: []byte("0123456789"), etag: `"v1"`}
+	server := httptest.NewServer(rs)
+	defer server.Close()
+	client := newParallelProxy(t, 3, 4)
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=2-5")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "2345", string(body))
+	assert.Equal(t, []string{"bytes=2-5"}, rs.ranges)
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, end, total, ok := parseContentRange("bytes 0-499/1234")
+	require.True(t, ok)
+	assert.Equal(t, []int64{0, 499, 1234}, []int64{start, end, total})
+	for _, value := range []string{"", "bytes 0-499/*", "bytes */1234", "bytes 5-4/10",
+		"bytes 0-10/10", "items 0-1/2"} {
+		_, _, _, ok := parseContentRange(value)
+		assert.False(t, ok, value)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processName finds the process that owns the client end of a connection to Alpaca, using lsof.
+// lsof lists both ends of the connection, so Alpaca's own process is skipped. The client's address
+// is enough to pick out the connection, so serverAddr isn't used.
+func processName(clientAddr, serverAddr string) string {
+	out, err := exec.Command("lsof", "-n", "-P", "-F", "pc", "-iTCP@"+clientAddr).Output()
+	if err != nil {
+		return ""
+	}
+	return parseLsofProcess(string(out), os.Getpid())
+}
+
+// parseLsofProcess returns the first command name in the output of "lsof -F pc" that doesn't
+// belong to the given process ID. The output has a line for each process ID (prefixed with "p"),
+// followed by a line for its command name (prefixed with "c").
+func parseLsofProcess(out string, self int) string {
+	var skip bool
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "p") {
+			skip = line[1:] == strconv.Itoa(self)
+		} else if strings.HasPrefix(line, "c") && !skip {
+			return line[1:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,28 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLsofProcess(t *testing.T) {
+	out := "p100\ncalpaca\np200\ncgit\n"
+	assert.Equal(t, "git", parseLsofProcess(out, 100))
+	assert.Equal(t, "alpaca", parseLsofProcess(out, 200))
+	assert.Equal(t, "", parseLsofProcess("p100\ncalpaca\n", 100))
+}
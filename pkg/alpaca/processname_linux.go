@@ -0,0 +1,113 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// processName finds the process that owns the client end of a connection to Alpaca, by looking up
+// the socket's inode in /proc/net/tcp (or tcp6), and then finding a process with that socket open.
+// This only works for processes run by the same user as Alpaca (or if Alpaca is run as root).
+// serverAddr is Alpaca's end of the connection, which is checked too (if it's not empty) so that a
+// different connection from the same client port can't be mistaken for this one.
+func processName(clientAddr, serverAddr string) string {
+	local, err := net.ResolveTCPAddr("tcp", clientAddr)
+	if err != nil {
+		return ""
+	}
+	var remote *net.TCPAddr
+	if serverAddr != "" {
+		if remote, err = net.ResolveTCPAddr("tcp", serverAddr); err != nil {
+			return ""
+		}
+	}
+	inode := socketInode("/proc/net/tcp", local, remote)
+	if inode == "" {
+		inode = socketInode("/proc/net/tcp6", local, remote)
+	}
+	if inode == "" {
+		return ""
+	}
+	target := "socket:[" + inode + "]"
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err != nil || link != target {
+			continue
+		}
+		pid := strings.Split(fd, "/")[2]
+		if pid == strconv.Itoa(os.Getpid()) {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", pid, "comm"))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(comm))
+	}
+	return ""
+}
+
+// socketInode returns the inode of the socket whose local address is local and (if it's not nil)
+// whose remote address is remote, from a file in the format of /proc/net/tcp. Sockets with an
+// inode of 0 (e.g. ones in TIME_WAIT, which no process has open any more) are skipped.
+func socketInode(path string, local, remote *net.TCPAddr) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	wantLocal := procNetAddr(local)
+	var wantRemote string
+	if remote != nil {
+		wantRemote = procNetAddr(remote)
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The fields are: sl, local_address, rem_address, st, tx_queue:rx_queue, tr:tm->when,
+		// retrnsmt, uid, timeout, inode, ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[1] != wantLocal || fields[9] == "0" {
+			continue
+		} else if remote == nil || fields[2] == wantRemote {
+			return fields[9]
+		}
+	}
+	return ""
+}
+
+// procNetAddr formats an address like the kernel does in /proc/net/tcp: the IP address as
+// host-endian 32-bit words in hex, and then the port in hex.
+func procNetAddr(addr *net.TCPAddr) string {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	var sb strings.Builder
+	for i := 0; i+4 <= len(ip); i += 4 {
+		word := make([]byte, 4)
+		binary.NativeEndian.PutUint32(word, binary.BigEndian.Uint32(ip[i:i+4]))
+		sb.WriteString(strings.ToUpper(hex.EncodeToString(word)))
+	}
+	return fmt.Sprintf("%s:%04X", sb.String(), addr.Port)
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcNetAddr(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	// This assumes a little-endian machine, which is what Linux almost always runs on.
+	assert.Equal(t, "0100007F:1F90", procNetAddr(addr))
+}
+
+func TestSocketInode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcp")
+	// The first socket is in TIME_WAIT, and the second is connected to a different server.
+	table := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt ...
+   0: 0100007F:D431 0100007F:0C38 06 00000000:00000000 03:00000ec4 00000000     0        0 0 3 0
+   1: 0100007F:D431 0100007F:0050 01 00000000:00000000 00:00000000 00000000  1000        0 1111 1 0
+   2: 0100007F:D431 0100007F:0C38 01 00000000:00000000 00:00000000 00000000  1000        0 2222 1 0
+`
+	require.NoError(t, os.WriteFile(path, []byte(table), 0o600))
+	client := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 54321}
+	server := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3128}
+	assert.Equal(t, "2222", socketInode(path, client, server))
+	assert.Equal(t, "1111", socketInode(path, client, nil))
+	assert.Equal(t, "", socketInode(path, server, client))
+}
+
+func TestProcessName(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	// Connect from a child process (running TestHelperDialer), since our own process is skipped.
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperDialer")
+	cmd.Env = []string{"ALPACA_WANT_HELPER_DIALER=1", "ALPACA_DIAL=" + l.Addr().String()}
+	require.NoError(t, cmd.Start())
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	comm, err := os.ReadFile("/proc/self/comm")
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(string(comm)),
+		processName(conn.RemoteAddr().String(), conn.LocalAddr().String()))
+	assert.Equal(t, strings.TrimSpace(string(comm)), processName(conn.RemoteAddr().String(), ""))
+	assert.Equal(t, "", processName(conn.RemoteAddr().String(), "127.0.0.1:1"))
+	assert.Equal(t, "", processName("127.0.0.1:1", ""))
+}
+
+func TestHelperDialer(t *testing.T) {
+	if os.Getenv("ALPACA_WANT_HELPER_DIALER") != "1" {
+		return
+	}
+	conn, err := net.Dial("tcp", os.Getenv("ALPACA_DIAL"))
+	if err != nil {
+		os.Exit(1)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Second)
+}
@@ -0,0 +1,706 @@
+// Copyright 2019, 2021, 2022, 2023, 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var tlsClientConfig *tls.Config
+
+type ProxyHandler struct {
+	transport *http.Transport
+	auth      proxyAuth
+	block     func(string)
+	tunnels   *tunnelTracker
+	parallel  *parallelDownloads // If set, large downloads are split into range requests
+	via       string             // Identifies this handler in Via headers (see loop.go)
+	// The largest request body that's read into memory before the request is sent upstream.
+	// Bigger bodies (and ones whose size isn't known in advance) are streamed, and only this
+	// much of them is kept in case the request has to be sent again.
+	maxBufferedBody int64
+	// If the PAC file returned a proxy to fall back to, how long to wait for a direct
+	// connection before using it (0 to wait as long as the OS does).
+	directTimeout time.Duration
+	// If set, another instance of Alpaca that requests are sent to (see -upstream-alpaca).
+	upstreamAlpaca *url.URL
+	// Used for all outgoing connections, to proxies and servers (see setDialer).
+	dial dialFunc
+	// The auth schemes offered by upstream proxies, and the ones chosen for them.
+	schemes *authSchemeCache
+	// How long upstream proxies (and servers) take to respond, for the dashboard.
+	latencies *latencyStats
+}
+
+type proxyFunc func(*http.Request) (*url.URL, error)
+
+func NewProxyHandler(auth proxyAuth, proxy proxyFunc, block func(string)) ProxyHandler {
+	tr := &http.Transport{
+		Proxy:           proxy,
+		TLSClientConfig: tlsClientConfig,
+		DialContext:     dialNAT64,
+		// Send streamed request bodies anyway, if the upstream ignores "Expect: 100-continue".
+		ExpectContinueTimeout: time.Second,
+	}
+	return ProxyHandler{
+		transport:       tr,
+		auth:            auth,
+		block:           block,
+		tunnels:         newTunnelTracker(),
+		via:             newViaPseudonym(),
+		maxBufferedBody: defaultMaxBufferedBody,
+		dial:            dialNAT64,
+		schemes:         newAuthSchemeCache(),
+		latencies:       newLatencyStats(),
+	}
+}
+
+// setDialer makes the handler use dial for its outgoing connections, instead of dialNAT64. Since
+// ProxyHandler is used by value, this has to be called before its transport is used, and before
+// setMaxConnLifetime.
+func (ph *ProxyHandler) setDialer(dial dialFunc) {
+	ph.dial = dial
+	ph.transport.DialContext = dial
+}
+
+// setMaxConnLifetime stops pooled connections to upstream proxies (and servers) from being used
+// for new requests once they're older than lifetime.
+func (ph ProxyHandler) setMaxConnLifetime(lifetime time.Duration) {
+	if lifetime > 0 {
+		ph.transport.DialContext = expiringDialer(ph.dial, lifetime)
+	}
+}
+
+// setIdleConns sets how many idle connections are kept open to each upstream proxy (or server).
+// Go's default is only two, and once a connection that has been authenticated with NTLM or
+// Negotiate is closed, the next one needs a new handshake, so Alpaca keeps more of them.
+func (ph ProxyHandler) setIdleConns(n int) {
+	if n > 0 {
+		ph.transport.MaxIdleConnsPerHost = n
+	}
+}
+
+func (ph ProxyHandler) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Pass CONNECT requests and absolute-form URIs to the ProxyHandler.
+		// If the request URL has a scheme, it is an absolute-form URI
+		// (RFC 7230 Section 5.3.2).
+		if req.Method == http.MethodConnect || req.URL.Scheme != "" {
+			ph.ServeHTTP(w, req)
+			return
+		}
+		// The request URI is an origin-form or asterisk-form target which we
+		// handle as an origin server (RFC 7230 5.3). authority-form URIs
+		// are only for CONNECT, which has already been dispatched to the
+		// ProxyHandler.
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (ph ProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyAuthSchemes, ph.schemes))
+	if client := req.Header.Get(socksClientHeader); client != "" {
+		id := req.Context().Value(contextKeyID)
+		log.Printf("[%d] %s %s is for SOCKS client %s", id, req.Method, logHost(req.Host), client)
+	}
+	if client := req.Header.Get(transparentClientHeader); client != "" {
+		id := req.Context().Value(contextKeyID)
+		log.Printf("[%d] %s %s is for intercepted client %s", id, req.Method, logHost(req.Host),
+			client)
+	}
+	if ref := req.Header.Get(alpacaRequestIDHeader); ref != "" {
+		// This is the upstream instance for another one, which wants to know what this
+		// request is called in this instance's logs.
+		id := req.Context().Value(contextKeyID)
+		log.Printf("[%d] %s %s is for Alpaca request %s", id, req.Method, logHost(req.Host), ref)
+		w.Header().Set(alpacaRequestIDHeader, requestRef(id))
+	}
+	if isLoop(req, ph.via) {
+		id := req.Context().Value(contextKeyID)
+		log.Printf("[%d] %s %s has come back to Alpaca: %v", id, req.Method, logHost(req.Host),
+			ErrProxyLoop)
+		writeProxyError(w, req, http.StatusLoopDetected, stageConnect, nil, ErrProxyLoop)
+		return
+	}
+	upgrade := upgradeType(req.Header)
+	deleteRequestHeaders(req)
+	if req.Method != http.MethodConnect {
+		headerRewrites.rewriteRequest(req)
+	}
+	if proxy, _ := ph.transport.Proxy(req); proxy != nil {
+		addVia(req, ph.via)
+		if ph.upstreamAlpaca != nil && proxy.Host == ph.upstreamAlpaca.Host {
+			req.Header.Set(alpacaRequestIDHeader, requestRef(req.Context().Value(contextKeyID)))
+		}
+	}
+	if req.Method == http.MethodConnect {
+		ph.handleConnect(w, req)
+	} else if upgrade != "" {
+		ph.proxyUpgrade(w, req, upgrade)
+	} else {
+		ph.proxyRequest(w, req, ph.auth)
+	}
+}
+
+func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
+	// Establish a connection to the server, or an upstream proxy.
+	id := req.Context().Value(contextKeyID)
+	proxy, err := ph.transport.Proxy(req)
+	if err != nil {
+		log.Printf("[%d] Error finding proxy for request: %v", id, err)
+	}
+	// Nothing has been sent to the server if it (or the proxy) can't be reached, so the other
+	// proxies that the PAC file returned can be tried, whatever the client sends next.
+	fallbacks, _ := req.Context().Value(contextKeyFallbacks).([]*url.URL)
+	var server net.Conn
+	for retries := 0; ; retries++ {
+		canRetry := retries < maxFailoverRetries && retries < len(fallbacks)
+		if proxy == nil {
+			timeout := time.Duration(0)
+			if canRetry {
+				timeout = ph.directTimeout
+			}
+			server, err = ph.connectDirect(req, timeout)
+		} else {
+			server, err = ph.connectViaProxy(req, proxy)
+			var oe *net.OpError
+			if errors.As(err, &oe) && oe.Op == "proxyconnect" {
+				err = ph.blockProxy(req, proxy, err)
+			}
+		}
+		if err == nil || !canRetry || !failoverSafe(err) {
+			break
+		}
+		proxy = fallbacks[retries]
+		log.Printf("[%d] Retrying via %q (%v)", id, proxyString(proxy), err)
+	}
+	if errors.Is(err, ErrProxyLoop) {
+		writeProxyError(w, req, http.StatusLoopDetected, stageConnect, proxy, err)
+		return
+	} else if err != nil {
+		writeProxyError(w, req, http.StatusBadGateway, stageConnect, proxy, err)
+		return
+	}
+	closeInDefer := true
+	defer func() {
+		if closeInDefer {
+			server.Close()
+		}
+	}()
+	// Take over the connection back to the client by hijacking the ResponseWriter.
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("[%d] Error hijacking response writer", id)
+		err := errors.New("response writer doesn't support hijacking")
+		writeProxyError(w, req, http.StatusInternalServerError, stageConnect, proxy, err)
+		return
+	}
+	client, _, err := h.Hijack()
+	if err != nil {
+		log.Printf("[%d] Error hijacking connection: %v", id, err)
+		writeProxyError(w, req, http.StatusInternalServerError, stageConnect, proxy, err)
+		return
+	}
+	defer func() {
+		if closeInDefer {
+			client.Close()
+		}
+	}()
+	// Write the response directly to the client connection. If we use Go's ResponseWriter, it
+	// will automatically insert a Content-Length header, which is not allowed in a 2xx CONNECT
+	// response (see https://tools.ietf.org/html/rfc7231#section-4.3.6).
+	var resp []byte
+	if req.ProtoAtLeast(1, 1) {
+		resp = []byte("HTTP/1.1 200 Connection Established\r\n")
+	} else {
+		resp = []byte("HTTP/1.0 200 Connection Established\r\n")
+	}
+	if ref := w.Header().Get(alpacaRequestIDHeader); ref != "" {
+		resp = fmt.Appendf(resp, "%s: %s\r\n", alpacaRequestIDHeader, ref)
+	}
+	resp = append(resp, "\r\n"...)
+	if _, err := client.Write(resp); err != nil {
+		log.Printf("[%d] Error writing response: %v", id, err)
+		return
+	}
+	closeInDefer = false
+	s := startSpan(req.Context(), "tunnel", spanKindInternal)
+	ph.tunnels.relayThen(client, server, req.URL.Hostname(), s.endThen(claimConnSlot(req)),
+		throttleForRequest(req))
+}
+
+// connectDirect connects to the host in a CONNECT request, giving up after timeout (if it's set).
+func (ph ProxyHandler) connectDirect(req *http.Request, timeout time.Duration) (net.Conn, error) {
+	s := startSpan(req.Context(), "dial", spanKindClient)
+	s.setAttributes(otlpString("server.address", req.Host))
+	ctx := req.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	server, err := ph.dial(ctx, "tcp", req.Host)
+	if err == nil {
+		ph.latencies.recordConnect(nil, time.Since(start))
+	}
+	s.setError(err)
+	s.end()
+	if err != nil {
+		id := req.Context().Value(contextKeyID)
+		log.Printf("[%d] Error dialling host %s: %v", id, logHost(req.Host), err)
+	}
+	return server, err
+}
+
+func (ph ProxyHandler) connectViaProxy(req *http.Request, proxy *url.URL) (net.Conn, error) {
+	id := req.Context().Value(contextKeyID)
+	auth := ph.auth
+	tr := transport{dialContext: ph.dial}
+	defer tr.Close()
+	s := startSpan(req.Context(), "dial", spanKindClient)
+	s.setAttributes(otlpString("server.address", proxy.Host))
+	start := time.Now()
+	err := tr.dial(proxy)
+	s.setError(err)
+	s.end()
+	if err != nil {
+		log.Printf("[%d] Error dialling proxy %s: %v", id, proxy.Host, err)
+		return nil, err
+	}
+	ph.latencies.recordConnect(proxy, time.Since(start))
+	start = time.Now()
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		log.Printf("[%d] Error reading CONNECT response: %v", id, err)
+		return nil, err
+	}
+	ph.latencies.recordTTFB(proxy, time.Since(start))
+	logUpstreamRef(id, resp.Header)
+	if resp.StatusCode == http.StatusProxyAuthRequired && authEnabled(auth) {
+		log.Printf("[%d] Got %q response, retrying with auth", id, resp.Status)
+		resp.Body.Close()
+		ph.schemes.remember(proxy, resp.Header)
+		if err := tr.dial(proxy); err != nil {
+			log.Printf("[%d] Error re-dialling %s: %v", id, proxy.Host, err)
+			return nil, err
+		}
+		s := startSpan(req.Context(), "auth", spanKindClient)
+		resp, err = auth.do(req, &tr)
+		s.endResponse(resp, err)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[%d] Got %q response", id, resp.Status)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired && authEnabled(auth) {
+		publishAuthFailed(proxy)
+		return nil, fmt.Errorf("[%d] %w by %s", id, ErrAuthRejected, proxy.Host)
+	} else if resp.StatusCode == http.StatusLoopDetected {
+		return nil, fmt.Errorf("[%d] %w via %s", id, ErrProxyLoop, proxy.Host)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[%d] Unexpected response status: %s", id, resp.Status)
+	}
+	return tr.hijack(), nil
+}
+
+func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, auth proxyAuth) {
+	id := req.Context().Value(contextKeyID)
+	stream := streamRequestBody(req, ph.maxBufferedBody)
+	if stream {
+		// Send the body upstream as it arrives. Asking the upstream to confirm that it wants
+		// the body means that the client isn't told to send it (see net/http's handling of
+		// "Expect: 100-continue") until the upstream is ready, and that a response such as
+		// "407 Proxy Authentication Required" arrives before any of it has been sent, so that
+		// the request can still be sent again. Upstreams that ignore it usually respond
+		// before reading much of the body, which is why the start of it is kept.
+		body := &streamedBody{src: req.Body, limit: ph.maxBufferedBody}
+		req.Body = body
+		req.GetBody = body.get
+		req.Header.Set("Expect", "100-continue")
+	} else {
+		// Make a copy of the request body, in case we have to replay it (for authentication)
+		var buf bytes.Buffer
+		if n, err := io.Copy(&buf, req.Body); err != nil {
+			log.Printf("[%d] Error copying request body (got %d/%d): %v",
+				id, n, req.ContentLength, err)
+			writeProxyError(w, req, requestBodyErrorStatus(err), stageRequest, nil, err)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
+		// Allow the transport to retry the request on a new connection (e.g. if the one it
+		// tried to reuse has expired), and the request to be sent again with auth.
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+		}
+	}
+	split := !stream && ph.parallel != nil && ph.parallel.canSplit(req, int(req.ContentLength))
+	if split {
+		req.Header.Set("Range", ph.parallel.rangeHeader(0, ph.parallel.chunkSize-1))
+	}
+	req, resp, err := ph.roundTrip(req)
+	if err != nil {
+		stage := stageRequest
+		status := http.StatusBadGateway
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Op == "proxyconnect" {
+			stage = stageConnect
+		} else if stream {
+			// The error might have come from reading the body, rather than the upstream.
+			status = requestBodyErrorStatus(err)
+		}
+		proxy, _ := ph.transport.Proxy(req)
+		writeProxyError(w, req, status, stage, proxy, err)
+		return
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired && authEnabled(auth) {
+		log.Printf("[%d] Got %q response, retrying with auth", id, resp.Status)
+		body, err := req.GetBody()
+		if err != nil {
+			log.Printf("[%d] Can't send the request again: %v", id, err)
+		} else {
+			resp.Body.Close()
+			req.Body = body
+			proxy, _ := ph.transport.Proxy(req)
+			ph.schemes.remember(proxy, resp.Header)
+			s := startSpan(req.Context(), "auth", spanKindClient)
+			resp, err = auth.do(req, ph.transport)
+			s.endResponse(resp, err)
+			if err != nil {
+				log.Printf("[%d] Error forwarding request (with auth): %v", id, err)
+				proxy, _ := ph.transport.Proxy(req)
+				writeProxyError(w, req, http.StatusBadGateway, stageAuth, proxy, err)
+				return
+			} else if resp.StatusCode == http.StatusProxyAuthRequired {
+				publishAuthFailed(proxy)
+				if proxy != nil {
+					// Otherwise the 407 came from the server, not from a proxy.
+					reportError(req, fmt.Errorf("%w by %s", ErrAuthRejected, proxy.Host))
+				}
+			}
+		}
+		log.Printf("[%d] Got %q response", id, resp.Status)
+	}
+	if split {
+		if resp, err = ph.parallel.serve(w, req, resp, ph.fetch); err != nil {
+			log.Printf("[%d] Error forwarding request: %v", id, err)
+			proxy, _ := ph.transport.Proxy(req)
+			writeProxyError(w, req, http.StatusBadGateway, stageRequest, proxy, err)
+			return
+		} else if resp == nil {
+			return
+		}
+	}
+	defer resp.Body.Close()
+	logUpstreamRef(id, resp.Header)
+	copyResponseHeaders(w, resp)
+	if resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout {
+		// Let clients tell a failure reported by an upstream proxy from one of Alpaca's own
+		// (unless the upstream is another instance of Alpaca, which has already said).
+		proxy, _ := ph.transport.Proxy(req)
+		if proxy != nil && w.Header().Get(proxyErrorHeader) == "" {
+			w.Header().Set(proxyErrorHeader, "upstream_error")
+		}
+	}
+	// Announce the trailers that the response has declared (e.g. gRPC's grpc-status), so that
+	// they can be sent on after the body.
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
+	w.WriteHeader(resp.StatusCode)
+	var dst io.Writer = w
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc") {
+		// Streamed gRPC messages need to be passed on as they arrive.
+		dst = flushWriter{w, http.NewResponseController(w)}
+	}
+	_, err = io.Copy(dst, resp.Body)
+	if err != nil {
+		// The response status has already been sent, so if copying fails, we can't return
+		// an error status to the client.  Instead, log the error.
+		log.Printf("[%d] Error copying response body: %v", id, err)
+		return
+	}
+	// The values of the trailers are only known once the body has been read.
+	for k, vs := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = vs
+	}
+}
+
+// flushWriter flushes each write to a response straight away.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		_ = fw.rc.Flush()
+	}
+	return n, err
+}
+
+// The default for -max-buffered-body (see ProxyHandler.maxBufferedBody).
+const defaultMaxBufferedBody = 1 << 20
+
+// streamRequestBody returns whether the body of req should be streamed upstream, rather than read
+// into memory first (if it's no bigger than maxBuffered). This includes requests where the client
+// has sent "Expect: 100-continue", since it's waiting to hear whether the upstream wants the body.
+func streamRequestBody(req *http.Request, maxBuffered int64) bool {
+	if req.ContentLength == 0 {
+		return false
+	}
+	return req.ContentLength < 0 || req.ContentLength > maxBuffered ||
+		strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+// requestBodyErrorStatus returns the status to respond with when the request body couldn't be
+// read from the client (or, if it was being streamed, sent upstream).
+func requestBodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	} else if errors.Is(err, io.ErrUnexpectedEOF) {
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+// streamedBody is a request body that's sent upstream as it arrives. The first limit bytes of it
+// are kept as they're read, so that it can be sent again (e.g. with auth, or via another proxy)
+// as long as no more than that has been read.
+type streamedBody struct {
+	src        io.ReadCloser
+	limit      int64
+	sent       bytes.Buffer // What has been read from src so far, unless it's over the limit
+	overflowed bool
+	mux        sync.Mutex
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	n, err := b.src.Read(p)
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.overflowed {
+		// Too late to keep it.
+	} else if int64(b.sent.Len()+n) > b.limit {
+		b.overflowed = true
+		b.sent = bytes.Buffer{}
+	} else {
+		b.sent.Write(p[:n])
+	}
+	return n, err
+}
+
+// Close does nothing, so that the body can be sent again after the transport is done with it.
+// The server closes the underlying body once the handler returns.
+func (b *streamedBody) Close() error {
+	return nil
+}
+
+// get returns a copy of the body, which sends what has already been read again before reading
+// the rest of it.
+func (b *streamedBody) get() (io.ReadCloser, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.overflowed {
+		return nil, fmt.Errorf("more than %d bytes of the request body have already been sent",
+			b.limit)
+	}
+	sent := bytes.NewReader(bytes.Clone(b.sent.Bytes()))
+	return io.NopCloser(io.MultiReader(sent, b)), nil
+}
+
+// The maximum number of times that a request is retried using a different proxy.
+const maxFailoverRetries = 2
+
+// roundTrip forwards a request upstream. If this fails, or the upstream responds with "502 Bad
+// Gateway" or "504 Gateway Timeout", GET and HEAD requests are retried using the other proxies
+// that the PAC file returned. Other requests are only retried if the server (or proxy) couldn't
+// be reached, since they might not be safe to send twice. It returns the request that was sent
+// last, whose context holds the proxy that was used.
+func (ph ProxyHandler) roundTrip(req *http.Request) (*http.Request, *http.Response, error) {
+	id := req.Context().Value(contextKeyID)
+	fallbacks, _ := req.Context().Value(contextKeyFallbacks).([]*url.URL)
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	for retries := 0; ; retries++ {
+		var reason string
+		traced, endDial := traceDial(req)
+		proxy, _ := getProxyFromContext(req)
+		traced = ph.latencies.trace(traced, proxy)
+		timedOut := func() bool { return false }
+		if proxy == nil && ph.directTimeout > 0 && retries < len(fallbacks) {
+			traced, timedOut = limitDial(traced, ph.directTimeout)
+		}
+		resp, err := ph.transport.RoundTrip(traced)
+		if err != nil && timedOut() {
+			err = &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+		}
+		endDial(err)
+		if err != nil {
+			log.Printf("[%d] Error forwarding request: %v", id, err)
+			err = ph.checkProxyConnectError(req, err)
+			reason = err.Error()
+		} else if resp.StatusCode == http.StatusBadGateway ||
+			resp.StatusCode == http.StatusGatewayTimeout {
+			reason = fmt.Sprintf("got %q response", resp.Status)
+		} else {
+			return req, resp, nil
+		}
+		if retries >= maxFailoverRetries || retries >= len(fallbacks) ||
+			(!idempotent && !failoverSafe(err)) {
+			return req, resp, err
+		}
+		body, berr := req.GetBody()
+		if berr != nil {
+			log.Printf("[%d] Can't retry via another proxy: %v", id, berr)
+			return req, resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		next := fallbacks[retries]
+		log.Printf("[%d] Retrying via %q (%s)", id, proxyString(next), reason)
+		req = req.WithContext(context.WithValue(req.Context(), contextKeyProxy, next))
+		req.Body = body
+	}
+}
+
+// failoverSafe returns whether err means that a request wasn't sent at all, because the server
+// (or the proxy) couldn't be reached, so that it's safe to send it via another proxy.
+func failoverSafe(err error) bool {
+	var oe *net.OpError
+	return errors.Is(err, ErrUpstreamBlocked) || (errors.As(err, &oe) && oe.Op == "dial")
+}
+
+// limitDial returns a copy of req that's cancelled if the transport hasn't got a connection for
+// it within timeout, and a func that returns whether that happened. Unlike a deadline, this
+// doesn't limit how long the response takes once it's connected.
+func limitDial(req *http.Request, timeout time.Duration) (*http.Request, func() bool) {
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	trace := &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) { timer.Stop() }}
+	ctx = httptrace.WithClientTrace(ctx, trace)
+	return req.WithContext(ctx), timedOut.Load
+}
+
+// checkProxyConnectError blocks the upstream proxy if err shows that it couldn't be reached.
+func (ph ProxyHandler) checkProxyConnectError(req *http.Request, err error) error {
+	var oe *net.OpError
+	if !errors.As(err, &oe) || oe.Op != "proxyconnect" {
+		return err
+	}
+	proxy, perr := ph.transport.Proxy(req)
+	if perr != nil || proxy == nil {
+		log.Printf("[%d] Proxy connect error to unknown proxy: %v",
+			req.Context().Value(contextKeyID), perr)
+		return err
+	}
+	return ph.blockProxy(req, proxy, oe)
+}
+
+// blockProxy temporarily blocks an upstream proxy that couldn't be reached, and returns an error
+// that wraps both ErrUpstreamBlocked and the original error.
+func (ph ProxyHandler) blockProxy(req *http.Request, proxy *url.URL, err error) error {
+	log.Printf("[%d] Temporarily blocking proxy: %q", req.Context().Value(contextKeyID), proxy.Host)
+	ph.block(proxy.Host)
+	events.publish(eventUpstreamDown, proxy.Host,
+		"Couldn't connect to the proxy %s, so it won't be used for %v: %v", proxy.Host, maxAge, err)
+	return fmt.Errorf("%w: %s: %w", ErrUpstreamBlocked, proxy.Host, err)
+}
+
+func deleteConnectionTokens(header http.Header) {
+	// Remove any header field(s) with the same name as a connection token (see
+	// https://tools.ietf.org/html/rfc2616#section-14.10)
+	if values, ok := header["Connection"]; ok {
+		for _, value := range values {
+			if value == "close" {
+				continue
+			}
+			tokens := strings.Split(value, ",")
+			for _, token := range tokens {
+				header.Del(strings.TrimSpace(token))
+			}
+		}
+	}
+}
+
+func deleteRequestHeaders(req *http.Request) {
+	// Delete hop-by-hop headers (see https://tools.ietf.org/html/rfc2616#section-13.5.1)
+	trailers := acceptsTrailers(req.Header)
+	deleteConnectionTokens(req.Header)
+	req.Header.Del("Connection")
+	req.Header.Del("Keep-Alive")
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("TE")
+	if trailers {
+		// Alpaca passes trailers on, so it can accept them too. gRPC servers insist on this.
+		req.Header.Set("TE", "trailers")
+	}
+	req.Header.Del("Upgrade")
+	req.Header.Del(socksClientHeader)
+	req.Header.Del(transparentClientHeader)
+	req.Header.Del(alpacaRequestIDHeader)
+}
+
+// acceptsTrailers returns whether the TE header in h says that trailers are accepted.
+func acceptsTrailers(h http.Header) bool {
+	for _, value := range h.Values("TE") {
+		for _, elem := range strings.Split(value, ",") {
+			token, _, _ := strings.Cut(elem, ";")
+			if strings.EqualFold(strings.TrimSpace(token), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func copyResponseHeaders(w http.ResponseWriter, resp *http.Response) {
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	// Delete hop-by-hop headers (see https://tools.ietf.org/html/rfc2616#section-13.5.1)
+	deleteConnectionTokens(w.Header())
+	w.Header().Del("Connection")
+	w.Header().Del("Keep-Alive")
+	w.Header().Del("Proxy-Authenticate")
+	w.Header().Del("Trailer")
+	w.Header().Del("Transfer-Encoding")
+	w.Header().Del("Upgrade")
+	headerRewrites.rewriteResponse(resp.Request, w.Header())
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The stages of handling a request at which Alpaca can fail.
+const (
+	stagePAC     = "pac"     // Finding a proxy for the request
+	stageConnect = "connect" // Connecting to the server, or an upstream proxy
+	stageAuth    = "auth"    // Authenticating to an upstream proxy
+	stageRequest = "request" // Reading, or forwarding, the request
+)
+
+// proxyErrorHeader is set to the error code (see proxyError) on every error response generated by
+// Alpaca, so that build tools can decide whether to retry without having to parse the body. It's
+// set to "upstream_error" on 502 and 504 responses that came from an upstream proxy.
+const proxyErrorHeader = "X-Alpaca-Error"
+
+// proxyError is the body of an error response generated by Alpaca (rather than an upstream proxy
+// or server), for clients that accept JSON. This lets scripts and IDE plugins show the user
+// something more useful than "502 Bad Gateway".
+type proxyError struct {
+	Code       string `json:"code"`
+	Stage      string `json:"stage"`
+	Upstream   string `json:"upstream"`
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"` // Seconds, if the request is worth retrying
+}
+
+// writeProxyError sends an error response with the given status (or 504 Gateway Timeout instead
+// of 502 Bad Gateway, if err is a timeout). The X-Alpaca-Error header gives the error code, and
+// errors that are likely to be temporary get a Retry-After header. If the client accepts JSON, the
+// body describes what went wrong (based on err); if it accepts HTML (i.e. it's a browser), the body
+// is an error page in the client's language; otherwise it's empty. proxy is the upstream proxy that
+// was being used, or nil if the request was going directly to the server.
+func writeProxyError(w http.ResponseWriter, req *http.Request, status int, stage string,
+	proxy *url.URL, err error) {
+	pe := proxyError{Stage: stage, Upstream: "DIRECT"}
+	if proxy != nil {
+		pe.Upstream = proxy.Host
+	}
+	if err != nil {
+		pe.Message = err.Error()
+		reportError(req, err)
+	}
+	var tooLarge *http.MaxBytesError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrAuthRejected):
+		pe.Code = "auth_rejected"
+		pe.Stage = stageAuth
+	case errors.Is(err, ErrUpstreamBlocked):
+		pe.Code = "upstream_unreachable"
+		pe.RetryAfter = 1
+	case errors.Is(err, ErrTooManyConnections):
+		pe.Code = "too_many_connections"
+		pe.RetryAfter = 5
+	case errors.Is(err, ErrProxyLoop):
+		pe.Code = "proxy_loop"
+	case errors.Is(err, ErrUploadBlocked):
+		pe.Code = "upload_blocked"
+	case errors.Is(err, ErrDownloadBlocked):
+		pe.Code = "download_blocked"
+	case errors.As(err, &tooLarge):
+		pe.Code = "request_too_large"
+	case errors.As(err, &dnsErr):
+		pe.Code = "dns_error"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		pe.Code = "timeout"
+		pe.RetryAfter = 5
+		if status == http.StatusBadGateway {
+			status = http.StatusGatewayTimeout
+		}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		pe.Code = "connection_refused"
+		pe.RetryAfter = 5
+	case errors.Is(err, syscall.ECONNRESET):
+		pe.Code = "connection_reset"
+		pe.RetryAfter = 1
+	case stage == stagePAC:
+		pe.Code = "pac_error"
+	case status == http.StatusBadGateway:
+		pe.Code = "bad_gateway"
+	default:
+		pe.Code = "internal_error"
+	}
+	langs := requestLanguages(req)
+	if _, ok := defaultMessages["error."+pe.Code]; ok {
+		pe.Suggestion = messages.text(langs, "error."+pe.Code)
+	}
+	w.Header().Set(proxyErrorHeader, pe.Code)
+	if pe.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(pe.RetryAfter))
+	}
+	if accepts(req, "application/json") {
+		writeJSON(w, status, pe)
+	} else if accepts(req, "text/html") {
+		writeErrorPage(w, status, pe, langs)
+	} else {
+		w.WriteHeader(status)
+	}
+}
+
+var errorPageTmpl = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Suggestion}}<p>{{.Suggestion}}</p>{{end}}
+<h2>{{.Details}}</h2>
+<pre>{{.Code}} ({{.Stage}}, via {{.Upstream}}): {{.Message}}</pre>
+</body>
+</html>
+`))
+
+// writeErrorPage sends an error page for browsers, in the language that they prefer (if it has
+// been translated into it; see messageCatalogs).
+func writeErrorPage(w http.ResponseWriter, status int, pe proxyError, langs []string) {
+	data := struct {
+		proxyError
+		Lang, Title, Details string
+	}{
+		proxyError: pe,
+		Lang:       "en",
+		Title:      messages.text(langs, "error.title"),
+		Details:    messages.text(langs, "error.details"),
+	}
+	if len(langs) > 0 {
+		data.Lang = langs[0]
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := errorPageTmpl.Execute(w, data); err != nil {
+		log.Printf("Error writing error page: %v", err)
+	}
+}
+
+// accepts returns true if the client listed the media type in its Accept header.
+func accepts(req *http.Request, mediaType string) bool {
+	for _, value := range req.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mt, _, err := mime.ParseMediaType(mediaRange)
+			if err == nil && mt == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
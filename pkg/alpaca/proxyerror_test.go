@@ -0,0 +1,193 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", true},
+		{"text/html, application/json;q=0.9", true},
+		{"application/jsonp", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		assert.Equal(t, test.expected, accepts(req, "application/json"), test.accept)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestWriteProxyError(t *testing.T) {
+	proxy := &url.URL{Scheme: "http", Host: "proxy.test:8080"}
+	tests := []struct {
+		name       string
+		status     int
+		stage      string
+		proxy      *url.URL
+		err        error
+		code       string
+		stageOut   string
+		statusOut  int
+		retryAfter string
+	}{
+		{"AuthRejected", http.StatusBadGateway, stageConnect, proxy,
+			fmt.Errorf("[1] %w by proxy.test", ErrAuthRejected), "auth_rejected", stageAuth,
+			http.StatusBadGateway, ""},
+		{"Blocked", http.StatusBadGateway, stageConnect, proxy,
+			fmt.Errorf("%w: proxy.test", ErrUpstreamBlocked), "upstream_unreachable", stageConnect,
+			http.StatusBadGateway, "1"},
+		{"TooLarge", http.StatusRequestEntityTooLarge, stageRequest, nil,
+			&http.MaxBytesError{Limit: 1}, "request_too_large", stageRequest,
+			http.StatusRequestEntityTooLarge, ""},
+		{"DNS", http.StatusBadGateway, stageConnect, nil,
+			&net.OpError{Op: "dial", Err: &net.DNSError{Name: "x.test"}}, "dns_error", stageConnect,
+			http.StatusBadGateway, ""},
+		{"Timeout", http.StatusBadGateway, stageConnect, nil,
+			&net.OpError{Op: "dial", Err: timeoutError{}}, "timeout", stageConnect,
+			http.StatusGatewayTimeout, "5"},
+		{"Refused", http.StatusBadGateway, stageConnect, nil,
+			&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "connection_refused",
+			stageConnect, http.StatusBadGateway, "5"},
+		{"Reset", http.StatusBadGateway, stageRequest, nil,
+			&net.OpError{Op: "read", Err: syscall.ECONNRESET}, "connection_reset", stageRequest,
+			http.StatusBadGateway, "1"},
+		{"PAC", http.StatusInternalServerError, stagePAC, nil,
+			errors.New("no proxies available"), "pac_error", stagePAC,
+			http.StatusInternalServerError, ""},
+		{"Other", http.StatusBadGateway, stageRequest, proxy,
+			errors.New("EOF"), "bad_gateway", stageRequest, http.StatusBadGateway, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+			req.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			writeProxyError(w, req, test.status, test.stage, test.proxy, test.err)
+			assert.Equal(t, test.statusOut, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, test.code, w.Header().Get(proxyErrorHeader))
+			assert.Equal(t, test.retryAfter, w.Header().Get("Retry-After"))
+			var pe proxyError
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&pe))
+			assert.Equal(t, test.code, pe.Code)
+			assert.Equal(t, test.stageOut, pe.Stage)
+			assert.Equal(t, test.err.Error(), pe.Message)
+			if test.proxy != nil {
+				assert.Equal(t, "proxy.test:8080", pe.Upstream)
+			} else {
+				assert.Equal(t, "DIRECT", pe.Upstream)
+			}
+		})
+	}
+}
+
+func TestWriteProxyErrorWithoutJSON(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+	w := httptest.NewRecorder()
+	writeProxyError(w, req, http.StatusBadGateway, stageConnect, nil, errors.New("EOF"))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "bad_gateway", w.Header().Get(proxyErrorHeader))
+	assert.Empty(t, w.Body.String())
+}
+
+func TestUpstreamErrorHeader(t *testing.T) {
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}))
+	defer parent.Close()
+	proxy := httptest.NewServer(newChildProxy(parent))
+	defer proxy.Close()
+	client := http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	resp, err := client.Get("http://www.test/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, "upstream_error", resp.Header.Get(proxyErrorHeader))
+}
+
+func TestProxyErrorFromProxy(t *testing.T) {
+	proxy := httptest.NewServer(newDirectProxy())
+	defer proxy.Close()
+	client := http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	req, err := http.NewRequest(http.MethodGet, "http://nonexistent.test/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	var pe proxyError
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&pe))
+	assert.Equal(t, stageRequest, pe.Stage)
+	assert.Equal(t, "DIRECT", pe.Upstream)
+	assert.True(t, strings.Contains(pe.Message, "nonexistent.test"), pe.Message)
+}
+
+func TestWriteProxyErrorPage(t *testing.T) {
+	defer func(saved *messageCatalogs) { messages = saved }(messages)
+	var err error
+	messages, err = loadMessageCatalogs(writeMessageCatalogs(t, map[string]string{
+		"de.json": `{"error.dns_error": "Prüfen Sie den Hostnamen <b>."}`,
+	}))
+	require.NoError(t, err)
+	dnsErr := &net.DNSError{Err: "no such host", Name: "www.test", IsNotFound: true}
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.test/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	req.Header.Set("Accept-Language", "de-DE,de;q=0.9,en;q=0.8")
+	w := httptest.NewRecorder()
+	writeProxyError(w, req, http.StatusBadGateway, stageConnect, nil, dnsErr)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, `<html lang="de-de">`)
+	assert.Contains(t, body, "Prüfen Sie den Hostnamen &lt;b&gt;.")
+	assert.Contains(t, body, "Alpaca couldn&#39;t complete this request")
+	assert.Contains(t, body, "dns_error")
+
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	writeProxyError(w, req, http.StatusBadGateway, stageConnect, nil, dnsErr)
+	var pe proxyError
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&pe))
+	assert.Equal(t, "Prüfen Sie den Hostnamen <b>.", pe.Suggestion)
+}
@@ -0,0 +1,468 @@
+// Copyright 2019, 2021, 2022 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const contextKeyProxy = contextKey("proxy")
+
+// contextKeyFallbacks holds the other proxies (in order, with nil for DIRECT) that the PAC file
+// returned for a request, which can be tried if the first one fails.
+const contextKeyFallbacks = contextKey("fallbacks")
+
+// contextKeyReasons holds a *[]string that findProxiesForRequest adds each step of its decision to,
+// so that "alpaca resolve" can show why a request goes where it does.
+const contextKeyReasons = contextKey("reasons")
+
+// explain records a step in the decision about which proxy to use for req, if anyone's asked.
+func explain(req *http.Request, format string, args ...interface{}) {
+	if reasons, ok := req.Context().Value(contextKeyReasons).(*[]string); ok {
+		*reasons = append(*reasons, fmt.Sprintf(format, args...))
+	}
+}
+
+func getProxyFromContext(req *http.Request) (*url.URL, error) {
+	if value := req.Context().Value(contextKeyProxy); value != nil {
+		proxy := value.(*url.URL)
+		return proxy, nil
+	}
+	return nil, nil
+}
+
+type ProxyFinder struct {
+	router  routingProvider
+	format  string // The name of the router's routingFormat
+	pacjs   []byte // The PAC file (or other routing config) that the router is using
+	fetcher *pacFetcher
+	wrapper *PACWrapper
+	blocked *blocklist
+	myIP    *myIPFinder
+	local   *localSubnets // If set, requests to hosts on a local subnet always go direct
+	bypass  *bypassList
+	routes  *routingRules  // If set, overrides the PAC file for some processes or ports
+	health  *healthChecker // If set, overrides the PAC file while a proxy is down
+	patch   *pacOverride   // If set, overrides the PAC file for some hosts
+	pins    *redirectPins  // If set, redirect targets are sent the same way as the redirect
+	captive *captivePortal // If set, requests go direct while there's a captive portal
+	// If set, another instance of Alpaca that's used instead of the PAC file.
+	upstream *url.URL
+	// If set, proxies are probed for the auth schemes they offer when they're first seen.
+	prober *authProber
+	// If set, each new PAC file is saved, so that it can be rolled back to later.
+	history *pacHistory
+	// While a rollback is in effect, the downloaded PAC file that was rolled back from.
+	rolledBack []byte
+	sync.Mutex
+}
+
+// NewProxyFinder returns a ProxyFinder that uses the first of the PAC URLs that can be downloaded
+// (or the system's PAC URL, if there aren't any).
+func NewProxyFinder(pacurls []string, wrapper *PACWrapper, myIP string) *ProxyFinder {
+	pf := &ProxyFinder{
+		wrapper: wrapper,
+		blocked: newBlocklist(),
+		myIP:    newMyIPFinder(myIP),
+		bypass:  newBypassList(),
+	}
+	pf.fetcher = newPACFetcher(pacurls...)
+	pf.checkForUpdates()
+	return pf
+}
+
+func (pf *ProxyFinder) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s := startSpan(req.Context(), "pac", spanKindInternal)
+		pf.checkForUpdates()
+		proxies, err := pf.findProxiesForRequest(req)
+		s.setError(err)
+		if err == nil {
+			names := make([]string, len(proxies))
+			for i, proxy := range proxies {
+				names[i] = proxyString(proxy)
+			}
+			s.setAttributes(otlpString("alpaca.proxies", strings.Join(names, "; ")))
+		}
+		s.end()
+		if err != nil {
+			log.Printf("[%d] %v", req.Context().Value(contextKeyID), err)
+			writeProxyError(w, req, http.StatusInternalServerError, stagePAC, nil, err)
+			return
+		}
+		if pf.prober != nil {
+			pf.prober.probe(proxies...)
+		}
+		if proxies[0] != nil {
+			ctx := context.WithValue(req.Context(), contextKeyProxy, proxies[0])
+			req = req.WithContext(ctx)
+		}
+		if len(proxies) > 1 {
+			ctx := context.WithValue(req.Context(), contextKeyFallbacks, proxies[1:])
+			req = req.WithContext(ctx)
+		}
+		if pf.pins != nil && req.Method != http.MethodConnect {
+			w = &redirectWriter{ResponseWriter: w, req: req, proxies: proxies, pins: pf.pins}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// refreshEvery sets the interval at which the PAC file is re-fetched (even if the network hasn't
+// changed), and starts a goroutine to do this in the background, rather than making a request
+// wait for it.
+func (pf *ProxyFinder) refreshEvery(interval time.Duration) {
+	pf.Lock()
+	pf.fetcher.refreshInterval = interval
+	pf.Unlock()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			pf.checkForUpdates()
+		}
+	}()
+}
+
+func (pf *ProxyFinder) checkForUpdates() {
+	pf.Lock()
+	defer pf.Unlock()
+	pacjs := pf.fetcher.download()
+	pf.myIP.setPACURL(pf.fetcher.url)
+	if pacjs == nil {
+		if !pf.fetcher.isConnected() {
+			pf.blocked = newBlocklist()
+			pf.wrapper.Wrap(nil)
+		}
+		return
+	}
+	if pf.rolledBack != nil {
+		if bytes.Equal(pacjs, pf.rolledBack) {
+			// Downloaded again (e.g. after a network change), but it's still the same.
+			return
+		}
+		log.Printf("The PAC file has changed since it was rolled back, so using the new one")
+		pf.rolledBack = nil
+	}
+	old := pf.pacjs
+	if err := pf.apply(pacjs); err != nil {
+		return
+	}
+	if old != nil && !bytes.Equal(pacjs, old) {
+		logPACDiff(pf.fetcher.url, old, pacjs)
+		events.publish(eventPACChanged, pf.fetcher.url, "Using a new PAC file from %s",
+			redactURL(pf.fetcher.url))
+	}
+	if pf.history != nil {
+		pf.history.record(pacjs)
+	}
+}
+
+// apply starts using pacjs to route requests. The caller must hold the lock.
+func (pf *ProxyFinder) apply(pacjs []byte) error {
+	pf.blocked = newBlocklist()
+	router := pf.router
+	format := detectRoutingFormat(pacjs)
+	if router == nil || format.name != pf.format {
+		router = format.newProvider(pf)
+	}
+	if err := router.Update(pacjs); err != nil {
+		log.Printf("Error running %s: %q", format.description, err)
+		return fmt.Errorf("error running %s: %w", format.description, err)
+	}
+	if format.name != pf.format && pf.format != "" {
+		log.Printf("Routing configuration changed from %s to %s", pf.format, format.name)
+	}
+	pf.router, pf.format, pf.pacjs = router, format.name, pacjs
+	if pf.prober != nil {
+		pf.prober.probePAC(pacjs)
+	}
+	if ps, ok := router.(pacScripter); ok {
+		pf.wrapper.Wrap(ps.pacScript())
+	} else {
+		pf.wrapper.Wrap(pacjs)
+	}
+	return nil
+}
+
+// rollback goes back to an older PAC file (see pacHistoryAPI), until a different PAC file is
+// downloaded.
+func (pf *ProxyFinder) rollback(pacjs []byte) error {
+	pf.Lock()
+	defer pf.Unlock()
+	rolledBack := pf.rolledBack
+	if rolledBack == nil {
+		rolledBack = pf.pacjs
+	}
+	if err := pf.apply(pacjs); err != nil {
+		return err
+	}
+	if bytes.Equal(pacjs, rolledBack) {
+		pf.rolledBack = nil // Back to the downloaded PAC file
+	} else {
+		pf.rolledBack = rolledBack
+	}
+	return nil
+}
+
+// setHistory starts saving each new PAC file, starting with the one that's already been loaded.
+func (pf *ProxyFinder) setHistory(h *pacHistory) {
+	pf.Lock()
+	defer pf.Unlock()
+	pf.history = h
+	if pf.pacjs != nil {
+		h.record(pf.pacjs)
+	}
+}
+
+// currentPAC returns the PAC file (or other routing config) that's being used.
+func (pf *ProxyFinder) currentPAC() []byte {
+	pf.Lock()
+	defer pf.Unlock()
+	return pf.pacjs
+}
+
+// setAuthProber starts probing proxies for their auth schemes, starting with the ones in the PAC
+// file that's already been loaded.
+func (pf *ProxyFinder) setAuthProber(ap *authProber) {
+	pf.Lock()
+	defer pf.Unlock()
+	pf.prober = ap
+	ap.probePAC(pf.pacjs)
+}
+
+func (pf *ProxyFinder) findProxyForRequest(req *http.Request) (*url.URL, error) {
+	proxies, err := pf.findProxiesForRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return proxies[0], nil
+}
+
+// findProxiesForRequest returns the proxies that can be used for a request, in order of
+// preference. A nil entry means that the request should be made directly. If there's no error,
+// there's always at least one entry.
+func (pf *ProxyFinder) findProxiesForRequest(req *http.Request) ([]*url.URL, error) {
+	id := req.Context().Value(contextKeyID)
+	direct := []*url.URL{nil}
+	if pf.bypass.contains(req.URL.Hostname()) {
+		log.Printf(`[%d] %s %s via "DIRECT" (bypassed)`, id, req.Method, logURL(req.URL))
+		explain(req, "%s is bypassed (using the extension API), so it goes DIRECT",
+			req.URL.Hostname())
+		return direct, nil
+	}
+	address := net.JoinHostPort(req.URL.Hostname(), requestPort(req))
+	if mapped, ok := hostMappings.lookup(address); ok {
+		log.Printf(`[%d] %s %s via "DIRECT" (mapped to %s)`,
+			id, req.Method, logURL(req.URL), logHost(mapped))
+		explain(req, "%s is mapped to %s (using -map-host), so it goes DIRECT", address, mapped)
+		return direct, nil
+	}
+	if localNames.contains(req.URL.Hostname()) {
+		log.Printf(`[%d] %s %s via "DIRECT" (local host name)`, id, req.Method, logURL(req.URL))
+		explain(req, "%s is a .local or single-label host name (using -local-names), so it "+
+			"goes DIRECT", req.URL.Hostname())
+		return direct, nil
+	}
+	if pf.captive != nil {
+		if reason, ok := pf.captive.detected(); ok {
+			log.Printf(`[%d] %s %s via "DIRECT" (captive portal: %s)`,
+				id, req.Method, logURL(req.URL), reason)
+			explain(req, "Everything goes DIRECT behind a captive portal (%s)", reason)
+			return direct, nil
+		}
+	}
+	if pf.pins != nil {
+		if proxies, ok := pf.pins.lookup(req); ok {
+			log.Printf("[%d] %s %s via %q (following a redirect)",
+				id, req.Method, logURL(req.URL), proxyString(proxies[0]))
+			explain(req, "Following a redirect from a request that went via %q",
+				proxyString(proxies[0]))
+			return proxies, nil
+		}
+	}
+	if pf.routes != nil {
+		if rule, ok := pf.routes.match(req); ok {
+			log.Printf("[%d] Using routing rule %q", id, rule)
+			explain(req, "Matched routing rule %q", rule)
+			return pf.chooseProxies(req, rule.result)
+		}
+	}
+	if pf.health != nil {
+		if rule, ok := pf.health.activeRule(); ok {
+			log.Printf("[%d] Using health rule %q", id, rule)
+			explain(req, "Health rule %q is active", rule)
+			return pf.chooseProxies(req, rule.result)
+		}
+	}
+	if pf.patch != nil {
+		if result, source, ok := pf.patch.find(*req.URL); ok {
+			log.Printf("[%d] Using %s", id, source)
+			explain(req, "Using %s", source)
+			return pf.chooseProxies(req, result)
+		}
+	}
+	if pf.upstream != nil {
+		log.Printf("[%d] %s %s via the upstream Alpaca at %s",
+			id, req.Method, logURL(req.URL), pf.upstream.Host)
+		explain(req, "Everything goes to the upstream Alpaca at %s (using -upstream-alpaca)",
+			pf.upstream.Host)
+		return []*url.URL{pf.upstream}, nil
+	}
+	if pf.fetcher == nil {
+		log.Printf(`[%d] %s %s via "DIRECT"`, id, req.Method, logURL(req.URL))
+		explain(req, "There's no PAC file, so everything goes DIRECT")
+		return direct, nil
+	}
+	if !pf.fetcher.isConnected() {
+		log.Printf(`[%d] %s %s via "DIRECT" (not connected to PAC server)`,
+			id, req.Method, logURL(req.URL))
+		explain(req, "The PAC file couldn't be downloaded, so everything goes DIRECT")
+		return direct, nil
+	}
+	if pf.local != nil && pf.local.contains(req.URL.Hostname()) {
+		log.Printf(`[%d] %s %s via "DIRECT" (host is on a local subnet)`,
+			id, req.Method, logURL(req.URL))
+		explain(req, "%s is on a local subnet (using -local-direct), so it goes DIRECT",
+			req.URL.Hostname())
+		return direct, nil
+	}
+	pf.Lock()
+	router := pf.router
+	pf.Unlock()
+	if router == nil {
+		return nil, errors.New("no valid PAC file has been downloaded")
+	}
+	str, err := router.FindProxyForURL(*req.URL)
+	if err != nil {
+		return nil, err
+	}
+	explain(req, "FindProxyForURL returned %q", str)
+	return pf.chooseProxies(req, str)
+}
+
+// chooseProxies returns the proxies in a PAC-style result (e.g. "PROXY proxy.test:8080; DIRECT")
+// that aren't blocked, with nil for DIRECT.
+func (pf *ProxyFinder) chooseProxies(req *http.Request, str string) ([]*url.URL, error) {
+	id := req.Context().Value(contextKeyID)
+	var proxies []*url.URL
+	var fallback *url.URL
+	for _, elem := range strings.Split(str, ";") {
+		fields := strings.Fields(strings.TrimSpace(elem))
+		var scheme string
+		var defaultPort string
+		if len(fields) == 0 {
+			continue
+		} else if fields[0] == "DIRECT" {
+			if len(proxies) == 0 {
+				log.Printf("[%d] %s %s via %q", id, req.Method, logURL(req.URL), elem)
+			}
+			proxies = append(proxies, nil)
+			continue
+		} else if len(fields) < 2 {
+			// e.g. "PROXY" without an address
+			log.Printf("[%d] Couldn't parse proxy: %q", id, elem)
+			continue
+		} else if fields[0] == "PROXY" || fields[0] == "HTTP" {
+			scheme = "http"
+			defaultPort = "80"
+		} else if fields[0] == "HTTPS" {
+			scheme = "https"
+			defaultPort = "443"
+		} else {
+			log.Printf("[%d] Couldn't parse proxy: %q", id, elem)
+			continue
+		}
+		proxy := &url.URL{Scheme: scheme, Host: fields[1]}
+		if proxy.Port() == "" {
+			proxy.Host = net.JoinHostPort(proxy.Host, defaultPort)
+		}
+		if pf.blocked.contains(proxy.Host) {
+			explain(req, "Skipping %q, which failed recently", proxyString(proxy))
+			if fallback == nil {
+				fallback = proxy
+			}
+			continue
+		}
+		if len(proxies) == 0 {
+			log.Printf("[%d] %s %s via %q", id, req.Method, logURL(req.URL), elem)
+		}
+		proxies = append(proxies, proxy)
+	}
+	if len(proxies) > 0 {
+		return proxies, nil
+	} else if fallback != nil {
+		// All the proxies are currently blocked. In this case, we'll temporarily ignore the
+		// blocklist and fall back to the first proxy that we saw (and skipped).
+		explain(req, "Every proxy failed recently, so trying %s anyway", proxyString(fallback))
+		return []*url.URL{fallback}, nil
+	}
+	return nil, errors.New("no proxies available")
+}
+
+// validatePACResult checks that each element of a PAC-style result (e.g. "PROXY a.test:80;
+// DIRECT") is one that chooseProxies understands: DIRECT on its own, or PROXY, HTTP or HTTPS
+// followed by a single address. It's used for the results in -route, -health-rule, -pac-override
+// and JSON proxy configs, so that they're checked when they're loaded, rather than when a request
+// uses them.
+func validatePACResult(result string) error {
+	for _, elem := range strings.Split(result, ";") {
+		fields := strings.Fields(elem)
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "DIRECT" && len(fields) == 1:
+		case (fields[0] == "PROXY" || fields[0] == "HTTP" || fields[0] == "HTTPS") &&
+			len(fields) == 2:
+		default:
+			return fmt.Errorf("invalid proxy %q", strings.TrimSpace(elem))
+		}
+	}
+	if strings.TrimSpace(result) == "" {
+		return errors.New("missing proxy")
+	}
+	return nil
+}
+
+// pacStatus returns the current PAC URL, and whether it was successfully downloaded.
+func (pf *ProxyFinder) pacStatus() (string, bool) {
+	pf.Lock()
+	defer pf.Unlock()
+	return pf.fetcher.url, pf.fetcher.isConnected()
+}
+
+// pacError returns why the PAC file couldn't be downloaded the last time that it was tried, or nil
+// if it was.
+func (pf *ProxyFinder) pacError() error {
+	pf.Lock()
+	defer pf.Unlock()
+	return pf.fetcher.err
+}
+
+func (pf *ProxyFinder) blockProxy(proxy string) {
+	pf.blocked.add(proxy)
+}
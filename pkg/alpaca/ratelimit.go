@@ -0,0 +1,166 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// contextKeyThrottle holds the throttle func for a CONNECT request, if bandwidth is limited.
+const contextKeyThrottle = contextKey("throttle")
+
+// The number of per-client buckets to keep before idle ones are cleared out.
+const maxClientBuckets = 1000
+
+// tokenBucket limits a rate (in bytes per second), while allowing bursts of up to a second's
+// worth of data.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	mux    sync.Mutex
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	now := time.Now
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now(), now: now}
+}
+
+// reserve takes n tokens from the bucket, and returns how long to wait before using them. The
+// bucket can go into debt, so that writes bigger than the burst size don't have to be split.
+func (tb *tokenBucket) reserve(n int) time.Duration {
+	tb.mux.Lock()
+	defer tb.mux.Unlock()
+	now := tb.now()
+	tb.tokens = min(tb.rate, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// idle returns whether the bucket is full, i.e. nothing has been sent for a second or more.
+func (tb *tokenBucket) idle() bool {
+	tb.mux.Lock()
+	defer tb.mux.Unlock()
+	return tb.tokens+tb.now().Sub(tb.last).Seconds()*tb.rate >= tb.rate
+}
+
+// bandwidthLimiter limits the rate at which data is sent to clients, both overall and for each
+// client IP address, so that a single runaway download can't saturate a slow link (such as a
+// VPN). This applies to responses, and to data sent to the client through CONNECT tunnels.
+type bandwidthLimiter struct {
+	global    *tokenBucket // nil for no overall limit
+	perClient int64        // The limit for each client, in bytes per second (0 for no limit)
+	clients   map[string]*tokenBucket
+	mux       sync.Mutex
+}
+
+func newBandwidthLimiter(global, perClient int64) *bandwidthLimiter {
+	bl := &bandwidthLimiter{perClient: perClient, clients: make(map[string]*tokenBucket)}
+	if global > 0 {
+		bl.global = newTokenBucket(global)
+	}
+	return bl
+}
+
+// throttle returns a func that blocks until n bytes can be sent to the client at addr.
+func (bl *bandwidthLimiter) throttle(addr string) func(n int) {
+	var client *tokenBucket
+	if bl.perClient > 0 {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		bl.mux.Lock()
+		if len(bl.clients) >= maxClientBuckets {
+			// A bucket that's still in use carries on working; it just isn't shared.
+			for h, tb := range bl.clients {
+				if tb.idle() {
+					delete(bl.clients, h)
+				}
+			}
+		}
+		if client = bl.clients[host]; client == nil {
+			client = newTokenBucket(bl.perClient)
+			bl.clients[host] = client
+		}
+		bl.mux.Unlock()
+	}
+	return func(n int) {
+		var delay time.Duration
+		if bl.global != nil {
+			delay = bl.global.reserve(n)
+		}
+		if client != nil {
+			if d := client.reserve(n); d > delay {
+				delay = d
+			}
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
+
+func (bl *bandwidthLimiter) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect && req.URL.Scheme == "" {
+			// Not a proxy request (see ProxyHandler.WrapHandler).
+			next.ServeHTTP(w, req)
+			return
+		}
+		throttle := bl.throttle(req.RemoteAddr)
+		if req.Method == http.MethodConnect {
+			// The connection is hijacked, so the tunnel has to do the throttling.
+			ctx := context.WithValue(req.Context(), contextKeyThrottle, throttle)
+			next.ServeHTTP(w, req.WithContext(ctx))
+			return
+		} else if upgradeType(req.Header) != "" {
+			// If the server switches protocols, the connection is relayed like a tunnel.
+			ctx := context.WithValue(req.Context(), contextKeyThrottle, throttle)
+			req = req.WithContext(ctx)
+		}
+		next.ServeHTTP(&throttledWriter{ResponseWriter: w, throttle: throttle}, req)
+	})
+}
+
+// throttleForRequest returns the throttle func for a CONNECT (or upgrade) request, or nil.
+func throttleForRequest(req *http.Request) func(n int) {
+	throttle, _ := req.Context().Value(contextKeyThrottle).(func(int))
+	return throttle
+}
+
+// throttledWriter is a ResponseWriter that limits the rate at which the body is written.
+type throttledWriter struct {
+	http.ResponseWriter
+	throttle func(n int)
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	w.throttle(len(p))
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
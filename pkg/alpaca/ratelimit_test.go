@@ -0,0 +1,105 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(1000)
+	tb.now = func() time.Time { return now }
+	tb.last = now
+	// The first second's worth can be sent straight away.
+	assert.Zero(t, tb.reserve(600))
+	assert.Zero(t, tb.reserve(400))
+	// After that, it's limited to the rate.
+	assert.Equal(t, 500*time.Millisecond, tb.reserve(500))
+	assert.Equal(t, time.Second, tb.reserve(500))
+	now = now.Add(time.Second)
+	assert.Zero(t, tb.reserve(0))
+	assert.False(t, tb.idle())
+	// Unused tokens don't build up beyond a second's worth.
+	now = now.Add(time.Minute)
+	assert.True(t, tb.idle())
+	assert.Zero(t, tb.reserve(1000))
+	assert.Equal(t, 100*time.Millisecond, tb.reserve(100))
+}
+
+func TestBandwidthLimiterPerClient(t *testing.T) {
+	bl := newBandwidthLimiter(0, 1000)
+	bl.throttle("127.0.0.1:50000")(600)
+	bl.throttle("127.0.0.1:50001")(400)
+	bl.throttle("[::1]:50000")(100)
+	// Connections from the same IP address share a bucket.
+	require.Len(t, bl.clients, 2)
+	assert.False(t, bl.clients["127.0.0.1"].idle())
+	assert.Greater(t, bl.clients["127.0.0.1"].reserve(100), 50*time.Millisecond)
+	assert.Zero(t, bl.clients["::1"].reserve(100))
+}
+
+func TestBandwidthLimiterResponse(t *testing.T) {
+	body := strings.Repeat("x", 15000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+	bl := newBandwidthLimiter(10000, 0)
+	proxy := httptest.NewServer(bl.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	start := time.Now()
+	status, got := getBody(t, client, server.URL)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, body, got)
+	// 10000 bytes can be sent straight away, and the rest takes half a second.
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestBandwidthLimiterTunnel(t *testing.T) {
+	body := strings.Repeat("x", 15000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+	target := server.Listener.Addr().String()
+	bl := newBandwidthLimiter(0, 10000)
+	proxy := httptest.NewServer(bl.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	start := time.Now()
+	conn, status := connectVia(t, proxy.Listener.Addr().String(), target)
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, status)
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(got))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// redirectPins remembers where redirects point to, so that the request that follows a redirect
+// can be sent the same way as the request that led to it. Registries (e.g. Docker Hub or npm)
+// commonly redirect downloads to a cloud storage domain, which the PAC file may route through a
+// different proxy (or not at all).
+type redirectPins struct {
+	ttl  time.Duration
+	pins map[string]redirectPin
+	now  func() time.Time
+	mux  sync.Mutex
+}
+
+type redirectPin struct {
+	proxies []*url.URL
+	expires time.Time
+}
+
+func newRedirectPins(ttl time.Duration) *redirectPins {
+	return &redirectPins{ttl: ttl, pins: make(map[string]redirectPin), now: time.Now}
+}
+
+// redirectKey returns the key that a request for u is pinned by. For https, this is just the host
+// and port, since the CONNECT request that the client sends for it doesn't include the path.
+func redirectKey(u *url.URL) string {
+	if u.Scheme == "https" {
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	u = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath,
+		RawQuery: u.RawQuery}
+	return u.String()
+}
+
+func requestKey(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return req.Host
+	}
+	return redirectKey(req.URL)
+}
+
+// pin records that the redirect target should use the given proxies (nil means DIRECT).
+func (rp *redirectPins) pin(target *url.URL, proxies []*url.URL) {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	now := rp.now()
+	for key, pin := range rp.pins {
+		if now.After(pin.expires) {
+			delete(rp.pins, key)
+		}
+	}
+	rp.pins[redirectKey(target)] = redirectPin{proxies: proxies, expires: now.Add(rp.ttl)}
+}
+
+// lookup returns the proxies that req has been pinned to, if it's following a recent redirect.
+func (rp *redirectPins) lookup(req *http.Request) ([]*url.URL, bool) {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	pin, ok := rp.pins[requestKey(req)]
+	if !ok || rp.now().After(pin.expires) {
+		return nil, false
+	}
+	return pin.proxies, true
+}
+
+// redirectWriter watches for a redirect in the response to req, and pins its target to the
+// proxies that req was sent through.
+type redirectWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	proxies []*url.URL
+	pins    *redirectPins
+}
+
+func (rw *redirectWriter) WriteHeader(status int) {
+	if isRedirect(status) {
+		if loc, err := rw.req.URL.Parse(rw.Header().Get("Location")); err == nil && loc.Host != "" {
+			rw.pins.pin(loc, rw.proxies)
+		}
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *redirectWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
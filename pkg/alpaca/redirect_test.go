@@ -0,0 +1,90 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirectKey(t *testing.T) {
+	for _, test := range []struct {
+		url, key string
+	}{
+		{"http://registry.test/v2/blob?x=1#frag", "http://registry.test/v2/blob?x=1"},
+		{"https://storage.test/bucket/blob", "storage.test:443"},
+		{"https://storage.test:8443/blob", "storage.test:8443"},
+	} {
+		u, err := url.Parse(test.url)
+		require.NoError(t, err)
+		assert.Equal(t, test.key, redirectKey(u), test.url)
+	}
+}
+
+func TestRedirectPinsExpire(t *testing.T) {
+	now := time.Now()
+	rp := newRedirectPins(time.Minute)
+	rp.now = func() time.Time { return now }
+	target, err := url.Parse("https://storage.test/blob")
+	require.NoError(t, err)
+	proxy := &url.URL{Scheme: "http", Host: "proxy.test:8080"}
+	rp.pin(target, []*url.URL{proxy})
+	req := httptest.NewRequest(http.MethodConnect, "https://storage.test:443", nil)
+	req.Host = "storage.test:443"
+	proxies, ok := rp.lookup(req)
+	require.True(t, ok)
+	assert.Equal(t, []*url.URL{proxy}, proxies)
+	now = now.Add(2 * time.Minute)
+	_, ok = rp.lookup(req)
+	assert.False(t, ok)
+}
+
+func TestRedirectFollowsOriginalProxy(t *testing.T) {
+	js := `function FindProxyForURL(url, host) {
+		if (host == "registry.test") return "PROXY registry-proxy:8080";
+		return "DIRECT";
+	}`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer server.Close()
+	pf := NewProxyFinder([]string{server.URL}, NewPACWrapper(PACData{Port: 1}), myIPAuto)
+	pf.pins = newRedirectPins(time.Minute)
+	var got *url.URL
+	handler := pf.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got, _ = getProxyFromContext(req)
+		if req.URL.Host == "registry.test" {
+			w.Header().Set("Location", "http://storage.test/blob")
+			w.WriteHeader(http.StatusFound)
+		}
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "http://registry.test/v2/blob", nil))
+	require.NotNil(t, got)
+	assert.Equal(t, "registry-proxy:8080", got.Host)
+	// Without the redirect, storage.test would go direct.
+	handler.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "http://storage.test/blob", nil))
+	require.NotNil(t, got)
+	assert.Equal(t, "registry-proxy:8080", got.Host)
+	handler.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "http://storage.test/other", nil))
+	assert.Nil(t, got)
+}
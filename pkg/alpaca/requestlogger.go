@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package alpaca
 
 import (
 	"log"
@@ -38,7 +38,7 @@ func RequestLogger(next http.Handler) http.Handler {
 			req.Context().Value(contextKeyID),
 			sw.status,
 			req.Method,
-			req.URL,
+			logURL(req.URL),
 		)
 	})
 }
@@ -0,0 +1,58 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// runResolve prints which proxy s would use for each URL (for "alpaca resolve"), along with the
+// steps that led to it: whether it was bypassed, mapped, or matched a rule or override, what the
+// PAC file returned, and which proxies were skipped because they failed recently.
+func runResolve(s *http.Server, urls []string, out io.Writer) error {
+	if len(urls) == 0 {
+		return errors.New("usage: alpaca resolve [flags] url...")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go func() { _ = s.Serve(l) }()
+	c := newSelfCheck(l.Addr().String(), out)
+	var failed error
+	for i, u := range urls {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		var route extensionRoute
+		err := c.getJSON("/alpaca/api/route?url="+url.QueryEscape(u), &route)
+		if err != nil {
+			fmt.Fprintf(out, "%s\n  error: %v\n", u, err)
+			failed = errors.New("couldn't resolve every URL")
+			continue
+		}
+		fmt.Fprintf(out, "%s\n  %s\n", u, route.Proxy)
+		for _, reason := range route.Reasons {
+			fmt.Fprintf(out, "    - %s\n", reason)
+		}
+	}
+	return failed
+}
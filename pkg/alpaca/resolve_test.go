@@ -0,0 +1,53 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	pacServer := httptest.NewServer(pacjsHandler(`function FindProxyForURL(url, host) {
+		return host == "www.example.com" ? "PROXY proxy.test:8080; DIRECT" : "DIRECT";
+	}`))
+	defer pacServer.Close()
+	s := createServer("localhost", 3128, []string{pacServer.URL}, nil, newTunnelTracker(),
+		serverOptions{})
+	var out strings.Builder
+	err := runResolve(s, []string{"http://www.example.com/", "https://other.test/"}, &out)
+	require.NoError(t, err)
+	assert.Equal(t, `http://www.example.com/
+  PROXY proxy.test:8080
+    - FindProxyForURL returned "PROXY proxy.test:8080; DIRECT"
+
+https://other.test/
+  DIRECT
+    - FindProxyForURL returned "DIRECT"
+`, out.String())
+}
+
+func TestResolveInvalidURL(t *testing.T) {
+	s := createServer("localhost", 3128, nil, nil, newTunnelTracker(), serverOptions{})
+	var out strings.Builder
+	err := runResolve(s, []string{"not a url"}, &out)
+	require.Error(t, err)
+	assert.Contains(t, out.String(), "not a url\n  error: url parameter must be an absolute URL")
+	assert.Error(t, runResolve(s, nil, &out))
+}
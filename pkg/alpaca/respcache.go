@@ -0,0 +1,566 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxHeuristicLifetime caps how long a response without an explicit lifetime is considered
+	// fresh for, based on how long ago it was last modified.
+	maxHeuristicLifetime = 24 * time.Hour
+	// maxLifetime caps the lifetime given by a response (to avoid overflowing a Duration).
+	maxLifetime = 365 * 24 * time.Hour
+	// responseCacheEntryShare is the fraction of the cache that a single response can use.
+	responseCacheEntryShare = 8
+)
+
+// responseCache keeps responses to plain HTTP GET requests that go through an upstream proxy, so
+// that repeated requests (e.g. package managers fetching the same metadata) don't have to wait
+// for a slow link. It loosely follows RFC 9111: only complete 200 responses with a known length
+// are stored, and only if their Cache-Control header allows a shared cache to store them and they
+// have a lifetime or a validator (an ETag or Last-Modified). A fresh response is served straight
+// from the cache; a stale one is revalidated with a conditional request, and served from the
+// cache if the server says it hasn't changed. Responses are kept in memory, up to maxSize bytes,
+// and if dir is set, on disk too, so that they survive restarts. Different upstream proxies (or
+// accounts) might not get the same responses, so they're stored separately for each of them.
+type responseCache struct {
+	maxSize     int64
+	dir         string // If set, responses are also kept on disk
+	maxDiskSize int64  // The directory is trimmed to this size after each response is stored
+	now         func() time.Time
+	// If set, returns the account that requests are authenticated as (see identity).
+	identity func() string
+	entries  map[string]*list.Element // By key (see key)
+	lru      *list.List               // Of *cachedResponse, most recently used first
+	size     int64
+	mux      sync.Mutex
+	diskMux  sync.Mutex
+}
+
+// cachedResponse is a stored response. On disk, it's saved as a line of JSON, followed by the body.
+type cachedResponse struct {
+	Key    string      `json:"key"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	// The values of the request headers that the response varies on (see the Vary header).
+	Vary     map[string]string `json:"vary,omitempty"`
+	Stored   time.Time         `json:"stored"`   // When the response was received
+	Age      time.Duration     `json:"age"`      // Its age when it was received
+	Lifetime time.Duration     `json:"lifetime"` // How long it's fresh for
+	Body     []byte            `json:"-"`
+}
+
+func newResponseCache(maxSize int64, dir string, maxDiskSize int64) (*responseCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &responseCache{
+		maxSize:     maxSize,
+		dir:         dir,
+		maxDiskSize: maxDiskSize,
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}, nil
+}
+
+func (rc *responseCache) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !cacheableRequest(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		id := req.Context().Value(contextKeyID)
+		key := rc.key(req)
+		entry := rc.get(key, req)
+		if entry != nil && rc.fresh(entry, req) {
+			log.Printf("[%d] Served from the response cache (age %v)", id,
+				rc.age(entry).Round(time.Second))
+			rc.serve(w, req, entry)
+			return
+		}
+		// Revalidate a stale response, unless the client is already doing that itself.
+		upstream := req
+		revalidate := entry != nil && hasValidator(entry.Header) && !conditional(req)
+		if revalidate {
+			upstream = req.Clone(req.Context())
+			if etag := entry.Header.Get("ETag"); etag != "" {
+				upstream.Header.Set("If-None-Match", etag)
+			}
+			if modified := entry.Header.Get("Last-Modified"); modified != "" {
+				upstream.Header.Set("If-Modified-Since", modified)
+			}
+		}
+		cw := &cacheWriter{
+			ResponseWriter: w,
+			revalidating:   revalidate,
+			limit:          rc.maxSize / responseCacheEntryShare,
+		}
+		next.ServeHTTP(cw, upstream)
+		if cw.notModified {
+			entry = rc.refresh(entry, cw.header)
+			log.Printf("[%d] Served from the response cache, after checking that it's unchanged",
+				id)
+			rc.serve(w, req, entry)
+			return
+		}
+		if entry := rc.newEntry(key, req, cw); entry != nil {
+			rc.put(entry, true)
+		}
+	})
+}
+
+// cacheableRequest returns whether a response to req could be served from the cache.
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.URL.Scheme != "http" {
+		return false
+	} else if proxy, _ := req.Context().Value(contextKeyProxy).(*url.URL); proxy == nil {
+		return false // Going direct, which is usually fast anyway
+	} else if req.Header.Get("Authorization") != "" {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// key returns what the response to req is stored under: its URL, along with the upstream proxy
+// that it's sent through and the account that it's authenticated as.
+func (rc *responseCache) key(req *http.Request) string {
+	var proxy, account string
+	if u, _ := req.Context().Value(contextKeyProxy).(*url.URL); u != nil {
+		proxy = u.Host
+	}
+	if rc.identity != nil {
+		account = rc.identity()
+	}
+	return strings.Join([]string{req.URL.String(), proxy, account}, "\n")
+}
+
+// conditional returns whether req is a conditional request.
+func conditional(req *http.Request) bool {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match",
+		"If-Unmodified-Since", "If-Range"} {
+		if req.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasValidator(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// parseCacheControl returns the directives in a Cache-Control header (with lower-case names), and
+// treats "Pragma: no-cache" as "Cache-Control: no-cache".
+func parseCacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range h.Values("Cache-Control") {
+		for _, part := range splitUnquoted(value, ',') {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	if strings.EqualFold(h.Get("Pragma"), "no-cache") {
+		directives["no-cache"] = ""
+	}
+	return directives
+}
+
+// seconds parses a delta-seconds value from a Cache-Control directive.
+func seconds(value string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(min(n, int64(maxLifetime/time.Second))) * time.Second, true
+}
+
+// freshnessLifetime returns how long a response with the given header is fresh for, and whether
+// it can be stored at all.
+func freshnessLifetime(h http.Header, now time.Time) (time.Duration, bool) {
+	cc := parseCacheControl(h)
+	for _, directive := range []string{"no-store", "private"} {
+		if _, ok := cc[directive]; ok {
+			return 0, false
+		}
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0, true // It has to be revalidated every time
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cc[directive]; ok {
+			if d, ok := seconds(value); ok {
+				return d, true
+			}
+		}
+	}
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = now
+	}
+	if value := h.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil || expires.Before(date) {
+			return 0, true // Invalid dates mean it's already expired
+		}
+		return expires.Sub(date), true
+	}
+	if modified, err := http.ParseTime(h.Get("Last-Modified")); err == nil && modified.Before(date) {
+		return min(date.Sub(modified)/10, maxHeuristicLifetime), true
+	}
+	return 0, true
+}
+
+// age returns how old a stored response is now.
+func (rc *responseCache) age(entry *cachedResponse) time.Duration {
+	return entry.Age + rc.now().Sub(entry.Stored)
+}
+
+// fresh returns whether a stored response can be used for req without revalidating it.
+func (rc *responseCache) fresh(entry *cachedResponse, req *http.Request) bool {
+	age := rc.age(entry)
+	if age >= entry.Lifetime {
+		return false
+	}
+	cc := parseCacheControl(req.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	} else if value, ok := cc["max-age"]; ok {
+		if d, ok := seconds(value); ok && age > d {
+			return false
+		}
+	}
+	return true
+}
+
+// serve sends a stored response to the client. http.ServeContent deals with the client's
+// conditional and Range headers.
+func (rc *responseCache) serve(w http.ResponseWriter, req *http.Request, entry *cachedResponse) {
+	h := w.Header()
+	for k, vs := range entry.Header {
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Del("Content-Length") // ServeContent sets it, and it's different for a Range request
+	h.Set("Age", strconv.FormatInt(int64(rc.age(entry)/time.Second), 10))
+	modified, _ := http.ParseTime(entry.Header.Get("Last-Modified"))
+	http.ServeContent(w, req, "", modified, bytes.NewReader(entry.Body))
+}
+
+// uncachedHeaders aren't stored with a response. (Hop-by-hop headers have already been removed.)
+var uncachedHeaders = []string{"Age", "Content-Length", alpacaRequestIDHeader, proxyErrorHeader}
+
+// newEntry returns the response that cw recorded, if it can be stored under key.
+func (rc *responseCache) newEntry(key string, req *http.Request, cw *cacheWriter) *cachedResponse {
+	h := cw.header
+	if cw.status != http.StatusOK || cw.tooBig || h == nil {
+		return nil
+	} else if length, err := strconv.Atoi(h.Get("Content-Length")); err != nil ||
+		length != cw.body.Len() {
+		return nil // It might not be complete
+	} else if h.Get("Set-Cookie") != "" || h.Get("Trailer") != "" {
+		return nil
+	}
+	now := rc.now()
+	lifetime, ok := freshnessLifetime(h, now)
+	if !ok || (lifetime <= 0 && !hasValidator(h)) {
+		return nil
+	}
+	entry := &cachedResponse{
+		Key:      key,
+		URL:      req.URL.String(),
+		Header:   h.Clone(),
+		Stored:   now,
+		Lifetime: lifetime,
+		Body:     bytes.Clone(cw.body.Bytes()),
+	}
+	if d, ok := seconds(h.Get("Age")); ok {
+		entry.Age = d
+	}
+	for _, name := range uncachedHeaders {
+		entry.Header.Del(name)
+	}
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			} else if name != "" {
+				if entry.Vary == nil {
+					entry.Vary = make(map[string]string)
+				}
+				entry.Vary[http.CanonicalHeaderKey(name)] = requestHeader(req, name)
+			}
+		}
+	}
+	return entry
+}
+
+func requestHeader(req *http.Request, name string) string {
+	return strings.Join(req.Header.Values(name), ", ")
+}
+
+// matches returns whether a stored response can be used for req, given the headers that it varies
+// on.
+func (entry *cachedResponse) matches(req *http.Request) bool {
+	for name, value := range entry.Vary {
+		if requestHeader(req, name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// refresh updates a stored response with the headers from a 304 (Not Modified) response, and
+// resets its age.
+func (rc *responseCache) refresh(entry *cachedResponse, header http.Header) *cachedResponse {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for k, vs := range header {
+		if !strings.EqualFold(k, "Content-Length") {
+			updated.Header[k] = append([]string(nil), vs...)
+		}
+	}
+	for _, name := range uncachedHeaders {
+		updated.Header.Del(name)
+	}
+	now := rc.now()
+	updated.Stored, updated.Age = now, 0
+	if d, ok := seconds(header.Get("Age")); ok {
+		updated.Age = d
+	}
+	if lifetime, ok := freshnessLifetime(updated.Header, now); ok {
+		updated.Lifetime = lifetime
+	}
+	rc.put(&updated, true)
+	return &updated
+}
+
+// get returns the stored response for key, if there's one that can be used for req.
+func (rc *responseCache) get(key string, req *http.Request) *cachedResponse {
+	rc.mux.Lock()
+	elem, ok := rc.entries[key]
+	if ok {
+		rc.lru.MoveToFront(elem)
+	}
+	rc.mux.Unlock()
+	var entry *cachedResponse
+	if ok {
+		entry = elem.Value.(*cachedResponse)
+	} else if entry = rc.load(key); entry != nil {
+		rc.put(entry, false)
+	}
+	if entry == nil || !entry.matches(req) {
+		return nil
+	}
+	return entry
+}
+
+// put stores a response in memory (evicting the least recently used ones to make room), and if
+// save is set, on disk. It replaces any response that was stored under the same key.
+func (rc *responseCache) put(entry *cachedResponse, save bool) {
+	size := int64(len(entry.Body))
+	rc.mux.Lock()
+	if elem, ok := rc.entries[entry.Key]; ok {
+		rc.size -= int64(len(elem.Value.(*cachedResponse).Body))
+		rc.lru.Remove(elem)
+		delete(rc.entries, entry.Key)
+	}
+	if size > rc.maxSize/responseCacheEntryShare {
+		rc.mux.Unlock()
+		return
+	}
+	rc.entries[entry.Key] = rc.lru.PushFront(entry)
+	rc.size += size
+	for rc.size > rc.maxSize {
+		oldest := rc.lru.Remove(rc.lru.Back()).(*cachedResponse)
+		delete(rc.entries, oldest.Key)
+		rc.size -= int64(len(oldest.Body))
+	}
+	rc.mux.Unlock()
+	if save && rc.dir != "" {
+		if err := rc.save(entry); err != nil {
+			log.Printf("Error saving a response to the cache directory: %v", err)
+		}
+	}
+}
+
+func (rc *responseCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(rc.dir, "response-"+hex.EncodeToString(sum[:]))
+}
+
+// save writes a response to the cache directory. The file is replaced atomically, so that it's
+// never left half-written.
+func (rc *responseCache) save(entry *cachedResponse) error {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(rc.dir, "download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(meta, '\n'))
+	if err == nil {
+		_, err = f.Write(entry.Body)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), rc.path(entry.Key))
+	}
+	if err == nil {
+		rc.trim()
+	}
+	return err
+}
+
+// load reads the response for key from the cache directory, if it's there.
+func (rc *responseCache) load(key string) *cachedResponse {
+	if rc.dir == "" {
+		return nil
+	}
+	path := rc.path(key)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	meta, err := r.ReadBytes('\n')
+	var entry cachedResponse
+	if err == nil {
+		err = json.Unmarshal(meta, &entry)
+	}
+	if err == nil {
+		entry.Body, err = io.ReadAll(r)
+	}
+	if err != nil || entry.Key != key {
+		log.Printf("Removing a corrupt response from the cache directory: %s", path)
+		os.Remove(path)
+		return nil
+	}
+	now := rc.now()
+	_ = os.Chtimes(path, now, now) // Used to evict the least recently used responses
+	return &entry
+}
+
+// trim removes the least recently used responses until the cache directory is no bigger than its
+// maximum size.
+func (rc *responseCache) trim() {
+	if rc.maxDiskSize <= 0 {
+		return
+	}
+	rc.diskMux.Lock()
+	defer rc.diskMux.Unlock()
+	entries, err := os.ReadDir(rc.dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "response-") {
+			continue
+		} else if info, err := entry.Info(); err == nil {
+			files = append(files, info)
+			total += info.Size()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, info := range files {
+		if total <= rc.maxDiskSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(rc.dir, info.Name())); err == nil {
+			total -= info.Size()
+		}
+	}
+}
+
+// cacheWriter records a response as it's sent to the client, so that it can be stored. If the
+// request was sent to revalidate a stored response and the server says that it hasn't changed,
+// the 304 response isn't sent to the client, since the stored response is sent instead.
+type cacheWriter struct {
+	http.ResponseWriter
+	revalidating bool
+	limit        int64 // The most of the body to record
+	status       int
+	header       http.Header // The header, as it was when the status was sent
+	notModified  bool
+	body         bytes.Buffer
+	tooBig       bool
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	w.header = w.Header().Clone()
+	if w.revalidating && status == http.StatusNotModified {
+		w.notModified = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified {
+		return len(p), nil
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if w.status == http.StatusOK && !w.tooBig {
+		if int64(w.body.Len()+n) > w.limit {
+			w.tooBig = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,285 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newResponseCacheProxy returns a client that goes through a proxy with a response cache, which
+// sends requests through a second (upstream) proxy to a server that uses the given handler.
+func newResponseCacheProxy(t *testing.T, rc *responseCache, handler http.HandlerFunc) (
+	*http.Client, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	parent := httptest.NewServer(newDirectProxy())
+	t.Cleanup(parent.Close)
+	parentURL := &url.URL{Host: parent.Listener.Addr().String()}
+	cached := rc.WrapHandler(NewProxyHandler(nil, getProxyFromContext, func(string) {}))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), contextKeyProxy, parentURL)
+		cached.ServeHTTP(w, req.WithContext(ctx))
+	}))
+	t.Cleanup(proxy.Close)
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	return client, server
+}
+
+func TestResponseCacheServesFreshResponses(t *testing.T) {
+	rc, err := newResponseCache(1<<20, "", 0)
+	require.NoError(t, err)
+	now := time.Now()
+	rc.now = func() time.Time { return now }
+	requests := 0
+	client, server := newResponseCacheProxy(t, rc, func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("metadata"))
+	})
+	for i := 0; i < 3; i++ {
+		status, body := getBody(t, client, server.URL+"/Release")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "metadata", body)
+	}
+	assert.Equal(t, 1, requests)
+	// A client that asks for a fresh copy gets one.
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/Release", nil)
+	require.NoError(t, err)
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, requests)
+	// Once it's stale, it's fetched again.
+	now = now.Add(time.Minute)
+	resp, err = client.Get(server.URL + "/Release")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 3, requests)
+}
+
+func TestResponseCacheRevalidatesStaleResponses(t *testing.T) {
+	rc, err := newResponseCache(1<<20, "", 0)
+	require.NoError(t, err)
+	var conditional []string
+	client, server := newResponseCacheProxy(t, rc, func(w http.ResponseWriter, req *http.Request) {
+		conditional = append(conditional, req.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("index"))
+	})
+	for i := 0; i < 2; i++ {
+		status, body := getBody(t, client, server.URL+"/index.json")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "index", body)
+	}
+	// With no lifetime, it's revalidated every time.
+	assert.Equal(t, []string{"", `"v1"`}, conditional)
+	// The client's own conditional requests are answered from the cache too.
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/index.json", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", `"v1"`)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
+
+func TestResponseCacheSkipsUncacheableResponses(t *testing.T) {
+	rc, err := newResponseCache(1<<20, "", 0)
+	require.NoError(t, err)
+	requests := make(map[string]int)
+	client, server := newResponseCacheProxy(t, rc, func(w http.ResponseWriter, req *http.Request) {
+		requests[req.URL.Path]++
+		switch req.URL.Path {
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store, max-age=60")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/cookie":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "session=1")
+		case "/vary-all":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "*")
+		case "/not-found":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotFound)
+		}
+		_, _ = w.Write([]byte("body"))
+	})
+	for _, path := range []string{"/no-store", "/private", "/cookie", "/vary-all", "/not-found",
+		"/no-lifetime"} {
+		for i := 0; i < 2; i++ {
+			getBody(t, client, server.URL+path)
+		}
+		assert.Equal(t, 2, requests[path], path)
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	rc, err := newResponseCache(1<<20, "", 0)
+	require.NoError(t, err)
+	requests := 0
+	client, server := newResponseCacheProxy(t, rc, func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte(req.Header.Get("Accept-Language")))
+	})
+	get := func(lang string) string {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Language", lang)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		buf := make([]byte, 10)
+		n, _ := resp.Body.Read(buf)
+		return string(buf[:n])
+	}
+	assert.Equal(t, "en", get("en"))
+	assert.Equal(t, "en", get("en"))
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, "fr", get("fr"))
+	assert.Equal(t, 2, requests)
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	rc, err := newResponseCache(80, "", 0)
+	require.NoError(t, err)
+	for _, u := range []string{"http://a.test/", "http://b.test/", "http://c.test/"} {
+		rc.put(&cachedResponse{Key: u, Body: make([]byte, 10)}, false)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+	require.NotNil(t, rc.get("http://a.test/", req))
+	// Too big for the cache (each response can use an eighth of it).
+	rc.put(&cachedResponse{Key: "http://big.test/", Body: make([]byte, 11)}, false)
+	assert.Nil(t, rc.get("http://big.test/", req))
+	for _, u := range []string{"http://d.test/", "http://e.test/", "http://f.test/",
+		"http://g.test/", "http://h.test/", "http://i.test/"} {
+		rc.put(&cachedResponse{Key: u, Body: make([]byte, 10)}, false)
+	}
+	assert.Equal(t, int64(80), rc.size)
+	assert.NotNil(t, rc.get("http://a.test/", req))
+	assert.Nil(t, rc.get("http://b.test/", req))
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	rc, err := newResponseCache(1<<20, "", 0)
+	require.NoError(t, err)
+	account := `CORP\malory`
+	rc.identity = func() string { return account }
+	requests := 0
+	client, server := newResponseCacheProxy(t, rc, func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("metadata"))
+	})
+	getBody(t, client, server.URL+"/Release")
+	getBody(t, client, server.URL+"/Release")
+	assert.Equal(t, 1, requests)
+	// Another account doesn't get the first one's response.
+	account = `CORP\svc-build`
+	getBody(t, client, server.URL+"/Release")
+	assert.Equal(t, 2, requests)
+	account = `CORP\malory`
+	getBody(t, client, server.URL+"/Release")
+	assert.Equal(t, 2, requests)
+	// Nor does a request that goes through another proxy.
+	req := httptest.NewRequest(http.MethodGet, server.URL+"/Release", nil)
+	a := req.WithContext(context.WithValue(req.Context(), contextKeyProxy,
+		&url.URL{Host: "a.test:8080"}))
+	b := req.WithContext(context.WithValue(req.Context(), contextKeyProxy,
+		&url.URL{Host: "b.test:8080"}))
+	assert.NotEqual(t, rc.key(a), rc.key(b))
+	assert.Equal(t, rc.key(a), rc.key(a.Clone(a.Context())))
+}
+
+func TestResponseCacheOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	rc, err := newResponseCache(1<<20, dir, 1<<20)
+	require.NoError(t, err)
+	requests := 0
+	handler := func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("packages"))
+	}
+	client, server := newResponseCacheProxy(t, rc, handler)
+	getBody(t, client, server.URL+"/Packages")
+	require.Len(t, rc.entries, 1)
+	var key string
+	for key = range rc.entries {
+	}
+	// After a restart, the response is still there.
+	rc, err = newResponseCache(1<<20, dir, 1<<20)
+	require.NoError(t, err)
+	used := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rc.now = func() time.Time { return used }
+	entry := rc.get(key, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NotNil(t, entry)
+	// Loading it marks it as recently used.
+	info, err := os.Stat(rc.path(key))
+	require.NoError(t, err)
+	assert.True(t, used.Equal(info.ModTime()), info.ModTime())
+	assert.Equal(t, "packages", string(entry.Body))
+	assert.Equal(t, "text/plain", entry.Header.Get("Content-Type"))
+	assert.Equal(t, time.Minute, entry.Lifetime)
+	assert.Equal(t, 1, requests)
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+	tests := []struct {
+		header   http.Header
+		lifetime time.Duration
+		ok       bool
+	}{
+		{http.Header{"Cache-Control": {"max-age=300"}}, 5 * time.Minute, true},
+		{http.Header{"Cache-Control": {"max-age=300, s-maxage=60"}}, time.Minute, true},
+		{http.Header{"Cache-Control": {"no-cache"}}, 0, true},
+		{http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{http.Header{"Cache-Control": {`private="Set-Cookie"`}}, 0, false},
+		{http.Header{"Date": {date},
+			"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{http.Header{"Date": {date}, "Expires": {"0"}}, 0, true},
+		{http.Header{"Date": {date},
+			"Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{http.Header{"Date": {date},
+			"Last-Modified": {now.Add(-1000 * time.Hour).Format(http.TimeFormat)}},
+			maxHeuristicLifetime, true},
+		{http.Header{}, 0, true},
+	}
+	for _, test := range tests {
+		lifetime, ok := freshnessLifetime(test.header, now)
+		assert.Equal(t, test.lifetime, lifetime, test.header)
+		assert.Equal(t, test.ok, ok, test.header)
+	}
+}
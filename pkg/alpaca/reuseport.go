@@ -0,0 +1,116 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// reusePortName returns the name (for handing over to a new instance) of the i'th of the sockets
+// that are opened for a listener using -reuse-port. The first one has the listener's own name, so
+// that an instance that doesn't use -reuse-port can still take over from one that does (and the
+// others are closed).
+func reusePortName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "#" + strconv.Itoa(i+1)
+}
+
+// perWorker splits total between workers, rounding up so that each of them gets at least one.
+func perWorker(total, workers int) int {
+	return (total + workers - 1) / workers
+}
+
+// reusePortListener accepts connections from several sockets that are bound to the same address
+// using SO_REUSEPORT (see listenReusePort). The kernel spreads new connections across the
+// sockets, and each one has an accept loop of its own, so that a busy Alpaca (e.g. one that's
+// shared by a team) isn't limited by a single accept queue.
+type reusePortListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func newReusePortListener(listeners []net.Listener) *reusePortListener {
+	rl := &reusePortListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go rl.acceptLoop(l)
+	}
+	return rl
+}
+
+func (rl *reusePortListener) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// Pass the error on, so that the server can decide whether to carry on (e.g.
+			// after running out of file descriptors).
+			select {
+			case rl.errs <- err:
+			case <-rl.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		select {
+		case rl.conns <- conn:
+		case <-rl.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (rl *reusePortListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-rl.conns:
+		return conn, nil
+	case err := <-rl.errs:
+		return nil, err
+	case <-rl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (rl *reusePortListener) Close() error {
+	var err error
+	rl.once.Do(func() {
+		close(rl.closed)
+		for _, l := range rl.listeners {
+			if cerr := l.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (rl *reusePortListener) Addr() net.Addr {
+	return rl.listeners[0].Addr()
+}
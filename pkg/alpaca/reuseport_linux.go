@@ -0,0 +1,83 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenReusePort listens on a TCP address with the SO_REUSEPORT option set, so that other
+// sockets (in this process, or in other processes run by the same user) can listen on the same
+// address too. The kernel spreads new connections evenly across them.
+func listenReusePort(address string) (net.Listener, error) {
+	var sockErr error
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// skfNetOff is SKF_NET_OFF, from <linux/filter.h>, as an unsigned offset: a BPF load from
+// skfNetOff+n reads byte n of the packet's IP header.
+const skfNetOff = 0xfff00000
+
+// pinClients makes the kernel choose which of the sockets sharing l's address gets each new
+// connection by the client's IP address, rather than by its address and port, so that all of a
+// client's connections go to the same socket (and so the same worker process). sockets is the
+// number of sockets that share the address, across all of the processes; a process that starts
+// later replaces the program, so they should all agree on it.
+func pinClients(l net.Listener, sockets int) error {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("not a TCP listener: %T", l)
+	}
+	filter := []unix.SockFilter{
+		// A = the IP version, from the first byte of the IP header.
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: skfNetOff},
+		{Code: unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 6, Jt: 2},
+		// IPv4: A = the source address.
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfNetOff + 12},
+		{Code: unix.BPF_JMP | unix.BPF_JA, K: 1},
+		// IPv6: A = the last 32 bits of the source address.
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfNetOff + 20},
+		// Return the index of the socket to use.
+		{Code: unix.BPF_ALU | unix.BPF_MOD | unix.BPF_K, K: uint32(sockets)},
+		{Code: unix.BPF_RET | unix.BPF_A},
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	raw, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET,
+			unix.SO_ATTACH_REUSEPORT_CBPF, &prog)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
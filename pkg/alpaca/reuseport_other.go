@@ -0,0 +1,32 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package alpaca
+
+import (
+	"errors"
+	"net"
+)
+
+// listenReusePort isn't implemented on this platform. Other platforms either don't have
+// SO_REUSEPORT, or don't spread connections across the sockets that share a port.
+func listenReusePort(address string) (net.Listener, error) {
+	return nil, errors.New("-reuse-port is only supported on Linux")
+}
+
+func pinClients(l net.Listener, sockets int) error {
+	return errors.New("-pin-clients is only supported on Linux")
+}
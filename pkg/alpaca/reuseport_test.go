@@ -0,0 +1,104 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReusePortName(t *testing.T) {
+	assert.Equal(t, "http/127.0.0.1:3128", reusePortName("http/127.0.0.1:3128", 0))
+	assert.Equal(t, "http/127.0.0.1:3128#3", reusePortName("http/127.0.0.1:3128", 2))
+}
+
+func TestReusePortListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only used on Linux")
+	}
+	l1, err := listenReusePort("127.0.0.1:0")
+	require.NoError(t, err)
+	l2, err := listenReusePort(l1.Addr().String())
+	require.NoError(t, err)
+	rl := newReusePortListener([]net.Listener{l1, l2})
+	defer rl.Close()
+	assert.Equal(t, l1.Addr(), rl.Addr())
+	// A plain listener can't share the port.
+	_, err = net.Listen("tcp", l1.Addr().String())
+	assert.Error(t, err)
+	// Every connection is accepted, whichever socket the kernel chooses for it.
+	for i := 0; i < 10; i++ {
+		client, err := net.Dial("tcp", rl.Addr().String())
+		require.NoError(t, err)
+		server, err := rl.Accept()
+		require.NoError(t, err)
+		_, err = client.Write([]byte{byte(i)})
+		require.NoError(t, err)
+		buf := make([]byte, 1)
+		_, err = server.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, byte(i), buf[0])
+		client.Close()
+		server.Close()
+	}
+	require.NoError(t, rl.Close())
+	_, err = rl.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = net.Dial("tcp", l1.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestPinClients(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only used on Linux")
+	}
+	l1, err := listenReusePort("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l1.Close()
+	l2, err := listenReusePort(l1.Addr().String())
+	require.NoError(t, err)
+	defer l2.Close()
+	require.NoError(t, pinClients(l1, 2))
+	// 127.0.0.1 is 0x7f000001, which is odd, so every connection goes to the second socket.
+	go func() {
+		for i := 0; i < 10; i++ {
+			if c, err := net.Dial("tcp", l1.Addr().String()); err == nil {
+				defer c.Close()
+			}
+		}
+	}()
+	require.NoError(t, l2.(*net.TCPListener).SetDeadline(time.Now().Add(5*time.Second)))
+	for i := 0; i < 10; i++ {
+		c, err := l2.Accept()
+		require.NoError(t, err)
+		c.Close()
+	}
+	require.NoError(t, l1.(*net.TCPListener).SetDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = l1.Accept()
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestPerWorker(t *testing.T) {
+	assert.Equal(t, 16, perWorker(16, 1))
+	assert.Equal(t, 4, perWorker(16, 4))
+	assert.Equal(t, 6, perWorker(16, 3))
+	assert.Equal(t, 1, perWorker(2, 4))
+}
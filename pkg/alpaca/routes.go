@@ -0,0 +1,120 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// routeRule sends the requests from a process, or to a port, to a fixed proxy (or DIRECT).
+type routeRule struct {
+	process string // The name of the client process, if set
+	port    string // The destination port, if set
+	result  string // A PAC-style result, e.g. "PROXY proxy.example.com:8080" or "DIRECT"
+}
+
+func (r routeRule) String() string {
+	if r.process != "" {
+		return "process=" + r.process + " " + r.result
+	}
+	return "port=" + r.port + " " + r.result
+}
+
+// routingRules are overrides that are checked before the PAC file. They're given by the -route
+// flag, as a comma-separated list of rules like "process=git PROXY proxy.example.com:8080" or
+// "port=22 DIRECT".
+type routingRules struct {
+	rules []routeRule
+	// processName returns the name of the process that owns the client end of a connection to
+	// Alpaca, or the empty string if it can't be found. serverAddr is Alpaca's end of the
+	// connection, or the empty string if it isn't known.
+	processName func(clientAddr, serverAddr string) string
+}
+
+func parseRoutingRules(value string) (*routingRules, error) {
+	rr := &routingRules{processName: processName}
+	for _, elem := range strings.Split(value, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		match, result, ok := strings.Cut(elem, " ")
+		key, arg, hasArg := strings.Cut(match, "=")
+		if !ok || !hasArg || arg == "" {
+			return nil, fmt.Errorf("invalid routing rule %q", elem)
+		}
+		rule := routeRule{result: strings.TrimSpace(result)}
+		switch key {
+		case "process":
+			rule.process = arg
+		case "port":
+			if _, err := strconv.ParseUint(arg, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid port in routing rule %q", elem)
+			}
+			rule.port = arg
+		default:
+			return nil, fmt.Errorf("invalid routing rule %q (expected process= or port=)", elem)
+		}
+		if err := validatePACResult(rule.result); err != nil {
+			return nil, fmt.Errorf("invalid proxy in routing rule %q: %w", elem, err)
+		}
+		rr.rules = append(rr.rules, rule)
+	}
+	return rr, nil
+}
+
+// match returns the first rule that applies to the request.
+func (rr *routingRules) match(req *http.Request) (routeRule, bool) {
+	var process string
+	var checkedProcess bool
+	for _, rule := range rr.rules {
+		if rule.port != "" && rule.port == requestPort(req) {
+			return rule, true
+		} else if rule.process == "" {
+			continue
+		}
+		if !checkedProcess {
+			var serverAddr string
+			if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				serverAddr = addr.String()
+			}
+			process = rr.processName(req.RemoteAddr, serverAddr)
+			checkedProcess = true
+		}
+		if process != "" && process == rule.process {
+			return rule, true
+		}
+	}
+	return routeRule{}, false
+}
+
+// requestPort returns the destination port of a request, e.g. "22" for "CONNECT git.test:22", or
+// "80" for "GET http://www.test/".
+func requestPort(req *http.Request) string {
+	if port := req.URL.Port(); port != "" {
+		return port
+	}
+	switch req.URL.Scheme {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoutingRules(t *testing.T) {
+	rr, err := parseRoutingRules(
+		"process=git PROXY proxy.test:8080; DIRECT, port=22 DIRECT,")
+	require.NoError(t, err)
+	assert.Equal(t, []routeRule{
+		{process: "git", result: "PROXY proxy.test:8080; DIRECT"},
+		{port: "22", result: "DIRECT"},
+	}, rr.rules)
+	rr, err = parseRoutingRules("")
+	require.NoError(t, err)
+	assert.Empty(t, rr.rules)
+}
+
+func TestParseInvalidRoutingRules(t *testing.T) {
+	for _, value := range []string{
+		"process=git",
+		"git PROXY proxy.test:8080",
+		"process= DIRECT",
+		"user=me DIRECT",
+		"port=ssh DIRECT",
+		"port=65536 DIRECT",
+		"port=22 SOCKS socks.test:1080",
+		"port=22 PROXY",
+		"port=22 HTTPS a.test:443 b.test:443",
+		"port=22 DIRECT a.test:80",
+	} {
+		_, err := parseRoutingRules(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRoutingRulesMatch(t *testing.T) {
+	rr, err := parseRoutingRules("process=ssh DIRECT, port=8443 PROXY a.test:80, port=80 DIRECT")
+	require.NoError(t, err)
+	var lookups int
+	process := "curl"
+	rr.processName = func(string, string) string {
+		lookups++
+		return process
+	}
+	connect := httptest.NewRequest(http.MethodConnect, "http://git.test:8443", nil)
+	connect.URL = &url.URL{Host: "git.test:8443"}
+	rule, ok := rr.match(connect)
+	require.True(t, ok)
+	assert.Equal(t, "PROXY a.test:80", rule.result)
+	rule, ok = rr.match(httptest.NewRequest(http.MethodGet, "http://www.test/", nil))
+	require.True(t, ok)
+	assert.Equal(t, "port=80 DIRECT", rule.String())
+	_, ok = rr.match(httptest.NewRequest(http.MethodGet, "https://www.test/", nil))
+	assert.False(t, ok)
+	assert.Equal(t, 3, lookups)
+	process = "ssh"
+	rule, ok = rr.match(httptest.NewRequest(http.MethodGet, "https://www.test/", nil))
+	require.True(t, ok)
+	assert.Equal(t, "process=ssh DIRECT", rule.String())
+}
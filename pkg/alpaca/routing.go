@@ -0,0 +1,186 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
+)
+
+// routingProvider decides how requests are sent, based on the routing configuration that
+// ProxyFinder downloads from the PAC URL. This is usually a PAC file (see PACRunner), but some
+// secure web gateways publish their routing in other formats.
+type routingProvider interface {
+	// Update replaces the provider's configuration.
+	Update(config []byte) error
+	// FindProxyForURL returns a PAC-style result for u, e.g. "PROXY proxy.test:8080; DIRECT".
+	FindProxyForURL(u url.URL) (string, error)
+}
+
+// pacScripter is implemented by routing providers whose configuration isn't a PAC file, to give
+// a PAC file that's equivalent to it, which PACWrapper can serve to clients.
+type pacScripter interface {
+	pacScript() []byte
+}
+
+// routingFormat is a format of routing configuration that Alpaca understands.
+type routingFormat struct {
+	name        string
+	description string // For log messages, e.g. "PAC JS"
+	// detect returns true if config is in this format.
+	detect func(config []byte) bool
+	// newProvider returns an empty provider for this format, for the given ProxyFinder.
+	newProvider func(pf *ProxyFinder) routingProvider
+}
+
+// routingFormats are the supported formats, in the order in which they're detected. PAC comes
+// last, since anything that isn't in another format is treated as JavaScript.
+var routingFormats = []routingFormat{
+	{
+		name:        "JSON",
+		description: "JSON proxy config",
+		detect:      isJSONRouting,
+		newProvider: func(*ProxyFinder) routingProvider { return &jsonRouting{} },
+	},
+	{
+		name:        "PAC",
+		description: "PAC JS",
+		detect:      func([]byte) bool { return true },
+		newProvider: func(pf *ProxyFinder) routingProvider {
+			return &PACRunner{myIP: pf.myIP, timeout: pacTimeout, traces: pacTraces}
+		},
+	},
+}
+
+func detectRoutingFormat(config []byte) routingFormat {
+	for _, format := range routingFormats {
+		if format.detect(config) {
+			return format
+		}
+	}
+	return routingFormats[len(routingFormats)-1]
+}
+
+func isJSONRouting(config []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(config), []byte("{"))
+}
+
+// jsonRouting is a routing provider for a JSON "proxy config", which lists host patterns (as for
+// shExpMatch) and the PAC-style result to use for them. The first matching rule wins:
+//
+//	{
+//	  "rules": [
+//	    {"hosts": ["*.corp.example.com", "intranet"], "proxy": "DIRECT"},
+//	    {"hosts": ["*.saas.example.com"], "proxy": "PROXY saas-proxy.example.com:8080"}
+//	  ],
+//	  "default": "PROXY proxy.example.com:8080; DIRECT"
+//	}
+type jsonRouting struct {
+	config jsonRoutingConfig
+	rules  []jsonRoutingRule
+	mux    sync.Mutex
+}
+
+type jsonRoutingConfig struct {
+	Rules []struct {
+		Hosts []string `json:"hosts"`
+		Proxy string   `json:"proxy"`
+	} `json:"rules"`
+	Default string `json:"default"`
+}
+
+type jsonRoutingRule struct {
+	globs []glob.Glob
+	proxy string
+}
+
+func (jr *jsonRouting) Update(config []byte) error {
+	var c jsonRoutingConfig
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return fmt.Errorf("invalid JSON proxy config: %w", err)
+	}
+	if c.Default == "" {
+		return errors.New(`invalid JSON proxy config: missing "default"`)
+	} else if err := validatePACResult(c.Default); err != nil {
+		return fmt.Errorf("invalid JSON proxy config: default: %w", err)
+	}
+	rules := make([]jsonRoutingRule, len(c.Rules))
+	for i, r := range c.Rules {
+		if len(r.Hosts) == 0 {
+			return fmt.Errorf("invalid JSON proxy config: rule %d has no hosts", i+1)
+		} else if err := validatePACResult(r.Proxy); err != nil {
+			return fmt.Errorf("invalid JSON proxy config: rule %d: %w", i+1, err)
+		}
+		for _, host := range r.Hosts {
+			g, err := glob.Compile(asciiPattern(strings.ToLower(host)))
+			if err != nil {
+				return fmt.Errorf("invalid JSON proxy config: rule %d: invalid host %q: %w",
+					i+1, host, err)
+			}
+			rules[i].globs = append(rules[i].globs, g)
+		}
+		rules[i].proxy = r.Proxy
+	}
+	jr.mux.Lock()
+	defer jr.mux.Unlock()
+	jr.config, jr.rules = c, rules
+	return nil
+}
+
+func (jr *jsonRouting) FindProxyForURL(u url.URL) (string, error) {
+	host := canonicalHost(u.Hostname())
+	jr.mux.Lock()
+	defer jr.mux.Unlock()
+	for _, rule := range jr.rules {
+		for _, g := range rule.globs {
+			if g.Match(host) {
+				return rule.proxy, nil
+			}
+		}
+	}
+	return jr.config.Default, nil
+}
+
+// pacScript returns a PAC script that makes the same decisions as the config, for clients that
+// fetch Alpaca's PAC file.
+func (jr *jsonRouting) pacScript() []byte {
+	jr.mux.Lock()
+	defer jr.mux.Unlock()
+	quote := func(s string) string {
+		b, _ := json.Marshal(s) // A JSON string is also a valid JavaScript string literal.
+		return string(b)
+	}
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+	for _, rule := range jr.config.Rules {
+		var conds []string
+		for _, host := range rule.Hosts {
+			conds = append(conds, "shExpMatch(host, "+quote(strings.ToLower(host))+")")
+		}
+		fmt.Fprintf(&b, "  if (%s) return %s;\n", strings.Join(conds, " || "), quote(rule.Proxy))
+	}
+	fmt.Fprintf(&b, "  return %s;\n}\n", quote(jr.config.Default))
+	return []byte(b.String())
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testJSONRouting = `{
+	"rules": [
+		{"hosts": ["*.corp.test", "intranet"], "proxy": "DIRECT"},
+		{"hosts": ["*.saas.test"], "proxy": "PROXY saas-proxy.test:8080; DIRECT"}
+	],
+	"default": "PROXY proxy.test:80"
+}`
+
+func TestJSONRouting(t *testing.T) {
+	jr := &jsonRouting{}
+	require.NoError(t, jr.Update([]byte(testJSONRouting)))
+	pr := &PACRunner{}
+	require.NoError(t, pr.Update(jr.pacScript()))
+	tests := []struct{ host, expected string }{
+		{"www.corp.test", "DIRECT"},
+		{"WWW.CORP.TEST", "DIRECT"},
+		{"intranet", "DIRECT"},
+		{"app.saas.test", "PROXY saas-proxy.test:8080; DIRECT"},
+		{"example.test", "PROXY proxy.test:80"},
+	}
+	for _, test := range tests {
+		u := url.URL{Scheme: "https", Host: test.host}
+		result, err := jr.FindProxyForURL(u)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, result, test.host)
+		// The generated PAC file should make the same decision.
+		result, err = pr.FindProxyForURL(u)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, result, test.host)
+	}
+}
+
+func TestJSONRoutingInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"rules": []}`,
+		`{"default": "SOCKS socks.test:1080"}`,
+		`{"default": "PROXY"}`,
+		`{"default": "DIRECT", "rules": [{"hosts": [], "proxy": "DIRECT"}]}`,
+		`{"default": "DIRECT", "rules": [{"hosts": ["[a"], "proxy": "DIRECT"}]}`,
+		`{"default": "DIRECT", "bypass": []}`,
+		`{"default": `,
+	} {
+		assert.Error(t, (&jsonRouting{}).Update([]byte(config)), config)
+	}
+}
+
+func TestDetectRoutingFormat(t *testing.T) {
+	assert.Equal(t, "JSON", detectRoutingFormat([]byte(" \n{\"default\": \"DIRECT\"}")).name)
+	assert.Equal(t, "PAC", detectRoutingFormat([]byte("function FindProxyForURL() {}")).name)
+	assert.Equal(t, "PAC", detectRoutingFormat(nil).name)
+}
+
+func TestProxyFinderWithJSONRouting(t *testing.T) {
+	config := testJSONRouting
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write([]byte(config))
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+	pw := NewPACWrapper(PACData{Port: 1})
+	pf := NewProxyFinder([]string{server.URL}, pw, myIPAuto)
+	req := httptest.NewRequest(http.MethodGet, "https://app.saas.test/", nil)
+	proxy, err := pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	require.NotNil(t, proxy)
+	assert.Equal(t, "saas-proxy.test:8080", proxy.Host)
+	assert.Contains(t, pw.upstreamPAC(), `shExpMatch(host, "*.saas.test")`)
+
+	// If the server switches to a PAC file, so should the ProxyFinder.
+	config = `function FindProxyForURL(url, host) { return "DIRECT" }`
+	pf.fetcher.refreshInterval = time.Hour
+	pf.fetcher.fetched = time.Time{}
+	pf.checkForUpdates()
+	proxy, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Nil(t, proxy)
+	assert.Equal(t, "PAC", pf.format)
+}
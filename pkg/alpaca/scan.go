@@ -0,0 +1,148 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// scanTimeout is how long to wait for a scanner to check an upload (or a download).
+const scanTimeout = 30 * time.Second
+
+// bodyScanner checks request bodies before they're sent upstream, e.g. for data loss prevention
+// (DLP). scan returns an error wrapping ErrUploadBlocked if the body mustn't be sent, or another
+// error if it couldn't be checked.
+type bodyScanner interface {
+	scan(ctx context.Context, req *http.Request, body []byte) error
+}
+
+// newBodyScanner returns the scanner given by -scan-uploads: an ICAP server, if it's an icap://
+// URL, or otherwise a command.
+func newBodyScanner(value string) (bodyScanner, error) {
+	if !strings.HasPrefix(value, "icap://") {
+		return &execScanner{command: value, execCommand: exec.Command}, nil
+	}
+	return newICAPClient(value)
+}
+
+// uploadScanner sends request bodies to a bodyScanner, and only sends them upstream if it allows
+// them. Bodies are read into memory to be scanned, so bigger ones than maxBody are blocked. Only
+// plain HTTP requests can be scanned, since HTTPS ones are sent through CONNECT tunnels.
+type uploadScanner struct {
+	scanner bodyScanner
+	domains []string // If set, only uploads to these domains (see parseDomainList) are scanned
+	maxBody int64
+}
+
+func newUploadScanner(scanner bodyScanner, domains []string, maxBody int64) *uploadScanner {
+	return &uploadScanner{scanner: scanner, domains: domains, maxBody: maxBody}
+}
+
+// applies returns whether uploads to host are scanned.
+func (us *uploadScanner) applies(host string) bool {
+	return len(us.domains) == 0 || inDomains(host, us.domains)
+}
+
+func (us *uploadScanner) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodConnect || req.URL.Scheme == "" || req.ContentLength == 0 ||
+			!us.applies(req.URL.Hostname()) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		id := req.Context().Value(contextKeyID)
+		body, err := io.ReadAll(io.LimitReader(req.Body, us.maxBody+1))
+		if err != nil {
+			log.Printf("[%d] Error reading request body: %v", id, err)
+			writeProxyError(w, req, requestBodyErrorStatus(err), stageRequest, nil, err)
+			return
+		}
+		if int64(len(body)) > us.maxBody {
+			err = fmt.Errorf("%w: the body is bigger than -scan-max-body (%d bytes), so it "+
+				"can't be scanned", ErrUploadBlocked, us.maxBody)
+		} else if len(body) > 0 {
+			err = us.scanner.scan(req.Context(), req, body)
+		}
+		if errors.Is(err, ErrUploadBlocked) {
+			log.Printf("[%d] %s %s: %v", id, req.Method, logURL(req.URL), err)
+			writeProxyError(w, req, http.StatusForbidden, stageRequest, nil, err)
+			return
+		} else if err != nil {
+			// Rather than letting the upload through unchecked.
+			err = fmt.Errorf("error scanning upload: %w", err)
+			log.Printf("[%d] %s %s: %v", id, req.Method, logURL(req.URL), err)
+			writeProxyError(w, req, http.StatusBadGateway, stageRequest, nil, err)
+			return
+		}
+		// The client has sent the whole body now, so it doesn't need to be streamed.
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.TransferEncoding = nil
+		req.Header.Del("Expect")
+		next.ServeHTTP(w, req)
+	})
+}
+
+// execScanner runs a command (using the shell, like a credential helper) to scan each upload.
+// The body is written to its stdin, and the method, URL and content type are given in the
+// ALPACA_METHOD, ALPACA_URL and ALPACA_CONTENT_TYPE environment variables. It prints key=value
+// lines: verdict=allow or verdict=block, and optionally a reason.
+type execScanner struct {
+	command     string
+	execCommand func(name string, arg ...string) *exec.Cmd
+}
+
+func (es *execScanner) scan(ctx context.Context, req *http.Request, body []byte) error {
+	cmd := shellCommand(es.execCommand, es.command)
+	cmd.Env = append(os.Environ(), "ALPACA_METHOD="+req.Method,
+		"ALPACA_URL="+req.URL.Redacted(), "ALPACA_CONTENT_TYPE="+req.Header.Get("Content-Type"))
+	cmd.Stdin = bytes.NewReader(body)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	// Don't wait for any background processes that it leaves running.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error running upload scanner %q: %w", es.command, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = cmd.Process.Kill() })
+	defer stop()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("error running upload scanner %q: %w", es.command, err)
+	}
+	result, err := parseHelperOutput(stdout.Bytes())
+	if err != nil {
+		return err
+	}
+	switch result["verdict"] {
+	case "allow":
+		return nil
+	case "block":
+		return fmt.Errorf("%w: %s", ErrUploadBlocked, cmp.Or(result["reason"], "no reason given"))
+	}
+	return fmt.Errorf("upload scanner returned an invalid verdict %q", result["verdict"])
+}
@@ -0,0 +1,185 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// secretScanner blocks bodies that contain "secret".
+type secretScanner struct {
+	scanned []string
+}
+
+func (ss *secretScanner) scan(_ context.Context, _ *http.Request, body []byte) error {
+	ss.scanned = append(ss.scanned, string(body))
+	if bytes.Contains(body, []byte("secret")) {
+		return fmt.Errorf("%w: found a secret", ErrUploadBlocked)
+	}
+	return nil
+}
+
+func TestUploadScanning(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		got = append(got, string(body))
+	}))
+	defer server.Close()
+	scanner := &secretScanner{}
+	us := newUploadScanner(scanner, parseDomainList("127.0.0.1"), 16)
+	proxy := httptest.NewServer(us.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	status, _ := postBody(t, client, server.URL, strings.NewReader("hello"))
+	assert.Equal(t, http.StatusOK, status)
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("a secret"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "upload_blocked", resp.Header.Get(proxyErrorHeader))
+	// Bodies that are too big to scan are blocked, without being scanned.
+	status, _ = postBody(t, client, server.URL, strings.NewReader(strings.Repeat("x", 17)))
+	assert.Equal(t, http.StatusForbidden, status)
+	// Uploads to other hosts aren't scanned.
+	other := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	status, _ = postBody(t, client, other, strings.NewReader("another secret"))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"hello", "a secret"}, scanner.scanned)
+	assert.Equal(t, []string{"hello", "another secret"}, got)
+}
+
+func TestUploadScannerApplies(t *testing.T) {
+	us := newUploadScanner(nil, parseDomainList("*.Example.com, .upload.test"), 0)
+	assert.True(t, us.applies("example.com"))
+	assert.True(t, us.applies("www.EXAMPLE.com"))
+	assert.True(t, us.applies("upload.test"))
+	assert.False(t, us.applies("notexample.com"))
+	assert.False(t, us.applies("test"))
+	assert.True(t, newUploadScanner(nil, nil, 0).applies("anything.test"))
+}
+
+func TestExecScanner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands need a Unix shell")
+	}
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.com/upload", nil)
+	req.Header.Set("Content-Type", "text/plain")
+	tests := []struct {
+		command string
+		err     string
+	}{
+		{"cat >/dev/null; echo verdict=allow", ""},
+		{`grep -q secret && printf 'verdict=block\nreason=found a secret\n'`,
+			"upload blocked by scanner: found a secret"},
+		{`cat >/dev/null; echo verdict=block; echo "reason=$ALPACA_METHOD $ALPACA_URL ` +
+			`$ALPACA_CONTENT_TYPE"`, "upload blocked by scanner: POST " +
+			"http://www.example.com/upload text/plain"},
+		{"echo verdict=block", "upload blocked by scanner: no reason given"},
+		{"echo verdict=maybe", `upload scanner returned an invalid verdict "maybe"`},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			scanner, err := newBodyScanner(test.command)
+			require.NoError(t, err)
+			err = scanner.scan(context.Background(), req, []byte("a secret"))
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.err)
+			}
+		})
+	}
+	// If the command fails, the upload couldn't be checked (rather than being blocked).
+	scanner, err := newBodyScanner("exit 1")
+	require.NoError(t, err)
+	err = scanner.scan(context.Background(), req, []byte("hello"))
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUploadBlocked)
+}
+
+// icapServer is a fake ICAP server, which blocks bodies that contain "secret".
+func icapServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			serveICAP(t, conn)
+		}
+	}()
+	return l
+}
+
+func serveICAP(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "REQMOD icap://"), line)
+	header, err := tp.ReadMIMEHeader()
+	require.NoError(t, err)
+	assert.Equal(t, "204", header.Get("Allow"))
+	req, err := http.ReadRequest(br)
+	require.NoError(t, err)
+	assert.Empty(t, req.Header.Get("Proxy-Authorization"))
+	body, err := io.ReadAll(httputil.NewChunkedReader(br))
+	require.NoError(t, err)
+	if !bytes.Contains(body, []byte("secret")) {
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\n\r\n"))
+		return
+	}
+	resp := "HTTP/1.1 403 Forbidden\r\n\r\n"
+	_, _ = fmt.Fprintf(conn, "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=%d\r\n\r\n%s",
+		len(resp), resp)
+}
+
+func TestICAPScanner(t *testing.T) {
+	l := icapServer(t)
+	defer l.Close()
+	scanner, err := newBodyScanner("icap://" + l.Addr().String() + "/reqmod")
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.com/upload", nil)
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	assert.NoError(t, scanner.scan(context.Background(), req, []byte("hello")))
+	err = scanner.scan(context.Background(), req, []byte("a secret"))
+	assert.EqualError(t, err,
+		"upload blocked by scanner: the ICAP server responded with 403 Forbidden")
+}
+
+func TestInvalidICAPURL(t *testing.T) {
+	_, err := newBodyScanner("icap://")
+	assert.Error(t, err)
+}
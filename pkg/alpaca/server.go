@@ -0,0 +1,169 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alpaca is a local HTTP proxy for command-line tools, which supports proxy
+// auto-configuration (PAC) files and NTLM authentication. It's what the alpaca command runs (see
+// Main), and it can also be embedded in other Go programs, such as IDE plugins and CLI tools,
+// using New. Only Config, Server, New and Main, and the test harness (Harness, NewHarness,
+// Scenario, ScenarioExpect, ScenarioResult and LoadScenarios) are meant to be used by other
+// programs; the rest of the package's exported identifiers may change between versions.
+//
+// Each Server has its own configuration, and keeps what it learns about upstream proxies (such as
+// the auth schemes that they offer, and their latencies) to itself, so more than one can run in
+// the same program. The settings that only the alpaca command has flags for (such as header
+// rules, host mappings, the PAC cache and TLS client certificates) are process-wide: Main sets
+// them, and Servers created by New use their defaults. The default dialer's record of recent DNS
+// and connection failures is shared too.
+//
+// A Server reports what goes wrong using the errors declared in this package (ErrAuthRejected,
+// ErrPACUnavailable, ErrUpstreamBlocked, ErrTooManyConnections, ErrProxyLoop, ErrUploadBlocked and
+// ErrDownloadBlocked), which are wrapped with more detail: errors sent to clients are passed to
+// Config.OnError, and Server.PACError returns ErrPACUnavailable.
+//
+// Like the alpaca command, the proxy logs using the standard log package.
+package alpaca
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/samuong/go-ntlmssp"
+)
+
+// Config configures a Server. The zero value of each field gives the same default behaviour as
+// the alpaca command (apart from Port and PACRefresh).
+type Config struct {
+	// Host and Port are the address to listen on. Host defaults to localhost, and if Port is
+	// 0, a free port is chosen (see Server.Addr).
+	Host string
+	Port int
+	// PACURLs are the PAC files to use, in order of preference. If it's empty, the system's
+	// PAC URL is used, if it has one.
+	PACURLs []string
+	// PACRefresh is how often to check the PAC file for changes. If it's 0, it's only checked
+	// when the network changes.
+	PACRefresh time.Duration
+	// Domain, Username and Password are the proxy account, for NTLM (and other) authentication
+	// to upstream proxies. If Username is empty, requests are sent without authentication.
+	Domain   string
+	Username string
+	Password string
+	// Dial, if set, is used for all of the server's outgoing connections, to proxies and
+	// servers, instead of the network.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// OnError, if set, is called with each error that's sent to a client instead of a
+	// response, and when an upstream proxy rejects the credentials. Where they apply, the
+	// errors wrap ErrAuthRejected, ErrUpstreamBlocked and the package's other Err values, so
+	// use errors.Is to check for them. It's called while the request is being served, so it
+	// may be called from more than one goroutine at once.
+	OnError func(req *http.Request, err error)
+}
+
+// Server is an embedded proxy, which is created by New.
+type Server struct {
+	config  Config
+	auth    proxyAuth
+	tunnels *tunnelTracker
+
+	mux      sync.Mutex
+	server   *http.Server
+	listener net.Listener
+	finder   *ProxyFinder
+}
+
+// New returns a Server with the given configuration, which starts listening when Start is
+// called.
+func New(config Config) (*Server, error) {
+	if config.Port < 0 || config.Port > 65535 {
+		return nil, errors.New("invalid port: " + strconv.Itoa(config.Port))
+	} else if config.PACRefresh < 0 {
+		return nil, errors.New("invalid PAC refresh interval: " + config.PACRefresh.String())
+	}
+	config.Host = cmp.Or(config.Host, "localhost")
+	s := &Server{config: config, tunnels: newTunnelTracker()}
+	if config.Username != "" {
+		s.auth = &authenticator{
+			domain:   config.Domain,
+			username: config.Username,
+			hash:     ntlmssp.GetNtlmHash(config.Password),
+			password: config.Password,
+		}
+	}
+	return s, nil
+}
+
+// Start starts listening, and serves requests in the background until Shutdown is called.
+func (s *Server) Start() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.server != nil {
+		return errors.New("the server has already been started")
+	}
+	addr := net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	// The served PAC file points at the port that's actually being listened on.
+	port := l.Addr().(*net.TCPAddr).Port
+	s.server = createServer(s.config.Host, port, s.config.PACURLs, s.auth, s.tunnels,
+		serverOptions{
+			pacRefresh: s.config.PACRefresh,
+			dial:       s.config.Dial,
+			onError:    s.config.OnError,
+			finder:     &s.finder,
+		})
+	s.listener = l
+	go func() { _ = s.server.Serve(l) }()
+	return nil
+}
+
+// Addr returns the address that the server is listening on, or nil if it hasn't been started.
+func (s *Server) Addr() net.Addr {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// PACError returns why the PAC file couldn't be found or downloaded, the last time that the server
+// tried, wrapping ErrPACUnavailable. It returns nil if the PAC file was downloaded (or the system's
+// proxy settings are used instead of one), or if the server hasn't been started.
+func (s *Server) PACError() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.finder == nil {
+		return nil
+	}
+	return s.finder.pacError()
+}
+
+// Shutdown stops listening, and waits for requests in progress to finish (see
+// http.Server.Shutdown). HTTPS tunnels that are still open are left to finish on their own.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedServer(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "DIRECT" }`
+	pacServer := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer pacServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	s, err := New(Config{Host: "127.0.0.1", PACURLs: []string{pacServer.URL}})
+	require.NoError(t, err)
+	assert.Nil(t, s.Addr())
+	require.NoError(t, s.Start())
+	assert.Error(t, s.Start())
+	proxyURL := &url.URL{Scheme: "http", Host: s.Addr().String()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	// The served PAC file points at the port that was chosen.
+	resp, err = http.Get(proxyURL.String() + "/alpaca.pac")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	port := strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+	assert.Contains(t, string(body), "PROXY localhost:"+port)
+	require.NoError(t, s.Shutdown(context.Background()))
+	_, err = client.Get(server.URL)
+	assert.Error(t, err)
+}
+
+func TestNewServerInvalidConfig(t *testing.T) {
+	_, err := New(Config{Port: 70000})
+	assert.Error(t, err)
+	_, err = New(Config{PACRefresh: -1})
+	assert.Error(t, err)
+	s, err := New(Config{Domain: "corp", Username: "malory", Password: "guest"})
+	require.NoError(t, err)
+	assert.Equal(t, "localhost", s.config.Host)
+	require.IsType(t, &authenticator{}, s.auth)
+	assert.Equal(t, "malory", s.auth.(*authenticator).username)
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
+
+func TestEmbeddedServerPACError(t *testing.T) {
+	pacServer := httptest.NewServer(http.NotFoundHandler())
+	defer pacServer.Close()
+	s, err := New(Config{Host: "127.0.0.1", PACURLs: []string{pacServer.URL}})
+	require.NoError(t, err)
+	assert.NoError(t, s.PACError())
+	require.NoError(t, s.Start())
+	defer s.Shutdown(context.Background())
+	assert.ErrorIs(t, s.PACError(), ErrPACUnavailable)
+}
+
+func TestEmbeddedServerOnError(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="corp"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+	js := `function FindProxyForURL(url, host) { return "PROXY ` + proxy.Listener.Addr().String() +
+		`" }`
+	pacServer := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer pacServer.Close()
+	errs := make(chan error, 10)
+	s, err := New(Config{
+		Host:     "127.0.0.1",
+		PACURLs:  []string{pacServer.URL},
+		Domain:   "corp",
+		Username: "malory",
+		Password: "guest",
+		OnError:  func(_ *http.Request, err error) { errs <- err },
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Start())
+	defer s.Shutdown(context.Background())
+	assert.NoError(t, s.PACError())
+	proxyURL := &url.URL{Scheme: "http", Host: s.Addr().String()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://www.example.com")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, <-errs, ErrAuthRejected)
+}
+
+func TestEmbeddedServerOnErrorDirect(t *testing.T) {
+	// A server (rather than a proxy) that goes through an NTLM handshake and then rejects it.
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		if requests == 2 {
+			sendChallengeResponse(w)
+			return
+		}
+		w.Header().Set("Proxy-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer server.Close()
+	js := `function FindProxyForURL(url, host) { return "DIRECT" }`
+	pacServer := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer pacServer.Close()
+	errs := make(chan error, 10)
+	s, err := New(Config{
+		Host:     "127.0.0.1",
+		PACURLs:  []string{pacServer.URL},
+		Domain:   "corp",
+		Username: "malory",
+		Password: "guest",
+		OnError:  func(_ *http.Request, err error) { errs <- err },
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Start())
+	defer s.Shutdown(context.Background())
+	proxyURL := &url.URL{Scheme: "http", Host: s.Addr().String()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, 3, requests)
+	// There's no upstream proxy to have rejected the credentials.
+	assert.Empty(t, errs)
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/armon/go-socks5"
+)
+
+// The SOCKS4 version number, and command and reply codes.
+const (
+	socks4Version  = 4
+	socks4Connect  = 1
+	socks4Granted  = 90
+	socks4Rejected = 91
+)
+
+// socksServer serves the SOCKS port. SOCKS5 connections are handled by go-socks5, and SOCKS4
+// (and SOCKS4a) ones, for old tools that only speak that, are handled here. The two are told apart
+// by the version number that the client sends first.
+type socksServer struct {
+	socks5 *socks5.Server
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	// SOCKS4 has no way to send a password, so it's turned away if SOCKS5 clients have to
+	// authenticate.
+	socks4 bool
+}
+
+func (s *socksServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *socksServer) serveConn(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	version, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if version[0] == socks4Version {
+		s.serveSocks4(conn, br)
+		return
+	}
+	// go-socks5 closes the connection itself.
+	_ = s.socks5.ServeConn(peekedConn{bufferedConn{conn, br}})
+}
+
+// peekedConn is a connection that has had its first byte peeked at. Like the connection itself,
+// it can be half-closed, which go-socks5 does once the destination has finished sending.
+type peekedConn struct {
+	bufferedConn
+}
+
+func (c peekedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// serveSocks4 handles a SOCKS4 or SOCKS4a request. Only CONNECT is supported, like SOCKS5.
+func (s *socksServer) serveSocks4(conn net.Conn, br *bufio.Reader) {
+	defer conn.Close()
+	client := conn.RemoteAddr().String()
+	cmd, addr, err := readSocks4Request(br)
+	if err != nil {
+		log.Printf("Error reading SOCKS4 request from %s: %v", client, err)
+		return
+	}
+	debugf("socks", "SOCKS4 request from %s to %s (command %d)", client, addr, cmd)
+	if !s.socks4 {
+		log.Printf("Rejected SOCKS4 request from %s: SOCKS4 clients can't authenticate, so "+
+			"use SOCKS5 (with a username and password) or the HTTP proxy", client)
+		_, _ = conn.Write(socks4Reply(socks4Rejected))
+		return
+	} else if cmd != socks4Connect {
+		log.Printf("Rejected SOCKS4 request from %s: unsupported command %d", client, cmd)
+		_, _ = conn.Write(socks4Reply(socks4Rejected))
+		return
+	}
+	ctx := context.WithValue(context.Background(), contextKeySocksClient, client)
+	upstream, err := s.dial(ctx, "tcp", addr)
+	if err != nil {
+		log.Printf("Error connecting to %s for SOCKS4 client %s: %v", addr, client, err)
+		_, _ = conn.Write(socks4Reply(socks4Rejected))
+		return
+	}
+	defer upstream.Close()
+	if _, err := conn.Write(socks4Reply(socks4Granted)); err != nil {
+		return
+	}
+	relay(conn, br, upstream)
+}
+
+// readSocks4Request reads a SOCKS4 request, and returns its command and the address to connect
+// to. A SOCKS4a request gives a host name (which isn't resolved, like with SOCKS5) rather than an
+// IPv4 address.
+func readSocks4Request(br *bufio.Reader) (byte, string, error) {
+	var header [8]byte // Version, command, port and IPv4 address
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, "", err
+	}
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+	// The user ID isn't used.
+	if _, err := readSocks4String(br); err != nil {
+		return 0, "", err
+	}
+	host := ip.String()
+	// In SOCKS4a, an address of 0.0.0.x (with x non-zero) means that a host name follows.
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		name, err := readSocks4String(br)
+		if err != nil {
+			return 0, "", err
+		} else if name == "" {
+			return 0, "", errors.New("empty host name")
+		}
+		host = name
+	}
+	return header[1], net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// readSocks4String reads a null-terminated string, which can't be longer than br's buffer.
+func readSocks4String(br *bufio.Reader) (string, error) {
+	buf, err := br.ReadSlice(0)
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("string longer than %d bytes", br.Size())
+	} else if err != nil {
+		return "", err
+	}
+	return string(buf[:len(buf)-1]), nil
+}
+
+// socks4Reply returns a reply with the given status. The address and port in it are ignored by
+// clients when replying to a CONNECT request.
+func socks4Reply(status byte) []byte {
+	return []byte{0, status, 0, 0, 0, 0, 0, 0}
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSocks4Test starts a SOCKS server in front of a fake HTTP proxy, which records the CONNECT
+// requests and then echoes data back. It returns the SOCKS server's address.
+func startSocks4Test(t *testing.T, a *authenticator) (string, <-chan *http.Request) {
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { httpListener.Close() })
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := httpListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		requests <- req
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		_, _ = io.Copy(conn, br)
+	}()
+	srv, err := startSocksServer(httpListener.Addr().String(), a)
+	require.NoError(t, err)
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { socksListener.Close() })
+	go func() { _ = srv.Serve(socksListener) }()
+	return socksListener.Addr().String(), requests
+}
+
+func TestSocks4Connect(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		request  string
+		expected string
+	}{
+		{"SOCKS4", "\x04\x01\x01\xbb\x0a\x00\x00\x01me\x00", "10.0.0.1:443"},
+		{"SOCKS4a", "\x04\x01\x01\xbb\x00\x00\x00\x01me\x00intranet.invalid\x00",
+			"intranet.invalid:443"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, requests := startSocks4Test(t, nil)
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte(tc.request))
+			require.NoError(t, err)
+			reply := make([]byte, 8)
+			_, err = io.ReadFull(conn, reply)
+			require.NoError(t, err)
+			assert.Equal(t, socks4Reply(socks4Granted), reply)
+			req := <-requests
+			assert.Equal(t, http.MethodConnect, req.Method)
+			assert.Equal(t, tc.expected, req.Host)
+			assert.Equal(t, conn.LocalAddr().String(), req.Header.Get(socksClientHeader))
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(buf))
+		})
+	}
+}
+
+func TestSocks4RejectedWithAuthentication(t *testing.T) {
+	addr, _ := startSocks4Test(t, &authenticator{username: "me", hash: []byte("hash")})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("\x04\x01\x01\xbb\x0a\x00\x00\x01me\x00"))
+	require.NoError(t, err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, socks4Reply(socks4Rejected), reply)
+}
+
+func TestSocks4Bind(t *testing.T) {
+	addr, _ := startSocks4Test(t, nil)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("\x04\x02\x01\xbb\x0a\x00\x00\x01\x00"))
+	require.NoError(t, err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, socks4Reply(socks4Rejected), reply)
+}
+
+func TestReadSocks4RequestTooLong(t *testing.T) {
+	br := bufio.NewReaderSize(strings.NewReader("\x04\x01\x00\x50\x0a\x00\x00\x01"+
+		strings.Repeat("x", 100)+"\x00"), 16)
+	_, _, err := readSocks4Request(br)
+	assert.EqualError(t, err, "string longer than 16 bytes")
+	br = bufio.NewReader(strings.NewReader("\x04\x01\x00\x50\x00\x00\x00\x01\x00\x00"))
+	_, _, err = readSocks4Request(br)
+	assert.EqualError(t, err, "empty host name")
+}
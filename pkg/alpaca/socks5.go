@@ -0,0 +1,113 @@
+package alpaca
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/armon/go-socks5"
+)
+
+// socksClientHeader is added to the CONNECT requests sent for SOCKS clients, so that the HTTP
+// proxy can log the address of the client that the request is really from. It's removed before
+// the request is sent upstream (see deleteRequestHeaders).
+const socksClientHeader = "X-Alpaca-Socks-Client"
+
+// contextKeySocksClient holds the address of the SOCKS client, in the context passed to Dial.
+const contextKeySocksClient = contextKey("socksClient")
+
+// socksRules allows every request (like socks5.PermitAll), and adds the client's address to the
+// context.
+type socksRules struct{}
+
+func (socksRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.RemoteAddr != nil {
+		ctx = context.WithValue(ctx, contextKeySocksClient, req.RemoteAddr.Address())
+	}
+	debugf("socks", "Request from %v to %v (command %d)", req.RemoteAddr, req.DestAddr,
+		req.Command)
+	return ctx, true
+}
+
+// socksResolver doesn't resolve host names, so that they're passed to the HTTP proxy as they are.
+// That way, the PAC file and the logs see the name that the client asked for rather than an IP
+// address, and names that only the upstream proxy can resolve still work.
+type socksResolver struct{}
+
+func (socksResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// Get network package from socks and transform it in a http proxy package
+func httpConnectDialer(proxyHTTPAddr string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, proxyHTTPAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+		if client, ok := ctx.Value(contextKeySocksClient).(string); ok {
+			connectReq += fmt.Sprintf("%s: %s\r\n", socksClientHeader, client)
+		}
+		if client, ok := ctx.Value(contextKeyTransparentClient).(string); ok {
+			connectReq += fmt.Sprintf("%s: %s\r\n", transparentClientHeader, client)
+		}
+		connectReq += "\r\n"
+		if _, err := conn.Write([]byte(connectReq)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		br := bufio.NewReader(conn)
+		status, err := br.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		debugf("socks", "CONNECT %s: %s", addr, strings.TrimSpace(status))
+		if !strings.HasPrefix(status, "HTTP/1.1 200") {
+			conn.Close()
+			return nil, errors.New("proxy HTTP rejected CONNECT: " + strings.TrimSpace(status))
+		}
+
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if line == "\r\n" {
+				break
+			}
+		}
+
+		return conn, nil
+	}
+}
+
+func startSocksServer(proxyHTTPAddr string, a *authenticator) (*socksServer, error) {
+	var auths []socks5.Authenticator
+	if a != nil {
+		creds := socks5.StaticCredentials{
+			a.username: string(a.hash),
+		}
+		auths = append(auths, socks5.UserPassAuthenticator{Credentials: creds})
+	}
+
+	dial := httpConnectDialer(proxyHTTPAddr)
+	conf := &socks5.Config{
+		AuthMethods: auths,
+		Resolver:    socksResolver{},
+		Rules:       socksRules{},
+		Dial:        dial,
+	}
+	srv, err := socks5.New(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &socksServer{socks5: srv, dial: dial, socks4: a == nil}, nil
+}
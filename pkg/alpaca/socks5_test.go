@@ -0,0 +1,84 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestSocksPassesHostName(t *testing.T) {
+	// A fake HTTP proxy, which records the CONNECT request and then echoes data back.
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer httpListener.Close()
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := httpListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		requests <- req
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		buf := make([]byte, 4)
+		if _, err := br.Read(buf); err == nil {
+			_, _ = conn.Write(buf)
+		}
+	}()
+
+	srv, err := startSocksServer(httpListener.Addr().String(), nil)
+	require.NoError(t, err)
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer socksListener.Close()
+	go func() { _ = srv.Serve(socksListener) }()
+
+	dialer, err := proxy.SOCKS5("tcp", socksListener.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	// The name doesn't resolve, but it should be passed to the HTTP proxy as it is.
+	conn, err := dialer.Dial("tcp", "intranet.invalid:443")
+	require.NoError(t, err)
+	defer conn.Close()
+	req := <-requests
+	assert.Equal(t, http.MethodConnect, req.Method)
+	assert.Equal(t, "intranet.invalid:443", req.Host)
+	assert.Equal(t, conn.LocalAddr().String(), req.Header.Get(socksClientHeader))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestSocksClientHeaderNotForwarded(t *testing.T) {
+	req, err := http.NewRequest(http.MethodConnect, "http://www.test:443", nil)
+	require.NoError(t, err)
+	req.Header.Set(socksClientHeader, "127.0.0.1:50000")
+	deleteRequestHeaders(req)
+	assert.Empty(t, req.Header.Get(socksClientHeader))
+}
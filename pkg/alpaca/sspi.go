@@ -0,0 +1,34 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package alpaca
+
+import (
+	"errors"
+	"net/http"
+)
+
+// sspiAuthenticator authenticates to proxies as the logged-in Windows user, which is only
+// possible on Windows.
+type sspiAuthenticator struct{}
+
+func newSSPIAuthenticator() (*sspiAuthenticator, error) {
+	return nil, errors.New("SSPI is only supported on Windows")
+}
+
+func (sa *sspiAuthenticator) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	return nil, errors.New("SSPI is only supported on Windows")
+}
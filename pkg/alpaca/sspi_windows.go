@@ -0,0 +1,188 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The Security Support Provider Interface (SSPI) lets us do NTLM (or Negotiate, which uses
+// Kerberos when it can) authentication using the credentials of the logged-in user, without ever
+// having to know their password. See
+// https://learn.microsoft.com/en-us/windows/win32/secauthn/sspi for details.
+var (
+	secur32                        = windows.NewLazySystemDLL("secur32.dll")
+	procAcquireCredentialsHandleW  = secur32.NewProc("AcquireCredentialsHandleW")
+	procInitializeSecurityContextW = secur32.NewProc("InitializeSecurityContextW")
+	procDeleteSecurityContext      = secur32.NewProc("DeleteSecurityContext")
+	procFreeContextBuffer          = secur32.NewProc("FreeContextBuffer")
+)
+
+const (
+	secpkgCredOutbound      = 0x2
+	secbufferVersion        = 0
+	secbufferToken          = 2
+	iscReqAllocateMemory    = 0x100
+	iscReqConnection        = 0x800
+	securityNativeDrep      = 0x10
+	secEOK                  = 0x0
+	secIContinueNeeded      = 0x90312
+	secICompleteNeeded      = 0x90313
+	secICompleteAndContinue = 0x90314
+)
+
+type secHandle struct {
+	lower, upper uintptr
+}
+
+type secBuffer struct {
+	size       uint32
+	bufferType uint32
+	buffer     *byte
+}
+
+type secBufferDesc struct {
+	version uint32
+	count   uint32
+	buffers *secBuffer
+}
+
+// sspiAuthenticator authenticates to proxies as the logged-in Windows user.
+type sspiAuthenticator struct {
+	ntlm      secHandle
+	negotiate *secHandle // Nil if the Negotiate package couldn't be used
+}
+
+func newSSPIAuthenticator() (*sspiAuthenticator, error) {
+	var sa sspiAuthenticator
+	if err := acquireCredentials("NTLM", &sa.ntlm); err != nil {
+		return nil, err
+	}
+	var negotiate secHandle
+	if err := acquireCredentials("Negotiate", &negotiate); err != nil {
+		log.Printf("Can't use Negotiate auth with the Windows credentials, so only NTLM will "+
+			"be used: %v", err)
+	} else {
+		sa.negotiate = &negotiate
+	}
+	return &sa, nil
+}
+
+// acquireCredentials gets a handle to the current user's credentials for the given security
+// package.
+func acquireCredentials(pkg string, cred *secHandle) error {
+	name, err := windows.UTF16PtrFromString(pkg)
+	if err != nil {
+		return err
+	}
+	var expiry int64
+	status, _, _ := procAcquireCredentialsHandleW.Call(
+		0, // Use the credentials of the current user
+		uintptr(unsafe.Pointer(name)),
+		secpkgCredOutbound,
+		0, 0, 0, 0,
+		uintptr(unsafe.Pointer(cred)),
+		uintptr(unsafe.Pointer(&expiry)),
+	)
+	if status != secEOK {
+		return fmt.Errorf("AcquireCredentialsHandle(%s) failed: status 0x%x", pkg, status)
+	}
+	return nil
+}
+
+// do authenticates using Negotiate if the proxy offers it (so that Kerberos is used where it's
+// available), and NTLM otherwise.
+func (sa *sspiAuthenticator) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	scheme, cred := "NTLM", &sa.ntlm
+	var target *uint16
+	if sa.negotiate != nil && authSchemesFor(req).offers(req, "negotiate") {
+		scheme, cred = "Negotiate", sa.negotiate
+		// Kerberos needs the proxy's service principal name.
+		if proxy, _ := req.Context().Value(contextKeyProxy).(*url.URL); proxy != nil {
+			spn, err := windows.UTF16PtrFromString("HTTP/" + proxy.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			target = spn
+		}
+	}
+	debugf("auth", "[%d] Using %s auth as the logged-in Windows user",
+		req.Context().Value(contextKeyID), scheme)
+	var ctx secHandle
+	token, err := sa.initialize(cred, target, nil, &ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer procDeleteSecurityContext.Call(uintptr(unsafe.Pointer(&ctx)))
+	return ntlmHandshake(req, rt, scheme, token, func(challenge []byte) ([]byte, error) {
+		return sa.initialize(cred, target, &ctx, &ctx, challenge)
+	})
+}
+
+// initialize calls InitializeSecurityContext, and returns the token that should be sent to the
+// proxy. For NTLM, the first call (with a nil prev) returns a Type 1 (Negotiate) message, and the
+// second call processes the proxy's challenge and returns a Type 3 (Authenticate) message. For
+// Negotiate, the first token may be a Kerberos ticket for target, which the proxy accepts straight
+// away.
+func (sa *sspiAuthenticator) initialize(cred *secHandle, target *uint16, prev, next *secHandle,
+	input []byte) ([]byte, error) {
+	var in *secBufferDesc
+	if len(input) > 0 {
+		in = &secBufferDesc{
+			version: secbufferVersion,
+			count:   1,
+			buffers: &secBuffer{uint32(len(input)), secbufferToken, &input[0]},
+		}
+	}
+	outBuf := secBuffer{bufferType: secbufferToken}
+	out := secBufferDesc{version: secbufferVersion, count: 1, buffers: &outBuf}
+	var attrs uint32
+	var expiry int64
+	status, _, _ := procInitializeSecurityContextW.Call(
+		uintptr(unsafe.Pointer(cred)),
+		uintptr(unsafe.Pointer(prev)),
+		uintptr(unsafe.Pointer(target)), // Only needed for Kerberos
+		iscReqAllocateMemory|iscReqConnection,
+		0,
+		securityNativeDrep,
+		uintptr(unsafe.Pointer(in)),
+		0,
+		uintptr(unsafe.Pointer(next)),
+		uintptr(unsafe.Pointer(&out)),
+		uintptr(unsafe.Pointer(&attrs)),
+		uintptr(unsafe.Pointer(&expiry)),
+	)
+	if outBuf.buffer != nil {
+		defer procFreeContextBuffer.Call(uintptr(unsafe.Pointer(outBuf.buffer)))
+	}
+	switch status {
+	case secEOK, secIContinueNeeded:
+	case secICompleteNeeded, secICompleteAndContinue:
+		// These only happen with protocols like Digest, which we don't use.
+		return nil, fmt.Errorf("InitializeSecurityContext: unsupported status 0x%x", status)
+	default:
+		return nil, fmt.Errorf("InitializeSecurityContext failed: status 0x%x", status)
+	}
+	if outBuf.buffer == nil {
+		return nil, nil
+	}
+	return append([]byte(nil), unsafe.Slice(outBuf.buffer, outBuf.size)...), nil
+}
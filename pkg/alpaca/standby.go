@@ -0,0 +1,93 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A standby instance of Alpaca (started with -standby) does everything up to the point of
+// listening on its ports, and then waits for the primary instance on the same ports to fail, so
+// that developers aren't left without a proxy while the primary is restarted. The primary is
+// checked by fetching its PAC file, which every instance serves.
+
+// waitForPrimary returns once the primary instance listening on la has failed the given number
+// of checks in a row (made every interval), and has released its port.
+func waitForPrimary(la listenAddr, interval time.Duration, failures int) {
+	host := la.host
+	if host == "" {
+		host = "localhost"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(la.port))
+	client := &http.Client{Transport: &http.Transport{}, Timeout: interval}
+	url := "http://" + addr + "/alpaca.pac"
+	log.Printf("Standing by for the primary instance at %s", addr)
+	failed := 0
+	for range time.Tick(interval) {
+		err := checkPrimary(client, url)
+		if err == nil {
+			if failed > 0 {
+				log.Printf("Primary instance at %s is responding again", addr)
+			}
+			failed = 0
+			continue
+		}
+		if failed++; failed == 1 {
+			log.Printf("Primary instance at %s isn't responding: %v", addr, err)
+		}
+		if failed < failures {
+			continue
+		}
+		// If the primary is hung, rather than gone, its port can't be taken over yet.
+		l, err := listenOnce(la)
+		if err != nil {
+			if failed == failures {
+				log.Printf("Primary instance at %s is still holding its port: %v", addr, err)
+			}
+			continue
+		}
+		l.Close()
+		log.Printf("Primary instance at %s is down, taking over", addr)
+		return
+	}
+}
+
+// listenOnce checks whether la can be listened on.
+func listenOnce(la listenAddr) (net.Listener, error) {
+	addrs, err := la.bindAddrs()
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen("tcp", addrs[0])
+}
+
+func checkPrimary(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
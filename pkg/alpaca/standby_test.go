@@ -0,0 +1,82 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// standBy runs waitForPrimary for the primary listening on l, and returns a channel that's
+// closed when it returns.
+func standBy(t *testing.T, l net.Listener) <-chan struct{} {
+	la, err := parseListenAddr(l.Addr().String(), 0)
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		waitForPrimary(la, 10*time.Millisecond, 3)
+		close(done)
+	}()
+	return done
+}
+
+func TestStandbyTakesOverWhenPrimaryStops(t *testing.T) {
+	mux := http.NewServeMux()
+	NewPACWrapper(PACData{Port: 3128}).SetupHandlers(mux)
+	primary := httptest.NewServer(mux)
+	done := standBy(t, primary.Listener)
+	select {
+	case <-done:
+		require.Fail(t, "standby took over while the primary was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	primary.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "standby didn't take over after the primary stopped")
+	}
+}
+
+func TestStandbyWaitsForHungPrimaryToReleasePort(t *testing.T) {
+	// The primary never accepts connections, so every check times out.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := standBy(t, l)
+	select {
+	case <-done:
+		require.Fail(t, "standby took over while the primary held its port")
+	case <-time.After(100 * time.Millisecond):
+	}
+	l.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "standby didn't take over after the primary released its port")
+	}
+}
+
+func TestCheckPrimary(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	err := checkPrimary(http.DefaultClient, server.URL+"/alpaca.pac")
+	assert.ErrorContains(t, err, "404")
+}
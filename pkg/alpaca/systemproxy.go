@@ -0,0 +1,194 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// The kinds of proxy that can be set for a network service using networksetup, e.g. using
+// `networksetup -setwebproxy` or `networksetup -getsocksfirewallproxy`.
+var systemProxyKinds = []string{"webproxy", "securewebproxy", "socksfirewallproxy"}
+
+type systemProxySetting struct {
+	enabled bool
+	server  string
+	port    string
+}
+
+// systemProxy points the macOS system proxy settings for the active network service at Alpaca,
+// and remembers the previous settings so that they can be restored when Alpaca exits.
+type systemProxy struct {
+	execCommand func(name string, arg ...string) *exec.Cmd
+	service     string
+	saved       map[string]systemProxySetting
+}
+
+func newSystemProxy() (*systemProxy, error) {
+	if runtime.GOOS != "darwin" {
+		return nil, errors.New("setting the system proxy is only supported on macOS")
+	}
+	return &systemProxy{execCommand: exec.Command}, nil
+}
+
+func (sp *systemProxy) run(name string, arg ...string) ([]byte, error) {
+	out, err := sp.execCommand(name, arg...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running %s %s: %w", name, strings.Join(arg, " "), err)
+	}
+	return out, nil
+}
+
+// set points the HTTP, HTTPS and SOCKS proxies of the active network service at Alpaca.
+func (sp *systemProxy) set(host string, httpPort, socksPort int) error {
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	service, err := sp.activeService()
+	if err != nil {
+		return err
+	}
+	sp.service = service
+	sp.saved = make(map[string]systemProxySetting)
+	for _, kind := range systemProxyKinds {
+		out, err := sp.run("networksetup", "-get"+kind, service)
+		if err != nil {
+			return err
+		}
+		saved := parseSystemProxySetting(out)
+		if saved.server == host {
+			// This was probably left behind by an instance of Alpaca that didn't exit cleanly;
+			// don't restore it.
+			saved.enabled = false
+		}
+		sp.saved[kind] = saved
+	}
+	ports := map[string]int{
+		"webproxy":           httpPort,
+		"securewebproxy":     httpPort,
+		"socksfirewallproxy": socksPort,
+	}
+	for _, kind := range systemProxyKinds {
+		port := strconv.Itoa(ports[kind])
+		if _, err := sp.run("networksetup", "-set"+kind, service, host, port); err != nil {
+			sp.restore()
+			return err
+		}
+	}
+	log.Printf("Set the system proxy for %q to %s", service, host)
+	return nil
+}
+
+// restore puts back the settings that were in place before set was called.
+func (sp *systemProxy) restore() {
+	for _, kind := range systemProxyKinds {
+		saved, ok := sp.saved[kind]
+		if !ok {
+			continue
+		}
+		var err error
+		if saved.enabled {
+			_, err = sp.run("networksetup", "-set"+kind, sp.service, saved.server, saved.port)
+		} else {
+			_, err = sp.run("networksetup", "-set"+kind+"state", sp.service, "off")
+		}
+		if err != nil {
+			log.Printf("Error restoring system proxy settings: %v", err)
+		}
+	}
+	log.Printf("Restored the system proxy settings for %q", sp.service)
+}
+
+// activeService returns the name of the network service (e.g. "Wi-Fi") for the interface that
+// the default route goes through.
+func (sp *systemProxy) activeService() (string, error) {
+	out, err := sp.run("route", "-n", "get", "default")
+	if err != nil {
+		return "", err
+	}
+	device := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), ":"); ok &&
+			strings.TrimSpace(key) == "interface" {
+			device = strings.TrimSpace(value)
+		}
+	}
+	if device == "" {
+		return "", errors.New("couldn't find the interface for the default route")
+	}
+	out, err = sp.run("networksetup", "-listnetworkserviceorder")
+	if err != nil {
+		return "", err
+	}
+	return serviceForDevice(out, device)
+}
+
+// Matches the lines in the output of `networksetup -listnetworkserviceorder`, e.g.
+// "(1) Wi-Fi" followed by "(Hardware Port: Wi-Fi, Device: en0)".
+var (
+	networkServiceLine = regexp.MustCompile(`^\(\*?\d+\) (.+)$`)
+	hardwarePortLine   = regexp.MustCompile(`^\(Hardware Port: .*, Device: (.*)\)$`)
+)
+
+func serviceForDevice(out []byte, device string) (string, error) {
+	service := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := networkServiceLine.FindStringSubmatch(line); m != nil {
+			service = m[1]
+		} else if m := hardwarePortLine.FindStringSubmatch(line); m != nil && m[1] == device {
+			return service, nil
+		}
+	}
+	return "", fmt.Errorf("couldn't find the network service for %s", device)
+}
+
+// parseSystemProxySetting parses the output of `networksetup -getwebproxy` (and friends):
+//
+//	Enabled: Yes
+//	Server: proxy.example.com
+//	Port: 8080
+//	Authenticated Proxy Enabled: 0
+func parseSystemProxySetting(out []byte) systemProxySetting {
+	var setting systemProxySetting
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Enabled":
+			setting.enabled = value == "Yes"
+		case "Server":
+			setting.server = value
+		case "Port":
+			setting.port = value
+		}
+	}
+	return setting
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testServiceOrder = `An asterisk (*) denotes that a network service is disabled.
+(1) Thunderbolt Bridge
+(Hardware Port: Thunderbolt Bridge, Device: bridge0)
+
+(2) Wi-Fi
+(Hardware Port: Wi-Fi, Device: en0)
+
+(*3) iPhone USB
+(Hardware Port: iPhone USB, Device: en5)
+`
+
+// fakeNetworkCommands returns an execCommand func that runs TestMockNetworkCommands instead of
+// route and networksetup, and a func that returns the networksetup commands that were run.
+func fakeNetworkCommands(t *testing.T) (func(string, ...string) *exec.Cmd, func() []string) {
+	logfile := filepath.Join(t.TempDir(), "commands.log")
+	execCommand := func(name string, arg ...string) *exec.Cmd {
+		arg = append([]string{"-test.run=TestMockNetworkCommands", "--", name}, arg...)
+		cmd := exec.Command(os.Args[0], arg...)
+		cmd.Env = []string{"ALPACA_WANT_MOCK_NETWORK_COMMANDS=1", "COMMAND_LOG=" + logfile}
+		return cmd
+	}
+	commands := func() []string {
+		buf, err := os.ReadFile(logfile)
+		require.NoError(t, err)
+		return strings.Split(strings.TrimSpace(string(buf)), "\n")
+	}
+	return execCommand, commands
+}
+
+func TestMockNetworkCommands(t *testing.T) {
+	if os.Getenv("ALPACA_WANT_MOCK_NETWORK_COMMANDS") != "1" {
+		return
+	}
+	args := os.Args
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	switch {
+	case args[0] == "route":
+		fmt.Print("   route to: default\ndestination: default\n  interface: en0\n")
+	case args[0] == "networksetup" && args[1] == "-listnetworkserviceorder":
+		fmt.Print(testServiceOrder)
+	case args[0] == "networksetup" && args[1] == "-getwebproxy":
+		fmt.Print("Enabled: Yes\nServer: proxy.test\nPort: 8080\n")
+	case args[0] == "networksetup" && strings.HasPrefix(args[1], "-get"):
+		fmt.Print("Enabled: No\nServer: \nPort: 0\n")
+	case args[0] == "networksetup" && strings.HasPrefix(args[1], "-set"):
+		f, err := os.OpenFile(os.Getenv("COMMAND_LOG"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			os.Exit(1)
+		}
+		fmt.Fprintln(f, strings.Join(args[1:], " "))
+		f.Close()
+	default:
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestSetAndRestoreSystemProxy(t *testing.T) {
+	execCommand, commands := fakeNetworkCommands(t)
+	sp := &systemProxy{execCommand: execCommand}
+	require.NoError(t, sp.set("localhost", 3128, 8010))
+	assert.Equal(t, []string{
+		"-setwebproxy Wi-Fi localhost 3128",
+		"-setsecurewebproxy Wi-Fi localhost 3128",
+		"-setsocksfirewallproxy Wi-Fi localhost 8010",
+	}, commands())
+	sp.restore()
+	assert.Equal(t, []string{
+		"-setwebproxy Wi-Fi localhost 3128",
+		"-setsecurewebproxy Wi-Fi localhost 3128",
+		"-setsocksfirewallproxy Wi-Fi localhost 8010",
+		"-setwebproxy Wi-Fi proxy.test 8080",
+		"-setsecurewebproxystate Wi-Fi off",
+		"-setsocksfirewallproxystate Wi-Fi off",
+	}, commands())
+}
+
+func TestServiceForDevice(t *testing.T) {
+	service, err := serviceForDevice([]byte(testServiceOrder), "en0")
+	require.NoError(t, err)
+	assert.Equal(t, "Wi-Fi", service)
+	service, err = serviceForDevice([]byte(testServiceOrder), "en5")
+	require.NoError(t, err)
+	assert.Equal(t, "iPhone USB", service)
+	_, err = serviceForDevice([]byte(testServiceOrder), "utun3")
+	assert.Error(t, err)
+}
+
+func TestParseSystemProxySetting(t *testing.T) {
+	out := "Enabled: Yes\nServer: proxy.test\nPort: 8080\nAuthenticated Proxy Enabled: 0\n"
+	assert.Equal(t, systemProxySetting{true, "proxy.test", "8080"},
+		parseSystemProxySetting([]byte(out)))
+	out = "Enabled: No\nServer: \nPort: 0\nAuthenticated Proxy Enabled: 0\n"
+	assert.Equal(t, systemProxySetting{false, "", "0"}, parseSystemProxySetting([]byte(out)))
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// loadTLSClientConfig returns the TLS config for connections to upstream HTTPS proxies. caFile is
+// a PEM bundle of CAs to trust (in addition to the system's), and certFile and keyFile are a PEM
+// client certificate and its private key (keyFile can be omitted if certFile contains both, or if
+// the key is held by keyHelper instead; see keyHelper). It returns nil if none of these are given,
+// so that Go's defaults are used.
+func loadTLSClientConfig(caFile, certFile, keyFile, keyHelper string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && keyHelper == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile == "" && (keyFile != "" || keyHelper != "") {
+		return nil, errors.New("a client key was given without a client certificate")
+	} else if keyFile != "" && keyHelper != "" {
+		return nil, errors.New("a client key file and a key helper can't both be given")
+	} else if keyHelper != "" {
+		cert, err := loadCertificateChain(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		cert.PrivateKey = newKeyHelper(keyHelper, cert.Leaf.PublicKey)
+		config.Certificates = []tls.Certificate{cert}
+	} else if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// loadCertificateChain loads the certificates from a PEM file, without a private key.
+func loadCertificateChain(path string) (tls.Certificate, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		if block, buf = pem.Decode(buf); block == nil {
+			break
+		} else if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("no certificates found in %s", path)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+	return cert, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCert generates a self-signed client certificate, and writes it and its private key
+// to PEM files.
+func writeClientCert(t *testing.T) (cert *x509.Certificate, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "alpaca"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+	return cert, certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	buf := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, buf, 0600))
+}
+
+func TestHTTPSProxyWithClientCert(t *testing.T) {
+	clientCert, certFile, keyFile := writeClientCert(t)
+	var r requestLogger
+	server := httptest.NewServer(r.log("server", http.NewServeMux()))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(r.log("tlsServer", http.NewServeMux()))
+	defer tlsServer.Close()
+	// The parent proxy only accepts clients that present our client certificate.
+	parent := httptest.NewUnstartedServer(r.log("parentProxy", newDirectProxy()))
+	parent.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	parent.TLS.ClientCAs.AddCert(clientCert)
+	parent.StartTLS()
+	defer parent.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", parent.Certificate().Raw)
+
+	config, err := loadTLSClientConfig(caFile, certFile, keyFile, "")
+	require.NoError(t, err)
+	defer func(saved *tls.Config) { tlsClientConfig = saved }(tlsClientConfig)
+	tlsClientConfig = config
+	parentURL, err := url.Parse(parent.URL)
+	require.NoError(t, err)
+	require.Equal(t, "https", parentURL.Scheme)
+	childProxy := NewProxyHandler(nil, getProxyFromContext, func(string) {})
+	child := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), contextKeyProxy, parentURL)
+		childProxy.ServeHTTP(w, req.WithContext(ctx))
+	}))
+	defer child.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           proxyServer(t, child),
+		TLSClientConfig: tlsConfig(tlsServer),
+	}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []string{"GET to parentProxy", "GET to server"}, r.requests)
+
+	r.clear()
+	resp, err = client.Get(tlsServer.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []string{"CONNECT to parentProxy", "GET to tlsServer"}, r.requests)
+}
+
+func TestLoadTLSClientConfig(t *testing.T) {
+	config, err := loadTLSClientConfig("", "", "", "")
+	require.NoError(t, err)
+	assert.Nil(t, config)
+
+	_, certFile, keyFile := writeClientCert(t)
+	config, err = loadTLSClientConfig("", certFile, keyFile, "")
+	require.NoError(t, err)
+	assert.Len(t, config.Certificates, 1)
+	assert.Nil(t, config.RootCAs)
+
+	// The certificate and key can also be in the same file.
+	certPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	keyPEM, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	combined := filepath.Join(t.TempDir(), "combined.pem")
+	require.NoError(t, os.WriteFile(combined, append(certPEM, keyPEM...), 0600))
+	config, err = loadTLSClientConfig("", combined, "", "")
+	require.NoError(t, err)
+	assert.Len(t, config.Certificates, 1)
+
+	config, err = loadTLSClientConfig(certFile, "", "", "")
+	require.NoError(t, err)
+	assert.NotNil(t, config.RootCAs)
+}
+
+func TestLoadTLSClientConfigErrors(t *testing.T) {
+	_, certFile, keyFile := writeClientCert(t)
+	_, err := loadTLSClientConfig("", "", keyFile, "")
+	assert.Error(t, err)
+	_, err = loadTLSClientConfig(keyFile, "", "", "") // not a certificate
+	assert.Error(t, err)
+	_, err = loadTLSClientConfig("", keyFile, certFile, "")
+	assert.Error(t, err)
+	_, err = loadTLSClientConfig(filepath.Join(t.TempDir(), "nonexistent.pem"), "", "", "")
+	assert.Error(t, err)
+}
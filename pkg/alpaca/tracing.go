@@ -0,0 +1,623 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const contextKeySpan = contextKey("span")
+
+// The kinds of span that Alpaca records (see the OTLP SpanKind enum).
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// The OTLP status code for a span that failed.
+const spanStatusError = 2
+
+// tracer records a span for each proxied request, with child spans for finding the proxy in the
+// PAC file, connecting upstream, authenticating and (for CONNECT requests) the life of the
+// tunnel, and sends them to an OpenTelemetry collector using the OTLP/HTTP JSON encoding. It's
+// configured using the standard OTEL_* environment variables (see newTracer). The W3C
+// traceparent header is passed upstream, so that Alpaca's spans show up in the client's trace.
+type tracer struct {
+	endpoint  string
+	headers   http.Header
+	resource  otlpResource
+	sample    func(traceID [16]byte) bool // Decides whether to sample a new trace
+	parentOK  bool                        // Whether to follow the client's sampling decision
+	interval  time.Duration               // How often to send finished spans
+	batchSize int                         // The maximum number of spans sent at once
+	limit     int                         // The maximum number of spans to buffer
+	client    *http.Client
+	spans     []otlpSpan
+	dropped   int // The number of spans dropped since the last successful send
+	mux       sync.Mutex
+}
+
+// newTracer returns a tracer configured by the OpenTelemetry SDK environment variables, or nil if
+// tracing isn't enabled (i.e. neither OTEL_EXPORTER_OTLP_TRACES_ENDPOINT nor
+// OTEL_EXPORTER_OTLP_ENDPOINT is set, or OTEL_SDK_DISABLED is true).
+func newTracer(lookupEnv func(string) (string, bool)) (*tracer, error) {
+	getenv := func(names ...string) string {
+		for _, name := range names {
+			if value, ok := lookupEnv(name); ok && value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	if strings.EqualFold(getenv("OTEL_SDK_DISABLED"), "true") ||
+		getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return nil, nil
+	}
+	endpoint := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		} else {
+			return nil, nil
+		}
+	}
+	if exporter := getenv("OTEL_TRACES_EXPORTER"); exporter != "" && exporter != "otlp" {
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q (expected \"otlp\")",
+			exporter)
+	}
+	protocol := getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL")
+	if protocol != "" && protocol != "http/json" {
+		return nil, fmt.Errorf("unsupported OTLP protocol %q (only \"http/json\" is supported)",
+			protocol)
+	}
+	tr := &tracer{endpoint: endpoint, headers: make(http.Header), parentOK: true}
+	pairs, err := parseKeyValues(getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS: %w", err)
+	}
+	tracesPairs, err := parseKeyValues(getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_TRACES_HEADERS: %w", err)
+	}
+	for _, kv := range append(pairs, tracesPairs...) {
+		tr.headers.Set(kv[0], kv[1])
+	}
+	if tr.sample, tr.parentOK, err = parseSampler(getenv("OTEL_TRACES_SAMPLER"),
+		getenv("OTEL_TRACES_SAMPLER_ARG")); err != nil {
+		return nil, err
+	}
+	var delay, timeout int
+	for _, setting := range []struct {
+		name  string
+		value *int
+		def   int
+	}{
+		{"OTEL_BSP_SCHEDULE_DELAY", &delay, 5000}, // Milliseconds
+		{"OTEL_BSP_MAX_QUEUE_SIZE", &tr.limit, 2048},
+		{"OTEL_BSP_MAX_EXPORT_BATCH_SIZE", &tr.batchSize, 512},
+		{"OTEL_EXPORTER_OTLP_TIMEOUT", &timeout, 10000}, // Milliseconds
+	} {
+		*setting.value = setting.def
+		if value := getenv(setting.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid %s: %q", setting.name, value)
+			}
+			*setting.value = n
+		}
+	}
+	tr.interval = time.Duration(delay) * time.Millisecond
+	// The collector is expected to be on the internal network, so don't use a proxy.
+	tr.client = &http.Client{
+		Transport: &http.Transport{},
+		Timeout:   time.Duration(timeout) * time.Millisecond,
+	}
+	attrs, err := parseKeyValues(getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %w", err)
+	}
+	service := getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "alpaca"
+	}
+	host, _ := os.Hostname()
+	tr.resource.Attributes = []otlpAttribute{
+		otlpString("service.name", service),
+		otlpString("host.name", host),
+	}
+	if BuildVersion != "" {
+		tr.resource.Attributes = append(tr.resource.Attributes,
+			otlpString("service.version", BuildVersion))
+	}
+	for _, kv := range attrs {
+		if kv[0] != "service.name" {
+			tr.resource.Attributes = append(tr.resource.Attributes, otlpString(kv[0], kv[1]))
+		}
+	}
+	return tr, nil
+}
+
+// parseKeyValues parses a list of key=value pairs, separated by commas, as used by
+// OTEL_EXPORTER_OTLP_HEADERS and OTEL_RESOURCE_ATTRIBUTES. Values may be percent-encoded.
+func parseKeyValues(s string) ([][2]string, error) {
+	var pairs [][2]string
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", item)
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, [2]string{strings.TrimSpace(key), value})
+	}
+	return pairs, nil
+}
+
+// parseSampler returns the function that decides whether to sample a new trace, and whether to
+// follow the client's decision instead if it sent a traceparent header, given the values of
+// OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG.
+func parseSampler(name, arg string) (func([16]byte) bool, bool, error) {
+	always := func([16]byte) bool { return true }
+	never := func([16]byte) bool { return false }
+	parentBased := true
+	if name == "" {
+		name = "parentbased_always_on"
+	}
+	if rest, ok := strings.CutPrefix(name, "parentbased_"); ok {
+		name = rest
+	} else {
+		parentBased = false
+	}
+	switch name {
+	case "always_on":
+		return always, parentBased, nil
+	case "always_off":
+		return never, parentBased, nil
+	case "traceidratio":
+		ratio := 1.0
+		if arg != "" {
+			var err error
+			if ratio, err = strconv.ParseFloat(arg, 64); err != nil || ratio < 0 || ratio > 1 {
+				return nil, false, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG: %q", arg)
+			}
+		}
+		// Use the random part of the trace ID, so that every service that samples by the same
+		// ratio makes the same decision.
+		threshold := uint64(ratio * (1 << 63))
+		return func(traceID [16]byte) bool {
+			return binary.BigEndian.Uint64(traceID[8:])>>1 < threshold
+		}, parentBased, nil
+	}
+	return nil, false, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER: %q", name)
+}
+
+// span is an operation that's being traced. All of its methods can be called on a nil span (which
+// is what startSpan returns if the request isn't being traced), and do nothing.
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte // All zeroes for a root span
+	sampled bool
+	name    string
+	kind    int
+	start   time.Time
+	attrs   []otlpAttribute
+	err     string
+	ended   bool
+	mux     sync.Mutex
+}
+
+// startRequest starts the span for a proxied request. If the client sent a valid traceparent
+// header, the span is part of the client's trace.
+func (tr *tracer) startRequest(req *http.Request) *span {
+	s := &span{tracer: tr, name: req.Method, kind: spanKindServer, start: time.Now()}
+	traceID, parent, flags, ok := parseTraceparent(req.Header.Get("traceparent"))
+	if ok {
+		s.traceID, s.parent = traceID, parent
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.id[:])
+	if ok && tr.parentOK {
+		s.sampled = flags&1 == 1
+	} else {
+		s.sampled = tr.sample(s.traceID)
+	}
+	s.attrs = []otlpAttribute{
+		otlpString("http.request.method", req.Method),
+		otlpString("server.address", req.Host),
+	}
+	if req.Method != http.MethodConnect {
+		s.attrs = append(s.attrs, otlpString("url.full", req.URL.String()))
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		s.attrs = append(s.attrs, otlpString("client.address", host))
+	}
+	if id, ok := req.Context().Value(contextKeyID).(uint64); ok {
+		s.attrs = append(s.attrs, otlpInt("alpaca.request_id", int(id)))
+	}
+	return s
+}
+
+// parseTraceparent parses a W3C traceparent header (see https://www.w3.org/TR/trace-context/).
+func parseTraceparent(value string) (traceID [16]byte, parent [8]byte, flags byte, ok bool) {
+	// Later versions may add fields after the flags, but they'll start with the same ones.
+	if len(value) < 55 || value[2] != '-' || value[35] != '-' || value[52] != '-' ||
+		(len(value) > 55 && (strings.HasPrefix(value, "00") || value[55] != '-')) {
+		return [16]byte{}, [8]byte{}, 0, false
+	}
+	lowerHex := func(dst []byte, src string) bool {
+		_, err := hex.Decode(dst, []byte(src))
+		return err == nil && strings.ToLower(src) == src
+	}
+	var version, flag [1]byte
+	if !lowerHex(version[:], value[:2]) || version[0] == 0xff ||
+		!lowerHex(traceID[:], value[3:35]) || !lowerHex(parent[:], value[36:52]) ||
+		!lowerHex(flag[:], value[53:55]) || traceID == [16]byte{} || parent == [8]byte{} {
+		return [16]byte{}, [8]byte{}, 0, false
+	}
+	return traceID, parent, flag[0], true
+}
+
+// traceparent returns the traceparent header that identifies s as the parent of an upstream
+// request.
+func (s *span) traceparent() string {
+	var flags byte
+	if s.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", s.traceID, s.id, flags)
+}
+
+// startSpan starts a child of the span in ctx, or returns nil if the request isn't being traced.
+func startSpan(ctx context.Context, name string, kind int) *span {
+	parent, _ := ctx.Value(contextKeySpan).(*span)
+	if parent == nil {
+		return nil
+	}
+	s := &span{
+		tracer:  parent.tracer,
+		traceID: parent.traceID,
+		parent:  parent.id,
+		sampled: parent.sampled,
+		name:    name,
+		kind:    kind,
+		start:   time.Now(),
+	}
+	_, _ = rand.Read(s.id[:])
+	return s
+}
+
+func (s *span) setAttributes(attrs ...otlpAttribute) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// setError marks the span as failed, unless err is nil.
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.ended {
+		s.err = err.Error()
+	}
+}
+
+// endResponse ends a span for a request sent upstream.
+func (s *span) endResponse(resp *http.Response, err error) {
+	if resp != nil {
+		s.setAttributes(otlpInt("http.response.status_code", resp.StatusCode))
+	}
+	s.setError(err)
+	s.end()
+}
+
+// end finishes the span, and queues it to be sent if it was sampled. Only the first call has any
+// effect.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	if s.ended || !s.sampled {
+		s.ended = true
+		s.mux.Unlock()
+		return
+	}
+	s.ended = true
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.id[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parent != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		out.Status = otlpStatus{Code: spanStatusError, Message: s.err}
+	}
+	s.mux.Unlock()
+	s.tracer.add(out)
+}
+
+// endThen returns a func that ends the span and then calls done (unless it's nil), for use as a
+// tunnel's done func.
+func (s *span) endThen(done func()) func() {
+	if s == nil {
+		return done
+	}
+	return func() {
+		s.end()
+		if done != nil {
+			done()
+		}
+	}
+}
+
+// traceDial returns a copy of req whose context records a "dial" span while the transport gets a
+// connection for it (which may be an idle one, rather than a new one), and a func to call with
+// the result of the request, which ends the span if the transport never got a connection.
+func traceDial(req *http.Request) (*http.Request, func(error)) {
+	if req.Context().Value(contextKeySpan) == nil {
+		return req, func(error) {}
+	}
+	var dial *span
+	var mux sync.Mutex
+	trace := &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			mux.Lock()
+			defer mux.Unlock()
+			dial.end()
+			dial = startSpan(req.Context(), "dial", spanKindClient)
+			dial.setAttributes(otlpString("server.address", hostPort))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mux.Lock()
+			defer mux.Unlock()
+			dial.setAttributes(otlpBool("alpaca.reused", info.Reused))
+			dial.end()
+		},
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	return req.WithContext(ctx), func(err error) {
+		mux.Lock()
+		defer mux.Unlock()
+		dial.setError(err)
+		dial.end()
+	}
+}
+
+func (tr *tracer) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect && req.URL.Scheme == "" {
+			// Not a proxy request (see ProxyHandler.WrapHandler).
+			next.ServeHTTP(w, req)
+			return
+		}
+		s := tr.startRequest(req)
+		req.Header.Set("traceparent", s.traceparent())
+		sw := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sw, req.WithContext(context.WithValue(req.Context(), contextKeySpan, s)))
+		if sw.status != 0 {
+			s.setAttributes(otlpInt("http.response.status_code", sw.status))
+		}
+		if code := w.Header().Get(proxyErrorHeader); code != "" {
+			s.setAttributes(otlpString("error.type", code))
+			s.setError(errors.New(code))
+		} else if sw.status >= 500 {
+			s.setError(errors.New(http.StatusText(sw.status)))
+		}
+		s.end()
+	})
+}
+
+// statusRecorder records the status of a response (e.g. for tracing, or the dashboard).
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// add queues a finished span to be sent, dropping the oldest one if the queue is full.
+func (tr *tracer) add(s otlpSpan) {
+	tr.mux.Lock()
+	defer tr.mux.Unlock()
+	tr.spans = append(tr.spans, s)
+	tr.trim()
+}
+
+func (tr *tracer) trim() {
+	if excess := len(tr.spans) - tr.limit; excess > 0 {
+		tr.spans = tr.spans[excess:]
+		tr.dropped += excess
+	}
+}
+
+// run sends finished spans to the collector until stop is closed, backing off exponentially
+// while it can't be reached (like logShipper.run).
+func (tr *tracer) run(stop <-chan struct{}) {
+	delay := tr.interval
+	failing := false
+	for {
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		}
+		err := tr.flush()
+		if err == nil {
+			if failing {
+				log.Printf("Sending traces to %s again", tr.endpoint)
+			}
+			failing = false
+			delay = tr.interval
+			continue
+		}
+		if !failing {
+			log.Printf("Error sending traces to %s, will keep retrying: %v", tr.endpoint, err)
+		}
+		failing = true
+		delay = min(delay*2, logShipMaxBackoff)
+	}
+}
+
+// flush sends all of the finished spans to the collector, in batches.
+func (tr *tracer) flush() error {
+	for {
+		tr.mux.Lock()
+		n := min(len(tr.spans), tr.batchSize)
+		batch := tr.spans[:n:n]
+		tr.spans = tr.spans[n:]
+		dropped := tr.dropped
+		tr.dropped = 0
+		tr.mux.Unlock()
+		if dropped > 0 {
+			log.Printf("Dropped %d spans while the trace collector was down", dropped)
+		}
+		if n == 0 {
+			return nil
+		}
+		if err := tr.send(batch); err != nil {
+			// Put the batch back, in front of any spans that have finished since.
+			tr.mux.Lock()
+			tr.spans = append(batch, tr.spans...)
+			tr.trim()
+			tr.mux.Unlock()
+			return err
+		}
+	}
+}
+
+func (tr *tracer) send(spans []otlpSpan) error {
+	buf, err := json.Marshal(otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: tr.resource,
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "alpaca", Version: BuildVersion},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, tr.endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	for name, values := range tr.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := tr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// The types below are the parts of the OTLP/HTTP JSON encoding of traces that Alpaca uses (see
+// logship.go for the types that are shared with logs).
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"` // Hex-encoded, unlike in protobuf
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
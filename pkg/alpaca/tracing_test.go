@@ -0,0 +1,304 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+// traceCollector is an OTLP/HTTP endpoint that records the spans it receives.
+type traceCollector struct {
+	*httptest.Server
+	headers http.Header
+	spans   []otlpSpan
+	mux     sync.Mutex
+}
+
+func newTraceCollector(t *testing.T) *traceCollector {
+	tc := &traceCollector{}
+	tc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		assert.Equal(t, "/v1/traces", req.URL.Path)
+		var body otlpTracesRequest
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		tc.mux.Lock()
+		defer tc.mux.Unlock()
+		tc.headers = req.Header
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				tc.spans = append(tc.spans, ss.Spans...)
+			}
+		}
+	}))
+	return tc
+}
+
+// span returns the first span with the given name.
+func (tc *traceCollector) span(t *testing.T, name string) otlpSpan {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	for _, s := range tc.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	require.Failf(t, "span not found", "no %q span in %v", name, tc.spans)
+	return otlpSpan{}
+}
+
+func newTestTracer(t *testing.T, endpoint string) *tracer {
+	tr, err := newTracer(envLookup(map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": endpoint,
+		"OTEL_EXPORTER_OTLP_HEADERS":  "Authorization=Bearer%20secret",
+	}))
+	require.NoError(t, err)
+	require.NotNil(t, tr)
+	return tr
+}
+
+func TestTracing(t *testing.T) {
+	var upstreamTraceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		upstreamTraceparent = req.Header.Get("traceparent")
+	}))
+	defer server.Close()
+	collector := newTraceCollector(t)
+	defer collector.Close()
+	tr := newTestTracer(t, collector.URL)
+	proxy := httptest.NewServer(AddContextID(tr.WrapHandler(newDirectProxy())))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	clientTraceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req.Header.Set("traceparent", clientTraceparent)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NoError(t, tr.flush())
+
+	assert.Equal(t, "Bearer secret", collector.headers.Get("Authorization"))
+	root := collector.span(t, "GET")
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", root.TraceID)
+	assert.Equal(t, "b7ad6b7169203331", root.ParentSpanID)
+	assert.Equal(t, spanKindServer, root.Kind)
+	assert.Contains(t, root.Attributes, otlpInt("http.response.status_code", 200))
+	assert.Zero(t, root.Status.Code)
+	// The upstream request is a child of Alpaca's span, in the client's trace.
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-"+root.SpanID+"-01",
+		upstreamTraceparent)
+	dial := collector.span(t, "dial")
+	assert.Equal(t, root.TraceID, dial.TraceID)
+	assert.Equal(t, root.SpanID, dial.ParentSpanID)
+}
+
+func TestTracingError(t *testing.T) {
+	collector := newTraceCollector(t)
+	defer collector.Close()
+	tr := newTestTracer(t, collector.URL)
+	proxy := httptest.NewServer(tr.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close() // Nothing's listening, so the connection is refused.
+
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NoError(t, tr.flush())
+
+	root := collector.span(t, "GET")
+	assert.Empty(t, root.ParentSpanID)
+	assert.Equal(t, spanStatusError, root.Status.Code)
+	assert.Contains(t, root.Attributes, otlpString("error.type", "connection_refused"))
+	assert.Equal(t, spanStatusError, collector.span(t, "dial").Status.Code)
+}
+
+func TestTracingTunnel(t *testing.T) {
+	collector := newTraceCollector(t)
+	defer collector.Close()
+	tr := newTestTracer(t, collector.URL)
+	proxy := httptest.NewServer(tr.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	conn, status := connectVia(t, proxy.Listener.Addr().String(),
+		server.Listener.Addr().String())
+	require.Equal(t, http.StatusOK, status)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		require.NoError(t, tr.flush())
+		collector.mux.Lock()
+		defer collector.mux.Unlock()
+		return len(collector.spans) == 3
+	}, time.Second, 10*time.Millisecond)
+	root := collector.span(t, "CONNECT")
+	tunnel := collector.span(t, "tunnel")
+	assert.Equal(t, root.SpanID, tunnel.ParentSpanID)
+	assert.Equal(t, root.SpanID, collector.span(t, "dial").ParentSpanID)
+}
+
+func TestTracingNotSampled(t *testing.T) {
+	collector := newTraceCollector(t)
+	defer collector.Close()
+	tr := newTestTracer(t, collector.URL)
+	var upstreamTraceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		upstreamTraceparent = req.Header.Get("traceparent")
+	}))
+	defer server.Close()
+	proxy := httptest.NewServer(tr.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NoError(t, tr.flush())
+	assert.Empty(t, collector.spans)
+	// The client's decision is still passed upstream.
+	assert.True(t, strings.HasPrefix(upstreamTraceparent,
+		"00-0af7651916cd43dd8448eb211c80319c-"))
+	assert.True(t, strings.HasSuffix(upstreamTraceparent, "-00"))
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"Valid", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true},
+		{"FutureVersion", "01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-xyz", true},
+		{"Empty", "", false},
+		{"ExtraFieldInVersion00",
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-xyz", false},
+		{"InvalidVersion", "ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false},
+		{"UpperCase", "00-0AF7651916CD43DD8448EB211C80319C-B7AD6B7169203331-01", false},
+		{"ZeroTraceID", "00-00000000000000000000000000000000-b7ad6b7169203331-01", false},
+		{"ZeroParentID", "00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", false},
+		{"NotHex", "00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, flags, ok := parseTraceparent(test.value)
+			assert.Equal(t, test.ok, ok)
+			if ok {
+				assert.Equal(t, byte(1), flags)
+			}
+		})
+	}
+}
+
+func TestNewTracer(t *testing.T) {
+	tr, err := newTracer(envLookup(nil))
+	require.NoError(t, err)
+	assert.Nil(t, tr, "tracing should be off unless an endpoint is set")
+
+	tr, err = newTracer(envLookup(map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318",
+		"OTEL_SDK_DISABLED":           "true",
+	}))
+	require.NoError(t, err)
+	assert.Nil(t, tr)
+
+	tr, err = newTracer(envLookup(map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT":        "http://collector:4318/",
+		"OTEL_SERVICE_NAME":                  "proxy",
+		"OTEL_RESOURCE_ATTRIBUTES":           "deployment.environment=prod",
+		"OTEL_BSP_SCHEDULE_DELAY":            "1000",
+		"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "http/json",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "http://collector:4318/v1/traces", tr.endpoint)
+	assert.Equal(t, time.Second, tr.interval)
+	assert.Contains(t, tr.resource.Attributes, otlpString("service.name", "proxy"))
+	assert.Contains(t, tr.resource.Attributes,
+		otlpString("deployment.environment", "prod"))
+
+	tr, err = newTracer(envLookup(map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT":        "http://collector:4318",
+		"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://traces:4318/custom",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "http://traces:4318/custom", tr.endpoint)
+
+	for name, value := range map[string]string{
+		"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc",
+		"OTEL_TRACES_SAMPLER":         "jaeger_remote",
+		"OTEL_BSP_MAX_QUEUE_SIZE":     "-1",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "novalue",
+	} {
+		_, err := newTracer(envLookup(map[string]string{
+			"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318",
+			name:                          value,
+		}))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestParseSampler(t *testing.T) {
+	var low, high [16]byte
+	high[8] = 0xff
+	sample, parentBased, err := parseSampler("traceidratio", "0.5")
+	require.NoError(t, err)
+	assert.False(t, parentBased)
+	assert.True(t, sample(low))
+	assert.False(t, sample(high))
+
+	sample, parentBased, err = parseSampler("parentbased_always_off", "")
+	require.NoError(t, err)
+	assert.True(t, parentBased)
+	assert.False(t, sample(low))
+
+	_, _, err = parseSampler("traceidratio", "2")
+	assert.Error(t, err)
+}
+
+func TestTracerDropsOldestSpans(t *testing.T) {
+	tr := newTestTracer(t, (&url.URL{Scheme: "http", Host: "127.0.0.1:1"}).String())
+	tr.limit = 2
+	for _, name := range []string{"a", "b", "c"} {
+		tr.add(otlpSpan{Name: name})
+	}
+	assert.Equal(t, []otlpSpan{{Name: "b"}, {Name: "c"}}, tr.spans)
+	assert.Equal(t, 1, tr.dropped)
+	assert.Error(t, tr.flush())
+	assert.Len(t, tr.spans, 2, "spans should be kept if they couldn't be sent")
+}
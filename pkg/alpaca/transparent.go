@@ -0,0 +1,215 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// transparentClientHeader is added to the CONNECT requests sent for connections that were
+// intercepted by the transparent proxy, like socksClientHeader is for SOCKS clients.
+const transparentClientHeader = "X-Alpaca-Transparent-Client"
+
+// contextKeyTransparentClient holds the address of the intercepted client, in the context passed
+// to httpConnectDialer.
+const contextKeyTransparentClient = contextKey("transparentClient")
+
+// sniffTimeout is how long to wait for an intercepted client to send the start of a TLS or HTTP
+// request, which holds the host name that it's connecting to. Clients of protocols in which the
+// server speaks first (e.g. SSH or SMTP) are delayed by this much.
+const sniffTimeout = 500 * time.Millisecond
+
+// transparentProxy accepts TCP connections that were sent to it by iptables (using either the
+// REDIRECT or TPROXY target), rather than by clients that were configured to use a proxy. It finds
+// out where each connection was really going, and sends it there through Alpaca's HTTP proxy with
+// a CONNECT request, so that it goes through the PAC file (or DIRECT) like any other request.
+type transparentProxy struct {
+	dial        func(ctx context.Context, network, addr string) (net.Conn, error)
+	originalDst func(conn net.Conn) (*net.TCPAddr, error)
+}
+
+func newTransparentProxy(proxyAddr string) *transparentProxy {
+	return &transparentProxy{
+		dial:        httpConnectDialer(proxyAddr),
+		originalDst: originalDst,
+	}
+}
+
+func (tp *transparentProxy) Serve(l net.Listener) error {
+	port := l.Addr().(*net.TCPAddr).Port
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go tp.handle(conn, port)
+	}
+}
+
+// handle sends an intercepted connection to where it was going. port is the one that the
+// listener is on, so that connections that were made to it directly (rather than being redirected
+// to it) can be turned away; otherwise, they'd be sent back to the listener forever.
+func (tp *transparentProxy) handle(conn net.Conn, port int) {
+	defer conn.Close()
+	client := conn.RemoteAddr().String()
+	dst, err := tp.originalDst(conn)
+	if err != nil {
+		log.Printf("Error finding the destination of intercepted connection from %s: %v",
+			client, err)
+		return
+	} else if dst.Port == port && isLocalIP(dst.IP) {
+		log.Printf("Connection from %s to %s wasn't intercepted (use the HTTP or SOCKS port "+
+			"instead, or check the iptables rules)", client, dst)
+		return
+	}
+	br := bufio.NewReaderSize(conn, 5+16384) // Enough for a TLS record
+	host := dst.IP.String()
+	if name := sniffHostName(conn, br); name != "" {
+		host = name
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(dst.Port))
+	debugf("transparent", "Intercepted connection from %s to %s (%s)", client, dst, target)
+	ctx := context.WithValue(context.Background(), contextKeyTransparentClient, client)
+	upstream, err := tp.dial(ctx, "tcp", target)
+	if err != nil {
+		log.Printf("Error connecting to %s for intercepted client %s: %v", target, client, err)
+		return
+	}
+	defer upstream.Close()
+	// The reader still holds whatever was sniffed, so that's sent first.
+	relay(conn, br, upstream)
+}
+
+// relay copies data both ways between a client and an upstream connection, until both sides
+// have finished sending (or either one fails). Data from the client is read from br, which may
+// already hold some of it.
+func relay(client net.Conn, br *bufio.Reader, upstream net.Conn) {
+	errs := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstream, br)
+		closeWrite(upstream)
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(client, upstream)
+		closeWrite(client)
+		errs <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			return
+		}
+	}
+}
+
+// isLocalIP reports whether ip is one of this host's addresses.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeWrite half-closes a connection, so that the other end sees EOF but can still reply.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// sniffHostName peeks at the start of what an intercepted client has sent, and returns the host
+// name that it's connecting to: the server name (SNI) from a TLS ClientHello, or the Host header
+// of an HTTP request. That way, the PAC file sees a host name rather than just an IP address. It
+// returns an empty string if there's no host name, or if the client doesn't send anything in
+// time. Nothing is consumed from br.
+func sniffHostName(conn net.Conn, br *bufio.Reader) string {
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	first, err := br.Peek(1)
+	if err != nil {
+		return ""
+	}
+	if first[0] == 0x16 { // A TLS handshake record
+		header, err := br.Peek(5)
+		if err != nil {
+			return ""
+		}
+		record, err := br.Peek(5 + (int(header[3])<<8 | int(header[4])))
+		if err != nil {
+			return ""
+		}
+		return tlsServerName(record)
+	}
+	// An HTTP request's headers usually arrive all at once, so only what's already been
+	// received is looked at.
+	buf, _ := br.Peek(br.Buffered())
+	if !bytes.Contains(buf, []byte("\r\n\r\n")) {
+		return ""
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return req.Host
+}
+
+// errSniffed stops the TLS handshake in tlsServerName once the ClientHello has been parsed.
+var errSniffed = errors.New("sniffed")
+
+// tlsServerName returns the server name from a TLS record containing a ClientHello, by starting a
+// handshake (which goes no further than parsing the ClientHello) using crypto/tls.
+func tlsServerName(record []byte) string {
+	var name string
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errSniffed
+		},
+	}
+	_ = tls.Server(readOnlyConn{r: bytes.NewReader(record)}, config).Handshake()
+	return name
+}
+
+// readOnlyConn is a net.Conn that reads from r, and discards anything that's written to it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,118 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST (and IP6T_SO_ORIGINAL_DST, which has the same value), from
+// <linux/netfilter_ipv4.h>. It isn't defined by the unix package.
+const soOriginalDst = 80
+
+// listenTransparent listens for connections that are sent to Alpaca by iptables. For the TPROXY
+// target, the socket needs the IP_TRANSPARENT option, which can only be set with CAP_NET_ADMIN;
+// if it can't be set, the listener still works with the REDIRECT target.
+func listenTransparent(address string) (net.Listener, error) {
+	var sockErr error
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+			if network == "tcp6" {
+				level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+			}
+			sockErr = unix.SetsockoptInt(int(fd), level, opt, 1)
+		})
+	}}
+	l, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	} else if sockErr != nil {
+		debugf("transparent", "Only REDIRECT will work on %s (can't set IP_TRANSPARENT: %v)",
+			l.Addr(), sockErr)
+	}
+	return l, nil
+}
+
+// originalDst returns the address that an intercepted connection was really for. For the REDIRECT
+// target, that's recorded by conntrack, and read using SO_ORIGINAL_DST. For the TPROXY target,
+// the connection's local address is the original destination.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := baseConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection: %T", conn)
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local := tc.LocalAddr().(*net.TCPAddr)
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			dst, sockErr = getOriginalDst4(int(fd))
+		} else {
+			dst, sockErr = getOriginalDst6(int(fd))
+		}
+	})
+	if err != nil {
+		return nil, err
+	} else if errors.Is(sockErr, unix.ENOENT) || errors.Is(sockErr, unix.ENOPROTOOPT) {
+		// There's no NAT entry, so either the connection came from TPROXY, or it wasn't
+		// intercepted at all (see transparentProxy.handle).
+		dst = local
+	} else if sockErr != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return dst, nil
+}
+
+func getOriginalDst4(fd int) (*net.TCPAddr, error) {
+	// The result is a struct sockaddr_in, which has the same size as struct ip_mreq.
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(mreq))
+	return &net.TCPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: int(ntohs(sa.Port))}, nil
+}
+
+func getOriginalDst6(fd int) (*net.TCPAddr, error) {
+	// The result is a struct sockaddr_in6, which fits in struct ip6_mtuinfo.
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	sa := info.Addr
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, sa.Addr[:])
+	return &net.TCPAddr{IP: ip, Port: int(ntohs(sa.Port))}, nil
+}
+
+// ntohs converts a port from a sockaddr (which is in network byte order) to a number.
+func ntohs(port uint16) uint16 {
+	var buf [2]byte
+	binary.NativeEndian.PutUint16(buf[:], port)
+	return binary.BigEndian.Uint16(buf[:])
+}
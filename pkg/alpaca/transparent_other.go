@@ -0,0 +1,33 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package alpaca
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+// listenTransparent isn't implemented on this platform, since there's no iptables.
+func listenTransparent(address string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffHostName(t *testing.T) {
+	sniff := func(send func(conn net.Conn)) string {
+		client, server := net.Pipe()
+		defer client.Close()
+		go send(client)
+		defer server.Close()
+		return sniffHostName(server, bufio.NewReaderSize(server, 5+16384))
+	}
+	assert.Equal(t, "www.example.com", sniff(func(conn net.Conn) {
+		_ = tls.Client(conn, &tls.Config{ServerName: "www.example.com"}).Handshake()
+	}))
+	assert.Equal(t, "www.example.com", sniff(func(conn net.Conn) {
+		_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: www.example.com:8080\r\n\r\n")
+	}))
+	assert.Empty(t, sniff(func(conn net.Conn) {
+		_, _ = io.WriteString(conn, "SSH-2.0-OpenSSH_9.6\r\n")
+	}))
+	assert.Empty(t, sniff(func(net.Conn) {}))
+}
+
+func TestTransparentProxy(t *testing.T) {
+	// A fake HTTP proxy, which records the CONNECT request and then echoes data back.
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer httpListener.Close()
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := httpListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		requests <- req
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		_, _ = io.Copy(conn, br)
+	}()
+
+	tp := newTransparentProxy(httpListener.Addr().String())
+	tp.originalDst = func(net.Conn) (*net.TCPAddr, error) {
+		return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}, nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() { _ = tp.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	request := "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	_, err = io.WriteString(conn, request)
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	echoed, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, request, string(echoed))
+	req := <-requests
+	assert.Equal(t, http.MethodConnect, req.Method)
+	assert.Equal(t, "www.example.com:80", req.Host)
+	assert.Equal(t, conn.LocalAddr().String(), req.Header.Get(transparentClientHeader))
+}
+
+func TestTransparentProxyRejectsDirectConnections(t *testing.T) {
+	tp := newTransparentProxy("127.0.0.1:1")
+	tp.originalDst = func(conn net.Conn) (*net.TCPAddr, error) {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() { _ = tp.Serve(l) }()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
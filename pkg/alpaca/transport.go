@@ -12,10 +12,11 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package alpaca
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
@@ -29,27 +30,57 @@ import (
 type transport struct {
 	conn   net.Conn
 	reader *bufio.Reader
+	// dialContext is used to connect to the proxy, if it's set. Otherwise, dialNAT64 is.
+	dialContext dialFunc
+	proxy       *url.URL // The proxy that was last dialled
 }
 
 func (t *transport) dial(proxy *url.URL) error {
 	if err := t.Close(); err != nil {
 		return err
 	}
-	var conn net.Conn
-	var err error
-	if proxy.Scheme == "https" {
-		conn, err = tls.Dial("tcp", proxy.Host, tlsClientConfig)
-	} else {
-		conn, err = net.Dial("tcp", proxy.Host)
+	dial := t.dialContext
+	if dial == nil {
+		dial = dialNAT64
+	}
+	conn, err := dial(context.Background(), "tcp", proxy.Host)
+	if err == nil && proxy.Scheme == "https" {
+		conn, err = tlsHandshake(conn, proxy.Hostname())
 	}
 	if err != nil {
 		return &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
 	}
 	t.conn = conn
 	t.reader = bufio.NewReader(conn)
+	t.proxy = proxy
 	return nil
 }
 
+// redial closes the connection, and connects to the same proxy again.
+func (t *transport) redial() error {
+	if t.proxy == nil {
+		return errors.New("no proxy to connect to")
+	}
+	return t.dial(t.proxy)
+}
+
+// tlsHandshake starts a TLS session on conn, with the server that has the given hostname.
+func tlsHandshake(conn net.Conn, hostname string) (net.Conn, error) {
+	config := &tls.Config{}
+	if tlsClientConfig != nil {
+		config = tlsClientConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = hostname
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
 func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if t.conn == nil {
 		return nil, errors.New("no connection, can't send request")
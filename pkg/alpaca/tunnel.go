@@ -0,0 +1,312 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnel relays data in both directions between a client and a server, e.g. after a CONNECT
+// request has been established.
+type tunnel struct {
+	client, server net.Conn
+	opened         time.Time
+	wg             sync.WaitGroup
+	detached       bool
+	reaped         bool          // Whether the reaper has closed the tunnel for being idle
+	idle           time.Duration // How long the tunnel can be idle for (0 for no limit)
+	lastActive     atomic.Int64  // Unix time (in nanoseconds) when data was last relayed
+	mux            sync.Mutex    // Protects detached and reaped, and setting read deadlines
+}
+
+// tunnelTracker keeps track of all of the tunnels that are currently open, so that they can be
+// handed over to another process (see handoff.go).
+type tunnelTracker struct {
+	tunnels map[*tunnel]struct{}
+	// If non-zero, tunnels are closed when no data has been sent in either direction for
+	// this long.
+	idleTimeout time.Duration
+	// Tunnels to these domains (see parseDomainList) are never closed for being idle, e.g. for
+	// long-lived gRPC streams that can be quiet for a long time.
+	noIdleTimeout []string
+	// If non-zero, how often TCP keep-alives are sent on both sides of each tunnel (rather than
+	// Go's default of every 15 seconds), so that NAT devices and firewalls don't drop them
+	// while they're quiet.
+	keepAlive time.Duration
+	reaping   bool         // Whether the reaper is running (see reap)
+	reaped    atomic.Int64 // The number of tunnels that the reaper has closed
+	mux       sync.Mutex
+}
+
+func newTunnelTracker() *tunnelTracker {
+	return &tunnelTracker{tunnels: make(map[*tunnel]struct{})}
+}
+
+// relay kicks off goroutines to copy data in each direction. Whichever goroutine finishes first
+// will close the Reader for the other goroutine, forcing any blocked copy to unblock. This
+// prevents any goroutine from blocking indefinitely (which will leak a file descriptor).
+func (tt *tunnelTracker) relay(client, server net.Conn) {
+	tt.relayThen(client, server, "", nil, nil)
+}
+
+// relayThen is like relay, but also calls done (unless it's nil) once the tunnel has closed, or
+// been detached. If throttle isn't nil, it's called before sending data to the client, to limit
+// the bandwidth used (see bandwidthLimiter). host is the host that the tunnel goes to.
+func (tt *tunnelTracker) relayThen(client, server net.Conn, host string, done func(),
+	throttle func(n int)) {
+	t := &tunnel{client: client, server: server, opened: time.Now()}
+	t.lastActive.Store(t.opened.UnixNano())
+	tt.mux.Lock()
+	tt.tunnels[t] = struct{}{}
+	if !inDomains(host, tt.noIdleTimeout) {
+		t.idle = tt.idleTimeout
+	}
+	if t.idle > 0 && !tt.reaping {
+		tt.reaping = true
+		go tt.reap(min(t.idle/4, maxReapInterval))
+	}
+	idle := t.idle
+	keepAlive := tt.keepAlive
+	tt.mux.Unlock()
+	if keepAlive > 0 {
+		setKeepAlive(client, keepAlive)
+		setKeepAlive(server, keepAlive)
+	}
+	t.wg.Add(2)
+	go func() {
+		defer t.wg.Done()
+		t.copy(server, client, idle, nil)
+		t.closeUnlessDetached(server)
+	}()
+	go func() {
+		defer t.wg.Done()
+		t.copy(client, server, idle, throttle)
+		t.closeUnlessDetached(client)
+	}()
+	go func() {
+		t.wg.Wait()
+		tt.mux.Lock()
+		delete(tt.tunnels, t)
+		tt.mux.Unlock()
+		if done != nil {
+			done()
+		}
+	}()
+}
+
+// maxReapInterval is the longest that the reaper waits between checks for idle tunnels.
+const maxReapInterval = 10 * time.Second
+
+// reap closes the tunnels that have been idle for longer than their idle timeout, checking every
+// interval. Rather than running all of the time, the reaper stops once there are no tunnels left
+// with an idle timeout, and relayThen starts it again when the next one is opened.
+func (tt *tunnelTracker) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		var idle []*tunnel
+		tt.mux.Lock()
+		reaping := false
+		for t := range tt.tunnels {
+			if t.idle <= 0 {
+				continue
+			}
+			reaping = true
+			if now.Sub(time.Unix(0, t.lastActive.Load())) >= t.idle {
+				idle = append(idle, t)
+			}
+		}
+		tt.reaping = reaping
+		tt.mux.Unlock()
+		for _, t := range idle {
+			if t.closeIdle() {
+				tt.reaped.Add(1)
+			}
+		}
+		if !reaping {
+			return
+		}
+	}
+}
+
+// closeIdle closes both sides of an idle tunnel, unless it's been detached or already closed. It
+// returns whether it closed the tunnel.
+func (t *tunnel) closeIdle() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.detached || t.reaped {
+		return false
+	}
+	t.reaped = true
+	t.client.Close()
+	t.server.Close()
+	return true
+}
+
+// setKeepAlive sets the TCP keep-alive period of conn (see tunnelTracker.keepAlive), if it's a
+// TCP connection, or wraps one (e.g. a TLS connection to an HTTPS proxy).
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			_ = c.SetKeepAlive(true)
+			_ = c.SetKeepAlivePeriod(period)
+			return
+		case bufferedConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return
+		}
+	}
+}
+
+// relayBuffers holds the buffers used to copy data through tunnels, so that each tunnel doesn't
+// need to allocate its own.
+var relayBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 32*1024)
+	return &buf
+}}
+
+// copy copies from src to dst until either side is closed. If idle is non-zero, it also records
+// when data was last copied, so that the reaper can close the tunnel once it's been idle for that
+// long. If throttle isn't nil, it's called with the size of each write before it's made.
+func (t *tunnel) copy(dst, src net.Conn, idle time.Duration, throttle func(n int)) {
+	dstTCP, _ := baseConn(dst).(*net.TCPConn)
+	srcTCP, _ := baseConn(src).(*net.TCPConn)
+	if idle <= 0 && throttle == nil && dstTCP != nil && srcTCP != nil {
+		// Between two TCP connections, io.Copy uses splice(2) on Linux, so the data doesn't
+		// need to be copied into (or out of) user space at all.
+		_, _ = io.Copy(dstTCP, srcTCP)
+		return
+	}
+	bufp := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(bufp)
+	buf := *bufp
+	var w io.Writer = dst
+	if throttle != nil {
+		w = throttledConn{dst, throttle}
+	}
+	if idle <= 0 {
+		// Hide any ReaderFrom or WriterTo methods, which would allocate their own buffer
+		// rather than using ours.
+		_, _ = io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{src}, buf)
+		return
+	}
+	for {
+		t.mux.Lock()
+		detached := t.detached
+		t.mux.Unlock()
+		if detached {
+			return
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.lastActive.Store(time.Now().UnixNano())
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue // Unblocked by detach
+		} else if err != nil {
+			return
+		}
+	}
+}
+
+// throttledConn calls throttle before each write to a connection.
+type throttledConn struct {
+	net.Conn
+	throttle func(n int)
+}
+
+func (c throttledConn) Write(p []byte) (int, error) {
+	c.throttle(len(p))
+	return c.Conn.Write(p)
+}
+
+func (t *tunnel) closeUnlessDetached(conn net.Conn) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if !t.detached {
+		conn.Close()
+	}
+}
+
+// detach stops relaying data, and returns duplicates of the client and server file descriptors.
+// The tunnel's own connections are closed, so the caller takes ownership of the tunnel. If the
+// tunnel can't be detached (e.g. because it was already closing, or because one of the
+// connections isn't backed by a file descriptor), the tunnel is closed and an error returned.
+func (t *tunnel) detach() (client, server *os.File, err error) {
+	t.mux.Lock()
+	t.detached = true
+	// Setting a deadline in the past unblocks any pending reads without losing any data.
+	_ = t.client.SetReadDeadline(time.Now())
+	_ = t.server.SetReadDeadline(time.Now())
+	t.mux.Unlock()
+	t.wg.Wait()
+	defer t.client.Close()
+	defer t.server.Close()
+	if client, err = connFile(t.client); err != nil {
+		return nil, nil, err
+	}
+	if server, err = connFile(t.server); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+func connFile(conn net.Conn) (*os.File, error) {
+	filer, ok := baseConn(conn).(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, &net.OpError{Op: "file", Net: "tcp", Err: os.ErrInvalid}
+	}
+	return filer.File()
+}
+
+// list returns all of the tunnels that are currently open.
+func (tt *tunnelTracker) list() []*tunnel {
+	tt.mux.Lock()
+	defer tt.mux.Unlock()
+	tunnels := make([]*tunnel, 0, len(tt.tunnels))
+	for t := range tt.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// count returns the number of tunnels that are currently open.
+func (tt *tunnelTracker) count() int {
+	tt.mux.Lock()
+	defer tt.mux.Unlock()
+	return len(tt.tunnels)
+}
+
+// wait blocks until all tunnels are closed, or the timeout expires.
+func (tt *tunnelTracker) wait(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for tt.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelTrackerRemovesClosedTunnels(t *testing.T) {
+	client, clientSide := net.Pipe()
+	serverSide, server := net.Pipe()
+	tt := newTunnelTracker()
+	tt.relay(clientSide, serverSide)
+	assert.Equal(t, 1, tt.count())
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+	client.Close()
+	tt.wait(time.Second)
+	assert.Equal(t, 0, tt.count())
+}
+
+func TestDetachPipeFails(t *testing.T) {
+	// A net.Pipe isn't backed by a file descriptor, so it can't be detached; the tunnel gets
+	// closed instead.
+	client, clientSide := net.Pipe()
+	serverSide, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tt := newTunnelTracker()
+	tt.relay(clientSide, serverSide)
+	tunnels := tt.list()
+	require.Len(t, tunnels, 1)
+	_, _, err := tunnels[0].detach()
+	assert.Error(t, err)
+	_, err = client.Write([]byte("x"))
+	assert.Error(t, err)
+}
+
+func TestIdleTunnelIsClosed(t *testing.T) {
+	client, clientSide := net.Pipe()
+	serverSide, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tt := newTunnelTracker()
+	tt.idleTimeout = 50 * time.Millisecond
+	tt.relay(clientSide, serverSide)
+	_, err := client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	tt.wait(time.Second)
+	assert.Equal(t, 0, tt.count())
+	assert.Equal(t, int64(1), tt.reaped.Load())
+	// With no tunnels left, the reaper stops.
+	require.Eventually(t, func() bool {
+		tt.mux.Lock()
+		defer tt.mux.Unlock()
+		return !tt.reaping
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTunnelWithNoIdleTimeout(t *testing.T) {
+	client, clientSide := net.Pipe()
+	serverSide, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tt := newTunnelTracker()
+	tt.idleTimeout = 50 * time.Millisecond
+	tt.noIdleTimeout = parseDomainList("example.com")
+	tt.relayThen(clientSide, serverSide, "grpc.example.com", nil, nil)
+	time.Sleep(150 * time.Millisecond)
+	go func() { _, _ = server.Write([]byte("x")) }()
+	buf := make([]byte, 1)
+	_, err := client.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(buf))
+	assert.Equal(t, 1, tt.count())
+}
+
+func TestTunnelWithTrafficInOneDirectionIsNotIdle(t *testing.T) {
+	client, clientSide := net.Pipe()
+	serverSide, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tt := newTunnelTracker()
+	tt.idleTimeout = 100 * time.Millisecond
+	tt.relay(clientSide, serverSide)
+	go func() {
+		for i := 0; i < 10; i++ {
+			if _, err := server.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+	}()
+	// The client never sends anything, but the tunnel should stay open while the server does.
+	buf := make([]byte, 10)
+	_, err := io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "xxxxxxxxxx", string(buf))
+	assert.Equal(t, 1, tt.count())
+}
+
+// tcpPair returns both ends of a TCP connection on the loopback interface.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	dialled, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	conn, ok := <-accepted
+	require.True(t, ok)
+	return dialled, conn
+}
+
+func TestRelayBetweenTCPConns(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	serverSide, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	tt := newTunnelTracker()
+	tt.relay(clientSide, serverSide)
+	data := bytes.Repeat([]byte("alpaca"), 1<<18)
+	go func() {
+		_, _ = client.Write(data)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	received, err := io.ReadAll(server)
+	require.NoError(t, err)
+	assert.Equal(t, data, received)
+}
+
+func BenchmarkRelay(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		pair func(testing.TB) (net.Conn, net.Conn)
+	}{
+		{"TCP", tcpPair},
+		{"Pipe", func(testing.TB) (net.Conn, net.Conn) { return net.Pipe() }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			client, clientSide := bench.pair(b)
+			serverSide, server := bench.pair(b)
+			defer client.Close()
+			defer server.Close()
+			tt := newTunnelTracker()
+			tt.relay(clientSide, serverSide)
+			go func() { _, _ = io.Copy(io.Discard, server) }()
+			buf := make([]byte, 64*1024)
+			b.SetBytes(int64(len(buf)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// durationValue is a flag.Value for a duration, e.g. "30s" or "1h30m". It's like the flags
+// created by flag.Duration, but rejects negative durations, and gives a more helpful error for a
+// number without a unit (which is easy to write in a config file or environment variable).
+type durationValue time.Duration
+
+func durationFlag(name string, value time.Duration, usage string) *time.Duration {
+	p := new(time.Duration)
+	*p = value
+	flag.Var((*durationValue)(p), name, usage)
+	return p
+}
+
+func (d *durationValue) Set(s string) error {
+	v, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(v)
+	return nil
+}
+
+func (d *durationValue) String() string {
+	return time.Duration(*d).String()
+}
+
+// parseDuration parses a non-negative duration, such as "30s" or "1h30m".
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return 0, fmt.Errorf("missing unit in duration %q (e.g. \"%ss\" or \"%sm\")", s, s, s)
+		}
+		return 0, fmt.Errorf("invalid duration %q (expected e.g. \"30s\", \"5m\" or \"1h30m\")",
+			s)
+	} else if d < 0 {
+		return 0, fmt.Errorf("invalid duration %q (can't be negative)", s)
+	}
+	return d, nil
+}
+
+// sizeValue is a flag.Value for a number of bytes, which can be given with a unit, e.g. "512KB"
+// or "1.5GB". Units are powers of 1024, so "KB" and "KiB" mean the same thing.
+type sizeValue int64
+
+func sizeFlag(name string, value int64, usage string) *int64 {
+	p := new(int64)
+	*p = value
+	flag.Var((*sizeValue)(p), name, usage)
+	return p
+}
+
+func (s *sizeValue) Set(str string) error {
+	v, err := parseSize(str)
+	if err != nil {
+		return err
+	}
+	*s = sizeValue(v)
+	return nil
+}
+
+func (s *sizeValue) String() string {
+	return formatSize(int64(*s))
+}
+
+var sizeUnits = []struct {
+	names []string
+	bytes int64
+}{
+	{[]string{"TB", "TIB", "T"}, 1 << 40},
+	{[]string{"GB", "GIB", "G"}, 1 << 30},
+	{[]string{"MB", "MIB", "M"}, 1 << 20},
+	{[]string{"KB", "KIB", "K"}, 1 << 10},
+	{[]string{"B", ""}, 1},
+}
+
+// parseSize parses a non-negative number of bytes, such as "1048576", "512KB" or "1.5GB".
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err == nil {
+		for _, u := range sizeUnits {
+			for _, name := range u.names {
+				if unit == name && n*float64(u.bytes) < math.MaxInt64 {
+					return int64(n * float64(u.bytes)), nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("invalid size %q (expected a number of bytes, optionally with a unit, "+
+		"e.g. \"512KB\", \"10MB\" or \"2GB\")", s)
+}
+
+// formatSize formats a number of bytes using the largest unit that it's a whole number of.
+func formatSize(n int64) string {
+	for _, u := range sizeUnits {
+		if n != 0 && n%u.bytes == 0 {
+			return strconv.FormatInt(n/u.bytes, 10) + u.names[0]
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"0", 0},
+		{"1048576", 1 << 20},
+		{"512B", 512},
+		{"512KB", 512 << 10},
+		{"10mb", 10 << 20},
+		{"10 MiB", 10 << 20},
+		{"1.5GB", 3 << 29},
+		{"2T", 2 << 40},
+	}
+	for _, test := range tests {
+		n, err := parseSize(test.input)
+		require.NoError(t, err, test.input)
+		assert.Equal(t, test.expected, n, test.input)
+	}
+	for _, input := range []string{"", "-1", "10 megabytes", "MB", "1.2.3", "1e3", "9999999TB"} {
+		_, err := parseSize(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0", formatSize(0))
+	assert.Equal(t, "1000B", formatSize(1000))
+	assert.Equal(t, "8MB", formatSize(8<<20))
+	assert.Equal(t, "1536MB", formatSize(3<<29))
+	assert.Equal(t, "10GB", formatSize(10<<30))
+}
+
+func TestParseDuration(t *testing.T) {
+	d, err := parseDuration(" 1h30m ")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Minute, d)
+	_, err = parseDuration("30")
+	assert.EqualError(t, err, `missing unit in duration "30" (e.g. "30s" or "30m")`)
+	_, err = parseDuration("-5s")
+	assert.EqualError(t, err, `invalid duration "-5s" (can't be negative)`)
+	_, err = parseDuration("soon")
+	assert.Error(t, err)
+}
+
+func TestUnitFlagsFromConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	var size, rate int64
+	var timeout time.Duration
+	fs.Var((*sizeValue)(&size), "blob-cache-size", "")
+	fs.Var((*sizeValue)(&rate), "bandwidth-limit", "")
+	fs.Var((*durationValue)(&timeout), "pac-timeout", "")
+	fs.String("config", "", "")
+	path := writeConfigFile(t, `{
+		"blob-cache-size": 10000000000,
+		"bandwidth-limit": "1MB",
+		"pac-timeout": "10s"
+	}`)
+	require.NoError(t, fs.Parse([]string{"-config", path}))
+	require.NoError(t, loadConfig(fs, noEnv))
+	assert.Equal(t, int64(10000000000), size)
+	assert.Equal(t, int64(1<<20), rate)
+	assert.Equal(t, 10*time.Second, timeout)
+
+	fs = flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	fs.Var((*durationValue)(&timeout), "pac-timeout", "")
+	fs.String("config", "", "")
+	require.NoError(t, fs.Parse([]string{"-config", writeConfigFile(t, `{"pac-timeout": 10}`)}))
+	err := loadConfig(fs, noEnv)
+	assert.ErrorContains(t, err, `missing unit in duration "10"`)
+}
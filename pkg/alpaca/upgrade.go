@@ -0,0 +1,163 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// upgradeType returns the protocol that a request asks to switch to (e.g. "websocket"), or "" if
+// it isn't asking to switch protocols (see RFC 9110, section 7.8).
+func upgradeType(header http.Header) string {
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// proxyUpgrade forwards a request to switch protocols, such as the handshake for a ws:// URL.
+// Like browsers do for WebSockets, it connects to the server through a CONNECT tunnel if there's
+// an upstream proxy, since most proxies don't support upgrading ordinary requests. If the server
+// agrees to switch protocols, the client and server connections are relayed like a tunnel.
+func (ph ProxyHandler) proxyUpgrade(w http.ResponseWriter, req *http.Request, upgrade string) {
+	id := req.Context().Value(contextKeyID)
+	proxy, err := ph.transport.Proxy(req)
+	if err != nil {
+		log.Printf("[%d] Error finding proxy for request: %v", id, err)
+	}
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	connect := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Via": req.Header.Values("Via")},
+	}).WithContext(req.Context())
+	var server net.Conn
+	if proxy == nil {
+		server, err = ph.connectDirect(connect, 0)
+	} else {
+		server, err = ph.connectViaProxy(connect, proxy)
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Op == "proxyconnect" {
+			err = ph.blockProxy(req, proxy, err)
+		}
+	}
+	if errors.Is(err, ErrProxyLoop) {
+		writeProxyError(w, req, http.StatusLoopDetected, stageConnect, proxy, err)
+		return
+	} else if err != nil {
+		writeProxyError(w, req, http.StatusBadGateway, stageConnect, proxy, err)
+		return
+	}
+	closeInDefer := true
+	defer func() {
+		if closeInDefer {
+			server.Close()
+		}
+	}()
+	if req.URL.Scheme == "https" {
+		server = tls.Client(server, &tls.Config{ServerName: req.URL.Hostname()})
+	}
+	// Send the request in origin-form, since it's going straight to the server.
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", upgrade)
+	if err := req.Write(server); err != nil {
+		log.Printf("[%d] Error writing upgrade request: %v", id, err)
+		writeProxyError(w, req, http.StatusBadGateway, stageRequest, proxy, err)
+		return
+	}
+	br := bufio.NewReader(server)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		log.Printf("[%d] Error reading upgrade response: %v", id, err)
+		writeProxyError(w, req, http.StatusBadGateway, stageRequest, proxy, err)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The server didn't switch protocols, so this is just an ordinary response.
+		defer resp.Body.Close()
+		copyResponseHeaders(w, resp)
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			log.Printf("[%d] Error copying response body: %v", id, err)
+		}
+		return
+	}
+	client, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("[%d] Error hijacking connection: %v", id, err)
+		writeProxyError(w, req, http.StatusInternalServerError, stageRequest, proxy, err)
+		return
+	}
+	// Write the response directly to the client connection, since the ResponseWriter has been
+	// hijacked. The Connection and Upgrade headers are hop-by-hop, but they're what tells the
+	// client that the protocol has been switched, so they're passed on.
+	header := resp.Header.Clone()
+	deleteConnectionTokens(header)
+	for _, name := range []string{"Keep-Alive", "Proxy-Authenticate", "Trailer",
+		"Transfer-Encoding"} {
+		header.Del(name)
+	}
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", resp.Header.Get("Upgrade"))
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+	_ = header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := client.Write(head.Bytes()); err != nil {
+		log.Printf("[%d] Error writing response: %v", id, err)
+		client.Close()
+		return
+	}
+	closeInDefer = false
+	// The server may have sent data straight after its response, which is now in br.
+	s := startSpan(req.Context(), "tunnel", spanKindInternal)
+	ph.tunnels.relayThen(client, bufferedConn{server, br}, req.URL.Hostname(),
+		s.endThen(claimConnSlot(req)), throttleForRequest(req))
+}
+
+// bufferedConn is a connection that has had some data read into a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoUpgradeHandler switches to an "echo" protocol, which sends a greeting and then echoes
+// everything back to the client.
+func echoUpgradeHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if upgradeType(req.Header) != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Connection: Upgrade\r\nUpgrade: echo\r\n\r\nhello")
+		_, _ = io.Copy(conn, brw)
+	})
+}
+
+// upgradeVia sends a request to switch to the "echo" protocol through the proxy, and returns the
+// response along with a reader for the rest of the connection.
+func upgradeVia(t *testing.T, proxy, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxy)
+	require.NoError(t, err)
+	fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n"+
+		"Connection: keep-alive, Upgrade\r\nUpgrade: echo\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	return conn, br, resp
+}
+
+func testUpgrade(t *testing.T, proxy http.Handler) {
+	server := httptest.NewServer(echoUpgradeHandler(t))
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	conn, br, resp := upgradeVia(t, proxyServer.Listener.Addr().String(),
+		server.Listener.Addr().String())
+	defer conn.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "Upgrade", resp.Header.Get("Connection"))
+	assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	_, err = conn.Write([]byte("ping!"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping!", string(buf))
+}
+
+func TestUpgradeDirect(t *testing.T) {
+	testUpgrade(t, newDirectProxy())
+}
+
+func TestUpgradeViaProxy(t *testing.T) {
+	parent := httptest.NewServer(newDirectProxy())
+	defer parent.Close()
+	testUpgrade(t, newChildProxy(parent))
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Upgrade", "echo")
+		w.WriteHeader(http.StatusUpgradeRequired)
+	}))
+	defer server.Close()
+	proxy := httptest.NewServer(newDirectProxy())
+	defer proxy.Close()
+	conn, _, resp := upgradeVia(t, proxy.Listener.Addr().String(),
+		server.Listener.Addr().String())
+	defer conn.Close()
+	assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Upgrade"))
+}
+
+func TestUpgradeType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"None", http.Header{}, ""},
+		{"WebSocket", http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+			"websocket"},
+		{"TokenList", http.Header{"Connection": {"keep-alive, upgrade"},
+			"Upgrade": {"websocket"}}, "websocket"},
+		{"NoConnectionToken", http.Header{"Upgrade": {"websocket"}}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, upgradeType(test.header))
+		})
+	}
+}
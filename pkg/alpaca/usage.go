@@ -0,0 +1,252 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often usage statistics are sent.
+const usageStatsInterval = 24 * time.Hour
+
+// usageReport is everything that's sent when usage statistics are enabled. There's deliberately
+// nothing in it that identifies the user, the machine, or the hosts that they visit.
+type usageReport struct {
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	// Whether each flag was set (but never its value). Each of these is randomized (see
+	// randomizedResponse), so that no report says for certain which flags were used.
+	Features map[string]bool `json:"features"`
+	// The number of requests handled since the last report, rounded down to a power of 10.
+	Requests int64 `json:"requests"`
+}
+
+// usageStats sends anonymous usage statistics to the endpoint given by -usage-stats, which helps
+// the maintainers to decide what to work on. This only happens if the user has opted in, and
+// -usage-stats-preview shows exactly what would be sent.
+type usageStats struct {
+	endpoint string
+	flags    *flag.FlagSet
+	requests atomic.Int64
+	random   func() float64
+	// The reports are sent using the proxy given by the environment (HTTPS_PROXY and so on,
+	// see http.ProxyFromEnvironment), like other HTTP clients, rather than the PAC file.
+	client *http.Client
+	// The file that the randomized responses are saved in, so that they're the same every
+	// time (see randomizedResponse). If it's empty, they're only kept in memory.
+	path      string
+	mux       sync.Mutex
+	responses map[string]bool // Keyed by the flag name and whether it's set, e.g. "C=true"
+}
+
+func newUsageStats(endpoint string, flags *flag.FlagSet) *usageStats {
+	return &usageStats{
+		endpoint: endpoint,
+		flags:    flags,
+		random:   rand.Float64,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		path:     defaultUsageStatsPath(),
+	}
+}
+
+// defaultUsageStatsPath returns the file that the randomized responses are saved in, in the
+// user's config directory, or the empty string if there isn't one.
+func defaultUsageStatsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "alpaca", "usage-stats.json")
+}
+
+// WrapHandler counts the requests handled.
+func (us *usageStats) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		us.requests.Add(1)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// randomizedResponse reports the truth half of the time, and the result of a coin toss the rest
+// of the time. The report is deniable, but the true proportion p of users with a feature can
+// still be worked out from the proportion q of reports that say so, as p = 2q - 1/2. The response
+// is only drawn once for each feature and value, and then saved and reused in every later report,
+// since otherwise the truth could be worked out by averaging many reports. This gives
+// ln(3)-differential privacy for each feature, however many reports are sent. The caller must
+// hold the lock.
+func (us *usageStats) randomizedResponse(feature string, value bool) bool {
+	key := feature + "=" + strconv.FormatBool(value)
+	if response, ok := us.responses[key]; ok {
+		return response
+	}
+	response := value
+	if us.random() >= 0.5 {
+		response = us.random() < 0.5
+	}
+	us.responses[key] = response
+	return response
+}
+
+// loadResponses reads the saved randomized responses, if there are any. The caller must hold the
+// lock.
+func (us *usageStats) loadResponses() {
+	if us.responses != nil {
+		return
+	}
+	us.responses = make(map[string]bool)
+	if us.path == "" {
+		return
+	}
+	buf, err := os.ReadFile(us.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		log.Printf("Error reading usage statistics: %v", err)
+		return
+	}
+	if err := json.Unmarshal(buf, &us.responses); err != nil {
+		log.Printf("Error reading usage statistics from %s: %v", us.path, err)
+		us.responses = make(map[string]bool)
+	}
+}
+
+// saveResponses writes the randomized responses to the file that they're loaded from. The caller
+// must hold the lock.
+func (us *usageStats) saveResponses() {
+	if us.path == "" {
+		return
+	}
+	buf, err := json.Marshal(us.responses)
+	if err != nil {
+		log.Printf("Error saving usage statistics: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(us.path), 0700); err != nil {
+		log.Printf("Error saving usage statistics: %v", err)
+	} else if err := os.WriteFile(us.path, buf, 0600); err != nil {
+		log.Printf("Error saving usage statistics: %v", err)
+	}
+}
+
+// roundDown rounds n down to a power of 10 (or 0).
+func roundDown(n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	rounded := int64(1)
+	for rounded*10 <= n {
+		rounded *= 10
+	}
+	return rounded
+}
+
+// report returns the next report to send, and starts counting requests from zero again.
+func (us *usageStats) report() usageReport {
+	set := make(map[string]bool)
+	us.flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	features := make(map[string]bool)
+	us.mux.Lock()
+	us.loadResponses()
+	saved := len(us.responses)
+	us.flags.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, "usage-stats") {
+			features[f.Name] = us.randomizedResponse(f.Name, set[f.Name])
+		}
+	})
+	if len(us.responses) != saved {
+		us.saveResponses()
+	}
+	us.mux.Unlock()
+	return usageReport{
+		Version:  BuildVersion,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Features: features,
+		Requests: roundDown(us.requests.Swap(0)),
+	}
+}
+
+// preview writes an example report to w, along with an explanation of what it contains.
+func (us *usageStats) preview(w io.Writer) error {
+	buf, err := json.MarshalIndent(us.report(), "", "  ")
+	if err != nil {
+		return err
+	}
+	var features []string
+	us.flags.Visit(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, "usage-stats") {
+			features = append(features, f.Name)
+		}
+	})
+	sort.Strings(features)
+	fmt.Fprintf(w, "With -usage-stats, a report like this would be sent every %v:\n\n%s\n\n",
+		usageStatsInterval, buf)
+	fmt.Fprintf(w, "The flags that are actually set are: %s\n", strings.Join(features, ", "))
+	fmt.Fprintln(w, "Each feature is reported truthfully half of the time, and at random the "+
+		"rest of the time, so the report doesn't say for certain which flags are set. "+
+		"Which is chosen is saved, so later reports say the same thing (unless the flags "+
+		"change).")
+	return nil
+}
+
+func (us *usageStats) send() error {
+	buf, err := json.Marshal(us.report())
+	if err != nil {
+		return err
+	}
+	resp, err := us.client.Post(us.endpoint, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// run sends a report every usageStatsInterval, until stop is closed.
+func (us *usageStats) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(usageStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := us.send(); err != nil {
+			log.Printf("Error sending usage statistics: %v", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpaca
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestUsageStats(t *testing.T, endpoint string, args ...string) *usageStats {
+	fs := flag.NewFlagSet("alpaca", flag.ContinueOnError)
+	fs.String("C", "", "")
+	fs.Bool("local-direct", false, "")
+	fs.String("usage-stats", "", "")
+	require.NoError(t, fs.Parse(args))
+	us := newUsageStats(endpoint, fs)
+	us.path = filepath.Join(t.TempDir(), "usage-stats.json")
+	// Always tell the truth, so that the reports are predictable.
+	us.random = func() float64 { return 0 }
+	return us
+}
+
+func TestRoundDown(t *testing.T) {
+	for n, want := range map[int64]int64{0: 0, 1: 1, 9: 1, 10: 10, 99: 10, 12345: 10000} {
+		assert.Equal(t, want, roundDown(n), "roundDown(%d)", n)
+	}
+}
+
+func TestUsageReport(t *testing.T) {
+	us := newTestUsageStats(t, "", "-C", "http://internal.test/proxy.pac", "-usage-stats",
+		"http://stats.test")
+	handler := us.WrapHandler(http.NotFoundHandler())
+	for i := 0; i < 42; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	report := us.report()
+	assert.Equal(t, runtime.GOOS, report.OS)
+	assert.Equal(t, map[string]bool{"C": true, "local-direct": false}, report.Features)
+	assert.Equal(t, int64(10), report.Requests)
+	// Requests are counted from zero again after each report.
+	assert.Zero(t, us.report().Requests)
+	// Flag values are never included.
+	buf, err := json.Marshal(report)
+	require.NoError(t, err)
+	assert.NotContains(t, string(buf), "internal.test")
+}
+
+func TestUsageReportRandomized(t *testing.T) {
+	us := newTestUsageStats(t, "", "-C", "http://internal.test/proxy.pac")
+	// Ignore the truth, and then toss a coin that comes up tails.
+	random := []float64{0.9, 0.9, 0.9, 0.1}
+	us.random = func() float64 {
+		r := random[0]
+		random = random[1:]
+		return r
+	}
+	assert.Equal(t, map[string]bool{"C": false, "local-direct": true}, us.report().Features)
+	// The responses are only drawn once, so later reports (even after a restart) don't give
+	// away any more than the first one.
+	us.random = func() float64 { panic("drew another response") }
+	assert.Equal(t, map[string]bool{"C": false, "local-direct": true}, us.report().Features)
+	restarted := newTestUsageStats(t, "", "-C", "http://internal.test/proxy.pac")
+	restarted.path = us.path
+	restarted.random = us.random
+	assert.Equal(t, map[string]bool{"C": false, "local-direct": true},
+		restarted.report().Features)
+	// Flags that have changed get responses of their own (here, the truth), which are saved too.
+	changed := newTestUsageStats(t, "", "-local-direct")
+	changed.path = us.path
+	assert.Equal(t, map[string]bool{"C": false, "local-direct": true}, changed.report().Features)
+	buf, err := os.ReadFile(us.path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"C=true": false, "C=false": false, "local-direct=false": true,
+		"local-direct=true": true}`, string(buf))
+}
+
+func TestUsagePreview(t *testing.T) {
+	us := newTestUsageStats(t, "", "-local-direct")
+	var buf strings.Builder
+	require.NoError(t, us.preview(&buf))
+	assert.Contains(t, buf.String(), `"local-direct": true`)
+	assert.Contains(t, buf.String(), "The flags that are actually set are: local-direct\n")
+}
+
+func TestUsageSend(t *testing.T) {
+	var got usageReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPost, req.Method)
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&got))
+	}))
+	defer server.Close()
+	us := newTestUsageStats(t, server.URL, "-local-direct")
+	require.NoError(t, us.send())
+	assert.Equal(t, map[string]bool{"C": false, "local-direct": true}, got.Features)
+}